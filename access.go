@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+)
+
+// restrictLogin is the node restriction to require an authenticated user.
+const restrictLogin = "login"
+
+// restrictUnreadable is the restriction of nodes whose node.yaml could not
+// be read or parsed. Only admins might view them, e.g. to repair them.
+const restrictUnreadable = roleAdmin
+
+// unrestrictedActions might be performed on nodes the user might not view.
+var unrestrictedActions = map[string]bool{
+	"login":          true,
+	"logout":         true,
+	"reset-password": true,
+	"set-locale":     true}
+
+// nodeRestriction holds the access restriction of a node as stored in its
+// node.yaml file.
+type nodeRestriction struct {
+	// Restrict is either "login" or the name of the role required to view
+	// the node and its descendants.
+	Restrict string
+}
+
+// nodeAccess checks the access restrictions of nodes for some user.
+//
+// Restrictions are cached, so a nodeAccess should only be used while
+// processing a single request.
+type nodeAccess struct {
+	// Root is the path to the data directory.
+	Root string
+	// Roles of the user. nil for anonymous users.
+	Roles []string
+	// Log logs unreadable restrictions. May be nil.
+	Log func(format string, v ...interface{})
+	// cache maps node paths to their own (not inherited) restriction.
+	cache map[string]string
+}
+
+// newNodeAccess returns a nodeAccess for a user with the given roles.
+func newNodeAccess(root string, roles []string) *nodeAccess {
+	return &nodeAccess{Root: root, Roles: roles, cache: make(map[string]string)}
+}
+
+// ownRestriction returns the restriction specified by the node at the given
+// path, not taking its ancestors into account.
+//
+// Directories without node.yaml are not restricted. Nodes whose node.yaml
+// could not be read or parsed get restrictUnreadable, so that a broken file
+// doesn't make a restricted node public.
+func (a *nodeAccess) ownRestriction(nodePath string) string {
+	if restriction, ok := a.cache[nodePath]; ok {
+		return restriction
+	}
+	if _, err := nodeFile(a.Root, nodePath, "node.yaml"); err != nil {
+		return ""
+	}
+	var restriction nodeRestriction
+	content, err := getNodeFile(a.Root, nodePath, "node.yaml")
+	if err == nil {
+		err = goyaml.Unmarshal(content, &restriction)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		if a.Log != nil {
+			a.Log("Could not read restriction of node %q: %v", nodePath, err)
+		}
+		restriction.Restrict = restrictUnreadable
+	}
+	a.cache[nodePath] = restriction.Restrict
+	return restriction.Restrict
+}
+
+// restrictions returns the restrictions of the node at the given path and
+// of all its ancestors.
+func (a *nodeAccess) restrictions(nodePath string) []string {
+	var ret []string
+	nodePath = path.Clean("/" + nodePath)
+	for {
+		if restriction := a.ownRestriction(nodePath); len(restriction) > 0 {
+			ret = append(ret, restriction)
+		}
+		if nodePath == "/" {
+			break
+		}
+		nodePath = path.Dir(nodePath)
+	}
+	return ret
+}
+
+// CanView returns true iff the user might view the node at the given path.
+//
+// A nil nodeAccess grants access to any node.
+func (a *nodeAccess) CanView(nodePath string) bool {
+	if a == nil {
+		return true
+	}
+	for _, restriction := range a.restrictions(nodePath) {
+		required := restriction
+		if restriction == restrictLogin {
+			required = roleReader
+		}
+		if !hasRole(a.Roles, required) {
+			return false
+		}
+	}
+	return true
+}
+
+// contextKey is the type of the keys used to store values in the request
+// context.
+type contextKey int
+
+const (
+	// nodeAccessKey is the context key of the request's nodeAccess.
+	nodeAccessKey contextKey = iota
+	// accessUserKey is the context key of the login of the authenticated
+	// user to be written to the access log.
+	accessUserKey
+	// editLockKey is the context key of the edit lock held by another user
+	// on the requested node.
+	editLockKey
+	// nodeLocaleKey is the context key of the locale of the served
+	// translation of the requested node.
+	nodeLocaleKey
+	// requestIDKey is the context key of the request's ID.
+	requestIDKey
+	// traceSpanKey is the context key of the span of traced requests.
+	traceSpanKey
+	// requestTimerKey is the context key of the timer of timed requests.
+	requestTimerKey
+	// debugInfoKey is the context key of the debug information shown in
+	// the debug toolbar.
+	debugInfoKey
+	// tokenAuthKey is the context key set to true if the request has been
+	// authenticated by an API token and its session cookie got discarded.
+	tokenAuthKey
+)
+
+// requestNodeAccess returns the nodeAccess of the given request or nil if
+// there is none.
+func requestNodeAccess(r *http.Request) *nodeAccess {
+	if access, ok := context.Get(r, nodeAccessKey).(*nodeAccess); ok {
+		return access
+	}
+	return nil
+}
+
+// privilegedAction returns true if the given action requires more than the
+// reader role on the given site and is not one of the site's public
+// actions.
+func privilegedAction(action string, site site) bool {
+	switch requiredRole(action, site.Permissions) {
+	case roleAnonymous, roleReader:
+		return false
+	}
+	return !inStringSlice(action, site.PublicActions)
+}
+
+// privilegedRoles returns true if the given roles include any role besides
+// the reader role, i.e. one which might be permitted privileged actions.
+func privilegedRoles(roles []string) bool {
+	for _, role := range roles {
+		if role != roleReader && role != roleAnonymous {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAllowed returns true if privileged actions and changes of content
+// are allowed from the given client IP address.
+func (s site) adminAllowed(ip string) bool {
+	return len(s.AdminAllow) == 0 || s.AdminAllow.Contains(ip)
+}
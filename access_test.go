@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"testing"
+)
+
+func TestNodeAccessCanView(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":                   "title: Root",
+		"/foo/node.yaml":               "title: Foo",
+		"/members/node.yaml":           "title: Members\nrestrict: login",
+		"/members/child/node.yaml":     "title: Child",
+		"/members/staff/node.yaml":     "title: Staff\nrestrict: editor",
+		"/members/staff/sub/node.yaml": "title: Staff Sub",
+		"/admins/node.yaml":            "title: Admins\nrestrict: admin",
+		"/custom/node.yaml":            "title: Custom\nrestrict: club",
+		"/broken/node.yaml":            "title: [Broken\nrestrict: login",
+		"/broken/child/node.yaml":      "title: Child"},
+		"TestNodeAccessCanView")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path  string
+		Roles []string
+		View  bool
+	}{
+		{"/", nil, true},
+		{"/foo", nil, true},
+		{"/members", nil, false},
+		{"/members", []string{"reader"}, true},
+		{"/members/child", nil, false},
+		{"/members/child", []string{"reader"}, true},
+		{"/members/staff/sub", []string{"reader"}, false},
+		{"/members/staff/sub", []string{"reader", "editor"}, true},
+		{"/admins", []string{"reader", "editor"}, false},
+		{"/admins", []string{"admin"}, true},
+		{"/custom", []string{"reader"}, false},
+		{"/custom", []string{"reader", "club"}, true},
+		{"/broken", nil, false},
+		{"/broken/child", []string{"reader", "editor"}, false},
+		{"/broken/child", []string{"admin"}, true},
+		{"/unknown/path", nil, true}}
+	for _, test := range tests {
+		access := newNodeAccess(root, test.Roles)
+		if ret := access.CanView(test.Path); ret != test.View {
+			t.Errorf("CanView(%q) for roles %v = %v, should be %v", test.Path,
+				test.Roles, ret, test.View)
+		}
+	}
+	var access *nodeAccess
+	if !access.CanView("/members") {
+		t.Errorf("CanView on nil nodeAccess should grant access")
+	}
+}
+
+func TestWriteNodeRestricted(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/members/node.yaml": `{"title": "Members", "restrict": "login"}`},
+		"TestWriteNodeRestricted")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := writeNode(client.Node{Path: "/members", Type: "Document",
+		Title: "Changed"}, "", root); err != nil {
+		t.Fatalf("writeNode(...) returned error: %v", err)
+	}
+	if newNodeAccess(root, nil).CanView("/members") {
+		t.Errorf("Writing a node should keep its restriction")
+	}
+}
+
+func TestPrivilegedAction(t *testing.T) {
+	site_ := site{Permissions: map[string]string{"comment": roleReader},
+		PublicActions: []string{"users"}}
+	tests := []struct {
+		Action     string
+		Privileged bool
+	}{
+		{"", false},
+		{"login", false},
+		{"logout", false},
+		{"comment", false},
+		{"users", false},
+		{"edit", true},
+		{"add", true},
+		{"remove", true},
+		{"users/edit", true},
+		{"custom", true}}
+	for _, v := range tests {
+		if ret := privilegedAction(v.Action, site_); ret != v.Privileged {
+			t.Errorf("privilegedAction(%q, _) = %v, should be %v", v.Action, ret,
+				v.Privileged)
+		}
+	}
+}
+
+func TestPrivilegedRoles(t *testing.T) {
+	tests := []struct {
+		Roles      []string
+		Privileged bool
+	}{
+		{nil, false},
+		{[]string{roleReader}, false},
+		{[]string{roleReader, roleEditor}, true},
+		{[]string{roleAdmin}, true},
+		{[]string{"moderator"}, true}}
+	for _, v := range tests {
+		if ret := privilegedRoles(v.Roles); ret != v.Privileged {
+			t.Errorf("privilegedRoles(%v) = %v, should be %v", v.Roles, ret,
+				v.Privileged)
+		}
+	}
+}
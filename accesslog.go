@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/context"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// responseRecorder wraps a http.ResponseWriter to record the status and the
+// size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	// Status is the HTTP status code of the response.
+	Status int
+	// Size is the number of bytes written to the body.
+	Size int
+}
+
+// WriteHeader records the status and sends the header.
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.Status == 0 {
+		r.Status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size and writes to the body.
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.Size += n
+	return n, err
+}
+
+// CloseNotify returns a channel receiving a value when the client went
+// away. Returns nil if the wrapped writer doesn't support this.
+func (r *responseRecorder) CloseNotify() <-chan bool {
+	return closeNotify(r.ResponseWriter)
+}
+
+// Flush sends any buffered data to the client. Does nothing if the wrapped
+// writer doesn't support this.
+func (r *responseRecorder) Flush() {
+	flusher, ok := r.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	flusher.Flush()
+}
+
+// Hijack lets the caller take over the connection, e.g. for WebSockets.
+// Fails if the wrapped writer doesn't support this.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The response writer can't be hijacked")
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// accessLog writes access log entries to a file.
+type accessLog struct {
+	// Path of the log file.
+	Path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// openAccessLog opens the access log file at the given path.
+func openAccessLog(path string) (*accessLog, error) {
+	log := &accessLog{Path: path}
+	if err := log.Reopen(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// Reopen closes and reopens the log file, e.g. after it has been rotated.
+func (l *accessLog) Reopen() error {
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0600)
+	if err != nil {
+		return fmt.Errorf("Could not open access log: %v", err)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+// Write writes the given entry to the log file.
+func (l *accessLog) Write(entry string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := fmt.Fprintln(l.file, entry)
+	return err
+}
+
+// combinedLogEntry returns the access log entry for the given request in
+// Combined Log Format, followed by the duration of the request in
+// microseconds.
+func combinedLogEntry(r *http.Request, host, user string, status, size int,
+	start time.Time, duration time.Duration) string {
+	if len(user) == 0 {
+		user = "-"
+	}
+	sizeStr := "-"
+	if size > 0 {
+		sizeStr = fmt.Sprint(size)
+	}
+	referer, userAgent := r.Referer(), r.UserAgent()
+	if len(referer) == 0 {
+		referer = "-"
+	}
+	if len(userAgent) == 0 {
+		userAgent = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %q %q %d", host, user,
+		start.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.URL.RequestURI(),
+		r.Proto, status, sizeStr, referer, userAgent,
+		duration/time.Microsecond)
+}
+
+// logAccess writes the access log entry for the given request.
+func (h *nodeHandler) logAccess(rec *responseRecorder, r *http.Request,
+	start time.Time) {
+	user, _ := context.Get(r, accessUserKey).(string)
+	status := rec.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	entry := combinedLogEntry(r, clientIP(r),
+		user, status, rec.Size, start, time.Since(start))
+	if h.AccessLog == nil {
+		h.Log.Info("%s", entry)
+		return
+	}
+	if err := h.AccessLog.Write(entry); err != nil {
+		h.Log.Error("Could not write access log: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResponseRecorder(t *testing.T) {
+	rec := responseRecorder{ResponseWriter: &responseWriter{}}
+	rec.Write([]byte("foo"))
+	rec.Write([]byte("bar!"))
+	if rec.Status != http.StatusOK || rec.Size != 7 {
+		t.Errorf("Recorded status %v, size %v; should be 200, 7", rec.Status,
+			rec.Size)
+	}
+	rec = responseRecorder{ResponseWriter: &responseWriter{}}
+	rec.WriteHeader(http.StatusNotFound)
+	rec.Write([]byte("Not found"))
+	if rec.Status != http.StatusNotFound || rec.Size != 9 {
+		t.Errorf("Recorded status %v, size %v; should be 404, 9", rec.Status,
+			rec.Size)
+	}
+}
+
+func TestCombinedLogEntry(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Referer", "http://example.com/")
+	header.Set("User-Agent", "Foo/1.0")
+	r := http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/foo/", RawQuery: "bar=1"},
+		Proto:  "HTTP/1.1",
+		Header: header}
+	start := time.Date(2013, time.March, 21, 13, 55, 36, 0, time.UTC)
+	tests := []struct {
+		User  string
+		Size  int
+		Entry string
+	}{
+		{"admin", 2326, `10.0.0.1 - admin [21/Mar/2013:13:55:36 +0000] ` +
+			`"GET /foo/?bar=1 HTTP/1.1" 200 2326 "http://example.com/" "Foo/1.0" 1500`},
+		{"", 0, `10.0.0.1 - - [21/Mar/2013:13:55:36 +0000] ` +
+			`"GET /foo/?bar=1 HTTP/1.1" 200 - "http://example.com/" "Foo/1.0" 1500`}}
+	for _, v := range tests {
+		ret := combinedLogEntry(&r, "10.0.0.1", v.User, 200, v.Size, start,
+			1500*time.Microsecond)
+		if ret != v.Entry {
+			t.Errorf("combinedLogEntry(...) = %q, should be %q", ret, v.Entry)
+		}
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	root, err := ioutil.TempDir("", "_monsti_TestAccessLogReopen")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "access.log")
+	log, err := openAccessLog(path)
+	if err != nil {
+		t.Fatalf("openAccessLog(_) failed: %v", err)
+	}
+	log.Write("foo")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Could not rotate log: %v", err)
+	}
+	if err := log.Reopen(); err != nil {
+		t.Fatalf("Reopen() failed: %v", err)
+	}
+	log.Write("bar")
+	for file, expected := range map[string]string{
+		path + ".1": "foo\n", path: "bar\n"} {
+		content, err := ioutil.ReadFile(file)
+		if err != nil || string(content) != expected {
+			t.Errorf("%v contains %q, %v, should be %q", file, content, err,
+				expected)
+		}
+	}
+}
+
+// hijackRecorder is a httptest.ResponseRecorder supporting Hijack.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	return nil, nil, nil
+}
+
+func TestResponseRecorderFlushHijack(t *testing.T) {
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rec := &responseRecorder{ResponseWriter: w}
+	var writer http.ResponseWriter = rec
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		t.Fatalf("responseRecorder should implement http.Flusher")
+	}
+	flusher.Flush()
+	if !w.Flushed || rec.Status != http.StatusOK {
+		t.Errorf("Flush() should flush the wrapped writer, status is %v",
+			rec.Status)
+	}
+	if _, _, err := rec.Hijack(); err != nil || !w.hijacked {
+		t.Errorf("Hijack() should hijack the wrapped writer: %v", err)
+	}
+	plain := &responseRecorder{ResponseWriter: &responseWriter{}}
+	plain.Flush()
+	if _, _, err := plain.Hijack(); err == nil {
+		t.Errorf("Hijack() should fail if the wrapped writer can't be hijacked")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acmeSettings configure automatic certificates.
+type acmeSettings struct {
+	// Enabled obtains and renews certificates of all hosts of sites which
+	// don't disable ACME. Requires a TLS listener on port 443 and an HTTP
+	// listener on port 80 for the challenges.
+	Enabled bool
+	// Email is the contact address of the ACME account, e.g. for expiry
+	// notices.
+	Email string
+	// CacheDirectory stores the certificates and account data. Defaults to
+	// acme in the configuration directory.
+	CacheDirectory string
+	// DirectoryURL is the ACME directory of the certificate authority.
+	// Defaults to Let's Encrypt.
+	DirectoryURL string
+	// RenewBeforeDays is the number of days before expiry certificates get
+	// renewed. Defaults to 30.
+	RenewBeforeDays int
+}
+
+// acmeHosts returns the hosts of the site to obtain certificates for.
+//
+// Wildcards, IP addresses and hosts without a domain like localhost are
+// left out as they can't be validated using HTTP challenges.
+func (s site) acmeHosts() []string {
+	if s.TLS.DisableACME {
+		return nil
+	}
+	hosts := append([]string{}, s.Hosts...)
+	hosts = append(hosts, s.Aliases...)
+	if len(s.CanonicalHost) > 0 {
+		hosts = append(hosts, s.CanonicalHost)
+	}
+	var ret []string
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		host = strings.ToLower(stripPort(host))
+		if seen[host] || strings.Contains(host, "*") ||
+			!strings.Contains(host, ".") ||
+			net.ParseIP(strings.Trim(host, "[]")) != nil {
+			continue
+		}
+		seen[host] = true
+		ret = append(ret, host)
+	}
+	return ret
+}
+
+// acmeHosts returns the hosts of the given sites to obtain certificates
+// for.
+func acmeHosts(sites map[string]site) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, site := range sites {
+		for _, host := range site.acmeHosts() {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// acmeCert is the state of the certificate of some host.
+type acmeCert struct {
+	Host string
+	// Expires is the expiry time of the current certificate.
+	Expires time.Time
+	// Renewal is the time the certificate will be renewed.
+	Renewal time.Time
+	// Error of the last failed attempt to obtain the certificate.
+	Error string
+}
+
+// acmeManager obtains and renews certificates using ACME.
+type acmeManager struct {
+	Manager *autocert.Manager
+	Log     *leveledLogger
+	// getCertificate obtains certificates. Used for testing.
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	mutex          sync.RWMutex
+	hosts          map[string]bool
+	certs          map[string]*acmeCert
+}
+
+// newACMEManager returns a new acmeManager for the hosts of the given
+// sites.
+func newACMEManager(settings acmeSettings, sites map[string]site,
+	log *leveledLogger) *acmeManager {
+	days := settings.RenewBeforeDays
+	if days <= 0 {
+		days = 30
+	}
+	m := &acmeManager{
+		Manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(settings.CacheDirectory),
+			RenewBefore: time.Duration(days) * 24 * time.Hour,
+			Email:       settings.Email},
+		Log:   log,
+		certs: make(map[string]*acmeCert)}
+	if len(settings.DirectoryURL) > 0 {
+		m.Manager.Client = &acme.Client{DirectoryURL: settings.DirectoryURL}
+	}
+	m.Manager.HostPolicy = m.hostPolicy
+	m.getCertificate = m.Manager.GetCertificate
+	m.SetHosts(sites)
+	return m
+}
+
+// SetHosts updates the hosts to obtain certificates for.
+func (m *acmeManager) SetHosts(sites map[string]site) {
+	hosts := acmeHosts(sites)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hosts = hosts
+	for host := range m.certs {
+		if !hosts[host] {
+			delete(m.certs, host)
+		}
+	}
+}
+
+// Allowed returns true if certificates may be obtained for the given host.
+func (m *acmeManager) Allowed(host string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.hosts[strings.ToLower(host)]
+}
+
+// hostPolicy is the autocert.HostPolicy allowing the configured hosts.
+func (m *acmeManager) hostPolicy(_ context.Context, host string) error {
+	if !m.Allowed(host) {
+		return fmt.Errorf("Host %q is not configured for ACME", host)
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate of the requested server name,
+// obtaining or renewing it if needed.
+//
+// Failures get logged once per host and error, so they don't flood the log
+// if clients retry.
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	cert, err := m.getCertificate(hello)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	state, ok := m.certs[host]
+	if !ok {
+		state = &acmeCert{Host: host}
+		m.certs[host] = state
+	}
+	if err != nil {
+		if state.Error != err.Error() {
+			m.Log.Error("Could not obtain certificate for %q: %v", host, err)
+		}
+		state.Error = err.Error()
+		return nil, err
+	}
+	state.Error = ""
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf != nil && !leaf.NotAfter.Equal(state.Expires) {
+		state.Expires = leaf.NotAfter
+		state.Renewal = leaf.NotAfter.Add(-m.Manager.RenewBefore)
+		m.Log.Info("Using certificate for %q valid until %v", host,
+			leaf.NotAfter.Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+type acmeCertList []acmeCert
+
+// Len is the number of elements in the list.
+func (l acmeCertList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l acmeCertList) Less(i, j int) bool {
+	return l[i].Host < l[j].Host
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l acmeCertList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Status returns the state of the certificates of the given hosts, sorted
+// by host. Certificates are obtained on the first request of a host,
+// so hosts which haven't been requested yet don't have an expiry time.
+//
+// Returns nil if m is nil.
+func (m *acmeManager) Status(hosts []string) []acmeCert {
+	if m == nil {
+		return nil
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var ret []acmeCert
+	for _, host := range hosts {
+		if !m.hosts[host] {
+			continue
+		}
+		if state, ok := m.certs[host]; ok {
+			ret = append(ret, *state)
+		} else {
+			ret = append(ret, acmeCert{Host: host})
+		}
+	}
+	sort.Sort(acmeCertList(ret))
+	return ret
+}
+
+// HTTPHandler returns a handler answering HTTP challenges and passing any
+// other request to the given handler, or to http.DefaultServeMux if nil.
+func (m *acmeManager) HTTPHandler(fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.DefaultServeMux
+	}
+	return m.Manager.HTTPHandler(fallback)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSiteACMEHosts(t *testing.T) {
+	tests := []struct {
+		Site  site
+		Hosts []string
+	}{
+		{site{Hosts: []string{"Example.com:8080", "localhost:8080",
+			"127.0.0.1", "[::1]:80"}}, []string{"example.com"}},
+		{site{Hosts: []string{"example.com"}, Aliases: []string{
+			"*.example.com", "www.example.com"}, CanonicalHost: "example.com"},
+			[]string{"example.com", "www.example.com"}}}
+	for i, v := range tests {
+		if hosts := v.Site.acmeHosts(); !reflect.DeepEqual(hosts, v.Hosts) {
+			t.Errorf("Test %v: acmeHosts() = %v, should be %v", i, hosts,
+				v.Hosts)
+		}
+	}
+	var optOut site
+	optOut.Hosts = []string{"example.com"}
+	optOut.TLS.DisableACME = true
+	if hosts := optOut.acmeHosts(); hosts != nil {
+		t.Errorf("acmeHosts() = %v for a site disabling ACME", hosts)
+	}
+}
+
+func TestACMECertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestACMECertificates")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	own := site{Hosts: []string{"own.example.com"}}
+	own.TLS.Certificate, own.TLS.Key = writeTestCertificate(t, dir, "own")
+	optOut := site{Hosts: []string{"optout.example.com"}}
+	optOut.TLS.DisableACME = true
+	sites := map[string]site{
+		"acme":   site{Hosts: []string{"acme.example.com", "fail.example.com"}},
+		"own":    own,
+		"optout": optOut}
+	var logBuf bytes.Buffer
+	manager := newACMEManager(acmeSettings{Enabled: true,
+		CacheDirectory: dir}, sites, newLeveledLogger(log.New(&logBuf, "", 0),
+		levelInfo))
+	acmeCert, err := tls.LoadX509KeyPair(writeTestCertificate(t, dir, "acme"))
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+	var requested []string
+	manager.getCertificate = func(hello *tls.ClientHelloInfo) (
+		*tls.Certificate, error) {
+		requested = append(requested, hello.ServerName)
+		if hello.ServerName == "fail.example.com" {
+			return nil, errors.New("rate limited")
+		}
+		return &acmeCert, nil
+	}
+	store := certStore{ACME: manager}
+	if errs := store.Load(sites, ""); len(errs) > 0 {
+		t.Fatalf("Could not load certificates: %v", errs)
+	}
+	tests := []struct {
+		ServerName, CommonName string
+	}{
+		{"acme.example.com", "acme"},
+		{"own.example.com", "own"},
+		{"fail.example.com", ""},
+		{"fail.example.com", ""},
+		{"optout.example.com", ""},
+		{"other.example.com", ""}}
+	for i, v := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{
+			ServerName: v.ServerName})
+		if len(v.CommonName) == 0 {
+			if err == nil {
+				t.Errorf("Test %v: GetCertificate(%q) should fail", i,
+					v.ServerName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %v: GetCertificate(%q) failed: %v", i, v.ServerName,
+				err)
+			continue
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		if leaf.Subject.CommonName != v.CommonName {
+			t.Errorf("Test %v: Got certificate %q for %q, should be %q", i,
+				leaf.Subject.CommonName, v.ServerName, v.CommonName)
+		}
+	}
+	if !reflect.DeepEqual(requested, []string{"acme.example.com",
+		"fail.example.com", "fail.example.com"}) {
+		t.Errorf("Requested certificates for %v", requested)
+	}
+	if n := strings.Count(logBuf.String(), "rate limited"); n != 1 {
+		t.Errorf("Failure has been logged %v times, should be once:\n%v", n,
+			logBuf.String())
+	}
+	status := manager.Status([]string{"acme.example.com", "fail.example.com",
+		"new.example.com"})
+	if len(status) != 2 || status[0].Expires.IsZero() ||
+		!status[0].Renewal.Before(status[0].Expires) ||
+		status[1].Error != "rate limited" {
+		t.Errorf("Status(...) = %+v", status)
+	}
+	// Removed hosts must not be requested anymore.
+	delete(sites, "acme")
+	store.Load(sites, "")
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{
+		ServerName: "acme.example.com"}); err == nil {
+		t.Errorf("GetCertificate(...) should fail for removed hosts")
+	}
+}
+
+func TestACMEHTTPHandler(t *testing.T) {
+	manager := newACMEManager(acmeSettings{Enabled: true}, nil,
+		newLeveledLogger(log.New(ioutil.Discard, "", 0), levelInfo))
+	handler := manager.HTTPHandler(httpsRedirector{})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET",
+		"http://example.com/.well-known/acme-challenge/foo", nil)
+	handler.ServeHTTP(w, r)
+	if w.Code == http.StatusMovedPermanently {
+		t.Errorf("Challenge request has been redirected")
+	}
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://example.com/foo", nil)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("Got status %v, should be redirected", w.Code)
+	}
+}
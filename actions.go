@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// Handlers of actions as returned by actionRegistry.Lookup.
+const (
+	// The action is unknown for the node type.
+	actionUnknown = ""
+	// The daemon handles the action itself.
+	actionDaemon = "daemon"
+	// The action is passed to the worker of the node type.
+	actionWorker = "worker"
+)
+
+// errActionUnknown is returned if an action is neither handled by the
+// daemon nor by the worker of the node type.
+var errActionUnknown = errors.New("Unknown action")
+
+// errActionDenied is returned if the user may not perform an action.
+var errActionDenied = errors.New("Permission denied")
+
+// daemonActions are the actions handled by the daemon itself, see
+// nodeHandler.ServeHTTP.
+var daemonActions = []string{"login", "logout", "reset-password",
+	"setup-2fa", "status", "recent", "usage", "search", "json", "feed",
+	"export", "import", "audit", "history", "blocks", "attachments",
+	"aliases", "tokens", "set-locale", "add", "remove", "users", "users/add",
+	"users/edit", "users/disable", "users/enable"}
+
+// actionRegistry knows the actions which may be requested on nodes: the
+// actions handled by the daemon and the actions advertised by the workers
+// during the protocol handshake.
+type actionRegistry struct {
+	// Protocols holds the actions advertised by the workers.
+	Protocols *protocolRegistry
+}
+
+// Lookup returns the handler of the given action on nodes of the given
+// type.
+//
+// Workers which did not advertise their actions, e.g. legacy workers, get
+// all actions not handled by the daemon.
+func (a actionRegistry) Lookup(nodeType, action string) string {
+	switch {
+	case len(action) == 0:
+		return actionWorker
+	case inStringSlice(action, daemonActions):
+		return actionDaemon
+	case a.Protocols.Get(nodeType).HasAction(action):
+		return actionWorker
+	}
+	return actionUnknown
+}
+
+// Check returns nil if a user with the given roles might perform the given
+// action on nodes of the given type, errActionUnknown if the action is not
+// registered or errActionDenied if the user lacks the required role.
+//
+// permissions maps actions to roles and overrides the default permissions.
+func (a actionRegistry) Check(nodeType, action string, roles []string,
+	permissions map[string]string) error {
+	if a.Lookup(nodeType, action) == actionUnknown {
+		return errActionUnknown
+	}
+	if !checkPermission(action, roles, permissions) {
+		return errActionDenied
+	}
+	return nil
+}
+
+// registeredActions lists the actions handled by the daemon or by the
+// worker of some node type.
+type registeredActions struct {
+	// NodeType is empty for the daemon's actions.
+	NodeType string
+	Actions  []string
+	// Advertised is false if the worker did not advertise its actions.
+	Advertised bool
+}
+
+// List returns the actions of the daemon followed by the actions of the
+// workers of the given node types.
+func (a actionRegistry) List(nodeTypes []string) []registeredActions {
+	daemon := append([]string{}, daemonActions...)
+	sort.Strings(daemon)
+	ret := []registeredActions{{Actions: daemon, Advertised: true}}
+	for _, nodeType := range nodeTypes {
+		protocol := a.Protocols.Get(nodeType)
+		sort.Strings(protocol.Actions)
+		ret = append(ret, registeredActions{nodeType, protocol.Actions,
+			protocol.Actions != nil})
+	}
+	return ret
+}
+
+// actions returns the registry of the actions known to the handler.
+func (h *nodeHandler) actions() actionRegistry {
+	return actionRegistry{h.Protocols}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestActionRegistryLookup(t *testing.T) {
+	protocols := newProtocolRegistry(newLeveledLogger(
+		log.New(ioutil.Discard, "", 0), levelInfo))
+	protocols.Handshake("Document", worker.ProtocolVersion,
+		[]string{"edit", "comments"})
+	registry := actionRegistry{protocols}
+	tests := []struct {
+		NodeType, Action, Handler string
+	}{
+		{"Document", "", actionWorker},
+		{"Document", "login", actionDaemon},
+		{"Document", "users/add", actionDaemon},
+		{"Document", "edit", actionWorker},
+		{"Document", "comments/approve", actionWorker},
+		{"Document", "unknown", actionUnknown},
+		// The worker did not advertise its actions yet.
+		{"Image", "unknown", actionWorker},
+		{"Image", "status", actionDaemon}}
+	for i, v := range tests {
+		if ret := registry.Lookup(v.NodeType, v.Action); ret != v.Handler {
+			t.Errorf("Test %v: Lookup(%q, %q) = %q, should be %q", i,
+				v.NodeType, v.Action, ret, v.Handler)
+		}
+	}
+	if ret := (actionRegistry{}).Lookup("Document", "unknown"); ret !=
+		actionWorker {
+		t.Errorf("Registry without protocols should pass all actions to"+
+			" the workers, got %q", ret)
+	}
+	list := registry.List([]string{"Document", "Image"})
+	expected := []registeredActions{
+		{"Document", []string{"comments", "edit"}, true},
+		{"Image", nil, false}}
+	if len(list) != 3 || list[0].NodeType != "" || !list[0].Advertised ||
+		len(list[0].Actions) != len(daemonActions) ||
+		!reflect.DeepEqual(list[1:], expected) {
+		t.Errorf("List(...) = %v", list)
+	}
+}
+
+func TestActionRegistryCheck(t *testing.T) {
+	registry := actionRegistry{newProtocolRegistry(newLeveledLogger(
+		log.New(ioutil.Discard, "", 0), levelInfo))}
+	registry.Protocols.Handshake("Document", worker.ProtocolVersion,
+		[]string{"edit", "comments"})
+	permissions := map[string]string{"comments": roleAnonymous}
+	tests := []struct {
+		Action string
+		Roles  []string
+		Err    error
+	}{
+		{"login", nil, nil},
+		{"status", nil, errActionDenied},
+		{"status", []string{roleAdmin}, nil},
+		{"comments", nil, nil},
+		{"edit", nil, errActionDenied},
+		{"edit", []string{roleEditor}, nil},
+		{"unknown", nil, errActionUnknown},
+		{"unknown", []string{roleAdmin}, errActionUnknown}}
+	for i, v := range tests {
+		if err := registry.Check("Document", v.Action, v.Roles,
+			permissions); err != v.Err {
+			t.Errorf("Test %v: Check(%q, %v) = %v, should be %v", i, v.Action,
+				v.Roles, err, v.Err)
+		}
+	}
+}
+
+func TestServeUnknownAction(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestServeUnknownAction")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path   string
+		Status int
+	}{
+		{"/foo/@@json", http.StatusOK},
+		{"/foo/@@comments", http.StatusOK},
+		{"/foo/@@doesnotexist", http.StatusNotImplemented}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		var tickets int
+		h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+			tickets++
+			ticket.ResponseChan <- client.Response{Body: []byte("ok"), Raw: true}
+		})
+		siteFoo, _ := h.Sites.Get("foo")
+		siteFoo.Permissions = map[string]string{"comments": roleAnonymous}
+		h.Sites.Set(map[string]site{"foo": siteFoo}, "")
+		h.Protocols = newProtocolRegistry(h.Log)
+		h.Protocols.Handshake("Document", worker.ProtocolVersion,
+			[]string{"comments"})
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+		}
+		if v.Status == http.StatusNotImplemented && tickets > 0 {
+			t.Errorf("Test %v: Unknown action has been passed to the worker", i)
+		}
+	}
+}
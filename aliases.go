@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// alias maps an old path, e.g. of a previous site, to the path of a node.
+type alias struct {
+	From, To string
+	// ToURL is the URL of the node, i.e. To below the site's base path.
+	ToURL string
+}
+
+// aliasList implements sort.Interface to sort aliases by their old path.
+type aliasList []alias
+
+func (a aliasList) Len() int           { return len(a) }
+func (a aliasList) Less(i, j int) bool { return a[i].From < a[j].From }
+func (a aliasList) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// cleanAliasPath returns the given old path in the form used as key of
+// aliases.yaml, i.e. absolute and without a trailing slash.
+func cleanAliasPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// loadAliases returns the aliases of the site with the given configuration
+// directory. A missing aliases.yaml holds no aliases.
+func loadAliases(configDir string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(configDir, "aliases.yaml"))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not load aliases.yaml: %v", err)
+	}
+	aliases := make(map[string]string)
+	if err = goyaml.Unmarshal(content, &aliases); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal aliases.yaml: %v", err)
+	}
+	return aliases, nil
+}
+
+// saveAliases atomically replaces the aliases of the site with the given
+// configuration directory.
+func saveAliases(configDir string, aliases map[string]string) error {
+	content, err := goyaml.Marshal(aliases)
+	if err != nil {
+		return fmt.Errorf("Could not marshal aliases: %v", err)
+	}
+	file := filepath.Join(configDir, "aliases.yaml")
+	if err := writeFileAtomic(file, content, 0600); err != nil {
+		return fmt.Errorf("Could not write aliases.yaml: %v", err)
+	}
+	return nil
+}
+
+// sortedAliases returns the given aliases of the given site sorted by their
+// old paths.
+func sortedAliases(aliases map[string]string, site site) []alias {
+	ret := make(aliasList, 0, len(aliases))
+	for from, to := range aliases {
+		ret = append(ret, alias{From: from, To: to, ToURL: site.URL(to)})
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+// resolveCase resolves the given path case-insensitively against the nodes
+// of the data directory located at root.
+//
+// Each segment matches the child with exactly the same name or, if there is
+// none, the only child whose name differs in case. Returns false if there
+// is no such node or if a segment is ambiguous.
+func resolveCase(root, nodePath string) (string, bool) {
+	resolved := "/"
+	for _, segment := range strings.Split(strings.Trim(nodePath, "/"), "/") {
+		if len(segment) == 0 {
+			continue
+		}
+		children, err := getChildren(root, resolved)
+		if err != nil {
+			return "", false
+		}
+		var match string
+		matches := 0
+		for _, child := range children {
+			if child == segment {
+				match, matches = child, 1
+				break
+			}
+			if !strings.HasPrefix(child, ".") && strings.EqualFold(child, segment) {
+				match = child
+				matches++
+			}
+		}
+		if matches != 1 {
+			return "", false
+		}
+		resolved = path.Join(resolved, match)
+	}
+	if _, err := lookupNode(root, resolved); err != nil {
+		return "", false
+	}
+	return resolved, true
+}
+
+// resolveLegacyPath returns the path of the node to be served for the given
+// path which does not match a node.
+//
+// Consults the site's aliases and, if enabled, resolves the path
+// case-insensitively. Returns false if no node has been found.
+func resolveLegacyPath(site site, nodePath string) (string, bool) {
+	root := site.Directories.Data
+	aliases, err := loadAliases(site.Directories.Config)
+	if err != nil {
+		return "", false
+	}
+	if to, ok := aliases[cleanAliasPath(nodePath)]; ok {
+		if _, err := lookupNode(root, to); err == nil {
+			return to, true
+		}
+	}
+	if site.CaseInsensitivePaths {
+		if resolved, ok := resolveCase(root, nodePath); ok &&
+			resolved != path.Clean(nodePath) {
+			return resolved, true
+		}
+	}
+	return "", false
+}
+
+// redirectLegacyPath redirects permanently to the canonical URL of the node
+// matching the given path, see resolveLegacyPath.
+//
+// Returns false if no node has been found.
+func redirectLegacyPath(w http.ResponseWriter, r *http.Request, site site,
+	nodePath, action string) bool {
+	resolved, ok := resolveLegacyPath(site, nodePath)
+	if !ok {
+		return false
+	}
+	target := strings.TrimSuffix(resolved, "/") + "/"
+	if len(action) > 0 {
+		target += "@@" + action
+	}
+	target = site.URL(target)
+	if len(r.URL.RawQuery) > 0 {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return true
+}
+
+// Aliases handles requests to manage the site's aliases.
+func (h *nodeHandler) Aliases(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	aliases, err := loadAliases(site.Directories.Config)
+	if err != nil {
+		panic("Can't load aliases: " + err.Error())
+	}
+	context := template.Context{}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		from := cleanAliasPath(r.Form.Get("From"))
+		to := path.Clean("/" + r.Form.Get("To"))
+		remove := len(r.Form.Get("Remove")) > 0
+		if remove {
+			from = r.Form.Get("Remove")
+		}
+		switch {
+		case !validCSRFRequest(r, session, r.Form.Get("CSRFToken")):
+			context["Error"] = G("The form has expired. Please try again.")
+		case remove:
+			delete(aliases, from)
+		case checkPathSegments(from) != nil || from == "/":
+			context["Error"] = G("Invalid old path.")
+		default:
+			if _, err := lookupNode(site.Directories.Data, to); err != nil {
+				context["Error"] = G("There is no node at the given path.")
+				break
+			}
+			aliases[from] = to
+		}
+		if _, ok := context["Error"]; ok {
+			break
+		}
+		if err := saveAliases(site.Directories.Config, aliases); err != nil {
+			panic("Can't save aliases: " + err.Error())
+		}
+		h.requestLog(r, site.Name).Info("%v changed alias %q",
+			sessionLogin(cSession), from)
+		http.Redirect(w, r, site.URL(path.Join(node.Path, "@@aliases")),
+			http.StatusSeeOther)
+		return
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	context["Aliases"] = sortedAliases(aliases, site)
+	context["CSRFToken"] = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/aliases", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Aliases"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveCase(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":               `{"type": "Document"}`,
+		"/about-us/node.yaml":      `{"type": "Document"}`,
+		"/about-us/Team/node.yaml": `{"type": "Document"}`,
+		"/news/node.yaml":          `{"type": "Document"}`,
+		"/News/node.yaml":          `{"type": "Document"}`,
+		"/.hidden/node.yaml":       `{"type": "Document"}`,
+		"/empty/foo":               ""}, "TestResolveCase")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path, Resolved string
+		Found          bool
+	}{
+		{"/About-Us/", "/about-us", true},
+		{"/ABOUT-US/team", "/about-us/Team", true},
+		{"/news", "/news", true},
+		{"/NEWS", "", false},
+		{"/.HIDDEN", "", false},
+		{"/Empty", "", false},
+		{"/missing", "", false}}
+	for _, v := range tests {
+		resolved, found := resolveCase(root, v.Path)
+		if resolved != v.Resolved || found != v.Found {
+			t.Errorf("resolveCase(%q) = %q, %v, should be %q, %v", v.Path,
+				resolved, found, v.Resolved, v.Found)
+		}
+	}
+}
+
+func TestRedirectLegacyPath(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":          `{"type": "Document"}`,
+		"/data/about-us/node.yaml": `{"type": "Document"}`,
+		"/config/aliases.yaml": `{"/about-us.html": "/about-us",
+			"/old/": "/missing"}`}, "TestRedirectLegacyPath")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path, Location string
+		Status         int
+	}{
+		{"/about-us.html", "/about-us/", http.StatusMovedPermanently},
+		{"/About-Us/?page=2", "/about-us/?page=2", http.StatusMovedPermanently},
+		{"/About-Us", "/about-us/", http.StatusMovedPermanently},
+		{"/About-Us/@@json", "/about-us/@@json", http.StatusMovedPermanently},
+		{"/old/", "", http.StatusNotFound},
+		{"/missing/", "", http.StatusNotFound}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		h, stop := setupWorkerHandler(filepath.Join(root, "data"), &logBuf,
+			func(worker.Ticket) {})
+		site_, _ := h.Sites.Get("foo")
+		site_.Directories.Config = filepath.Join(root, "config")
+		site_.CaseInsensitivePaths = true
+		h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != v.Location {
+			t.Errorf("Test %v: Location is %q, should be %q", i, location,
+				v.Location)
+		}
+	}
+}
+
+func TestSortedAliases(t *testing.T) {
+	aliases := map[string]string{"/old": "/foo", "/a": "/bar/"}
+	tests := []struct {
+		BasePath string
+		Aliases  []alias
+	}{
+		{"", []alias{{"/a", "/bar/", "/bar/"}, {"/old", "/foo", "/foo"}}},
+		{"/base", []alias{{"/a", "/bar/", "/base/bar/"},
+			{"/old", "/foo", "/base/foo"}}}}
+	for i, v := range tests {
+		ret := sortedAliases(aliases, site{BasePath: v.BasePath})
+		if !reflect.DeepEqual(ret, v.Aliases) {
+			t.Errorf("Test %v: sortedAliases(...) = %v, should be %v", i, ret,
+				v.Aliases)
+		}
+	}
+}
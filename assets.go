@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assetVersionParam is the query parameter holding the fingerprint of
+// static assets. The static file servers ignore it.
+const assetVersionParam = "v"
+
+// assetFingerprint is the cached fingerprint of a static file.
+type assetFingerprint struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string
+}
+
+// assetFingerprints caches the fingerprints of static files until they
+// get modified.
+type assetFingerprints struct {
+	// Log receives warnings about missing files. May be nil.
+	Log   *leveledLogger
+	mutex sync.Mutex
+	files map[string]assetFingerprint
+	// missing are the files which are known to be missing.
+	missing map[string]bool
+}
+
+// staticAssets caches the fingerprints of the static files of all sites.
+var staticAssets = &assetFingerprints{}
+
+// Fingerprint returns a hash of the content of the given file, or an empty
+// string if it can't be read. Missing files will be logged once.
+func (a *assetFingerprints) Fingerprint(file string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		if !a.missing[file] {
+			a.Log.Warn("Missing static asset %v", file)
+			if a.missing == nil {
+				a.missing = make(map[string]bool)
+			}
+			a.missing[file] = true
+		}
+		return ""
+	}
+	delete(a.missing, file)
+	cached, ok := a.files[file]
+	if ok && cached.ModTime.Equal(info.ModTime()) &&
+		cached.Size == info.Size() {
+		return cached.Hash
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		a.Log.Warn("Could not read static asset: %v", err)
+		return ""
+	}
+	hash := sha256.Sum256(content)
+	cached = assetFingerprint{ModTime: info.ModTime(), Size: info.Size(),
+		Hash: hex.EncodeToString(hash[:6])}
+	if a.files == nil {
+		a.files = make(map[string]assetFingerprint)
+	}
+	a.files[file] = cached
+	return cached.Hash
+}
+
+// assetResolver fingerprints the URLs of a site's static assets.
+type assetResolver struct {
+	// Shared and Site are the shared and the site's static directories.
+	Shared, Site string
+	// BasePath is the site's base path.
+	BasePath string
+}
+
+// newAssetResolver returns the asset resolver of the given site.
+func newAssetResolver(settings *settings, site site) *assetResolver {
+	return &assetResolver{Shared: settings.Directories.Statics,
+		Site: site.Directories.Statics, BasePath: site.BasePath}
+}
+
+// URL returns the URL of the static asset at the given path, e.g.
+// /static/css/main.css or /site-static/logo.png, with the fingerprint of
+// the file's content appended. Returns the plain path if the file doesn't
+// exist.
+//
+// Paths of site assets get prefixed with the site's base path.
+func (a *assetResolver) URL(assetPath string) string {
+	if a == nil {
+		return assetPath
+	}
+	cleaned := path.Clean("/" + assetPath)
+	var dir, prefix string
+	switch {
+	case strings.HasPrefix(cleaned, "/static/") && len(a.Shared) > 0:
+		dir = a.Shared
+	case strings.HasPrefix(cleaned, "/site-static/") && len(a.Site) > 0:
+		dir, prefix = a.Site, a.BasePath
+	default:
+		return assetPath
+	}
+	// Mirrors the file servers, which serve the parents of the static
+	// directories.
+	file := filepath.Join(filepath.Dir(dir), filepath.FromSlash(cleaned))
+	url := prefix + cleaned
+	if hash := staticAssets.Fingerprint(file); len(hash) > 0 {
+		url += "?" + assetVersionParam + "=" + hash
+	}
+	return url
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/template"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssetURL(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/static/css/main.css":       "body {}",
+		"/site/site-static/logo.svg": "<svg/>"}, "TestAssetURL")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	defer func(a *assetFingerprints) { staticAssets = a }(staticAssets)
+	staticAssets = &assetFingerprints{Log: newLeveledLogger(
+		log.New(&logBuf, "", 0), levelInfo)}
+	assets := &assetResolver{Shared: filepath.Join(root, "static"),
+		Site: filepath.Join(root, "site", "site-static"), BasePath: "/base"}
+	tests := []struct {
+		Path, URL string
+	}{
+		{"/static/css/main.css", "/static/css/main.css?v="},
+		{"static/css/main.css", "/static/css/main.css?v="},
+		{"/site-static/logo.svg", "/base/site-static/logo.svg?v="},
+		{"/static/missing.css", "/static/missing.css"},
+		{"/static/css", "/static/css"},
+		{"/other/main.css", "/other/main.css"}}
+	for i, v := range tests {
+		ret := assets.URL(v.Path)
+		if !strings.HasPrefix(ret, v.URL) ||
+			(strings.HasSuffix(v.URL, "=") && len(ret) != len(v.URL)+12) {
+			t.Errorf("Test %v: URL(%q) = %q, should be %q plus hash", i, v.Path,
+				ret, v.URL)
+		}
+	}
+	assets.URL("/static/missing.css")
+	if n := strings.Count(logBuf.String(), "missing.css"); n != 1 {
+		t.Errorf("Missing asset has been logged %v times, should be once: %q",
+			n, logBuf.String())
+	}
+	before := assets.URL("/static/css/main.css")
+	if again := assets.URL("/static/css/main.css"); again != before {
+		t.Errorf("URL of unchanged asset changed from %q to %q", before, again)
+	}
+	file := filepath.Join(root, "static", "css", "main.css")
+	if err := ioutil.WriteFile(file, []byte("body {x}"), 0600); err != nil {
+		t.Fatalf("Could not write asset: %v", err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatalf("Could not change modification time: %v", err)
+	}
+	if after := assets.URL("/static/css/main.css"); after == before {
+		t.Errorf("URL of changed asset is still %q", after)
+	}
+	var nilAssets *assetResolver
+	if ret := nilAssets.URL("/static/x.css"); ret != "/static/x.css" {
+		t.Errorf("URL(...) of nil resolver returned %q", ret)
+	}
+}
+
+func TestAssetURLTemplate(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/templates/master.html":  `<link href="{{assetURL "/site-static/a.css"}}">`,
+		"/site/site-static/a.css": "a {}",
+		"/site/data/__empty__":    ""}, "TestAssetURLTemplate")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{}
+	site_.Directories.Data = filepath.Join(root, "site", "data")
+	site_.Directories.Statics = filepath.Join(root, "site", "site-static")
+	r := &templateRenderer{Root: filepath.Join(root, "templates")}
+	ret := renderInMaster(r, nil, masterTmplEnv{Node: client.Node{Path: "/"}},
+		new(settings), site_, "")
+	if !strings.HasPrefix(ret, `<link href="/site-static/a.css?v=`) {
+		t.Errorf("renderInMaster(...) returned %q", ret)
+	}
+	ret = r.Render("master", template.Context{}, "", "")
+	if ret != `<link href="/site-static/a.css">` {
+		t.Errorf("Render(...) without embedder returned %q", ret)
+	}
+}
+
+func TestServeFingerprintedAsset(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/site-static/a.css": "a {}"}, "TestServeFingerprintedAsset")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	h, stop := setupWorkerHandler(root, ioutil.Discard, nil)
+	defer stop()
+	site_, _ := h.Sites.Get("foo")
+	site_.Directories.Statics = filepath.Join(root, "site-static")
+	h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET",
+		"http://example.com/site-static/a.css?v=0123456789ab", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "a {}" {
+		t.Errorf("Fingerprinted asset got %v %q", w.Code, w.Body.String())
+	}
+}
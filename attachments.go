@@ -0,0 +1,425 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/context"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// attachmentUploadPrefix is the prefix of the hidden files in node
+// directories receiving uploads until they are complete.
+const attachmentUploadPrefix = ".upload-"
+
+// reservedAttachmentNames are names which must not be used for attachments
+// because they are used by the node itself. Their translations, e.g.
+// node.de.yaml, are reserved as well.
+var reservedAttachmentNames = []string{"node.yaml", "navigation.yaml"}
+
+// scriptableTypes are MIME types of attachments which browsers might execute
+// and which are therefore only served as downloads.
+var scriptableTypes = []string{"text/html", "image/svg+xml",
+	"application/xhtml+xml", "text/xml", "application/xml"}
+
+// errInvalidAttachmentName is returned for malformed or reserved attachment
+// names.
+var errInvalidAttachmentName = errors.New("Invalid attachment name")
+
+// attachment is a data file of a node.
+type attachment struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// validAttachmentName returns true if the given name might be used for an
+// attachment.
+//
+// Names must not contain path separators, start with a dot or @@ or clash
+// with the files of the node itself.
+func validAttachmentName(name string) bool {
+	return len(name) > 0 && !strings.ContainsAny(name, "/\\\x00") &&
+		!strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "@@") &&
+		!reservedAttachmentName(name) && !isMenuFile(name)
+}
+
+// reservedAttachmentName returns true if the given name is one of the
+// reservedAttachmentNames or a translation of one, e.g. node.de.yaml.
+func reservedAttachmentName(name string) bool {
+	for _, reserved := range reservedAttachmentNames {
+		ext := path.Ext(reserved)
+		if name == reserved ||
+			strings.HasPrefix(name, strings.TrimSuffix(reserved, ext)+".") &&
+				strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentFile returns the filesystem path of the attachment at the given
+// path, e.g. /foo/report.pdf for the attachment report.pdf of node /foo, in
+// the data directory located at root.
+//
+// Attachments of nodes below hidden directories are not considered.
+func attachmentFile(root, filePath string) (string, error) {
+	nodePath, name := path.Split(filePath)
+	if !validAttachmentName(name) || strings.Contains(nodePath, "/.") {
+		return "", errInvalidAttachmentName
+	}
+	file, err := nodeFile(root, path.Clean(nodePath), name)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("Not an attachment: %v", filePath)
+	}
+	return file, nil
+}
+
+// isRegionFile returns true if the given file holds the (possibly
+// translated) content of one of the site's regions.
+func isRegionFile(site site, name string) bool {
+	if path.Ext(name) != ".html" {
+		return false
+	}
+	base := strings.SplitN(name, ".", 2)[0]
+	for _, reg := range siteRegions(site) {
+		if reg.Name == base {
+			return true
+		}
+	}
+	return false
+}
+
+// servableFile returns the filesystem path of the attachment at the given
+// path of the site if it might be served directly. Region files are only
+// served embedded into pages.
+func servableFile(site site, filePath string) (string, error) {
+	if isRegionFile(site, path.Base(filePath)) {
+		return "", errInvalidAttachmentName
+	}
+	return attachmentFile(site.Directories.Data, filePath)
+}
+
+// publicFile returns true if the attachment at the given path of the site
+// might be viewed by anonymous users.
+func publicFile(site site, filePath string) bool {
+	return checkPermission("", nil, site.Permissions) &&
+		newNodeAccess(site.Directories.Data, nil).CanView(path.Dir(filePath))
+}
+
+// listAttachments returns the attachments of the node at the given path of
+// the data directory located at root, sorted by name.
+func listAttachments(root, nodePath string) ([]attachment, error) {
+	dir, err := nodeFile(root, nodePath, "")
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read node directory: %v", err)
+	}
+	var ret []attachment
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !validAttachmentName(info.Name()) {
+			continue
+		}
+		ret = append(ret, attachment{Name: info.Name(), Size: info.Size(),
+			ModTime: info.ModTime()})
+	}
+	sort.Sort(attachmentList(ret))
+	return ret, nil
+}
+
+// attachmentList sorts attachments by name.
+type attachmentList []attachment
+
+// Len is the number of elements in the list.
+func (l attachmentList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l attachmentList) Less(i, j int) bool {
+	return l[i].Name < l[j].Name
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l attachmentList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// storeAttachment moves the uploaded file at the given path to the node's
+// attachment with the given name, replacing an existing attachment.
+//
+// The uploaded file has to be located in the node's directory.
+func storeAttachment(root, nodePath, name, upload string) error {
+	if !validAttachmentName(name) {
+		return errInvalidAttachmentName
+	}
+	file, err := nodeFile(root, nodePath, name)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(file); err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("%q is not an attachment", name)
+	}
+	if err := os.Chmod(upload, getContentModes().FileMode()); err != nil {
+		return err
+	}
+	defer lockWrites(file)()
+	if err := os.Rename(upload, file); err != nil {
+		return fmt.Errorf("Could not store attachment: %v", err)
+	}
+	return nil
+}
+
+// renameAttachment renames the node's attachment from to the given name.
+//
+// Fails if the new name is already in use.
+func renameAttachment(root, nodePath, from, to string) error {
+	if !validAttachmentName(from) || !validAttachmentName(to) {
+		return errInvalidAttachmentName
+	}
+	source, err := attachmentFile(root, path.Join(nodePath, from))
+	if err != nil {
+		return err
+	}
+	target, err := nodeFile(root, nodePath, to)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		return fmt.Errorf("%q already exists", to)
+	}
+	defer lockWrites(target)()
+	if err := os.Rename(source, target); err != nil {
+		return fmt.Errorf("Could not rename attachment: %v", err)
+	}
+	return nil
+}
+
+// removeAttachment removes the node's attachment with the given name.
+func removeAttachment(root, nodePath, name string) error {
+	file, err := attachmentFile(root, path.Join(nodePath, name))
+	if err != nil {
+		return err
+	}
+	defer lockWrites(file)()
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("Could not remove attachment: %v", err)
+	}
+	return nil
+}
+
+// attachmentsChanged updates the node's update stamps and notifies about
+// the change of the given attachment like dataWritten.
+func attachmentsChanged(site site, nodePath, name, login, action string,
+	logf func(format string, v ...interface{})) {
+	if err := touchNode(site.Directories.Data, nodePath, login,
+		time.Now()); err != nil {
+		logf("Could not update stamps of node %q: %v", nodePath, err)
+	}
+	dataWritten(site, nodePath, name, login, action, logf)
+}
+
+// receiveAttachments streams the files uploaded with the given request to
+// the node's directory and returns the uploads. Form values will be stored
+// in the request's Form.
+//
+// The uploaded files have to be stored or removed by the caller, even if an
+// error is returned.
+func receiveAttachments(r *http.Request, root,
+	nodePath string) ([]uploadedFile, error) {
+	dir, err := nodeFile(root, nodePath, "")
+	if err != nil {
+		return nil, err
+	}
+	return streamMultipart(r, func() (*os.File, error) {
+		return ioutil.TempFile(dir, attachmentUploadPrefix)
+	})
+}
+
+// Attachments handles requests to list, upload, rename and remove the
+// attachments of a node.
+func (h *nodeHandler) Attachments(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	root := site.Directories.Data
+	context := template.Context{}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var uploads []uploadedFile
+		var err error
+		if isMultipart(r) {
+			uploads, err = receiveAttachments(r, root, node.Path)
+			defer func() {
+				for _, upload := range uploads {
+					os.Remove(upload.Path)
+				}
+			}()
+		} else {
+			err = r.ParseForm()
+		}
+		if bodyTooLarge(err) {
+			h.renderError(w, r, "The request is too large.",
+				http.StatusRequestEntityTooLarge, node, cSession, site)
+			return
+		}
+		if err != nil {
+			h.requestLog(r, site.Name).Info("Could not parse request body: %v",
+				err)
+			h.renderError(w, r, "Invalid request.", http.StatusBadRequest, node,
+				cSession, site)
+			return
+		}
+		login := sessionLogin(cSession)
+		logf := h.requestLog(r, site.Name).Warn
+		switch {
+		case !validCSRFRequest(r, session, r.Form.Get("CSRFToken")):
+			context["Error"] = G("The form has expired. Please try again.")
+		case site.ReadOnly:
+			context["Error"] = G("The site is read-only.")
+		case len(uploads) > 0:
+			for _, upload := range uploads {
+				// Some browsers send the full path of the file.
+				name := path.Base(strings.Replace(upload.Name, "\\", "/", -1))
+				if err := storeAttachment(root, node.Path, name,
+					upload.Path); err != nil {
+					context["Error"] = fmt.Sprintf(G("Could not upload %q: %v"),
+						upload.Name, err)
+					break
+				}
+				attachmentsChanged(site, node.Path, name, login, auditWriteData,
+					logf)
+			}
+		case len(r.Form.Get("Delete")) > 0:
+			name := r.Form.Get("Name")
+			if err := removeAttachment(root, node.Path, name); err != nil {
+				context["Error"] = fmt.Sprintf(G("Could not remove %q: %v"), name,
+					err)
+				break
+			}
+			attachmentsChanged(site, node.Path, name, login, auditRemove, logf)
+		case len(r.Form.Get("NewName")) > 0:
+			from, to := r.Form.Get("Name"), r.Form.Get("NewName")
+			if err := renameAttachment(root, node.Path, from, to); err != nil {
+				context["Error"] = fmt.Sprintf(G("Could not rename %q: %v"), from,
+					err)
+				break
+			}
+			attachmentsChanged(site, node.Path, to, login, auditWriteData, logf)
+		}
+		if context["Error"] == nil {
+			http.Redirect(w, r, site.URL(path.Join(node.Path, "@@attachments")),
+				http.StatusSeeOther)
+			return
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	attachments, err := listAttachments(root, node.Path)
+	if err != nil {
+		panic("Can't list attachments: " + err.Error())
+	}
+	context["Attachments"] = attachments
+	context["NodeURL"] = strings.TrimSuffix(site.URL(node.Path), "/") + "/"
+	context["CSRFToken"] = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/attachments", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Attachments"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+// attachmentCacheControl returns the Cache-Control header of the attachments
+// of the node at the given path.
+//
+// Attachments of restricted nodes must not be stored by shared caches.
+func attachmentCacheControl(root, nodePath string) string {
+	if newNodeAccess(root, nil).CanView(nodePath) {
+		return "public, max-age=3600"
+	}
+	return "private, no-cache"
+}
+
+// ServeAttachment serves the attachment at the given path to a user with
+// the given roles.
+//
+// Range requests and conditional requests are supported.
+func (h *nodeHandler) ServeAttachment(w http.ResponseWriter, r *http.Request,
+	filePath string, roles []string, cSession *client.Session, site site) {
+	root := site.Directories.Data
+	nodePath := path.Dir(filePath)
+	node, err := lookupNode(root, nodePath)
+	if err != nil {
+		h.renderError(w, r, "Node not found.", http.StatusNotFound,
+			client.Node{Path: "/"}, cSession, site)
+		return
+	}
+	access := newNodeAccess(root, roles)
+	context.Set(r, nodeAccessKey, access)
+	if !access.CanView(nodePath) || !checkPermission("", roles,
+		site.Permissions) {
+		h.Deny(w, r, node, cSession, site)
+		return
+	}
+	file, err := servableFile(site, filePath)
+	if err != nil {
+		h.renderError(w, r, "Node not found.", http.StatusNotFound, node,
+			cSession, site)
+		return
+	}
+	params, resize, err := parseImageParams(r.URL.Query())
+	if err != nil {
+		h.renderError(w, r, err.Error()+".", http.StatusBadRequest, node,
+			cSession, site)
+		return
+	}
+	if resize && h.serveResizedImage(w, r, filePath, file, params, site) {
+		return
+	}
+	content, err := os.Open(file)
+	if err != nil {
+		panic("Can't open attachment: " + err.Error())
+	}
+	defer content.Close()
+	info, err := content.Stat()
+	if err != nil {
+		panic("Can't stat attachment: " + err.Error())
+	}
+	name := path.Base(filePath)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	if inStringSlice(strings.SplitN(contentType, ";", 2)[0], scriptableTypes) {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", attachmentCacheControl(root, nodePath))
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidAttachmentName(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Valid bool
+	}{
+		{"report.pdf", true},
+		{"Bericht 2013.PDF", true},
+		{"", false},
+		{".hidden", false},
+		{"..", false},
+		{"foo/bar.pdf", false},
+		{"foo\\bar.pdf", false},
+		{"@@edit", false},
+		{"node.yaml", false},
+		{"node.de.yaml", false},
+		{"node.de_DE.yaml", false},
+		{"navigation.yaml", false},
+		{"navigation.de.yaml", false},
+		{"node.html", true},
+		{"nodes.yaml", true}}
+	for _, v := range tests {
+		if ret := validAttachmentName(v.Name); ret != v.Valid {
+			t.Errorf("validAttachmentName(%q) = %v, should be %v", v.Name, ret,
+				v.Valid)
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":     `{"type": "Document", "title": "Foo"}`,
+		"/foo/body.html":     "body",
+		"/foo/.upload-1":     "upload",
+		"/foo/.hidden":       "hidden",
+		"/foo/bar/node.yaml": `{"type": "Document"}`}, "TestAttachments")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	check := func(step string, names ...string) {
+		attachments, err := listAttachments(root, "/foo")
+		if err != nil {
+			t.Fatalf("%v: Could not list attachments: %v", step, err)
+		}
+		var ret []string
+		for _, attachment := range attachments {
+			ret = append(ret, attachment.Name)
+		}
+		if len(ret) != len(names) {
+			t.Errorf("%v: Attachments are %v, should be %v", step, ret, names)
+			return
+		}
+		for i := range ret {
+			if ret[i] != names[i] {
+				t.Errorf("%v: Attachments are %v, should be %v", step, ret, names)
+				return
+			}
+		}
+	}
+	check("Initial", "body.html")
+	upload := filepath.Join(root, "foo", ".upload-1")
+	if err := storeAttachment(root, "/foo", "a.pdf", upload); err != nil {
+		t.Fatalf("Could not store attachment: %v", err)
+	}
+	check("Stored", "a.pdf", "body.html")
+	if err := storeAttachment(root, "/foo", "bar", upload); err == nil {
+		t.Errorf("Attachments should not replace child nodes")
+	}
+	translation := filepath.Join(root, "foo", ".upload-2")
+	if err := ioutil.WriteFile(translation, []byte("type: Evil"),
+		0600); err != nil {
+		t.Fatalf("Could not write upload: %v", err)
+	}
+	if err := storeAttachment(root, "/foo", "node.de.yaml",
+		translation); err == nil {
+		t.Errorf("Attachments should not replace translations of node.yaml")
+	}
+	if err := renameAttachment(root, "/foo", "a.pdf", "body.html"); err == nil {
+		t.Errorf("Renaming to an existing name should fail")
+	}
+	if err := renameAttachment(root, "/foo", "a.pdf", "../a.pdf"); err == nil {
+		t.Errorf("Renaming to an invalid name should fail")
+	}
+	if err := renameAttachment(root, "/foo", "a.pdf", "b.pdf"); err != nil {
+		t.Errorf("Could not rename attachment: %v", err)
+	}
+	check("Renamed", "b.pdf", "body.html")
+	if content, err := ioutil.ReadFile(filepath.Join(root, "foo",
+		"b.pdf")); err != nil || string(content) != "upload" {
+		t.Errorf("Renamed attachment should contain upload, got %q, %v",
+			content, err)
+	}
+	if err := removeAttachment(root, "/foo", "node.yaml"); err == nil {
+		t.Errorf("Removing node.yaml should fail")
+	}
+	if err := removeAttachment(root, "/foo", "b.pdf"); err != nil {
+		t.Errorf("Could not remove attachment: %v", err)
+	}
+	check("Removed", "body.html")
+	site := site{Name: "foo"}
+	site.Directories.Data = root
+	attachmentsChanged(site, "/foo", "b.pdf", "alice", auditRemove,
+		t.Logf)
+	node, err := readStoredNode(root, "/foo")
+	if err != nil || node.LastUpdateBy != "alice" || node.Title != "Foo" {
+		t.Errorf("Update stamps should be set, got %+v, %v", node, err)
+	}
+}
+
+func TestServeAttachment(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":     `{"type": "Document", "title": "Foo"}`,
+		"/foo/report.pdf":    "%PDF",
+		"/foo/page.html":     "<script></script>",
+		"/secret/node.yaml":  `{"type": "Document", "restrict": "login"}`,
+		"/secret/report.pdf": "%PDF"}, "TestServeAttachment")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path, ContentType, Disposition string
+		Status                         int
+	}{
+		{"/foo/report.pdf", "application/pdf", "", http.StatusOK},
+		{"/foo/page.html", "text/html; charset=utf-8", "attachment",
+			http.StatusOK},
+		{"/foo/node.yaml", "", "", http.StatusSeeOther},
+		{"/foo/missing.pdf", "", "", http.StatusSeeOther},
+		{"/secret/report.pdf", "", "", http.StatusSeeOther}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		h, stop := setupWorkerHandler(root, &logBuf, func(worker.Ticket) {})
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+			continue
+		}
+		if v.Status != http.StatusOK {
+			continue
+		}
+		if ret := w.Header().Get("Content-Type"); ret != v.ContentType {
+			t.Errorf("Test %v: Content-Type is %q, should be %q", i, ret,
+				v.ContentType)
+		}
+		if ret := w.Header().Get("Content-Disposition"); ret != v.Disposition {
+			t.Errorf("Test %v: Content-Disposition is %q, should be %q", i, ret,
+				v.Disposition)
+		}
+		if ret := w.Header().Get("Cache-Control"); ret != "public, max-age=3600" {
+			t.Errorf("Test %v: Wrong Cache-Control: %q", i, ret)
+		}
+	}
+}
+
+func TestServeAttachmentDirectly(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":            `{"type": "Document", "title": "Foo"}`,
+		"/foo/video.mp4":            "0123456789",
+		"/foo/sidebar.html":         "sidebar",
+		"/foo/sidebar.de.html":      "Seitenleiste",
+		"/foo/node.de.yaml":         `{"title": "Foo (de)"}`,
+		"/foo/.revisions/video.mp4": "old",
+		"/secret/node.yaml":         `{"type": "Document", "restrict": "login"}`,
+		"/secret/video.mp4":         "0123456789"},
+		"TestServeAttachmentDirectly")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path, Range, IfModifiedSince string
+		Status                       int
+		Body                         string
+	}{
+		{"/foo/video.mp4", "bytes=2-5", "", http.StatusPartialContent, "2345"},
+		{"/foo/video.mp4", "", "Mon, 02 Jan 2090 15:04:05 GMT",
+			http.StatusNotModified, ""},
+		{"/foo/node.yaml", "", "", http.StatusSeeOther, ""},
+		{"/foo/node.de.yaml", "", "", http.StatusSeeOther, ""},
+		{"/foo/sidebar.html", "", "", http.StatusSeeOther, ""},
+		{"/foo/sidebar.de.html", "", "", http.StatusSeeOther, ""},
+		{"/foo/.revisions/video.mp4", "", "", http.StatusSeeOther, ""},
+		{"/secret/video.mp4", "", "", http.StatusSeeOther, ""}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		tickets := 0
+		h, stop := setupWorkerHandler(root, &logBuf, func(worker.Ticket) {
+			tickets++
+		})
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		if len(v.Range) > 0 {
+			r.Header.Set("Range", v.Range)
+		}
+		if len(v.IfModifiedSince) > 0 {
+			r.Header.Set("If-Modified-Since", v.IfModifiedSince)
+		}
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+			continue
+		}
+		if w.Code == http.StatusSeeOther {
+			if location := w.Header().Get("Location"); location ==
+				"" || location == v.Path {
+				t.Errorf("Test %v: Should not be served, got location %q", i,
+					location)
+			}
+			continue
+		}
+		if w.Body.String() != v.Body {
+			t.Errorf("Test %v: Body is %q, should be %q", i, w.Body.String(),
+				v.Body)
+		}
+		if cookie := w.Header().Get("Set-Cookie"); len(cookie) > 0 {
+			t.Errorf("Test %v: Should not start a session, got %q", i, cookie)
+		}
+		if tickets > 0 {
+			t.Errorf("Test %v: Should not be passed to a worker", i)
+		}
+	}
+}
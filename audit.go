@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditAdd        = "add"
+	auditRemove     = "remove"
+	auditWriteNode  = "write-node"
+	auditWriteData  = "write-data"
+	auditImportNode = "import"
+	auditRevert     = "revert"
+	auditRelink     = "relink"
+)
+
+// auditPageSize is the number of records shown per page of @@audit.
+const auditPageSize = 50
+
+// auditMutex serializes writes to the audit logs of this process. Writes of
+// other processes are serialized by file locks.
+var auditMutex sync.Mutex
+
+// auditRecord is an entry of the audit log.
+type auditRecord struct {
+	// Time of the change in RFC 3339 format.
+	Time   string `json:"time"`
+	Site   string `json:"site"`
+	User   string `json:"user"`
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	// File is the changed data file, if any.
+	File string `json:"file,omitempty"`
+}
+
+// auditLogPath returns the path of the site's audit log.
+func auditLogPath(site site) string {
+	if len(site.AuditLog) > 0 {
+		return site.AuditLog
+	}
+	return filepath.Join(site.Directories.Data, ".monsti", "audit.log")
+}
+
+// appendAudit appends a record of the given change to the site's audit log.
+func appendAudit(site site, login, action, nodePath, file string) error {
+	line, err := json.Marshal(auditRecord{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Site:   site.Name,
+		User:   login,
+		Action: action,
+		Path:   nodePath,
+		File:   file})
+	if err != nil {
+		return fmt.Errorf("Could not marshal audit record: %v", err)
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	logPath := auditLogPath(site)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+		return fmt.Errorf("Could not create audit log directory: %v", err)
+	}
+	defer lockWrites(logPath)()
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open audit log: %v", err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("Could not lock audit log: %v", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Could not write audit log: %v", err)
+	}
+	return nil
+}
+
+// auditChange records the given change in the site's audit log. Failures
+// will be reported to logf.
+func auditChange(site site, login, action, nodePath, file string,
+	logf func(format string, v ...interface{})) {
+	if err := appendAudit(site, login, action, nodePath, file); err != nil {
+		logf("Could not audit %v of %q by %q: %v", action, nodePath, login, err)
+	}
+}
+
+// auditFilter selects records of the audit log.
+type auditFilter struct {
+	// Path selects records of the node at the given path and its
+	// descendants.
+	Path string
+	// From and To select records within the given time range. Zero times
+	// are ignored.
+	From, To time.Time
+}
+
+// Match returns true iff the given record matches the filter.
+func (f auditFilter) Match(record auditRecord) bool {
+	if len(f.Path) > 0 && f.Path != "/" && record.Path != f.Path &&
+		!strings.HasPrefix(record.Path, strings.TrimSuffix(f.Path, "/")+"/") {
+		return false
+	}
+	recordTime, err := time.Parse(time.RFC3339, record.Time)
+	if err != nil {
+		return false
+	}
+	if !f.From.IsZero() && recordTime.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !recordTime.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// readAudit returns the records of the audit log at the given path matching
+// the filter, newest first.
+func readAudit(logPath string, filter auditFilter) ([]auditRecord, error) {
+	f, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open audit log: %v", err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read audit log: %v", err)
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// Audit handles requests to show the site's audit log.
+//
+// The query parameters path, from and to (dates like 2006-01-02, both
+// inclusive) filter the records.
+func (h *nodeHandler) Audit(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if r.Method != "GET" {
+		panic("Request method not supported: " + r.Method)
+	}
+	query := r.URL.Query()
+	filter := auditFilter{Path: query.Get("path")}
+	if from, err := time.Parse("2006-01-02", query.Get("from")); err == nil {
+		filter.From = from
+	}
+	if to, err := time.Parse("2006-01-02", query.Get("to")); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+	records, err := readAudit(auditLogPath(site), filter)
+	if err != nil {
+		panic("Can't read audit log: " + err.Error())
+	}
+	page, pages, start, end := paginate(query.Get("page"), len(records),
+		auditPageSize)
+	pageURL := func(page int) string {
+		values := url.Values{"page": {strconv.Itoa(page)}}
+		for _, key := range []string{"path", "from", "to"} {
+			if len(query.Get(key)) > 0 {
+				values.Set(key, query.Get(key))
+			}
+		}
+		return "?" + values.Encode()
+	}
+	context := template.Context{"Records": records[start:end], "Page": page,
+		"Pages": pages, "Path": query.Get("path"), "From": query.Get("from"),
+		"To": query.Get("to")}
+	if page > 1 {
+		context["PrevURL"] = pageURL(page - 1)
+	}
+	if page < pages {
+		context["NextURL"] = pageURL(page + 1)
+	}
+	body := h.renderTemplate("daemon/actions/audit", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Audit log"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAppendAudit")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	site := site{Name: "FooSite"}
+	site.Directories.Data = dir
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := appendAudit(site, "editor", auditWriteData,
+				fmt.Sprintf("/foo/%v", i), "body.html"); err != nil {
+				t.Errorf("appendAudit failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := appendAudit(site, "admin", auditRemove, "/bar", ""); err != nil {
+		t.Fatalf("appendAudit failed: %v", err)
+	}
+	logPath := filepath.Join(dir, ".monsti", "audit.log")
+	records, err := readAudit(logPath, auditFilter{})
+	if err != nil {
+		t.Fatalf("readAudit failed: %v", err)
+	}
+	if len(records) != 21 {
+		t.Fatalf("readAudit returned %v records, should be 21", len(records))
+	}
+	if r := records[0]; r.User != "admin" || r.Action != auditRemove ||
+		r.Path != "/bar" || r.Site != "FooSite" {
+		t.Errorf("Newest record is %v, should be the removal of /bar", r)
+	}
+	records, err = readAudit(logPath, auditFilter{Path: "/foo"})
+	if err != nil || len(records) != 20 {
+		t.Errorf("readAudit for /foo returned %v records, %v, should be 20",
+			len(records), err)
+	}
+}
+
+func TestAuditFilterMatch(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2013, 4, day, 0, 0, 0, 0, time.UTC)
+	}
+	record := auditRecord{Time: "2013-04-05T12:00:00Z", Path: "/foo/bar"}
+	tests := []struct {
+		Filter auditFilter
+		Match  bool
+	}{
+		{auditFilter{}, true},
+		{auditFilter{Path: "/"}, true},
+		{auditFilter{Path: "/foo"}, true},
+		{auditFilter{Path: "/foo/"}, true},
+		{auditFilter{Path: "/foo/bar"}, true},
+		{auditFilter{Path: "/fo"}, false},
+		{auditFilter{Path: "/cruz"}, false},
+		{auditFilter{From: date(5)}, true},
+		{auditFilter{From: date(6)}, false},
+		{auditFilter{To: date(6)}, true},
+		{auditFilter{To: date(5)}, false},
+		{auditFilter{From: date(4), To: date(6), Path: "/foo"}, true}}
+	for i, v := range tests {
+		if ret := v.Filter.Match(record); ret != v.Match {
+			t.Errorf("Test %v: Match(_) = %v, should be %v", i, ret, v.Match)
+		}
+	}
+}
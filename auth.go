@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// Names of the authentication backends.
+const (
+	// authLocal authenticates against the site's users.yaml.
+	authLocal = "local"
+	// authLDAP authenticates by binding to an LDAP server.
+	authLDAP = "ldap"
+)
+
+// errWrongCredentials is returned by authentication backends if the login
+// or password is wrong.
+var errWrongCredentials = errors.New("Wrong login or password")
+
+// authUnavailableError is returned by authentication backends which could
+// not check the credentials, e.g. because the LDAP server is down.
+type authUnavailableError struct {
+	Backend string
+	Err     error
+}
+
+func (e *authUnavailableError) Error() string {
+	return fmt.Sprintf("Authentication backend %v unavailable: %v", e.Backend,
+		e.Err)
+}
+
+// authBackend authenticates users.
+type authBackend interface {
+	// Name returns the name of the backend as used in the settings.
+	Name() string
+	// Authenticate checks the given credentials.
+	//
+	// Returns the authenticated user or errWrongCredentials. Users of
+	// external backends have their External field set and will be stored as
+	// shadow users, see syncShadowUser. Returns an authUnavailableError if
+	// the credentials could not be checked.
+	Authenticate(login, password string) (*user, error)
+}
+
+// localBackend authenticates against the users of a site's users.yaml.
+type localBackend struct {
+	// ConfigDir is the site's configuration directory.
+	ConfigDir string
+}
+
+func (b localBackend) Name() string {
+	return authLocal
+}
+
+func (b localBackend) Authenticate(login, password string) (*user, error) {
+	user, err := getUser(login, b.ConfigDir)
+	if err != nil {
+		return nil, &authUnavailableError{authLocal, err}
+	}
+	if user == nil || len(user.External) > 0 ||
+		!passwordEqual(user.Password, password) {
+		return nil, errWrongCredentials
+	}
+	return user, nil
+}
+
+// ldapSettings configure the authentication against an LDAP server, e.g.
+// Active Directory.
+//
+// Users are either bound by a DN built from BindDN or searched by Filter
+// below BaseDN using the SearchDN account.
+type ldapSettings struct {
+	// URL of the server, e.g. ldap://ldap.example.com or
+	// ldaps://ldap.example.com:636.
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS.
+	StartTLS bool
+	// CACertificate is the path to a PEM file of the certificate authorities
+	// to trust. Defaults to the system's authorities.
+	CACertificate string
+	// InsecureSkipVerify disables the verification of the server's
+	// certificate. Only use it for testing!
+	InsecureSkipVerify bool
+	// BindDN is the DN of users with %s being replaced by the escaped login,
+	// e.g. uid=%s,ou=people,dc=example,dc=com.
+	BindDN string
+	// SearchDN and SearchPassword are the credentials of the account used
+	// to search users if BindDN is empty. Searches anonymously if empty.
+	SearchDN, SearchPassword string
+	// BaseDN is the DN to search users below.
+	BaseDN string
+	// Filter to search users with %s being replaced by the escaped login,
+	// e.g. (sAMAccountName=%s).
+	Filter string
+	// NameAttribute and EmailAttribute are the attributes of the users'
+	// names and email addresses. Default to cn and mail.
+	NameAttribute, EmailAttribute string
+	// GroupAttribute is the attribute listing the users' groups. Defaults to
+	// memberOf.
+	GroupAttribute string
+	// RoleGroups maps group DNs to roles. If set, the roles of LDAP users
+	// will be replaced on login by the roles of their groups. Otherwise, the
+	// roles are managed locally.
+	RoleGroups map[string]string
+}
+
+// ldapConn is a connection to an LDAP server.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// dialLDAP connects to the LDAP server of the given settings.
+var dialLDAP = func(settings ldapSettings) (ldapConn, error) {
+	server, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL: %v", err)
+	}
+	config := &tls.Config{InsecureSkipVerify: settings.InsecureSkipVerify}
+	config.ServerName = server.Host
+	if i := strings.LastIndex(server.Host, ":"); i != -1 {
+		config.ServerName = server.Host[:i]
+	}
+	if len(settings.CACertificate) > 0 {
+		pem, err := ioutil.ReadFile(settings.CACertificate)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA certificate: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %q",
+				settings.CACertificate)
+		}
+	}
+	switch server.Scheme {
+	case "ldaps":
+		return ldap.DialTLS("tcp", hostPort(server.Host, "636"), config)
+	case "ldap":
+		conn, err := ldap.Dial("tcp", hostPort(server.Host, "389"))
+		if err != nil || !settings.StartTLS {
+			return conn, err
+		}
+		if err := conn.StartTLS(config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("Unsupported URL scheme %q", server.Scheme)
+}
+
+// hostPort appends the given default port to host if it has no port.
+func hostPort(host, port string) string {
+	if strings.LastIndex(host, ":") > strings.LastIndex(host, "]") {
+		return host
+	}
+	return host + ":" + port
+}
+
+// escapeLDAPFilter escapes the special characters of the given value to be
+// used in a search filter (RFC 4515).
+func escapeLDAPFilter(value string) string {
+	var ret []byte
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '*', '(', ')', 0:
+			ret = append(ret, fmt.Sprintf("\\%02x", c)...)
+		default:
+			ret = append(ret, c)
+		}
+	}
+	return string(ret)
+}
+
+// escapeLDAPDN escapes the special characters of the given value to be used
+// as attribute value of a DN (RFC 4514).
+func escapeLDAPDN(value string) string {
+	var ret []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) != -1,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(value)-1:
+			ret = append(ret, '\\', c)
+		case c == 0:
+			ret = append(ret, `\00`...)
+		default:
+			ret = append(ret, c)
+		}
+	}
+	return string(ret)
+}
+
+// ldapBackend authenticates by binding to an LDAP server.
+type ldapBackend struct {
+	Settings ldapSettings
+}
+
+func (b ldapBackend) Name() string {
+	return authLDAP
+}
+
+// unavailable returns an authUnavailableError for the given error.
+func (b ldapBackend) unavailable(err error) error {
+	return &authUnavailableError{authLDAP, err}
+}
+
+func (b ldapBackend) Authenticate(login, password string) (*user, error) {
+	// Binds without password are anonymous binds and would always succeed.
+	if len(login) == 0 || len(password) == 0 {
+		return nil, errWrongCredentials
+	}
+	conn, err := dialLDAP(b.Settings)
+	if err != nil {
+		return nil, b.unavailable(err)
+	}
+	defer conn.Close()
+	dn, err := b.findDN(conn, login)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(dn, password); err != nil {
+		if lerr, ok := err.(*ldap.Error); ok &&
+			lerr.ResultCode == ldap.LDAPResultInvalidCredentials {
+			return nil, errWrongCredentials
+		}
+		return nil, b.unavailable(err)
+	}
+	attributes := b.attributes()
+	result, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)",
+		attributes[:], nil))
+	if err != nil {
+		return nil, b.unavailable(err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, b.unavailable(fmt.Errorf("Could not read entry %q", dn))
+	}
+	entry := result.Entries[0]
+	user := &user{External: authLDAP}
+	user.Login = login
+	user.Name = entry.GetAttributeValue(attributes[0])
+	user.Email = entry.GetAttributeValue(attributes[1])
+	if len(b.Settings.RoleGroups) > 0 {
+		user.Roles = b.groupRoles(entry.GetAttributeValues(attributes[2]))
+	}
+	return user, nil
+}
+
+// attributes returns the name, email and group attributes.
+func (b ldapBackend) attributes() [3]string {
+	ret := [3]string{b.Settings.NameAttribute, b.Settings.EmailAttribute,
+		b.Settings.GroupAttribute}
+	for i, attr := range [3]string{"cn", "mail", "memberOf"} {
+		if len(ret[i]) == 0 {
+			ret[i] = attr
+		}
+	}
+	return ret
+}
+
+// findDN returns the DN of the user with the given login.
+func (b ldapBackend) findDN(conn ldapConn, login string) (string, error) {
+	if len(b.Settings.BindDN) > 0 {
+		return fmt.Sprintf(b.Settings.BindDN, escapeLDAPDN(login)), nil
+	}
+	if err := conn.Bind(b.Settings.SearchDN,
+		b.Settings.SearchPassword); err != nil {
+		return "", b.unavailable(fmt.Errorf("Could not bind search account: %v",
+			err))
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(b.Settings.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(b.Settings.Filter, escapeLDAPFilter(login)), []string{"dn"},
+		nil))
+	if err != nil {
+		return "", b.unavailable(err)
+	}
+	// Ambiguous logins are rejected.
+	if len(result.Entries) != 1 {
+		return "", errWrongCredentials
+	}
+	return result.Entries[0].DN, nil
+}
+
+// groupRoles returns the roles mapped to the given groups. Users get at
+// least the reader role.
+func (b ldapBackend) groupRoles(groups []string) []string {
+	roles := []string{roleReader}
+	for group, role := range b.Settings.RoleGroups {
+		for _, member := range groups {
+			if strings.EqualFold(group, member) && !inStringSlice(role, roles) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// checkAuthSettings checks the authentication settings of a site.
+func checkAuthSettings(backends []string, settings ldapSettings) error {
+	for _, backend := range backends {
+		switch backend {
+		case authLocal:
+		case authLDAP:
+			if len(settings.URL) == 0 {
+				return errors.New("Missing LDAP URL")
+			}
+			if len(settings.BindDN) == 0 && (len(settings.BaseDN) == 0 ||
+				len(settings.Filter) == 0) {
+				return errors.New("Missing LDAP BindDN or BaseDN and Filter")
+			}
+		default:
+			return fmt.Errorf("Unknown authentication backend %q", backend)
+		}
+	}
+	return nil
+}
+
+// siteAuthBackends returns the authentication backends of the given site in
+// the configured order.
+func siteAuthBackends(site site) []authBackend {
+	if len(site.Auth.Backends) == 0 {
+		return []authBackend{localBackend{site.Directories.Config}}
+	}
+	backends := make([]authBackend, 0, len(site.Auth.Backends))
+	for _, name := range site.Auth.Backends {
+		switch name {
+		case authLocal:
+			backends = append(backends, localBackend{site.Directories.Config})
+		case authLDAP:
+			backends = append(backends, ldapBackend{site.Auth.LDAP})
+		}
+	}
+	return backends
+}
+
+// syncShadowUser stores the given user of an external backend in the users
+// of the site with the given configuration directory.
+//
+// Creates the shadow user on first login. Otherwise updates its name, email
+// address and, if the backend maps roles, its roles. Returns the stored
+// user.
+func syncShadowUser(configDir string, external *user) (*user, error) {
+	defer lockUsers(configDir)()
+	users, err := loadUsers(configDir)
+	if err != nil {
+		return nil, err
+	}
+	idx := findUser(users, external.Login)
+	switch {
+	case idx == -1:
+		if len(external.Roles) == 0 {
+			// Users without roles would be administrators.
+			external.Roles = []string{roleReader}
+		}
+		users = append(users, *external)
+		idx = len(users) - 1
+	case users[idx].External != external.External:
+		return nil, fmt.Errorf("User %q is not a user of backend %v",
+			external.Login, external.External)
+	default:
+		users[idx].Name = external.Name
+		users[idx].Email = external.Email
+		if len(external.Roles) > 0 {
+			users[idx].Roles = external.Roles
+		}
+	}
+	if err := saveUsers(configDir, users); err != nil {
+		return nil, err
+	}
+	return &users[idx], nil
+}
+
+// authenticate checks the given credentials against the authentication
+// backends of the given site.
+//
+// Returns the authenticated local or shadow user. Returns
+// errWrongCredentials if no backend accepted the credentials or an
+// authUnavailableError if a backend which could not check them was
+// involved.
+func authenticate(site site, login, password string) (*user, error) {
+	var unavailable error
+	for _, backend := range siteAuthBackends(site) {
+		user, err := backend.Authenticate(login, password)
+		switch {
+		case err == errWrongCredentials:
+			continue
+		case err != nil:
+			unavailable = err
+			continue
+		}
+		if len(user.External) > 0 {
+			if user, err = syncShadowUser(site.Directories.Config,
+				user); err != nil {
+				return nil, err
+			}
+		}
+		if user.Disabled {
+			return nil, errWrongCredentials
+		}
+		return user, nil
+	}
+	if unavailable != nil {
+		return nil, unavailable
+	}
+	return nil, errWrongCredentials
+}
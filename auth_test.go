@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-ldap/ldap"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"reflect"
+	"testing"
+)
+
+// fakeLDAPConn is a fake LDAP server holding the given entries.
+type fakeLDAPConn struct {
+	// Passwords maps DNs to passwords.
+	Passwords map[string]string
+	Entries   []*ldap.Entry
+	// Binds records the DNs of all bind attempts.
+	Binds []string
+}
+
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	c.Binds = append(c.Binds, username)
+	if pw, ok := c.Passwords[username]; !ok || pw != password {
+		return &ldap.Error{Err: errors.New("Invalid credentials"),
+			ResultCode: ldap.LDAPResultInvalidCredentials}
+	}
+	return nil
+}
+
+func (c *fakeLDAPConn) Search(request *ldap.SearchRequest) (*ldap.SearchResult,
+	error) {
+	result := new(ldap.SearchResult)
+	for _, entry := range c.Entries {
+		switch {
+		case request.Scope == ldap.ScopeBaseObject && entry.DN == request.BaseDN,
+			request.Scope == ldap.ScopeWholeSubtree &&
+				request.Filter == "(uid="+entry.GetAttributeValue("uid")+")":
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (c *fakeLDAPConn) Close() {}
+
+// setupFakeLDAP makes dialLDAP connect to the given connection, or fail if
+// nil. Returns a function to restore dialLDAP.
+func setupFakeLDAP(conn *fakeLDAPConn) func() {
+	dial := dialLDAP
+	dialLDAP = func(settings ldapSettings) (ldapConn, error) {
+		if conn == nil {
+			return nil, errors.New("Connection refused")
+		}
+		return conn, nil
+	}
+	return func() { dialLDAP = dial }
+}
+
+func newFakeLDAPConn() *fakeLDAPConn {
+	attr := func(name string, values ...string) *ldap.EntryAttribute {
+		return &ldap.EntryAttribute{Name: name, Values: values}
+	}
+	return &fakeLDAPConn{
+		Passwords: map[string]string{
+			"uid=alice,dc=example":     "secret",
+			"uid=bob,dc=example":       "other",
+			"cn=search,dc=example":     "search",
+			"uid=twin,ou=a,dc=example": "x",
+			"uid=twin,ou=b,dc=example": "x"},
+		Entries: []*ldap.Entry{
+			{DN: "uid=alice,dc=example", Attributes: []*ldap.EntryAttribute{
+				attr("uid", "alice"), attr("cn", "Alice"),
+				attr("mail", "alice@example.com"),
+				attr("memberOf", "CN=Editors,DC=example", "cn=staff,dc=example")}},
+			{DN: "uid=bob,dc=example", Attributes: []*ldap.EntryAttribute{
+				attr("uid", "bob"), attr("cn", "Bob")}},
+			{DN: "uid=twin,ou=a,dc=example", Attributes: []*ldap.EntryAttribute{
+				attr("uid", "twin")}},
+			{DN: "uid=twin,ou=b,dc=example", Attributes: []*ldap.EntryAttribute{
+				attr("uid", "twin")}}}}
+}
+
+func TestEscapeLDAP(t *testing.T) {
+	tests := []struct {
+		Value, Filter, DN string
+	}{
+		{"alice", "alice", "alice"},
+		{"*)(uid=*", `\2a\29\28uid=\2a`, `*)(uid\=*`},
+		{`a\b`, `a\5cb`, `a\\b`},
+		{"a,b+c", "a,b+c", `a\,b\+c`},
+		{" #a ", " #a ", `\ #a\ `},
+		{"#a", "#a", `\#a`}}
+	for _, v := range tests {
+		if ret := escapeLDAPFilter(v.Value); ret != v.Filter {
+			t.Errorf("escapeLDAPFilter(%q) = %q, should be %q", v.Value, ret,
+				v.Filter)
+		}
+		if ret := escapeLDAPDN(v.Value); ret != v.DN {
+			t.Errorf("escapeLDAPDN(%q) = %q, should be %q", v.Value, ret, v.DN)
+		}
+	}
+}
+
+func TestLDAPBackend(t *testing.T) {
+	conn := newFakeLDAPConn()
+	defer setupFakeLDAP(conn)()
+	bind := ldapBackend{ldapSettings{BindDN: "uid=%s,dc=example",
+		RoleGroups: map[string]string{"cn=editors,dc=example": "editor"}}}
+	search := ldapBackend{ldapSettings{SearchDN: "cn=search,dc=example",
+		SearchPassword: "search", BaseDN: "dc=example", Filter: "(uid=%s)"}}
+	alice := &user{External: authLDAP, Roles: []string{"reader", "editor"}}
+	alice.Login, alice.Name, alice.Email = "alice", "Alice", "alice@example.com"
+	bob := &user{External: authLDAP}
+	bob.Login, bob.Name = "bob", "Bob"
+	tests := []struct {
+		Backend         ldapBackend
+		Login, Password string
+		User            *user
+		Error           error
+	}{
+		{bind, "alice", "secret", alice, nil},
+		{bind, "alice", "wrong", nil, errWrongCredentials},
+		{bind, "alice", "", nil, errWrongCredentials},
+		{bind, "nobody", "secret", nil, errWrongCredentials},
+		{search, "bob", "other", bob, nil},
+		{search, "bob", "secret", nil, errWrongCredentials},
+		{search, "nobody", "secret", nil, errWrongCredentials},
+		{search, "twin", "x", nil, errWrongCredentials}}
+	for i, v := range tests {
+		user, err := v.Backend.Authenticate(v.Login, v.Password)
+		if err != v.Error || !reflect.DeepEqual(user, v.User) {
+			t.Errorf("Test %v: Authenticate(%q, %q) = %+v, %v, should be %+v,"+
+				" %v", i, v.Login, v.Password, user, err, v.User, v.Error)
+		}
+	}
+	if dn := conn.Binds[len(conn.Binds)-1]; dn != "cn=search,dc=example" {
+		t.Errorf("Ambiguous login has been bound as %q", dn)
+	}
+	setupFakeLDAP(nil)
+	_, err := bind.Authenticate("alice", "secret")
+	if _, ok := err.(*authUnavailableError); !ok {
+		t.Errorf("Authenticate(...) without server = %v, should be unavailable",
+			err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestAuthenticate")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := saveUsers(root, []user{
+		{User: client.User{Login: "local", Password: hashPassword("pw", 4)}},
+		{User: client.User{Login: "alice", Password: hashPassword("local", 4)},
+			Roles: []string{"admin"}}}); err != nil {
+		t.Fatalf("Could not save users: %v", err)
+	}
+	conn := newFakeLDAPConn()
+	restore := setupFakeLDAP(conn)
+	defer restore()
+	settings := ldapSettings{URL: "ldap://example.com",
+		BindDN: "uid=%s,dc=example"}
+	tests := []struct {
+		Backends        []string
+		Down            bool
+		Login, Password string
+		Authenticated   bool
+		// Failed is true if the credentials could not be checked.
+		Failed bool
+	}{
+		{nil, false, "local", "pw", true, false},
+		{nil, false, "bob", "other", false, false},
+		{[]string{"local", "ldap"}, false, "local", "pw", true, false},
+		{[]string{"local", "ldap"}, false, "bob", "other", true, false},
+		{[]string{"local", "ldap"}, true, "local", "pw", true, false},
+		{[]string{"local", "ldap"}, true, "bob", "other", false, true},
+		{[]string{"ldap", "local"}, true, "local", "pw", true, false},
+		{[]string{"ldap"}, false, "local", "pw", false, false},
+		{[]string{"ldap"}, false, "bob", "other", true, false},
+		{[]string{"ldap"}, false, "bob", "wrong", false, false},
+		// Local users must not be taken over by LDAP users.
+		{[]string{"ldap"}, false, "alice", "secret", false, true}}
+	for i, v := range tests {
+		site_ := site{}
+		site_.Directories.Config = root
+		site_.Auth.Backends = v.Backends
+		site_.Auth.LDAP = settings
+		if v.Down {
+			setupFakeLDAP(nil)
+		} else {
+			setupFakeLDAP(conn)
+		}
+		user, err := authenticate(site_, v.Login, v.Password)
+		failed := err != nil && err != errWrongCredentials
+		if (user != nil) != v.Authenticated || failed != v.Failed {
+			t.Errorf("Test %v: authenticate(_, %q, %q) = %v, %v", i, v.Login,
+				v.Password, user, err)
+		}
+	}
+	shadow := testUser(t, "bob", root)
+	if shadow == nil || shadow.External != authLDAP || shadow.Name != "Bob" ||
+		!reflect.DeepEqual(shadow.GetRoles(), []string{roleReader}) {
+		t.Errorf("Shadow user of bob is %+v", shadow)
+	}
+	if local := testUser(t, "alice", root); local.External != "" ||
+		!reflect.DeepEqual(local.Roles, []string{"admin"}) {
+		t.Errorf("Local user alice has been changed to %+v", local)
+	}
+}
+
+func TestCheckAuthSettings(t *testing.T) {
+	tests := []struct {
+		Backends []string
+		Settings ldapSettings
+		Valid    bool
+	}{
+		{nil, ldapSettings{}, true},
+		{[]string{"local"}, ldapSettings{}, true},
+		{[]string{"ldap"}, ldapSettings{}, false},
+		{[]string{"ldap"}, ldapSettings{URL: "ldap://a"}, false},
+		{[]string{"ldap"}, ldapSettings{URL: "ldap://a", BindDN: "uid=%s"},
+			true},
+		{[]string{"ldap", "local"}, ldapSettings{URL: "ldap://a",
+			BaseDN: "dc=a", Filter: "(uid=%s)"}, true},
+		{[]string{"kerberos"}, ldapSettings{}, false}}
+	for i, v := range tests {
+		if err := checkAuthSettings(v.Backends, v.Settings); (err == nil) !=
+			v.Valid {
+			t.Errorf("Test %v: checkAuthSettings(%v, %+v) = %v", i, v.Backends,
+				v.Settings, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// block is a region's content as seen from a node.
+type block struct {
+	region
+	// Content of the region.
+	Content string
+	// Source is the path of the node defining the content or empty if the
+	// region has no content.
+	Source string
+	// SourceURL is the URL of the node defining the content.
+	SourceURL string
+	// Local is true iff the content is defined by the node itself.
+	Local bool
+	// Editable is true iff the node may define own content for the region.
+	Editable bool
+}
+
+// getBlocks returns the blocks of the given regions for the node at the given
+// path of the data directory located at root.
+func getBlocks(regions []region, nodePath, root string) []block {
+	blocks := make([]block, 0, len(regions))
+	for _, reg := range regions {
+		content, source := findRegion(reg, nodePath, root, "")
+		blocks = append(blocks, block{
+			region:   reg,
+			Content:  content,
+			Source:   source,
+			Local:    source == nodePath,
+			Editable: !reg.Root || nodePath == "/"})
+	}
+	return blocks
+}
+
+// writeBlock writes or, if remove is true, removes the node's own content for
+// the given region.
+func writeBlock(site site, nodePath string, reg region, content string,
+	remove bool, login string) error {
+	root := site.Directories.Data
+	file, err := nodeFile(root, nodePath, reg.Name+".html")
+	if err != nil {
+		return err
+	}
+	if err := saveRevision(root, nodePath, reg.Name+".html", login,
+		site.MaxRevisions, time.Now()); err != nil {
+		return err
+	}
+	if remove {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove block: %v", err)
+		}
+		return nil
+	}
+	if err := writeContentFile(file, []byte(content)); err != nil {
+		return fmt.Errorf("Could not write block: %v", err)
+	}
+	return nil
+}
+
+// Blocks handles requests to edit the region content of a node.
+func (h *nodeHandler) Blocks(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	regions := siteRegions(site)
+	context := template.Context{}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		var reg *region
+		for i := range regions {
+			if regions[i].Name == r.Form.Get("Region") {
+				reg = &regions[i]
+			}
+		}
+		content := r.Form.Get("Content")
+		remove := len(r.Form.Get("Delete")) > 0
+		// Empty content hides inherited content, so it has to be requested
+		// explicitly.
+		suppress := len(r.Form.Get("Suppress")) > 0
+		switch {
+		case !validCSRFRequest(r, session, r.Form.Get("CSRFToken")):
+			context["Error"] = G("The form has expired. Please try again.")
+		case site.ReadOnly:
+			context["Error"] = G("The site is read-only.")
+		case reg == nil || (reg.Root && node.Path != "/"):
+			h.renderError(w, r, "Unknown region.", http.StatusBadRequest, node,
+				cSession, site)
+			return
+		case !remove && !suppress && len(strings.TrimSpace(content)) == 0:
+			context["Error"] = G("The content is empty. Use \"Suppress\" to hide the inherited content.")
+		default:
+			login := sessionLogin(cSession)
+			if suppress {
+				content = ""
+			}
+			if err := writeBlock(site, node.Path, *reg, content,
+				remove, login); err != nil {
+				panic("Can't write block: " + err.Error())
+			}
+			action := auditWriteData
+			if remove {
+				action = auditRemove
+			}
+			dataWritten(site, node.Path, reg.Name+".html", login, action,
+				h.requestLog(r, site.Name).Warn)
+			http.Redirect(w, r, site.URL(path.Join(node.Path, "@@blocks")),
+				http.StatusSeeOther)
+			return
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	blocks := getBlocks(regions, node.Path, site.Directories.Data)
+	for i := range blocks {
+		if len(blocks[i].Source) > 0 {
+			blocks[i].SourceURL = site.URL(blocks[i].Source)
+		}
+	}
+	context["Blocks"] = blocks
+	context["CSRFToken"] = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/blocks", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Blocks"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteBlock(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/sidebar.html":    "root sidebar",
+		"/foo/__empty__":   "",
+		"/foo/footer.html": "foo footer"}, "TestWriteBlock")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := site{}
+	site.Directories.Data = root
+	sidebar := region{Name: "sidebar", Inherit: true}
+	check := func(step, content, source string) {
+		blocks := getBlocks([]region{sidebar}, "/foo", root)
+		if blocks[0].Content != content || blocks[0].Source != source ||
+			blocks[0].Local != (source == "/foo") {
+			t.Errorf("%v: block is %+v, should be %q from %q", step, blocks[0],
+				content, source)
+		}
+	}
+	check("Initial", "root sidebar", "/")
+	if err := writeBlock(site, "/foo", sidebar, "foo sidebar", false,
+		"alice"); err != nil {
+		t.Fatalf("writeBlock failed: %v", err)
+	}
+	check("Written", "foo sidebar", "/foo")
+	if err := writeBlock(site, "/foo", sidebar, "", true, "alice"); err != nil {
+		t.Fatalf("writeBlock failed: %v", err)
+	}
+	check("Removed", "root sidebar", "/")
+	idx, err := loadRevisionIndex(filepath.Join(root, "foo", revisionsDir))
+	if err != nil || len(idx.Revisions) != 1 {
+		t.Errorf("Removed block should be kept as revision: %v, %v", idx, err)
+	}
+	blocks := getBlocks([]region{{Name: "footer", Root: true}}, "/foo", root)
+	if blocks[0].Editable || blocks[0].Source != "" {
+		t.Errorf("Root region should not be editable below root: %+v",
+			blocks[0])
+	}
+}
+
+func TestBlocksSuppress(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/sidebar.html":                    "root sidebar",
+		"/data/foo/node.yaml":                   "",
+		"/templates/master.html":                "",
+		"/templates/daemon/actions/blocks.html": ""}, "TestBlocksSuppress")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := site{}
+	site.Directories.Data = filepath.Join(root, "data")
+	site.Regions = []region{{Name: "sidebar", Inherit: true}}
+	h := nodeHandler{
+		Renderer: &templateRenderer{Root: filepath.Join(root, "templates")},
+		Settings: new(settings)}
+	session := newTestSession(nil)
+	file := filepath.Join(site.Directories.Data, "foo", "sidebar.html")
+	tests := []struct {
+		Form    url.Values
+		Status  int
+		Content string
+	}{
+		{url.Values{"Content": {" "}}, http.StatusOK, "-"},
+		{url.Values{"Suppress": {"1"}, "Content": {"foo"}}, http.StatusSeeOther,
+			""},
+		{url.Values{"Content": {"foo"}}, http.StatusSeeOther, "foo"},
+		{url.Values{"Delete": {"1"}}, http.StatusSeeOther, "-"}}
+	for i, v := range tests {
+		v.Form.Set("Region", "sidebar")
+		v.Form.Set("CSRFToken", getCSRFToken(session))
+		r, _ := http.NewRequest("POST", "http://example.com/foo/@@blocks",
+			strings.NewReader(v.Form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.Blocks(w, r, client.Node{Path: "/foo"}, session, &client.Session{},
+			site)
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+		}
+		content, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			content = []byte("-")
+		}
+		if string(content) != v.Content {
+			t.Errorf("Test %v: Block contains %q, should contain %q", i, content,
+				v.Content)
+		}
+	}
+}
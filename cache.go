@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"github.com/howeyc/fsnotify"
+	"github.com/monsti/rpc/client"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// defaultCacheEntries is the maximum number of entries of a data cache if
+// the settings don't specify another value.
+const defaultCacheEntries = 10000
+
+// Kinds of data cache entries.
+const (
+	// cacheNode entries hold parsed node.yaml files.
+	cacheNode = "node"
+	// cacheFile entries hold the content of node files like regions.
+	cacheFile = "file"
+	// cacheChildren entries hold the names of a node's child directories.
+	cacheChildren = "children"
+)
+
+// cacheKey identifies an entry of a data cache.
+type cacheKey struct {
+	Kind string
+	// Path of the node.
+	Path string
+	// Name of the file for cacheFile entries.
+	Name string
+}
+
+// cacheEntry is a memoized value or error.
+type cacheEntry struct {
+	Value interface{}
+	Err   error
+}
+
+// dataCache memoizes reads of a site's data directory.
+//
+// Entries get invalidated explicitly by the functions writing to the data
+// directory and by a watcher of the directory to catch changes made by
+// others. If the watcher fails, the cache gets disabled.
+type dataCache struct {
+	// Root is the path of the data directory.
+	Root string
+	// MaxEntries is the maximum number of cached entries.
+	MaxEntries int
+	mutex      sync.RWMutex
+	// entries maps cleaned node paths to the entries of the nodes.
+	entries map[string]map[cacheKey]cacheEntry
+	// size is the number of cached entries.
+	size int
+	// subpaths maps node paths to the paths of those children which hold
+	// entries or have descendants holding entries.
+	subpaths map[string]map[string]bool
+	// generation gets incremented on each invalidation.
+	generation int
+	// invalidated maps keys to the generation of their last invalidation,
+	// so that values loaded before won't be cached. Keys without kind stand
+	// for all entries of the node, see invalidatedTrees for descendants.
+	invalidated map[cacheKey]int
+	// invalidatedTrees maps node paths to the generation of the last
+	// invalidation of the node and its descendants.
+	invalidatedTrees map[string]int
+	// floor is the generation of the last reset of the invalidations.
+	// Values loaded before won't be cached.
+	floor    int
+	disabled bool
+	watcher  *fsnotify.Watcher
+}
+
+// dataCaches maps data directories to their caches.
+var dataCaches = make(map[string]*dataCache)
+
+// dataCachesMutex protects dataCaches.
+var dataCachesMutex sync.RWMutex
+
+// newDataCache returns a new cache for the given data directory.
+//
+// If maxEntries is not positive, defaultCacheEntries will be used.
+func newDataCache(root string, maxEntries int) *dataCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	return &dataCache{Root: root, MaxEntries: maxEntries,
+		entries:          make(map[string]map[cacheKey]cacheEntry),
+		subpaths:         make(map[string]map[string]bool),
+		invalidated:      make(map[cacheKey]int),
+		invalidatedTrees: make(map[string]int)}
+}
+
+// getDataCache returns the cache of the given data directory or nil if it
+// should be read directly.
+func getDataCache(root string) *dataCache {
+	dataCachesMutex.RLock()
+	defer dataCachesMutex.RUnlock()
+	c := dataCaches[root]
+	if c == nil {
+		return nil
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.disabled {
+		return nil
+	}
+	return c
+}
+
+// enableDataCache starts caching reads of the given data directory unless
+// it's already cached.
+//
+// Failures of the directory watcher will be reported to logf.
+func enableDataCache(root string, maxEntries int,
+	logf func(format string, v ...interface{})) {
+	dataCachesMutex.Lock()
+	defer dataCachesMutex.Unlock()
+	if _, ok := dataCaches[root]; ok {
+		return
+	}
+	c := newDataCache(root, maxEntries)
+	if err := c.watch(logf); err != nil {
+		logf("Not caching data directory %q: %v", root, err)
+		return
+	}
+	dataCaches[root] = c
+}
+
+// get returns the entry with the given key, loading it with the given
+// function if it's not cached.
+func (c *dataCache) get(key cacheKey,
+	load func() (interface{}, error)) (interface{}, error) {
+	nodePath := path.Clean("/" + key.Path)
+	c.mutex.RLock()
+	entry, ok := c.entries[nodePath][key]
+	generation := c.generation
+	c.mutex.RUnlock()
+	if ok {
+		return entry.Value, entry.Err
+	}
+	value, err := load()
+	// Only cache missing files besides successful reads. Other errors might
+	// be temporary.
+	if err != nil && !os.IsNotExist(err) {
+		return value, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.disabled || c.stale(nodePath, key.Kind, generation) {
+		return value, err
+	}
+	if c.size >= c.MaxEntries {
+		c.evict()
+	}
+	entries, ok := c.entries[nodePath]
+	if !ok {
+		entries = make(map[cacheKey]cacheEntry)
+		c.entries[nodePath] = entries
+		c.link(nodePath)
+	}
+	if _, ok := entries[key]; !ok {
+		c.size++
+	}
+	entries[key] = cacheEntry{value, err}
+	return value, err
+}
+
+// stale returns true if entries of the given kind of the node at the given
+// path have been invalidated since the given generation.
+func (c *dataCache) stale(nodePath, kind string, generation int) bool {
+	if generation < c.floor ||
+		c.invalidated[cacheKey{Path: nodePath}] > generation ||
+		c.invalidated[cacheKey{Kind: kind, Path: nodePath}] > generation {
+		return true
+	}
+	for {
+		if c.invalidatedTrees[nodePath] > generation {
+			return true
+		}
+		if nodePath == "/" {
+			return false
+		}
+		nodePath = path.Dir(nodePath)
+	}
+}
+
+// invalidate starts a new generation and records the invalidation of the
+// given key or, if tree is true, of the node at the key's path and its
+// descendants.
+func (c *dataCache) invalidate(key cacheKey, tree bool) {
+	c.generation++
+	if len(c.invalidated)+len(c.invalidatedTrees) >= c.MaxEntries {
+		// Forget old invalidations instead of all values being loaded.
+		c.invalidated = make(map[cacheKey]int)
+		c.invalidatedTrees = make(map[string]int)
+		c.floor = c.generation
+	}
+	if tree {
+		c.invalidatedTrees[key.Path] = c.generation
+	} else {
+		c.invalidated[key] = c.generation
+	}
+}
+
+// evict removes some arbitrary entry.
+func (c *dataCache) evict() {
+	for nodePath, entries := range c.entries {
+		for key := range entries {
+			delete(entries, key)
+			c.size--
+			c.unlink(nodePath)
+			return
+		}
+	}
+}
+
+// link adds the given node path to the subpaths of its ancestors.
+func (c *dataCache) link(nodePath string) {
+	for nodePath != "/" {
+		parent := path.Dir(nodePath)
+		children, ok := c.subpaths[parent]
+		if !ok {
+			children = make(map[string]bool)
+			c.subpaths[parent] = children
+		}
+		if children[nodePath] {
+			return
+		}
+		children[nodePath] = true
+		nodePath = parent
+	}
+}
+
+// unlink removes the given node path from the subpaths of its ancestors if
+// neither the node nor its descendants hold any entries.
+func (c *dataCache) unlink(nodePath string) {
+	for nodePath != "/" {
+		if len(c.entries[nodePath]) > 0 || len(c.subpaths[nodePath]) > 0 {
+			return
+		}
+		delete(c.entries, nodePath)
+		delete(c.subpaths, nodePath)
+		parent := path.Dir(nodePath)
+		delete(c.subpaths[parent], nodePath)
+		nodePath = parent
+	}
+}
+
+// remove removes the entries of the given kind of the node at the given
+// path or all of its entries if kind is empty.
+func (c *dataCache) remove(nodePath, kind string) {
+	for key := range c.entries[nodePath] {
+		if len(kind) == 0 || key.Kind == kind {
+			delete(c.entries[nodePath], key)
+			c.size--
+		}
+	}
+	c.unlink(nodePath)
+}
+
+// removeTree removes the entries of the node at the given path and its
+// descendants.
+func (c *dataCache) removeTree(nodePath string) {
+	for child := range c.subpaths[nodePath] {
+		c.removeTree(child)
+	}
+	c.remove(nodePath, "")
+}
+
+// Invalidate removes the entries of the node at the given path and its
+// descendants as well as the list of its parent's children.
+func (c *dataCache) Invalidate(nodePath string) {
+	nodePath = path.Clean("/" + nodePath)
+	parent := path.Dir(nodePath)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.invalidate(cacheKey{Path: nodePath}, true)
+	c.removeTree(nodePath)
+	c.invalidate(cacheKey{Kind: cacheChildren, Path: parent}, false)
+	c.remove(parent, cacheChildren)
+}
+
+// InvalidateNode removes the entries of the node at the given path, but
+// not those of its descendants.
+func (c *dataCache) InvalidateNode(nodePath string) {
+	nodePath = path.Clean("/" + nodePath)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.invalidate(cacheKey{Path: nodePath}, false)
+	c.remove(nodePath, "")
+}
+
+// disable clears and disables the cache, so that reads go to the data
+// directory again.
+func (c *dataCache) disable() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.disabled = true
+	c.entries = make(map[string]map[cacheKey]cacheEntry)
+	c.subpaths = make(map[string]map[string]bool)
+	c.size = 0
+}
+
+// invalidateCache invalidates the cached entries of the node at the given
+// path of the data directory located at root, see dataCache.Invalidate.
+func invalidateCache(root, nodePath string) {
+	if c := getDataCache(root); c != nil {
+		c.Invalidate(nodePath)
+	}
+}
+
+// handleEvent invalidates the entries affected by a change of the given
+// file or directory.
+func (c *dataCache) handleEvent(name string) {
+	rel, err := filepath.Rel(c.Root, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	changed := path.Clean("/" + filepath.ToSlash(rel))
+	// The changed path might be a node directory or a file of a node. Only
+	// the entries of the directory's node are affected by a changed file.
+	c.Invalidate(changed)
+	c.InvalidateNode(path.Dir(changed))
+}
+
+// watchTree adds the given directory and its non-hidden subdirectories to
+// the watcher.
+func (c *dataCache) watchTree(dir string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") && file != c.Root {
+			return filepath.SkipDir
+		}
+		return c.watcher.Watch(file)
+	})
+}
+
+// watch starts watching the data directory for changes.
+//
+// If the watcher fails later on, the failure will be reported to logf and
+// the cache gets disabled.
+func (c *dataCache) watch(logf func(format string, v ...interface{})) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("Could not create watcher: %v", err)
+	}
+	c.watcher = watcher
+	if err := c.watchTree(c.Root); err != nil {
+		watcher.Close()
+		return fmt.Errorf("Could not watch data directory: %v", err)
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Event:
+				if !ok {
+					return
+				}
+				c.handleEvent(event.Name)
+				if info, err := os.Stat(event.Name); event.IsCreate() &&
+					err == nil && info.IsDir() {
+					if err := c.watchTree(event.Name); err != nil {
+						c.fail(err, logf)
+						return
+					}
+				}
+			case err, ok := <-watcher.Error:
+				if !ok {
+					return
+				}
+				c.fail(err, logf)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// fail disables the cache after a failure of its watcher.
+func (c *dataCache) fail(err error, logf func(format string,
+	v ...interface{})) {
+	logf("Watcher of data directory %q failed, disabling cache: %v", c.Root,
+		err)
+	c.disable()
+	c.watcher.Close()
+}
+
+// Node returns the node at the given path.
+func (c *dataCache) Node(nodePath string) (client.Node, error) {
+	value, err := c.get(cacheKey{Kind: cacheNode, Path: nodePath},
+		func() (interface{}, error) {
+			return readNode(c.Root, nodePath)
+		})
+	node, _ := value.(client.Node)
+	return node, err
+}
+
+// File returns the content of the given file of the node at the given path.
+func (c *dataCache) File(nodePath, name string) ([]byte, error) {
+	value, err := c.get(cacheKey{Kind: cacheFile, Path: nodePath, Name: name},
+		func() (interface{}, error) {
+			return readNodeFile(c.Root, nodePath, name)
+		})
+	content, _ := value.([]byte)
+	return content, err
+}
+
+// Children returns the names of the child directories of the node at the
+// given path, including hidden ones.
+func (c *dataCache) Children(nodePath string) ([]string, error) {
+	value, err := c.get(cacheKey{Kind: cacheChildren, Path: nodePath},
+		func() (interface{}, error) {
+			return readChildren(c.Root, nodePath)
+		})
+	children, _ := value.([]string)
+	return children, err
+}
+
+// readNodeFile returns the content of the given file of the node at the
+// given path of the data directory located at root.
+func readNodeFile(root, nodePath, name string) ([]byte, error) {
+	file, err := nodeFile(root, nodePath, name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file)
+}
+
+// readChildren returns the names of the child directories of the node at
+// the given path of the data directory located at root.
+func readChildren(root, nodePath string) ([]string, error) {
+	dir, err := nodeFile(root, nodePath, "")
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read node directory: %v", err)
+	}
+	var children []string
+	for _, info := range infos {
+		if info.IsDir() {
+			children = append(children, info.Name())
+		}
+	}
+	return children, nil
+}
+
+// getNodeFile returns the content of the given file of the node at the given
+// path of the data directory located at root, using its cache if enabled.
+func getNodeFile(root, nodePath, name string) ([]byte, error) {
+	if c := getDataCache(root); c != nil {
+		return c.File(nodePath, name)
+	}
+	return readNodeFile(root, nodePath, name)
+}
+
+// getChildren returns the names of the child directories of the node at the
+// given path of the data directory located at root, using its cache if
+// enabled.
+func getChildren(root, nodePath string) ([]string, error) {
+	if c := getDataCache(root); c != nil {
+		return c.Children(nodePath)
+	}
+	return readChildren(root, nodePath)
+}
+
+// enableCaches enables the caches of the given sites' data directories if
+// configured by the given settings.
+func (h *nodeHandler) enableCaches(settings *settings, sites map[string]site) {
+	if !settings.Cache.Enabled {
+		return
+	}
+	for name, site := range sites {
+		enableDataCache(site.Directories.Data, settings.Cache.MaxEntries,
+			h.SiteLog(name).Warn)
+	}
+}
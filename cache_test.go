@@ -0,0 +1,210 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useDataCache registers the given cache for its data directory until the
+// returned function gets called.
+func useDataCache(c *dataCache) func() {
+	dataCachesMutex.Lock()
+	dataCaches[c.Root] = c
+	dataCachesMutex.Unlock()
+	return func() {
+		dataCachesMutex.Lock()
+		delete(dataCaches, c.Root)
+		dataCachesMutex.Unlock()
+	}
+}
+
+func TestDataCache(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":     `{"type": "Document", "title": "Root"}`,
+		"/sidebar.html":  "root sidebar",
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestDataCache")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	c := newDataCache(root, 0)
+	defer useDataCache(c)()
+	sidebar := region{Name: "sidebar", Inherit: true}
+	check := func(step, title, content string) {
+		node, err := lookupNode(root, "/foo")
+		if err != nil || node.Title != title {
+			t.Errorf("%v: lookupNode(...) = %v, %v, should have title %q", step,
+				node, err, title)
+		}
+		if ret := getRegion(sidebar, "/foo", root, ""); ret != content {
+			t.Errorf("%v: Sidebar is %q, should be %q", step, ret, content)
+		}
+	}
+	check("Initial", "Foo", "root sidebar")
+	file := filepath.Join(root, "foo", "node.yaml")
+	ioutil.WriteFile(file, []byte(`{"type": "Document", "title": "Bar"}`),
+		0600)
+	ioutil.WriteFile(filepath.Join(root, "foo", "sidebar.html"),
+		[]byte("foo sidebar"), 0600)
+	check("Cached", "Foo", "root sidebar")
+	c.handleEvent(file)
+	check("Watched", "Bar", "foo sidebar")
+	if err := writeNode(client.Node{Path: "/foo", Type: "Document",
+		Title: "Baz"}, "alice", root); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	check("Written", "Baz", "foo sidebar")
+	if err := writeNode(client.Node{Path: "/bar", Type: "Document",
+		Title: "Bar"}, "alice", root); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if children, err := getChildren(root, "/"); err != nil ||
+		len(children) != 3 {
+		t.Errorf("New node should be listed, got %v, %v", children, err)
+	}
+	removeNode("/foo", "alice", root, nil)
+	if _, err := lookupNode(root, "/foo"); err == nil {
+		t.Errorf("Removed node should not be found")
+	}
+	c.disable()
+	if getDataCache(root) != nil {
+		t.Errorf("Disabled cache should not be used")
+	}
+	if _, err := os.Stat(filepath.Join(root, "bar", "node.yaml")); err != nil {
+		t.Errorf("Node should have been written: %v", err)
+	}
+}
+
+func TestDataCacheEvent(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":         `{"type": "Document"}`,
+		"/foo/node.yaml":     `{"type": "Document"}`,
+		"/foo/sub/node.yaml": `{"type": "Document"}`,
+		"/bar/node.yaml":     `{"type": "Document"}`,
+		"/bar/sub/node.yaml": `{"type": "Document"}`}, "TestDataCacheEvent")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	c := newDataCache(root, 0)
+	cached := func(key cacheKey) bool {
+		_, ok := c.entries[key.Path][key]
+		return ok
+	}
+	load := func() {
+		for _, nodePath := range []string{"/", "/foo", "/foo/sub", "/bar",
+			"/bar/sub"} {
+			c.Node(nodePath)
+			c.Children(nodePath)
+		}
+	}
+	tests := []struct {
+		Changed string
+		Kept    []cacheKey
+		Removed []cacheKey
+	}{
+		{"/foo/node.yaml",
+			[]cacheKey{{cacheNode, "/bar", ""}, {cacheNode, "/bar/sub", ""},
+				{cacheNode, "/foo/sub", ""}, {cacheChildren, "/", ""},
+				{cacheNode, "/", ""}},
+			[]cacheKey{{cacheNode, "/foo", ""}}},
+		{"/foo",
+			[]cacheKey{{cacheNode, "/bar", ""}, {cacheNode, "/bar/sub", ""},
+				{cacheChildren, "/bar", ""}},
+			[]cacheKey{{cacheNode, "/foo", ""}, {cacheNode, "/foo/sub", ""},
+				{cacheChildren, "/", ""}}}}
+	for _, v := range tests {
+		load()
+		c.handleEvent(filepath.Join(root, filepath.FromSlash(v.Changed)))
+		for _, key := range v.Kept {
+			if !cached(key) {
+				t.Errorf("Change of %q removed entry %v", v.Changed, key)
+			}
+		}
+		for _, key := range v.Removed {
+			if cached(key) {
+				t.Errorf("Change of %q kept entry %v", v.Changed, key)
+			}
+		}
+	}
+	// Loads started before an invalidation of another node get cached.
+	c = newDataCache(root, 0)
+	c.get(cacheKey{cacheNode, "/bar", ""}, func() (interface{}, error) {
+		c.handleEvent(filepath.Join(root, "foo", "node.yaml"))
+		return readNode(root, "/bar")
+	})
+	c.get(cacheKey{cacheNode, "/foo", ""}, func() (interface{}, error) {
+		c.handleEvent(filepath.Join(root, "foo", "node.yaml"))
+		return readNode(root, "/foo")
+	})
+	if !cached(cacheKey{cacheNode, "/bar", ""}) ||
+		cached(cacheKey{cacheNode, "/foo", ""}) {
+		t.Errorf("Only the unchanged node should be cached")
+	}
+}
+
+func TestDataCacheMaxEntries(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/a/node.yaml": `{"type": "Document"}`,
+		"/b/node.yaml": `{"type": "Document"}`,
+		"/c/node.yaml": `{"type": "Document"}`}, "TestDataCacheMaxEntries")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	c := newDataCache(root, 2)
+	for _, nodePath := range []string{"/a", "/b", "/c", "/missing"} {
+		c.Node(nodePath)
+	}
+	if c.size != 2 {
+		t.Errorf("Cache should hold 2 entries, got %v", c.size)
+	}
+}
+
+// benchmarkPageData reads the data needed to render a page like the
+// daemon does on each request.
+func benchmarkPageData(b *testing.B, cached bool) {
+	files := map[string]string{
+		"/node.yaml":    `{"type": "Document", "title": "Root"}`,
+		"/sidebar.html": "sidebar",
+		"/footer.html":  "footer"}
+	for _, a := range []string{"a", "b", "c", "d"} {
+		files["/"+a+"/node.yaml"] = `{"type": "Document", "title": "A"}`
+		for _, b := range []string{"a", "b", "c", "d"} {
+			files["/"+a+"/"+b+"/node.yaml"] = `{"type": "Document", "title": "B"}`
+		}
+	}
+	root, cleanup, err := utesting.CreateDirectoryTree(files,
+		"BenchmarkPageData")
+	if err != nil {
+		b.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if cached {
+		defer useDataCache(newDataCache(root, 0))()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		node, err := lookupNode(root, "/b/c")
+		if err != nil {
+			b.Fatalf("Could not find node: %v", err)
+		}
+		translateNode(root, node, "de")
+		getNav("/", "/b/c", root, nil, "de")
+		getNav("/b/c", "/b/c", root, nil, "de")
+		getRegions(defaultRegions, "/b/c", root, "de")
+	}
+}
+
+func BenchmarkPageDataUncached(b *testing.B) {
+	benchmarkPageData(b, false)
+}
+
+func BenchmarkPageDataCached(b *testing.B) {
+	benchmarkPageData(b, true)
+}
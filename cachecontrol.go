@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// cacheRule sets the Cache-Control header of the nodes matching Path.
+type cacheRule struct {
+	// Path is a glob pattern like /news/* if it contains any of *?[, or a
+	// prefix otherwise. Prefixes match the node itself and its
+	// descendants, e.g. /legal matches /legal and /legal/imprint.
+	Path string
+	// Value of the Cache-Control header, e.g. "public, max-age=86400".
+	Value string
+}
+
+// matches returns true if the rule applies to the node at the given path.
+func (c cacheRule) matches(nodePath string) bool {
+	nodePath = path.Clean("/" + nodePath)
+	if strings.ContainsAny(c.Path, "*?[") {
+		ok, _ := path.Match(c.Path, nodePath)
+		return ok
+	}
+	prefix := path.Clean("/" + c.Path)
+	return prefix == "/" || nodePath == prefix ||
+		strings.HasPrefix(nodePath, prefix+"/")
+}
+
+// checkCacheRules checks the patterns of the given rules.
+func checkCacheRules(rules []cacheRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Path, "/"); err != nil {
+			return fmt.Errorf("Invalid cache rule path %q: %v", rule.Path, err)
+		}
+		if len(rule.Value) == 0 {
+			return fmt.Errorf("Cache rule for %q has no value", rule.Path)
+		}
+	}
+	return nil
+}
+
+// cacheControl returns the Cache-Control header of the response for the
+// given node path and action, or an empty string if there is none.
+//
+// The first matching rule of the site applies to anonymous responses.
+// Responses to actions and authenticated users must never be stored.
+// Sites without rules don't get any header.
+func cacheControl(site site, nodePath, action string,
+	authenticated bool) string {
+	if len(site.CacheControl) == 0 {
+		return ""
+	}
+	if len(action) > 0 || authenticated {
+		return "no-store"
+	}
+	for _, rule := range site.CacheControl {
+		if rule.matches(nodePath) {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+// uncacheableCookies makes responses setting cookies private.
+//
+// Shared caches would otherwise store the cookie, e.g. of an anonymous
+// user's new session, and hand it out to other clients.
+func uncacheableCookies(header http.Header) {
+	value := strings.ToLower(header.Get("Cache-Control"))
+	if len(header.Get("Set-Cookie")) == 0 || len(value) == 0 ||
+		strings.Contains(value, "no-store") {
+		return
+	}
+	header.Set("Cache-Control", "private, no-store")
+}
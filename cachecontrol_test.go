@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheControl(t *testing.T) {
+	site_ := site{CacheControl: []cacheRule{
+		{"/news/archive", "public, max-age=3600"},
+		{"/news/*", "no-cache"},
+		{"/news", "public, max-age=60"},
+		{"/legal/", "public, max-age=86400"},
+		{"/", "public, max-age=300"}}}
+	tests := []struct {
+		Path, Action  string
+		Authenticated bool
+		Value         string
+	}{
+		{"/news/archive/2013/", "", false, "public, max-age=3600"},
+		{"/news/foo/", "", false, "no-cache"},
+		{"/news/foo/bar/", "", false, "public, max-age=60"},
+		{"/news/", "", false, "public, max-age=60"},
+		{"/newsletter/", "", false, "public, max-age=300"},
+		{"/legal/", "", false, "public, max-age=86400"},
+		{"/legal/imprint/", "", false, "public, max-age=86400"},
+		{"/", "", false, "public, max-age=300"},
+		{"/legal/", "edit", false, "no-store"},
+		{"/legal/", "", true, "no-store"},
+		{"/news/foo/", "", true, "no-store"}}
+	for i, v := range tests {
+		ret := cacheControl(site_, v.Path, v.Action, v.Authenticated)
+		if ret != v.Value {
+			t.Errorf("Test %v: cacheControl(_, %q, %q, %v) = %q, should be %q",
+				i, v.Path, v.Action, v.Authenticated, ret, v.Value)
+		}
+	}
+	for _, authenticated := range []bool{false, true} {
+		if ret := cacheControl(site{}, "/foo/", "edit",
+			authenticated); ret != "" {
+			t.Errorf("Sites without rules should not get headers, got %q", ret)
+		}
+	}
+}
+
+func TestCheckCacheRules(t *testing.T) {
+	tests := []struct {
+		Rules []cacheRule
+		Valid bool
+	}{
+		{nil, true},
+		{[]cacheRule{{"/news/*", "no-cache"}}, true},
+		{[]cacheRule{{"/news/[", "no-cache"}}, false},
+		{[]cacheRule{{"/news/", ""}}, false}}
+	for i, v := range tests {
+		if err := checkCacheRules(v.Rules); (err == nil) != v.Valid {
+			t.Errorf("Test %v: checkCacheRules(%v) returned %v", i, v.Rules, err)
+		}
+	}
+}
+
+func TestServeCacheControl(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestServeCacheControl")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	h, stop := setupWorkerHandler(root, ioutil.Discard,
+		func(ticket worker.Ticket) {
+			ticket.ResponseChan <- client.Response{Body: []byte("Foo"), Raw: true}
+		})
+	defer stop()
+	site_, _ := h.Sites.Get("foo")
+	site_.CacheControl = []cacheRule{{"/foo", "public, max-age=60"}}
+	h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+	h.ServeHTTP(w, r)
+	if value := w.Header().Get("Cache-Control"); value != "public, max-age=60" {
+		t.Errorf("Cache-Control is %q, should be public, max-age=60", value)
+	}
+}
+
+func TestUncacheableCookies(t *testing.T) {
+	tests := []struct {
+		Cookie, Value, Expected string
+	}{
+		{"", "public, max-age=60", "public, max-age=60"},
+		{"session=foo", "public, max-age=60", "private, no-store"},
+		{"session=foo", "no-cache", "private, no-store"},
+		{"session=foo", "no-store", "no-store"},
+		{"session=foo", "", ""}}
+	for i, v := range tests {
+		header := http.Header{}
+		if len(v.Cookie) > 0 {
+			header.Set("Set-Cookie", v.Cookie)
+		}
+		if len(v.Value) > 0 {
+			header.Set("Cache-Control", v.Value)
+		}
+		uncacheableCookies(header)
+		if ret := header.Get("Cache-Control"); ret != v.Expected {
+			t.Errorf("Test %v: Cache-Control is %q, should be %q", i, ret,
+				v.Expected)
+		}
+	}
+}
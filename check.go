@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dataProblem is a problem found in a data directory.
+type dataProblem struct {
+	// File is the path of the affected file.
+	File string
+	// Reason describes the problem.
+	Reason string
+}
+
+// checkNodeFile checks the given node.yaml file.
+//
+// The node's type must be among the given node types. If full is true, the
+// timestamps will be checked as well.
+func checkNodeFile(file string, nodeTypes []string, full bool) []string {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []string{fmt.Sprintf("Could not read file: %v", err)}
+	}
+	var node storedNode
+	if err := goyaml.Unmarshal(content, &node); err != nil {
+		return []string{fmt.Sprintf("Could not parse node: %v", err)}
+	}
+	var reasons []string
+	switch {
+	case len(node.Type) == 0:
+		reasons = append(reasons, "Missing node type")
+	case !inStringSlice(node.Type, nodeTypes):
+		reasons = append(reasons, fmt.Sprintf("Unknown node type %q",
+			node.Type))
+	}
+	switch node.NavOrder {
+	case "", navOrderManual, navOrderAlphabetical, navOrderCreatedDesc,
+		navOrderCreatedAsc:
+	default:
+		reasons = append(reasons, fmt.Sprintf("Unknown navigation order %q",
+			node.NavOrder))
+	}
+	if !full {
+		return reasons
+	}
+	for _, stamp := range []struct{ Name, Value string }{
+		{"Created", node.Created}, {"LastUpdate", node.LastUpdate}} {
+		if len(stamp.Value) == 0 {
+			continue
+		}
+		if _, err := time.Parse(nodeTimeFormat, stamp.Value); err != nil {
+			reasons = append(reasons, fmt.Sprintf("Invalid timestamp %v: %q",
+				stamp.Name, stamp.Value))
+		}
+	}
+	return reasons
+}
+
+// checkDataDir checks the node.yaml files of the data directory located at
+// root, see checkNodeFile.
+//
+// Unreadable directories and broken files get reported without stopping
+// the check.
+func checkDataDir(root string, nodeTypes []string,
+	full bool) []dataProblem {
+	var problems []dataProblem
+	filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			problems = append(problems, dataProblem{file, err.Error()})
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && file != root {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.Name() != "node.yaml" {
+			return nil
+		}
+		for _, reason := range checkNodeFile(file, nodeTypes, full) {
+			problems = append(problems, dataProblem{file, reason})
+		}
+		return nil
+	})
+	return problems
+}
+
+// checkSites checks the data directories of the given sites and writes a
+// summary to w.
+//
+// Returns the number of problems found.
+func checkSites(w io.Writer, sites map[string]site, nodeTypes []string) int {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	total := 0
+	for _, name := range names {
+		problems := checkDataDir(sites[name].Directories.Data, nodeTypes, true)
+		total += len(problems)
+		fmt.Fprintf(w, "Site %v: %v problem(s)\n", name, len(problems))
+		for _, problem := range problems {
+			fmt.Fprintf(w, "  %v: %v\n", problem.File, problem.Reason)
+		}
+	}
+	return total
+}
+
+// checkSitesOnStartup checks the data directories of the given sites and
+// logs the problems found as warnings of the sites' logs.
+func (h *nodeHandler) checkSitesOnStartup(sites map[string]site,
+	nodeTypes []string) {
+	for name, site := range sites {
+		for _, problem := range checkDataDir(site.Directories.Data, nodeTypes,
+			false) {
+			h.SiteLog(name).Warn("Data check: %v: %v", problem.File,
+				problem.Reason)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	utesting "github.com/monsti/util/testing"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckDataDir(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":           `{"type": "Document"}`,
+		"/broken/node.yaml":    `{"type": `,
+		"/unknown/node.yaml":   `{"type": "Gallery"}`,
+		"/untyped/node.yaml":   `{"title": "Untyped"}`,
+		"/stamps/node.yaml":    `{"type": "Document", "lastupdate": "yesterday"}`,
+		"/stamps/a/node.yaml":  `{"type": "Document"}`,
+		"/.hidden/node.yaml":   `{"type": `,
+		"/broken/b/node.yaml":  `{"type": "Gallery"}`,
+		"/stamps/a/other.yaml": `{"type": `}, "TestCheckDataDir")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodeTypes := []string{"Document"}
+	tests := []struct {
+		Full     bool
+		Problems []string
+	}{
+		{false, []string{"/broken/b", "/broken", "/unknown", "/untyped"}},
+		{true, []string{"/broken/b", "/broken", "/stamps", "/unknown",
+			"/untyped"}}}
+	for _, v := range tests {
+		problems := checkDataDir(root, nodeTypes, v.Full)
+		var ret []string
+		for _, problem := range problems {
+			rel, _ := filepath.Rel(root, filepath.Dir(problem.File))
+			ret = append(ret, "/"+filepath.ToSlash(rel))
+		}
+		if strings.Join(ret, " ") != strings.Join(v.Problems, " ") {
+			t.Errorf("checkDataDir(..., %v) found problems in %v, should be %v",
+				v.Full, ret, v.Problems)
+		}
+	}
+	site_ := site{Name: "foo"}
+	site_.Directories.Data = root
+	var out bytes.Buffer
+	if n := checkSites(&out, map[string]site{"foo": site_},
+		nodeTypes); n != 5 || !strings.HasPrefix(out.String(),
+		"Site foo: 5 problem(s)\n") {
+		t.Errorf("checkSites(...) = %v, wrote %q", n, out.String())
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// corsSettings configure cross-origin requests to the API endpoints, i.e.
+// @@json and requests authenticated by API tokens.
+type corsSettings struct {
+	// Origins allowed to access the API, e.g. https://app.example.com or
+	// https://*.example.com for any subdomain. "*" allows any origin, but
+	// can't be combined with Credentials.
+	Origins []string
+	// Methods allowed for cross-origin requests. Defaults to GET and POST.
+	Methods []string
+	// Headers allowed for cross-origin requests. Defaults to Authorization
+	// and Content-Type.
+	Headers []string
+	// MaxAge is the time in seconds browsers may cache preflight results.
+	MaxAge int
+	// Credentials allows requests including cookies.
+	Credentials bool
+}
+
+// checkCORSSettings checks the given CORS settings.
+//
+// Any origin may not send requests including cookies, as any website could
+// act on behalf of the site's users otherwise.
+func checkCORSSettings(c corsSettings) error {
+	if !c.Credentials {
+		return nil
+	}
+	for _, pattern := range c.Origins {
+		if pattern == "*" {
+			return fmt.Errorf("Origin \"*\" can't be used with credentials")
+		}
+	}
+	return nil
+}
+
+// matchOrigin returns true if the given origin matches the given pattern.
+//
+// Schemes and ports must match exactly. Hosts of patterns may start with
+// "*." to match any subdomain.
+func matchOrigin(origin, pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	originURL, err := url.Parse(strings.ToLower(origin))
+	if err != nil || len(originURL.Host) == 0 {
+		return false
+	}
+	patternURL, err := url.Parse(strings.ToLower(pattern))
+	if err != nil || originURL.Scheme != patternURL.Scheme {
+		return false
+	}
+	if strings.HasPrefix(patternURL.Host, "*.") {
+		return strings.HasSuffix(originURL.Host, patternURL.Host[1:])
+	}
+	return originURL.Host == patternURL.Host
+}
+
+// AllowOrigin returns true if the given origin might access the API.
+func (c corsSettings) AllowOrigin(origin string) bool {
+	if len(origin) == 0 || origin == "null" {
+		return false
+	}
+	for _, pattern := range c.Origins {
+		if matchOrigin(origin, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// methods returns the allowed methods.
+func (c corsSettings) methods() []string {
+	if len(c.Methods) == 0 {
+		return []string{"GET", "POST"}
+	}
+	return c.Methods
+}
+
+// headers returns the allowed request headers.
+func (c corsSettings) headers() []string {
+	if len(c.Headers) == 0 {
+		return []string{"Authorization", "Content-Type"}
+	}
+	return c.Headers
+}
+
+// allowHeaders returns true if all headers of the given comma separated
+// list are allowed.
+func (c corsSettings) allowHeaders(list string) bool {
+	for _, header := range strings.Split(list, ",") {
+		header = strings.TrimSpace(header)
+		if len(header) == 0 {
+			continue
+		}
+		allowed := false
+		for _, v := range c.headers() {
+			allowed = allowed || strings.EqualFold(v, header)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// isPreflight returns true if the given request is a CORS preflight
+// request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && len(r.Header.Get("Origin")) > 0 &&
+		len(r.Header.Get("Access-Control-Request-Method")) > 0
+}
+
+// corsRequest returns true if CORS applies to the given request for the
+// given action.
+//
+// Preflight requests don't carry the Authorization header, so they apply
+// if the actual request will.
+func corsRequest(r *http.Request, action string) bool {
+	if action == "json" {
+		return true
+	}
+	if isPreflight(r) {
+		return strings.Contains(strings.ToLower(
+			r.Header.Get("Access-Control-Request-Headers")), "authorization")
+	}
+	_, ok := bearerToken(r)
+	return ok
+}
+
+// handleCORS sets the CORS headers of responses to API requests of allowed
+// origins.
+//
+// Preflight requests get answered without creating a session. Returns true
+// if the request has been answered. Requests of other origins don't get any
+// CORS headers, so browsers will deny access to the response.
+func handleCORS(w http.ResponseWriter, r *http.Request, settings corsSettings,
+	action string) bool {
+	preflight := isPreflight(r)
+	if !corsRequest(r, action) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	header := w.Header()
+	allowed := settings.AllowOrigin(origin)
+	if preflight {
+		allowed = allowed && inStringSlice(
+			r.Header.Get("Access-Control-Request-Method"), settings.methods()) &&
+			settings.allowHeaders(r.Header.Get("Access-Control-Request-Headers"))
+	}
+	if allowed {
+		header.Set("Access-Control-Allow-Origin", origin)
+		if settings.Credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if len(settings.Origins) > 0 {
+		header.Add("Vary", "Origin")
+	}
+	if !preflight {
+		return false
+	}
+	if allowed {
+		header.Set("Access-Control-Allow-Methods",
+			strings.Join(settings.methods(), ", "))
+		header.Set("Access-Control-Allow-Headers",
+			strings.Join(settings.headers(), ", "))
+		if settings.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(settings.MaxAge))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
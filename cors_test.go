@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		Origin, Pattern string
+		Match           bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://APP.example.com", "https://app.example.com", true},
+		{"http://app.example.com", "https://app.example.com", false},
+		{"https://app.example.com:8443", "https://app.example.com", false},
+		{"https://app.example.com:8443", "https://app.example.com:8443", true},
+		{"https://a.b.example.com", "https://*.example.com", true},
+		{"https://example.com", "https://*.example.com", false},
+		{"https://evilexample.com", "https://*.example.com", false},
+		{"https://example.com.evil.org", "https://*.example.com", false},
+		{"https://foo.org", "*", true},
+		{"null", "https://example.com", false}}
+	for _, v := range tests {
+		if ret := matchOrigin(v.Origin, v.Pattern); ret != v.Match {
+			t.Errorf("matchOrigin(%q, %q) = %v, should be %v", v.Origin,
+				v.Pattern, ret, v.Match)
+		}
+	}
+}
+
+func TestCheckCORSSettings(t *testing.T) {
+	tests := []struct {
+		Settings corsSettings
+		OK       bool
+	}{
+		{corsSettings{}, true},
+		{corsSettings{Origins: []string{"*"}}, true},
+		{corsSettings{Origins: []string{"https://*.example.com"},
+			Credentials: true}, true},
+		{corsSettings{Origins: []string{"https://example.com", "*"},
+			Credentials: true}, false}}
+	for i, v := range tests {
+		if err := checkCORSSettings(v.Settings); (err == nil) != v.OK {
+			t.Errorf("Test %v: checkCORSSettings(%+v) returned %v", i, v.Settings,
+				err)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestCORS")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Method, Path, Origin string
+		// Headers are additional request headers.
+		Headers map[string]string
+		Status  int
+		// Allowed is the expected Access-Control-Allow-Origin header.
+		Allowed string
+		Methods string
+	}{
+		{"OPTIONS", "/foo/@@json", "https://app.example.com", map[string]string{
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "authorization"},
+			http.StatusNoContent, "https://app.example.com", "GET, POST"},
+		{"OPTIONS", "/foo/", "https://a.sub.example.com", map[string]string{
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "Authorization, Content-Type"},
+			http.StatusNoContent, "https://a.sub.example.com", "GET, POST"},
+		{"OPTIONS", "/foo/@@json", "https://app.example.com", map[string]string{
+			"Access-Control-Request-Method": "DELETE"},
+			http.StatusNoContent, "", ""},
+		{"OPTIONS", "/foo/@@json", "https://app.example.com", map[string]string{
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "X-Custom"},
+			http.StatusNoContent, "", ""},
+		{"OPTIONS", "/foo/@@json", "https://evil.org", map[string]string{
+			"Access-Control-Request-Method": "GET"},
+			http.StatusNoContent, "", ""},
+		{"GET", "/foo/@@json", "https://app.example.com", nil, http.StatusOK,
+			"https://app.example.com", ""},
+		{"GET", "/foo/@@json", "https://evil.org", nil, http.StatusOK, "", ""},
+		{"GET", "/foo/@@json", "", nil, http.StatusOK, "", ""}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		worked := false
+		h, stop := setupWorkerHandler(root, &logBuf, func(worker.Ticket) {
+			worked = true
+		})
+		site_, _ := h.Sites.Get("foo")
+		site_.CORS = corsSettings{Origins: []string{"https://app.example.com",
+			"https://*.sub.example.com"}, MaxAge: 600}
+		h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(v.Method, "http://example.com"+v.Path, nil)
+		if len(v.Origin) > 0 {
+			r.Header.Set("Origin", v.Origin)
+		}
+		for key, value := range v.Headers {
+			r.Header.Set(key, value)
+		}
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+		}
+		header := w.Header()
+		if allowed := header.Get("Access-Control-Allow-Origin"); allowed !=
+			v.Allowed {
+			t.Errorf("Test %v: Allowed origin is %q, should be %q", i, allowed,
+				v.Allowed)
+		}
+		if len(v.Allowed) > 0 && header.Get("Vary") != "Origin" {
+			t.Errorf("Test %v: Missing Vary header", i)
+		}
+		if methods := header.Get("Access-Control-Allow-Methods"); methods !=
+			v.Methods {
+			t.Errorf("Test %v: Allowed methods are %q, should be %q", i, methods,
+				v.Methods)
+		}
+		if v.Method == "OPTIONS" {
+			if worked || len(header.Get("Set-Cookie")) > 0 {
+				t.Errorf("Test %v: Preflight request invoked the worker or created"+
+					" a session", i)
+			}
+			if maxAge := header.Get("Access-Control-Max-Age"); (maxAge ==
+				"600") != (len(v.Allowed) > 0) {
+				t.Errorf("Test %v: Max age is %q", i, maxAge)
+			}
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronAction is the action of the tickets of scheduled tasks. It can't be
+// requested over HTTP.
+const cronAction = "cron"
+
+// cronStatePath is the path of the file holding the times of the last
+// scheduled runs relative to the data directory.
+const cronStatePath = ".monsti/cron.yaml"
+
+// cronMacros maps the shortcuts of cron expressions to the expressions.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *"}
+
+// cronSpec is a parsed cron expression. The fields are bit sets of the
+// matching values.
+type cronSpec struct {
+	Minute, Hour, Day, Month, Weekday uint64
+	// AnyDay and AnyWeekday are true if the day of month or the day of
+	// week is *. If neither is, days matching any of them match.
+	AnyDay, AnyWeekday bool
+}
+
+// parseCronField parses a field of a cron expression, e.g. *, */15, 1-5 or
+// 1,15, and returns the set of values between min and max it matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("Invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			from, err1 = strconv.Atoi(bounds[0])
+			to, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("Invalid range %q", part)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid value %q", part)
+			}
+			from, to = value, value
+			if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of range %v-%v", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+// parseCronSpec parses the given cron expression consisting of minute, hour,
+// day of month, month and day of week, e.g. "*/15 8-18 * * 1-5", or one of
+// the cronMacros.
+func parseCronSpec(expr string) (*cronSpec, error) {
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression %q: Expected 5 fields",
+			expr)
+	}
+	limits := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		var err error
+		if sets[i], err = parseCronField(field, limits[i][0],
+			limits[i][1]); err != nil {
+			return nil, fmt.Errorf("Invalid cron expression %q: %v", expr, err)
+		}
+	}
+	// Sunday is 0 or 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSpec{Minute: sets[0], Hour: sets[1], Day: sets[2],
+		Month: sets[3], Weekday: sets[4], AnyDay: fields[2] == "*",
+		AnyWeekday: fields[4] == "*"}, nil
+}
+
+// matchDay returns true if the spec matches the day of the given time.
+func (s *cronSpec) matchDay(t time.Time) bool {
+	day := s.Day&(1<<uint(t.Day())) != 0
+	weekday := s.Weekday&(1<<uint(t.Weekday())) != 0
+	if s.AnyDay || s.AnyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Match returns true if the spec matches the minute of the given time.
+func (s *cronSpec) Match(t time.Time) bool {
+	return s.Month&(1<<uint(t.Month())) != 0 && s.matchDay(t) &&
+		s.Hour&(1<<uint(t.Hour())) != 0 && s.Minute&(1<<uint(t.Minute())) != 0
+}
+
+// Next returns the first time after the given time matching the spec, or
+// the zero time if there is none within five years.
+func (s *cronSpec) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.Month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0,
+				t.Location())
+		case s.Hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				t.Location())
+		case s.Minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// cronStateMutex serializes updates of the cron state files.
+var cronStateMutex sync.Mutex
+
+// loadCronState returns the times of the last scheduled runs by node type
+// in the data directory located at the given root.
+func loadCronState(root string) (map[string]time.Time, error) {
+	content, err := ioutil.ReadFile(filepath.Join(root, cronStatePath))
+	if os.IsNotExist(err) {
+		return map[string]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored map[string]string
+	if err := goyaml.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("Could not parse cron state: %v", err)
+	}
+	ret := make(map[string]time.Time, len(stored))
+	for nodeType, value := range stored {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			ret[nodeType] = t
+		}
+	}
+	return ret, nil
+}
+
+// saveCronRun records a scheduled run of the given node type at the given
+// time in the data directory located at the given root.
+func saveCronRun(root, nodeType string, t time.Time) error {
+	cronStateMutex.Lock()
+	defer cronStateMutex.Unlock()
+	state, err := loadCronState(root)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]string, len(state)+1)
+	for key, value := range state {
+		stored[key] = value.Format(time.RFC3339)
+	}
+	stored[nodeType] = t.Format(time.RFC3339)
+	content, err := goyaml.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("Could not marshal cron state: %v", err)
+	}
+	file := filepath.Join(root, cronStatePath)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, content, 0600)
+}
+
+// cronTask holds the status of the scheduled task of some node type on
+// some site.
+type cronTask struct {
+	Site, NodeType string
+	// Schedule is the cron expression of the task.
+	Schedule string
+	// Next is the time of the next scheduled run.
+	Next time.Time
+	// Running is true while the task runs.
+	Running bool
+	// LastRun is the start of the last run and LastDuration its duration.
+	LastRun      time.Time
+	LastDuration time.Duration
+	// LastError is the error of the last run, if it failed.
+	LastError string
+	// Runs and Failures count the runs since the daemon started.
+	Runs, Failures int
+}
+
+// cronTaskList sorts tasks by node type.
+type cronTaskList []cronTask
+
+// Len is the number of elements in the list.
+func (l cronTaskList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l cronTaskList) Less(i, j int) bool {
+	return l[i].NodeType < l[j].NodeType
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l cronTaskList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// cronScheduler keeps track of the runs of scheduled tasks and makes sure
+// that runs of the same task don't overlap.
+type cronScheduler struct {
+	mutex sync.Mutex
+	tasks map[[2]string]*cronTask
+}
+
+// task returns the task of the given node type on the given site. The
+// mutex must be held.
+func (c *cronScheduler) task(siteName, nodeType string) *cronTask {
+	key := [2]string{siteName, nodeType}
+	if c.tasks == nil {
+		c.tasks = make(map[[2]string]*cronTask)
+	}
+	task, ok := c.tasks[key]
+	if !ok {
+		task = &cronTask{Site: siteName, NodeType: nodeType}
+		c.tasks[key] = task
+	}
+	return task
+}
+
+// Trigger calls run in a new goroutine to run the task of the given node
+// type on the given site and records the result.
+//
+// Returns false if the task is still running.
+func (c *cronScheduler) Trigger(siteName, nodeType string,
+	run func() error) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	task := c.task(siteName, nodeType)
+	if task.Running {
+		return false
+	}
+	task.Running = true
+	start := time.Now()
+	task.LastRun = start
+	go func() {
+		err := run()
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		task.Running = false
+		task.LastDuration = time.Since(start)
+		task.LastError = ""
+		task.Runs++
+		if err != nil {
+			task.LastError = err.Error()
+			task.Failures++
+		}
+	}()
+	return true
+}
+
+// Tasks returns the status of the tasks of the given site, given the node
+// types' cron expressions.
+func (c *cronScheduler) Tasks(siteName string, schedules map[string]string,
+	now time.Time) []cronTask {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := make([]cronTask, 0, len(schedules))
+	for nodeType, schedule := range schedules {
+		task := *c.task(siteName, nodeType)
+		task.Schedule = schedule
+		if spec, err := parseCronSpec(schedule); err == nil {
+			task.Next = spec.Next(now)
+		}
+		ret = append(ret, task)
+	}
+	sort.Sort(cronTaskList(ret))
+	return ret
+}
+
+// schedules returns the cron expressions of the node types having a
+// schedule.
+func (h *nodeHandler) schedules() map[string]string {
+	ret := make(map[string]string)
+	for _, nodeType := range h.NodeTypes() {
+		schedule := h.currentSettings().nodeType(nodeType).Schedule
+		if len(schedule) > 0 {
+			ret[nodeType] = schedule
+		}
+	}
+	return ret
+}
+
+// TriggerTask starts the scheduled task of the given node type on the given
+// site unless it's still running. Returns false if it is.
+func (h *nodeHandler) TriggerTask(siteName, nodeType string) bool {
+	started := h.Cron.Trigger(siteName, nodeType, func() error {
+		err := h.runTask(siteName, nodeType)
+		if err != nil {
+			h.SiteLog(siteName).Error(
+				"Scheduled task of node type %q failed: %v", nodeType, err)
+		}
+		return err
+	})
+	if !started {
+		h.SiteLog(siteName).Warn(
+			"Skipping scheduled task of node type %q, it is still running",
+			nodeType)
+	}
+	return started
+}
+
+// runTask sends a ticket with the cron action and without HTTP request to
+// the worker of the given node type and waits for the response.
+func (h *nodeHandler) runTask(siteName, nodeType string) error {
+	site, ok := h.Sites.Get(siteName)
+	if !ok {
+		return fmt.Errorf("Unknown site %q", siteName)
+	}
+	if err := saveCronRun(site.Directories.Data, nodeType,
+		time.Now()); err != nil {
+		h.SiteLog(siteName).Warn("Could not save run of scheduled task: %v",
+			err)
+	}
+	if _, ok := h.nodeQueue(nodeType); !ok {
+		return fmt.Errorf("Missing queue for node type %q", nodeType)
+	}
+	if protocol := h.Protocols.Get(nodeType); protocol.State ==
+		handshakeRefused || !protocol.HasAction(cronAction) {
+		return fmt.Errorf("Node type %q does not implement action %q",
+			nodeType, cronAction)
+	}
+	ticket := worker.Ticket{
+		Site:      site.Name,
+		Node:      client.Node{Path: "/", Type: nodeType},
+		Session:   client.Session{Locale: site.Locale},
+		Action:    cronAction,
+		RequestID: newRequestID()}
+	if timeout := h.currentSettings().nodeType(nodeType).Timeout; timeout > 0 {
+		ticket.Deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	h.SiteLog(siteName).Info("[%v] Running scheduled task of node type %q",
+		ticket.RequestID, nodeType)
+	res, err := h.requestWorker(ticket, nil)
+	if err == errWorkerDied {
+		h.Stats.Failed(nodeType)
+	}
+	if err != nil {
+		return err
+	}
+	h.Stats.Served(nodeType)
+	return h.ProcessHeadlessResponse(res, ticket)
+}
+
+// scheduleTasks runs the scheduled tasks of all sites at the times given
+// by the node types' schedules.
+//
+// Tasks of node types having CatchUp set get run once at startup if a run
+// has been missed.
+func (h *nodeHandler) scheduleTasks() {
+	h.catchUpTasks(time.Now())
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		h.runDueTasks(time.Now())
+	}
+}
+
+// runDueTasks starts the tasks scheduled for the minute of the given time.
+func (h *nodeHandler) runDueTasks(now time.Time) {
+	for nodeType, schedule := range h.schedules() {
+		spec, err := parseCronSpec(schedule)
+		if err != nil || !spec.Match(now) {
+			continue
+		}
+		for name := range h.Sites.All() {
+			h.TriggerTask(name, nodeType)
+		}
+	}
+}
+
+// catchUpTasks starts the tasks of node types having CatchUp set whose
+// last run is older than their last scheduled time before the given time.
+func (h *nodeHandler) catchUpTasks(now time.Time) {
+	schedules := h.schedules()
+	for name, site := range h.Sites.All() {
+		state, err := loadCronState(site.Directories.Data)
+		if err != nil {
+			h.SiteLog(name).Error("Could not load cron state: %v", err)
+			continue
+		}
+		for nodeType, schedule := range schedules {
+			spec, err := parseCronSpec(schedule)
+			if err != nil || !h.currentSettings().nodeType(nodeType).CatchUp {
+				continue
+			}
+			last, ok := state[nodeType]
+			if next := spec.Next(last); ok && !next.IsZero() &&
+				next.Before(now) {
+				h.SiteLog(name).Info(
+					"Catching up on scheduled task of node type %q missed at %v",
+					nodeType, next)
+				h.TriggerTask(name, nodeType)
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronSpec(t *testing.T) {
+	tests := []struct {
+		Expr  string
+		Valid bool
+	}{
+		{"* * * * *", true},
+		{"*/15 8-18 * * 1-5", true},
+		{"0 0 1,15 * 7", true},
+		{"5/20 * * * *", true},
+		{"@daily", true},
+		{"* * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+		{"@sometimes", false}}
+	for i, v := range tests {
+		if _, err := parseCronSpec(v.Expr); (err == nil) != v.Valid {
+			t.Errorf("Test %v: parseCronSpec(%q) returned %v", i, v.Expr, err)
+		}
+	}
+}
+
+func TestCronSpecNext(t *testing.T) {
+	date := func(value string) time.Time {
+		ret, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatalf("Could not parse date: %v", err)
+		}
+		return ret
+	}
+	tests := []struct {
+		Expr, After, Next string
+	}{
+		{"* * * * *", "2014-03-10 12:30", "2014-03-10 12:31"},
+		{"*/15 * * * *", "2014-03-10 12:30", "2014-03-10 12:45"},
+		{"5/20 * * * *", "2014-03-10 12:30", "2014-03-10 12:45"},
+		{"@hourly", "2014-03-10 12:30", "2014-03-10 13:00"},
+		{"@daily", "2014-12-31 12:30", "2015-01-01 00:00"},
+		{"30 9 * * 1-5", "2014-03-07 10:00", "2014-03-10 09:30"},
+		{"0 0 * * 7", "2014-03-10 00:00", "2014-03-16 00:00"},
+		{"0 0 13 * 5", "2014-03-10 00:00", "2014-03-13 00:00"},
+		{"0 0 29 2 *", "2014-03-10 00:00", "2016-02-29 00:00"},
+		{"0 0 31 2 *", "2014-03-10 00:00", ""}}
+	for i, v := range tests {
+		spec, err := parseCronSpec(v.Expr)
+		if err != nil {
+			t.Fatalf("Test %v: Could not parse %q: %v", i, v.Expr, err)
+		}
+		next := spec.Next(date(v.After))
+		if len(v.Next) == 0 && !next.IsZero() ||
+			len(v.Next) > 0 && !next.Equal(date(v.Next)) {
+			t.Errorf("Test %v: Next(%v) of %q is %v, should be %v", i, v.After,
+				v.Expr, next, v.Next)
+		}
+		if !next.IsZero() && !spec.Match(next) {
+			t.Errorf("Test %v: %q does not match %v", i, v.Expr, next)
+		}
+	}
+}
+
+func TestCronState(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestCronState")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if state, err := loadCronState(root); err != nil || len(state) != 0 {
+		t.Errorf("loadCronState(...) of empty directory = %v, %v", state, err)
+	}
+	now := time.Now().Truncate(time.Second)
+	if err := saveCronRun(root, "Newsletter", now); err != nil {
+		t.Fatalf("Could not save run: %v", err)
+	}
+	if err := saveCronRun(root, "Feed", now.Add(-time.Hour)); err != nil {
+		t.Fatalf("Could not save run: %v", err)
+	}
+	state, err := loadCronState(root)
+	if err != nil || !state["Newsletter"].Equal(now) ||
+		!state["Feed"].Equal(now.Add(-time.Hour)) {
+		t.Errorf("loadCronState(...) = %v, %v", state, err)
+	}
+}
+
+// waitForTasks waits until the scheduled tasks of the handler's site
+// finished.
+func waitForTasks(t *testing.T, h *nodeHandler) []cronTask {
+	for i := 0; i < 200; i++ {
+		tasks := h.Cron.Tasks("foo", h.schedules(), time.Now())
+		running := false
+		for _, task := range tasks {
+			running = running || task.Running
+		}
+		if !running {
+			return tasks
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Scheduled tasks did not finish in time")
+	return nil
+}
+
+func TestRunTask(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `{"type": "Document"}`}, "TestRunTask")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	body := []byte("Sent 3 newsletters")
+	h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+		if ticket.Action != cronAction || ticket.Request != nil ||
+			ticket.Site != "foo" {
+			t.Errorf("Got ticket %+v", ticket)
+		}
+		ticket.ResponseChan <- client.Response{Body: body}
+	})
+	defer stop()
+	h.Settings.NodeTypeSettings = map[string]nodeTypeSettings{
+		"Document": {ID: "Document", Schedule: "@daily"}}
+	if !h.TriggerTask("foo", "Document") {
+		t.Fatalf("TriggerTask(...) returned false")
+	}
+	tasks := waitForTasks(t, h)
+	if len(tasks) != 1 || tasks[0].Runs != 1 || tasks[0].Failures != 0 ||
+		tasks[0].Schedule != "@daily" || tasks[0].Next.IsZero() {
+		t.Errorf("Tasks(...) = %+v", tasks)
+	}
+	if !strings.Contains(logBuf.String(), "Sent 3 newsletters") {
+		t.Errorf("The response has not been logged: %q", logBuf.String())
+	}
+	if state, _ := loadCronState(root); state["Document"].IsZero() {
+		t.Errorf("The run has not been recorded")
+	}
+	body = nil
+	h.TriggerTask("foo", "Document")
+	tasks = waitForTasks(t, h)
+	if tasks[0].Runs != 2 || tasks[0].Failures != 1 ||
+		len(tasks[0].LastError) == 0 {
+		t.Errorf("Empty response has not been counted as failure: %+v", tasks)
+	}
+}
+
+func TestTriggerTaskOverlap(t *testing.T) {
+	var c cronScheduler
+	release := make(chan struct{})
+	if !c.Trigger("foo", "Document", func() error {
+		<-release
+		return nil
+	}) {
+		t.Fatalf("Trigger(...) returned false")
+	}
+	if c.Trigger("foo", "Document", func() error { return nil }) {
+		t.Errorf("Trigger(...) started a running task")
+	}
+	if !c.Trigger("bar", "Document", func() error { return nil }) {
+		t.Errorf("Trigger(...) did not start the task of another site")
+	}
+	close(release)
+}
+
+func TestCatchUpTasks(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `{"type": "Document"}`}, "TestCatchUpTasks")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	now := time.Now()
+	tests := []struct {
+		CatchUp bool
+		LastRun time.Time
+		Runs    int
+	}{
+		{false, now.Add(-48 * time.Hour), 0},
+		{true, time.Time{}, 0},
+		{true, now, 0},
+		{true, now.Add(-48 * time.Hour), 1}}
+	for i, v := range tests {
+		h, stop := setupWorkerHandler(root, ioutil.Discard,
+			func(ticket worker.Ticket) {
+				ticket.ResponseChan <- client.Response{Body: []byte("ok")}
+			})
+		h.Settings.NodeTypeSettings = map[string]nodeTypeSettings{
+			"Document": {ID: "Document", Schedule: "@daily",
+				CatchUp: v.CatchUp}}
+		os.Remove(filepath.Join(root, cronStatePath))
+		if err := saveCronRun(root, "Other", now); err != nil {
+			t.Fatalf("Could not save run: %v", err)
+		}
+		if !v.LastRun.IsZero() {
+			if err := saveCronRun(root, "Document", v.LastRun); err != nil {
+				t.Fatalf("Could not save run: %v", err)
+			}
+		}
+		h.catchUpTasks(now)
+		tasks := waitForTasks(t, h)
+		stop()
+		if tasks[0].Runs != v.Runs {
+			t.Errorf("Test %v: Got %v runs, should be %v", i, tasks[0].Runs,
+				v.Runs)
+		}
+	}
+}
+
+func TestServeCronAction(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document"}`}, "TestServeCronAction")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	h, stop := setupWorkerHandler(root, ioutil.Discard,
+		func(ticket worker.Ticket) {
+			t.Errorf("Got ticket for HTTP request of @@cron")
+			ticket.ResponseChan <- client.Response{Body: []byte("ok")}
+		})
+	defer stop()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://example.com/foo/@@cron", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("@@cron got status %v, should be %v", w.Code,
+			http.StatusNotFound)
+	}
+}
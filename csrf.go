@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/gorilla/context"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/form"
+	"net/http"
+)
+
+// csrfSessionKey is the session value key of the CSRF token.
+const csrfSessionKey = "csrf_token"
+
+// csrfFormField is the name of the form field holding the CSRF token.
+const csrfFormField = "CSRFToken"
+
+// getCSRFToken returns the CSRF token of the given session.
+//
+// A new token will be generated and stored in the session if there is none
+// yet. The session has to be saved afterwards.
+func getCSRFToken(session *sessions.Session) string {
+	if token, ok := session.Values[csrfSessionKey].(string); ok && len(token) > 0 {
+		return token
+	}
+	token := randomToken()
+	session.Values[csrfSessionKey] = token
+	return token
+}
+
+// pendingCSRFToken returns the CSRF token of the given session.
+//
+// Unlike getCSRFToken, a new token doesn't get stored in the session. This
+// way, responses not using it don't set a session cookie and may be cached.
+// Used tokens must be stored using storeCSRFToken.
+func pendingCSRFToken(session *sessions.Session) string {
+	if token, ok := session.Values[csrfSessionKey].(string); ok && len(token) > 0 {
+		return token
+	}
+	return randomToken()
+}
+
+// storeCSRFToken stores the given token returned by pendingCSRFToken in the
+// session if it has no token yet.
+func storeCSRFToken(session *sessions.Session, token string) {
+	if stored, ok := session.Values[csrfSessionKey].(string); !ok ||
+		len(stored) == 0 {
+		session.Values[csrfSessionKey] = token
+	}
+}
+
+// rotateCSRFToken replaces the CSRF token of the given session by a new one.
+func rotateCSRFToken(session *sessions.Session) string {
+	delete(session.Values, csrfSessionKey)
+	return getCSRFToken(session)
+}
+
+// equalCSRFTokens returns true iff the given token matches the expected
+// token. Empty tokens never match. The tokens are compared in constant time.
+func equalCSRFTokens(expected, token string) bool {
+	if len(expected) == 0 || len(token) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// checkCSRFToken returns true iff the given token matches the session's
+// token.
+func checkCSRFToken(session *sessions.Session, token string) bool {
+	expected, _ := session.Values[csrfSessionKey].(string)
+	return equalCSRFTokens(expected, token)
+}
+
+// csrfExempt returns true if the request does not need to be checked for a
+// CSRF token.
+//
+// Only requests authenticated by an API token are exempt. They don't use
+// the session cookie and can't be forged by a cross-site form. Other
+// credentials in the Authorization header, e.g. Basic auth, get attached by
+// browsers to cross-site requests and don't exempt the request.
+func csrfExempt(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	authenticated, _ := context.Get(r, tokenAuthKey).(bool)
+	return authenticated
+}
+
+// csrfField returns the form field to be used for the CSRF token.
+//
+// Forms using this field must have a CSRFToken string in their data struct.
+func csrfField() form.Field {
+	return form.Field{"", "", nil, new(form.HiddenWidget)}
+}
+
+// validCSRFRequest checks the given token for POST requests.
+func validCSRFRequest(r *http.Request, session *sessions.Session,
+	token string) bool {
+	return csrfExempt(r) || checkCSRFToken(session, token)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"testing"
+)
+
+func TestCSRFToken(t *testing.T) {
+	session := sessions.NewSession(nil, "test")
+	if checkCSRFToken(session, "") {
+		t.Errorf("checkCSRFToken(_, \"\") = true without token, should be false")
+	}
+	token := getCSRFToken(session)
+	if len(token) == 0 {
+		t.Fatalf("getCSRFToken(_) returned empty token")
+	}
+	if ret := getCSRFToken(session); ret != token {
+		t.Errorf("getCSRFToken(_) = %q, should be stable (%q)", ret, token)
+	}
+	if !checkCSRFToken(session, token) {
+		t.Errorf("checkCSRFToken(_, %q) = false, should be true", token)
+	}
+	if checkCSRFToken(session, "foo") {
+		t.Errorf("checkCSRFToken(_, \"foo\") = true, should be false")
+	}
+	newToken := rotateCSRFToken(session)
+	if newToken == token {
+		t.Errorf("rotateCSRFToken(_) returned old token")
+	}
+	if checkCSRFToken(session, token) {
+		t.Errorf("checkCSRFToken(_, %q) = true for rotated token", token)
+	}
+}
+
+func TestPendingCSRFToken(t *testing.T) {
+	session := sessions.NewSession(nil, "test")
+	token := pendingCSRFToken(session)
+	if len(token) == 0 {
+		t.Fatalf("pendingCSRFToken(_) returned empty token")
+	}
+	if len(session.Values) > 0 {
+		t.Errorf("pendingCSRFToken(_) changed the session: %v", session.Values)
+	}
+	storeCSRFToken(session, token)
+	if !checkCSRFToken(session, token) {
+		t.Errorf("storeCSRFToken(_, %q) did not store the token", token)
+	}
+	if ret := pendingCSRFToken(session); ret != token {
+		t.Errorf("pendingCSRFToken(_) = %q, should be stored token %q", ret,
+			token)
+	}
+	storeCSRFToken(session, "foo")
+	if !checkCSRFToken(session, token) {
+		t.Errorf("storeCSRFToken(_, \"foo\") replaced the stored token")
+	}
+}
+
+func TestCSRFExempt(t *testing.T) {
+	req := http.Request{Header: make(http.Header)}
+	defer context.Clear(&req)
+	if csrfExempt(&req) {
+		t.Errorf("csrfExempt(_) = true for plain request, should be false")
+	}
+	req.SetBasicAuth("alice", "secret")
+	if csrfExempt(&req) {
+		t.Errorf("csrfExempt(_) = true with Basic auth, should be false")
+	}
+	context.Set(&req, tokenAuthKey, true)
+	if !csrfExempt(&req) {
+		t.Errorf("csrfExempt(_) = false for token request, should be true")
+	}
+}
+
+func TestEqualCSRFTokens(t *testing.T) {
+	tests := []struct {
+		Expected, Token string
+		Equal           bool
+	}{
+		{"", "", false},
+		{"foo", "", false},
+		{"", "foo", false},
+		{"foo", "bar", false},
+		{"foo", "foobar", false},
+		{"foo", "foo", true}}
+	for _, v := range tests {
+		if ret := equalCSRFTokens(v.Expected, v.Token); ret != v.Equal {
+			t.Errorf("equalCSRFTokens(%q, %q) = %v, should be %v", v.Expected,
+				v.Token, ret, v.Equal)
+		}
+	}
+}
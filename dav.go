@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"github.com/gorilla/context"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// davPrefix is the site path of the WebDAV endpoint.
+const davPrefix = "/@@dav"
+
+// isDAVPath returns true if the given site path belongs to the WebDAV
+// endpoint.
+func isDAVPath(sitePath string) bool {
+	return sitePath == davPrefix || strings.HasPrefix(sitePath, davPrefix+"/")
+}
+
+var (
+	// davLocks holds the WebDAV lock systems of the sites by site name.
+	davLocks      = make(map[string]webdav.LockSystem)
+	davLocksMutex sync.Mutex
+)
+
+// getDAVLocks returns the WebDAV lock system of the site with the given
+// name.
+func getDAVLocks(siteName string) webdav.LockSystem {
+	davLocksMutex.Lock()
+	defer davLocksMutex.Unlock()
+	ls, ok := davLocks[siteName]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks[siteName] = ls
+	}
+	return ls
+}
+
+// davWriteMethods are the WebDAV methods changing the site's content.
+var davWriteMethods = map[string]bool{
+	"COPY":      true,
+	"DELETE":    true,
+	"MKCOL":     true,
+	"MOVE":      true,
+	"PROPPATCH": true,
+	"PUT":       true}
+
+// ServeDAV serves the site's data directory over WebDAV.
+//
+// Users authenticate with Basic auth or API tokens and need the dav
+// permission. API tokens are restricted to their node path. Nodes the user
+// might not view are not accessible. Only HTTPS requests are accepted
+// unless the site allows insecure tokens. Changes are rejected if the site
+// is read-only.
+func (h *nodeHandler) ServeDAV(w http.ResponseWriter, r *http.Request,
+	site site) {
+	if !site.WebDAV {
+		http.NotFound(w, r)
+		return
+	}
+	if requestScheme(r) != "https" && !site.AllowInsecureTokens {
+		h.requestLog(r, site.Name).Warn("Rejected WebDAV request over HTTP")
+		http.Error(w, "WebDAV requires HTTPS.", http.StatusForbidden)
+		return
+	}
+	if !site.adminAllowed(clientIP(r)) {
+		h.requestLog(r, site.Name).Warn("Rejected WebDAV request from %v",
+			clientIP(r))
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	fs := &davFS{Site: site, Scope: "/",
+		Logf: h.requestLog(r, site.Name).Warn}
+	sitePath, _ := site.stripBasePath(r.URL.Path)
+	davPath := path.Clean("/" + strings.TrimPrefix(sitePath, davPrefix))
+	var roles []string
+	if secret, ok := bearerToken(r); ok {
+		token, ok := h.authenticateToken(w, r, site, secret, davPath, "dav")
+		if !ok {
+			return
+		}
+		fs.Login, fs.Scope, roles = token.Login(), token.Path, token.Roles()
+	} else {
+		user, ok := h.authenticateBasic(w, r, site)
+		if !ok {
+			return
+		}
+		fs.Login, roles = user.Login, user.GetRoles()
+	}
+	if !checkPermission("dav", roles, site.Permissions) {
+		h.requestLog(r, site.Name).Warn("User %q may not use WebDAV", fs.Login)
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	fs.Access = newNodeAccess(site.Directories.Data, roles)
+	fs.Access.Log = h.requestLog(r, site.Name).Error
+	if site.ReadOnly && davWriteMethods[r.Method] {
+		http.Error(w, "The site is read-only.", http.StatusForbidden)
+		return
+	}
+	if r.Method == "PUT" && path.Base(r.URL.Path) == "node.yaml" {
+		// Reject invalid nodes before the handler responds with a generic
+		// error when closing the file.
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Could not read request.", http.StatusBadRequest)
+			return
+		}
+		if err := checkNodeYAML(content); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fs.checkRestriction(davPath, content); err != nil {
+			h.requestLog(r, site.Name).Warn("Refused to write %q for user %q: %v",
+				davPath, fs.Login, err)
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(content))
+	}
+	handler := &webdav.Handler{
+		Prefix:     site.URL(davPrefix),
+		FileSystem: fs,
+		LockSystem: getDAVLocks(site.Name),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				h.requestLog(r, site.Name).Debug("WebDAV %v %v: %v", r.Method,
+					r.URL.Path, err)
+			}
+		}}
+	handler.ServeHTTP(w, r)
+}
+
+// authenticateBasic checks the Basic auth credentials of the given request.
+//
+// Users having two-factor authentication enabled can't use Basic auth.
+// Writes an error response and returns false if the credentials are
+// missing or wrong.
+func (h *nodeHandler) authenticateBasic(w http.ResponseWriter,
+	r *http.Request, site site) (*user, bool) {
+	unauthorized := func() (*user, bool) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+site.Name+`"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return nil, false
+	}
+	login, password, ok := r.BasicAuth()
+	if !ok {
+		return unauthorized()
+	}
+	ip := clientIP(r)
+	keys := []string{"login:" + login, "ip:" + ip}
+	if h.LoginLimiter.Locked(keys...) {
+		h.requestLog(r, site.Name).Warn(
+			"Rejected WebDAV login for locked user %q from %v", login, ip)
+		return unauthorized()
+	}
+	time.Sleep(h.LoginLimiter.Delay(keys...))
+	user, err := authenticate(site, login, password)
+	if err != nil && err != errWrongCredentials {
+		h.requestLog(r, site.Name).Error("Could not authenticate user %q: %v",
+			login, err)
+		http.Error(w, "Login is currently not possible.",
+			http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		if h.LoginLimiter.Fail(keys...) {
+			h.requestLog(r, site.Name).Warn("Locked login for user %q from %v"+
+				" after too many failed attempts", login, ip)
+		}
+		return unauthorized()
+	}
+	h.LoginLimiter.Succeed(keys[0])
+	if len(user.TOTPSecret) > 0 {
+		h.requestLog(r, site.Name).Warn(
+			"Rejected WebDAV login of user %q with two-factor authentication",
+			login)
+		return unauthorized()
+	}
+	context.Set(r, accessUserKey, user.Login)
+	return user, true
+}
+
+// checkNodeYAML checks that the given content of a node.yaml file can be
+// parsed and names the node's type.
+func checkNodeYAML(content []byte) error {
+	var node storedNode
+	if err := goyaml.Unmarshal(content, &node); err != nil {
+		return fmt.Errorf("Could not parse node: %v", err)
+	}
+	if len(node.Type) == 0 {
+		return fmt.Errorf("Missing node type")
+	}
+	return nil
+}
+
+// davFS is the webdav.FileSystem of a site's data directory.
+//
+// Hidden files and directories like revisions and caches are invisible.
+// Nodes the user might not view are not accessible and only admins might
+// change restrictions. Changes get recorded like the changes made using
+// the web interface.
+type davFS struct {
+	Site site
+	// Login of the user making the changes.
+	Login string
+	// Scope is the node path the user is restricted to, including the
+	// node's descendants.
+	Scope string
+	// Access checks the restrictions of the nodes for the user. nil grants
+	// access to any node.
+	Access *nodeAccess
+	// Logf receives errors of the change hooks.
+	Logf func(format string, v ...interface{})
+}
+
+// resolve returns the cleaned node path and the filesystem path of the
+// given name.
+//
+// Returns os.ErrPermission if the name is outside of the scope or belongs
+// to a node the user might not view.
+func (fs *davFS) resolve(name string) (string, string, error) {
+	cleaned := path.Clean("/" + name)
+	for _, segment := range strings.Split(cleaned, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", "", os.ErrNotExist
+		}
+	}
+	scope := strings.TrimSuffix(path.Clean("/"+fs.Scope), "/") + "/"
+	if !strings.HasPrefix(strings.TrimSuffix(cleaned, "/")+"/", scope) {
+		return "", "", os.ErrPermission
+	}
+	file, err := nodeFile(fs.Site.Directories.Data, cleaned, "")
+	if err == errInvalidPath {
+		return "", "", os.ErrPermission
+	}
+	if err != nil {
+		return "", "", err
+	}
+	nodePath := cleaned
+	if info, err := os.Stat(file); err != nil || !info.IsDir() {
+		nodePath = path.Dir(cleaned)
+	}
+	if !fs.Access.CanView(nodePath) {
+		return "", "", os.ErrPermission
+	}
+	return cleaned, file, nil
+}
+
+// checkRestriction returns os.ErrPermission if replacing the node.yaml
+// file at the given name with the given content would change the node's
+// restriction and the user is not an admin. nil content removes the file.
+func (fs *davFS) checkRestriction(name string, content []byte) error {
+	if path.Base(name) != "node.yaml" || fs.Access == nil ||
+		hasRole(fs.Access.Roles, roleAdmin) {
+		return nil
+	}
+	_, file, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	var current, changed nodeRestriction
+	currentContent, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := goyaml.Unmarshal(currentContent, &current); err != nil {
+		return os.ErrPermission
+	}
+	if err := goyaml.Unmarshal(content, &changed); err != nil {
+		return err
+	}
+	if current.Restrict != changed.Restrict {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// written records the change of the given file or directory.
+func (fs *davFS) written(name, action string) {
+	nodePath, file := path.Dir(name), path.Base(name)
+	dataWritten(fs.Site, nodePath, file, fs.Login, action, fs.Logf)
+}
+
+// Mkdir creates the given directory.
+func (fs *davFS) Mkdir(ctx stdcontext.Context, name string,
+	perm os.FileMode) error {
+	cleaned, dir, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return os.ErrExist
+	}
+	if _, err := os.Stat(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := mkdirContent(dir); err != nil {
+		return err
+	}
+	fs.written(cleaned, auditWriteData)
+	return nil
+}
+
+// OpenFile opens the given file. Files opened for writing will be written
+// when closed.
+func (fs *davFS) OpenFile(ctx stdcontext.Context, name string, flag int,
+	perm os.FileMode) (webdav.File, error) {
+	cleaned, file, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		return davReadFile{f}, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case os.IsNotExist(err) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	f := &davWriteFile{FS: fs, Name: cleaned}
+	if flag&os.O_TRUNC == 0 {
+		f.Content = content
+	}
+	return f, nil
+}
+
+// write validates and writes the given file.
+func (fs *davFS) write(name string, content []byte) error {
+	if path.Base(name) == "node.yaml" {
+		if err := checkNodeYAML(content); err != nil {
+			return err
+		}
+	}
+	if err := fs.checkRestriction(name, content); err != nil {
+		return err
+	}
+	_, file, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	root, nodePath := fs.Site.Directories.Data, path.Dir(name)
+	if err := saveRevision(root, nodePath, path.Base(name), fs.Login,
+		fs.Site.MaxRevisions, time.Now()); err != nil {
+		fs.Logf("Could not save revision of %q: %v", name, err)
+	}
+	if err := writeContentFile(file, content); err != nil {
+		return err
+	}
+	fs.written(name, auditWriteData)
+	return nil
+}
+
+// RemoveAll removes the given file or directory. The root and protected
+// nodes can't be removed.
+func (fs *davFS) RemoveAll(ctx stdcontext.Context, name string) error {
+	cleaned, file, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if cleaned == "/" || cleaned == path.Clean("/"+fs.Scope) {
+		return os.ErrPermission
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && nodeProtected(cleaned, fs.Site.ProtectedPaths) {
+		return os.ErrPermission
+	}
+	if err := fs.checkRestriction(cleaned, nil); err != nil {
+		return err
+	}
+	unlock := lockWrites(file)
+	err = os.RemoveAll(file)
+	unlock()
+	if err != nil {
+		return err
+	}
+	fs.written(cleaned, auditRemove)
+	return nil
+}
+
+// Rename moves the given file or directory. Moved node.yaml files must be
+// valid, protected nodes can't be moved.
+func (fs *davFS) Rename(ctx stdcontext.Context, oldName,
+	newName string) error {
+	oldPath, oldFile, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, newFile, err := fs.resolve(newName)
+	if err != nil {
+		return err
+	}
+	if oldPath == "/" || oldPath == path.Clean("/"+fs.Scope) {
+		return os.ErrPermission
+	}
+	if info, err := os.Stat(oldFile); err == nil && info.IsDir() &&
+		nodeProtected(oldPath, fs.Site.ProtectedPaths) {
+		return os.ErrPermission
+	}
+	if err := fs.checkRestriction(oldPath, nil); err != nil {
+		return err
+	}
+	if path.Base(newPath) == "node.yaml" {
+		content, err := ioutil.ReadFile(oldFile)
+		if err != nil {
+			return err
+		}
+		if err := checkNodeYAML(content); err != nil {
+			return err
+		}
+		if err := fs.checkRestriction(newPath, content); err != nil {
+			return err
+		}
+	}
+	unlock := lockWrites(newFile)
+	err = os.Rename(oldFile, newFile)
+	unlock()
+	if err != nil {
+		return err
+	}
+	fs.written(oldPath, auditRemove)
+	fs.written(newPath, auditWriteData)
+	return nil
+}
+
+// Stat returns the info of the given file or directory.
+func (fs *davFS) Stat(ctx stdcontext.Context, name string) (os.FileInfo,
+	error) {
+	_, file, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(file)
+}
+
+// davReadFile is a file of the data directory opened for reading.
+type davReadFile struct {
+	*os.File
+}
+
+// Readdir returns the non-hidden entries of the directory.
+func (f davReadFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+// Write fails as the file is read only.
+func (f davReadFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// davWriteFile buffers the content of a file opened for writing.
+type davWriteFile struct {
+	FS *davFS
+	// Name is the path of the file within the data directory.
+	Name    string
+	Content []byte
+	offset  int64
+	closed  bool
+}
+
+// Close writes the file.
+func (f *davWriteFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return f.FS.write(f.Name, f.Content)
+}
+
+// Read reads from the buffered content.
+func (f *davWriteFile) Read(p []byte) (int, error) {
+	if f.offset >= int64(len(f.Content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.Content[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// Seek sets the offset for the next Read or Write.
+func (f *davWriteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.Content))
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Readdir fails as the file is not a directory.
+func (f *davWriteFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// Stat returns the info of the buffered content.
+func (f *davWriteFile) Stat() (os.FileInfo, error) {
+	return davFileInfo{name: path.Base(f.Name), size: int64(len(f.Content))},
+		nil
+}
+
+// Write writes to the buffered content at the current offset.
+func (f *davWriteFile) Write(p []byte) (int, error) {
+	if end := f.offset + int64(len(p)); end > int64(len(f.Content)) {
+		f.Content = append(f.Content,
+			make([]byte, end-int64(len(f.Content)))...)
+	}
+	copy(f.Content[f.offset:], p)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+// davFileInfo describes a file which has not been written yet.
+type davFileInfo struct {
+	name string
+	size int64
+}
+
+func (i davFileInfo) Name() string       { return i.name }
+func (i davFileInfo) Size() int64        { return i.size }
+func (i davFileInfo) Mode() os.FileMode  { return 0644 }
+func (i davFileInfo) ModTime() time.Time { return time.Now() }
+func (i davFileInfo) IsDir() bool        { return false }
+func (i davFileInfo) Sys() interface{}   { return nil }
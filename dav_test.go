@@ -0,0 +1,296 @@
+package main
+
+import (
+	stdcontext "context"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDAVFS(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":                 `{"type": "Document"}`,
+		"/data/foo/node.yaml":             `{"type": "Document"}`,
+		"/data/foo/body.html":             "Foo",
+		"/data/foo/.revisions/index.yaml": "{}",
+		"/data/bar/node.yaml":             `{"type": "Document"}`,
+		"/outside/secret":                 "secret"}, "TestDAVFS")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{Name: "foo"}
+	site_.Directories.Data = filepath.Join(root, "data")
+	if err := os.Symlink(filepath.Join(root, "outside"),
+		filepath.Join(root, "data", "foo", "link")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+	fs := &davFS{Site: site_, Login: "alice", Scope: "/foo",
+		Logf: t.Logf}
+	ctx := stdcontext.Background()
+	tests := []struct {
+		Name string
+		Err  error
+	}{
+		{"/foo/body.html", nil},
+		{"foo/../foo/body.html", nil},
+		{"/foo/.revisions/index.yaml", os.ErrNotExist},
+		{"/foo/.revisions", os.ErrNotExist},
+		{"/bar/node.yaml", os.ErrPermission},
+		{"/foo/../bar/node.yaml", os.ErrPermission},
+		{"/", os.ErrPermission},
+		{"/foo/link/secret", os.ErrPermission}}
+	for i, v := range tests {
+		if _, err := fs.Stat(ctx, v.Name); err != v.Err {
+			t.Errorf("Test %v: Stat(_, %q) returned %v, should be %v", i, v.Name,
+				err, v.Err)
+		}
+	}
+	dir, err := fs.OpenFile(ctx, "/foo", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Could not open directory: %v", err)
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			t.Errorf("Readdir(-1) returned hidden entry %q", info.Name())
+		}
+	}
+	write := func(name, content string) error {
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	if err := write("/foo/node.yaml", `{"type": `); err == nil {
+		t.Errorf("Invalid node.yaml has been accepted")
+	}
+	if err := write("/foo/node.yaml", `{"title": "Foo"}`); err == nil {
+		t.Errorf("node.yaml without type has been accepted")
+	}
+	if err := write("/foo/body.html", "Bar"); err != nil {
+		t.Fatalf("Could not write body: %v", err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(root, "data", "foo",
+		"body.html"))
+	if string(content) != "Bar" {
+		t.Errorf("body.html contains %q, should be Bar", content)
+	}
+	records, err := readAudit(auditLogPath(site_), auditFilter{})
+	if err != nil || len(records) != 1 || records[0].User != "alice" ||
+		records[0].Action != auditWriteData || records[0].Path != "/foo" ||
+		records[0].File != "body.html" {
+		t.Errorf("Audit log contains %+v, %v", records, err)
+	}
+	if err := fs.Rename(ctx, "/foo/body.html", "/foo/node.yaml"); err == nil {
+		t.Errorf("Moving an invalid file to node.yaml has been accepted")
+	}
+	if err := fs.Rename(ctx, "/foo/body.html",
+		"/foo/.revisions/body.html"); err != os.ErrNotExist {
+		t.Errorf("Moving a file into a hidden directory returned %v", err)
+	}
+	if err := fs.Rename(ctx, "/foo/body.html", "/bar/body.html"); err !=
+		os.ErrPermission {
+		t.Errorf("Moving a file out of the scope returned %v", err)
+	}
+	if err := fs.RemoveAll(ctx, "/foo"); err != os.ErrPermission {
+		t.Errorf("Removing the scope returned %v", err)
+	}
+}
+
+func TestDAVFSRestrictions(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":         `{"type": "Document"}`,
+		"/admins/node.yaml":  `{"type": "Document", "restrict": "admin"}`,
+		"/admins/body.html":  "Admins",
+		"/members/node.yaml": `{"type": "Document", "restrict": "login"}`,
+		"/members/body.html": "Members"}, "TestDAVFSRestrictions")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{Name: "foo"}
+	site_.Directories.Data = root
+	fs := &davFS{Site: site_, Login: "alice", Scope: "/",
+		Access: newNodeAccess(root, []string{roleEditor}), Logf: t.Logf}
+	ctx := stdcontext.Background()
+	for _, name := range []string{"/admins", "/admins/body.html",
+		"/admins/new.html"} {
+		if _, err := fs.Stat(ctx, name); err != os.ErrPermission {
+			t.Errorf("Stat(_, %q) returned %v, should be %v", name, err,
+				os.ErrPermission)
+		}
+	}
+	if _, err := fs.OpenFile(ctx, "/admins/body.html", os.O_RDONLY,
+		0); err != os.ErrPermission {
+		t.Errorf("Opening a restricted file returned %v", err)
+	}
+	if err := fs.Mkdir(ctx, "/admins/new", 0755); err != os.ErrPermission {
+		t.Errorf("Creating a directory in a restricted node returned %v", err)
+	}
+	if err := fs.Rename(ctx, "/members/body.html",
+		"/admins/body.html"); err != os.ErrPermission {
+		t.Errorf("Moving a file into a restricted node returned %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/members/body.html"); err != nil {
+		t.Errorf("Could not stat viewable file: %v", err)
+	}
+	write := func(fs *davFS, name, content string) error {
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	if err := write(fs, "/members/node.yaml",
+		`{"type": "Document"}`); err != os.ErrPermission {
+		t.Errorf("Dropping the restriction returned %v", err)
+	}
+	if err := write(fs, "/members/body.html", "Changed"); err != nil {
+		t.Errorf("Could not write viewable file: %v", err)
+	}
+	if err := write(fs, "/members/node.yaml",
+		`{"type": "Document", "title": "Members", "restrict": "login"}`); err !=
+		nil {
+		t.Errorf("Could not change node keeping the restriction: %v", err)
+	}
+	if err := fs.RemoveAll(ctx, "/members/node.yaml"); err != os.ErrPermission {
+		t.Errorf("Removing a restricted node.yaml returned %v", err)
+	}
+	if err := fs.Rename(ctx, "/members/node.yaml",
+		"/members/old.yaml"); err != os.ErrPermission {
+		t.Errorf("Moving a restricted node.yaml returned %v", err)
+	}
+	if newNodeAccess(root, nil).CanView("/members") {
+		t.Errorf("Restriction has been dropped")
+	}
+	admin := &davFS{Site: site_, Login: "bob", Scope: "/",
+		Access: newNodeAccess(root, []string{roleAdmin}), Logf: t.Logf}
+	if err := write(admin, "/members/node.yaml",
+		`{"type": "Document"}`); err != nil {
+		t.Errorf("Admin could not drop the restriction: %v", err)
+	}
+}
+
+func TestServeDAV(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":         `{"type": "Document"}`,
+		"/data/foo/node.yaml":     `{"type": "Document"}`,
+		"/data/foo/body.html":     "Foo",
+		"/data/admins/node.yaml":  `{"type": "Document", "restrict": "admin"}`,
+		"/data/admins/body.html":  "Admins",
+		"/data/members/node.yaml": `{"type": "Document", "restrict": "login"}`,
+		"/config/__empty__":       ""}, "TestServeDAV")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	configDir := filepath.Join(root, "config")
+	if err := saveUsers(configDir, []user{
+		{User: client.User{Login: "editor", Password: hashPassword("pw", 4)},
+			Roles: []string{roleEditor}},
+		{User: client.User{Login: "reader", Password: hashPassword("pw", 4)},
+			Roles: []string{roleReader}}}); err != nil {
+		t.Fatalf("Could not save users: %v", err)
+	}
+	tests := []struct {
+		Method, URL     string
+		Login, Password string
+		Body            string
+		Disabled        bool
+		Status          int
+	}{
+		{"GET", "https://example.com/@@dav/foo/body.html", "editor", "pw", "",
+			true, http.StatusNotFound},
+		{"GET", "http://example.com/@@dav/foo/body.html", "editor", "pw", "",
+			false, http.StatusForbidden},
+		{"GET", "https://example.com/@@dav/foo/body.html", "", "", "", false,
+			http.StatusUnauthorized},
+		{"GET", "https://example.com/@@dav/foo/body.html", "editor", "wrong",
+			"", false, http.StatusUnauthorized},
+		{"GET", "https://example.com/@@dav/foo/body.html", "reader", "pw", "",
+			false, http.StatusForbidden},
+		{"GET", "https://example.com/@@dav/foo/body.html", "editor", "pw", "",
+			false, http.StatusOK},
+		{"GET", "https://example.com/@@dav/.monsti/audit.log", "editor", "pw",
+			"", false, http.StatusNotFound},
+		{"GET", "https://example.com/@@dav/admins/body.html", "editor", "pw",
+			"", false, http.StatusNotFound},
+		{"PUT", "https://example.com/@@dav/members/node.yaml", "editor", "pw",
+			`{"type": "Document"}`, false, http.StatusForbidden},
+		{"PUT", "https://example.com/@@dav/foo/node.yaml", "editor", "pw",
+			`{"type": `, false, http.StatusBadRequest},
+		{"PUT", "https://example.com/@@dav/foo/node.yaml", "editor", "pw",
+			`{"type": "Document", "title": "Foo"}`, false, http.StatusCreated}}
+	for i, v := range tests {
+		h, stop := setupWorkerHandler(filepath.Join(root, "data"),
+			ioutil.Discard, nil)
+		site_, _ := h.Sites.Get("foo")
+		site_.Directories.Config = configDir
+		site_.WebDAV = !v.Disabled
+		h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(v.Method, v.URL, strings.NewReader(v.Body))
+		if len(v.Login) > 0 {
+			r.SetBasicAuth(v.Login, v.Password)
+		}
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: %v %v got status %v, should be %v", i, v.Method,
+				v.URL, w.Code, v.Status)
+		}
+	}
+	node, err := readStoredNode(filepath.Join(root, "data"), "/foo")
+	if err != nil || node.Title != "Foo" {
+		t.Errorf("Node has not been written: %+v, %v", node, err)
+	}
+	// Read-only sites may be read but not changed.
+	for method, status := range map[string]int{
+		"GET":       http.StatusOK,
+		"PUT":       http.StatusForbidden,
+		"DELETE":    http.StatusForbidden,
+		"MKCOL":     http.StatusForbidden,
+		"MOVE":      http.StatusForbidden,
+		"COPY":      http.StatusForbidden,
+		"PROPPATCH": http.StatusForbidden} {
+		h, stop := setupWorkerHandler(filepath.Join(root, "data"),
+			ioutil.Discard, nil)
+		site_, _ := h.Sites.Get("foo")
+		site_.Directories.Config = configDir
+		site_.WebDAV = true
+		site_.ReadOnly = true
+		h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "https://example.com/@@dav/foo/body.html",
+			strings.NewReader(""))
+		r.SetBasicAuth("editor", "pw")
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != status {
+			t.Errorf("%v on read-only site got status %v, should be %v", method,
+				w.Code, status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "data", "foo",
+		"body.html")); err != nil {
+		t.Errorf("File of read-only site has been changed: %v", err)
+	}
+}
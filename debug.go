@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"github.com/monsti/util/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// debugInfo is collected while handling requests of admins to sites with
+// enabled debug toolbar. It's shown in the toolbar below the page.
+type debugInfo struct {
+	// NodeFile is the loaded node.yaml file.
+	NodeFile string
+	NodeType string
+	// PrimaryNavRoot and SecondaryNavRoot are the paths of the nodes the
+	// navigations have been built for. Empty if there is no navigation.
+	PrimaryNavRoot, SecondaryNavRoot string
+	Regions                          []debugRegion
+	Templates                        []debugTemplate
+	// Timer records the time spent in the worker.
+	Timer *requestTimer
+}
+
+// debugRegion describes where the content of a region has been found.
+type debugRegion struct {
+	Name string
+	// Source is the path of the node defining the content, or empty if the
+	// region has no content.
+	Source string
+}
+
+// debugTemplate is a template rendered by renderInMaster.
+type debugTemplate struct {
+	Name string
+	// File is the template's file, if it's known.
+	File string
+}
+
+// WorkerTime returns the time between queueing the ticket of the request
+// and receiving the worker's response.
+func (d *debugInfo) WorkerTime() time.Duration {
+	if d.Timer == nil {
+		return 0
+	}
+	return d.Timer.Phases[phaseQueue] + d.Timer.Phases[phaseWorker]
+}
+
+// startDebug starts collecting debug information for the given request if
+// the site has enabled the debug toolbar and the user is an admin. Returns
+// nil otherwise.
+func startDebug(r *http.Request, site site, roles []string) *debugInfo {
+	if !site.DebugToolbar || !hasRole(roles, roleAdmin) {
+		return nil
+	}
+	info := &debugInfo{Timer: getRequestTimer(r)}
+	if info.Timer == nil {
+		info.Timer = newRequestTimer(r, time.Now())
+	}
+	context.Set(r, debugInfoKey, info)
+	return info
+}
+
+// requestDebugInfo returns the debug information of the given request or
+// nil if the debug toolbar won't be shown.
+func requestDebugInfo(r *http.Request) *debugInfo {
+	info, _ := context.Get(r, debugInfoKey).(*debugInfo)
+	return info
+}
+
+// debugRenderer records the templates it renders in the debug information.
+type debugRenderer struct {
+	renderer
+	Info *debugInfo
+}
+
+func (r debugRenderer) Render(name string, context interface{}, locale,
+	siteTemplates string) string {
+	tmpl := debugTemplate{Name: name}
+	if shared, ok := r.renderer.(*templateRenderer); ok {
+		tmpl.File = templateFile(name, siteTemplates, shared.Root)
+	}
+	r.Info.Templates = append(r.Info.Templates, tmpl)
+	return r.renderer.Render(name, context, locale, siteTemplates)
+}
+
+// appendToolbar renders the debug toolbar and inserts it at the end of the
+// given page's body.
+func appendToolbar(r renderer, page string, info *debugInfo, locale,
+	siteTemplates string) string {
+	toolbar := r.Render("daemon/debugtoolbar",
+		template.Context{"Debug": info}, locale, siteTemplates)
+	end := strings.LastIndex(strings.ToLower(page), "</body>")
+	if end == -1 {
+		return page + toolbar
+	}
+	return page[:end] + toolbar + page[end:]
+}
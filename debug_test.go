@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStartDebug(t *testing.T) {
+	tests := []struct {
+		Enabled bool
+		Roles   []string
+		Debug   bool
+	}{
+		{true, []string{roleAdmin}, true},
+		{true, []string{"editor"}, false},
+		{true, nil, false},
+		{false, []string{roleAdmin}, false}}
+	for i, v := range tests {
+		r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+		site_ := site{DebugToolbar: v.Enabled}
+		info := startDebug(r, site_, v.Roles)
+		if (info != nil) != v.Debug || requestDebugInfo(r) != info {
+			t.Errorf("Test %v: startDebug(...) returned %v", i, info)
+		}
+		if info != nil && (info.Timer == nil || getRequestTimer(r) == nil) {
+			t.Errorf("Test %v: Request of debug toolbar is not timed", i)
+		}
+	}
+}
+
+func TestDebugToolbar(t *testing.T) {
+	toolbar, err := ioutil.ReadFile("templates/debugtoolbar.html")
+	if err != nil {
+		t.Fatalf("Could not read toolbar template: %v", err)
+	}
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/foo/node.yaml":                 "title: Foo",
+		"/data/foo/sidebar.html":              "Sidebar",
+		"/data/foo/bar/node.yaml":             "title: Bar",
+		"/templates/master.html":              "<html><body>{{.Page.Content}}</body></html>",
+		"/templates/daemon/debugtoolbar.html": string(toolbar)},
+		"TestDebugToolbar")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r := &templateRenderer{Root: filepath.Join(root, "templates")}
+	site_ := site{}
+	site_.Directories.Data = filepath.Join(root, "data")
+	info := &debugInfo{NodeFile: "/data/foo/bar/<script>alert(1)</script>"}
+	env := masterTmplEnv{Node: client.Node{Path: "/foo/bar"}, Debug: info}
+	ret := renderInMaster(r, []byte("Content"), env, new(settings), site_, "")
+	if !strings.HasPrefix(ret, "<html><body>Content<details") ||
+		!strings.HasSuffix(ret, "</details>\n</body></html>") {
+		t.Errorf("Toolbar has not been appended to the body: %q", ret)
+	}
+	if strings.Contains(ret, "<script>") ||
+		!strings.Contains(ret, "&lt;script&gt;") {
+		t.Errorf("Toolbar values have not been escaped: %q", ret)
+	}
+	if info.PrimaryNavRoot != "/" || info.SecondaryNavRoot != "/foo" {
+		t.Errorf("Navigation roots are %q and %q, should be / and /foo",
+			info.PrimaryNavRoot, info.SecondaryNavRoot)
+	}
+	sources := make(map[string]string)
+	for _, reg := range info.Regions {
+		sources[reg.Name] = reg.Source
+	}
+	if sources["sidebar"] != "/foo" || sources["footer"] != "" {
+		t.Errorf("Region sources are %v", sources)
+	}
+	if len(info.Templates) != 1 || info.Templates[0].Name != "master" ||
+		info.Templates[0].File != filepath.Join(root, "templates",
+			"master.html") {
+		t.Errorf("Rendered templates are %v", info.Templates)
+	}
+	env.Debug = nil
+	if ret := renderInMaster(r, []byte("Content"), env, new(settings), site_,
+		""); strings.Contains(ret, "details") {
+		t.Errorf("Toolbar has been rendered without debug information: %q", ret)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// maxDiffLines is the maximum number of lines of texts to be diffed.
+const maxDiffLines = 5000
+
+// isText returns true if the given content seems to be text.
+func isText(content []byte) bool {
+	return utf8.Valid(content) && !bytes.Contains(content, []byte{0})
+}
+
+// diffOp is a line of an edit script: ' ' for unchanged, '-' for removed and
+// '+' for added lines.
+type diffOp struct {
+	Kind byte
+	Line string
+}
+
+// diffLines returns an edit script transforming the lines a into b.
+//
+// It uses Myers' algorithm in its linear space variant, i.e. it needs
+// O((N+M)D) time and O(N+M) space for N and M lines with D differences.
+func diffLines(a, b []string) []diffOp {
+	return appendDiff(nil, a, b)
+}
+
+// appendDiff appends the edit script transforming the lines a into b to the
+// given operations.
+func appendDiff(ops []diffOp, a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) &&
+		a[len(a)-suffix-1] == b[len(b)-suffix-1] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+	x, y := -1, -1
+	if len(a) > 0 && len(b) > 0 {
+		x, y = middleSnake(a, b)
+	}
+	if x >= 0 && x+y > 0 && x+y < len(a)+len(b) {
+		ops = appendDiff(ops, a[:x], b[:y])
+		ops = appendDiff(ops, a[x:], b[y:])
+	} else {
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+	}
+	for _, line := range common {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// middleSnake returns the point where the forward and reverse searches for
+// the shortest edit script transforming the lines a into b meet. The
+// script can be split at this point.
+//
+// Returns -1, -1 if the lines have nothing in common.
+func middleSnake(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// forward[offset+k] and reverse[offset+k] are the furthest reaching x
+	// of the forward and reverse paths on diagonal k.
+	forward := make([]int, 2*offset+1)
+	reverse := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i], reverse[i] = -1, -1
+	}
+	forward[offset+1], reverse[offset+1] = 0, 0
+	delta := n - m
+	// If delta is odd, the forward path will overlap the reverse path.
+	odd := delta%2 != 0
+	// Diagonals which left the grid aren't searched further.
+	startF, endF, startR, endR := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + startF; k <= d-endF; k += 2 {
+			var x int
+			if k == -d || k != d && forward[offset+k-1] < forward[offset+k+1] {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			switch {
+			case x > n:
+				endF += 2
+			case y > m:
+				startF += 2
+			case odd:
+				i := offset + delta - k
+				if i >= 0 && i < len(reverse) && reverse[i] != -1 &&
+					x >= n-reverse[i] {
+					return x, y
+				}
+			}
+		}
+		for k := -d + startR; k <= d-endR; k += 2 {
+			var x int
+			if k == -d || k != d && reverse[offset+k-1] < reverse[offset+k+1] {
+				x = reverse[offset+k+1]
+			} else {
+				x = reverse[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			reverse[offset+k] = x
+			switch {
+			case x > n:
+				endR += 2
+			case y > m:
+				startR += 2
+			case !odd:
+				i := offset + delta - k
+				if i >= 0 && i < len(forward) && forward[i] != -1 &&
+					forward[i] >= n-x {
+					return forward[i], forward[i] - (i - offset)
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+// splitLines splits the given text into lines without line endings.
+func splitLines(text string) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// unifiedDiff returns a unified diff of the texts a and b, named nameA and
+// nameB. Returns an empty string if the texts are equal.
+func unifiedDiff(nameA, nameB, a, b string) (string, error) {
+	linesA, linesB := splitLines(a), splitLines(b)
+	if len(linesA) > maxDiffLines || len(linesB) > maxDiffLines {
+		return "", fmt.Errorf("Texts too long to be diffed")
+	}
+	ops := diffLines(linesA, linesB)
+	var buf bytes.Buffer
+	// Find hunks, i.e. changed lines with their context.
+	for start := 0; start < len(ops); {
+		for start < len(ops) && ops[start].Kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		end := start
+		for unchanged := 0; end < len(ops) && unchanged <= 2*diffContext; end++ {
+			if ops[end].Kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		// Trim trailing context.
+		for end > start && ops[end-1].Kind == ' ' {
+			end--
+		}
+		from := start - diffContext
+		if from < 0 {
+			from = 0
+		}
+		to := end + diffContext
+		if to > len(ops) {
+			to = len(ops)
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %v\n+++ %v\n", nameA, nameB)
+		}
+		lineA, lineB := 1, 1
+		for _, op := range ops[:from] {
+			if op.Kind != '+' {
+				lineA++
+			}
+			if op.Kind != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, op := range ops[from:to] {
+			if op.Kind != '+' {
+				countA++
+			}
+			if op.Kind != '-' {
+				countB++
+			}
+		}
+		if countA == 0 {
+			lineA--
+		}
+		if countB == 0 {
+			lineB--
+		}
+		fmt.Fprintf(&buf, "@@ -%v,%v +%v,%v @@\n", lineA, countA, lineB, countB)
+		for _, op := range ops[from:to] {
+			fmt.Fprintf(&buf, "%c%v\n", op.Kind, op.Line)
+		}
+		start = to
+	}
+	return buf.String(), nil
+}
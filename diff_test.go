@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		A, B, Diff string
+	}{
+		{"", "", ""},
+		{"foo\nbar\n", "foo\nbar\n", ""},
+		{"", "foo\n", "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+foo\n"},
+		{"foo\n", "", "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-foo\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			"--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			"--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n"}}
+	for i, v := range tests {
+		ret, err := unifiedDiff("a", "b", v.A, v.B)
+		if err != nil || ret != v.Diff {
+			t.Errorf("Test %v: unifiedDiff(_, _, %q, %q) =\n%v, %v\nshould be\n%v",
+				i, v.A, v.B, ret, err, v.Diff)
+		}
+	}
+}
+
+// lcsLength returns the length of the longest common subsequence of the
+// lines a and b.
+func lcsLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+func TestDiffLines(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(30))
+		for i := range lines {
+			lines[i] = string('a' + rune(random.Intn(4)))
+		}
+		return lines
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		var gotA, gotB []string
+		unchanged := 0
+		for _, op := range diffLines(a, b) {
+			if op.Kind != '+' {
+				gotA = append(gotA, op.Line)
+			}
+			if op.Kind != '-' {
+				gotB = append(gotB, op.Line)
+			}
+			if op.Kind == ' ' {
+				unchanged++
+			}
+		}
+		if strings.Join(gotA, ",") != strings.Join(a, ",") ||
+			strings.Join(gotB, ",") != strings.Join(b, ",") {
+			t.Fatalf("diffLines(%v, %v) doesn't transform a into b", a, b)
+		}
+		if lcs := lcsLength(a, b); unchanged != lcs {
+			t.Fatalf("diffLines(%v, %v) keeps %v lines, should keep %v", a, b,
+				unchanged, lcs)
+		}
+	}
+}
+
+func TestUnifiedDiffLong(t *testing.T) {
+	a := make([]string, maxDiffLines)
+	b := make([]string, maxDiffLines)
+	for i := range a {
+		a[i], b[i] = "a", "b"
+	}
+	ret, err := unifiedDiff("a", "b", strings.Join(a, "\n"),
+		strings.Join(b, "\n"))
+	if err != nil || strings.Count(ret, "\n") != 2*maxDiffLines+3 {
+		t.Errorf("unifiedDiff(...) of long texts returned %v lines, %v",
+			strings.Count(ret, "\n"), err)
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		Content string
+		Text    bool
+	}{
+		{"", true},
+		{"Hello Wörld\n", true},
+		{"\x89PNG\r\n\x1a\n\x00\x00", false},
+		{"\xff\xfe", false}}
+	for i, v := range tests {
+		if ret := isText([]byte(v.Content)); ret != v.Text {
+			t.Errorf("Test %v: isText(%q) = %v, should be %v", i, v.Content, ret,
+				v.Text)
+		}
+	}
+}
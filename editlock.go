@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// editLockTTL is the time after which edit locks expire if not refreshed.
+const editLockTTL = 15 * time.Minute
+
+// editLockFile is the name of the lock file in the node directories.
+const editLockFile = ".lock"
+
+// editLock is an advisory lock of a node being edited.
+type editLock struct {
+	// User is the login of the user editing the node.
+	User string
+	// Since is the time the user started editing (RFC 3339).
+	Since string
+	// Refreshed is the time the lock has been refreshed the last time
+	// (RFC 3339).
+	Refreshed string
+}
+
+// Expired returns true if the lock has not been refreshed within the TTL.
+func (l *editLock) Expired(now time.Time) bool {
+	refreshed, err := time.Parse(time.RFC3339, l.Refreshed)
+	return err != nil || now.Sub(refreshed) > editLockTTL
+}
+
+// readEditLock returns the edit lock of the node at the given path of the data
+// directory located at the given root or nil if the node is not locked.
+func readEditLock(root, nodePath string) (*editLock, error) {
+	file, err := nodeFile(root, nodePath, editLockFile)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read edit lock: %v", err)
+	}
+	lock := new(editLock)
+	if err := goyaml.Unmarshal(content, lock); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal edit lock: %v", err)
+	}
+	return lock, nil
+}
+
+// activeEditLock returns the lock of the node at the given path if it is
+// held by some other user than the one with the given login.
+func activeEditLock(root, nodePath, login string, now time.Time) *editLock {
+	lock, err := readEditLock(root, nodePath)
+	if err != nil || lock == nil || lock.User == login || lock.Expired(now) {
+		return nil
+	}
+	return lock
+}
+
+// acquireEditLock locks the node at the given path for the user with the
+// given login.
+//
+// If the node is locked by another user, the lock will only be taken over
+// if takeover is true. Otherwise, the other user's lock will be returned.
+func acquireEditLock(root, nodePath, login string, takeover bool,
+	now time.Time) (*editLock, error) {
+	lock, err := readEditLock(root, nodePath)
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil && lock.User != login && !lock.Expired(now) && !takeover {
+		return lock, nil
+	}
+	if lock == nil || lock.User != login || lock.Expired(now) {
+		lock = &editLock{User: login, Since: now.Format(time.RFC3339)}
+	}
+	lock.Refreshed = now.Format(time.RFC3339)
+	content, err := goyaml.Marshal(lock)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal edit lock: %v", err)
+	}
+	file, err := nodeFile(root, nodePath, editLockFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(file, content, 0600); err != nil {
+		return nil, fmt.Errorf("Could not write edit lock: %v", err)
+	}
+	return nil, nil
+}
+
+// releaseEditLock removes the lock of the node at the given path if it is
+// held by the user with the given login.
+func releaseEditLock(root, nodePath, login string) error {
+	lock, err := readEditLock(root, nodePath)
+	if err != nil || lock == nil || lock.User != login {
+		return err
+	}
+	file, err := nodeFile(root, nodePath, editLockFile)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove edit lock: %v", err)
+	}
+	return nil
+}
+
+// takeOverEditLock handles requests to take over the lock of the node being
+// edited by another user and redirects to the edit form.
+//
+// The lock is only taken over if the request has a valid CSRF token.
+func (h *nodeHandler) takeOverEditLock(w http.ResponseWriter, r *http.Request,
+	node client.Node, login string, session *sessions.Session, site site) {
+	r.ParseForm()
+	if validCSRFRequest(r, session, r.Form.Get("CSRFToken")) {
+		_, err := acquireEditLock(site.Directories.Data, node.Path, login, true,
+			time.Now())
+		if err != nil {
+			h.requestLog(r, site.Name).Warn("Could not take over lock of %q: %v",
+				node.Path, err)
+		} else {
+			h.requestLog(r, site.Name).Info("User %q took over lock of %q", login,
+				node.Path)
+		}
+	}
+	http.Redirect(w, r, site.URL(path.Join(node.Path, "@@edit")),
+		http.StatusSeeOther)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEditLockExpired(t *testing.T) {
+	now := time.Date(2013, 4, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Refreshed string
+		Expired   bool
+	}{
+		{"", true},
+		{"2013-04-05T11:50:00Z", false},
+		{"2013-04-05T11:40:00Z", true}}
+	for i, v := range tests {
+		lock := editLock{User: "foo", Refreshed: v.Refreshed}
+		if ret := lock.Expired(now); ret != v.Expired {
+			t.Errorf("Test %v: Expired() = %v, should be %v", i, ret, v.Expired)
+		}
+	}
+}
+
+func TestEditLock(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": ""}, "TestEditLock")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	now := time.Date(2013, 4, 5, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		Action, User string
+		Minutes      int
+		// Holder is the user holding the lock afterwards.
+		Holder string
+		// Other is the user whose lock has been returned by acquireEditLock.
+		Other string
+	}{
+		{"acquire", "alice", 0, "alice", ""},
+		{"acquire", "bob", 5, "alice", "alice"},
+		{"acquire", "alice", 10, "alice", ""},
+		{"acquire", "bob", 20, "alice", "alice"},
+		{"acquire", "bob", 30, "bob", ""},
+		{"release", "alice", 31, "bob", ""},
+		{"takeover", "alice", 32, "alice", ""},
+		{"release", "alice", 33, "", ""}}
+	for i, v := range steps {
+		at := now.Add(time.Duration(v.Minutes) * time.Minute)
+		var other *editLock
+		switch v.Action {
+		case "acquire", "takeover":
+			other, err = acquireEditLock(root, "/foo", v.User,
+				v.Action == "takeover", at)
+		case "release":
+			err = releaseEditLock(root, "/foo", v.User)
+		}
+		if err != nil {
+			t.Fatalf("Step %v: %v failed: %v", i, v.Action, err)
+		}
+		if other != nil && other.User != v.Other ||
+			other == nil && len(v.Other) > 0 {
+			t.Errorf("Step %v: %v returned lock %v, should be held by %q", i,
+				v.Action, other, v.Other)
+		}
+		holder := ""
+		if lock := activeEditLock(root, "/foo", "", at); lock != nil {
+			holder = lock.User
+		}
+		if holder != v.Holder {
+			t.Errorf("Step %v: Lock is held by %q, should be held by %q", i,
+				holder, v.Holder)
+		}
+	}
+}
+
+func TestTakeOverEditLock(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": ""}, "TestTakeOverEditLock")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	h, stop := setupWorkerHandler(root, &logBuf, func(worker.Ticket) {})
+	defer stop()
+	site, _ := h.Sites.Get("foo")
+	session := sessions.NewSession(nil, "test")
+	tests := []struct {
+		Token  string
+		Holder string
+	}{
+		{"", "alice"},
+		{"foo", "alice"},
+		{getCSRFToken(session), "bob"}}
+	for i, v := range tests {
+		if _, err := acquireEditLock(root, "/foo", "alice", true,
+			time.Now()); err != nil {
+			t.Fatalf("Test %v: Could not lock: %v", i, err)
+		}
+		body := url.Values{"CSRFToken": {v.Token}}.Encode()
+		r, _ := http.NewRequest("POST",
+			"http://example.com/foo/@@edit?takeover=1", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.takeOverEditLock(w, r, client.Node{Path: "/foo"}, "bob", session,
+			site)
+		if w.Code != http.StatusSeeOther ||
+			w.Header().Get("Location") != "/foo/@@edit" {
+			t.Errorf("Test %v: Got %v to %q, should redirect to the edit form",
+				i, w.Code, w.Header().Get("Location"))
+		}
+		holder := ""
+		if lock, _ := readEditLock(root, "/foo"); lock != nil {
+			holder = lock.User
+		}
+		if holder != v.Holder {
+			t.Errorf("Test %v: Lock is held by %q, should be held by %q", i,
+				holder, v.Holder)
+		}
+	}
+}
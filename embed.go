@@ -0,0 +1,228 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	htmlT "html/template"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// embeddedNode is a node embedded into a template, e.g. in a list of
+// teasers.
+type embeddedNode struct {
+	client.Node
+	// Created and LastUpdate are the zero time if unknown.
+	Created, LastUpdate time.Time
+}
+
+// embedder provides the functions to embed other nodes into templates.
+//
+// It memoizes the nodes read, so it should only be used for a single
+// request.
+type embedder struct {
+	// Root is the site's data directory.
+	Root string
+	// Access restricts the embeddable nodes.
+	Access *nodeAccess
+	// Locale selects the translations of the nodes.
+	Locale string
+	// Current is the path of the node being rendered. It can't be embedded
+	// into itself.
+	Current string
+	// Assets fingerprints the URLs of static assets. May be nil.
+	Assets   *assetResolver
+	nodes    map[string]*embeddedNode
+	bodies   map[string]string
+	children map[string][]*embeddedNode
+}
+
+// newEmbedder returns a new embedder for the request for the given node.
+//
+// If access is nil, only nodes anonymous users may view can be embedded.
+func newEmbedder(root string, access *nodeAccess, locale,
+	current string) *embedder {
+	if access == nil {
+		access = newNodeAccess(root, nil)
+	}
+	return &embedder{Root: root, Access: access, Locale: locale,
+		Current: current}
+}
+
+// embedFuncNames are the names of the template functions to embed other
+// nodes and to link to static assets.
+var embedFuncNames = []string{"nodeTitle", "nodeBody", "childList",
+	"assetURL"}
+
+// embedFuncs returns the template functions to embed other nodes using the
+// given embedder. If it's nil, the functions will return empty values and
+// plain asset paths.
+func embedFuncs(e *embedder) htmlT.FuncMap {
+	return htmlT.FuncMap{
+		"nodeTitle": e.Title,
+		"nodeBody":  e.Body,
+		"childList": e.Children,
+		"assetURL":  e.AssetURL}
+}
+
+// usesEmbedFuncs returns true iff the given template source seems to use one
+// of the functions to embed other nodes.
+func usesEmbedFuncs(source string) bool {
+	for _, name := range embedFuncNames {
+		if strings.Contains(source, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// node returns the node at the given path or nil if it does not exist or may
+// not be viewed.
+func (e *embedder) node(nodePath string) *embeddedNode {
+	nodePath = path.Clean("/" + nodePath)
+	if ret, ok := e.nodes[nodePath]; ok {
+		return ret
+	}
+	if e.nodes == nil {
+		e.nodes = make(map[string]*embeddedNode)
+	}
+	var ret *embeddedNode
+	if e.Access.CanView(nodePath) {
+		if stored, err := readStoredNode(e.Root, nodePath); err == nil {
+			stored.Node.Path = nodePath
+			node, _ := translateNode(e.Root, stored.Node, e.Locale)
+			ret = &embeddedNode{Node: node}
+			ret.Created, _ = time.Parse(nodeTimeFormat, stored.Created)
+			ret.LastUpdate, _ = time.Parse(nodeTimeFormat, stored.LastUpdate)
+		}
+	}
+	e.nodes[nodePath] = ret
+	return ret
+}
+
+// AssetURL returns the fingerprinted URL of the static asset at the given
+// path. See assetResolver.URL.
+func (e *embedder) AssetURL(assetPath string) string {
+	if e == nil {
+		return assetPath
+	}
+	return e.Assets.URL(assetPath)
+}
+
+// Title returns the title of the node at the given path.
+func (e *embedder) Title(nodePath string) string {
+	if e == nil {
+		return ""
+	}
+	if node := e.node(nodePath); node != nil {
+		return node.Title
+	}
+	return ""
+}
+
+// Body returns the body of the node at the given path.
+//
+// If maxBytes is positive, the body will be returned as plain text truncated
+// to about this length. Nodes can't embed their own body.
+func (e *embedder) Body(nodePath string, maxBytes int) htmlT.HTML {
+	if e == nil || e.node(nodePath) == nil {
+		return ""
+	}
+	nodePath = path.Clean("/" + nodePath)
+	if nodePath == path.Clean("/"+e.Current) {
+		return ""
+	}
+	body, ok := e.bodies[nodePath]
+	if !ok {
+		if e.bodies == nil {
+			e.bodies = make(map[string]string)
+		}
+		name, _ := findTranslation(e.Root, nodePath, "body.html", e.Locale)
+		if file, err := nodeFile(e.Root, nodePath, name); err == nil {
+			content, _ := ioutil.ReadFile(file)
+			body = string(content)
+		}
+		e.bodies[nodePath] = body
+	}
+	if maxBytes > 0 {
+		return htmlT.HTML(htmlT.HTMLEscapeString(
+			truncateText(strings.TrimSpace(stripTags(body)), maxBytes)))
+	}
+	return htmlT.HTML(body)
+}
+
+// embeddedNodeList sorts embedded nodes by the given key.
+type embeddedNodeList struct {
+	Nodes []*embeddedNode
+	Key   string
+}
+
+// Len is the number of nodes in the list.
+func (l *embeddedNodeList) Len() int {
+	return len(l.Nodes)
+}
+
+// Less returns whether the node with index i should sort before the node
+// with index j.
+func (l *embeddedNodeList) Less(i, j int) bool {
+	a, b := l.Nodes[i], l.Nodes[j]
+	key := strings.TrimPrefix(l.Key, "-")
+	if strings.HasPrefix(l.Key, "-") {
+		a, b = b, a
+	}
+	switch key {
+	case "title":
+		return a.Title < b.Title
+	case "created":
+		return a.Created.Before(b.Created)
+	case "updated":
+		return a.LastUpdate.Before(b.LastUpdate)
+	}
+	return a.Order < b.Order
+}
+
+// Swap swaps the nodes with indexes i and j.
+func (l *embeddedNodeList) Swap(i, j int) {
+	l.Nodes[i], l.Nodes[j] = l.Nodes[j], l.Nodes[i]
+}
+
+// Children returns at most limit viewable children of the node at the given
+// path, sorted by the given key: order, title, created or updated. Keys
+// prefixed with a dash sort in descending order.
+//
+// A limit of zero or less returns all children.
+func (e *embedder) Children(nodePath string, limit int,
+	sortKey string) []*embeddedNode {
+	if e == nil || e.node(nodePath) == nil {
+		return nil
+	}
+	nodePath = path.Clean("/" + nodePath)
+	key := nodePath + "\x00" + sortKey
+	children, ok := e.children[key]
+	if !ok {
+		if e.children == nil {
+			e.children = make(map[string][]*embeddedNode)
+		}
+		dir, err := nodeFile(e.Root, nodePath, "")
+		if err == nil {
+			entries, _ := ioutil.ReadDir(dir)
+			for _, entry := range entries {
+				if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+				child := e.node(path.Join(nodePath, entry.Name()))
+				if child != nil && !child.Hide {
+					children = append(children, child)
+				}
+			}
+		}
+		sort.Stable(&embeddedNodeList{children, sortKey})
+		e.children[key] = children
+	}
+	if limit > 0 && len(children) > limit {
+		children = children[:limit]
+	}
+	return children
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/monsti/util/template"
+	utesting "github.com/monsti/util/testing"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmbedder(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":              `{"title": "Home"}`,
+		"/body.html":              "<p>Home body</p>",
+		"/blog/node.yaml":         `{"title": "Blog"}`,
+		"/blog/a/node.yaml":       `{"title": "A", "order": 2, "created": "01 May 13 12:00 UTC"}`,
+		"/blog/a/body.html":       "<p>First entry with some text</p>",
+		"/blog/b/node.yaml":       `{"title": "B", "order": 1, "created": "03 May 13 12:00 UTC"}`,
+		"/blog/c/node.yaml":       `{"title": "C", "order": 3, "created": "02 May 13 12:00 UTC"}`,
+		"/blog/hidden/node.yaml":  `{"title": "Hidden", "hide": true}`,
+		"/members/node.yaml":      `{"title": "Members", "restrict": "login"}`,
+		"/members/body.html":      "Secret",
+		"/blog/a/node.de.yaml":    `{"title": "Ä"}`,
+		"/blog/.revisions/x.yaml": ""}, "TestEmbedder")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	e := newEmbedder(root, newNodeAccess(root, nil), "", "/")
+	tests := []struct {
+		Got, Expected string
+	}{
+		{e.Title("/blog/a"), "A"},
+		{e.Title("/missing"), ""},
+		{e.Title("/members"), ""},
+		{string(e.Body("/blog/a", 0)), "<p>First entry with some text</p>"},
+		{string(e.Body("/blog/a", 12)), "First entry …"},
+		{string(e.Body("/members", 0)), ""},
+		{string(e.Body("/", 0)), ""},
+		{newEmbedder(root, nil, "de", "").Title("/blog/a"), "Ä"},
+		{string(newEmbedder(root, nil, "", "").Body("/members", 0)), ""},
+		{string(newEmbedder(root, newNodeAccess(root, []string{roleReader}), "",
+			"").Body("/members", 0)), "Secret"}}
+	for i, v := range tests {
+		if v.Got != v.Expected {
+			t.Errorf("Test %v: Got %q, should be %q", i, v.Got, v.Expected)
+		}
+	}
+	children := []struct {
+		Limit           int
+		SortKey, Titles string
+	}{
+		{0, "", "B,A,C"},
+		{2, "order", "B,A"},
+		{0, "-title", "C,B,A"},
+		{0, "created", "A,C,B"},
+		{1, "-created", "B"}}
+	for _, v := range children {
+		var titles []string
+		for _, child := range e.Children("/blog", v.Limit, v.SortKey) {
+			titles = append(titles, child.Title)
+		}
+		if strings.Join(titles, ",") != v.Titles {
+			t.Errorf("Children(\"/blog\", %v, %q) = %v, should be %v", v.Limit,
+				v.SortKey, titles, v.Titles)
+		}
+	}
+	if len(e.Children("/members", 0, "")) != 0 {
+		t.Errorf("Children of restricted nodes should be empty")
+	}
+	// Memoized nodes won't be read again.
+	os.Remove(filepath.Join(root, "blog", "a", "body.html"))
+	if e.Title("/blog/a") != "A" || len(e.Body("/blog/a", 0)) == 0 {
+		t.Errorf("Embedded nodes should be memoized")
+	}
+}
+
+func TestRenderEmbeds(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/contact/node.yaml": `{"title": "Contact"}`,
+		"/data/contact/body.html": "<b>Mail us</b>",
+		"/templates/page.html":    `{{nodeTitle "/contact"}}|{{nodeBody "/contact" 0}}`,
+		"/templates/plain.html":   `{{G "Plain"}}`},
+		"TestRenderEmbeds")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	data := filepath.Join(root, "data")
+	r := &templateRenderer{Root: filepath.Join(root, "templates")}
+	tests := []struct {
+		Current, Rendered string
+	}{
+		{"/", "Contact|<b>Mail us</b>"},
+		{"/contact", "Contact|"}}
+	for i := 0; i < 2; i++ {
+		for _, v := range tests {
+			ret := r.Render("page", template.Context{
+				"Embed": newEmbedder(data, nil, "", v.Current)}, "", "")
+			if ret != v.Rendered {
+				t.Errorf("Rendering for %q returned %q, should be %q", v.Current,
+					ret, v.Rendered)
+			}
+		}
+	}
+	if ret := r.Render("page", template.Context{}, "", ""); ret != "|" {
+		t.Errorf("Rendering without embedder returned %q, should be \"|\"", ret)
+	}
+	if ret := r.Render("plain", nil, "", ""); ret != "Plain" {
+		t.Errorf("Rendering plain template returned %q", ret)
+	}
+}
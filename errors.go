@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"net/http"
+)
+
+// renderError replies to the request with an error page showing the given
+// message in the site's theme and the session's locale. API requests get a
+// JSON error object.
+//
+// The message should be an untranslated message ID. If the error page can't
+// be rendered, the message will be sent as plain text.
+func (h *nodeHandler) renderError(w http.ResponseWriter, r *http.Request,
+	message string, code int, node client.Node, cSession *client.Session,
+	site site) {
+	if isAPIRequest(r) {
+		writeJSON(w, map[string]string{"error": message}, code)
+		return
+	}
+	if cSession == nil {
+		cSession = &client.Session{Locale: site.Locale}
+	}
+	content, err := h.renderErrorPage(r, message, code, node, cSession, site)
+	if err != nil {
+		h.requestLog(r, site.Name).Error("Could not render error page: %v", err)
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprint(w, content)
+}
+
+// renderErrorPage renders the error page for the given message and code.
+//
+// Returns an error instead of panicking if the page can't be rendered, so
+// that it may be used in the panic handler.
+func (h *nodeHandler) renderErrorPage(r *http.Request, message string,
+	code int, node client.Node, cSession *client.Session, site site) (content string,
+	err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("%v", panicErr)
+		}
+	}()
+	G := l10n.UseCatalog(cSession.Locale)
+	body := h.renderTemplate("daemon/error", template.Context{
+		"Code":    code,
+		"Status":  G(http.StatusText(code)),
+		"Message": G(message)}, cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession,
+		Title: G(http.StatusText(code)), Access: requestNodeAccess(r)}
+	return renderInMaster(h.Renderer, []byte(body), env, h.currentSettings(),
+		site, cSession.Locale), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderError(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/__empty__":              "",
+		"/templates/master.html":       "<html>{{.Page.Title}}|{{.Page.Content}}</html>",
+		"/templates/daemon/error.html": "<p>{{.Code}} {{.Message}}</p>"},
+		"TestRenderError")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := site{}
+	site.Directories.Data = filepath.Join(root, "data")
+	tests := []struct {
+		Templates, Accept, Message string
+		Code                       int
+		ContentType, Body          string
+	}{
+		{"templates", "", "Node not found.", http.StatusNotFound,
+			"text/html; charset=utf-8",
+			"<html>Not Found|<p>404 Node not found.</p></html>"},
+		{"templates", "", "Application error.",
+			http.StatusInternalServerError, "text/html; charset=utf-8",
+			"<html>Internal Server Error|<p>500 Application error.</p></html>"},
+		{"templates", "application/json", "Forbidden.", http.StatusForbidden,
+			"application/json; charset=utf-8", `{"error":"Forbidden."}`},
+		{"missing", "", "Forbidden.", http.StatusForbidden,
+			"text/plain; charset=utf-8", "Forbidden.\n"}}
+	for i, v := range tests {
+		h := nodeHandler{
+			Renderer: &templateRenderer{Root: filepath.Join(root, v.Templates)},
+			Settings: new(settings)}
+		r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+		r.Header.Set("Accept", v.Accept)
+		w := httptest.NewRecorder()
+		h.renderError(w, r, v.Message, v.Code, client.Node{Path: "/"}, nil,
+			site)
+		body := strings.TrimSpace(w.Body.String())
+		if w.Code != v.Code || w.Header().Get("Content-Type") != v.ContentType ||
+			body != strings.TrimSpace(v.Body) {
+			t.Errorf("Test %v: renderError responded %v %q %q, should be %v %q %q",
+				i, w.Code, w.Header().Get("Content-Type"), body, v.Code,
+				v.ContentType, v.Body)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// walkExportTree calls the given function for the given directory and all
+// files and directories below it which should be exported.
+//
+// The function gets the slash separated path relative to the directory.
+// Hidden files and directories, e.g. the trash or the search index, will be
+// skipped. Symlinks will be skipped with a warning.
+func walkExportTree(dir string, log *leveledLogger,
+	fun func(rel, file string, info os.FileInfo) error) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && file != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			log.Warn("Skipping symlink %q while exporting", file)
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		return fun(filepath.ToSlash(rel), file, info)
+	})
+}
+
+// exportSize returns the total size in bytes of the files which would be
+// exported from the given directory.
+func exportSize(dir string) (int64, error) {
+	var size int64
+	err := walkExportTree(dir, nil, func(rel, file string,
+		info os.FileInfo) error {
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// writeExport writes a gzipped tar archive of the given directory to the
+// given writer.
+//
+// All entries are placed in a directory with the given name.
+func writeExport(w io.Writer, dir, name string, log *leveledLogger) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	err := walkExportTree(dir, log, func(rel, file string,
+		info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(name, rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(archive, f, info.Size())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not write archive: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("Could not write archive: %v", err)
+	}
+	return gz.Close()
+}
+
+// exportName returns the name of the export of the given node, derived from
+// the site's name, the node's path and the given date.
+func exportName(siteName, nodePath string, date time.Time) string {
+	parts := []string{siteName}
+	if trimmed := strings.Trim(nodePath, "/"); len(trimmed) > 0 {
+		parts = append(parts, strings.Replace(trimmed, "/", "-", -1))
+	}
+	parts = append(parts, date.Format("2006-01-02"))
+	return strings.Join(parts, "-")
+}
+
+// Export handles requests to export a node and its descendants.
+//
+// Without the download query parameter, a confirmation page will be shown.
+func (h *nodeHandler) Export(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if r.Method != "GET" {
+		panic("Request method not supported: " + r.Method)
+	}
+	dir, err := nodeFile(site.Directories.Data, node.Path, "")
+	if err != nil {
+		panic("Can't export node: " + err.Error())
+	}
+	name := exportName(site.Name, node.Path, time.Now())
+	if r.URL.Query().Get("download") == "1" {
+		h.requestLog(r, site.Name).Info("User %q exported %q",
+			sessionLogin(cSession), node.Path)
+		w.Header().Set("Content-Type", "application/x-gzip")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+		log := h.requestLog(r, site.Name)
+		if err := writeExport(w, dir, name, log); err != nil {
+			// The response has already been started, so there's no way to tell
+			// the client.
+			log.Error("Could not export %q: %v", node.Path, err)
+		}
+		return
+	}
+	size, err := exportSize(dir)
+	if err != nil {
+		panic("Can't estimate export size: " + err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/export", template.Context{
+		"Filename": name + ".tar.gz",
+		"Size":     fmt.Sprintf("%.1f MB", float64(size)/(1024*1024)),
+		"URL":      site.URL(path.Join(node.Path, "@@export")) + "?download=1"},
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Export"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
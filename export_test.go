@@ -0,0 +1,79 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	utesting "github.com/monsti/util/testing"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportName(t *testing.T) {
+	date := time.Date(2013, 4, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Path, Name string
+	}{
+		{"/", "foo-2013-04-05"},
+		{"/bar/", "foo-bar-2013-04-05"},
+		{"/bar/cruz", "foo-bar-cruz-2013-04-05"}}
+	for i, v := range tests {
+		if ret := exportName("foo", v.Path, date); ret != v.Name {
+			t.Errorf("Test %v: exportName(%q) = %q, should be %q", i, v.Path, ret,
+				v.Name)
+		}
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":          "title: Foo",
+		"/foo/navigation.yaml":    "",
+		"/foo/body.html":          "Hello",
+		"/foo/bar/node.yaml":      "title: Bar",
+		"/foo/.trash/x/node.yaml": "",
+		"/secret.txt":             "secret"}, "TestWriteExport")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := os.Symlink(filepath.Join(root, "secret.txt"),
+		filepath.Join(root, "foo", "link.txt")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+	dir := filepath.Join(root, "foo")
+	var buf bytes.Buffer
+	if err := writeExport(&buf, dir, "export", nil); err != nil {
+		t.Fatalf("writeExport failed: %v", err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Export is not gzipped: %v", err)
+	}
+	archive := tar.NewReader(gz)
+	var names []string
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Could not read archive: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+	expected := []string{"export/", "export/bar/", "export/bar/node.yaml",
+		"export/body.html", "export/navigation.yaml", "export/node.yaml"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Archive contains %v, should contain %v", names, expected)
+	}
+	size, err := exportSize(dir)
+	if err != nil || size != int64(len("title: Foo")+len("Hello")+
+		len("title: Bar")) {
+		t.Errorf("exportSize(_) = %v, %v, should be 25, nil", size, err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/monsti/rpc/client"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultFeedEntries is the default number of entries of a node's feed.
+const defaultFeedEntries = 20
+
+// feedSummaryLength is the maximum length of entry summaries in bytes.
+const feedSummaryLength = 500
+
+// feedSettings holds the feed settings of a node as stored in its node.yaml
+// file.
+type feedSettings struct {
+	// Enabled makes the node's children available as Atom feed at @@feed.
+	Enabled bool
+	// Entries is the maximum number of entries. Defaults to 20.
+	Entries int `yaml:",omitempty"`
+}
+
+// atomLink is a link of an Atom feed or entry.
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// atomText is a text construct of an Atom feed or entry.
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+// atomEntry is an entry of an Atom feed.
+type atomEntry struct {
+	ID        string    `xml:"id"`
+	Title     string    `xml:"title"`
+	Link      atomLink  `xml:"link"`
+	Published string    `xml:"published,omitempty"`
+	Updated   string    `xml:"updated"`
+	Author    *atomName `xml:"author,omitempty"`
+	Summary   *atomText `xml:"summary,omitempty"`
+}
+
+// atomName is a person construct of an Atom feed or entry.
+type atomName struct {
+	Name string `xml:"name"`
+}
+
+// atomFeed is an Atom feed as specified by RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomName    `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// feedItem is a child node to be included in a feed.
+type feedItem struct {
+	node             *storedNode
+	created, updated time.Time
+	summary          string
+}
+
+// feedItemList sorts feed items by creation time, most recent first.
+type feedItemList []feedItem
+
+// Len is the number of elements in the list.
+func (l feedItemList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l feedItemList) Less(i, j int) bool {
+	if l[i].created.Equal(l[j].created) {
+		return l[i].node.Path < l[j].node.Path
+	}
+	return l[i].created.After(l[j].created)
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l feedItemList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// truncateText shortens the given text to at most max bytes without breaking
+// runes or, if possible, words.
+func truncateText(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+	if space := strings.LastIndex(text[:max], " "); space > 0 {
+		max = space
+	}
+	return text[:max] + " …"
+}
+
+// getFeedItems returns the viewable children of the node at the given path
+// of the data directory located at the given root, most recent first.
+func getFeedItems(root, nodePath string, access *nodeAccess) ([]feedItem,
+	error) {
+	dir, err := nodeFile(root, nodePath, "")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var items []feedItem
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		childPath := path.Join(nodePath, entry.Name())
+		if !access.CanView(childPath) {
+			continue
+		}
+		child, err := readStoredNode(root, childPath)
+		if err != nil {
+			continue
+		}
+		item := feedItem{node: child}
+		item.created, _ = time.Parse(nodeTimeFormat, child.Created)
+		item.updated, err = time.Parse(nodeTimeFormat, child.LastUpdate)
+		if err != nil {
+			item.updated = item.created
+		}
+		if file, err := nodeFile(root, childPath, searchBodyFile); err == nil {
+			if body, err := ioutil.ReadFile(file); err == nil {
+				item.summary = truncateText(stripTags(string(body)),
+					feedSummaryLength)
+			}
+		}
+		items = append(items, item)
+	}
+	sort.Sort(feedItemList(items))
+	return items, nil
+}
+
+// buildFeed returns the Atom feed of the given node with the given items.
+//
+// baseURL is the absolute URL of the site without trailing slash.
+func buildFeed(node *storedNode, items []feedItem, baseURL string,
+	site site) *atomFeed {
+	nodeURL := baseURL + site.URL(node.Path)
+	feed := &atomFeed{
+		ID:     nodeURL,
+		Title:  node.Title,
+		Author: atomName{site.Title},
+		Links: []atomLink{
+			{Href: nodeURL},
+			{Rel: "self", Href: baseURL + site.URL(path.Join(node.Path, "@@feed"))}},
+		Entries: []atomEntry{}}
+	var updated time.Time
+	for _, item := range items {
+		entryURL := baseURL + site.URL(item.node.Path+"/")
+		entry := atomEntry{
+			ID:      entryURL,
+			Title:   item.node.Title,
+			Link:    atomLink{Href: entryURL},
+			Updated: item.updated.Format(time.RFC3339)}
+		if !item.created.IsZero() {
+			entry.Published = item.created.Format(time.RFC3339)
+		}
+		if len(item.node.CreatedBy) > 0 {
+			entry.Author = &atomName{item.node.CreatedBy}
+		}
+		if len(item.summary) > 0 {
+			entry.Summary = &atomText{Type: "text", Body: item.summary}
+		}
+		if item.updated.After(updated) {
+			updated = item.updated
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if updated.IsZero() {
+		if t, err := time.Parse(nodeTimeFormat, node.LastUpdate); err == nil {
+			updated = t
+		}
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+	return feed
+}
+
+// Feed handles requests for the Atom feed of a node's children.
+func (h *nodeHandler) Feed(w http.ResponseWriter, r *http.Request,
+	node client.Node, site site) {
+	if r.Method != "GET" {
+		panic("Request method not supported: " + r.Method)
+	}
+	stored, err := readStoredNode(site.Directories.Data, node.Path)
+	if err != nil {
+		panic("Could not read node: " + err.Error())
+	}
+	if stored.Feed == nil || !stored.Feed.Enabled {
+		h.renderError(w, r, "Page not found.", http.StatusNotFound, node, nil,
+			site)
+		return
+	}
+	items, err := getFeedItems(site.Directories.Data, node.Path,
+		requestNodeAccess(r))
+	if err != nil {
+		panic("Could not get feed items: " + err.Error())
+	}
+	entries := stored.Feed.Entries
+	if entries <= 0 {
+		entries = defaultFeedEntries
+	}
+	if len(items) > entries {
+		items = items[:entries]
+	}
+	feed := buildFeed(stored, items, requestScheme(r)+"://"+r.Host, site)
+	content, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		panic("Could not marshal feed: " + err.Error())
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(content)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/monsti/rpc/client"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		Text      string
+		Max       int
+		Truncated string
+	}{
+		{"", 10, ""},
+		{"foo bar", 10, "foo bar"},
+		{"foo bar cruz", 10, "foo bar …"},
+		{"foobarcruz!", 6, "foobar …"},
+		{"Größe", 3, "Gr …"}}
+	for i, v := range tests {
+		if ret := truncateText(v.Text, v.Max); ret != v.Truncated {
+			t.Errorf("Test %v: truncateText(%q, %v) = %q, should be %q", i, v.Text,
+				v.Max, ret, v.Truncated)
+		}
+	}
+}
+
+func TestBuildFeed(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2013, 4, day, 12, 0, 0, 0, time.UTC)
+	}
+	items := []feedItem{
+		{node: &storedNode{Node: client.Node{Path: "/blog/old", Title: "Old"}},
+			created: date(1), updated: date(5), summary: "Old <entry>"},
+		{node: &storedNode{Node: client.Node{Path: "/blog/new", Title: "New"},
+			CreatedBy: "editor"},
+			created: date(3), updated: date(3)}}
+	sort.Sort(feedItemList(items))
+	site := site{Title: "Foo Site", BasePath: "/sub"}
+	feed := buildFeed(&storedNode{Node: client.Node{Path: "/blog",
+		Title: "Blog"}}, items, "https://example.com", site)
+	if feed.ID != "https://example.com/sub/blog" || feed.Title != "Blog" ||
+		feed.Updated != "2013-04-05T12:00:00Z" {
+		t.Errorf("Feed has ID %q, title %q and update time %q", feed.ID,
+			feed.Title, feed.Updated)
+	}
+	expected := []atomEntry{
+		{ID: "https://example.com/sub/blog/new/", Title: "New",
+			Link:      atomLink{Href: "https://example.com/sub/blog/new/"},
+			Published: "2013-04-03T12:00:00Z", Updated: "2013-04-03T12:00:00Z",
+			Author: &atomName{"editor"}},
+		{ID: "https://example.com/sub/blog/old/", Title: "Old",
+			Link:      atomLink{Href: "https://example.com/sub/blog/old/"},
+			Published: "2013-04-01T12:00:00Z", Updated: "2013-04-05T12:00:00Z",
+			Summary: &atomText{Type: "text", Body: "Old <entry>"}}}
+	if !reflect.DeepEqual(feed.Entries, expected) {
+		t.Errorf("Feed entries are %v, should be %v", feed.Entries, expected)
+	}
+	content, err := xml.Marshal(feed)
+	if err != nil {
+		t.Fatalf("Could not marshal feed: %v", err)
+	}
+	if !strings.HasPrefix(string(content),
+		`<feed xmlns="http://www.w3.org/2005/Atom"><id>`) ||
+		!strings.Contains(string(content), "Old &lt;entry&gt;") {
+		t.Errorf("Marshalled feed is not a valid Atom feed: %s", content)
+	}
+}
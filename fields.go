@@ -0,0 +1,114 @@
+package main
+
+import (
+	"launchpad.net/goyaml"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// nodeFields holds the custom top-level keys of a node.yaml file, e.g. a
+// teaser text written by a worker, which are not part of storedNode.
+type nodeFields map[string]interface{}
+
+// Get returns the value of the given key, or an empty string if there is
+// none. f may be nil, so templates can use {{.Page.Fields.Get "teaser"}}
+// for any node.
+func (f nodeFields) Get(key string) interface{} {
+	if value, ok := f[key]; ok && value != nil {
+		return value
+	}
+	return ""
+}
+
+// storedNodeKeys are the keys of node.yaml files used by storedNode.
+var storedNodeKeys = yamlKeys(reflect.TypeOf(storedNode{}))
+
+// yamlKeys returns the keys used by goyaml for the fields of the given
+// struct type, including those of inlined structs.
+func yamlKeys(t reflect.Type) map[string]bool {
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		switch {
+		case tag[0] == "-":
+		case len(tag) > 1 && inStringSlice("inline", tag[1:]):
+			for key := range yamlKeys(field.Type) {
+				keys[key] = true
+			}
+		case len(tag[0]) > 0:
+			keys[tag[0]] = true
+		default:
+			keys[strings.ToLower(field.Name)] = true
+		}
+	}
+	return keys
+}
+
+// parseNodeFields returns the custom fields of the given content of a
+// node.yaml file. Returns nil if there are none.
+func parseNodeFields(content []byte) (nodeFields, error) {
+	var all map[string]interface{}
+	if err := goyaml.Unmarshal(content, &all); err != nil {
+		return nil, err
+	}
+	var fields nodeFields
+	for key, value := range all {
+		if storedNodeKeys[key] {
+			continue
+		}
+		if fields == nil {
+			fields = make(nodeFields)
+		}
+		fields[key] = value
+	}
+	return fields, nil
+}
+
+// getNodeFields returns the custom fields of the node at the given path of
+// the data directory located at root, using its cache if enabled. Returns
+// nil if there are none or if the node can't be read.
+func getNodeFields(root, nodePath string) nodeFields {
+	content, err := getNodeFile(root, nodePath, "node.yaml")
+	if err != nil {
+		return nil
+	}
+	fields, _ := parseNodeFields(content)
+	return fields
+}
+
+// marshalStoredNode returns the content of the node.yaml file of the given
+// node, including its custom fields.
+func marshalStoredNode(stored *storedNode) ([]byte, error) {
+	content, err := goyaml.Marshal(stored)
+	if err != nil || len(stored.Fields) == 0 {
+		return content, err
+	}
+	var all map[string]interface{}
+	if err := goyaml.Unmarshal(content, &all); err != nil {
+		return nil, err
+	}
+	if all == nil {
+		all = make(map[string]interface{})
+	}
+	for key, value := range stored.Fields {
+		if !storedNodeKeys[key] {
+			all[key] = value
+		}
+	}
+	return goyaml.Marshal(all)
+}
+
+// loadFields sets the custom fields of the nodes the links of the given
+// site's navigation point to. The links' targets must be absolute.
+func (nav navigation) loadFields(site site) {
+	for i, link := range nav {
+		nodePath, ok := site.stripBasePath(link.Target)
+		if !ok {
+			continue
+		}
+		nav[i].Fields = getNodeFields(site.Directories.Data,
+			path.Clean("/"+nodePath))
+	}
+}
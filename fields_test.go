@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNodeFieldsGet(t *testing.T) {
+	var fields nodeFields
+	if value := fields.Get("teaser"); value != "" {
+		t.Errorf("Get(...) of nil fields = %v", value)
+	}
+	fields = nodeFields{"teaser": "Hello", "empty": nil}
+	if value := fields.Get("teaser"); value != "Hello" {
+		t.Errorf(`Get("teaser") = %v, should be "Hello"`, value)
+	}
+	if value := fields.Get("empty"); value != "" {
+		t.Errorf(`Get("empty") = %v, should be ""`, value)
+	}
+}
+
+func TestParseNodeFields(t *testing.T) {
+	tests := []struct {
+		Content string
+		Fields  nodeFields
+	}{
+		{`{}`, nil},
+		{`{"type": "Document", "title": "Foo", "hide": true}`, nil},
+		{`{"type": "Document", "teaser": "Hello"}`,
+			nodeFields{"teaser": "Hello"}},
+		{`{"title": "Foo", "teaser": "Hello", "color": "red"}`,
+			nodeFields{"teaser": "Hello", "color": "red"}}}
+	for i, v := range tests {
+		fields, err := parseNodeFields([]byte(v.Content))
+		if err != nil {
+			t.Errorf("Test %v: parseNodeFields(...) returned error: %v", i, err)
+			continue
+		}
+		if len(fields) != len(v.Fields) {
+			t.Errorf("Test %v: parseNodeFields(...) = %v, should be %v", i,
+				fields, v.Fields)
+			continue
+		}
+		for key, value := range v.Fields {
+			if fields[key] != value {
+				t.Errorf("Test %v: Field %q is %v, should be %v", i, key,
+					fields[key], value)
+			}
+		}
+	}
+}
+
+func TestWriteNodeKeepsFields(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo",
+"teaser": "Hello"}`}, "TestWriteNodeKeepsFields")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := writeNode(client.Node{Path: "/foo", Type: "Document",
+		Title: "New Foo"}, "alice", root); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if teaser := getNodeFields(root, "/foo").Get("teaser"); teaser != "Hello" {
+		t.Errorf("Teaser after writeNode is %v, should be \"Hello\"", teaser)
+	}
+	if err := touchNode(root, "/foo", "bob", time.Now()); err != nil {
+		t.Fatalf("Could not touch node: %v", err)
+	}
+	if teaser := getNodeFields(root, "/foo").Get("teaser"); teaser != "Hello" {
+		t.Errorf("Teaser after touchNode is %v, should be \"Hello\"", teaser)
+	}
+}
+
+func TestRenderInMasterFields(t *testing.T) {
+	masterTmpl := `{{.Page.Fields.Get "teaser"}}
+{{range .Page.PrimaryNav}}#{{.Target}}|{{.Fields.Get "color"}}{{end}}`
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":        `{"title": "Home"}`,
+		"/data/foo/node.yaml":    `{"title": "Foo", "color": "red"}`,
+		"/data/bar/node.yaml":    `{"title": "Bar", "teaser": "Hello"}`,
+		"/templates/master.html": masterTmpl}, "TestRenderInMasterFields")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r := &templateRenderer{Root: filepath.Join(root, "templates")}
+	tests := []struct {
+		Theme    *themeManifest
+		Fields   nodeFields
+		Rendered string
+	}{
+		{nil, nil, "Hello\n#/bar/|#/foo/|"},
+		{&themeManifest{NavigationFields: true}, nil,
+			"Hello\n#/base/bar/|#/base/foo/|red"},
+		{nil, nodeFields{"teaser": "Preview"}, "Preview\n#/bar/|#/foo/|"}}
+	for i, v := range tests {
+		site_ := site{Theme: v.Theme}
+		site_.Directories.Data = filepath.Join(root, "data")
+		if v.Theme != nil {
+			site_.BasePath = "/base"
+		}
+		ret := renderInMaster(r, nil, masterTmplEnv{
+			Node:   client.Node{Title: "Bar", Path: "/bar"},
+			Fields: v.Fields}, new(settings), site_, "")
+		if ret != v.Rendered {
+			t.Errorf("Test %v: renderInMaster(...) returned %q, should be %q", i,
+				ret, v.Rendered)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/monsti/form"
+	"strings"
+	"sync"
+	"time"
+)
+
+// formTokenSessionKey is the session value key of the issued one-time form
+// tokens.
+const formTokenSessionKey = "form_tokens"
+
+// maxSessionFormTokens is the maximum number of issued form tokens kept in
+// a session. The oldest tokens get dropped first, e.g. those of abandoned
+// forms.
+const maxSessionFormTokens = 8
+
+// maxUsedFormTokens is the maximum number of used form tokens remembered to
+// detect replayed submissions.
+const maxUsedFormTokens = 1000
+
+// formTokenWait is the time a replayed submission waits for the first one
+// to finish.
+var formTokenWait = 10 * time.Second
+
+// usedFormToken is a form token which has been submitted.
+type usedFormToken struct {
+	// done gets closed once the submission finished.
+	done chan struct{}
+	// Target is the URL the successful submission redirected to. Empty if
+	// the submission is still running.
+	Target string
+}
+
+// formTokenRegistry remembers the used one-time form tokens.
+//
+// Sessions are stored in cookies, so replayed submissions might still
+// carry the used token in their session.
+type formTokenRegistry struct {
+	mutex  sync.Mutex
+	tokens map[string]*usedFormToken
+	// order holds the tokens of finished submissions, oldest first.
+	order []string
+}
+
+// usedFormTokens holds the used form tokens of all sites.
+var usedFormTokens = &formTokenRegistry{
+	tokens: make(map[string]*usedFormToken)}
+
+// Claim claims the given token for a submission.
+//
+// Returns true if the token has not been used before. Otherwise, returns
+// the target of the first submission, waiting for it if necessary. The
+// target is empty if waiting timed out.
+func (f *formTokenRegistry) Claim(token string) (string, bool) {
+	for {
+		f.mutex.Lock()
+		used, ok := f.tokens[token]
+		if !ok {
+			f.tokens[token] = &usedFormToken{done: make(chan struct{})}
+			f.mutex.Unlock()
+			return "", true
+		}
+		f.mutex.Unlock()
+		select {
+		case <-used.done:
+		case <-time.After(formTokenWait):
+			return "", false
+		}
+		f.mutex.Lock()
+		target := used.Target
+		f.mutex.Unlock()
+		if len(target) > 0 {
+			return target, false
+		}
+		// The first submission failed, so try again.
+	}
+}
+
+// Finish finishes the submission of the given claimed token. target is the
+// URL the successful submission redirected to, or empty if the submission
+// failed and the token may be used again.
+func (f *formTokenRegistry) Finish(token, target string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	used, ok := f.tokens[token]
+	if !ok {
+		return
+	}
+	if len(target) == 0 {
+		delete(f.tokens, token)
+	} else {
+		used.Target = target
+		f.order = append(f.order, token)
+		if len(f.order) > maxUsedFormTokens {
+			delete(f.tokens, f.order[0])
+			f.order = f.order[1:]
+		}
+	}
+	close(used.done)
+}
+
+// Target returns the target of the successful submission of the given
+// token, or an empty string if there is none.
+func (f *formTokenRegistry) Target(token string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if used, ok := f.tokens[token]; ok && len(token) > 0 {
+		return used.Target
+	}
+	return ""
+}
+
+// formTokenField returns the form field of one-time form tokens.
+func formTokenField() form.Field {
+	return form.Field{"", "", nil, new(form.HiddenWidget)}
+}
+
+// sessionFormTokens returns the form tokens issued to the given session,
+// oldest first.
+func sessionFormTokens(session *sessions.Session) []string {
+	tokens, _ := session.Values[formTokenSessionKey].(string)
+	return strings.Fields(tokens)
+}
+
+// getFormToken returns the given one-time form token if it has been issued
+// to the given session, e.g. when rendering a form again after a failed
+// submission. Otherwise, a new token will be issued and stored in the
+// session. The session has to be saved afterwards.
+func getFormToken(session *sessions.Session, token string) string {
+	if len(token) > 0 && inStringSlice(token, sessionFormTokens(session)) {
+		return token
+	}
+	token = randomToken()
+	tokens := append(sessionFormTokens(session), token)
+	if len(tokens) > maxSessionFormTokens {
+		tokens = tokens[len(tokens)-maxSessionFormTokens:]
+	}
+	session.Values[formTokenSessionKey] = strings.Join(tokens, " ")
+	return token
+}
+
+// revokeFormToken removes the given token from the session after a
+// successful submission. The session has to be saved afterwards.
+func revokeFormToken(session *sessions.Session, token string) {
+	var tokens []string
+	for _, issued := range sessionFormTokens(session) {
+		if issued != token {
+			tokens = append(tokens, issued)
+		}
+	}
+	session.Values[formTokenSessionKey] = strings.Join(tokens, " ")
+}
+
+// Outcomes of claimFormToken.
+const (
+	// The form may be submitted.
+	formTokenValid = iota
+	// The form has already been submitted successfully.
+	formTokenReplayed
+	// The token has not been issued to the session or it has been dropped.
+	formTokenInvalid
+)
+
+// claimFormToken claims the given one-time form token of a submission.
+//
+// Returns the target of the first submission if the form has been
+// submitted before. Submissions without token, e.g. of API clients, are
+// always valid. The returned function has to be called with the target of
+// a valid submission if it succeeded, or an empty string if it failed.
+func claimFormToken(session *sessions.Session, token string) (int, string,
+	func(target string)) {
+	finish := func(string) {}
+	if len(token) == 0 {
+		return formTokenValid, "", finish
+	}
+	if target := usedFormTokens.Target(token); len(target) > 0 {
+		return formTokenReplayed, target, finish
+	}
+	if !inStringSlice(token, sessionFormTokens(session)) {
+		return formTokenInvalid, "", finish
+	}
+	target, ok := usedFormTokens.Claim(token)
+	switch {
+	case ok:
+		return formTokenValid, "", func(target string) {
+			usedFormTokens.Finish(token, target)
+		}
+	case len(target) > 0:
+		return formTokenReplayed, target, finish
+	}
+	return formTokenInvalid, "", finish
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetFormToken(t *testing.T) {
+	session := sessions.NewSession(nil, "test")
+	first := getFormToken(session, "")
+	if len(first) == 0 || getFormToken(session, first) != first {
+		t.Errorf("getFormToken(_, %q) should return the issued token", first)
+	}
+	if ret := getFormToken(session, "foo"); ret == "foo" || ret == first {
+		t.Errorf("getFormToken(_, \"foo\") = %q, should be a new token", ret)
+	}
+	for i := 0; i < 2*maxSessionFormTokens; i++ {
+		getFormToken(session, "")
+	}
+	tokens := sessionFormTokens(session)
+	if len(tokens) != maxSessionFormTokens || inStringSlice(first, tokens) {
+		t.Errorf("Session holds %v tokens, should be the %v newest ones",
+			len(tokens), maxSessionFormTokens)
+	}
+	revokeFormToken(session, tokens[0])
+	if ret := sessionFormTokens(session); len(ret) !=
+		maxSessionFormTokens-1 || inStringSlice(tokens[0], ret) {
+		t.Errorf("revokeFormToken should remove the token, got %v", ret)
+	}
+}
+
+func TestFormTokenRegistry(t *testing.T) {
+	registry := &formTokenRegistry{tokens: make(map[string]*usedFormToken)}
+	if _, ok := registry.Claim("foo"); !ok {
+		t.Fatalf("Claim(\"foo\") should succeed for a new token")
+	}
+	claimed := make(chan string)
+	go func() {
+		target, _ := registry.Claim("foo")
+		claimed <- target
+	}()
+	select {
+	case <-claimed:
+		t.Errorf("Claim should wait for the first submission")
+	case <-time.After(50 * time.Millisecond):
+	}
+	registry.Finish("foo", "/foo/@@edit")
+	if target := <-claimed; target != "/foo/@@edit" {
+		t.Errorf("Claim(\"foo\") = %q, should be the first target", target)
+	}
+	if _, ok := registry.Claim("bar"); !ok {
+		t.Fatalf("Claim(\"bar\") should succeed for a new token")
+	}
+	registry.Finish("bar", "")
+	if _, ok := registry.Claim("bar"); !ok {
+		t.Errorf("Tokens of failed submissions should be claimable again")
+	}
+	for i := 0; i < maxUsedFormTokens; i++ {
+		token := randomToken()
+		registry.Claim(token)
+		registry.Finish(token, "/")
+	}
+	if target := registry.Target("foo"); len(target) > 0 ||
+		len(registry.order) != maxUsedFormTokens {
+		t.Errorf("Registry should drop the oldest tokens, got %v tokens",
+			len(registry.order))
+	}
+}
+
+// testSessionStore stores the sessions of the replay tests, which get
+// saved after successful submissions.
+var testSessionStore = sessions.NewCookieStore([]byte("secret"))
+
+// newTestSession returns a session of testSessionStore holding the values
+// of the given session, like one restored from the same cookie.
+func newTestSession(from *sessions.Session) *sessions.Session {
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	session, _ := testSessionStore.Get(r, "monsti-session")
+	if from != nil {
+		for key, value := range from.Values {
+			session.Values[key] = value
+		}
+	}
+	return session
+}
+
+func TestAddReplay(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `{"type": "Document"}`}, "TestAddReplay")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{Name: "FooSite"}
+	site_.Directories.Data = root
+	h := nodeHandler{Settings: &settings{},
+		NodeQueues: map[string]chan worker.Ticket{"Document": nil}}
+	session := newTestSession(nil)
+	token := getFormToken(session, "")
+	form := url.Values{
+		"Type":      {"Document"},
+		"Name":      {"foo"},
+		"Title":     {"Foo"},
+		"CSRFToken": {getCSRFToken(session)},
+		"FormToken": {token}}
+	cSession := &client.Session{User: &client.User{Login: "editor"}}
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("POST", "http://example.com/@@add",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		submitted := newTestSession(session)
+		h.Add(w, r, client.Node{Path: "/", Type: "Document"}, submitted,
+			cSession, site_)
+		if i == 0 && inStringSlice(token, sessionFormTokens(submitted)) {
+			t.Errorf("Token should have been revoked after the first submission")
+		}
+		if location := w.Header().Get("Location"); w.Code !=
+			http.StatusSeeOther || location != "/foo/@@edit" {
+			t.Errorf("Submission %v: Add responded with %v to %q, should"+
+				" redirect to the new node", i, w.Code, location)
+		}
+	}
+	children, err := getChildren(root, "/")
+	var nodes int
+	for _, child := range children {
+		if !strings.HasPrefix(child, ".") {
+			nodes++
+		}
+	}
+	if err != nil || nodes != 1 {
+		t.Errorf("Got %v new nodes (%v), should be 1", nodes, children)
+	}
+}
+
+func TestRemoveReplay(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":     `{"type": "Document"}`,
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRemoveReplay")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	h, stop := setupWorkerHandler(root, ioutil.Discard, func(worker.Ticket) {})
+	defer stop()
+	site_, _ := h.Sites.Get("foo")
+	session := newTestSession(nil)
+	form := url.Values{
+		"Confirm":   {"1489"},
+		"CSRFToken": {getCSRFToken(session)},
+		"FormToken": {getFormToken(session, "")}}
+	newRequest := func() *http.Request {
+		r, _ := http.NewRequest("POST", "http://example.com/foo/@@remove",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	w := httptest.NewRecorder()
+	h.Remove(w, newRequest(), client.Node{Path: "/foo", Type: "Document"},
+		newTestSession(session), &client.Session{User: &client.User{
+			Login: "admin"}}, site_)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Remove responded with %v, should be %v", w.Code,
+			http.StatusSeeOther)
+	}
+	if _, err := os.Stat(filepath.Join(root, "foo")); !os.IsNotExist(err) {
+		t.Fatalf("Node should have been removed")
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest())
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther ||
+		location != "/" {
+		t.Errorf("Replayed removal responded with %v to %q, should redirect"+
+			" to the parent", w.Code, location)
+	}
+}
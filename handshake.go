@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout is the time after which a worker which didn't perform
+// the protocol handshake will be treated as legacy worker.
+const handshakeTimeout = 10 * time.Second
+
+// States of the protocol handshake with a worker.
+const (
+	// The worker has been started but didn't perform the handshake yet.
+	handshakePending = "pending"
+	// The worker speaks a compatible protocol version.
+	handshakeOK = "ok"
+	// The worker doesn't support the handshake.
+	handshakeLegacy = "legacy"
+	// The worker speaks an incompatible protocol version.
+	handshakeRefused = "refused"
+)
+
+// workerProtocol holds the outcome of the protocol handshake with a worker.
+type workerProtocol struct {
+	// State of the handshake.
+	State string
+	// Version announced by the worker.
+	Version string
+	// Actions implemented by the worker. Unknown if nil.
+	Actions []string
+	// generation gets incremented on each start of the worker.
+	generation int
+}
+
+// HasAction returns true if the worker might implement the given action,
+// i.e. if it announced it or if its actions are unknown.
+//
+// Only the first part of sub actions (e.g. users of users/add) is checked.
+func (p workerProtocol) HasAction(action string) bool {
+	if p.Actions == nil {
+		return true
+	}
+	return inStringSlice(strings.SplitN(action, "/", 2)[0], p.Actions)
+}
+
+// majorVersion returns the major version of the given version, e.g. 1 for
+// 1.2.
+func majorVersion(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
+
+// protocolRegistry keeps track of the protocols spoken by the workers of
+// the node types.
+//
+// A nil protocolRegistry treats all workers as legacy workers.
+type protocolRegistry struct {
+	// Log is used to report incompatible and legacy workers.
+	Log     *leveledLogger
+	mutex   sync.Mutex
+	workers map[string]*workerProtocol
+	// logged holds the messages which have already been logged.
+	logged map[string]bool
+}
+
+// newProtocolRegistry returns a new, empty protocolRegistry.
+func newProtocolRegistry(log *leveledLogger) *protocolRegistry {
+	return &protocolRegistry{
+		Log:     log,
+		workers: make(map[string]*workerProtocol),
+		logged:  make(map[string]bool)}
+}
+
+// logOnce logs the given message at the given level unless it has already
+// been logged. Must be called with the mutex held.
+func (p *protocolRegistry) logOnce(level logLevel, format string,
+	v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if p.logged[msg] {
+		return
+	}
+	p.logged[msg] = true
+	p.Log.output(level, "%s", msg)
+}
+
+// Started records a (re)start of the worker of the given node type. Its
+// handshake is pending until it performs it or until the returned
+// generation times out.
+func (p *protocolRegistry) Started(nodeType string) int {
+	if p == nil {
+		return 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	protocol, ok := p.workers[nodeType]
+	if !ok {
+		protocol = new(workerProtocol)
+		p.workers[nodeType] = protocol
+	}
+	*protocol = workerProtocol{State: handshakePending,
+		generation: protocol.generation + 1}
+	return protocol.generation
+}
+
+// Handshake records the handshake of the worker of the given node type.
+//
+// Returns an error if the worker's major version differs from the daemon's.
+func (p *protocolRegistry) Handshake(nodeType, version string,
+	actions []string) error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	protocol, ok := p.workers[nodeType]
+	if !ok {
+		protocol = new(workerProtocol)
+		p.workers[nodeType] = protocol
+	}
+	protocol.Version = version
+	if majorVersion(version) != majorVersion(worker.ProtocolVersion) {
+		protocol.State, protocol.Actions = handshakeRefused, nil
+		p.logOnce(levelError, "Refusing worker of node type %q: It speaks"+
+			" protocol version %q, but the daemon requires %q. Requests for"+
+			" this node type will fail until the worker gets updated.",
+			nodeType, version, worker.ProtocolVersion)
+		return fmt.Errorf("Incompatible protocol version %q, daemon speaks %q",
+			version, worker.ProtocolVersion)
+	}
+	protocol.State, protocol.Actions = handshakeOK, actions
+	if protocol.Actions == nil {
+		protocol.Actions = []string{}
+	}
+	return nil
+}
+
+// Legacy treats the worker of the given node type as a legacy worker not
+// supporting the handshake if its handshake is still pending.
+//
+// If generation is positive, only the worker of this generation will be
+// affected.
+func (p *protocolRegistry) Legacy(nodeType string, generation int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	protocol, ok := p.workers[nodeType]
+	if !ok || protocol.State != handshakePending ||
+		generation > 0 && generation != protocol.generation {
+		return
+	}
+	protocol.State = handshakeLegacy
+	p.logOnce(levelWarn, "Worker of node type %q does not perform the"+
+		" protocol handshake. Support for such workers is deprecated and will"+
+		" be removed.", nodeType)
+}
+
+// Get returns the protocol of the worker of the given node type.
+func (p *protocolRegistry) Get(nodeType string) workerProtocol {
+	if p == nil {
+		return workerProtocol{State: handshakeLegacy}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	protocol, ok := p.workers[nodeType]
+	if !ok {
+		return workerProtocol{State: handshakePending}
+	}
+	ret := *protocol
+	if protocol.Actions != nil {
+		ret.Actions = append([]string{}, protocol.Actions...)
+	}
+	return ret
+}
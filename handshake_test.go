@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWorkerProtocolHasAction(t *testing.T) {
+	tests := []struct {
+		Actions []string
+		Action  string
+		Has     bool
+	}{
+		{nil, "edit", true},
+		{[]string{}, "edit", false},
+		{[]string{"edit"}, "edit", true},
+		{[]string{"edit"}, "add", false},
+		{[]string{"comments"}, "comments/approve", true}}
+	for i, v := range tests {
+		protocol := workerProtocol{Actions: v.Actions}
+		if ret := protocol.HasAction(v.Action); ret != v.Has {
+			t.Errorf("Test %v: HasAction(%q) = %v, should be %v", i, v.Action,
+				ret, v.Has)
+		}
+	}
+}
+
+func TestProtocolRegistry(t *testing.T) {
+	var logBuf bytes.Buffer
+	p := newProtocolRegistry(newLeveledLogger(log.New(&logBuf, "", 0),
+		levelInfo))
+	if state := p.Get("Foo").State; state != handshakePending {
+		t.Errorf("Unknown workers should be pending, got %q", state)
+	}
+	first := p.Started("Foo")
+	second := p.Started("Foo")
+	p.Legacy("Foo", first)
+	if state := p.Get("Foo").State; state != handshakePending {
+		t.Errorf("Timeout of old worker should be ignored, got %q", state)
+	}
+	if err := p.Handshake("Foo", "1.3", []string{"edit"}); err != nil {
+		t.Errorf("Handshake with compatible version failed: %v", err)
+	}
+	p.Legacy("Foo", second)
+	if ret := p.Get("Foo"); ret.State != handshakeOK || ret.Version != "1.3" ||
+		!ret.HasAction("edit") || ret.HasAction("add") {
+		t.Errorf("Wrong protocol after handshake: %v", ret)
+	}
+	for i := 0; i < 2; i++ {
+		p.Started("Bar")
+		if err := p.Handshake("Bar", "2.0", nil); err == nil {
+			t.Errorf("Handshake with incompatible version should fail")
+		}
+	}
+	if state := p.Get("Bar").State; state != handshakeRefused {
+		t.Errorf("Incompatible worker should be refused, got %q", state)
+	}
+	if n := strings.Count(logBuf.String(), "Refusing worker"); n != 1 {
+		t.Errorf("Refusal should be logged once, got %q", logBuf.String())
+	}
+	p.Started("Baz")
+	p.Legacy("Baz", 0)
+	if state := p.Get("Baz").State; state != handshakeLegacy {
+		t.Errorf("Worker without handshake should be legacy, got %q", state)
+	}
+	if !strings.Contains(logBuf.String(), "deprecated") {
+		t.Errorf("Legacy workers should be logged, got %q", logBuf.String())
+	}
+	var nilRegistry *protocolRegistry
+	nilRegistry.Started("Foo")
+	if state := nilRegistry.Get("Foo").State; state != handshakeLegacy {
+		t.Errorf("nil registry should treat workers as legacy, got %q", state)
+	}
+}
+
+func TestRequestNodeProtocol(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRequestNodeProtocol")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Version, Path string
+		Status        int
+	}{
+		{worker.ProtocolVersion, "/foo/", http.StatusOK},
+		{worker.ProtocolVersion, "/foo/@@comments", http.StatusOK},
+		{worker.ProtocolVersion, "/foo/@@unknown", http.StatusNotImplemented},
+		{"2.0", "/foo/", http.StatusBadGateway}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+			ticket.ResponseChan <- client.Response{Body: []byte("ok"), Raw: true}
+		})
+		siteFoo, _ := h.Sites.Get("foo")
+		siteFoo.Permissions = map[string]string{
+			"comments": roleAnonymous, "unknown": roleAnonymous}
+		h.Sites.Set(map[string]site{"foo": siteFoo}, "")
+		h.Protocols = newProtocolRegistry(h.Log)
+		h.Protocols.Handshake("Document", v.Version, []string{"comments"})
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+)
+
+// defaultHeaders are the security headers of all responses.
+var defaultHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "SAMEORIGIN",
+	"Referrer-Policy":        "strict-origin-when-cross-origin"}
+
+// defaultActionHeaders are the security headers of action views like @@edit
+// which override defaultHeaders.
+var defaultActionHeaders = map[string]string{
+	"X-Frame-Options": "DENY"}
+
+// securityHeaders returns the security headers for the given action of the
+// given site.
+//
+// The site's Headers and ActionHeaders override the defaults. Headers with
+// empty values are left out.
+func securityHeaders(site site, action string) http.Header {
+	headers := make(http.Header)
+	layers := []map[string]string{defaultHeaders, site.Headers}
+	if len(action) > 0 {
+		layers = []map[string]string{defaultHeaders, defaultActionHeaders,
+			site.Headers, site.ActionHeaders}
+	}
+	for _, layer := range layers {
+		for key, value := range layer {
+			headers.Set(key, value)
+		}
+	}
+	for key, values := range headers {
+		if len(values[0]) == 0 {
+			delete(headers, key)
+		}
+	}
+	return headers
+}
+
+// setSecurityHeaders adds the security headers for the given action of the
+// given site to the given response headers.
+func setSecurityHeaders(header http.Header, site site, action string) {
+	for key, values := range securityHeaders(site, action) {
+		header[key] = values
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	custom := site{
+		Headers: map[string]string{
+			"content-security-policy": "default-src 'self'",
+			"Referrer-Policy":         ""},
+		ActionHeaders: map[string]string{
+			"X-Frame-Options": "SAMEORIGIN"}}
+	tests := []struct {
+		Site    site
+		Action  string
+		Headers http.Header
+	}{
+		{site{}, "", http.Header{
+			"X-Content-Type-Options": {"nosniff"},
+			"X-Frame-Options":        {"SAMEORIGIN"},
+			"Referrer-Policy":        {"strict-origin-when-cross-origin"}}},
+		{site{}, "edit", http.Header{
+			"X-Content-Type-Options": {"nosniff"},
+			"X-Frame-Options":        {"DENY"},
+			"Referrer-Policy":        {"strict-origin-when-cross-origin"}}},
+		{custom, "", http.Header{
+			"X-Content-Type-Options":  {"nosniff"},
+			"X-Frame-Options":         {"SAMEORIGIN"},
+			"Content-Security-Policy": {"default-src 'self'"}}},
+		{custom, "edit", http.Header{
+			"X-Content-Type-Options":  {"nosniff"},
+			"X-Frame-Options":         {"SAMEORIGIN"},
+			"Content-Security-Policy": {"default-src 'self'"}}}}
+	for i, v := range tests {
+		headers := securityHeaders(v.Site, v.Action)
+		if !reflect.DeepEqual(headers, v.Headers) {
+			t.Errorf("Test %v: securityHeaders(_, %q) = %v, should be %v", i,
+				v.Action, headers, v.Headers)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// defaultHealthCheckPath is the path of the health check if the settings
+// don't specify otherwise.
+const defaultHealthCheckPath = "/healthz"
+
+// healthCheckPath returns the path of the health check endpoint.
+func (h *nodeHandler) healthCheckPath() string {
+	if len(h.currentSettings().HealthCheckPath) > 0 {
+		return h.currentSettings().HealthCheckPath
+	}
+	return defaultHealthCheckPath
+}
+
+// checkHealth returns a list of problems which prevent the daemon from
+// serving requests.
+func (h *nodeHandler) checkHealth() []string {
+	var failures []string
+	for name, site := range h.Sites.All() {
+		if _, err := os.Stat(site.Directories.Data); err != nil {
+			failures = append(failures, fmt.Sprintf(
+				"data directory of site %q not accessible", name))
+		}
+	}
+	for _, nodeType := range h.currentSettings().NodeTypes {
+		if _, ok := h.nodeQueue(nodeType); !ok {
+			failures = append(failures, fmt.Sprintf(
+				"missing queue for node type %q", nodeType))
+		}
+	}
+	for _, status := range h.Stats.Get() {
+		if status.State == workerDead {
+			failures = append(failures, fmt.Sprintf(
+				"worker for node type %q is dead", status.NodeType))
+		}
+	}
+	return failures
+}
+
+// ServeHealth responds to health check requests, e.g. of load balancers.
+//
+// Responds with 200 and {"status": "ok"} if the daemon is healthy, or 503
+// and a list of failures otherwise.
+func (h *nodeHandler) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	failures := h.checkHealth()
+	body := struct {
+		Status   string   `json:"status"`
+		Failures []string `json:"failures,omitempty"`
+	}{"ok", failures}
+	status := http.StatusOK
+	if len(failures) > 0 {
+		body.Status = "fail"
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
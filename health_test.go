@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestServeHealth(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/__empty__": ""}, "TestServeHealth")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	okSite := site{}
+	okSite.Directories.Data = root + "/data"
+	brokenSite := site{}
+	brokenSite.Directories.Data = root + "/missing"
+	tests := []struct {
+		Sites    map[string]site
+		Dead     bool
+		Status   int
+		Failures []string
+	}{
+		{map[string]site{"ok": okSite}, false, http.StatusOK, nil},
+		{map[string]site{"broken": brokenSite}, false,
+			http.StatusServiceUnavailable,
+			[]string{`data directory of site "broken" not accessible`}},
+		{map[string]site{"ok": okSite}, true, http.StatusServiceUnavailable,
+			[]string{`worker for node type "Document" is dead`}}}
+	for i, v := range tests {
+		h := nodeHandler{
+			Settings: &settings{NodeTypes: []string{"Document"}},
+			Sites:    newSiteRegistry(v.Sites, ""),
+			NodeQueues: map[string]chan worker.Ticket{
+				"Document": make(chan worker.Ticket)},
+			Stats: newWorkerStats()}
+		h.Stats.Started("Document")
+		if v.Dead {
+			h.Stats.SetState("Document", workerDead)
+		}
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://unknown.example.com/healthz", nil)
+		h.ServeHTTP(w, r)
+		var body struct {
+			Status   string
+			Failures []string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("Test %v: Could not decode body %q: %v", i, w.Body, err)
+		}
+		if w.Code != v.Status || !reflect.DeepEqual(body.Failures, v.Failures) {
+			t.Errorf("Test %v: Got status %v, failures %v; should be %v, %v", i,
+				w.Code, body.Failures, v.Status, v.Failures)
+		}
+		if len(w.HeaderMap.Get("Set-Cookie")) > 0 {
+			t.Errorf("Test %v: Health check should not set cookies", i)
+		}
+	}
+}
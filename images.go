@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageCachePath is the path of the cache of resized images relative to the
+// data directory.
+const imageCachePath = ".monsti/imgcache"
+
+// imageCacheGCInterval is the interval between removals of stale entries of
+// the image caches.
+const imageCacheGCInterval = time.Hour
+
+// maxImageDimension is the maximum width and height of resized images.
+const maxImageDimension = 8000
+
+// maxImageVariants is the maximum number of resized versions of an image
+// kept in the image cache. The oldest ones get removed first.
+const maxImageVariants = 8
+
+// maxImagePixels is the maximum number of pixels of images to be resized
+// and of the resized images. Resizing needs four bytes per pixel. Larger
+// images will be served at their original size.
+const maxImagePixels = 50000000
+
+// resizedImageMaxAge is the Cache-Control max-age of resized images in
+// seconds. Cache entries are keyed by the source's modification time, so
+// they never change.
+const resizedImageMaxAge = 365 * 24 * 60 * 60
+
+// Fit modes of resized images.
+const (
+	// fitContain scales the image to fit into the requested size.
+	fitContain = "contain"
+	// fitCover scales the image to cover the requested size and crops the
+	// overflowing parts.
+	fitCover = "cover"
+)
+
+// resizableTypes maps the extensions of images which might be resized to
+// their format as reported by image.Decode.
+var resizableTypes = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif"}
+
+// imageParams holds the requested size of an image.
+type imageParams struct {
+	// Width and Height of the resized image. One of them may be zero to keep
+	// the aspect ratio.
+	Width, Height int
+	// Fit is either fitContain or fitCover.
+	Fit string
+}
+
+// parseImageParams parses the w, h and fit parameters of the given query.
+//
+// Returns false if no size has been requested and an error if the
+// parameters are invalid.
+func parseImageParams(query url.Values) (imageParams, bool, error) {
+	var params imageParams
+	if len(query.Get("w")) == 0 && len(query.Get("h")) == 0 {
+		return params, false, nil
+	}
+	for _, v := range []struct {
+		Key   string
+		Value *int
+	}{{"w", &params.Width}, {"h", &params.Height}} {
+		if len(query.Get(v.Key)) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(v.Key))
+		if err != nil || n <= 0 || n > maxImageDimension {
+			return params, true, fmt.Errorf("Invalid image size %v=%q", v.Key,
+				query.Get(v.Key))
+		}
+		*v.Value = n
+	}
+	params.Fit = query.Get("fit")
+	switch params.Fit {
+	case "":
+		params.Fit = fitContain
+	case fitContain, fitCover:
+	default:
+		return params, true, fmt.Errorf("Unknown fit %q", params.Fit)
+	}
+	return params, true, nil
+}
+
+// imageCacheFile returns the path of the cache entry for the given source
+// file (e.g. /foo/photo.jpg) of the data directory located at root.
+func imageCacheFile(root, filePath string, modTime time.Time,
+	params imageParams, ext string) string {
+	return filepath.Join(root, imageCachePath, filepath.FromSlash(filePath),
+		fmt.Sprintf("%d-%dx%d-%v%v", modTime.UnixNano(), params.Width,
+			params.Height, params.Fit, ext))
+}
+
+// targetSize returns the size the source image of the given size should be
+// scaled to and the part of the source image to be used.
+func targetSize(width, height int, params imageParams) (int, int,
+	image.Rectangle) {
+	src := image.Rect(0, 0, width, height)
+	w, h := params.Width, params.Height
+	switch {
+	case w == 0:
+		w = int(math.Max(1, math.Floor(float64(width*h)/float64(height)+0.5)))
+		return w, h, src
+	case h == 0:
+		h = int(math.Max(1, math.Floor(float64(height*w)/float64(width)+0.5)))
+		return w, h, src
+	}
+	scaleX := float64(w) / float64(width)
+	scaleY := float64(h) / float64(height)
+	if params.Fit == fitCover {
+		// Crop the source to the target's aspect ratio, keeping at least one
+		// pixel.
+		if scaleX > scaleY {
+			cropped := int(math.Max(1, float64(h)/scaleX))
+			src.Min.Y = (height - cropped) / 2
+			src.Max.Y = src.Min.Y + cropped
+		} else {
+			cropped := int(math.Max(1, float64(w)/scaleY))
+			src.Min.X = (width - cropped) / 2
+			src.Max.X = src.Min.X + cropped
+		}
+		return w, h, src
+	}
+	scale := math.Min(scaleX, scaleY)
+	w = int(math.Max(1, math.Floor(float64(width)*scale+0.5)))
+	h = int(math.Max(1, math.Floor(float64(height)*scale+0.5)))
+	return w, h, src
+}
+
+// resampleWeights holds the contributions of source pixels to a destination
+// pixel.
+type resampleWeights struct {
+	// First is the index of the first contributing source pixel.
+	First int
+	// Weights of the contributing source pixels, summing up to 1.
+	Weights []float64
+}
+
+// computeWeights returns the weights of a triangle filter to scale from
+// srcSize to dstSize pixels. The filter gets widened when downscaling to
+// take all source pixels into account.
+func computeWeights(srcSize, dstSize int) []resampleWeights {
+	scale := float64(srcSize) / float64(dstSize)
+	support := math.Max(scale, 1)
+	ret := make([]resampleWeights, dstSize)
+	for i := range ret {
+		center := (float64(i)+0.5)*scale - 0.5
+		first := int(math.Ceil(center - support))
+		last := int(math.Floor(center + support))
+		var sum float64
+		weights := make([]float64, 0, last-first+1)
+		for j := first; j <= last; j++ {
+			weight := 1 - math.Abs(float64(j)-center)/support
+			if weight < 0 {
+				weight = 0
+			}
+			weights = append(weights, weight)
+			sum += weight
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		ret[i] = resampleWeights{First: first, Weights: weights}
+	}
+	return ret
+}
+
+// resample scales the given part of the source image to the given size.
+func resample(src image.Image, part image.Rectangle, w, h int) *image.RGBA {
+	rgba := image.NewRGBA(image.Rect(0, 0, part.Dx(), part.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min.Add(part.Min),
+		draw.Src)
+	srcW, srcH := part.Dx(), part.Dy()
+	clamp := func(i, max int) int {
+		if i < 0 {
+			return 0
+		}
+		if i >= max {
+			return max - 1
+		}
+		return i
+	}
+	// Scale horizontally into tmp, then vertically into dst.
+	tmp := make([]float64, w*srcH*4)
+	for x, cw := range computeWeights(srcW, w) {
+		for y := 0; y < srcH; y++ {
+			var c [4]float64
+			for k, weight := range cw.Weights {
+				off := rgba.PixOffset(clamp(cw.First+k, srcW), y)
+				for i := range c {
+					c[i] += weight * float64(rgba.Pix[off+i])
+				}
+			}
+			copy(tmp[(y*w+x)*4:], c[:])
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y, cw := range computeWeights(srcH, h) {
+		for x := 0; x < w; x++ {
+			var c [4]float64
+			for k, weight := range cw.Weights {
+				off := (clamp(cw.First+k, srcH)*w + x) * 4
+				for i := range c {
+					c[i] += weight * tmp[off+i]
+				}
+			}
+			off := dst.PixOffset(x, y)
+			for i := range c {
+				dst.Pix[off+i] = uint8(math.Max(0, math.Min(255, c[i]+0.5)))
+			}
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation (1 to 8) of the JPEG image
+// read from the given reader. Returns 1 if the image has no orientation.
+func jpegOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	var marker [2]byte
+	if _, err := io.ReadFull(br, marker[:]); err != nil ||
+		marker != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(br, marker[:]); err != nil ||
+			marker[0] != 0xFF || marker[1] == 0xDA {
+			return 1
+		}
+		var size uint16
+		if err := binary.Read(br, binary.BigEndian, &size); err != nil ||
+			size < 2 {
+			return 1
+		}
+		segment := make([]byte, size-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// exifOrientation returns the orientation stored in the first IFD of the
+// given TIFF structure of an EXIF segment, or 1.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+// orient transforms the given image according to the given EXIF
+// orientation so that it is displayed upright.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// resizeImage resizes the image read from the given file according to the
+// given parameters and writes the encoded result to the given writer.
+//
+// Returns false if the image can't be resized, e.g. because its format is
+// not supported.
+func resizeImage(file string, params imageParams, out io.Writer) (bool,
+	error) {
+	content, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer content.Close()
+	config, format, err := image.DecodeConfig(content)
+	if err != nil || config.Width*config.Height > maxImagePixels ||
+		config.Width == 0 || config.Height == 0 {
+		return false, nil
+	}
+	if _, err := content.Seek(0, 0); err != nil {
+		return false, err
+	}
+	img, _, err := image.Decode(content)
+	if err != nil {
+		return false, nil
+	}
+	if format == "jpeg" {
+		if _, err := content.Seek(0, 0); err != nil {
+			return false, err
+		}
+		img = orient(img, jpegOrientation(content))
+	}
+	b := img.Bounds()
+	w, h, part := targetSize(b.Dx(), b.Dy(), params)
+	if w*h > maxImagePixels {
+		return false, nil
+	}
+	resized := resample(img, part, w, h)
+	if format == "jpeg" {
+		err = jpeg.Encode(out, resized, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(out, resized)
+	}
+	if err != nil {
+		return false, fmt.Errorf("Could not encode image: %v", err)
+	}
+	return true, nil
+}
+
+// resizedImageExt returns the extension of the resized versions of images
+// with the given extension.
+func resizedImageExt(ext string) string {
+	if resizableTypes[strings.ToLower(ext)] == "jpeg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+// cachedImage returns the path of the resized version of the given image
+// file at the given path of the site's data directory, creating the cache
+// entry if necessary.
+//
+// Returns an empty path if the image can't be resized.
+func cachedImage(root, filePath, file string, info os.FileInfo,
+	params imageParams) (string, error) {
+	ext := resizedImageExt(path.Ext(filePath))
+	cached := imageCacheFile(root, filePath, info.ModTime(), params, ext)
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+	var buf bytes.Buffer
+	ok, err := resizeImage(file, params, &buf)
+	if !ok || err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0700); err != nil {
+		return "", fmt.Errorf("Could not create image cache: %v", err)
+	}
+	if err := evictImageVariants(filepath.Dir(cached),
+		maxImageVariants-1); err != nil {
+		return "", fmt.Errorf("Could not evict cached images: %v", err)
+	}
+	if err := writeFileAtomic(cached, buf.Bytes(), 0600); err != nil {
+		return "", fmt.Errorf("Could not write image cache: %v", err)
+	}
+	return cached, nil
+}
+
+// cacheEntries sorts the entries of an image cache by modification time,
+// oldest first.
+type cacheEntries []os.FileInfo
+
+func (c cacheEntries) Len() int {
+	return len(c)
+}
+
+func (c cacheEntries) Less(i, j int) bool {
+	return c[i].ModTime().Before(c[j].ModTime())
+}
+
+func (c cacheEntries) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+// evictImageVariants removes the oldest resized versions of an image from
+// the given cache directory until at most n of them are left.
+func evictImageVariants(dir string, n int) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil || len(infos) <= n {
+		return err
+	}
+	sort.Sort(cacheEntries(infos))
+	for _, info := range infos[:len(infos)-n] {
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveResizedImage serves the resized version of the given image file at
+// the given path if the image can be resized.
+//
+// Returns false if the original image should be served instead.
+func (h *nodeHandler) serveResizedImage(w http.ResponseWriter,
+	r *http.Request, filePath, file string, params imageParams,
+	site site) bool {
+	if _, ok := resizableTypes[strings.ToLower(path.Ext(filePath))]; !ok {
+		return false
+	}
+	root := site.Directories.Data
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	cached, err := cachedImage(root, filePath, file, info, params)
+	if err != nil {
+		h.requestLog(r, site.Name).Warn("Could not resize image %q: %v",
+			filePath, err)
+	}
+	if len(cached) == 0 {
+		return false
+	}
+	content, err := os.Open(cached)
+	if err != nil {
+		return false
+	}
+	defer content.Close()
+	visibility := "public"
+	if !newNodeAccess(root, nil).CanView(path.Dir(filePath)) {
+		visibility = "private"
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("%v, max-age=%d", visibility,
+		resizedImageMaxAge))
+	ext := path.Ext(cached)
+	w.Header().Set("Content-Type", "image/"+resizableTypes[ext])
+	http.ServeContent(w, r, path.Base(filePath), info.ModTime(), content)
+	return true
+}
+
+// collectImageCache removes the entries of the image cache of the data
+// directory located at root whose source images have been changed or
+// removed.
+func collectImageCache(root string) error {
+	cacheRoot := filepath.Join(root, imageCachePath)
+	var stale []string
+	err := filepath.Walk(cacheRoot, func(file string, info os.FileInfo,
+		err error) error {
+		if os.IsNotExist(err) && file == cacheRoot {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(cacheRoot, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		source, err := os.Stat(filepath.Join(root, rel))
+		modTime := strings.SplitN(info.Name(), "-", 2)[0]
+		if err != nil || !source.Mode().IsRegular() ||
+			modTime != strconv.FormatInt(source.ModTime().UnixNano(), 10) {
+			stale = append(stale, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Could not walk image cache: %v", err)
+	}
+	for _, file := range stale {
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("Could not remove cached image: %v", err)
+		}
+		// Remove directories which became empty.
+		for dir := filepath.Dir(file); dir != cacheRoot; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// collectImageCaches periodically removes stale entries of the image caches
+// of all sites.
+func (h *nodeHandler) collectImageCaches() {
+	for _ = range time.Tick(imageCacheGCInterval) {
+		for name, site := range h.Sites.All() {
+			if err := collectImageCache(site.Directories.Data); err != nil {
+				h.SiteLog(name).Error("Could not collect image cache: %v", err)
+			}
+		}
+	}
+}
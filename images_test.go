@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseImageParams(t *testing.T) {
+	tests := []struct {
+		Query  string
+		Params imageParams
+		Resize bool
+		Error  bool
+	}{
+		{"", imageParams{}, false, false},
+		{"fit=cover", imageParams{}, false, false},
+		{"w=400", imageParams{400, 0, fitContain}, true, false},
+		{"w=400&h=300&fit=cover", imageParams{400, 300, fitCover}, true, false},
+		{"h=8000", imageParams{0, 8000, fitContain}, true, false},
+		{"w=8001", imageParams{}, true, true},
+		{"w=0", imageParams{}, true, true},
+		{"w=abc", imageParams{}, true, true},
+		{"w=10&fit=stretch", imageParams{}, true, true}}
+	for _, v := range tests {
+		query, _ := url.ParseQuery(v.Query)
+		params, resize, err := parseImageParams(query)
+		if resize != v.Resize || (err != nil) != v.Error ||
+			(err == nil && params != v.Params) {
+			t.Errorf("parseImageParams(%q) = %v, %v, %v, should be %v, %v,"+
+				" error: %v", v.Query, params, resize, err, v.Params, v.Resize,
+				v.Error)
+		}
+	}
+}
+
+func TestTargetSize(t *testing.T) {
+	tests := []struct {
+		Width, Height int
+		Params        imageParams
+		W, H          int
+		Part          image.Rectangle
+	}{
+		{800, 600, imageParams{400, 0, fitContain}, 400, 300,
+			image.Rect(0, 0, 800, 600)},
+		{800, 600, imageParams{0, 300, fitContain}, 400, 300,
+			image.Rect(0, 0, 800, 600)},
+		{800, 600, imageParams{200, 200, fitContain}, 200, 150,
+			image.Rect(0, 0, 800, 600)},
+		{800, 600, imageParams{200, 200, fitCover}, 200, 200,
+			image.Rect(100, 0, 700, 600)},
+		{600, 800, imageParams{200, 100, fitCover}, 200, 100,
+			image.Rect(0, 250, 600, 550)},
+		{1000, 1, imageParams{10, 2000, fitCover}, 10, 2000,
+			image.Rect(499, 0, 500, 1)},
+		{1, 1000, imageParams{2000, 10, fitCover}, 2000, 10,
+			image.Rect(0, 499, 1, 500)}}
+	for i, v := range tests {
+		w, h, part := targetSize(v.Width, v.Height, v.Params)
+		if w != v.W || h != v.H || part != v.Part {
+			t.Errorf("Test %v: targetSize(...) = %v, %v, %v, should be %v, %v,"+
+				" %v", i, w, h, part, v.W, v.H, v.Part)
+			continue
+		}
+		src := image.NewRGBA(image.Rect(0, 0, v.Width, v.Height))
+		if dst := resample(src, part, w, h); dst.Bounds() !=
+			image.Rect(0, 0, w, h) {
+			t.Errorf("Test %v: resample(...) returned an image of size %v", i,
+				dst.Bounds())
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			c := color.RGBA{0, 0, 0, 255}
+			if x >= 20 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	dst := resample(src, src.Bounds(), 4, 2)
+	if dst.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Fatalf("Resampled image has size %v", dst.Bounds())
+	}
+	if r, _, _, _ := dst.At(0, 0).RGBA(); r != 0 {
+		t.Errorf("Left pixel should be black, got %v", dst.At(0, 0))
+	}
+	if r, _, _, _ := dst.At(3, 1).RGBA(); r != 0xffff {
+		t.Errorf("Right pixel should be white, got %v", dst.At(3, 1))
+	}
+}
+
+// exifJPEG returns the given image encoded as JPEG with an EXIF segment
+// holding the given orientation.
+func exifJPEG(t *testing.T, img image.Image, orientation uint16) []byte {
+	var segment bytes.Buffer
+	segment.WriteString("Exif\x00\x00MM")
+	for _, v := range []interface{}{uint16(42), uint32(8), uint16(1),
+		uint16(0x0112), uint16(3), uint32(1), orientation, uint16(0),
+		uint32(0)} {
+		binary.Write(&segment, binary.BigEndian, v)
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatalf("Could not encode JPEG: %v", err)
+	}
+	var ret bytes.Buffer
+	ret.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(&ret, binary.BigEndian, uint16(segment.Len()+2))
+	ret.Write(segment.Bytes())
+	ret.Write(encoded.Bytes()[2:])
+	return ret.Bytes()
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for _, orientation := range []uint16{1, 3, 6, 8} {
+		content := exifJPEG(t, img, orientation)
+		if ret := jpegOrientation(bytes.NewReader(content)); ret !=
+			int(orientation) {
+			t.Errorf("jpegOrientation(...) = %v, should be %v", ret, orientation)
+		}
+	}
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, img, nil)
+	if ret := jpegOrientation(&plain); ret != 1 {
+		t.Errorf("Images without EXIF should have orientation 1, got %v", ret)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red := color.RGBA{255, 0, 0, 255}
+	img.Set(0, 0, red)
+	tests := []struct {
+		Orientation int
+		Size, Red   image.Point
+	}{
+		{1, image.Pt(3, 2), image.Pt(0, 0)},
+		{2, image.Pt(3, 2), image.Pt(2, 0)},
+		{3, image.Pt(3, 2), image.Pt(2, 1)},
+		{4, image.Pt(3, 2), image.Pt(0, 1)},
+		{5, image.Pt(2, 3), image.Pt(0, 0)},
+		{6, image.Pt(2, 3), image.Pt(1, 0)},
+		{7, image.Pt(2, 3), image.Pt(1, 2)},
+		{8, image.Pt(2, 3), image.Pt(0, 2)}}
+	for _, v := range tests {
+		ret := orient(img, v.Orientation)
+		if ret.Bounds().Size() != v.Size {
+			t.Errorf("Orientation %v: Size is %v, should be %v", v.Orientation,
+				ret.Bounds().Size(), v.Size)
+			continue
+		}
+		if r, _, _, _ := ret.At(v.Red.X, v.Red.Y).RGBA(); r != 0xffff {
+			t.Errorf("Orientation %v: Pixel %v should be red", v.Orientation,
+				v.Red)
+		}
+	}
+}
+
+func TestServeResizedImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 80, 40))
+	var encoded bytes.Buffer
+	png.Encode(&encoded, img)
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":  `{"type": "Document", "title": "Foo"}`,
+		"/foo/photo.png":  encoded.String(),
+		"/foo/photo.jpg":  string(exifJPEG(t, img, 6)),
+		"/foo/broken.png": "not an image"}, "TestServeResizedImage")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path, ContentType string
+		Status            int
+		Size              image.Point
+	}{
+		{"/foo/photo.png?w=40", "image/png", http.StatusOK, image.Pt(40, 20)},
+		{"/foo/photo.png?w=40", "image/png", http.StatusOK, image.Pt(40, 20)},
+		{"/foo/photo.png?w=20&h=20&fit=cover", "image/png", http.StatusOK,
+			image.Pt(20, 20)},
+		{"/foo/photo.jpg?h=40", "image/jpeg", http.StatusOK, image.Pt(20, 40)},
+		{"/foo/broken.png?w=40", "image/png", http.StatusOK, image.Point{}},
+		{"/foo/photo.png?w=8000&h=8000&fit=cover", "image/png", http.StatusOK,
+			image.Pt(80, 40)},
+		{"/foo/photo.png?w=9000", "", http.StatusBadRequest, image.Point{}}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		h, stop := setupWorkerHandler(root, &logBuf, func(worker.Ticket) {})
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+			continue
+		}
+		if v.Status != http.StatusOK {
+			continue
+		}
+		if ret := w.Header().Get("Content-Type"); ret != v.ContentType {
+			t.Errorf("Test %v: Content-Type is %q, should be %q", i, ret,
+				v.ContentType)
+		}
+		if v.Size == (image.Point{}) {
+			if w.Body.String() != "not an image" {
+				t.Errorf("Test %v: Original should be served, got %q", i,
+					w.Body.String())
+			}
+			continue
+		}
+		config, _, err := image.DecodeConfig(w.Body)
+		if err != nil || config.Width != v.Size.X || config.Height != v.Size.Y {
+			t.Errorf("Test %v: Got image of %vx%v (%v), should be %v", i,
+				config.Width, config.Height, err, v.Size)
+		}
+		if v.Size == img.Bounds().Size() {
+			// Originals are served with the usual caching headers.
+			continue
+		}
+		if ret := w.Header().Get("Cache-Control"); ret !=
+			"public, max-age=31536000" {
+			t.Errorf("Test %v: Wrong Cache-Control: %q", i, ret)
+		}
+	}
+}
+
+func TestResizedImageRateLimit(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 80, 40))
+	var encoded bytes.Buffer
+	png.Encode(&encoded, img)
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`,
+		"/foo/photo.png": encoded.String()}, "TestResizedImageRateLimit")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	h, stop := setupWorkerHandler(root, &logBuf, func(worker.Ticket) {})
+	defer stop()
+	h.RateLimiter = newRateLimiter([numBudgets]rateBudget{
+		budgetPages: {Rate: 1}}, nil, 0)
+	tests := []struct {
+		Path   string
+		Status int
+	}{
+		{"/foo/photo.png?w=40", http.StatusOK},
+		{"/foo/photo.png?w=20", statusTooManyRequests},
+		{"/foo/photo.png", http.StatusOK}}
+	for i, v := range tests {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com"+v.Path, nil)
+		r.RemoteAddr = "1.2.3.4:1234"
+		h.ServeHTTP(w, r)
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+		}
+	}
+}
+
+func TestEvictImageVariants(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/a.png": "a", "/b.png": "b", "/c.png": "c"},
+		"TestEvictImageVariants")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	now := time.Now()
+	for i, name := range []string{"b.png", "a.png", "c.png"} {
+		modTime := now.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(filepath.Join(root, name), modTime, modTime)
+	}
+	if err := evictImageVariants(root, 2); err != nil {
+		t.Fatalf("evictImageVariants(...) returned error: %v", err)
+	}
+	infos, _ := ioutil.ReadDir(root)
+	if len(infos) != 2 || infos[0].Name() != "a.png" ||
+		infos[1].Name() != "c.png" {
+		t.Errorf("The oldest entry should have been removed, got %v", infos)
+	}
+}
+
+func TestCollectImageCache(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document"}`,
+		"/foo/a.png":     "a",
+		"/foo/b.png":     "b"}, "TestCollectImageCache")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := collectImageCache(root); err != nil {
+		t.Errorf("Collecting a missing cache should succeed, got %v", err)
+	}
+	info, _ := os.Stat(filepath.Join(root, "foo", "a.png"))
+	params := imageParams{Width: 10, Fit: fitContain}
+	current := imageCacheFile(root, "/foo/a.png", info.ModTime(), params,
+		".png")
+	outdated := imageCacheFile(root, "/foo/a.png",
+		info.ModTime().Add(-time.Hour), params, ".png")
+	removed := imageCacheFile(root, "/foo/c.png", info.ModTime(), params,
+		".png")
+	for _, file := range []string{current, outdated, removed} {
+		os.MkdirAll(filepath.Dir(file), 0700)
+		ioutil.WriteFile(file, []byte("cached"), 0600)
+	}
+	if err := collectImageCache(root); err != nil {
+		t.Fatalf("Could not collect image cache: %v", err)
+	}
+	if _, err := os.Stat(current); err != nil {
+		t.Errorf("Current entry should be kept: %v", err)
+	}
+	if _, err := os.Stat(outdated); !os.IsNotExist(err) {
+		t.Errorf("Outdated entry should be removed")
+	}
+	if _, err := os.Stat(filepath.Dir(removed)); !os.IsNotExist(err) {
+		t.Errorf("Entries of removed images should be removed")
+	}
+}
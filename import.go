@@ -0,0 +1,464 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxImportSize is the maximum size in bytes of uploaded import archives.
+const maxImportSize = 64 << 20
+
+// maxImportExtracted is the maximum total size in bytes of the files of an
+// import archive.
+const maxImportExtracted = 512 << 20
+
+// importSessionKey is the session value key of the name of the temporary
+// directory holding the uploaded import.
+const importSessionKey = "import_dir"
+
+// importDirPrefix is the prefix of the temporary import directories.
+const importDirPrefix = "monsti-import-"
+
+// maxImportAge is the time after which uploaded imports which haven't been
+// applied get removed.
+const maxImportAge = 24 * time.Hour
+
+// extractImport extracts the given gzipped tar archive as written by
+// writeExport to the given directory, dropping the archive's top level
+// directory.
+//
+// Only regular files and directories are allowed. Paths must not leave the
+// archive's top level directory and must not contain hidden files.
+func extractImport(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Archive is not gzipped: %v", err)
+	}
+	archive := tar.NewReader(gz)
+	var top string
+	var extracted int64
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read archive: %v", err)
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if strings.HasPrefix(name, "/") || checkPathSegments(name) != nil ||
+			len(name) == 0 {
+			return fmt.Errorf("Invalid path %q", header.Name)
+		}
+		parts := strings.SplitN(name, "/", 2)
+		if len(top) == 0 {
+			top = parts[0]
+		}
+		if parts[0] != top {
+			return fmt.Errorf("Path %q outside of top level directory %q",
+				header.Name, top)
+		}
+		if len(parts) == 1 {
+			continue
+		}
+		for _, segment := range strings.Split(parts[1], "/") {
+			if strings.HasPrefix(segment, ".") {
+				return fmt.Errorf("Invalid path %q", header.Name)
+			}
+		}
+		target := filepath.Join(dir, filepath.FromSlash(parts[1]))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			extracted += header.Size
+			if extracted > maxImportExtracted {
+				return errors.New("Archive too big")
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, archive)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("Could not extract %q: %v", header.Name, err)
+			}
+		default:
+			return fmt.Errorf("Unsupported entry %q", header.Name)
+		}
+	}
+	if len(top) == 0 {
+		return errors.New("Archive is empty")
+	}
+	return nil
+}
+
+// importItem is a node of an import.
+type importItem struct {
+	// Path of the node relative to the import's root.
+	Path string
+	// Target is the path of the node in the data directory.
+	Target string
+	// Exists is true if there is already a node at the target path.
+	Exists bool
+	// Overwrite is true if an existing node will be overwritten.
+	Overwrite bool
+}
+
+// checkImport validates the nodes of the import extracted to the given
+// directory and returns them, parents first.
+//
+// target is the path of the node below which the import will be placed,
+// root the data directory and policy the site's node naming policy.
+func checkImport(dir, target, root, policy string) ([]importItem, error) {
+	var items []importItem
+	err := filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		nodePath := path.Clean("/" + filepath.ToSlash(rel))
+		if nodePath != "/" && !validNodeName(path.Base(nodePath), policy) {
+			return fmt.Errorf("Invalid node name %q", nodePath)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(file, "node.yaml"))
+		if err != nil {
+			return fmt.Errorf("Missing node.yaml of node %q", nodePath)
+		}
+		var node storedNode
+		if err := goyaml.Unmarshal(content, &node); err != nil {
+			return fmt.Errorf("Invalid node.yaml of node %q: %v", nodePath, err)
+		}
+		if len(node.Type) == 0 {
+			return fmt.Errorf("Missing type of node %q", nodePath)
+		}
+		item := importItem{Path: nodePath, Target: path.Join(target, nodePath)}
+		existing, err := nodeFile(root, item.Target, "node.yaml")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(existing); err == nil {
+			item.Exists = true
+		}
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(importItemList(items))
+	return items, nil
+}
+
+// importItemList sorts import items by path.
+type importItemList []importItem
+
+// Len is the number of elements in the list.
+func (l importItemList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l importItemList) Less(i, j int) bool {
+	return l[i].Path < l[j].Path
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l importItemList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// applyImport copies the files of the given items from the import extracted
+// to the given directory to the data directory located at the given root.
+//
+// Existing nodes will only be written if marked to be overwritten. Missing
+// parents of the written nodes are created as placeholders of the given
+// type for the given user. Returns the paths of the written nodes.
+func applyImport(dir, root string, items []importItem, parentType,
+	login string) ([]string, error) {
+	var written []string
+	for _, item := range items {
+		if item.Exists && !item.Overwrite {
+			continue
+		}
+		created, err := createParentNodes(root, item.Target, parentType, login)
+		written = append(written, created...)
+		if err != nil {
+			return written, err
+		}
+		targetDir, err := nodeFile(root, item.Target, "")
+		if err != nil {
+			return written, err
+		}
+		if err := mkdirContent(targetDir); err != nil {
+			return written, err
+		}
+		sourceDir := filepath.Join(dir, filepath.FromSlash(item.Path))
+		files, err := ioutil.ReadDir(sourceDir)
+		if err != nil {
+			return written, err
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(sourceDir, file.Name()))
+			if err != nil {
+				return written, err
+			}
+			if err := writeContentFile(filepath.Join(targetDir, file.Name()),
+				content); err != nil {
+				return written, err
+			}
+		}
+		written = append(written, item.Target)
+	}
+	return written, nil
+}
+
+// importDir returns the temporary directory of the import stored in the
+// given session.
+//
+// Returns false if the session holds no import or if its directory is gone,
+// e.g. because the import has been applied or removed by
+// removeStaleImports.
+func importDir(session *sessions.Session) (string, bool) {
+	name, ok := session.Values[importSessionKey].(string)
+	if !ok || !strings.HasPrefix(name, importDirPrefix) ||
+		strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	dir := filepath.Join(os.TempDir(), name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return dir, true
+}
+
+// clearImport removes the import stored in the given session.
+func clearImport(session *sessions.Session) {
+	if dir, ok := importDir(session); ok {
+		os.RemoveAll(dir)
+	}
+	delete(session.Values, importSessionKey)
+}
+
+// removeStaleImports removes the import directories in the given temporary
+// directory which have been uploaded before the given time.
+func removeStaleImports(tempDir string, before time.Time) {
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), importDirPrefix) &&
+			entry.ModTime().Before(before) {
+			os.RemoveAll(filepath.Join(tempDir, entry.Name()))
+		}
+	}
+}
+
+// receiveImport reads the multipart form of the given upload request and
+// extracts the uploaded archive to a new temporary directory.
+//
+// The CSRF token has to be sent before the archive.
+func receiveImport(w http.ResponseWriter, r *http.Request,
+	session *sessions.Session) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", err
+	}
+	validToken := csrfExempt(r)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", errors.New("Missing archive")
+		}
+		if err != nil {
+			return "", err
+		}
+		switch part.FormName() {
+		case "CSRFToken":
+			token, err := ioutil.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				return "", err
+			}
+			validToken = validToken || checkCSRFToken(session, string(token))
+		case "Archive":
+			if !validToken {
+				return "", errCSRF
+			}
+			dir, err := ioutil.TempDir("", importDirPrefix)
+			if err != nil {
+				return "", err
+			}
+			if err := extractImport(part, dir); err != nil {
+				os.RemoveAll(dir)
+				return "", err
+			}
+			return dir, nil
+		}
+	}
+}
+
+// errCSRF is returned for forms with missing or invalid CSRF tokens.
+var errCSRF = errors.New("The form has expired. Please try again.")
+
+// Import handles requests to import an archive written by @@export below a
+// node.
+//
+// Imports are done in three steps: The archive gets uploaded and validated,
+// then the user chooses which existing nodes to overwrite, optionally doing
+// a dry run, and finally the nodes get written.
+func (h *nodeHandler) Import(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	context := template.Context{}
+	var items []importItem
+	switch {
+	case r.Method == "GET":
+	case r.Method == "POST" && site.ReadOnly:
+		context["Error"] = G("The site is read-only.")
+	case r.Method == "POST" && r.URL.Query().Get("step") == "upload":
+		clearImport(session)
+		// Imports which have been abandoned by their users.
+		removeStaleImports(os.TempDir(), time.Now().Add(-maxImportAge))
+		dir, err := receiveImport(w, r, session)
+		if err == nil {
+			items, err = checkImport(dir, node.Path, site.Directories.Data,
+				site.NodeNames)
+			if err != nil {
+				os.RemoveAll(dir)
+			}
+		}
+		if err != nil {
+			h.requestLog(r, site.Name).Info("Rejected import below %q: %v",
+				node.Path, err)
+			context["Error"] = G("The archive could not be imported: ") +
+				err.Error()
+			break
+		}
+		session.Values[importSessionKey] = filepath.Base(dir)
+	case r.Method == "POST":
+		r.ParseForm()
+		if !validCSRFRequest(r, session, r.Form.Get("CSRFToken")) {
+			context["Error"] = G("The form has expired. Please try again.")
+			break
+		}
+		dryRun := r.Form.Get("DryRun") == "1"
+		var target string
+		if !dryRun {
+			// Replayed submissions, e.g. after clicking twice, get redirected
+			// like the first one.
+			formStatus, replayTarget, finish := claimFormToken(session,
+				r.Form.Get("FormToken"))
+			if formStatus == formTokenReplayed {
+				http.Redirect(w, r, replayTarget, http.StatusSeeOther)
+				return
+			}
+			if formStatus == formTokenInvalid {
+				context["Error"] = G("The form has expired. Please try again.")
+				break
+			}
+			defer func() { finish(target) }()
+		}
+		dir, ok := importDir(session)
+		if !ok {
+			context["Error"] = G("The form has expired. Please try again.")
+			break
+		}
+		if !dryRun {
+			// The import can't be retried, even if it fails.
+			defer os.RemoveAll(dir)
+		}
+		var err error
+		items, err = checkImport(dir, node.Path, site.Directories.Data,
+			site.NodeNames)
+		if err != nil {
+			if _, ok := importDir(session); !ok {
+				// Removed meanwhile, e.g. by an upload in another tab.
+				context["Error"] = G("The form has expired. Please try again.")
+				break
+			}
+			panic("Can't check import: " + err.Error())
+		}
+		for i := range items {
+			items[i].Overwrite = r.Form.Get("Overwrite:"+items[i].Path) == "1"
+		}
+		if dryRun {
+			context["DryRun"] = true
+			break
+		}
+		login := sessionLogin(cSession)
+		written, err := applyImport(dir, site.Directories.Data, items,
+			site.placeholderType(), login)
+		for _, nodePath := range written {
+			recordChange(site.Directories.Data, nodeChange(site.Directories.Data,
+				nodePath, login))
+			indexNode(site.Directories.Data, nodePath)
+			auditChange(site, login, auditImportNode, nodePath, "",
+				h.requestLog(r, site.Name).Warn)
+			fireWebhooks(site, eventNodeWritten, nodePath, login,
+				h.requestLog(r, site.Name).Warn)
+		}
+		if err != nil {
+			panic("Can't import: " + err.Error())
+		}
+		h.requestLog(r, site.Name).Info("User %q imported %v nodes below %q",
+			login, len(written), node.Path)
+		target = site.URL(node.Path)
+		revokeFormToken(session, r.Form.Get("FormToken"))
+		clearImport(session)
+		session.Save(r, w)
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	context["Items"] = items
+	context["CSRFToken"] = getCSRFToken(session)
+	context["FormToken"] = getFormToken(session, r.Form.Get("FormToken"))
+	context["UploadURL"] = site.URL(path.Join(node.Path, "@@import")) +
+		"?step=upload"
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/import", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Import"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeArchive returns a gzipped tar archive with the given entries.
+func makeArchive(t *testing.T, entries []tar.Header) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, header := range entries {
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		header.Mode = 0600
+		content := []byte("content of " + header.Name)
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+		if err := archive.WriteHeader(&header); err != nil {
+			t.Fatalf("Could not write archive: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			archive.Write(content)
+		}
+	}
+	archive.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestExtractImport(t *testing.T) {
+	tests := []struct {
+		Entries []tar.Header
+		Files   []string
+	}{
+		{[]tar.Header{
+			{Name: "export/", Typeflag: tar.TypeDir},
+			{Name: "export/node.yaml"},
+			{Name: "export/foo/", Typeflag: tar.TypeDir},
+			{Name: "export/foo/node.yaml"},
+			{Name: "export/foo/body.html"}},
+			[]string{"foo/body.html", "foo/node.yaml", "node.yaml"}},
+		{[]tar.Header{{Name: "export/../node.yaml"}}, nil},
+		{[]tar.Header{{Name: "/etc/node.yaml"}}, nil},
+		{[]tar.Header{{Name: "export/node.yaml"}, {Name: "other/node.yaml"}},
+			nil},
+		{[]tar.Header{{Name: "export/.trash/node.yaml"}}, nil},
+		{[]tar.Header{{Name: "export/link", Typeflag: tar.TypeSymlink,
+			Linkname: "/etc/passwd"}}, nil},
+		{nil, nil}}
+	for i, v := range tests {
+		dir, err := ioutil.TempDir("", "TestExtractImport")
+		if err != nil {
+			t.Fatalf("Could not create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		err = extractImport(bytes.NewReader(makeArchive(t, v.Entries)), dir)
+		if (err == nil) != (v.Files != nil) {
+			t.Errorf("Test %v: extractImport returned error %v", i, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var files []string
+		filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if !info.IsDir() {
+				rel, _ := filepath.Rel(dir, file)
+				files = append(files, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if !reflect.DeepEqual(files, v.Files) {
+			t.Errorf("Test %v: Extracted %v, should be %v", i, files, v.Files)
+		}
+	}
+}
+
+func TestApplyImport(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/target/node.yaml":     "old",
+		"/data/target/foo/node.yaml": "old foo",
+		"/import/node.yaml":          "new",
+		"/import/foo/node.yaml":      "new foo",
+		"/import/bar/node.yaml":      "new bar",
+		"/import/bar/body.html":      "new body"}, "TestApplyImport")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	data := filepath.Join(root, "data")
+	items := []importItem{
+		{Path: "/", Target: "/target", Exists: true, Overwrite: true},
+		{Path: "/bar", Target: "/target/bar"},
+		{Path: "/foo", Target: "/target/foo", Exists: true}}
+	written, err := applyImport(filepath.Join(root, "import"), data, items,
+		"Document", "alice")
+	if err != nil {
+		t.Fatalf("applyImport failed: %v", err)
+	}
+	if expected := []string{"/target", "/target/bar"}; !reflect.DeepEqual(
+		written, expected) {
+		t.Errorf("applyImport wrote %v, should write %v", written, expected)
+	}
+	for file, expected := range map[string]string{
+		"target/node.yaml":     "new",
+		"target/foo/node.yaml": "old foo",
+		"target/bar/node.yaml": "new bar",
+		"target/bar/body.html": "new body"} {
+		content, err := ioutil.ReadFile(filepath.Join(data, file))
+		if err != nil || string(content) != expected {
+			t.Errorf("%v contains %q, should contain %q", file, content, expected)
+		}
+	}
+}
+
+func TestImportDir(t *testing.T) {
+	existing, err := ioutil.TempDir("", importDirPrefix)
+	if err != nil {
+		t.Fatalf("Could not create import directory: %v", err)
+	}
+	defer os.RemoveAll(existing)
+	tests := []struct {
+		Value interface{}
+		OK    bool
+	}{
+		{nil, false},
+		{42, false},
+		{filepath.Base(existing), true},
+		{filepath.Base(existing) + "-missing", false},
+		{"other-123", false},
+		{"monsti-import-/../etc", false}}
+	for i, v := range tests {
+		session := sessions.NewSession(nil, "monsti-session")
+		if v.Value != nil {
+			session.Values[importSessionKey] = v.Value
+		}
+		dir, ok := importDir(session)
+		if ok != v.OK || ok && dir != filepath.Join(os.TempDir(),
+			v.Value.(string)) {
+			t.Errorf("Test %v: importDir(%v) = %q, %v", i, v.Value, dir, ok)
+		}
+	}
+}
+
+func TestRemoveStaleImports(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/monsti-import-old/node.yaml": "",
+		"/monsti-import-new/node.yaml": "",
+		"/other-old/node.yaml":         ""}, "TestRemoveStaleImports")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	old := time.Now().Add(-2 * maxImportAge)
+	for _, name := range []string{"monsti-import-old", "other-old"} {
+		if err := os.Chtimes(filepath.Join(root, name), old, old); err != nil {
+			t.Fatalf("Could not change times: %v", err)
+		}
+	}
+	removeStaleImports(root, time.Now().Add(-maxImportAge))
+	for name, exists := range map[string]bool{"monsti-import-old": false,
+		"monsti-import-new": true, "other-old": true} {
+		if _, err := os.Stat(filepath.Join(root, name)); (err == nil) != exists {
+			t.Errorf("%v should exist: %v, got %v", name, exists, err)
+		}
+	}
+}
+
+func TestImportResubmit(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/target/node.yaml":                `{"type": "Document"}`,
+		"/templates/master.html":                "{{.Page.Content}}",
+		"/templates/daemon/actions/import.html": "{{.Error}}"},
+		"TestImportResubmit")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	dir, err := ioutil.TempDir("", importDirPrefix)
+	if err != nil {
+		t.Fatalf("Could not create import directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "node.yaml"),
+		[]byte(`{"type": "Document", "title": "Imported"}`), 0600); err != nil {
+		t.Fatalf("Could not write import: %v", err)
+	}
+	site_ := site{Name: "FooSite"}
+	site_.Directories.Data = filepath.Join(root, "data")
+	h := nodeHandler{
+		Renderer: &templateRenderer{Root: filepath.Join(root, "templates")},
+		Settings: new(settings)}
+	session := newTestSession(nil)
+	session.Values[importSessionKey] = filepath.Base(dir)
+	cSession := &client.Session{User: &client.User{Login: "editor"}}
+	submit := func(token string, dryRun bool) *httptest.ResponseRecorder {
+		form := url.Values{
+			"CSRFToken":   {getCSRFToken(session)},
+			"FormToken":   {token},
+			"Overwrite:/": {"1"}}
+		if dryRun {
+			form.Set("DryRun", "1")
+		}
+		r, _ := http.NewRequest("POST", "http://example.com/target/@@import",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.Import(w, r, client.Node{Path: "/target", Type: "Document"},
+			newTestSession(session), cSession, site_)
+		return w
+	}
+	token := getFormToken(session, "")
+	for i := 0; i < 2; i++ {
+		w := submit(token, false)
+		if location := w.Header().Get("Location"); w.Code !=
+			http.StatusSeeOther || location != "/target" {
+			t.Errorf("Submission %v: Import responded with %v to %q, should"+
+				" redirect to the target", i, w.Code, location)
+		}
+	}
+	node, err := readStoredNode(site_.Directories.Data, "/target")
+	if err != nil || node.Title != "Imported" {
+		t.Errorf("Import should have been applied, got %+v, %v", node, err)
+	}
+	// Forms submitted after the import has been applied or removed have
+	// expired.
+	for i, dryRun := range []bool{false, true} {
+		w := submit(getFormToken(session, ""), dryRun)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(),
+			"The form has expired.") {
+			t.Errorf("Test %v: Import responded with %v: %q, should show an"+
+				" error", i, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/monsti/rpc/client"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxJSONDepth is the maximum depth of children included by @@json.
+const maxJSONDepth = 3
+
+// jsonNode is the representation of a node returned by @@json.
+type jsonNode struct {
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	ShortTitle  string `json:"shortTitle,omitempty"`
+	Description string `json:"description,omitempty"`
+	Hide        bool   `json:"hide,omitempty"`
+	// Times are formatted according to RFC 3339.
+	Created      string `json:"created,omitempty"`
+	CreatedBy    string `json:"createdBy,omitempty"`
+	LastUpdate   string `json:"lastUpdate,omitempty"`
+	LastUpdateBy string `json:"lastUpdateBy,omitempty"`
+	// Files are the names of the node's data files.
+	Files    []string   `json:"files"`
+	Children []jsonNode `json:"children,omitempty"`
+}
+
+// jsonTime converts a time of a node.yaml file to RFC 3339. Returns an empty
+// string for invalid times.
+func jsonTime(value string) string {
+	t, err := time.Parse(nodeTimeFormat, value)
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// getJSONNode returns the JSON representation of the node at the given path
+// of the data directory located at the given root, including its viewable
+// children up to the given depth.
+//
+// The logins of the nodes' authors are only included if authors is true.
+func getJSONNode(root, nodePath string, depth int, access *nodeAccess,
+	authors bool) (*jsonNode, error) {
+	node, err := readStoredNode(root, nodePath)
+	if err != nil {
+		return nil, err
+	}
+	ret := &jsonNode{
+		Path:         node.Path,
+		Type:         node.Type,
+		Title:        node.Title,
+		ShortTitle:   node.ShortTitle,
+		Description:  node.Description,
+		Hide:         node.Hide,
+		Created:      jsonTime(node.Created),
+		CreatedBy:    node.CreatedBy,
+		LastUpdate:   jsonTime(node.LastUpdate),
+		LastUpdateBy: node.LastUpdateBy,
+		Files:        []string{}}
+	if !authors {
+		ret.CreatedBy, ret.LastUpdateBy = "", ""
+	}
+	dir, err := nodeFile(root, nodePath, "")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, "."):
+		case !entry.IsDir():
+			if name != "node.yaml" {
+				ret.Files = append(ret.Files, name)
+			}
+		case depth > 0:
+			childPath := path.Join(nodePath, name)
+			if !access.CanView(childPath) {
+				continue
+			}
+			child, err := getJSONNode(root, childPath, depth-1, access,
+				authors)
+			if err != nil {
+				continue
+			}
+			ret.Children = append(ret.Children, *child)
+		}
+	}
+	return ret, nil
+}
+
+// writeJSON writes the given value as JSON response with the given status
+// code.
+func writeJSON(w http.ResponseWriter, value interface{}, code int) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		panic("Could not marshal JSON: " + err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(content)
+}
+
+// httpError replies to the request with the given error message and HTTP
+// code. API requests get a JSON error object.
+func httpError(w http.ResponseWriter, r *http.Request, message string,
+	code int) {
+	if isAPIRequest(r) {
+		writeJSON(w, map[string]string{"error": message}, code)
+		return
+	}
+	http.Error(w, message, code)
+}
+
+// JSON handles requests for the JSON representation of a node.
+//
+// The query parameter depth selects the depth of included children and
+// defaults to 1. The logins of authors are only shown to authenticated
+// users.
+func (h *nodeHandler) JSON(w http.ResponseWriter, r *http.Request,
+	node client.Node, cSession *client.Session, site site) {
+	if r.Method != "GET" {
+		httpError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	depth := 1
+	if value := r.URL.Query().Get("depth"); len(value) > 0 {
+		var err error
+		if depth, err = strconv.Atoi(value); err != nil || depth < 0 {
+			httpError(w, r, "Invalid depth.", http.StatusBadRequest)
+			return
+		}
+	}
+	if depth > maxJSONDepth {
+		depth = maxJSONDepth
+	}
+	ret, err := getJSONNode(site.Directories.Data, node.Path, depth,
+		requestNodeAccess(r), cSession.User != nil)
+	if err != nil {
+		panic("Could not read node: " + err.Error())
+	}
+	writeJSON(w, ret, http.StatusOK)
+}
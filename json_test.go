@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestJSONTime(t *testing.T) {
+	tests := []struct {
+		Value, Expected string
+	}{
+		{"", ""},
+		{"foo", ""},
+		{"02 Jan 06 15:04 UTC", "2006-01-02T15:04:00Z"}}
+	for i, v := range tests {
+		if ret := jsonTime(v.Value); ret != v.Expected {
+			t.Errorf("Test %v: jsonTime(%q) = %q, should be %q", i, v.Value, ret,
+				v.Expected)
+		}
+	}
+}
+
+func TestGetJSONNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":               "title: Root\ntype: Document",
+		"/body.html":               "Hello",
+		"/.monsti/recent.yaml":     "",
+		"/foo/node.yaml":           "title: Foo\ntype: Document",
+		"/foo/bar/node.yaml":       "title: Bar\ntype: Document",
+		"/secret/node.yaml":        "title: Secret\ntype: Document\nrestrict: login",
+		"/foo/bar/cruz/node.yaml":  "title: Cruz\ntype: Document",
+		"/foo/bar/cruz/image.jpeg": "",
+		"/nonode/some_file.txt":    ""}, "TestGetJSONNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	ret, err := getJSONNode(root, "/", 2, newNodeAccess(root, nil), false)
+	if err != nil {
+		t.Fatalf("getJSONNode failed: %v", err)
+	}
+	expected := &jsonNode{Path: "/", Type: "Document", Title: "Root",
+		Files: []string{"body.html"},
+		Children: []jsonNode{{Path: "/foo", Type: "Document", Title: "Foo",
+			Files: []string{},
+			Children: []jsonNode{{Path: "/foo/bar", Type: "Document",
+				Title: "Bar", Files: []string{}}}}}}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("getJSONNode(...) = %v, should be %v", ret, expected)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	tests := []struct {
+		URL, Accept string
+		User        bool
+		Code        int
+		JSON        bool
+	}{
+		{"http://example.com/foo/@@json", "", false, http.StatusUnauthorized,
+			true},
+		{"http://example.com/foo/@@json", "", true, http.StatusForbidden, true},
+		{"http://example.com/foo/@@edit", "application/json", false,
+			http.StatusUnauthorized, true},
+		{"http://example.com/foo/@@edit", "", true, http.StatusForbidden,
+			false},
+		{"http://example.com/foo/@@edit", "", false, http.StatusSeeOther,
+			false}}
+	h := nodeHandler{}
+	for i, v := range tests {
+		r, _ := http.NewRequest("GET", v.URL, nil)
+		r.Header.Set("Accept", v.Accept)
+		w := httptest.NewRecorder()
+		cSession := &client.Session{}
+		if v.User {
+			cSession.User = &client.User{Login: "foo"}
+		}
+		h.Deny(w, r, client.Node{Path: "/foo"}, cSession, site{})
+		if w.Code != v.Code {
+			t.Errorf("Test %v: Deny responded with %v, should be %v", i, w.Code,
+				v.Code)
+		}
+		var body map[string]string
+		isJSON := w.Header().Get("Content-Type") ==
+			"application/json; charset=utf-8" &&
+			json.Unmarshal(w.Body.Bytes(), &body) == nil && len(body["error"]) > 0
+		if isJSON != v.JSON {
+			t.Errorf("Test %v: Deny responded with JSON: %v, should be %v", i,
+				isJSON, v.JSON)
+		}
+	}
+}
+
+func TestGetJSONNodeAuthors(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `{"type": "Document", "createdby": "alice",
+			"lastupdateby": "bob"}`,
+		"/foo/node.yaml": `{"type": "Document", "createdby": "alice"}`},
+		"TestGetJSONNodeAuthors")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	for _, authors := range []bool{false, true} {
+		ret, err := getJSONNode(root, "/", 1, newNodeAccess(root, nil), authors)
+		if err != nil || len(ret.Children) != 1 {
+			t.Fatalf("getJSONNode(...) = %v, %v", ret, err)
+		}
+		shown := ret.CreatedBy == "alice" && ret.LastUpdateBy == "bob" &&
+			ret.Children[0].CreatedBy == "alice"
+		hidden := ret.CreatedBy == "" && ret.LastUpdateBy == "" &&
+			ret.Children[0].CreatedBy == ""
+		if authors && !shown || !authors && !hidden {
+			t.Errorf("getJSONNode(..., %v) = %+v", authors, ret)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/monsti/monsti-daemon/worker"
+)
+
+// defaultInteractiveBurst is the number of interactive tickets handed out
+// in a row if a bulk ticket is waiting and the settings don't specify
+// another value.
+const defaultInteractiveBurst = 8
+
+// ticketLanes sorts tickets into two lanes in front of a node type's queue.
+//
+// Interactive tickets (actions requested by logged in users) are preferred
+// over bulk tickets (everything else), so that editors don't have to wait
+// behind anonymous page views. To not starve the bulk lane, at most Burst
+// interactive tickets will be handed out in a row while a bulk ticket is
+// waiting.
+type ticketLanes struct {
+	Interactive chan worker.Ticket
+	Bulk        chan worker.Ticket
+	// Burst is the maximum number of interactive tickets handed out in a
+	// row while bulk tickets are waiting.
+	Burst int
+	// stop gets closed to stop run.
+	stop chan struct{}
+	// stopped gets closed after run returned.
+	stopped chan struct{}
+}
+
+// newTicketLanes returns new lanes with the given burst limit.
+//
+// If burst is not positive, defaultInteractiveBurst will be used.
+func newTicketLanes(burst int) *ticketLanes {
+	if burst <= 0 {
+		burst = defaultInteractiveBurst
+	}
+	return &ticketLanes{
+		Interactive: make(chan worker.Ticket),
+		Bulk:        make(chan worker.Ticket),
+		Burst:       burst,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{})}
+}
+
+// isInteractive returns true if the ticket is an action requested by a
+// logged in user.
+func isInteractive(ticket worker.Ticket) bool {
+	return len(ticket.Action) > 0 && ticket.Session.User != nil
+}
+
+// Queue puts the ticket into its lane and blocks until run took it. The
+// ticket might still wait for a worker afterwards.
+//
+// Returns false if the ticket's Done channel got closed before.
+func (l *ticketLanes) Queue(ticket worker.Ticket) bool {
+	lane := l.Bulk
+	if isInteractive(ticket) {
+		lane = l.Interactive
+	}
+	select {
+	case lane <- ticket:
+		return true
+	case <-ticket.Done:
+		return false
+	}
+}
+
+// next waits for the next ticket to be handed out. streak is the number of
+// interactive tickets handed out in a row. Returns the ticket and the new
+// streak. Returns false if the lanes have been stopped.
+func (l *ticketLanes) next(streak int) (worker.Ticket, int, bool) {
+	first, second := l.Interactive, l.Bulk
+	if streak >= l.Burst {
+		first, second = l.Bulk, l.Interactive
+	}
+	var ticket worker.Ticket
+	select {
+	case ticket = <-first:
+	default:
+		select {
+		case ticket = <-first:
+		case ticket = <-second:
+		case <-l.stop:
+			return ticket, streak, false
+		}
+	}
+	if isInteractive(ticket) {
+		return ticket, streak + 1, true
+	}
+	return ticket, 0, true
+}
+
+// run hands out the tickets of both lanes to the given queue until the
+// lanes get stopped.
+func (l *ticketLanes) run(queue chan<- worker.Ticket) {
+	defer close(l.stopped)
+	streak := 0
+	for {
+		var ticket worker.Ticket
+		var ok bool
+		if ticket, streak, ok = l.next(streak); !ok {
+			return
+		}
+		select {
+		case queue <- ticket:
+		case <-l.stop:
+			// The ticket is dropped. Its requester stops waiting when the
+			// ticket expires.
+			return
+		}
+	}
+}
+
+// Stop stops run and waits until it returned, e.g. before the queue gets
+// closed. Tickets not handed out yet are dropped.
+func (l *ticketLanes) Stop() {
+	close(l.stop)
+	<-l.stopped
+}
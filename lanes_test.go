@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	"testing"
+)
+
+func TestIsInteractive(t *testing.T) {
+	tests := []struct {
+		Action, Login string
+		Interactive   bool
+	}{
+		{"", "", false},
+		{"", "foo", false},
+		{"edit", "", false},
+		{"edit", "foo", true}}
+	for i, v := range tests {
+		ticket := worker.Ticket{Action: v.Action}
+		if len(v.Login) > 0 {
+			ticket.Session.User = &client.User{Login: v.Login}
+		}
+		if ret := isInteractive(ticket); ret != v.Interactive {
+			t.Errorf("Test %v: isInteractive(%v, %q) = %v, should be %v", i,
+				v.Action, v.Login, ret, v.Interactive)
+		}
+	}
+}
+
+func TestTicketLanesNext(t *testing.T) {
+	lanes := ticketLanes{
+		Interactive: make(chan worker.Ticket, 10),
+		Bulk:        make(chan worker.Ticket, 10),
+		Burst:       2}
+	user := &client.User{Login: "foo"}
+	for _, path := range []string{"/i1", "/i2", "/i3", "/i4", "/i5"} {
+		ticket := worker.Ticket{Node: client.Node{Path: path}, Action: "edit"}
+		ticket.Session.User = user
+		lanes.Interactive <- ticket
+	}
+	for _, path := range []string{"/b1", "/b2"} {
+		lanes.Bulk <- worker.Ticket{Node: client.Node{Path: path}}
+	}
+	expected := []string{"/i1", "/i2", "/b1", "/i3", "/i4", "/b2", "/i5"}
+	streak := 0
+	for i, path := range expected {
+		var ticket worker.Ticket
+		ticket, streak, _ = lanes.next(streak)
+		if ticket.Node.Path != path {
+			t.Errorf("Ticket %v should be %q, got %q", i, path,
+				ticket.Node.Path)
+		}
+	}
+}
+
+func TestTicketLanesRun(t *testing.T) {
+	lanes := newTicketLanes(0)
+	if lanes.Burst != defaultInteractiveBurst {
+		t.Errorf("Burst should default to %v, got %v", defaultInteractiveBurst,
+			lanes.Burst)
+	}
+	queue := make(chan worker.Ticket)
+	go lanes.run(queue)
+	go lanes.Queue(worker.Ticket{Node: client.Node{Path: "/foo"}})
+	if ticket := <-queue; ticket.Node.Path != "/foo" {
+		t.Errorf("Got ticket for %q, should be /foo", ticket.Node.Path)
+	}
+	// Stopping must not wait for the queue to take the held ticket.
+	lanes.Queue(worker.Ticket{Node: client.Node{Path: "/bar"}})
+	lanes.Stop()
+	close(queue)
+}
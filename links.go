@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// linkPattern matches href and src attributes. The attribute's name, the
+// equal sign, the quotes and the value are captured.
+var linkPattern = regexp.MustCompile(`(?i)\b(href|src)(\s*=\s*)` +
+	`(["'])([^"']*)(["'])`)
+
+// linkRewrite describes the links of a file to be rewritten.
+type linkRewrite struct {
+	// Path of the node of the file.
+	Path string
+	// File is the name of the file.
+	File string
+	// Links is the number of rewritten links.
+	Links int
+}
+
+// movedLink returns the given link of the given site with oldPath replaced
+// by newPath.
+//
+// Handles absolute paths and paths including the site's base path. Returns
+// false if the link doesn't point to oldPath or below.
+func movedLink(site site, link, oldPath, newPath string) (string, bool) {
+	end := strings.IndexAny(link, "?#")
+	if end == -1 {
+		end = len(link)
+	}
+	linkPath, rest := link[:end], link[end:]
+	prefix := ""
+	if stripped, ok := site.stripBasePath(linkPath); ok &&
+		len(site.BasePath) > 0 {
+		prefix, linkPath = site.BasePath, stripped
+	}
+	oldPath = strings.TrimSuffix(oldPath, "/")
+	if !strings.HasPrefix(linkPath, oldPath) ||
+		(len(linkPath) > len(oldPath) && linkPath[len(oldPath)] != '/') {
+		return link, false
+	}
+	return prefix + path.Clean(newPath) + linkPath[len(oldPath):] + rest, true
+}
+
+// rewriteLinks replaces the links to oldPath or below in the given content
+// by links to newPath. Returns the new content and the number of rewritten
+// links.
+func rewriteLinks(site site, content, oldPath, newPath string) (string,
+	int) {
+	count := 0
+	ret := linkPattern.ReplaceAllStringFunc(content, func(attr string) string {
+		parts := linkPattern.FindStringSubmatch(attr)
+		link, ok := movedLink(site, parts[4], oldPath, newPath)
+		if !ok {
+			return attr
+		}
+		count++
+		return parts[1] + parts[2] + parts[3] + link + parts[5]
+	})
+	return ret, count
+}
+
+// relinkNodes rewrites the links to the node moved from oldPath to newPath
+// and its descendants in the HTML files of the site's nodes.
+//
+// If dryRun is true, the files will not be changed. Rewritten files will be
+// recorded as changes of the given user and reported to logf. As rewritten
+// links don't match anymore, an interrupted run may simply be repeated.
+// Returns the rewritten files.
+func relinkNodes(site site, oldPath, newPath, login string, dryRun bool,
+	logf func(format string, v ...interface{})) ([]linkRewrite, error) {
+	root := site.Directories.Data
+	var rewrites []linkRewrite
+	err := walkNodes(root, func(nodePath string, _ os.FileInfo) error {
+		dir, err := nodeFile(root, nodePath, "")
+		if err != nil {
+			return err
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") ||
+				filepath.Ext(info.Name()) != ".html" {
+				continue
+			}
+			// Check the file, as it might be a symlink to another directory.
+			file, err := nodeFile(root, nodePath, info.Name())
+			if err != nil {
+				continue
+			}
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			rewritten, count := rewriteLinks(site, string(content), oldPath,
+				newPath)
+			if count == 0 {
+				continue
+			}
+			rewrites = append(rewrites, linkRewrite{nodePath, info.Name(), count})
+			if dryRun {
+				continue
+			}
+			if err := writeContentFile(file, []byte(rewritten)); err != nil {
+				return fmt.Errorf("Could not rewrite links of %q: %v", file, err)
+			}
+			logf("Rewrote %v links to %q in %q", count, oldPath, file)
+			dataWritten(site, nodePath, info.Name(), login, auditRelink, logf)
+		}
+		return nil
+	})
+	return rewrites, err
+}
+
+// nodeMoved keeps links to the node moved from oldPath to newPath working.
+//
+// Rewrites the links of the site's nodes, see relinkNodes, or, if the site
+// keeps moved nodes' URLs, adds an alias for the old path.
+func nodeMoved(site site, oldPath, newPath, login string,
+	logf func(format string, v ...interface{})) error {
+	if !site.AliasMovedNodes {
+		_, err := relinkNodes(site, oldPath, newPath, login, false, logf)
+		return err
+	}
+	aliases, err := loadAliases(site.Directories.Config)
+	if err != nil {
+		return err
+	}
+	for from, to := range aliases {
+		if moved, ok := movedLink(site, to, oldPath, newPath); ok {
+			aliases[from] = moved
+		}
+	}
+	aliases[cleanAliasPath(oldPath)] = path.Clean(newPath)
+	return saveAliases(site.Directories.Config, aliases)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMovedLink(t *testing.T) {
+	tests := []struct {
+		BasePath, Link, Moved string
+		Ok                    bool
+	}{
+		{"", "/old", "/new/place", true},
+		{"", "/old/", "/new/place/", true},
+		{"", "/old/child/?page=2#top", "/new/place/child/?page=2#top", true},
+		{"", "/old/@@edit", "/new/place/@@edit", true},
+		{"", "/older/", "/older/", false},
+		{"", "old/", "old/", false},
+		{"", "http://example.com/old/", "http://example.com/old/", false},
+		{"/site", "/site/old/photo.jpg", "/site/new/place/photo.jpg", true},
+		{"/site", "/old/", "/new/place/", true},
+		{"/site", "/site/older", "/site/older", false}}
+	for _, v := range tests {
+		site := site{BasePath: v.BasePath}
+		moved, ok := movedLink(site, v.Link, "/old", "/new/place")
+		if moved != v.Moved || ok != v.Ok {
+			t.Errorf("movedLink(%q, %q, ...) = %q, %v, should be %q, %v",
+				v.BasePath, v.Link, moved, ok, v.Moved, v.Ok)
+		}
+	}
+}
+
+func TestRelinkNodes(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":     `{"type": "Document"}`,
+		"/data/body.html":     `<a href="/old/">Old</a> <img SRC='/old/a.png'>`,
+		"/data/sidebar.html":  `<a href="/other/">Other</a>`,
+		"/data/notes.txt":     `<a href="/old/">Old</a>`,
+		"/data/.hidden.html":  `<a href="/old/">Old</a>`,
+		"/data/new/node.yaml": `{"type": "Document"}`,
+		"/data/new/body.html": `<a href="/old/child/">Child</a>`,
+		"/config/sites":       ""}, "TestRelinkNodes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := site{Name: "foo"}
+	site.Directories.Data = filepath.Join(root, "data")
+	site.Directories.Config = filepath.Join(root, "config")
+	expected := []linkRewrite{{"/new", "body.html", 1},
+		{"/", "body.html", 2}}
+	for _, dryRun := range []bool{true, false} {
+		rewrites, err := relinkNodes(site, "/old", "/new", "alice", dryRun,
+			t.Logf)
+		if err != nil || !reflect.DeepEqual(rewrites, expected) {
+			t.Errorf("relinkNodes(..., %v, ...) = %v, %v, should be %v", dryRun,
+				rewrites, err, expected)
+		}
+	}
+	for file, content := range map[string]string{
+		"body.html":     `<a href="/new/">Old</a> <img SRC='/new/a.png'>`,
+		"notes.txt":     `<a href="/old/">Old</a>`,
+		".hidden.html":  `<a href="/old/">Old</a>`,
+		"new/body.html": `<a href="/new/child/">Child</a>`} {
+		ret, err := ioutil.ReadFile(filepath.Join(site.Directories.Data, file))
+		if err != nil || string(ret) != content {
+			t.Errorf("%v contains %q, should contain %q", file, ret, content)
+		}
+	}
+	if rewrites, err := relinkNodes(site, "/old", "/new", "alice", false,
+		t.Logf); err != nil || len(rewrites) != 0 {
+		t.Errorf("Repeated run should not rewrite links, got %v, %v", rewrites,
+			err)
+	}
+}
+
+func TestNodeMovedAlias(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/body.html":      `<a href="/old/">Old</a>`,
+		"/config/aliases.yaml": `{"/legacy.html": "/old/child"}`},
+		"TestNodeMovedAlias")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := site{Name: "foo", AliasMovedNodes: true}
+	site.Directories.Data = filepath.Join(root, "data")
+	site.Directories.Config = filepath.Join(root, "config")
+	if err := nodeMoved(site, "/old/", "/new", "alice", t.Logf); err != nil {
+		t.Fatalf("nodeMoved failed: %v", err)
+	}
+	aliases, err := loadAliases(site.Directories.Config)
+	expected := map[string]string{"/legacy.html": "/new/child",
+		"/old": "/new"}
+	if err != nil || !reflect.DeepEqual(aliases, expected) {
+		t.Errorf("Aliases are %v, %v, should be %v", aliases, err, expected)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(site.Directories.Data,
+		"body.html")); string(content) != `<a href="/old/">Old</a>` {
+		t.Errorf("Links should not be rewritten, got %q", content)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Names of the listeners. Sockets passed by systemd socket activation are
+// assigned to listeners by these names (FileDescriptorName=).
+const (
+	listenerHTTP    = "http"
+	listenerHTTPS   = "https"
+	listenerUnix    = "unix"
+	listenerFastCGI = "fastcgi"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// activationNames returns the names of the sockets passed by systemd socket
+// activation, starting at file descriptor listenFDsStart.
+//
+// Returns nil if the process with the given pid has not been socket
+// activated. A single socket without a known name will be used for plain
+// HTTP.
+func activationNames(getenv func(string) string, pid int) ([]string, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	names := make([]string, count)
+	if fdNames := getenv("LISTEN_FDNAMES"); len(fdNames) > 0 {
+		copy(names, strings.Split(fdNames, ":"))
+	}
+	known := map[string]bool{listenerHTTP: true, listenerHTTPS: true,
+		listenerUnix: true, listenerFastCGI: true}
+	for i, name := range names {
+		if known[name] {
+			continue
+		}
+		if count > 1 {
+			return nil, fmt.Errorf("Unknown name %q of passed socket %v. Use"+
+				" FileDescriptorName= to name it http, https, unix or fastcgi.",
+				name, i)
+		}
+		names[i] = listenerHTTP
+	}
+	return names, nil
+}
+
+// systemdListeners returns the listeners passed by systemd socket
+// activation by their names, or nil if the daemon has not been socket
+// activated.
+func systemdListeners() (map[string]net.Listener, error) {
+	names, err := activationNames(os.Getenv, os.Getpid())
+	if err != nil || names == nil {
+		return nil, err
+	}
+	listeners := make(map[string]net.Listener, len(names))
+	for i, name := range names {
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not use passed socket %q: %v", name,
+				err)
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("Several sockets named %q have been passed",
+				name)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on the Unix domain socket at the given path and sets
+// the socket file's mode.
+//
+// Stale socket files, e.g. of a crashed process, get removed. Fails if the
+// path exists but is not a socket or another process listens on it.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%q exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Socket %q is in use by another process",
+				path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Could not remove stale socket %q: %v", path,
+				err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Could not set mode of socket %q: %v", path, err)
+	}
+	return listener, nil
+}
+
+// openListener returns the socket activated listener of the given name if
+// any, or listens on the given address.
+//
+// Addresses starting with a slash are paths of Unix domain sockets, which
+// get the given mode.
+func openListener(activated map[string]net.Listener, name, address string,
+	mode os.FileMode) (net.Listener, error) {
+	if listener, ok := activated[name]; ok {
+		return listener, nil
+	}
+	if strings.HasPrefix(address, "/") {
+		return listenUnix(address, mode)
+	}
+	return net.Listen("tcp", address)
+}
+
+// unixPeerHandler serves requests received on Unix domain sockets.
+//
+// These requests don't have a client address, so they are treated as
+// coming from the loopback address. Thus, proxies connecting to the socket
+// may be trusted by listing 127.0.0.1 in TrustedProxies.
+type unixPeerHandler struct {
+	// Handler to serve the requests. Defaults to http.DefaultServeMux.
+	Handler http.Handler
+}
+
+func (h unixPeerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.RemoteAddr = "127.0.0.1:0"
+	handler := h.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(w, r)
+}
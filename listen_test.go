@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestActivationNames(t *testing.T) {
+	tests := []struct {
+		Env   map[string]string
+		Names []string
+		Error bool
+	}{
+		{map[string]string{}, nil, false},
+		{map[string]string{"LISTEN_PID": "2", "LISTEN_FDS": "1"}, nil, false},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"},
+			[]string{"http"}, false},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1",
+			"LISTEN_FDNAMES": "monsti.socket"}, []string{"http"}, false},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1",
+			"LISTEN_FDNAMES": "fastcgi"}, []string{"fastcgi"}, false},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2",
+			"LISTEN_FDNAMES": "https:http"}, []string{"https", "http"}, false},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2",
+			"LISTEN_FDNAMES": "https:foo"}, nil, true},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"}, nil, true},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "x"}, nil, true}}
+	for i, v := range tests {
+		getenv := func(key string) string { return v.Env[key] }
+		names, err := activationNames(getenv, 1)
+		if (err != nil) != v.Error || !reflect.DeepEqual(names, v.Names) {
+			t.Errorf("Test %v: activationNames(...) = %v, %v, should be %v,"+
+				" error: %v", i, names, err, v.Names, v.Error)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListenUnix")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "monsti.sock")
+	listener, err := listenUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("listenUnix(...) failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("Socket file has mode %v (%v), should be 0660", info.Mode(),
+			err)
+	}
+	if _, err := listenUnix(path, 0660); err == nil {
+		t.Errorf("listenUnix(...) should fail if the socket is in use")
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	// Stale sockets get replaced.
+	listener, err = listenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("listenUnix(...) failed for a stale socket: %v", err)
+	}
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket file should be removed on close: %v", err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("foo"), 0600); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if _, err := listenUnix(file, 0660); err == nil {
+		t.Errorf("listenUnix(...) should fail for existing files")
+	}
+}
+
+func TestUnixPeerHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUnixPeerHandler")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "monsti.sock")
+	listener, err := openListener(nil, listenerUnix, path, 0660)
+	if err != nil {
+		t.Fatalf("openListener(...) failed: %v", err)
+	}
+	defer listener.Close()
+	var host, ip string
+	go http.Serve(listener, unixPeerHandler{http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			host, ip = r.Host, clientIP(r)
+		})})
+	client := http.Client{Transport: &http.Transport{
+		Dial: func(network, address string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}}}
+	res, err := client.Get("http://example.com/foo")
+	if err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	res.Body.Close()
+	if host != "example.com" || ip != "127.0.0.1" {
+		t.Errorf("Request has host %q and client IP %q, should be example.com"+
+			" and 127.0.0.1", host, ip)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localeSessionKey is the session key of the locale chosen by the user.
+const localeSessionKey = "locale"
+
+// sourceLocale is the locale of the untranslated messages.
+const sourceLocale = "en"
+
+// findLocales returns the locales having a catalog in the given locales
+// directory and the source locale.
+func findLocales(dir string) []string {
+	locales := []string{sourceLocale}
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == sourceLocale {
+			continue
+		}
+		files, _ := ioutil.ReadDir(filepath.Join(dir, entry.Name(),
+			"LC_MESSAGES"))
+		if len(files) > 0 {
+			locales = append(locales, entry.Name())
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// siteLocales returns the locales available for the given site's web
+// interface.
+func (h *nodeHandler) siteLocales(site site) []string {
+	if len(site.Locale) == 0 || inStringSlice(site.Locale, h.Locales) {
+		return h.Locales
+	}
+	return append([]string{site.Locale}, h.Locales...)
+}
+
+// acceptedLanguages returns the language tags of the given Accept-Language
+// header, most preferred first.
+func acceptedLanguages(header string) []string {
+	type language struct {
+		Tag     string
+		Quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		languages = append(languages, language{tag, quality})
+	}
+	// Stable insertion sort by quality, keeping the order of equal ones.
+	for i := 1; i < len(languages); i++ {
+		for j := i; j > 0 && languages[j].Quality > languages[j-1].Quality; j-- {
+			languages[j], languages[j-1] = languages[j-1], languages[j]
+		}
+	}
+	tags := make([]string, len(languages))
+	for i, lang := range languages {
+		tags[i] = lang.Tag
+	}
+	return tags
+}
+
+// matchLocale returns the available locale matching the given language tag,
+// e.g. de for de-DE.
+func matchLocale(tag string, available []string) (string, bool) {
+	tag = strings.Replace(tag, "-", "_", -1)
+	for _, candidate := range []string{tag, strings.SplitN(tag, "_", 2)[0]} {
+		for _, locale := range available {
+			if strings.EqualFold(locale, candidate) {
+				return locale, true
+			}
+		}
+	}
+	return "", false
+}
+
+// requestLocale returns the locale to be used for the web interface.
+//
+// It's the locale chosen in the session, the user's preferred locale, the
+// best match of the request's Accept-Language header or the site's locale,
+// in this order.
+func requestLocale(r *http.Request, session *sessions.Session,
+	userLocale string, available []string, siteLocale string) string {
+	chosen, _ := session.Values[localeSessionKey].(string)
+	for _, locale := range []string{chosen, userLocale} {
+		if len(locale) > 0 && inStringSlice(locale, available) {
+			return locale
+		}
+	}
+	for _, tag := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if locale, ok := matchLocale(tag, available); ok {
+			return locale
+		}
+	}
+	return siteLocale
+}
+
+// setUserLocale stores the preferred locale of the user with the given login.
+func setUserLocale(configDir, login, locale string) error {
+	defer lockUsers(configDir)()
+	users, err := loadUsers(configDir)
+	if err != nil {
+		return err
+	}
+	idx := findUser(users, login)
+	if idx == -1 {
+		return fmt.Errorf("Unknown user %q", login)
+	}
+	users[idx].Locale = locale
+	return saveUsers(configDir, users)
+}
+
+// SetLocale handles requests to choose the locale of the web interface.
+func (h *nodeHandler) SetLocale(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	available := h.siteLocales(site)
+	context := template.Context{}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		locale := r.Form.Get("Locale")
+		switch {
+		case !validCSRFRequest(r, session, r.Form.Get("CSRFToken")):
+			context["Error"] = G("The form has expired. Please try again.")
+		case !inStringSlice(locale, available):
+			context["Error"] = G("Unknown language.")
+		default:
+			session.Values[localeSessionKey] = locale
+			if login := sessionLogin(cSession); len(login) > 0 {
+				if err := setUserLocale(site.Directories.Config, login,
+					locale); err != nil {
+					panic("Can't save preferred locale: " + err.Error())
+				}
+			}
+			if err := session.Save(r, w); err != nil {
+				panic(err.Error())
+			}
+			target := site.URL(node.Path)
+			if back, ok := checkBackURL(r.URL.Query().Get("back")); ok {
+				target = back
+			}
+			http.Redirect(w, r, target, http.StatusSeeOther)
+			return
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	type localeOption struct {
+		Locale   string
+		Selected bool
+	}
+	options := make([]localeOption, len(available))
+	for i, locale := range available {
+		options[i] = localeOption{locale, locale == cSession.Locale}
+	}
+	context["Locales"] = options
+	context["CSRFToken"] = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/setlocale", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Language"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFindLocales(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/de/LC_MESSAGES/monsti-daemon.mo": "",
+		"/fr/LC_MESSAGES/monsti-daemon.mo": "",
+		"/it/__empty__":                    "",
+		"/monsti-daemon.pot":               ""}, "TestFindLocales")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	ret := findLocales(root)
+	if strings.Join(ret, ",") != "de,en,fr" {
+		t.Errorf("findLocales(_) = %v, should be [de en fr]", ret)
+	}
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := []struct {
+		Header, Tags string
+	}{
+		{"", ""},
+		{"de", "de"},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", "fr-CH,fr,en,de"},
+		{"en;q=0.5, de", "de,en"},
+		{"en;q=0, de;q=0.1", "de"}}
+	for _, v := range tests {
+		ret := strings.Join(acceptedLanguages(v.Header), ",")
+		if ret != v.Tags {
+			t.Errorf("acceptedLanguages(%q) = %q, should be %q", v.Header, ret,
+				v.Tags)
+		}
+	}
+}
+
+func TestRequestLocale(t *testing.T) {
+	available := []string{"de", "en", "fr"}
+	tests := []struct {
+		Chosen, User, AcceptLanguage, Locale string
+	}{
+		{"", "", "", "en"},
+		{"", "", "de-DE,fr;q=0.5", "de"},
+		{"", "", "it,fr-CH;q=0.8", "fr"},
+		{"", "", "it", "en"},
+		{"", "fr", "de", "fr"},
+		{"de", "fr", "en", "de"},
+		{"xx", "", "fr", "fr"},
+		{"", "../de", "", "en"}}
+	for i, v := range tests {
+		r, _ := http.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Accept-Language", v.AcceptLanguage)
+		session := sessions.NewSession(nil, "test")
+		if len(v.Chosen) > 0 {
+			session.Values[localeSessionKey] = v.Chosen
+		}
+		ret := requestLocale(r, session, v.User, available, "en")
+		if ret != v.Locale {
+			t.Errorf("Test %v: requestLocale(...) = %q, should be %q", i, ret,
+				v.Locale)
+		}
+	}
+}
+
+func TestRequestNodeLocale(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRequestNodeLocale")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var locale string
+	h, stop := setupWorkerHandler(root, ioutil.Discard,
+		func(ticket worker.Ticket) {
+			locale = ticket.Session.Locale
+			ticket.ResponseChan <- client.Response{Body: []byte("ok"), Raw: true}
+		})
+	defer stop()
+	site_, _ := h.Sites.Get("foo")
+	site_.Locale = "en"
+	h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+	h.Locales = []string{"de", "en"}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+	r.Header.Set("Accept-Language", "de")
+	h.ServeHTTP(w, r)
+	if locale != "en" {
+		t.Errorf("Worker got locale %q, should be the site's locale", locale)
+	}
+	if vary := w.Header()["Vary"]; !inStringSlice("Accept-Language", vary) {
+		t.Errorf("Vary header is %v, should contain Accept-Language", vary)
+	}
+}
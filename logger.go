@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// logLevel is the severity of log messages.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// levelNames maps log levels to their names as used in the settings and the
+// log output.
+var levelNames = map[logLevel]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR"}
+
+// parseLogLevel returns the log level with the given (case insensitive)
+// name. Returns levelInfo for empty or unknown names.
+func parseLogLevel(name string) logLevel {
+	for level, levelName := range levelNames {
+		if strings.ToUpper(name) == levelName {
+			return level
+		}
+	}
+	return levelInfo
+}
+
+// leveledLogger wraps a log.Logger to discard messages below some level.
+//
+// A nil leveledLogger discards all messages.
+type leveledLogger struct {
+	// Logger is the underlying logger.
+	Logger *log.Logger
+	// Level is the minimum level of messages to be logged.
+	Level logLevel
+	// Prefix is prepended to all messages.
+	Prefix string
+}
+
+// newLeveledLogger returns a new leveled logger writing to the given logger.
+func newLeveledLogger(logger *log.Logger, level logLevel) *leveledLogger {
+	return &leveledLogger{Logger: logger, Level: level}
+}
+
+// openSiteLogger returns a leveled logger writing to the given file.
+//
+// The file will be created if it does not exist.
+func openSiteLogger(path, siteName string, level logLevel) (*leveledLogger,
+	error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open log file: %v", err)
+	}
+	return newLeveledLogger(log.New(file, siteName+" ", log.LstdFlags),
+		level), nil
+}
+
+// withPrefix returns a logger writing to the same logger, prefixing all
+// messages with the given prefix.
+func (l *leveledLogger) withPrefix(prefix string) *leveledLogger {
+	if l == nil {
+		return nil
+	}
+	return &leveledLogger{Logger: l.Logger, Level: l.Level,
+		Prefix: l.Prefix + prefix}
+}
+
+// output logs the message if the level is high enough.
+func (l *leveledLogger) output(level logLevel, format string,
+	v ...interface{}) {
+	if l == nil || l.Logger == nil || level < l.Level {
+		return
+	}
+	l.Logger.Output(3, levelNames[level]+": "+l.Prefix+
+		fmt.Sprintf(format, v...))
+}
+
+// Debug logs a debug message.
+func (l *leveledLogger) Debug(format string, v ...interface{}) {
+	l.output(levelDebug, format, v...)
+}
+
+// Info logs an informational message.
+func (l *leveledLogger) Info(format string, v ...interface{}) {
+	l.output(levelInfo, format, v...)
+}
+
+// Warn logs a warning.
+func (l *leveledLogger) Warn(format string, v ...interface{}) {
+	l.output(levelWarn, format, v...)
+}
+
+// Error logs an error.
+func (l *leveledLogger) Error(format string, v ...interface{}) {
+	l.output(levelError, format, v...)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Level logLevel
+	}{
+		{"", levelInfo},
+		{"debug", levelDebug},
+		{"INFO", levelInfo},
+		{"Warn", levelWarn},
+		{"error", levelError},
+		{"unknown", levelInfo}}
+	for _, v := range tests {
+		if ret := parseLogLevel(v.Name); ret != v.Level {
+			t.Errorf("parseLogLevel(%q) = %v, should be %v", v.Name, ret, v.Level)
+		}
+	}
+}
+
+func TestLeveledLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLeveledLogger(log.New(&buf, "", 0), levelWarn)
+	logger.Debug("debug %v", 1)
+	logger.Info("info %v", 2)
+	logger.Warn("warn %v", 3)
+	logger.Error("error %v", 4)
+	expected := "WARN: warn 3\nERROR: error 4\n"
+	if buf.String() != expected {
+		t.Errorf("Logged %q, should be %q", buf.String(), expected)
+	}
+	var nilLogger *leveledLogger
+	nilLogger.Error("Should not panic")
+	if strings.Contains(buf.String(), "panic") {
+		t.Errorf("nil logger should discard messages")
+	}
+}
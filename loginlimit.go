@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// loginFailures tracks failed login attempts for some key.
+type loginFailures struct {
+	// Count is the number of failures within the window.
+	Count int
+	// Last is the time of the last failure.
+	Last time.Time
+	// LockedUntil is the time until further attempts will be rejected.
+	LockedUntil time.Time
+}
+
+// loginLimiter tracks failed login attempts by keys (e.g. login names and
+// client IPs) to slow down and lock out brute force attacks.
+//
+// A nil loginLimiter does not limit at all.
+type loginLimiter struct {
+	// DelayAfter is the number of failures after which responses will be
+	// delayed.
+	DelayAfter int
+	// MaxDelay is the maximum delay.
+	MaxDelay time.Duration
+	// Threshold is the number of failures after which the key gets locked.
+	Threshold int
+	// Window is the time after the last failure after which the failures
+	// will be forgotten.
+	Window time.Duration
+	// Lockout is the time a key stays locked.
+	Lockout time.Duration
+	// MaxKeys is the maximum number of tracked keys. If reached, the keys
+	// with the oldest failures will be forgotten first.
+	MaxKeys int
+	// now returns the current time. Used for testing.
+	now      func() time.Time
+	mutex    sync.Mutex
+	failures map[string]*loginFailures
+	// swept is the time expired entries have been removed the last time.
+	swept time.Time
+}
+
+// newLoginLimiter returns a new loginLimiter using the given settings.
+//
+// Zero values of the settings will be replaced by defaults.
+func newLoginLimiter(threshold int, window, lockout time.Duration) *loginLimiter {
+	if threshold <= 0 {
+		threshold = 10
+	}
+	if window <= 0 {
+		window = 15 * time.Minute
+	}
+	if lockout <= 0 {
+		lockout = 15 * time.Minute
+	}
+	return &loginLimiter{
+		DelayAfter: 3,
+		MaxDelay:   5 * time.Second,
+		Threshold:  threshold,
+		Window:     window,
+		Lockout:    lockout,
+		MaxKeys:    10000,
+		now:        time.Now,
+		failures:   make(map[string]*loginFailures)}
+}
+
+// expired returns true if the given failures may be forgotten.
+func (l *loginLimiter) expired(failures *loginFailures, now time.Time) bool {
+	return now.Sub(failures.Last) > l.Window && now.After(failures.LockedUntil)
+}
+
+// get returns the current failures of the given key or nil.
+//
+// Expired entries will be removed. The mutex must be held by the caller.
+func (l *loginLimiter) get(key string) *loginFailures {
+	failures, ok := l.failures[key]
+	if !ok {
+		return nil
+	}
+	if l.expired(failures, l.now()) {
+		delete(l.failures, key)
+		return nil
+	}
+	return failures
+}
+
+// makeRoom removes expired entries once per window and, if there are still
+// MaxKeys entries, the entry with the oldest failure. The mutex must be held
+// by the caller.
+func (l *loginLimiter) makeRoom(now time.Time) {
+	if now.Sub(l.swept) > l.Window || len(l.failures) >= l.MaxKeys {
+		for key, failures := range l.failures {
+			if l.expired(failures, now) {
+				delete(l.failures, key)
+			}
+		}
+		l.swept = now
+	}
+	if l.MaxKeys <= 0 || len(l.failures) < l.MaxKeys {
+		return
+	}
+	oldest := ""
+	for key, failures := range l.failures {
+		if len(oldest) == 0 || failures.Last.Before(l.failures[oldest].Last) {
+			oldest = key
+		}
+	}
+	delete(l.failures, oldest)
+}
+
+// Locked returns true if any of the given keys is locked.
+func (l *loginLimiter) Locked(keys ...string) bool {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, key := range keys {
+		if failures := l.get(key); failures != nil &&
+			l.now().Before(failures.LockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the time to wait before processing a login attempt for the
+// given keys.
+func (l *loginLimiter) Delay(keys ...string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var delay time.Duration
+	for _, key := range keys {
+		failures := l.get(key)
+		if failures == nil || failures.Count <= l.DelayAfter {
+			continue
+		}
+		keyDelay := time.Duration(failures.Count-l.DelayAfter) * time.Second
+		if keyDelay > delay {
+			delay = keyDelay
+		}
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	return delay
+}
+
+// Fail records a failed login attempt for the given keys.
+//
+// Returns true if any of the keys got locked.
+func (l *loginLimiter) Fail(keys ...string) (locked bool) {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	for _, key := range keys {
+		failures := l.get(key)
+		if failures == nil {
+			l.makeRoom(now)
+			failures = new(loginFailures)
+			l.failures[key] = failures
+		}
+		failures.Count++
+		failures.Last = now
+		if failures.Count >= l.Threshold {
+			failures.LockedUntil = now.Add(l.Lockout)
+			failures.Count = 0
+			locked = true
+		}
+	}
+	return
+}
+
+// Succeed resets the failures of the given keys.
+func (l *loginLimiter) Succeed(keys ...string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
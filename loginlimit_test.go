@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newLoginLimiter(5, 10*time.Minute, 30*time.Minute)
+	limiter.now = func() time.Time { return now }
+	keys := []string{"login:foo", "ip:127.0.0.1"}
+	for i := 1; i < 5; i++ {
+		if limiter.Fail(keys...) {
+			t.Fatalf("Fail(...) locked after %v failures, should lock after 5", i)
+		}
+		if limiter.Locked(keys...) {
+			t.Fatalf("Locked(...) = true after %v failures", i)
+		}
+	}
+	if delay := limiter.Delay(keys...); delay != time.Second {
+		t.Errorf("Delay(...) = %v after 4 failures, should be 1s", delay)
+	}
+	if !limiter.Fail(keys...) {
+		t.Errorf("Fail(...) should lock after 5 failures")
+	}
+	if !limiter.Locked("login:foo") || !limiter.Locked("ip:127.0.0.1") {
+		t.Errorf("Locked(...) = false after 5 failures, should be true")
+	}
+	if limiter.Locked("login:bar", "ip:127.0.0.2") {
+		t.Errorf("Locked(...) = true for other keys, should be false")
+	}
+	now = now.Add(29 * time.Minute)
+	if !limiter.Locked(keys...) {
+		t.Errorf("Locked(...) = false before lockout expired")
+	}
+	now = now.Add(2 * time.Minute)
+	if limiter.Locked(keys...) {
+		t.Errorf("Locked(...) = true after lockout expired")
+	}
+	limiter.Fail(keys...)
+	now = now.Add(11 * time.Minute)
+	if delay := limiter.Delay(keys...); delay != 0 {
+		t.Errorf("Delay(...) = %v after window, should be 0", delay)
+	}
+	if _, ok := limiter.failures["login:foo"]; ok {
+		t.Errorf("Failures should have been forgotten after window")
+	}
+	limiter.Fail(keys...)
+	limiter.Succeed("login:foo")
+	if _, ok := limiter.failures["login:foo"]; ok {
+		t.Errorf("Succeed(...) should reset failures")
+	}
+	var nilLimiter *loginLimiter
+	if nilLimiter.Fail(keys...) || nilLimiter.Locked(keys...) ||
+		nilLimiter.Delay(keys...) != 0 {
+		t.Errorf("nil loginLimiter should not limit")
+	}
+}
+
+func TestLoginLimiterPrune(t *testing.T) {
+	limiter := newLoginLimiter(3, 10*time.Minute, 30*time.Minute)
+	limiter.MaxKeys = 3
+	now := time.Date(2013, 4, 5, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	for _, key := range []string{"a", "b", "c", "d"} {
+		limiter.Fail(key)
+		now = now.Add(time.Minute)
+	}
+	if _, ok := limiter.failures["a"]; ok || len(limiter.failures) != 3 {
+		t.Errorf("Oldest key should have been forgotten: %v", limiter.failures)
+	}
+	now = now.Add(20 * time.Minute)
+	limiter.Fail("e")
+	if _, ok := limiter.failures["e"]; !ok || len(limiter.failures) != 1 {
+		t.Errorf("Expired keys should have been removed: %v", limiter.failures)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/chrneumann/mimemail"
+	"net/smtp"
+	"strings"
+)
+
+// sendMail sends the given mail using the SMTP settings.
+//
+// If the mail has no sender or recipients, the site owner will be used.
+func sendMail(settings *settings, site site, mail mimemail.Mail) error {
+	owner := mimemail.Address{site.Owner.Name, site.Owner.Email}
+	if len(mail.From.Email) == 0 {
+		mail.From = owner
+	}
+	if mail.To == nil {
+		mail.To = []mimemail.Address{owner}
+	}
+	auth := smtp.PlainAuth("", settings.Mail.Username,
+		settings.Mail.Password, strings.Split(settings.Mail.Host, ":")[0])
+	return smtp.SendMail(settings.Mail.Host, auth,
+		mail.Sender(), mail.Recipients(), mail.Message())
+}
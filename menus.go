@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"path"
+	"sort"
+	"strings"
+)
+
+// menuFileSuffix is the suffix of the files in the root node's directory
+// defining additional menus, e.g. footer-nav.yaml for the menu footer.
+const menuFileSuffix = "-nav.yaml"
+
+// menuEntry is a link of a menu as stored in its file.
+type menuEntry struct {
+	Name string
+	// Target is the absolute path of a node or an external URL.
+	Target string
+}
+
+// isMenuFile returns true iff the given file name is the name of a menu
+// file.
+func isMenuFile(name string) bool {
+	return strings.HasSuffix(name, menuFileSuffix) &&
+		len(name) > len(menuFileSuffix)
+}
+
+// externalTarget returns true if the given menu target is not a node path.
+func externalTarget(target string) bool {
+	return !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//")
+}
+
+// getMenu returns the menu with the given name of the given site.
+//
+// Links to nodes which don't exist or which the user might not view are
+// omitted. active is the absolute path to the currently active node. access
+// may be nil.
+func getMenu(site site, name, active string, access *nodeAccess) (navigation,
+	error) {
+	root := site.Directories.Data
+	content, err := getNodeFile(root, "/", name+menuFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var entries []menuEntry
+	if err := goyaml.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal menu %q: %v", name, err)
+	}
+	var menu navigation
+	for _, entry := range entries {
+		if externalTarget(entry.Target) {
+			menu = append(menu, navLink{Name: entry.Name, Target: entry.Target})
+			continue
+		}
+		target := path.Clean(entry.Target)
+		if _, err := lookupNode(root, target); err != nil ||
+			!access.CanView(target) {
+			continue
+		}
+		menu = append(menu, navLink{
+			Name:   entry.Name,
+			Target: site.URL(strings.TrimSuffix(target, "/") + "/"),
+			Active: target == active})
+	}
+	return menu, nil
+}
+
+// menuNames returns the sorted names of the menus defined for the given
+// site.
+func menuNames(site site) ([]string, error) {
+	infos, err := ioutil.ReadDir(site.Directories.Data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read data directory: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() && isMenuFile(info.Name()) {
+			names = append(names, strings.TrimSuffix(info.Name(), menuFileSuffix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// getMenus returns the menus of the given site by their names, see getMenu.
+func getMenus(site site, active string,
+	access *nodeAccess) (map[string]navigation, error) {
+	names, err := menuNames(site)
+	if err != nil {
+		return nil, err
+	}
+	menus := make(map[string]navigation, len(names))
+	for _, name := range names {
+		if menus[name], err = getMenu(site, name, active, access); err != nil {
+			return nil, err
+		}
+	}
+	return menus, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	"reflect"
+	"testing"
+)
+
+func TestGetMenus(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":     `{"type": "Document"}`,
+		"/foo/node.yaml": `{"type": "Document"}`,
+		"/bar/node.yaml": `{"type": "Document"}`,
+		"/footer-nav.yaml": `[{"name": "Foo", "target": "/foo/"},
+			{"name": "Missing", "target": "/missing"},
+			{"name": "Home", "target": "/"},
+			{"name": "Example", "target": "http://example.com/"}]`,
+		"/meta-nav.yaml": `[{"name": "Bar", "target": "/bar"}]`,
+		"/-nav.yaml":     `[{"name": "Foo", "target": "/foo"}]`},
+		"TestGetMenus")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{BasePath: "/base"}
+	site_.Directories.Data = root
+	menus, err := getMenus(site_, "/foo", nil)
+	if err != nil {
+		t.Fatalf("getMenus failed: %v", err)
+	}
+	expected := map[string]navigation{
+		"footer": navigation{
+			{Name: "Foo", Target: "/base/foo/", Active: true},
+			{Name: "Home", Target: "/base/"},
+			{Name: "Example", Target: "http://example.com/"}},
+		"meta": navigation{{Name: "Bar", Target: "/base/bar/"}}}
+	if !reflect.DeepEqual(menus, expected) {
+		t.Errorf("getMenus(...) = %v, should be %v", menus, expected)
+	}
+}
+
+func TestIsMenuFile(t *testing.T) {
+	tests := []struct {
+		Name string
+		Menu bool
+	}{
+		{"footer-nav.yaml", true},
+		{"-nav.yaml", false},
+		{"footer.yaml", false},
+		{"node.yaml", false}}
+	for _, v := range tests {
+		if ret := isMenuFile(v.Name); ret != v.Menu {
+			t.Errorf("isMenuFile(%q) = %v, should be %v", v.Name, ret, v.Menu)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// minifyPreserved are the elements whose content must be kept as is.
+var minifyPreserved = []string{"pre", "textarea", "script", "style"}
+
+// isHTMLResponse returns true if the response with the given headers is an
+// HTML document, i.e. it has no or an HTML content type.
+func isHTMLResponse(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	return len(contentType) == 0 || strings.HasPrefix(contentType, "text/html")
+}
+
+// isHTMLSpace returns true if c is whitespace in HTML.
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// hasPrefixFold returns true if s begins with the given lower case prefix,
+// ignoring case.
+func hasPrefixFold(s []byte, prefix string) bool {
+	return len(s) >= len(prefix) &&
+		bytes.EqualFold(s[:len(prefix)], []byte(prefix))
+}
+
+// indexFold returns the index of the first occurrence of the given lower case
+// string in s ignoring case, or -1.
+func indexFold(s []byte, sep string) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if hasPrefixFold(s[i:], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+// preservedElement returns the name of the preserved element opened by the
+// tag at the beginning of s, or an empty string.
+func preservedElement(s []byte) string {
+	for _, name := range minifyPreserved {
+		if hasPrefixFold(s[1:], name) && len(s) > len(name)+1 {
+			next := s[len(name)+1]
+			if next == '>' || next == '/' || isHTMLSpace(next) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// tagEnd returns the index after the end of the tag at the beginning of s.
+// Quoted attribute values may contain '>'.
+func tagEnd(s []byte) int {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '>':
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// minifyHTML conservatively removes whitespace and comments from the given
+// HTML document.
+//
+// Runs of whitespace in text get collapsed to a single newline, if they
+// contain one, or space. Comments get removed except for conditional
+// comments. Tags and the content of pre, textarea, script and style
+// elements are kept as they are.
+func minifyHTML(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); {
+		c := in[i]
+		switch {
+		case isHTMLSpace(c):
+			end, newline := i, false
+			for ; end < len(in) && isHTMLSpace(in[end]); end++ {
+				newline = newline || in[end] == '\n'
+			}
+			if newline {
+				out = append(out, '\n')
+			} else {
+				out = append(out, ' ')
+			}
+			i = end
+		case c != '<':
+			out = append(out, c)
+			i++
+		case bytes.HasPrefix(in[i:], []byte("<!--")):
+			end := bytes.Index(in[i+4:], []byte("-->"))
+			if end == -1 {
+				end = len(in)
+			} else {
+				end += i + 7
+			}
+			// Keep conditional comments like <!--[if IE]> and <!--<![endif]-->.
+			if bytes.HasPrefix(in[i+4:], []byte("[")) ||
+				bytes.HasPrefix(in[i+4:], []byte("<!")) {
+				out = append(out, in[i:end]...)
+			}
+			i = end
+		default:
+			end := i + tagEnd(in[i:])
+			out = append(out, in[i:end]...)
+			if name := preservedElement(in[i:]); len(name) > 0 {
+				closing := indexFold(in[end:], "</"+name)
+				if closing == -1 {
+					closing = len(in) - end
+				}
+				out = append(out, in[end:end+closing]...)
+				end += closing
+			}
+			i = end
+		}
+	}
+	return out
+}
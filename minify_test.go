@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMinifyHTML(t *testing.T) {
+	tests := []struct {
+		In, Out string
+	}{
+		{"", ""},
+		{"<p>Foo  bar</p>", "<p>Foo bar</p>"},
+		{"<div>\n    <p>Foo</p>\n\n    <p>Bar</p>\n</div>\n",
+			"<div>\n<p>Foo</p>\n<p>Bar</p>\n</div>\n"},
+		{"<b>Foo</b>  \t <i>bar</i>", "<b>Foo</b> <i>bar</i>"},
+		{`<a title="Foo   bar" href="/">  x</a>`,
+			`<a title="Foo   bar" href="/"> x</a>`},
+		{`<a title="a > b"   href="/">x</a>`, `<a title="a > b"   href="/">x</a>`},
+		{"<p>Foo<!-- comment --> bar</p>", "<p>Foo bar</p>"},
+		{"<!--[if lt IE 9]><script src=\"x.js\"></script><![endif]-->",
+			"<!--[if lt IE 9]><script src=\"x.js\"></script><![endif]-->"},
+		{"<!--[if !IE]><!--> <p>x</p> <!--<![endif]-->",
+			"<!--[if !IE]><!--> <p>x</p> <!--<![endif]-->"},
+		{"<p>Foo</p><!-- unclosed", "<p>Foo</p>"},
+		{"<pre>  foo\n\n  bar  </pre>  <p>x</p>",
+			"<pre>  foo\n\n  bar  </pre> <p>x</p>"},
+		{"<PRE class=\"code\">  a  <b>  b  </b>  </Pre>",
+			"<PRE class=\"code\">  a  <b>  b  </b>  </Pre>"},
+		{"<textarea name=\"x\">\n  foo\n</textarea>",
+			"<textarea name=\"x\">\n  foo\n</textarea>"},
+		{"<script>\n  if (a  <  b) { x = \"<!-- y -->\"; }\n</script>",
+			"<script>\n  if (a  <  b) { x = \"<!-- y -->\"; }\n</script>"},
+		{"<style>\n  p  {  }\n</style>", "<style>\n  p  {  }\n</style>"},
+		{"<preview>  a  </preview>", "<preview> a </preview>"},
+		{"<script>  unclosed", "<script>  unclosed"}}
+	for i, v := range tests {
+		if ret := string(minifyHTML([]byte(v.In))); ret != v.Out {
+			t.Errorf("Test %v: minifyHTML(%q) = %q, should be %q", i, v.In, ret,
+				v.Out)
+		}
+	}
+}
+
+func TestIsHTMLResponse(t *testing.T) {
+	tests := []struct {
+		ContentType string
+		HTML        bool
+	}{
+		{"", true},
+		{"text/html; charset=utf-8", true},
+		{"application/json", false},
+		{"text/plain", false}}
+	for i, v := range tests {
+		header := make(http.Header)
+		if len(v.ContentType) > 0 {
+			header.Set("Content-Type", v.ContentType)
+		}
+		if ret := isHTMLResponse(header); ret != v.HTML {
+			t.Errorf("Test %v: isHTMLResponse(%q) = %v, should be %v", i,
+				v.ContentType, ret, v.HTML)
+		}
+	}
+}
+
+// minifyBenchmarkPage is a typical page rendered in the master template.
+var minifyBenchmarkPage = []byte(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Foo</title>
+    <!-- Styles -->
+    <link rel="stylesheet" href="/static/css/main.css">
+    <script>
+      var config = {  debug: false  };
+    </script>
+  </head>
+  <body>
+    <div class="navbar">
+      <ul class="nav">
+` + strings.Repeat(`
+        <li>
+          <a href="/foo/">
+            Foo
+          </a>
+        </li>
+`, 20) + `
+      </ul>
+    </div>
+    <div class="container">
+      <!-- Content -->
+      <div class="content">
+` + strings.Repeat(`
+        <p>
+          Lorem ipsum dolor sit amet, consectetur adipisici elit, sed
+          eiusmod tempor incidunt ut labore et dolore magna aliqua.
+        </p>
+`, 10) + `
+        <pre>
+  code  block
+        </pre>
+      </div>
+    </div>
+  </body>
+</html>
+`)
+
+func BenchmarkMinifyHTML(b *testing.B) {
+	minified := minifyHTML(minifyBenchmarkPage)
+	b.Logf("Minified %v bytes to %v bytes (%.0f%%)", len(minifyBenchmarkPage),
+		len(minified), 100*float64(len(minified))/
+			float64(len(minifyBenchmarkPage)))
+	b.SetBytes(int64(len(minifyBenchmarkPage)))
+	for i := 0; i < b.N; i++ {
+		minifyHTML(minifyBenchmarkPage)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// contentModes are the modes of the files and directories written to the
+// data directories.
+type contentModes struct {
+	// File is the mode of files.
+	File os.FileMode
+	// Dir is the mode of directories.
+	Dir os.FileMode
+	// Umask gets removed from File and Dir. It's only set as the process'
+	// umask if SetUmask is true.
+	Umask    os.FileMode
+	SetUmask bool
+}
+
+// defaultContentModes are the modes used if not configured otherwise.
+var defaultContentModes = contentModes{File: 0600, Dir: 0700}
+
+// parseMode parses the given octal mode, returning def if it's empty.
+func parseMode(name, mode string, def os.FileMode) (os.FileMode, error) {
+	if len(mode) == 0 {
+		return def, nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("Invalid %v mode %q", name, mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// parseContentModes parses the given octal modes and umask.
+//
+// Modes making content world-writable are rejected unless allowWritable is
+// true.
+func parseContentModes(file, dir, umask string,
+	allowWritable bool) (contentModes, error) {
+	var modes contentModes
+	var err error
+	if modes.File, err = parseMode("file", file,
+		defaultContentModes.File); err != nil {
+		return modes, err
+	}
+	if modes.Dir, err = parseMode("directory", dir,
+		defaultContentModes.Dir); err != nil {
+		return modes, err
+	}
+	if modes.Umask, err = parseMode("umask", umask, 0); err != nil {
+		return modes, err
+	}
+	modes.SetUmask = len(umask) > 0
+	if modes.WorldWritable() && !allowWritable {
+		return modes, fmt.Errorf("Modes %v and %v make content world-writable,"+
+			" set Modes.AllowWorldWritable to allow this", modes.FileMode(),
+			modes.DirMode())
+	}
+	return modes, nil
+}
+
+// FileMode returns the mode of files after applying the umask.
+func (m contentModes) FileMode() os.FileMode {
+	return m.File &^ m.Umask
+}
+
+// DirMode returns the mode of directories after applying the umask.
+func (m contentModes) DirMode() os.FileMode {
+	return m.Dir &^ m.Umask
+}
+
+// WorldWritable returns true iff files or directories will be writable by
+// all users.
+func (m contentModes) WorldWritable() bool {
+	return (m.FileMode()|m.DirMode())&0002 != 0
+}
+
+// currentModes are the modes used to write content.
+var currentModes = defaultContentModes
+
+// currentModesMutex protects currentModes.
+var currentModesMutex sync.RWMutex
+
+// setContentModes sets the modes used to write content.
+func setContentModes(modes contentModes) {
+	currentModesMutex.Lock()
+	defer currentModesMutex.Unlock()
+	currentModes = modes
+}
+
+// getContentModes returns the modes used to write content.
+func getContentModes() contentModes {
+	currentModesMutex.RLock()
+	defer currentModesMutex.RUnlock()
+	return currentModes
+}
+
+// mkdirContent creates the given directory and its missing parents with the
+// configured directory mode.
+func mkdirContent(dir string) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%q is not a directory", dir)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirContent(parent); err != nil {
+			return err
+		}
+	}
+	mode := getContentModes().DirMode()
+	if err := os.Mkdir(dir, mode); err != nil && !os.IsExist(err) {
+		return err
+	}
+	// Mkdir is subject to the process' umask.
+	return os.Chmod(dir, mode)
+}
+
+// writeContentFile atomically writes the given file with the configured file
+// mode.
+func writeContentFile(file string, data []byte) error {
+	return writeFileAtomic(file, data, getContentModes().FileMode())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestParseContentModes(t *testing.T) {
+	tests := []struct {
+		File, Dir, Umask string
+		AllowWritable    bool
+		Modes            contentModes
+		Error            bool
+	}{
+		{"", "", "", false, contentModes{File: 0600, Dir: 0700}, false},
+		{"0640", "750", "", false, contentModes{File: 0640, Dir: 0750}, false},
+		{"0666", "0777", "002", false, contentModes{File: 0666, Dir: 0777,
+			Umask: 02, SetUmask: true}, false},
+		{"0666", "", "", false, contentModes{}, true},
+		{"0666", "", "", true, contentModes{File: 0666, Dir: 0700}, false},
+		{"0640", "0777", "", false, contentModes{}, true},
+		{"0680", "", "", false, contentModes{}, true},
+		{"01640", "", "", false, contentModes{}, true},
+		{"", "", "abc", false, contentModes{}, true}}
+	for i, v := range tests {
+		modes, err := parseContentModes(v.File, v.Dir, v.Umask, v.AllowWritable)
+		if (err != nil) != v.Error || (err == nil && modes != v.Modes) {
+			t.Errorf("Test %v: parseContentModes(...) = %+v, %v, should be %+v,"+
+				" error: %v", i, modes, err, v.Modes, v.Error)
+		}
+	}
+}
+
+func TestContentModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("File modes are not supported on this platform.")
+	}
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `{"type": "Document"}`}, "TestContentModes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	defer setContentModes(getContentModes())
+	// The configured modes must not be restricted by the process' umask.
+	defer syscall.Umask(syscall.Umask(077))
+	setContentModes(contentModes{File: 0666, Dir: 0777, Umask: 02})
+	if err := writeNode(client.Node{Path: "/foo", Type: "Document"}, "alice",
+		root); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if err := mkdirContent(filepath.Join(root, "foo", "a", "b")); err != nil {
+		t.Fatalf("Could not create directories: %v", err)
+	}
+	if err := writeContentFile(filepath.Join(root, "foo", "body.html"),
+		[]byte("body")); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	tests := []struct {
+		File string
+		Mode os.FileMode
+	}{
+		{"foo", os.ModeDir | 0775},
+		{"foo/node.yaml", 0664},
+		{"foo/a", os.ModeDir | 0775},
+		{"foo/a/b", os.ModeDir | 0775},
+		{"foo/body.html", 0664}}
+	for _, v := range tests {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(v.File)))
+		if err != nil {
+			t.Errorf("Could not stat %v: %v", v.File, err)
+			continue
+		}
+		if info.Mode() != v.Mode {
+			t.Errorf("Mode of %v is %v, should be %v", v.File, info.Mode(),
+				v.Mode)
+		}
+	}
+}
@@ -8,23 +8,25 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"github.com/monsti/monsti-daemon/worker"
 	"github.com/monsti/util/l10n"
-	"github.com/monsti/util/template"
 	"log"
+	"net"
 	"net/http"
+	"net/http/fcgi"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 )
 
-func main() {
-	logger := log.New(os.Stderr, "monsti", log.LstdFlags)
-	flag.Parse()
-	if flag.NArg() != 1 {
-		logger.Fatalf("Usage: %v <config_directory>\n", filepath.Base(os.Args[0]))
-	}
-	cfgPath := flag.Arg(0)
+// absConfigPath returns the absolute path of the given configuration
+// directory.
+func absConfigPath(cfgPath string) string {
 	if !filepath.IsAbs(cfgPath) {
 		wd, err := os.Getwd()
 		if err != nil {
@@ -32,38 +34,219 @@ func main() {
 		}
 		cfgPath = filepath.Join(wd, cfgPath)
 	}
+	return cfgPath
+}
+
+func main() {
+	logger := log.New(os.Stderr, "monsti", log.LstdFlags)
+	check := flag.Bool("check", false,
+		"Check the data directories of all sites and exit")
+	rehashCheck := flag.Bool("rehash-check", false,
+		"Report the accounts with outdated password hashes and exit")
+	if len(os.Args) > 1 && os.Args[1] == "newsite" {
+		if err := newSiteCommand(os.Args[2:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		if err := usageCommand(os.Stdout, os.Args[2:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		logger.Fatalf("Usage: %v [--check|--rehash-check]"+
+			" <config_directory>\n       %v newsite --help\n"+
+			"       %v usage --help\n", filepath.Base(os.Args[0]),
+			filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+	}
+	cfgPath := absConfigPath(flag.Arg(0))
 	settings, err := loadSettings(cfgPath)
 	if err != nil {
 		logger.Fatal("Could not load settings: ", err)
 	}
+	if *check {
+		if checkSites(os.Stdout, settings.Sites, settings.NodeTypes) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *rehashCheck {
+		if _, err := checkPasswordHashes(os.Stdout, settings.Sites,
+			settings.Login.PasswordCost); err != nil {
+			logger.Fatal("Could not check password hashes: ", err)
+		}
+		return
+	}
+	if settings.ContentModes.SetUmask {
+		syscall.Umask(int(settings.ContentModes.Umask))
+	}
+	if settings.ContentModes.WorldWritable() {
+		logger.Printf("Warning: Content will be world-writable (modes %v and"+
+			" %v).", settings.ContentModes.FileMode(),
+			settings.ContentModes.DirMode())
+	}
+	setContentModes(settings.ContentModes)
 	l10n.DefaultSettings.Domain = "monsti"
 	l10n.DefaultSettings.Directory = settings.Directories.Locales
+	logLevel := parseLogLevel(settings.Log.Level)
 	handler := nodeHandler{
-		Renderer:   template.Renderer{Root: settings.Directories.Templates},
+		Renderer: &templateRenderer{Root: settings.Directories.Templates,
+			Dev: settings.DevMode},
 		Settings:   settings,
+		Sites:      newSiteRegistry(settings.Sites, settings.DefaultSite),
 		NodeQueues: make(map[string]chan worker.Ticket),
-		Log:        logger}
+		Log:        newLeveledLogger(logger, logLevel),
+		SiteLogs:   make(map[string]*leveledLogger),
+		Stats:      newWorkerStats(),
+		Protocols:  newProtocolRegistry(newLeveledLogger(logger, logLevel)),
+		Locales:    findLocales(settings.Directories.Locales),
+		LoginLimiter: newLoginLimiter(settings.Login.MaxFailures,
+			time.Duration(settings.Login.WindowMinutes)*time.Minute,
+			time.Duration(settings.Login.LockoutMinutes)*time.Minute),
+		RateLimiter: newRateLimiter([numBudgets]rateBudget{
+			settings.RateLimit.Pages, settings.RateLimit.Actions,
+			settings.RateLimit.Auth}, settings.RateLimitAllow,
+			settings.RateLimit.MaxClients),
+		Tracer: newTracer(settings.Tracing,
+			newLeveledLogger(logger, logLevel)),
+		Notifier: newNotifier(settings, newLeveledLogger(logger, logLevel))}
+	for name, site := range settings.Sites {
+		if len(site.LogFile) == 0 {
+			continue
+		}
+		siteLog, err := openSiteLogger(site.LogFile, name, logLevel)
+		if err != nil {
+			logger.Fatalf("Could not open log file of site %q: %v", name, err)
+		}
+		handler.SiteLogs[name] = siteLog
+	}
+	if len(settings.Log.AccessLog) > 0 {
+		handler.AccessLog, err = openAccessLog(settings.Log.AccessLog)
+		if err != nil {
+			logger.Fatal("Could not open access log: ", err)
+		}
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, syscall.SIGUSR1)
+		go func() {
+			for _ = range reopen {
+				if err := handler.AccessLog.Reopen(); err != nil {
+					handler.Log.Error("Could not reopen access log: %v", err)
+				}
+			}
+		}()
+	}
+	for _, ntype := range settings.NodeTypes {
+		if _, err := settings.workerCommand(ntype); err != nil {
+			logger.Fatal("Could not start workers: ", err)
+		}
+	}
 	for _, ntype := range settings.NodeTypes {
 		handler.AddNodeProcess(ntype, logger)
 	}
+	for _, site := range settings.Sites {
+		siteWriteLock(site)
+	}
+	go handler.checkSitesOnStartup(settings.Sites, settings.NodeTypes)
+	staticAssets.Log = handler.Log
+	handler.enableCaches(settings, settings.Sites)
+	go handler.collectImageCaches()
+	go handler.scheduleTasks()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for _ = range reload {
+			if err := handler.Reload(cfgPath); err != nil {
+				handler.Log.Error("Could not reload settings: %v", err)
+			}
+		}
+	}()
 	http.Handle("/static/", http.FileServer(http.Dir(
 		filepath.Dir(settings.Directories.Statics))))
-	handler.Hosts = make(map[string]string)
-	for site_title, site := range settings.Sites {
-		for _, host := range site.Hosts {
-			handler.Hosts[host] = site_title
-			http.Handle(host+"/site-static/", http.FileServer(http.Dir(
-				filepath.Dir(site.Directories.Statics))))
+	http.Handle("/", &handler)
+	activated, err := systemdListeners()
+	if err != nil {
+		logger.Fatal("Could not use socket activation: ", err)
+	}
+	var listeners []net.Listener
+	failed := make(chan error)
+	serve := func(name string, listener net.Listener,
+		serveFunc func(net.Listener, http.Handler) error, handler http.Handler) {
+		listeners = append(listeners, listener)
+		go func() {
+			err := serveFunc(listener, handler)
+			failed <- fmt.Errorf("%v listener failed: %v", name, err)
+		}()
+		logger.Printf("Listening for %v on %q.", name, listener.Addr())
+	}
+	var plainHandler http.Handler
+	if len(settings.TLS.Listen) > 0 {
+		handler.Certificates = new(certStore)
+		if settings.TLS.ACME.Enabled {
+			handler.Certificates.ACME = newACMEManager(settings.TLS.ACME,
+				settings.Sites, handler.Log)
+		}
+		for _, err := range handler.Certificates.Load(settings.Sites,
+			settings.DefaultSite) {
+			handler.Log.Error("%v", err)
+		}
+		listener, err := openListener(activated, listenerHTTPS,
+			settings.TLS.Listen, 0)
+		if err != nil {
+			logger.Fatal("Could not start TLS listener: ", err)
+		}
+		serve("HTTPS", tls.NewListener(listener, &tls.Config{
+			GetCertificate: handler.Certificates.GetCertificate}), http.Serve, nil)
+		if settings.TLS.RedirectHTTP {
+			_, port, _ := net.SplitHostPort(settings.TLS.Listen)
+			plainHandler = httpsRedirector{Port: port, Handler: &handler}
 		}
 	}
-	http.Handle("/", &handler)
-	c := make(chan int)
-	go func() {
-		if err := http.ListenAndServe(settings.Listen, nil); err != nil {
-			logger.Fatal("HTTP Listener failed: ", err)
+	if handler.Certificates != nil && handler.Certificates.ACME != nil {
+		// Answer HTTP challenges before any redirects or site lookups.
+		plainHandler = handler.Certificates.ACME.HTTPHandler(plainHandler)
+	}
+	if len(settings.Unix.Path) > 0 {
+		listener, err := openListener(activated, listenerUnix,
+			settings.Unix.Path, settings.UnixMode)
+		if err != nil {
+			logger.Fatal("Could not start Unix socket listener: ", err)
 		}
-		c <- 1
-	}()
-	logger.Printf("Monsti is up and running. Listening on %q.", settings.Listen)
-	<-c
+		serve("HTTP", listener, http.Serve, unixPeerHandler{plainHandler})
+	}
+	if len(settings.FastCGI.Listen) > 0 {
+		listener, err := openListener(activated, listenerFastCGI,
+			settings.FastCGI.Listen, settings.FastCGIMode)
+		if err != nil {
+			logger.Fatal("Could not start FastCGI listener: ", err)
+		}
+		serve("FastCGI", listener, fcgi.Serve, nil)
+	}
+	_, activatedHTTP := activated[listenerHTTP]
+	if len(settings.Listen) > 0 || activatedHTTP || len(listeners) == 0 {
+		address := settings.Listen
+		if len(address) == 0 {
+			address = ":http"
+		}
+		listener, err := openListener(activated, listenerHTTP, address, 0)
+		if err != nil {
+			logger.Fatal("Could not start HTTP listener: ", err)
+		}
+		serve("HTTP", listener, http.Serve, plainHandler)
+	}
+	// Close the listeners on shutdown to remove the socket files.
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	logger.Printf("Monsti is up and running.")
+	select {
+	case err := <-failed:
+		logger.Fatal(err)
+	case sig := <-shutdown:
+		logger.Printf("Received %v, shutting down.", sig)
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"code.google.com/p/go.text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Node naming policies.
+const (
+	// namesASCII allows ASCII letters, digits, dashes and underscores.
+	namesASCII = "ascii"
+	// namesUnicode additionally allows any Unicode letters and digits. Names
+	// and request paths get NFC normalized.
+	namesUnicode = "unicode"
+)
+
+// asciiName matches valid node names of the ASCII naming policy.
+var asciiName = regexp.MustCompile(`^[-\w]+$`)
+
+// reservedNames are names which must not be used for nodes because they
+// clash with other URLs or files.
+var reservedNames = []string{"static", "site-static"}
+
+// normalizeName returns the normalized form of the given node name or path
+// according to the given naming policy.
+func normalizeName(name, policy string) string {
+	if policy == namesUnicode {
+		return norm.NFC.String(name)
+	}
+	return name
+}
+
+// validNodeName returns whether the given (normalized) node name is allowed
+// by the given naming policy.
+func validNodeName(name, policy string) bool {
+	if len(name) == 0 || strings.HasPrefix(name, "@@") ||
+		strings.HasPrefix(name, ".") || inStringSlice(name, reservedNames) {
+		return false
+	}
+	if policy != namesUnicode {
+		return asciiName.MatchString(name)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) &&
+			r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
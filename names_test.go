@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidNodeName(t *testing.T) {
+	tests := []struct {
+		Name           string
+		ASCII, Unicode bool
+	}{
+		{"foo", true, true},
+		{"foo-bar_2", true, true},
+		{"", false, false},
+		{"über", false, true},
+		{"café", false, true},
+		{"日本語", false, true},
+		{"foo bar", false, false},
+		{"foo/bar", false, false},
+		{"foo.bar", false, false},
+		{".", false, false},
+		{"..", false, false},
+		{".hidden", false, false},
+		{"@@edit", false, false},
+		{"node.yaml", false, false},
+		{"static", false, false},
+		{"site-static", false, false},
+		{"a\x00", false, false}}
+	for i, v := range tests {
+		if ret := validNodeName(v.Name, namesASCII); ret != v.ASCII {
+			t.Errorf("Test %v: validNodeName(%q, ascii) = %v, should be %v", i,
+				v.Name, ret, v.ASCII)
+		}
+		if ret := validNodeName(v.Name, namesUnicode); ret != v.Unicode {
+			t.Errorf("Test %v: validNodeName(%q, unicode) = %v, should be %v", i,
+				v.Name, ret, v.Unicode)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		Name, Policy, Normalized string
+	}{
+		{"über", namesUnicode, "über"},
+		{"/café/über/", namesUnicode, "/café/über/"},
+		{"über", namesASCII, "über"}}
+	for i, v := range tests {
+		if ret := normalizeName(v.Name, v.Policy); ret != v.Normalized {
+			t.Errorf("Test %v: normalizeName(%q, %q) = %q, should be %q", i,
+				v.Name, v.Policy, ret, v.Normalized)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/monsti/rpc/client"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// newSiteOptions are the options of the newsite command.
+type newSiteOptions struct {
+	// From is the name of the site to be cloned.
+	From string
+	// Name is the name of the new site.
+	Name string
+	// Hosts are the hosts which should deliver the new site.
+	Hosts []string
+	// Admin asks for an initial admin user of the new site.
+	Admin bool
+	// DryRun lists the actions without performing them.
+	DryRun bool
+}
+
+// newSiteAction is a step of creating a new site.
+type newSiteAction struct {
+	// Description tells what the action creates.
+	Description string
+	// Do performs the action.
+	Do func() error
+}
+
+// validSiteName returns true iff the given name may be used as name of a
+// site's configuration directory.
+func validSiteName(name string) bool {
+	return len(name) > 0 && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`)
+}
+
+// checkNewSite checks the given options of the newsite command against the
+// given settings.
+func checkNewSite(settings *settings, opts newSiteOptions) error {
+	if !validSiteName(opts.Name) {
+		return fmt.Errorf("Invalid site name %q", opts.Name)
+	}
+	if _, ok := settings.Sites[opts.From]; !ok {
+		return fmt.Errorf("Unknown template site %q", opts.From)
+	}
+	if _, ok := settings.Sites[opts.Name]; ok {
+		return fmt.Errorf("Site %q already exists", opts.Name)
+	}
+	sitePath := filepath.Join(settings.Directories.Config, "sites", opts.Name)
+	if _, err := os.Stat(sitePath); !os.IsNotExist(err) {
+		return fmt.Errorf("Site directory %q already exists", sitePath)
+	}
+	if len(opts.Hosts) == 0 {
+		return fmt.Errorf("Missing host of the new site")
+	}
+	for name, site := range settings.Sites {
+		hosts := append(append([]string{site.CanonicalHost}, site.Hosts...),
+			site.Aliases...)
+		for _, host := range opts.Hosts {
+			if inStringSlice(host, hosts) {
+				return fmt.Errorf("Host %q is already used by site %q", host, name)
+			}
+		}
+	}
+	return nil
+}
+
+// newSiteDir returns the directory of the new site at sitePath
+// corresponding to the given directory of the template site at
+// templatePath.
+//
+// Directories inside the template site's configuration directory keep their
+// relative path, others get the given default name.
+func newSiteDir(templatePath, sitePath, dir, name string) string {
+	rel, err := filepath.Rel(templatePath, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = name
+	}
+	return filepath.Join(sitePath, rel)
+}
+
+// copyTree copies the given directory to dst, which must not exist yet.
+//
+// Hidden files and directories, e.g. the search index or the trash of a
+// data directory, will be skipped, see walkExportTree.
+func copyTree(src, dst string) error {
+	return walkExportTree(src, nil, func(rel, file string,
+		info os.FileInfo) error {
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+		if info.IsDir() {
+			return os.Mkdir(target, info.Mode().Perm())
+		}
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// newSiteConfig returns the content of the site.yaml file of the new site
+// given the content of the template site's one.
+//
+// Host specific settings like aliases, certificates and log files of the
+// template site will be dropped. The session key will be replaced by a new
+// random one.
+func newSiteConfig(content []byte, opts newSiteOptions,
+	dirs map[string]string) ([]byte, error) {
+	var config map[string]interface{}
+	if err := goyaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("Could not parse site.yaml: %v", err)
+	}
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	for _, key := range []string{"canonicalhost", "aliases", "tls", "logfile",
+		"auditlog"} {
+		delete(config, key)
+	}
+	config["name"] = opts.Name
+	config["hosts"] = opts.Hosts
+	config["sessionauthkey"] = randomToken()
+	config["directories"] = dirs
+	return goyaml.Marshal(config)
+}
+
+// planNewSite returns the actions creating the site described by the given
+// options. admin is the initial admin user of the new site, or nil.
+func planNewSite(settings *settings, opts newSiteOptions,
+	admin *user) ([]newSiteAction, error) {
+	from := settings.Sites[opts.From]
+	templatePath := from.Directories.Config
+	sitePath := filepath.Join(settings.Directories.Config, "sites", opts.Name)
+	content, err := ioutil.ReadFile(filepath.Join(templatePath, "site.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read settings of template site: %v",
+			err)
+	}
+	actions := []newSiteAction{{
+		fmt.Sprintf("Site directory %v", sitePath),
+		func() error { return os.Mkdir(sitePath, 0700) }}}
+	dirs := make(map[string]string)
+	for _, dir := range []struct {
+		Key, Name, Path string
+	}{
+		{"data", "data directory", from.Directories.Data},
+		{"statics", "static files", from.Directories.Statics},
+		{"templates", "templates", from.Directories.Templates}} {
+		if len(dir.Path) == 0 || dir.Path == templatePath {
+			continue
+		}
+		if _, err := os.Stat(dir.Path); err != nil {
+			if os.IsNotExist(err) && dir.Key != "data" {
+				continue
+			}
+			return nil, fmt.Errorf("Could not read %v of template site: %v",
+				dir.Name, err)
+		}
+		src, dst := dir.Path, newSiteDir(templatePath, sitePath, dir.Path,
+			dir.Key)
+		dirs[dir.Key], _ = filepath.Rel(sitePath, dst)
+		actions = append(actions, newSiteAction{
+			fmt.Sprintf("Copy of the %v %v at %v", dir.Name, src, dst),
+			func() error {
+				if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+					return err
+				}
+				return copyTree(src, dst)
+			}})
+	}
+	config, err := newSiteConfig(content, opts, dirs)
+	if err != nil {
+		return nil, err
+	}
+	actions = append(actions, newSiteAction{
+		fmt.Sprintf("Settings %v with hosts %v and a new session key",
+			filepath.Join(sitePath, "site.yaml"), strings.Join(opts.Hosts, ", ")),
+		func() error {
+			return writeFileAtomic(filepath.Join(sitePath, "site.yaml"), config,
+				0600)
+		}})
+	users := []user{}
+	description := fmt.Sprintf("Empty user database %v",
+		filepath.Join(sitePath, "users.yaml"))
+	if opts.Admin {
+		login := "(asked for)"
+		if admin != nil {
+			users, login = append(users, *admin), admin.Login
+		}
+		description = fmt.Sprintf("User database %v with admin %v",
+			filepath.Join(sitePath, "users.yaml"), login)
+	}
+	actions = append(actions, newSiteAction{description,
+		func() error { return saveUsers(sitePath, users) }})
+	return actions, nil
+}
+
+// promptAdmin asks for the login, email address and password of the
+// initial admin user of a new site.
+//
+// If r is a terminal, the password will be read without echoing it.
+func promptAdmin(w io.Writer, r io.Reader, cost int) (*user, error) {
+	in := bufio.NewReader(r)
+	fd := -1
+	if file, ok := r.(*os.File); ok && terminal.IsTerminal(int(file.Fd())) {
+		fd = int(file.Fd())
+	}
+	ask := func(prompt string, hidden bool) (string, error) {
+		fmt.Fprint(w, prompt)
+		var line string
+		var err error
+		if hidden && fd >= 0 {
+			var secret []byte
+			secret, err = terminal.ReadPassword(fd)
+			fmt.Fprintln(w)
+			line = string(secret)
+		} else {
+			line, err = in.ReadString('\n')
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("Missing answer")
+			}
+			return "", fmt.Errorf("Could not read %v: %v",
+				strings.TrimSuffix(strings.ToLower(prompt), ": "), err)
+		}
+		return line, nil
+	}
+	login, err := ask("Login: ", false)
+	if err != nil {
+		return nil, err
+	}
+	email, err := ask("Email address: ", false)
+	if err != nil {
+		return nil, err
+	}
+	password, err := ask("Password: ", true)
+	if err != nil {
+		return nil, err
+	}
+	admin := user{User: client.User{Login: login, Name: login, Email: email,
+		Password: hashPassword(password, cost)}, Roles: []string{roleAdmin}}
+	return &admin, nil
+}
+
+// createSite creates the site described by the given options and writes
+// what has been created to w. With opts.DryRun, the actions are only
+// listed.
+//
+// The resulting configuration gets checked like on startup. If it's
+// invalid, the new site will be removed again.
+func createSite(w io.Writer, r io.Reader, settings *settings,
+	opts newSiteOptions) error {
+	if err := checkNewSite(settings, opts); err != nil {
+		return err
+	}
+	var admin *user
+	if opts.Admin && !opts.DryRun {
+		var err error
+		if admin, err = promptAdmin(w, r,
+			settings.Login.PasswordCost); err != nil {
+			return err
+		}
+	}
+	actions, err := planNewSite(settings, opts, admin)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		fmt.Fprintln(w, "Would create:")
+		for _, action := range actions {
+			fmt.Fprintf(w, "  %v\n", action.Description)
+		}
+		return nil
+	}
+	sitePath := filepath.Join(settings.Directories.Config, "sites", opts.Name)
+	fail := func(err error) error {
+		if removeErr := os.RemoveAll(sitePath); removeErr != nil {
+			return fmt.Errorf("%v (could not remove %v: %v)", err, sitePath,
+				removeErr)
+		}
+		return fmt.Errorf("%v (removed %v)", err, sitePath)
+	}
+	fmt.Fprintln(w, "Created:")
+	for i, action := range actions {
+		if err := action.Do(); err != nil {
+			err = fmt.Errorf("Could not create %v: %v",
+				strings.ToLower(action.Description[:1])+action.Description[1:], err)
+			if i == 0 {
+				return err
+			}
+			return fail(err)
+		}
+		fmt.Fprintf(w, "  %v\n", action.Description)
+	}
+	newSettings, err := loadSettings(settings.Directories.Config)
+	if err != nil {
+		return fail(fmt.Errorf("Invalid configuration of new site: %v", err))
+	}
+	if checkSites(w, map[string]site{opts.Name: newSettings.Sites[opts.Name]},
+		newSettings.NodeTypes) > 0 {
+		return fail(fmt.Errorf("Data check of new site failed"))
+	}
+	return nil
+}
+
+// newSiteCommand runs the newsite command with the given arguments.
+func newSiteCommand(args []string) error {
+	flags := flag.NewFlagSet("newsite", flag.ContinueOnError)
+	var opts newSiteOptions
+	flags.StringVar(&opts.From, "from", "", "Name of the site to be cloned")
+	flags.StringVar(&opts.Name, "name", "", "Name of the new site")
+	hosts := flags.String("host", "",
+		"Comma separated hosts which should deliver the new site")
+	flags.BoolVar(&opts.Admin, "admin", false,
+		"Ask for an initial admin user of the new site")
+	flags.BoolVar(&opts.DryRun, "dry-run", false,
+		"List the actions without performing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || len(opts.From) == 0 || len(opts.Name) == 0 {
+		return fmt.Errorf("Usage: %v newsite --from=<site> --name=<name>"+
+			" --host=<host>[,<host>...] [--admin] [--dry-run] <config_directory>",
+			filepath.Base(os.Args[0]))
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); len(host) > 0 {
+			opts.Hosts = append(opts.Hosts, host)
+		}
+	}
+	settings, err := loadSettings(absConfigPath(flags.Arg(0)))
+	if err != nil {
+		return fmt.Errorf("Could not load settings: %v", err)
+	}
+	return createSite(os.Stdout, os.Stdin, settings, opts)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidSiteName(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Valid bool
+	}{
+		{"customer", true},
+		{"customer-2.example", true},
+		{"", false},
+		{".hidden", false},
+		{"..", false},
+		{"foo/bar", false}}
+	for i, v := range tests {
+		if ret := validSiteName(v.Name); ret != v.Valid {
+			t.Errorf("Test %v: validSiteName(%q) = %v, should be %v", i, v.Name,
+				ret, v.Valid)
+		}
+	}
+}
+
+// setupNewSiteConfig creates a configuration directory with a template
+// site and returns its settings.
+func setupNewSiteConfig(t *testing.T, name string) (*settings, func()) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/monsti.yaml": `{"nodetypes": ["Document"]}`,
+		"/sites/template/site.yaml": `{"title": "Template",
+"hosts": ["template.example.com"], "aliases": ["www.template.example.com"],
+"sessionauthkey": "secret", "directories": {"data": "data",
+"templates": "templates"}}`,
+		"/sites/template/users.yaml":            `[{"login": "alice"}]`,
+		"/sites/template/data/node.yaml":        `{"type": "Document"}`,
+		"/sites/template/data/foo/node.yaml":    `{"type": "Document"}`,
+		"/sites/template/data/.monsti/a.yaml":   `{}`,
+		"/sites/template/templates/master.html": "Master"}, name)
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	settings, err := loadSettings(root)
+	if err != nil {
+		cleanup()
+		t.Fatalf("Could not load settings: %v", err)
+	}
+	return settings, cleanup
+}
+
+func TestCreateSite(t *testing.T) {
+	settings, cleanup := setupNewSiteConfig(t, "TestCreateSite")
+	defer cleanup()
+	var out bytes.Buffer
+	err := createSite(&out, strings.NewReader("bob\nbob@example.com\nfoo\n"),
+		settings, newSiteOptions{From: "template", Name: "customer",
+			Hosts: []string{"customer.example.com"}, Admin: true})
+	if err != nil {
+		t.Fatalf("createSite(...) returned error: %v\n%v", err, out.String())
+	}
+	newSettings, err := loadSettings(settings.Directories.Config)
+	if err != nil {
+		t.Fatalf("Could not load settings of new site: %v", err)
+	}
+	site, ok := newSettings.Sites["customer"]
+	sitePath := filepath.Join(settings.Directories.Config, "sites",
+		"customer")
+	if !ok || len(site.Hosts) != 1 || site.Hosts[0] != "customer.example.com" ||
+		len(site.Aliases) != 0 || site.Title != "Template" ||
+		len(site.SessionAuthKey) == 0 || site.SessionAuthKey == "secret" ||
+		site.Directories.Data != filepath.Join(sitePath, "data") {
+		t.Errorf("Settings of the new site are %+v", site)
+	}
+	for _, file := range []string{"data/foo/node.yaml",
+		"templates/master.html"} {
+		if _, err := os.Stat(filepath.Join(sitePath, file)); err != nil {
+			t.Errorf("%v has not been copied: %v", file, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sitePath, "data", ".monsti")); err == nil {
+		t.Errorf("Hidden directory has been copied")
+	}
+	users, err := loadUsers(sitePath)
+	if err != nil || len(users) != 1 || users[0].Login != "bob" ||
+		!passwordEqual(users[0].Password, "foo") {
+		t.Errorf("Users of the new site are %v, %v", users, err)
+	}
+	if !strings.Contains(out.String(), filepath.Join(sitePath, "site.yaml")) {
+		t.Errorf("Output does not list the settings file:\n%v", out.String())
+	}
+	err = createSite(&out, nil, newSettings, newSiteOptions{From: "template",
+		Name: "customer", Hosts: []string{"other.example.com"}})
+	if err == nil {
+		t.Errorf("createSite(...) overwrote an existing site")
+	}
+}
+
+func TestCreateSiteDryRun(t *testing.T) {
+	settings, cleanup := setupNewSiteConfig(t, "TestCreateSiteDryRun")
+	defer cleanup()
+	var out bytes.Buffer
+	if err := createSite(&out, nil, settings, newSiteOptions{
+		From: "template", Name: "customer", Admin: true, DryRun: true,
+		Hosts: []string{"customer.example.com"}}); err != nil {
+		t.Fatalf("createSite(...) returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(settings.Directories.Config, "sites",
+		"customer")); !os.IsNotExist(err) {
+		t.Errorf("Dry run created the site directory")
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 6 {
+		t.Errorf("Dry run listed %v lines, should be 6:\n%v", lines,
+			out.String())
+	}
+}
+
+func TestCheckNewSite(t *testing.T) {
+	settings, cleanup := setupNewSiteConfig(t, "TestCheckNewSite")
+	defer cleanup()
+	os.Mkdir(filepath.Join(settings.Directories.Config, "sites", "stale"),
+		0700)
+	tests := []struct {
+		From, Name, Host string
+		Valid            bool
+	}{
+		{"template", "customer", "customer.example.com", true},
+		{"missing", "customer", "customer.example.com", false},
+		{"template", "template", "customer.example.com", false},
+		{"template", "stale", "customer.example.com", false},
+		{"template", "../customer", "customer.example.com", false},
+		{"template", "customer", "", false},
+		{"template", "customer", "www.template.example.com", false}}
+	for i, v := range tests {
+		opts := newSiteOptions{From: v.From, Name: v.Name}
+		if len(v.Host) > 0 {
+			opts.Hosts = []string{v.Host}
+		}
+		if err := checkNewSite(settings, opts); (err == nil) != v.Valid {
+			t.Errorf("Test %v: checkNewSite(%+v) returned %v", i, opts, err)
+		}
+	}
+	if err := createSite(ioutil.Discard, nil, settings, newSiteOptions{
+		From: "template", Name: "stale",
+		Hosts: []string{"customer.example.com"}}); err == nil {
+		t.Errorf("createSite(...) used an existing directory")
+	}
+}
+
+func TestPromptAdmin(t *testing.T) {
+	file, err := ioutil.TempFile("", "TestPromptAdmin")
+	if err != nil {
+		t.Fatalf("Could not create temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	fmt.Fprint(file, "bob\nbob@example.com\nfoo\n")
+	file.Seek(0, 0)
+	var out bytes.Buffer
+	// Files which aren't terminals are read like any other reader.
+	admin, err := promptAdmin(&out, file, 4)
+	if err != nil {
+		t.Fatalf("promptAdmin(...) returned error: %v", err)
+	}
+	if admin.Login != "bob" || admin.Email != "bob@example.com" ||
+		len(admin.Password) == 0 || admin.Password == "foo" {
+		t.Errorf("promptAdmin(...) = %+v", admin)
+	}
+	if _, err := promptAdmin(&out, strings.NewReader("bob\n"), 4); err == nil {
+		t.Errorf("promptAdmin(...) should fail on missing answers")
+	}
+}
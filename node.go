@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gorilla/sessions"
 	"github.com/monsti/form"
@@ -15,67 +16,22 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-// getFooter retrieves the footer.
-//
-// root is the path to the data directory
-//
-// Returns an empty string if there is no footer.
-func getFooter(root string) string {
-	path := filepath.Join(root, "footer.html")
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		return ""
-	}
-	return string(content)
-}
-
-// getBelowHeader retrieves the below header content for the given node.
-//
-// path is the node's path.
-// root is the path to the data directory.
-//
-// Returns an empty string if there is no below header content.
-func getBelowHeader(path, root string) string {
-	file := filepath.Join(root, path, "below_header.html")
-	content, err := ioutil.ReadFile(file)
-	if err != nil {
-		return ""
-	}
-	return string(content)
-}
-
-// getSidebar retrieves the sidebar content for the given node.
-//
-// path is the node's path.
-// root is the path to the data directory.
-//
-// It traverses up to the root until it finds a node with defined sidebar
-// content.
-//
-// Returns an empty string if there is no sidebar content.
-func getSidebar(path, root string) string {
-	for {
-		file := filepath.Join(root, path, "sidebar.html")
-		content, err := ioutil.ReadFile(file)
-		if err != nil {
-			if path == filepath.Dir(path) {
-				break
-			}
-			path = filepath.Dir(path)
-			continue
-		}
-		return string(content)
-	}
-	return ""
-}
-
 // navLink represents a link in the navigation.
 type navLink struct {
 	Name, Target  string
 	Active, Child bool
 	Order         int
+	// Locale is the locale of the translated Name. Empty if the name is
+	// not translated.
+	Locale string
+	// Fields are the custom fields of the linked node. Only loaded if the
+	// theme asks for them, see themeManifest.
+	Fields nodeFields
 }
 
 type navigation []navLink
@@ -97,6 +53,85 @@ func (n *navigation) Swap(i, j int) {
 	(*n)[i], (*n)[j] = (*n)[j], (*n)[i]
 }
 
+// Orders of the navigation links of a node's children.
+const (
+	// navOrderManual sorts by the nodes' Order attributes.
+	navOrderManual = "manual"
+	// navOrderAlphabetical sorts case-insensitively by the links' names.
+	navOrderAlphabetical = "alphabetical"
+	// navOrderCreatedDesc sorts the newest nodes first.
+	navOrderCreatedDesc = "created-desc"
+	// navOrderCreatedAsc sorts the oldest nodes first.
+	navOrderCreatedAsc = "created-asc"
+)
+
+// navByFunc sorts a navigation using the given function.
+type navByFunc struct {
+	*navigation
+	less func(a, b navLink) bool
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (n navByFunc) Less(i, j int) bool {
+	return n.less((*n.navigation)[i], (*n.navigation)[j])
+}
+
+// readStoredNodeFile reads the node.yaml file of the node at the given path
+// of the data directory located at root, using its cache if enabled.
+func readStoredNodeFile(root, nodePath string) (*storedNode, error) {
+	content, err := getNodeFile(root, nodePath, "node.yaml")
+	if err != nil {
+		return nil, err
+	}
+	node := new(storedNode)
+	if err := goyaml.Unmarshal(content, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// sortNav sorts the links of the children of the node at the given path of
+// the data directory located at root according to the node's NavOrder.
+//
+// The links' targets are relative to the given directory.
+func sortNav(links navigation, root, nodePath, dir string) {
+	order := navOrderManual
+	if stored, err := readStoredNodeFile(root, nodePath); err == nil &&
+		len(stored.NavOrder) > 0 {
+		order = stored.NavOrder
+	}
+	created := func(link navLink) time.Time {
+		stored, err := readStoredNodeFile(root, path.Join(dir, link.Target))
+		if err != nil {
+			return time.Time{}
+		}
+		ret, _ := time.Parse(nodeTimeFormat, stored.Created)
+		return ret
+	}
+	var less func(a, b navLink) bool
+	switch order {
+	case navOrderAlphabetical:
+		less = func(a, b navLink) bool {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+	case navOrderCreatedDesc:
+		less = func(a, b navLink) bool {
+			return created(a).After(created(b))
+		}
+	case navOrderCreatedAsc:
+		less = func(a, b navLink) bool {
+			return created(a).Before(created(b))
+		}
+	default:
+		sort.Sort(&links)
+		return
+	}
+	// Sort by name first to break ties.
+	sort.Sort(&links)
+	sort.Stable(navByFunc{&links, less})
+}
+
 // getShortTitle returns the given node's ShortTitle attribute, or, if the
 // ShortTitle is of zero length, its Title attribute.
 func getShortTitle(node client.Node) string {
@@ -111,67 +146,83 @@ func getShortTitle(node client.Node) string {
 // nodePath is the absolute path of the node for which to get the navigation.
 // active is the absolute path to the currently active node.
 // root is the path of the data directory.
-func getNav(nodePath, active string, root string) (navLinks navigation,
-	err error) {
+// access is used to omit nodes the user might not view. May be nil.
+func getNav(nodePath, active string, root string,
+	access *nodeAccess, locale string) (navigation, error) {
+	navLinks, _, err := findNav(nodePath, active, root, access, locale)
+	return navLinks, err
+}
+
+// findNav returns the navigation for the given node like getNav and the path
+// of the node the navigation has been built for, i.e. the nearest ancestor
+// with visible children. The path is empty if there is no navigation.
+func findNav(nodePath, active string, root string, access *nodeAccess,
+	locale string) (navLinks navigation, navRoot string, err error) {
 	// Search children
-	children, err := ioutil.ReadDir(filepath.Join(root, nodePath))
+	children, err := getChildren(root, nodePath)
 	if err != nil {
-		return nil, fmt.Errorf("Could not read node directory: %v", err)
+		return nil, "", err
 	}
 	anyChild := false
 	childrenNavLinks := navLinks[:]
 	for _, child := range children {
-		if !child.IsDir() {
+		if strings.HasPrefix(child, ".") {
 			continue
 		}
-		node, err := lookupNode(root, path.Join(nodePath,
-			child.Name()))
-		if err != nil || node.Hide {
+		node, err := lookupNode(root, path.Join(nodePath, child))
+		if err != nil || node.Hide || !access.CanView(node.Path) {
 			continue
 		}
 		anyChild = true
+		node, translation := translateNode(root, node, locale)
 		childrenNavLinks = append(childrenNavLinks, navLink{
 			Name:   getShortTitle(node),
-			Target: child.Name(), Child: true, Order: node.Order})
+			Target: child, Child: true, Order: node.Order,
+			Locale: translation})
 	}
 	if !anyChild {
 		if nodePath == "/" || path.Dir(nodePath) == "/" {
-			return nil, nil
+			return nil, "", nil
 		}
-		return getNav(path.Dir(nodePath), active, root)
+		return findNav(path.Dir(nodePath), active, root, access, locale)
 	}
-	sort.Sort(&childrenNavLinks)
+	sortNav(childrenNavLinks, root, nodePath, nodePath)
 	siblingsNavLinks := navLinks[:]
 	// Search siblings
 	if nodePath != "/" && path.Dir(nodePath) == "/" {
 		node, err := lookupNode(root, nodePath)
 		if err != nil {
-			return nil, fmt.Errorf("Could not find node: %v", err)
+			return nil, "", fmt.Errorf("Could not find node: %v", err)
 		}
+		node, translation := translateNode(root, node, locale)
 		siblingsNavLinks = append(siblingsNavLinks, navLink{
 			Name:   getShortTitle(node),
-			Target: path.Join("..", path.Base(nodePath)), Order: node.Order})
+			Target: path.Join("..", path.Base(nodePath)), Order: node.Order,
+			Locale: translation})
 	} else if nodePath != "/" {
 		parent := path.Dir(nodePath)
-		siblings, err := ioutil.ReadDir(filepath.Join(root, parent))
+		siblings, err := getChildren(root, parent)
 		if err != nil {
-			return nil, fmt.Errorf("Could not read node directory: %v", err)
+			return nil, "", err
 		}
 		for _, sibling := range siblings {
-			if !sibling.IsDir() {
+			if strings.HasPrefix(sibling, ".") {
 				continue
 			}
-			node, err := lookupNode(root, path.Join(parent,
-				sibling.Name()))
-			if err != nil || node.Hide {
+			node, err := lookupNode(root, path.Join(parent, sibling))
+			if err != nil || node.Hide || !access.CanView(node.Path) {
 				continue
 			}
+			node, translation := translateNode(root, node, locale)
 			siblingsNavLinks = append(siblingsNavLinks, navLink{
 				Name:   getShortTitle(node),
-				Target: path.Join("..", sibling.Name()), Order: node.Order})
+				Target: path.Join("..", sibling), Order: node.Order,
+				Locale: translation})
 		}
 	}
-	sort.Sort(&siblingsNavLinks)
+	if nodePath != "/" {
+		sortNav(siblingsNavLinks, root, path.Dir(nodePath), nodePath)
+	}
 	// Insert children at their parent
 	for i, link := range siblingsNavLinks {
 		if link.Target == path.Join("..", path.Base(nodePath)) {
@@ -196,6 +247,7 @@ func getNav(nodePath, active string, root string) (navLinks navigation,
 			navLinks[i].Active = true
 		}
 	}
+	navRoot = nodePath
 	return
 }
 
@@ -212,6 +264,8 @@ func (nav *navigation) MakeAbsolute(root string) {
 
 type addFormData struct {
 	Type, Name, Title string
+	CSRFToken         string
+	FormToken         string
 }
 
 // Add handles add requests.
@@ -221,51 +275,188 @@ func (h *nodeHandler) Add(w http.ResponseWriter, r *http.Request,
 	G := l10n.UseCatalog(cSession.Locale)
 	data := addFormData{}
 	nodeTypeOptions := []form.Option{}
-	for _, nodeType := range h.Settings.NodeTypes {
+	nodeTypeInfos := []nodeTypeSettings{}
+	nodeTypes := h.NodeTypes()
+	for _, id := range h.currentSettings().addableTypes(node.Type, nodeTypes) {
+		nodeType := h.currentSettings().nodeType(id)
+		nodeType.Name = G(nodeType.Name)
+		if len(nodeType.Description) > 0 {
+			nodeType.Description = G(nodeType.Description)
+		}
 		nodeTypeOptions = append(nodeTypeOptions,
-			form.Option{nodeType, nodeType})
+			form.Option{id, nodeType.Name})
+		nodeTypeInfos = append(nodeTypeInfos, nodeType)
 	}
 	selectWidget := form.SelectWidget{nodeTypeOptions}
 	form := form.NewForm(&data, form.Fields{
 		"Type": form.Field{G("Content type"), "", form.Required(G("Required.")), selectWidget},
 		"Name": form.Field{G("Name"),
 			G("The name as it should appear in the URL."),
-			form.And(form.Required(G("Required.")), form.Regex(`^[-\w]*$`,
-				G("Contains	invalid characters."))), nil},
-		"Title": form.Field{G("Title"), "", form.Required(G("Required.")), nil}})
+			form.Required(G("Required.")), nil},
+		"Title":     form.Field{G("Title"), "", form.Required(G("Required.")), nil},
+		"CSRFToken": csrfField(),
+		"FormToken": formTokenField()})
 	switch r.Method {
 	case "GET":
 	case "POST":
 		r.ParseForm()
 		if form.Fill(r.Form) {
-			data.Name = strings.ToLower(data.Name)
-			if !inStringSlice(data.Type, h.Settings.NodeTypes) {
-				panic("Can't add this content type.")
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			// Replayed submissions, e.g. after clicking twice, get redirected
+			// to the node added by the first one.
+			formStatus, target, finish := claimFormToken(session,
+				data.FormToken)
+			if formStatus == formTokenReplayed {
+				http.Redirect(w, r, target, http.StatusSeeOther)
+				return
+			}
+			if formStatus == formTokenInvalid {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			defer func() { finish(target) }()
+			if site.ReadOnly {
+				form.AddError("", G("The site is read-only."))
+				break
+			}
+			data.Name = normalizeName(strings.ToLower(data.Name), site.NodeNames)
+			if !validNodeName(data.Name, site.NodeNames) {
+				form.AddError("Name", G("Contains invalid characters."))
+				break
+			}
+			if err := h.currentSettings().checkChildType(node.Type, data.Type,
+				nodeTypes); err != nil {
+				panic("Can't add this content type: " + err.Error())
 			}
 			newPath := filepath.Join(node.Path, data.Name)
 			newNode := client.Node{
 				Path:  newPath,
 				Type:  data.Type,
 				Title: data.Title}
-			if err := writeNode(newNode, site.Directories.Data); err != nil {
-				panic("Can't add node: " + err.Error())
+			err := addNode(newNode, sessionLogin(cSession),
+				site.Directories.Data)
+			if err == errNodeExists {
+				form.AddError("Name", G("A node with this name already exists."))
+				break
 			}
-			http.Redirect(w, r, newPath+"/@@edit", http.StatusSeeOther)
+			if err != nil {
+				h.requestLog(r, site.Name).Error("Could not add node %q: %v",
+					newPath, err)
+				form.AddError("", G("The node could not be added."))
+				break
+			}
+			auditChange(site, sessionLogin(cSession), auditAdd, newPath, "",
+				h.requestLog(r, site.Name).Warn)
+			fireWebhooks(site, eventNodeWritten, newPath, sessionLogin(cSession),
+				h.requestLog(r, site.Name).Warn)
+			target = site.URL(newPath + "/@@edit")
+			if len(data.FormToken) > 0 {
+				revokeFormToken(session, data.FormToken)
+				if err := session.Save(r, w); err != nil {
+					panic(err.Error())
+				}
+			}
+			http.Redirect(w, r, target, http.StatusSeeOther)
 			return
 		}
 	default:
 		panic("Request method not supported: " + r.Method)
 	}
-	body := h.Renderer.Render("daemon/actions/addform", template.Context{
-		"Form": form.RenderData()}, cSession.Locale, site.Directories.Templates)
+	data.CSRFToken = getCSRFToken(session)
+	data.FormToken = getFormToken(session, data.FormToken)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/addform", template.Context{
+		"Form":      form.RenderData(),
+		"NodeTypes": nodeTypeInfos}, cSession.Locale, site)
 	env := masterTmplEnv{Node: node, Session: cSession,
-		Flags: EDIT_VIEW, Title: G("Add content")}
-	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
-		site, cSession.Locale))
+		Flags: EDIT_VIEW, Title: G("Add content"),
+		Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
 }
 
 type removeFormData struct {
-	Confirm int
+	Confirm     int
+	ConfirmName string
+	CSRFToken   string
+	FormToken   string
+}
+
+// maxListedDescendants is the maximum number of descendants listed on the
+// remove form.
+const maxListedDescendants = 20
+
+// confirmNameDescendants is the number of descendants above which the
+// node's name has to be typed to confirm its removal.
+const confirmNameDescendants = 10
+
+// subtree summarizes the content below a node.
+type subtree struct {
+	// Nodes are the paths of the first descendant nodes.
+	Nodes []string
+	// NodeCount is the number of descendant nodes.
+	NodeCount int
+	// FileCount is the number of files of the node and its descendants,
+	// not counting node.yaml files.
+	FileCount int
+}
+
+// Truncated returns true iff not all descendant nodes are listed.
+func (s subtree) Truncated() bool {
+	return s.NodeCount > len(s.Nodes)
+}
+
+// summarizeSubtree summarizes the content below the node at the given path
+// of the data directory located at root.
+//
+// At most limit descendant paths will be listed. Hidden files and
+// directories, e.g. revisions, are ignored.
+func summarizeSubtree(root, nodePath string, limit int) (subtree, error) {
+	var summary subtree
+	dir, err := nodeFile(root, nodePath, "")
+	if err != nil {
+		return summary, err
+	}
+	err = filepath.Walk(dir, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && file != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			if info.Name() != "node.yaml" {
+				summary.FileCount++
+			}
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(file, "node.yaml")); file == dir ||
+			err != nil {
+			return nil
+		}
+		summary.NodeCount++
+		if len(summary.Nodes) < limit {
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			summary.Nodes = append(summary.Nodes, "/"+filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, fmt.Errorf("Could not walk node directory: %v", err)
+	}
+	return summary, nil
 }
 
 // Remove handles remove requests.
@@ -273,36 +464,116 @@ func (h *nodeHandler) Remove(w http.ResponseWriter, r *http.Request,
 	node client.Node, session *sessions.Session, cSession *client.Session,
 	site site) {
 	G := l10n.UseCatalog(cSession.Locale)
+	if nodeProtected(node.Path, site.ProtectedPaths) {
+		h.renderError(w, r, G("This node is protected and can't be removed."),
+			http.StatusForbidden, node, cSession, site)
+		return
+	}
+	summary, err := summarizeSubtree(site.Directories.Data, node.Path,
+		maxListedDescendants)
+	if err != nil {
+		panic("Can't summarize subtree: " + err.Error())
+	}
+	confirmName := summary.NodeCount > confirmNameDescendants
 	data := removeFormData{}
-	form := form.NewForm(&data, form.Fields{
+	fields := form.Fields{
 		"Confirm": form.Field{G("Confirm"), "", form.Required(G("Required.")),
-			new(form.HiddenWidget)}})
+			new(form.HiddenWidget)},
+		"CSRFToken": csrfField(),
+		"FormToken": formTokenField()}
+	if confirmName {
+		fields["ConfirmName"] = form.Field{G("Name"), "", nil, nil}
+	}
+	form := form.NewForm(&data, fields)
+	var formError string
 	switch r.Method {
 	case "GET":
 	case "POST":
 		r.ParseForm()
 		if form.Fill(r.Form) {
-			removeNode(node.Path, site.Directories.Data)
-			http.Redirect(w, r, path.Dir(node.Path), http.StatusSeeOther)
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			formStatus, target, finish := claimFormToken(session,
+				data.FormToken)
+			if formStatus == formTokenReplayed {
+				http.Redirect(w, r, target, http.StatusSeeOther)
+				return
+			}
+			if formStatus == formTokenInvalid {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			defer func() { finish(target) }()
+			if site.ReadOnly {
+				form.AddError("", G("The site is read-only."))
+				break
+			}
+			if confirmName && data.ConfirmName != path.Base(node.Path) {
+				formError = G("Please type the name of the node to confirm.")
+				break
+			}
+			if err := removeNode(node.Path, sessionLogin(cSession),
+				site.Directories.Data, site.ProtectedPaths); err != nil {
+				h.requestLog(r, site.Name).Error("Could not remove node %q: %v",
+					node.Path, err)
+				form.AddError("", G("The node could not be removed."))
+				break
+			}
+			auditChange(site, sessionLogin(cSession), auditRemove, node.Path, "",
+				h.requestLog(r, site.Name).Warn)
+			fireWebhooks(site, eventNodeRemoved, node.Path, sessionLogin(cSession),
+				h.requestLog(r, site.Name).Warn)
+			target = site.URL(path.Dir(node.Path))
+			if len(data.FormToken) > 0 {
+				revokeFormToken(session, data.FormToken)
+				if err := session.Save(r, w); err != nil {
+					panic(err.Error())
+				}
+			}
+			http.Redirect(w, r, target, http.StatusSeeOther)
 			return
 		}
 	default:
 		panic("Request method not supported: " + r.Method)
 	}
 	data.Confirm = 1489
-	body := h.Renderer.Render("daemon/actions/removeform", template.Context{
-		"Form": form.RenderData(), "Node": node},
-		cSession.Locale, site.Directories.Templates)
+	data.CSRFToken = getCSRFToken(session)
+	data.FormToken = getFormToken(session, data.FormToken)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	data.ConfirmName = ""
+	body := h.renderTemplate("daemon/actions/removeform", template.Context{
+		"Form": form.RenderData(), "Node": node, "NodeURL": site.URL(node.Path),
+		"Name": path.Base(node.Path), "Subtree": summary,
+		"ConfirmName": confirmName, "Error": formError}, cSession.Locale, site)
 	env := masterTmplEnv{Node: node, Session: cSession,
-		Flags: EDIT_VIEW, Title: fmt.Sprintf(G("Remove \"%v\""), node.Title)}
-	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
-		site, cSession.Locale))
+		Flags: EDIT_VIEW, Title: fmt.Sprintf(G("Remove \"%v\""), node.Title),
+		Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
 }
 
 // lookupNode look ups a node at the given path.
 // If no such node exists, return nil.
+//
+// The data directory's cache will be used if enabled.
 func lookupNode(root, path string) (client.Node, error) {
-	node_path := filepath.Join(root, path[1:], "node.yaml")
+	if c := getDataCache(root); c != nil {
+		return c.Node(path)
+	}
+	return readNode(root, path)
+}
+
+// readNode reads the node at the given path from the data directory located
+// at root.
+func readNode(root, path string) (client.Node, error) {
+	node_path, err := nodeFile(root, path, "node.yaml")
+	if err != nil {
+		return client.Node{}, err
+	}
 	content, err := ioutil.ReadFile(node_path)
 	if err != nil {
 		return client.Node{}, err
@@ -315,30 +586,297 @@ func lookupNode(root, path string) (client.Node, error) {
 	return node, nil
 }
 
+// nodeTimeFormat is the format of the timestamps in node.yaml files.
+const nodeTimeFormat = time.RFC822
+
+// storedNode is a node as stored in its node.yaml file.
+type storedNode struct {
+	client.Node `yaml:",inline"`
+	// Created is the time the node has been created.
+	Created string `yaml:",omitempty"`
+	// CreatedBy is the login of the user who created the node.
+	CreatedBy string `yaml:",omitempty"`
+	// LastUpdate is the time of the last change of the node.
+	LastUpdate string `yaml:",omitempty"`
+	// LastUpdateBy is the login of the user who changed the node last.
+	LastUpdateBy string `yaml:",omitempty"`
+	// Feed holds the settings of the feed of the node's children.
+	Feed *feedSettings `yaml:",omitempty"`
+	// NavOrder is the order of the node's children in the navigation:
+	// manual (the default), alphabetical, created-desc or created-asc.
+	NavOrder string `yaml:",omitempty"`
+	// Fields are the custom keys of the node.yaml file, which will be
+	// preserved when writing the node.
+	Fields nodeFields `yaml:"-"`
+}
+
+// readStoredNode reads the node.yaml file of the node at the given path of the
+// data directory located at the given root.
+func readStoredNode(root, nodePath string) (*storedNode, error) {
+	file, err := nodeFile(root, nodePath, "node.yaml")
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	node := new(storedNode)
+	if err := goyaml.Unmarshal(content, node); err != nil {
+		return nil, err
+	}
+	node.Path = nodePath
+	node.Fields, _ = parseNodeFields(content)
+	return node, nil
+}
+
+// walkNodes calls the given function for each node of the data directory
+// located at the given root.
+//
+// The function gets the node's path and the info of its node.yaml file.
+// Hidden directories, i.e. those starting with a dot, will be skipped.
+func walkNodes(root string, fun func(nodePath string,
+	info os.FileInfo) error) error {
+	err := filepath.Walk(root, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && file != root {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.Name() != "node.yaml" {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		return fun(path.Clean("/"+filepath.ToSlash(rel)), info)
+	})
+	if err != nil {
+		return fmt.Errorf("Could not walk data directory: %v", err)
+	}
+	return nil
+}
+
+// errNodeExists is returned by addNode if the node exists already.
+var errNodeExists = errors.New("Node exists already")
+
+// Functions to write node.yaml files and to remove node directories. Tests
+// replace them to simulate failures.
+var (
+	writeNodeFile = writeContentFile
+	removeNodeDir = os.RemoveAll
+)
+
+// addNode writes the given new node to the data directory located at the
+// given root.
+//
+// Returns errNodeExists if there is a node at the path already. If the
+// node can't be written, the directory created for it will be removed.
+func addNode(node client.Node, login, root string) error {
+	dir, err := nodeFile(root, node.Path, "")
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "node.yaml")); err == nil {
+		return errNodeExists
+	}
+	_, err = os.Stat(dir)
+	created := os.IsNotExist(err)
+	if err := writeNode(node, login, root); err != nil {
+		if created {
+			os.RemoveAll(dir)
+			invalidateCache(root, node.Path)
+		}
+		return err
+	}
+	return nil
+}
+
 // writeNode writes the given node to the data directory located at the given
 // root.
-func writeNode(node client.Node, root string) error {
-	path := node.Path
-	node.Path = ""
-	content, err := goyaml.Marshal(&node)
+//
+// The node's creation stamps will be set if the node is new and its update
+// stamps will be set to the current time and the given user's login. Keys
+// of the node's node.yaml file it doesn't manage, like restrict, will be
+// preserved.
+func writeNode(node client.Node, login, root string) error {
+	node_path, err := nodeFile(root, node.Path, "node.yaml")
 	if err != nil {
 		return err
 	}
-	node_path := filepath.Join(root, path[1:],
-		"node.yaml")
-	if err := os.Mkdir(filepath.Dir(node_path), 0700); err != nil {
-		if !os.IsExist(err) {
-			panic("Can't create directory for new node: " + err.Error())
+	var stored storedNode
+	if content, err := ioutil.ReadFile(node_path); err == nil {
+		goyaml.Unmarshal(content, &stored)
+		stored.Fields, _ = parseNodeFields(content)
+	}
+	stored.Node = node
+	stored.Path = ""
+	now := time.Now().Format(nodeTimeFormat)
+	if len(stored.Created) == 0 {
+		stored.Created, stored.CreatedBy = now, login
+	}
+	stored.LastUpdate, stored.LastUpdateBy = now, login
+	content, err := marshalStoredNode(&stored)
+	if err != nil {
+		return err
+	}
+	dirMode := getContentModes().DirMode()
+	if err := os.Mkdir(filepath.Dir(node_path), dirMode); err == nil {
+		// Mkdir is subject to the process' umask.
+		if err := os.Chmod(filepath.Dir(node_path), dirMode); err != nil {
+			return err
+		}
+	} else if !os.IsExist(err) {
+		return fmt.Errorf("Could not create directory of node: %v", err)
+	}
+	if err := writeNodeFile(node_path, content); err != nil {
+		return err
+	}
+	invalidateCache(root, node.Path)
+	recordChange(root, nodeChange(root, node.Path, login))
+	indexNode(root, node.Path)
+	return nil
+}
+
+// defaultPlaceholderType is the node type of placeholder nodes if the site's
+// settings don't specify another one.
+const defaultPlaceholderType = "Document"
+
+// placeholderType returns the node type of placeholder nodes.
+func (s site) placeholderType() string {
+	if len(s.PlaceholderType) > 0 {
+		return s.PlaceholderType
+	}
+	return defaultPlaceholderType
+}
+
+// placeholderTitle returns the title of a placeholder node with the given
+// name, e.g. "About us" for about-us.
+func placeholderTitle(name string) string {
+	title := strings.TrimSpace(strings.NewReplacer("-", " ", "_", " ").Replace(
+		name))
+	if len(title) == 0 {
+		return name
+	}
+	first, size := utf8.DecodeRuneInString(title)
+	return string(unicode.ToUpper(first)) + title[size:]
+}
+
+// createParentNodes creates placeholder nodes of the given type for the
+// missing ancestors of the node at the given path of the data directory
+// located at root.
+//
+// Placeholders get titles derived from their names, see placeholderTitle.
+// Returns the paths of the created nodes, starting with the topmost one.
+func createParentNodes(root, nodePath, nodeType, login string) ([]string,
+	error) {
+	var created []string
+	parent := "/"
+	for _, name := range strings.Split(strings.Trim(path.Clean(nodePath), "/"),
+		"/") {
+		if len(name) == 0 || path.Join(parent, name) == path.Clean(nodePath) {
+			break
+		}
+		parent = path.Join(parent, name)
+		if _, err := lookupNode(root, parent); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return created, err
+		}
+		if err := writeNode(client.Node{Path: parent, Type: nodeType,
+			Title: placeholderTitle(name)}, login, root); err != nil {
+			return created, fmt.Errorf("Could not create node %q: %v", parent, err)
+		}
+		created = append(created, parent)
+	}
+	return created, nil
+}
+
+// touchNode sets the update stamps of the node at the given path of the data
+// directory located at the given root to the given time and user's login.
+func touchNode(root, nodePath, login string, now time.Time) error {
+	stored, err := readStoredNode(root, nodePath)
+	if err != nil {
+		return err
+	}
+	file, err := nodeFile(root, nodePath, "node.yaml")
+	if err != nil {
+		return err
+	}
+	stored.Path = ""
+	stored.LastUpdate = now.Format(nodeTimeFormat)
+	stored.LastUpdateBy = login
+	content, err := marshalStoredNode(stored)
+	if err != nil {
+		return err
+	}
+	if err := writeContentFile(file, content); err != nil {
+		return err
+	}
+	invalidateCache(root, nodePath)
+	return nil
+}
+
+// errNodeProtected is returned by removeNode if the node is protected, see
+// nodeProtected.
+var errNodeProtected = errors.New("The node is protected")
+
+// nodeProtected returns true if the node at the given path must not be
+// removed or moved away.
+//
+// Protected are the root node, hidden housekeeping directories like
+// .monsti, the given protected paths and their subtrees as well as the
+// ancestors of protected paths.
+func nodeProtected(nodePath string, protected []string) bool {
+	nodePath = path.Clean("/" + nodePath)
+	if nodePath == "/" {
+		return true
+	}
+	for _, segment := range strings.Split(nodePath[1:], "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	for _, protectedPath := range protected {
+		protectedPath = path.Clean("/" + protectedPath)
+		if nodePath == protectedPath ||
+			strings.HasPrefix(nodePath, protectedPath+"/") ||
+			strings.HasPrefix(protectedPath, nodePath+"/") {
+			return true
 		}
 	}
-	return ioutil.WriteFile(node_path, content, 0600)
+	return false
 }
 
-// removeNode recursively removes the given node from the data directory located
-// at the given root and from the navigation of the parent node.
-func removeNode(path, root string) {
-	nodePath := filepath.Join(root, path[1:])
-	if err := os.RemoveAll(nodePath); err != nil {
-		panic("Can't remove node: " + err.Error())
+// removeNode recursively removes the node at the given path from the data
+// directory located at the given root.
+//
+// Returns errNodeProtected if the node is protected given the site's
+// protected paths, see nodeProtected. The removal will be recorded as a
+// change made by the given user, but only if the node's directory has been
+// removed completely.
+func removeNode(path, login, root string, protected []string) error {
+	if nodeProtected(path, protected) {
+		return errNodeProtected
+	}
+	nodePath, err := nodeFile(root, path, "")
+	if err != nil {
+		return err
+	}
+	change := nodeChange(root, path, login)
+	unlock := lockWrites(nodePath)
+	err = removeNodeDir(nodePath)
+	unlock()
+	// Parts of the node might have been removed even on failure.
+	invalidateCache(root, path)
+	if err != nil {
+		return fmt.Errorf("Could not remove node directory: %v", err)
 	}
+	change.Removed = true
+	recordChange(root, change)
+	unindexNode(root, path)
+	return nil
 }
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
 	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetNav(t *testing.T) {
@@ -62,7 +73,7 @@ func TestGetNav(t *testing.T) {
 			{Name: "Cruz", Target: ".", Active: true, Order: -2},
 			{Name: "Cruz Child 1", Target: "child1", Child: true}}}}
 	for _, test := range tests {
-		ret, err := getNav(test.Path, test.Active, root)
+		ret, err := getNav(test.Path, test.Active, root, nil, "")
 		if err != nil || !(len(ret) == 0 && len(test.Expected) == 0 || reflect.DeepEqual(ret, test.Expected)) {
 			t.Errorf(`getNav(%q, %q, _) = %v, %v, should be %v, nil`,
 				test.Path, test.Active, ret, err, test.Expected)
@@ -70,6 +81,37 @@ func TestGetNav(t *testing.T) {
 	}
 }
 
+func TestGetNavRestricted(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":         "title: Foo",
+		"/members/node.yaml":     "title: Members\nrestrict: login",
+		"/members/sub/node.yaml": "title: Sub",
+		"/staff/node.yaml":       "title: Staff\nrestrict: editor"},
+		"TestGetNavRestricted")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Roles    []string
+		Expected []string
+	}{
+		{nil, []string{"Foo"}},
+		{[]string{"reader"}, []string{"Foo", "Members"}},
+		{[]string{"reader", "editor"}, []string{"Foo", "Members", "Staff"}}}
+	for _, test := range tests {
+		ret, err := getNav("/", "/", root, newNodeAccess(root, test.Roles), "")
+		names := make([]string, 0)
+		for _, link := range ret {
+			names = append(names, link.Name)
+		}
+		if err != nil || !reflect.DeepEqual(names, test.Expected) {
+			t.Errorf(`getNav("/", "/", _, %v) returned %v, %v, should be %v`,
+				test.Roles, names, err, test.Expected)
+		}
+	}
+}
+
 func TestNavigationMakeAbsolute(t *testing.T) {
 	nav := navigation{
 		{Target: "foo"},
@@ -99,9 +141,300 @@ func TestRemoveNode(t *testing.T) {
 		t.Fatalf("Could not create directory tree: ", err)
 	}
 	defer cleanup()
-	removeNode("/foo", root)
+	if err := removeNode("/foo", "admin", root, nil); err != nil {
+		t.Errorf("Could not remove node: %v", err)
+	}
 	if f, err := os.Open(filepath.Join(root, "foo")); !os.IsNotExist(err) {
 		f.Close()
 		t.Errorf(`/foo does still exist, should be removed`)
 	}
+	if err := removeNode("/", "admin", root, nil); err != errNodeProtected {
+		t.Errorf("The root node should not be removed: %v", err)
+	}
+	if err := removeNode("/bar", "admin", root,
+		[]string{"/bar/"}); err != errNodeProtected {
+		t.Errorf("The protected node should not be removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bar")); err != nil {
+		t.Errorf("/bar should still exist: %v", err)
+	}
+}
+
+func TestNodeProtected(t *testing.T) {
+	protected := []string{"/about/", "/news/archive"}
+	tests := []struct {
+		Path      string
+		Protected bool
+	}{
+		{"/", true},
+		{"", true},
+		{"/.monsti", true},
+		{"/.trash/foo", true},
+		{"/about", true},
+		{"/about/team", true},
+		{"/news", true},
+		{"/news/archive/2014", true},
+		{"/news/latest", false},
+		{"/aboutus", false},
+		{"/foo", false}}
+	for i, v := range tests {
+		if ret := nodeProtected(v.Path, protected); ret != v.Protected {
+			t.Errorf("Test %v: nodeProtected(%q, ...) = %v, should be %v", i,
+				v.Path, ret, v.Protected)
+		}
+	}
+}
+
+func TestRemoveNodeFailure(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document"}`}, "TestRemoveNodeFailure")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	defer func() { removeNodeDir = os.RemoveAll }()
+	removeNodeDir = func(string) error { return errors.New("injected") }
+	if err := removeNode("/foo", "admin", root, nil); err == nil {
+		t.Errorf("removeNode should fail")
+	}
+	if _, err := lookupNode(root, "/foo"); err != nil {
+		t.Errorf("Node should still exist: %v", err)
+	}
+	changes, _ := loadRecentChanges(root)
+	for _, change := range changes {
+		if change.Removed {
+			t.Errorf("Failed removal should not be recorded, got %v", change)
+		}
+	}
+}
+
+func TestAddNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":     `{"type": "Document"}`,
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`,
+		"/bar/body.html": "body"}, "TestAddNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	defer func() { writeNodeFile = writeContentFile }()
+	tests := []struct {
+		Path   string
+		Fail   bool
+		Err    bool
+		Exists bool
+	}{
+		{"/new", false, false, true},
+		{"/foo", false, true, true},
+		{"/failed", true, true, false},
+		{"/bar", true, true, true}}
+	for _, v := range tests {
+		writeNodeFile = writeContentFile
+		if v.Fail {
+			writeNodeFile = func(string, []byte) error {
+				return errors.New("injected")
+			}
+		}
+		err := addNode(client.Node{Path: v.Path, Type: "Document",
+			Title: "New"}, "alice", root)
+		if (err != nil) != v.Err {
+			t.Errorf("addNode(%q) = %v, should fail: %v", v.Path, err, v.Err)
+		}
+		_, err = os.Stat(filepath.Join(root, v.Path[1:]))
+		if (err == nil) != v.Exists {
+			t.Errorf("Directory of %q should exist: %v, got %v", v.Path,
+				v.Exists, err)
+		}
+	}
+	if node, err := lookupNode(root, "/foo"); err != nil || node.Title != "Foo" {
+		t.Errorf("Existing node should be kept, got %v, %v", node, err)
+	}
+}
+
+func TestAddStampsNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": "title: Root\ntype: Document"}, "TestAddStampsNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{Name: "FooSite"}
+	site_.Directories.Data = root
+	h := nodeHandler{Settings: &settings{},
+		NodeQueues: map[string]chan worker.Ticket{"Document": nil}}
+	session := sessions.NewSession(nil, "monsti-session")
+	form := url.Values{
+		"Type":      {"Document"},
+		"Name":      {"foo"},
+		"Title":     {"Foo"},
+		"CSRFToken": {getCSRFToken(session)}}
+	r, _ := http.NewRequest("POST", "http://example.com/@@add",
+		strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	cSession := &client.Session{User: &client.User{Login: "editor"}}
+	before := time.Now().Add(-time.Minute)
+	h.Add(w, r, client.Node{Path: "/", Type: "Document"}, session, cSession,
+		site_)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Add responded with %v, should be %v", w.Code,
+			http.StatusSeeOther)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "foo", "node.yaml"))
+	if err != nil {
+		t.Fatalf("Could not read node.yaml of new node: %v", err)
+	}
+	var node storedNode
+	if err := goyaml.Unmarshal(content, &node); err != nil {
+		t.Fatalf("Could not unmarshal node.yaml: %v", err)
+	}
+	if node.CreatedBy != "editor" || node.LastUpdateBy != "editor" {
+		t.Errorf("CreatedBy and LastUpdateBy are %q and %q, should be %q",
+			node.CreatedBy, node.LastUpdateBy, "editor")
+	}
+	for name, stamp := range map[string]string{"Created": node.Created,
+		"LastUpdate": node.LastUpdate} {
+		if stampTime, err := time.Parse(time.RFC822, stamp); err != nil ||
+			stampTime.Before(before) {
+			t.Errorf("%v is %q, should be the current time in RFC822 format",
+				name, stamp)
+		}
+	}
+}
+
+func TestPlaceholderTitle(t *testing.T) {
+	tests := []struct {
+		Name, Title string
+	}{
+		{"about-us", "About us"},
+		{"news_2013", "News 2013"},
+		{"über", "Über"},
+		{"-", "-"}}
+	for _, v := range tests {
+		if ret := placeholderTitle(v.Name); ret != v.Title {
+			t.Errorf("placeholderTitle(%q) = %q, should be %q", v.Name, ret,
+				v.Title)
+		}
+	}
+}
+
+func TestCreateParentNodes(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":      `{"type": "Document"}`,
+		"/a/node.yaml":    `{"type": "Image", "title": "A"}`,
+		"/a/b/c/foo.html": "foo"}, "TestCreateParentNodes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path    string
+		Created []string
+	}{
+		{"/a/b/c/d-e/f", []string{"/a/b", "/a/b/c", "/a/b/c/d-e"}},
+		{"/a/b/c/d-e/f", nil},
+		{"/a/b", nil},
+		{"/g", nil}}
+	for _, v := range tests {
+		created, err := createParentNodes(root, v.Path, "Document", "alice")
+		if err != nil || !reflect.DeepEqual(created, v.Created) {
+			t.Errorf("createParentNodes(..., %q, ...) = %v, %v, should be %v",
+				v.Path, created, err, v.Created)
+		}
+	}
+	node, err := readStoredNode(root, "/a/b/c/d-e")
+	if err != nil || node.Type != "Document" || node.Title != "D e" ||
+		node.CreatedBy != "alice" {
+		t.Errorf("Placeholder should have been written, got %+v, %v", node, err)
+	}
+	if node, err := lookupNode(root, "/a"); err != nil || node.Type != "Image" {
+		t.Errorf("Existing node should be kept, got %v, %v", node, err)
+	}
+	if _, err := lookupNode(root, "/a/b/c/d-e/f"); err == nil {
+		t.Errorf("The node itself should not be created")
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(root, "a", "b", "c",
+		"foo.html")); err != nil || string(content) != "foo" {
+		t.Errorf("Existing files should be kept, got %q, %v", content, err)
+	}
+}
+
+func TestSummarizeSubtree(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":              `{"type": "Document"}`,
+		"/foo/body.html":              "body",
+		"/foo/.revisions/index.yaml":  "",
+		"/foo/a/node.yaml":            `{"type": "Document"}`,
+		"/foo/a/photo.jpg":            "",
+		"/foo/a/.upload-1":            "",
+		"/foo/a/b/node.yaml":          `{"type": "Document"}`,
+		"/foo/c/node.yaml":            `{"type": "Document"}`,
+		"/foo/.trash/d/node.yaml":     `{"type": "Document"}`,
+		"/leaf/node.yaml":             `{"type": "Document"}`,
+		"/leaf/.revisions/index.yaml": ""}, "TestSummarizeSubtree")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path    string
+		Limit   int
+		Summary subtree
+	}{
+		{"/foo", 20, subtree{[]string{"/foo/a", "/foo/a/b", "/foo/c"}, 3, 2}},
+		{"/foo", 1, subtree{[]string{"/foo/a"}, 3, 2}},
+		{"/leaf", 20, subtree{nil, 0, 0}}}
+	for _, v := range tests {
+		summary, err := summarizeSubtree(root, v.Path, v.Limit)
+		if err != nil || !reflect.DeepEqual(summary, v.Summary) {
+			t.Errorf("summarizeSubtree(..., %q, %v) = %+v, %v, should be %+v",
+				v.Path, v.Limit, summary, err, v.Summary)
+		}
+		if summary.Truncated() != (v.Limit == 1) {
+			t.Errorf("summarizeSubtree(..., %q, %v) should be truncated: %v",
+				v.Path, v.Limit, v.Limit == 1)
+		}
+	}
+}
+
+func TestSortNav(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/manual/node.yaml":      `{"type": "Document"}`,
+		"/alpha/node.yaml":       `{"type": "Document", "navorder": "alphabetical"}`,
+		"/desc/node.yaml":        `{"type": "Document", "navorder": "created-desc"}`,
+		"/asc/node.yaml":         `{"type": "Document", "navorder": "created-asc"}`,
+		"/children/b/node.yaml":  `{"created": "02 Jan 13 15:04 UTC"}`,
+		"/children/a/node.yaml":  `{"created": "03 Jan 13 15:04 UTC"}`,
+		"/children/c/node.yaml":  `{"created": "01 Jan 13 15:04 UTC"}`,
+		"/children/d/node.yaml":  `{}`,
+		"/children/node.yaml":    `{"type": "Document"}`,
+		"/alpha/child/node.yaml": `{"type": "Document"}`}, "TestSortNav")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path  string
+		Names []string
+	}{
+		{"/manual", []string{"C", "b", "A", "D"}},
+		{"/alpha", []string{"A", "b", "C", "D"}},
+		{"/desc", []string{"A", "b", "C", "D"}},
+		{"/asc", []string{"D", "C", "b", "A"}}}
+	for _, v := range tests {
+		links := navigation{
+			{Name: "A", Target: "../children/a", Order: 2},
+			{Name: "b", Target: "../children/b", Order: 1},
+			{Name: "C", Target: "../children/c"},
+			{Name: "D", Target: "../children/d", Order: 3}}
+		sortNav(links, root, v.Path, v.Path)
+		var names []string
+		for _, link := range links {
+			names = append(names, link.Name)
+		}
+		if !reflect.DeepEqual(names, v.Names) {
+			t.Errorf("sortNav(..., %q, ...) sorted %v, should be %v", v.Path,
+				names, v.Names)
+		}
+	}
 }
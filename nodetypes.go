@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/util"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// nodeTypeSettings describes a node type and holds its settings.
+type nodeTypeSettings struct {
+	// ID of the node type as used in node.yaml files and by workers.
+	ID string `yaml:"-"`
+	// Name is the display name of the node type. It will be translated if
+	// the locale's catalog contains a translation. Defaults to the ID.
+	Name string
+	// Description is a short description of the node type, translated like
+	// the name.
+	Description string
+	// Icon is the URL path to an icon of the node type.
+	Icon string
+	// Children lists the node types which may be added below nodes of this
+	// type. Any type may be added if empty.
+	Children []string
+	// NotAddable prevents adding nodes of this type via the web interface,
+	// e.g. for singleton types like the site root.
+	NotAddable bool
+	// Command is the path of the worker's executable. Defaults to
+	// monsti-<id> (lower case), looked up in PATH. Relative paths are
+	// relative to the configuration directory.
+	Command string
+	// Args are additional command line arguments of the worker, passed after
+	// the configuration directory.
+	Args []string
+	// Env holds additional environment variables of the worker.
+	Env map[string]string
+	// Dir is the working directory of the worker. Relative paths are
+	// relative to the configuration directory.
+	Dir string
+	// Timeout is the time in seconds the daemon waits for the worker's
+	// response to a request. No timeout if zero.
+	Timeout int
+	// Schedule is a cron expression like "*/15 * * * *" or "@daily". At the
+	// given times, the worker gets a ticket with the cron action and without
+	// HTTP request for each site. See scheduleTasks.
+	Schedule string
+	// CatchUp runs the scheduled task once at startup if a run has been
+	// missed while the daemon was down.
+	CatchUp bool
+}
+
+// loadNodeTypeSettings loads the settings of the given node types from the
+// files types/<id>.yaml in the given configuration directory.
+//
+// Settings of node types without such a file will be taken from the given
+// map, which holds the settings of monsti.yaml.
+func loadNodeTypeSettings(cfgPath string, nodeTypes []string,
+	configured map[string]nodeTypeSettings) (map[string]nodeTypeSettings,
+	error) {
+	ret := make(map[string]nodeTypeSettings, len(nodeTypes))
+	for _, id := range nodeTypes {
+		nodeType := configured[id]
+		path := filepath.Join(cfgPath, "types", id+".yaml")
+		if _, err := os.Stat(path); err == nil {
+			if err := util.ParseYAML(path, &nodeType); err != nil {
+				return nil, fmt.Errorf("Could not load settings of node type %q: %v",
+					id, err)
+			}
+		}
+		nodeType.ID = id
+		if len(nodeType.Schedule) > 0 {
+			if _, err := parseCronSpec(nodeType.Schedule); err != nil {
+				return nil, fmt.Errorf("Invalid schedule of node type %q: %v", id,
+					err)
+			}
+		}
+		if strings.Contains(nodeType.Command, "/") {
+			util.MakeAbsolute(&nodeType.Command, cfgPath)
+		}
+		if len(nodeType.Dir) > 0 {
+			util.MakeAbsolute(&nodeType.Dir, cfgPath)
+		}
+		if len(nodeType.Name) == 0 {
+			nodeType.Name = id
+		}
+		ret[id] = nodeType
+	}
+	return ret, nil
+}
+
+// nodeType returns the settings of the node type with the given ID.
+func (s *settings) nodeType(id string) nodeTypeSettings {
+	nodeType, ok := s.NodeTypeSettings[id]
+	if !ok {
+		nodeType = nodeTypeSettings{ID: id, Name: id}
+	}
+	return nodeType
+}
+
+// workerCommand returns the command to start the worker of the node type
+// with the given ID.
+//
+// Fails if the worker's executable or working directory can't be found.
+func (s *settings) workerCommand(id string) (worker.Command, error) {
+	nodeType := s.nodeType(id)
+	command := worker.Command{
+		Path: nodeType.Command,
+		Args: append([]string{s.Directories.Config}, nodeType.Args...),
+		Dir:  nodeType.Dir}
+	if len(command.Path) == 0 {
+		command.Path = strings.ToLower("monsti-" + id)
+	}
+	path, err := exec.LookPath(command.Path)
+	if err != nil {
+		return command, fmt.Errorf("Invalid worker executable of node type"+
+			" %q: %v", id, err)
+	}
+	command.Path = path
+	if len(command.Dir) > 0 {
+		if info, err := os.Stat(command.Dir); err != nil || !info.IsDir() {
+			return command, fmt.Errorf("Invalid working directory of node type"+
+				" %q: %q is not a directory", id, command.Dir)
+		}
+	}
+	keys := make([]string, 0, len(nodeType.Env))
+	for key := range nodeType.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		command.Env = append(command.Env, key+"="+nodeType.Env[key])
+	}
+	return command, nil
+}
+
+// addableTypes returns those of the given available node types which may be
+// added below a node of the given parent type.
+func (s *settings) addableTypes(parentType string, available []string) []string {
+	var ret []string
+	for _, nodeType := range available {
+		if s.checkChildType(parentType, nodeType, available) == nil {
+			ret = append(ret, nodeType)
+		}
+	}
+	return ret
+}
+
+// checkChildType checks if a node of the given type may be placed below a
+// node of the given parent type.
+//
+// available lists the node types having a running worker.
+func (s *settings) checkChildType(parentType, childType string,
+	available []string) error {
+	if !inStringSlice(childType, available) {
+		return fmt.Errorf("Unknown node type %q", childType)
+	}
+	if s.NodeTypeSettings[childType].NotAddable {
+		return fmt.Errorf("Node type %q is not addable", childType)
+	}
+	children := s.NodeTypeSettings[parentType].Children
+	if len(children) > 0 && !inStringSlice(childType, children) {
+		return fmt.Errorf("Node type %q not allowed below %q", childType,
+			parentType)
+	}
+	return nil
+}
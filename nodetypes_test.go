@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckChildType(t *testing.T) {
+	settings := new(settings)
+	settings.NodeTypeSettings = map[string]nodeTypeSettings{
+		"Blog":     {Children: []string{"BlogEntry"}},
+		"Root":     {NotAddable: true},
+		"Document": {}}
+	available := []string{"Blog", "BlogEntry", "Document", "Root"}
+	tests := []struct {
+		Parent, Child string
+		OK            bool
+	}{
+		{"Document", "Document", true},
+		{"Document", "Blog", true},
+		{"Document", "Root", false},
+		{"Document", "Unknown", false},
+		{"Blog", "BlogEntry", true},
+		{"Blog", "Document", false},
+		{"Root", "Blog", true},
+		{"Unconfigured", "Document", true}}
+	for i, v := range tests {
+		err := settings.checkChildType(v.Parent, v.Child, available)
+		if (err == nil) != v.OK {
+			t.Errorf("Test %v: checkChildType(%q, %q) = %v, should be ok: %v",
+				i, v.Parent, v.Child, err, v.OK)
+		}
+	}
+	if ret := settings.addableTypes("Blog", available); !reflect.DeepEqual(
+		ret, []string{"BlogEntry"}) {
+		t.Errorf(`addableTypes("Blog") = %v, should be [BlogEntry]`, ret)
+	}
+	if ret := settings.addableTypes("Document", available); !reflect.DeepEqual(
+		ret, []string{"Blog", "BlogEntry", "Document"}) {
+		t.Errorf(`addableTypes("Document") = %v, should be`+
+			` [Blog BlogEntry Document]`, ret)
+	}
+}
+
+func TestLoadNodeTypeSettings(t *testing.T) {
+	configured := map[string]nodeTypeSettings{
+		"Blog": {Name: "Blog", Description: "A blog.",
+			Children: []string{"BlogEntry"}}}
+	ret, err := loadNodeTypeSettings("/nonexistent", []string{"Blog",
+		"Document"}, configured)
+	if err != nil {
+		t.Fatalf("loadNodeTypeSettings failed: %v", err)
+	}
+	expected := map[string]nodeTypeSettings{
+		"Blog": {ID: "Blog", Name: "Blog", Description: "A blog.",
+			Children: []string{"BlogEntry"}},
+		"Document": {ID: "Document", Name: "Document"}}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("loadNodeTypeSettings(...) = %v, should be %v", ret, expected)
+	}
+}
+
+func TestLoadNodeTypeSettingsPaths(t *testing.T) {
+	configured := map[string]nodeTypeSettings{
+		"Foo": {Command: "bin/monsti-foo", Dir: "work"},
+		"Bar": {Command: "monsti-bar"}}
+	ret, err := loadNodeTypeSettings("/etc/monsti", []string{"Foo", "Bar"},
+		configured)
+	if err != nil {
+		t.Fatalf("loadNodeTypeSettings failed: %v", err)
+	}
+	if ret["Foo"].Command != "/etc/monsti/bin/monsti-foo" ||
+		ret["Foo"].Dir != "/etc/monsti/work" {
+		t.Errorf("Paths of Foo should be made absolute, got %v", ret["Foo"])
+	}
+	if ret["Bar"].Command != "monsti-bar" || ret["Bar"].Dir != "" {
+		t.Errorf("Command of Bar should be looked up in PATH, got %v",
+			ret["Bar"])
+	}
+}
+
+func TestWorkerCommand(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/bin/monsti-foo": "#!/bin/sh\n",
+		"/work/.keep":     ""}, "TestWorkerCommand")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	binary := filepath.Join(root, "bin", "monsti-foo")
+	if err := os.Chmod(binary, 0700); err != nil {
+		t.Fatalf("Could not make worker executable: %v", err)
+	}
+	settings := new(settings)
+	settings.Directories.Config = "/etc/monsti"
+	settings.NodeTypeSettings = map[string]nodeTypeSettings{
+		"Foo": {Command: binary, Args: []string{"-v"},
+			Env: map[string]string{"GOGC": "50", "API": "http://staging"},
+			Dir: filepath.Join(root, "work")},
+		"Missing":    {Command: filepath.Join(root, "bin", "missing")},
+		"InvalidDir": {Command: binary, Dir: binary}}
+	ret, err := settings.workerCommand("Foo")
+	expected := worker.Command{Path: binary,
+		Args: []string{"/etc/monsti", "-v"},
+		Env:  []string{"API=http://staging", "GOGC=50"},
+		Dir:  filepath.Join(root, "work")}
+	if err != nil || !reflect.DeepEqual(ret, expected) {
+		t.Errorf(`workerCommand("Foo") = %v, %v, should be %v`, ret, err,
+			expected)
+	}
+	for _, id := range []string{"Missing", "InvalidDir"} {
+		if _, err := settings.workerCommand(id); err == nil ||
+			!strings.Contains(err.Error(), id) {
+			t.Errorf("workerCommand(%q) should fail naming the node type, got %v",
+				id, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/chrneumann/mimemail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of failure notifications.
+const (
+	notifyPanic      = "panic"
+	notifyWorkerDied = "worker-died"
+)
+
+// maxNotifiedStack is the maximum length of stack traces in notifications.
+const maxNotifiedStack = 4096
+
+// notifyMail sends notification mails. Used for testing.
+var notifyMail = sendMail
+
+// notificationSettings configure notifications about failures like
+// recovered panics.
+type notificationSettings struct {
+	// Email enables notifications by mail using the SMTP settings.
+	Email bool
+	// To are the recipients of notification mails. Defaults to the site's
+	// owner.
+	To []string
+	// Webhook receives the notifications as JSON if its URL is set.
+	Webhook webhook
+	// WindowMinutes is the time in minutes further notifications of the same
+	// failure will be suppressed. Defaults to 60.
+	WindowMinutes int
+}
+
+// enabled returns true if notifications should be sent.
+func (n notificationSettings) enabled() bool {
+	return n.Email || len(n.Webhook.URL) > 0
+}
+
+// window returns the time notifications of the same failure are suppressed.
+func (n notificationSettings) window() time.Duration {
+	if n.WindowMinutes > 0 {
+		return time.Duration(n.WindowMinutes) * time.Minute
+	}
+	return time.Hour
+}
+
+// notification describes a failure. It's the payload of notification
+// webhook requests.
+type notification struct {
+	Kind string `json:"kind"`
+	Site string `json:"site,omitempty"`
+	// Path of the failed request.
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+	// Stack is the truncated stack trace of panics.
+	Stack string `json:"stack,omitempty"`
+	// Time of the failure in RFC 3339 format.
+	Time string `json:"time"`
+}
+
+// signature identifies failures of the same cause, ignoring the request
+// path and the varying parts of stack traces like goroutine IDs and
+// argument values.
+func (n notification) signature() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\n%v\n%v\n", n.Kind, n.Site, n.Error)
+	for _, line := range strings.Split(n.Stack, "\n") {
+		if len(line) == 0 || line[0] == '\t' ||
+			strings.HasPrefix(line, "goroutine ") {
+			continue
+		}
+		if i := strings.LastIndex(line, "("); i != -1 {
+			line = line[:i]
+		}
+		fmt.Fprintln(hash, line)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// truncateStack truncates the given stack trace to maxNotifiedStack bytes.
+func truncateStack(stack string) string {
+	if len(stack) <= maxNotifiedStack {
+		return stack
+	}
+	return stack[:maxNotifiedStack] + "\n[...]"
+}
+
+// notifier sends failure notifications, suppressing repeated notifications
+// of the same failure.
+//
+// A nil notifier does not notify at all.
+type notifier struct {
+	Settings *settings
+	Log      *leveledLogger
+	// now returns the current time. Used for testing.
+	now   func() time.Time
+	mutex sync.Mutex
+	// suppressed maps the recipients and signatures of notified failures to
+	// the end of their suppression window.
+	suppressed map[string]time.Time
+}
+
+// newNotifier returns a new notifier using the SMTP and notification
+// settings of the given settings.
+func newNotifier(settings *settings, log *leveledLogger) *notifier {
+	return &notifier{Settings: settings, Log: log, now: time.Now,
+		suppressed: make(map[string]time.Time)}
+}
+
+// suppress returns true if the given failure has already been notified to
+// the given site's recipients within the window. Otherwise, the failure
+// gets recorded.
+func (n *notifier) suppress(siteName string, note notification,
+	window time.Duration) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	now := n.now()
+	for key, until := range n.suppressed {
+		if !now.Before(until) {
+			delete(n.suppressed, key)
+		}
+	}
+	key := siteName + "\n" + note.signature()
+	if _, ok := n.suppressed[key]; ok {
+		return true
+	}
+	n.suppressed[key] = now.Add(window)
+	return false
+}
+
+// Notify asynchronously sends the given notification according to the
+// given notification settings of the given site.
+//
+// Failed deliveries are only logged.
+func (n *notifier) Notify(config notificationSettings, site site,
+	note notification) {
+	if n == nil || !config.enabled() {
+		return
+	}
+	if n.suppress(site.Name, note, config.window()) {
+		n.Log.Debug("Suppressed notification of %v %q", note.Kind, note.Error)
+		return
+	}
+	note.Time = n.now().UTC().Format(time.RFC3339)
+	note.Stack = truncateStack(note.Stack)
+	if config.Email {
+		mail := mimemail.Mail{
+			Subject: fmt.Sprintf("[monsti] %v: %v", note.Kind, note.Error),
+			Body: []byte(fmt.Sprintf(
+				"Site: %v\nPath: %v\nTime: %v\nError: %v\n\n%v\n", note.Site,
+				note.Path, note.Time, note.Error, note.Stack))}
+		for _, to := range config.To {
+			mail.To = append(mail.To, mimemail.Address{Email: to})
+		}
+		if len(site.Owner.Email) == 0 && len(mail.To) > 0 {
+			mail.From = mail.To[0]
+		}
+		go func() {
+			if err := notifyMail(n.Settings, site, mail); err != nil {
+				n.Log.Error("Could not mail %v notification: %v", note.Kind, err)
+			}
+		}()
+	}
+	if len(config.Webhook.URL) > 0 {
+		payload, err := json.Marshal(note)
+		if err != nil {
+			panic("Could not marshal notification: " + err.Error())
+		}
+		go func() {
+			if err := deliverWebhook(config.Webhook, payload); err != nil {
+				n.Log.Error("Could not deliver %v notification to %v: %v",
+					note.Kind, config.Webhook.URL, err)
+			}
+		}()
+	}
+}
+
+// NotifyAll sends the given notification to the daemon's administrators
+// and, if it concerns a site, to the administrators of the given site.
+func (n *notifier) NotifyAll(s site, note notification) {
+	if n == nil {
+		return
+	}
+	n.Notify(n.Settings.Notifications, site{}, note)
+	if len(s.Name) > 0 {
+		n.Notify(s.Notifications, s, note)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/chrneumann/mimemail"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chanWriter sends everything written to it to the channel.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestNotificationSignature(t *testing.T) {
+	stack := func(goroutine, arg string) string {
+		return "goroutine " + goroutine + " [running]:\n" +
+			"main.(*nodeHandler).serve.func1(" + arg + ")\n" +
+			"\t/src/serve.go:300 +0x1c5\n" +
+			"main.(*nodeHandler).Login(" + arg + ", 0x1)\n" +
+			"\t/src/users.go:42 +0x2a\n"
+	}
+	base := notification{Kind: notifyPanic, Site: "foo", Path: "/foo/",
+		Error: "boom", Stack: stack("1", "0xc000010000")}
+	tests := []struct {
+		Note notification
+		Same bool
+	}{
+		{notification{Kind: notifyPanic, Site: "foo", Path: "/bar/",
+			Error: "boom", Stack: stack("42", "0xc000020000")}, true},
+		{notification{Kind: notifyPanic, Site: "foo", Path: "/foo/",
+			Error: "bang", Stack: stack("1", "0xc000010000")}, false},
+		{notification{Kind: notifyPanic, Site: "bar", Path: "/foo/",
+			Error: "boom", Stack: stack("1", "0xc000010000")}, false},
+		{notification{Kind: notifyPanic, Site: "foo", Path: "/foo/",
+			Error: "boom", Stack: strings.Replace(stack("1", "0x1"), "Login",
+				"Logout", 1)}, false}}
+	for i, v := range tests {
+		if same := v.Note.signature() == base.signature(); same != v.Same {
+			t.Errorf("Test %v: Signatures equal: %v, should be %v", i, same,
+				v.Same)
+		}
+	}
+	long := strings.Repeat("x", maxNotifiedStack+100)
+	if ret := truncateStack(long); len(ret) > maxNotifiedStack+10 {
+		t.Errorf("truncateStack(...) returned %v bytes", len(ret))
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	hooked := make(chan notification, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var note notification
+			if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+				t.Errorf("Could not decode notification: %v", err)
+			}
+			hooked <- note
+		}))
+	defer server.Close()
+	mailed := make(chan mimemail.Mail, 10)
+	defer func(f func(*settings, site, mimemail.Mail) error) {
+		notifyMail = f
+	}(notifyMail)
+	notifyMail = func(_ *settings, _ site, mail mimemail.Mail) error {
+		mailed <- mail
+		return errors.New("SMTP server down")
+	}
+	logged := make(chanWriter, 10)
+	settings_ := &settings{}
+	settings_.Notifications = notificationSettings{Email: true,
+		To: []string{"admin@example.com"}, WindowMinutes: 10}
+	n := newNotifier(settings_, newLeveledLogger(log.New(logged, "", 0),
+		levelInfo))
+	now := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+	site_ := site{Name: "foo"}
+	site_.Notifications.Webhook.URL = server.URL
+	site_.Notifications.WindowMinutes = 10
+	note := notification{Kind: notifyPanic, Site: "foo", Path: "/foo/",
+		Error: "boom", Stack: "goroutine 1 [running]:\nmain.foo()\n"}
+	receive := func(expected int) {
+		for i := 0; i < expected; i++ {
+			select {
+			case hook := <-hooked:
+				if hook.Site != "foo" || hook.Path != "/foo/" ||
+					hook.Error != "boom" || !strings.Contains(hook.Stack,
+					"main.foo()") || hook.Time != now.Format(time.RFC3339) {
+					t.Errorf("Webhook got %+v", hook)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Missing webhook notification")
+			}
+			select {
+			case mail := <-mailed:
+				if len(mail.To) != 1 || mail.To[0].Email != "admin@example.com" ||
+					!strings.Contains(mail.Subject, "boom") ||
+					!bytes.Contains(mail.Body, []byte("/foo/")) {
+					t.Errorf("Mailed %+v", mail)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Missing mail notification")
+			}
+		}
+		select {
+		case hook := <-hooked:
+			t.Errorf("Unexpected webhook notification %+v", hook)
+		case mail := <-mailed:
+			t.Errorf("Unexpected mail notification %+v", mail)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	n.NotifyAll(site_, note)
+	receive(1)
+	// Repeated panics on other paths get suppressed within the window.
+	now = now.Add(5 * time.Minute)
+	note.Path = "/bar/"
+	n.NotifyAll(site_, note)
+	receive(0)
+	note.Path = "/foo/"
+	now = now.Add(6 * time.Minute)
+	n.NotifyAll(site_, note)
+	receive(1)
+	select {
+	case msg := <-logged:
+		if !strings.Contains(msg, "SMTP server down") {
+			t.Errorf("Logged %q, should be the failed mail", msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Failed mail has not been logged")
+	}
+	var nilNotifier *notifier
+	nilNotifier.NotifyAll(site_, note)
+}
+
+func TestNotifierDisabled(t *testing.T) {
+	n := newNotifier(&settings{}, newLeveledLogger(log.New(ioutil.Discard,
+		"", 0), levelInfo))
+	n.NotifyAll(site{Name: "foo"}, notification{Kind: notifyPanic})
+	if len(n.suppressed) > 0 {
+		t.Errorf("Notifications without recipients should not be recorded")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errInvalidPath is returned for node paths or file names which are malformed
+// or point outside of the data directory.
+var errInvalidPath = errors.New("Invalid node path")
+
+// checkPathSegments checks the segments of the given slash separated path.
+//
+// Segments must not be empty or contain "..", "." segments and NUL bytes are
+// rejected as well. A leading and a trailing slash are allowed.
+func checkPathSegments(p string) error {
+	if strings.Contains(p, "\x00") || strings.Contains(p, "\\") {
+		return errInvalidPath
+	}
+	p = strings.TrimPrefix(p, "/")
+	p = strings.TrimSuffix(p, "/")
+	if len(p) == 0 {
+		return nil
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if len(segment) == 0 || segment == "." ||
+			strings.Contains(segment, "..") {
+			return errInvalidPath
+		}
+	}
+	return nil
+}
+
+// resolveExisting resolves symlinks of the longest existing prefix of the
+// given absolute path.
+func resolveExisting(p string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// nodeFile returns the filesystem path of the given file of the node at the
+// given path in the data directory root.
+//
+// file may be empty to get the node's directory. It may be a relative path
+// below the node's directory. Returns errInvalidPath if the paths are
+// malformed or if the result, after resolving symlinks, is not located in
+// the data directory.
+func nodeFile(root, nodePath, file string) (string, error) {
+	if !strings.HasPrefix(nodePath, "/") || checkPathSegments(nodePath) != nil ||
+		strings.HasPrefix(file, "/") || checkPathSegments(file) != nil {
+		return "", errInvalidPath
+	}
+	target := filepath.Join(root, filepath.FromSlash(nodePath),
+		filepath.FromSlash(file))
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := resolveExisting(target)
+	if err != nil {
+		return "", err
+	}
+	if resolved != resolvedRoot &&
+		!strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+		return "", errInvalidPath
+	}
+	return target, nil
+}
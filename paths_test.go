@@ -0,0 +1,58 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeFile(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/foo/node.yaml":  "",
+		"/outside/secret.yaml": ""}, "TestNodeFile")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	data := filepath.Join(root, "data")
+	if err := os.Symlink(filepath.Join(root, "outside"),
+		filepath.Join(data, "evil")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(data, "foo"),
+		filepath.Join(data, "alias")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+	tests := []struct {
+		NodePath, File string
+		Valid          bool
+	}{
+		{"/", "", true},
+		{"/", "footer.html", true},
+		{"/foo", "node.yaml", true},
+		{"/foo/", "node.yaml", true},
+		{"/foo/new", "node.yaml", true},
+		{"/foo", "images/bar.png", true},
+		{"/alias", "node.yaml", true},
+		{"foo", "node.yaml", false},
+		{"/../outside", "secret.yaml", false},
+		{"/foo/../../outside", "secret.yaml", false},
+		{"/..%2f..%2foutside", "secret.yaml", false},
+		{"/foo//bar", "node.yaml", false},
+		{"/foo/./bar", "node.yaml", false},
+		{"/foo\x00", "node.yaml", false},
+		{"/foo", "../../outside/secret.yaml", false},
+		{"/foo", "/etc/passwd", false},
+		{"/foo", "..", false},
+		{"/foo", "a\x00b", false},
+		{"/evil", "secret.yaml", false},
+		{"/evil/new", "node.yaml", false}}
+	for i, v := range tests {
+		_, err := nodeFile(data, v.NodePath, v.File)
+		if (err == nil) != v.Valid {
+			t.Errorf("Test %v: nodeFile(_, %q, %q) returned error %v, should"+
+				" be valid: %v", i, v.NodePath, v.File, err, v.Valid)
+		}
+	}
+}
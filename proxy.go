@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is a list of networks of reverse proxies whose forwarding
+// headers are trusted.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses the given CIDRs or single IP addresses.
+func parseTrustedProxies(specs []string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0, len(specs))
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid proxy address %q", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{ip, net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy network %q: %v", spec, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Contains returns whether the given IP address belongs to a trusted proxy.
+func (p trustedProxies) Contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client.
+//
+// The address of requests forwarded by trusted proxies must have been
+// resolved by applyProxyHeaders beforehand.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedFor returns the client address according to the X-Forwarded-For
+// header, i.e. the rightmost address not belonging to a trusted proxy.
+func (p trustedProxies) forwardedFor(r *http.Request, peer string) string {
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		client = hop
+		if !p.Contains(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// applyProxyHeaders updates the client address, scheme and host of the
+// request according to the forwarding headers if the request comes from a
+// trusted proxy. Forwarding headers, request IDs and trace contexts of
+// other requests will be removed.
+//
+// If trustPeer is true, the immediate peer will be trusted whatever its
+// address, as with the deprecated TrustForwardedFor setting.
+func applyProxyHeaders(r *http.Request, proxies trustedProxies,
+	trustPeer bool) {
+	peer := clientIP(r)
+	if !trustPeer && !proxies.Contains(peer) {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+		r.Header.Del(requestIDHeader)
+		r.Header.Del(traceParentHeader)
+		return
+	}
+	r.RemoteAddr = proxies.forwardedFor(r, peer)
+	if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		r.URL.Scheme = proto
+	}
+	if host := r.Header.Get("X-Forwarded-Host"); len(host) > 0 {
+		r.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+	}
+}
+
+// requestScheme returns the scheme used by the client, i.e. http or https.
+func requestScheme(r *http.Request) string {
+	if r.URL != nil && len(r.URL.Scheme) > 0 {
+		return r.URL.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
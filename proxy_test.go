@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		Specs []string
+		Valid bool
+	}{
+		{nil, true},
+		{[]string{"10.0.0.0/8", "192.168.1.1", "::1", "fd00::/8"}, true},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"proxy.example.com"}, false}}
+	for i, v := range tests {
+		if _, err := parseTrustedProxies(v.Specs); (err == nil) != v.Valid {
+			t.Errorf("Test %v: parseTrustedProxies(%v) returned error %v", i,
+				v.Specs, err)
+		}
+	}
+}
+
+func TestApplyProxyHeaders(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatalf("Could not parse proxies: %v", err)
+	}
+	tests := []struct {
+		RemoteAddr, ForwardedFor, Proto, ForwardedHost string
+		IP, Scheme, Host                               string
+	}{
+		{"10.0.0.1:1234", "", "", "", "10.0.0.1", "http", "example.com"},
+		{"10.0.0.1:1234", "1.2.3.4", "https", "www.example.com",
+			"1.2.3.4", "https", "www.example.com"},
+		{"[::1]:1234", "1.2.3.4", "", "", "1.2.3.4", "http", "example.com"},
+		// Spoofed entries left of the real client must be ignored.
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4", "", "", "1.2.3.4", "http",
+			"example.com"},
+		// Chained trusted proxies.
+		{"10.0.0.1:1234", "1.2.3.4, 10.0.0.2", "", "", "1.2.3.4", "http",
+			"example.com"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "", "10.0.0.3", "http",
+			"example.com"},
+		{"10.0.0.1:1234", "garbage, 1.2.3.4", "", "", "1.2.3.4", "http",
+			"example.com"},
+		{"10.0.0.1:1234", "", "gopher", "", "10.0.0.1", "http", "example.com"},
+		// Headers of untrusted peers must be ignored.
+		{"1.2.3.4:1234", "10.0.0.2", "https", "evil.example.com",
+			"1.2.3.4", "http", "example.com"},
+		{"11.0.0.1:1234", "1.2.3.4", "", "", "11.0.0.1", "http", "example.com"},
+		{"[::2]:1234", "1.2.3.4", "", "", "::2", "http", "example.com"}}
+	for i, v := range tests {
+		r := http.Request{RemoteAddr: v.RemoteAddr, Header: make(http.Header),
+			Host: "example.com", URL: &url.URL{Path: "/"}}
+		if len(v.ForwardedFor) > 0 {
+			r.Header.Set("X-Forwarded-For", v.ForwardedFor)
+		}
+		if len(v.Proto) > 0 {
+			r.Header.Set("X-Forwarded-Proto", v.Proto)
+		}
+		if len(v.ForwardedHost) > 0 {
+			r.Header.Set("X-Forwarded-Host", v.ForwardedHost)
+		}
+		trusted := proxies.Contains(clientIP(&r))
+		applyProxyHeaders(&r, proxies, false)
+		if ip, scheme := clientIP(&r), requestScheme(&r); ip != v.IP ||
+			scheme != v.Scheme || r.Host != v.Host {
+			t.Errorf("Test %v: Got %q, %q, %q; should be %q, %q, %q", i, ip,
+				scheme, r.Host, v.IP, v.Scheme, v.Host)
+		}
+		if !trusted && (len(r.Header.Get("X-Forwarded-For")) > 0 ||
+			len(r.Header.Get("X-Forwarded-Host")) > 0) {
+			t.Errorf("Test %v: Headers of untrusted peers should be removed", i)
+		}
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	r := http.Request{URL: &url.URL{}}
+	if scheme := requestScheme(&r); scheme != "http" {
+		t.Errorf("requestScheme(...) = %q, should be http", scheme)
+	}
+	r.TLS = &tls.ConnectionState{}
+	if scheme := requestScheme(&r); scheme != "https" {
+		t.Errorf("requestScheme(...) with TLS = %q, should be https", scheme)
+	}
+}
+
+func TestApplyProxyHeadersTrustPeer(t *testing.T) {
+	tests := []struct {
+		RemoteAddr, ForwardedFor, Proto, IP, Scheme string
+	}{
+		{"1.2.3.4:1234", "", "", "1.2.3.4", "http"},
+		{"1.2.3.4:1234", "10.0.0.2", "https", "10.0.0.2", "https"},
+		// Only the address added by the peer may be used.
+		{"1.2.3.4:1234", "6.6.6.6, 10.0.0.2", "", "10.0.0.2", "http"}}
+	for i, v := range tests {
+		r := http.Request{RemoteAddr: v.RemoteAddr, Header: make(http.Header),
+			Host: "example.com", URL: &url.URL{Path: "/"}}
+		if len(v.ForwardedFor) > 0 {
+			r.Header.Set("X-Forwarded-For", v.ForwardedFor)
+		}
+		if len(v.Proto) > 0 {
+			r.Header.Set("X-Forwarded-Proto", v.Proto)
+		}
+		applyProxyHeaders(&r, nil, true)
+		if ip, scheme := clientIP(&r), requestScheme(&r); ip != v.IP ||
+			scheme != v.Scheme {
+			t.Errorf("Test %v: Got %q, %q; should be %q, %q", i, ip, scheme,
+				v.IP, v.Scheme)
+		}
+	}
+}
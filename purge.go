@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// purgeKeyHeader is the header of rendered nodes telling external caches
+// the node's path, e.g. to be used as surrogate key.
+const purgeKeyHeader = "X-Monsti-Node"
+
+// purgeAttempts is the number of attempts of purge requests.
+const purgeAttempts = 3
+
+// purgeBackoff is the delay before the second attempt of a purge request.
+// It doubles for each further attempt.
+var purgeBackoff = time.Second
+
+// purgeClient is the HTTP client used to send purge requests.
+var purgeClient = &http.Client{Timeout: 10 * time.Second}
+
+// purgeSettings configures purging of changed nodes from external caches
+// like Varnish.
+type purgeSettings struct {
+	// Enabled sends purge requests for changed nodes and the X-Monsti-Node
+	// header with rendered nodes.
+	Enabled bool
+	// Method of the purge requests. Defaults to PURGE.
+	Method string
+	// URL of the purge requests. {host} will be replaced by the site's
+	// canonical host and {path} by the URL path of the node. Defaults to
+	// http://{host}{path}.
+	URL string
+}
+
+// purgeHost returns the host the site's cache entries are keyed by: the
+// canonical host, or else the first of the site's hosts.
+func purgeHost(site site) string {
+	return site.host()
+}
+
+// purgeTargets returns the paths to be purged if the node at the given
+// path changed: the node itself, its parent showing it in its navigation
+// and the root node showing the primary navigation.
+func purgeTargets(nodePath string) []string {
+	nodePath = path.Clean("/" + nodePath)
+	targets := []string{nodePath}
+	for _, target := range []string{path.Dir(nodePath), "/"} {
+		if !inStringSlice(target, targets) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// sendPurge sends the purge request for the node at the given path,
+// retrying failed attempts.
+func sendPurge(site site, nodePath string) error {
+	host := purgeHost(site)
+	if len(host) == 0 {
+		return fmt.Errorf("Site %q has no hosts", site.Name)
+	}
+	method, url := site.Purge.Method, site.Purge.URL
+	if len(method) == 0 {
+		method = "PURGE"
+	}
+	if len(url) == 0 {
+		url = "http://{host}{path}"
+	}
+	urlPath := site.URL(nodePath)
+	if !strings.HasSuffix(urlPath, "/") {
+		urlPath += "/"
+	}
+	url = strings.NewReplacer("{host}", host, "{path}", urlPath).Replace(url)
+	return retryRequest(purgeClient, purgeAttempts, purgeBackoff,
+		func() (*http.Request, error) {
+			req, err := http.NewRequest(method, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Host = host
+			req.Header.Set(purgeKeyHeader, nodePath)
+			return req, nil
+		}, func(status int) bool {
+			// Caches answer with 404 if there is nothing to purge.
+			return status == http.StatusNotFound
+		})
+}
+
+// purgeNode asynchronously purges the changed node at the given path, its
+// parent and the root node from the site's external caches, if enabled.
+//
+// Failed requests will be reported to logf.
+func purgeNode(site site, nodePath string,
+	logf func(format string, v ...interface{})) {
+	if !site.Purge.Enabled {
+		return
+	}
+	go func() {
+		for _, target := range purgeTargets(nodePath) {
+			if err := sendPurge(site, target); err != nil {
+				logf("Could not purge %q from cache: %v", target, err)
+			}
+		}
+	}()
+}
+
+// purgeAll purges all nodes of the site from its external caches.
+//
+// Returns the number of purged nodes. Failed requests will be reported to
+// logf.
+func purgeAll(site site, logf func(format string, v ...interface{})) (int,
+	error) {
+	purged := 0
+	err := walkNodes(site.Directories.Data, func(nodePath string,
+		info os.FileInfo) error {
+		if err := sendPurge(site, nodePath); err != nil {
+			logf("Could not purge %q from cache: %v", nodePath, err)
+			return nil
+		}
+		purged++
+		return nil
+	})
+	return purged, err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPurgeTargets(t *testing.T) {
+	tests := []struct {
+		Path    string
+		Targets []string
+	}{
+		{"/", []string{"/"}},
+		{"/foo", []string{"/foo", "/"}},
+		{"/foo/bar/", []string{"/foo/bar", "/foo", "/"}}}
+	for i, v := range tests {
+		if ret := purgeTargets(v.Path); !reflect.DeepEqual(ret, v.Targets) {
+			t.Errorf("Test %v: purgeTargets(%q) = %v, should be %v", i, v.Path,
+				ret, v.Targets)
+		}
+	}
+}
+
+// purgeRequest is a purge request received by a test server.
+type purgeRequest struct {
+	Method, Host, Path, Key string
+}
+
+// setupPurgeServer returns a server recording the purge requests. The
+// first failures requests will fail.
+func setupPurgeServer(failures int) (*httptest.Server, chan purgeRequest) {
+	requests := make(chan purgeRequest, 100)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if failures > 0 {
+				failures--
+				http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			requests <- purgeRequest{r.Method, r.Host, r.URL.Path,
+				r.Header.Get(purgeKeyHeader)}
+		}))
+	return server, requests
+}
+
+// receivePurges returns the given number of purge requests by path.
+func receivePurges(t *testing.T, requests chan purgeRequest,
+	n int) map[string]purgeRequest {
+	ret := make(map[string]purgeRequest)
+	for i := 0; i < n; i++ {
+		select {
+		case req := <-requests:
+			ret[req.Path] = req
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Got %v purge requests, should be %v", i, n)
+		}
+	}
+	return ret
+}
+
+func TestPurgeNode(t *testing.T) {
+	server, requests := setupPurgeServer(1)
+	defer server.Close()
+	defer func(backoff time.Duration) { purgeBackoff = backoff }(purgeBackoff)
+	purgeBackoff = time.Millisecond
+	site := site{Name: "foo", Hosts: []string{"foo.example.com"},
+		CanonicalHost: "www.example.com", BasePath: "/base"}
+	site.Purge.URL = server.URL + "{path}"
+	logf := func(format string, v ...interface{}) {
+		t.Errorf("Unexpected purge failure: "+format, v...)
+	}
+	fireWebhooks(site, eventNodeWritten, "/foo/bar", "alice", logf)
+	select {
+	case req := <-requests:
+		t.Errorf("Purged %v although purging is disabled", req.Path)
+	case <-time.After(50 * time.Millisecond):
+	}
+	site.Purge.Enabled = true
+	fireWebhooks(site, eventNodeWritten, "/foo/bar", "alice", logf)
+	expected := map[string]purgeRequest{
+		"/base/":         {"PURGE", "www.example.com", "/base/", "/"},
+		"/base/foo/":     {"PURGE", "www.example.com", "/base/foo/", "/foo"},
+		"/base/foo/bar/": {"PURGE", "www.example.com", "/base/foo/bar/", "/foo/bar"}}
+	if ret := receivePurges(t, requests, 3); !reflect.DeepEqual(ret,
+		expected) {
+		t.Errorf("Got purge requests %v, should be %v", ret, expected)
+	}
+}
+
+func TestPurgeAll(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":         `{"type": "Document"}`,
+		"/foo/node.yaml":     `{"type": "Document"}`,
+		"/.monsti/__empty__": ""}, "TestPurgeAll")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	server, requests := setupPurgeServer(0)
+	defer server.Close()
+	site := site{Name: "foo", Hosts: []string{"foo.example.com"}}
+	site.Directories.Data = root
+	site.Purge = purgeSettings{Enabled: true, Method: "BAN",
+		URL: server.URL + "{path}"}
+	purged, err := purgeAll(site, func(format string, v ...interface{}) {
+		t.Errorf("Unexpected purge failure: "+format, v...)
+	})
+	if err != nil || purged != 2 {
+		t.Errorf("purgeAll(...) = %v, %v", purged, err)
+	}
+	expected := map[string]purgeRequest{
+		"/":     {"BAN", "foo.example.com", "/", "/"},
+		"/foo/": {"BAN", "foo.example.com", "/foo/", "/foo"}}
+	if ret := receivePurges(t, requests, 2); !reflect.DeepEqual(ret,
+		expected) {
+		t.Errorf("Got purge requests %v, should be %v", ret, expected)
+	}
+}
+
+func TestServePurgeKey(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestServePurgeKey")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	h, stop := setupWorkerHandler(root, ioutil.Discard,
+		func(ticket worker.Ticket) {
+			ticket.ResponseChan <- client.Response{Body: []byte("Foo"), Raw: true}
+		})
+	defer stop()
+	for _, enabled := range []bool{false, true} {
+		site_, _ := h.Sites.Get("foo")
+		site_.Purge.Enabled = enabled
+		h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+		h.ServeHTTP(w, r)
+		if key := w.Header().Get(purgeKeyHeader); enabled && key != "/foo" ||
+			!enabled && len(key) > 0 {
+			t.Errorf("%v is %q with purging set to %v", purgeKeyHeader, key,
+				enabled)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// statusTooManyRequests is the status code of responses to rate limited
+// requests (RFC 6585).
+const statusTooManyRequests = 429
+
+// Request budgets of the rate limiter.
+const (
+	// budgetPages limits page views of anonymous users.
+	budgetPages = iota
+	// budgetActions limits requests of @@ actions.
+	budgetActions
+	// budgetAuth limits authentication attempts.
+	budgetAuth
+	numBudgets
+)
+
+// budgetNames are the names of the budgets as shown on the status page.
+var budgetNames = [numBudgets]string{"pages", "actions", "auth"}
+
+// rateBudget is the configuration of a budget.
+type rateBudget struct {
+	// Rate is the number of allowed requests per minute. Zero disables the
+	// budget.
+	Rate float64
+	// Burst is the number of requests which may be sent at once. Defaults
+	// to Rate.
+	Burst int
+}
+
+// capacity returns the maximum number of tokens of a bucket.
+func (b rateBudget) capacity() float64 {
+	if b.Burst > 0 {
+		return float64(b.Burst)
+	}
+	return math.Max(1, math.Ceil(b.Rate))
+}
+
+// rateBucket is a token bucket of some client and budget.
+type rateBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitStat holds how often some budget has been exceeded.
+type rateLimitStat struct {
+	Budget    string
+	Triggered int
+}
+
+// rateLimiter limits the requests of clients by their IP addresses using
+// token buckets.
+//
+// The least recently used buckets will be dropped if there are more than
+// MaxBuckets. A nil rateLimiter does not limit at all.
+type rateLimiter struct {
+	Budgets [numBudgets]rateBudget
+	// Allow are the networks which will not be limited.
+	Allow trustedProxies
+	// MaxBuckets is the maximum number of tracked buckets.
+	MaxBuckets int
+	// now returns the current time. Used for testing.
+	now       func() time.Time
+	mutex     sync.Mutex
+	buckets   map[string]*list.Element
+	lru       *list.List
+	triggered [numBudgets]int
+}
+
+// newRateLimiter returns a new rateLimiter using the given budgets, or nil
+// if all budgets are disabled.
+//
+// maxBuckets defaults to 10000 if zero.
+func newRateLimiter(budgets [numBudgets]rateBudget, allow trustedProxies,
+	maxBuckets int) *rateLimiter {
+	enabled := false
+	for _, budget := range budgets {
+		enabled = enabled || budget.Rate > 0
+	}
+	if !enabled {
+		return nil
+	}
+	if maxBuckets <= 0 {
+		maxBuckets = 10000
+	}
+	return &rateLimiter{
+		Budgets:    budgets,
+		Allow:      allow,
+		MaxBuckets: maxBuckets,
+		now:        time.Now,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New()}
+}
+
+// Take takes a token of the given budget from the bucket of the client with
+// the given IP address.
+//
+// Returns false and the time until the next token is available if the
+// budget is exhausted.
+func (l *rateLimiter) Take(budget int, ip string) (bool, time.Duration) {
+	if l == nil || l.Budgets[budget].Rate <= 0 || l.Allow.Contains(ip) {
+		return true, 0
+	}
+	config := l.Budgets[budget]
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	key := budgetNames[budget] + ":" + ip
+	var bucket *rateBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*rateBucket)
+		refill := now.Sub(bucket.last).Minutes() * config.Rate
+		bucket.tokens = math.Min(config.capacity(), bucket.tokens+refill)
+	} else {
+		bucket = &rateBucket{key: key, tokens: config.capacity()}
+		l.buckets[key] = l.lru.PushFront(bucket)
+		for l.lru.Len() > l.MaxBuckets {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*rateBucket).key)
+		}
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		l.triggered[budget]++
+		wait := (1 - bucket.tokens) / config.Rate * float64(time.Minute)
+		return false, time.Duration(wait)
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Stats returns how often the enabled budgets have been exceeded.
+func (l *rateLimiter) Stats() []rateLimitStat {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var stats []rateLimitStat
+	for budget, config := range l.Budgets {
+		if config.Rate > 0 {
+			stats = append(stats, rateLimitStat{budgetNames[budget],
+				l.triggered[budget]})
+		}
+	}
+	return stats
+}
+
+// requestBudget returns the budget of a request using the given method for
+// the given action, or -1 if the request should not be limited.
+//
+// authenticated is true if the request has been sent by a logged in user.
+func requestBudget(method, action string, authenticated bool) int {
+	switch {
+	case (action == "login" || action == "reset-password") && method == "POST":
+		return budgetAuth
+	case len(action) > 0:
+		return budgetActions
+	case !authenticated:
+		return budgetPages
+	}
+	return -1
+}
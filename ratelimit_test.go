@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	allow, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	limiter := newRateLimiter([numBudgets]rateBudget{
+		budgetPages: {Rate: 60, Burst: 2}}, allow, 2)
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time { return now }
+	tests := []struct {
+		Advance time.Duration
+		Budget  int
+		IP      string
+		OK      bool
+		Wait    time.Duration
+	}{
+		{0, budgetPages, "1.1.1.1", true, 0},
+		{0, budgetPages, "1.1.1.1", true, 0},
+		{0, budgetPages, "1.1.1.1", false, time.Second},
+		{500 * time.Millisecond, budgetPages, "1.1.1.1", false,
+			500 * time.Millisecond},
+		{500 * time.Millisecond, budgetPages, "1.1.1.1", true, 0},
+		{0, budgetPages, "2.2.2.2", true, 0},
+		{0, budgetActions, "1.1.1.1", true, 0},
+		{0, budgetPages, "10.1.2.3", true, 0},
+		{0, budgetPages, "10.1.2.3", true, 0},
+		{0, budgetPages, "10.1.2.3", true, 0},
+		{time.Hour, budgetPages, "1.1.1.1", true, 0},
+		{0, budgetPages, "1.1.1.1", true, 0},
+		{0, budgetPages, "1.1.1.1", false, time.Second}}
+	for i, v := range tests {
+		now = now.Add(v.Advance)
+		ok, wait := limiter.Take(v.Budget, v.IP)
+		if ok != v.OK || wait != v.Wait {
+			t.Errorf("Test %v: Take(%v, %q) = %v, %v, should be %v, %v", i,
+				v.Budget, v.IP, ok, wait, v.OK, v.Wait)
+		}
+		if limiter.lru.Len() > 2 || len(limiter.buckets) != limiter.lru.Len() {
+			t.Errorf("Test %v: Limiter tracks %v buckets, should be at most 2", i,
+				limiter.lru.Len())
+		}
+	}
+	expected := []rateLimitStat{{"pages", 3}}
+	if stats := limiter.Stats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Stats() = %v, should be %v", stats, expected)
+	}
+	if newRateLimiter([numBudgets]rateBudget{}, nil, 0) != nil {
+		t.Errorf("newRateLimiter(...) without budgets should return nil")
+	}
+	var disabled *rateLimiter
+	if ok, _ := disabled.Take(budgetAuth, "1.1.1.1"); !ok {
+		t.Errorf("Take(...) of nil limiter should not limit")
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	tests := []struct {
+		Method, Action string
+		Authenticated  bool
+		Budget         int
+	}{
+		{"GET", "", false, budgetPages},
+		{"GET", "", true, -1},
+		{"GET", "edit", true, budgetActions},
+		{"GET", "login", false, budgetActions},
+		{"POST", "login", false, budgetAuth},
+		{"POST", "reset-password", false, budgetAuth},
+		{"POST", "edit", true, budgetActions}}
+	for _, v := range tests {
+		if ret := requestBudget(v.Method, v.Action, v.Authenticated); ret !=
+			v.Budget {
+			t.Errorf("requestBudget(%q, %q, %v) = %v, should be %v", v.Method,
+				v.Action, v.Authenticated, ret, v.Budget)
+		}
+	}
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRateLimitedRequest")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	h, stop := setupWorkerHandler(root, &logBuf, func(worker.Ticket) {})
+	defer stop()
+	h.RateLimiter = newRateLimiter([numBudgets]rateBudget{
+		budgetActions: {Rate: 1}}, nil, 0)
+	for i, status := range []int{http.StatusOK, statusTooManyRequests} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com/foo/@@json", nil)
+		r.RemoteAddr = "1.2.3.4:1234"
+		h.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("Request %v: Got status %v, should be %v", i, w.Code, status)
+		}
+		if retry := w.Header().Get("Retry-After"); (status ==
+			statusTooManyRequests) != (retry == "60") {
+			t.Errorf("Request %v: Retry-After is %q", i, retry)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentIndexPath is the path of the recent changes index relative to the
+// data directory.
+const recentIndexPath = ".monsti/recent.yaml"
+
+// recentLogPath is the path of the log of changes recorded since the
+// recent changes index has been written, relative to the data directory.
+const recentLogPath = ".monsti/recent.log"
+
+// maxRecentChanges is the maximum number of changes kept in the index.
+const maxRecentChanges = 1000
+
+// maxRecentLogSize is the size in bytes of the log of recent changes at
+// which it gets merged into the index.
+const maxRecentLogSize = 64 << 10
+
+// recentPageSize is the number of changes shown per page of @@recent.
+const recentPageSize = 50
+
+// recentMutex serializes updates of the recent changes indexes.
+var recentMutex sync.Mutex
+
+// recentChange is the last change of some node.
+type recentChange struct {
+	Path, Title, Type string
+	// User is the login of the user who changed the node.
+	User string `yaml:",omitempty"`
+	// Time of the change in nodeTimeFormat.
+	Time string
+	// Removed is true if the node has been removed.
+	Removed bool `yaml:",omitempty"`
+}
+
+// recentChangeList sorts changes by time, most recent first.
+type recentChangeList []recentChange
+
+// Len is the number of elements in the list.
+func (l recentChangeList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l recentChangeList) Less(i, j int) bool {
+	ti, _ := time.Parse(nodeTimeFormat, l[i].Time)
+	tj, _ := time.Parse(nodeTimeFormat, l[j].Time)
+	if ti.Equal(tj) {
+		return l[i].Path < l[j].Path
+	}
+	return ti.After(tj)
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l recentChangeList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// buildRecentChanges walks the data directory located at the given root and
+// returns the changes of all nodes according to their update stamps.
+func buildRecentChanges(root string) ([]recentChange, error) {
+	var changes []recentChange
+	err := walkNodes(root, func(nodePath string, info os.FileInfo) error {
+		node, err := readStoredNode(root, nodePath)
+		if err != nil {
+			return nil
+		}
+		changeTime := node.LastUpdate
+		if len(changeTime) == 0 {
+			changeTime = info.ModTime().Format(nodeTimeFormat)
+		}
+		changes = append(changes, recentChange{
+			Path:  nodePath,
+			Title: node.Title,
+			Type:  node.Type,
+			User:  node.LastUpdateBy,
+			Time:  changeTime})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(recentChangeList(changes))
+	return changes, nil
+}
+
+// loadRecentChanges returns the recent changes of the data directory located
+// at the given root, most recent first.
+//
+// The index will be rebuilt if it is missing. Changes of the log get merged
+// into the index.
+func loadRecentChanges(root string) ([]recentChange, error) {
+	content, err := ioutil.ReadFile(filepath.Join(root, recentIndexPath))
+	if os.IsNotExist(err) {
+		changes, err := buildRecentChanges(root)
+		if err != nil {
+			return nil, err
+		}
+		return changes, saveRecentChanges(root, changes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read recent changes: %v", err)
+	}
+	var changes []recentChange
+	if err := goyaml.Unmarshal(content, &changes); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal recent changes: %v", err)
+	}
+	file, err := os.Open(filepath.Join(root, recentLogPath))
+	if os.IsNotExist(err) {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open log of recent changes: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var change recentChange
+		// Skip incomplete lines, e.g. if the daemon crashed while writing.
+		if err := json.Unmarshal(scanner.Bytes(), &change); err == nil {
+			changes = mergeChange(changes, change)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read log of recent changes: %v", err)
+	}
+	if len(changes) > maxRecentChanges {
+		changes = changes[:maxRecentChanges]
+	}
+	return changes, nil
+}
+
+// saveRecentChanges writes the given changes to the index of the data
+// directory located at the given root and removes the log.
+func saveRecentChanges(root string, changes []recentChange) error {
+	if len(changes) > maxRecentChanges {
+		changes = changes[:maxRecentChanges]
+	}
+	content, err := goyaml.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("Could not marshal recent changes: %v", err)
+	}
+	file := filepath.Join(root, recentIndexPath)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("Could not create index directory: %v", err)
+	}
+	if err := writeFileAtomic(file, content, 0600); err != nil {
+		return fmt.Errorf("Could not write recent changes: %v", err)
+	}
+	err = os.Remove(filepath.Join(root, recentLogPath))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove log of recent changes: %v", err)
+	}
+	return nil
+}
+
+// mergeChange returns the given changes with the given change added,
+// replacing any older change of the same node.
+//
+// If the change is a removal, all descendants of the node will be marked as
+// removed, too.
+func mergeChange(changes []recentChange,
+	change recentChange) []recentChange {
+	updated := []recentChange{change}
+	for _, old := range changes {
+		switch {
+		case old.Path == change.Path:
+			if len(change.Title) == 0 {
+				updated[0].Title, updated[0].Type = old.Title, old.Type
+			}
+		case change.Removed && strings.HasPrefix(old.Path,
+			strings.TrimSuffix(change.Path, "/")+"/"):
+			old.Removed = true
+			updated = append(updated, old)
+		default:
+			updated = append(updated, old)
+		}
+	}
+	sort.Stable(recentChangeList(updated))
+	return updated
+}
+
+// appendChange appends the given change to the log of the data directory
+// located at the given root. Returns the size of the log.
+func appendChange(root string, change recentChange) (int64, error) {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return 0, fmt.Errorf("Could not marshal change: %v", err)
+	}
+	file, err := os.OpenFile(filepath.Join(root, recentLogPath),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("Could not open log of recent changes: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return 0, fmt.Errorf("Could not write log of recent changes: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("Could not stat log of recent changes: %v", err)
+	}
+	return info.Size(), nil
+}
+
+// recordChange adds the given change to the index of the data directory
+// located at the given root, replacing any older change of the same node.
+//
+// If the change is a removal, all descendants of the node will be marked as
+// removed, too. The change gets appended to a log, which is merged into the
+// index once it exceeds maxRecentLogSize. On failure, the index gets
+// deleted to be rebuilt on next use.
+func recordChange(root string, change recentChange) {
+	recentMutex.Lock()
+	defer recentMutex.Unlock()
+	// Make sure there's an index the log applies to.
+	_, err := os.Stat(filepath.Join(root, recentIndexPath))
+	if os.IsNotExist(err) {
+		_, err = loadRecentChanges(root)
+	}
+	var size int64
+	if err == nil {
+		size, err = appendChange(root, change)
+	}
+	if err == nil && size > maxRecentLogSize {
+		var changes []recentChange
+		if changes, err = loadRecentChanges(root); err == nil {
+			err = saveRecentChanges(root, changes)
+		}
+	}
+	if err != nil {
+		os.Remove(filepath.Join(root, recentIndexPath))
+		os.Remove(filepath.Join(root, recentLogPath))
+	}
+}
+
+// nodeChange returns a change of the node at the given path made by the user
+// with the given login right now.
+func nodeChange(root, nodePath, login string) recentChange {
+	change := recentChange{
+		Path: path.Clean("/" + nodePath),
+		User: login,
+		Time: time.Now().Format(nodeTimeFormat)}
+	if node, err := readStoredNode(root, nodePath); err == nil {
+		change.Title, change.Type = node.Title, node.Type
+	}
+	return change
+}
+
+// Recent handles requests to show the recent changes of the site.
+func (h *nodeHandler) Recent(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if node.Path != "/" {
+		h.renderError(w, r, "Page not found.", http.StatusNotFound, node,
+			cSession, site)
+		return
+	}
+	if r.Method != "GET" {
+		panic("Request method not supported: " + r.Method)
+	}
+	recentMutex.Lock()
+	changes, err := loadRecentChanges(site.Directories.Data)
+	recentMutex.Unlock()
+	if err != nil {
+		panic("Can't load recent changes: " + err.Error())
+	}
+	page, pages, start, end := paginate(r.URL.Query().Get("page"),
+		len(changes), recentPageSize)
+	type recentRow struct {
+		recentChange
+		URL, EditURL string
+	}
+	rows := make([]recentRow, 0, end-start)
+	for _, change := range changes[start:end] {
+		rows = append(rows, recentRow{change, site.URL(change.Path),
+			site.URL(path.Join(change.Path, "@@edit"))})
+	}
+	context := template.Context{"Changes": rows, "Page": page, "Pages": pages}
+	if page > 1 {
+		context["PrevURL"] = "?page=" + strconv.Itoa(page-1)
+	}
+	if page < pages {
+		context["NextURL"] = "?page=" + strconv.Itoa(page+1)
+	}
+	body := h.renderTemplate("daemon/actions/recent", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Recent changes"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
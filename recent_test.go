@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRecentChangeListSort(t *testing.T) {
+	changes := []recentChange{
+		{Path: "/a", Time: "02 Jan 06 15:04 UTC"},
+		{Path: "/b", Time: "03 Jan 06 15:04 UTC"},
+		{Path: "/d", Time: "02 Jan 06 16:04 UTC"},
+		{Path: "/c", Time: "02 Jan 06 16:04 UTC"}}
+	sort.Sort(recentChangeList(changes))
+	var paths []string
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	expected := []string{"/b", "/c", "/d", "/a"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Sorted changes are %v, should be %v", paths, expected)
+	}
+}
+
+func TestRecordChange(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `
+title: Root
+type: Document
+lastupdate: 01 Jan 06 15:04 UTC
+lastupdateby: admin`,
+		"/foo/node.yaml": `
+title: Foo
+type: Document
+lastupdate: 02 Jan 06 15:04 UTC
+lastupdateby: editor`,
+		"/foo/bar/node.yaml": `
+title: Bar
+type: Image
+lastupdate: 03 Jan 06 15:04 UTC
+lastupdateby: editor`}, "TestRecordChange")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	changes, err := loadRecentChanges(root)
+	if err != nil {
+		t.Fatalf("loadRecentChanges failed: %v", err)
+	}
+	expected := []recentChange{
+		{"/foo/bar", "Bar", "Image", "editor", "03 Jan 06 15:04 UTC", false},
+		{"/foo", "Foo", "Document", "editor", "02 Jan 06 15:04 UTC", false},
+		{"/", "Root", "Document", "admin", "01 Jan 06 15:04 UTC", false}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("loadRecentChanges(_) = %v, should be %v", changes, expected)
+	}
+	recordChange(root, recentChange{Path: "/", User: "foo",
+		Time: "04 Jan 06 15:04 UTC"})
+	recordChange(root, recentChange{Path: "/foo", Title: "Foo",
+		Type: "Document", User: "admin", Time: "05 Jan 06 15:04 UTC",
+		Removed: true})
+	changes, err = loadRecentChanges(root)
+	if err != nil {
+		t.Fatalf("loadRecentChanges failed: %v", err)
+	}
+	expected = []recentChange{
+		{"/foo", "Foo", "Document", "admin", "05 Jan 06 15:04 UTC", true},
+		{"/", "Root", "Document", "foo", "04 Jan 06 15:04 UTC", false},
+		{"/foo/bar", "Bar", "Image", "editor", "03 Jan 06 15:04 UTC", true}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Changes after recordChange are %v, should be %v", changes,
+			expected)
+	}
+}
+
+func TestRecentChangesLog(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `{"title": "Root", "type": "Document"}`},
+		"TestRecentChangesLog")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	indexFile := filepath.Join(root, recentIndexPath)
+	logFile := filepath.Join(root, recentLogPath)
+	recordChange(root, recentChange{Path: "/foo", Title: "Foo",
+		Time: "04 Jan 06 15:04 UTC"})
+	index, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		t.Fatalf("Index has not been written: %v", err)
+	}
+	recordChange(root, recentChange{Path: "/bar", Title: "Bar",
+		Time: "05 Jan 06 15:04 UTC"})
+	if after, _ := ioutil.ReadFile(indexFile); !bytes.Equal(after, index) {
+		t.Errorf("Changes should be appended to the log, not the index")
+	}
+	// Incomplete lines are skipped.
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Could not open log: %v", err)
+	}
+	f.Write([]byte(`{"Path": "/torn`))
+	f.Close()
+	changes, err := loadRecentChanges(root)
+	if err != nil || len(changes) != 3 || changes[1].Path != "/bar" ||
+		changes[2].Path != "/foo" {
+		t.Errorf("loadRecentChanges(_) = %v, %v, should include the log",
+			changes, err)
+	}
+	os.Remove(logFile)
+	// Enough changes to exceed maxRecentLogSize.
+	pages := 900
+	for i := 0; i < pages; i++ {
+		recordChange(root, recentChange{Path: fmt.Sprintf("/page%v", i),
+			Time: "06 Jan 06 15:04 UTC"})
+	}
+	if info, err := os.Stat(logFile); err == nil &&
+		info.Size() > maxRecentLogSize {
+		t.Errorf("Log should be merged into the index, has %v bytes",
+			info.Size())
+	}
+	changes, err = loadRecentChanges(root)
+	if err != nil || len(changes) != pages+1 {
+		t.Errorf("loadRecentChanges(_) returned %v changes, %v", len(changes),
+			err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	htmlT "html/template"
+	"path/filepath"
+	"strings"
+)
+
+// region is a content region of the master template, e.g. a sidebar.
+//
+// The content of a region is stored in the file <region name>.html of a
+// node's directory. Localized content may be stored in
+// <region name>.<locale>.html, e.g. footer.de.html.
+type region struct {
+	// Name of the region.
+	Name string
+	// Inherit makes nodes without own content for the region use the
+	// content of their nearest ancestor. An empty content file suppresses
+	// the inherited content.
+	Inherit bool
+	// Root makes all nodes use the region content of the root node.
+	Root bool
+}
+
+// defaultRegions are used for sites without configured regions.
+var defaultRegions = []region{
+	{Name: "below_header", Inherit: true},
+	{Name: "sidebar", Inherit: true},
+	{Name: "footer", Inherit: true}}
+
+// validRegionName checks if the given name may be used as region name.
+func validRegionName(name string) bool {
+	return len(name) > 0 && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, "/\\")
+}
+
+// regionFiles returns the names of the files to look for the content of the
+// given region in the given locale, most specific first.
+func regionFiles(name, locale string) []string {
+	var files []string
+	for _, candidate := range localeCandidates(locale) {
+		files = append(files, localizedFile(name+".html", candidate))
+	}
+	return append(files, name+".html")
+}
+
+// findRegion retrieves the content of the given region in the given locale
+// for the node at the given path of the data directory located at root.
+//
+// Returns the content and the path of the node defining it. The path is
+// empty if there is no content for the region.
+func findRegion(reg region, path, root, locale string) (content,
+	source string) {
+	if reg.Root {
+		path = "/"
+	}
+	files := regionFiles(reg.Name, locale)
+	for {
+		for _, name := range files {
+			content, err := getNodeFile(root, path, name)
+			if err == errInvalidPath {
+				return "", ""
+			}
+			if err == nil {
+				return string(content), path
+			}
+		}
+		if !reg.Inherit || path == filepath.Dir(path) {
+			return "", ""
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// getRegion retrieves the content of the given region in the given locale
+// for the node at the given path of the data directory located at root.
+//
+// Returns an empty string if there is no content for the region.
+func getRegion(reg region, path, root, locale string) string {
+	content, _ := findRegion(reg, path, root, locale)
+	return content
+}
+
+// siteRegions returns the regions of the given site.
+func siteRegions(site site) []region {
+	if site.Regions == nil {
+		return defaultRegions
+	}
+	return site.Regions
+}
+
+// getRegions retrieves the content of the given regions in the given locale
+// for the node at the given path of the data directory located at root.
+//
+// Returns a map of region names to their content. Regions without content
+// will be omitted.
+func getRegions(regions []region, path, root,
+	locale string) map[string]htmlT.HTML {
+	ret := make(map[string]htmlT.HTML, len(regions))
+	for _, reg := range regions {
+		if content := getRegion(reg, path, root, locale); len(content) > 0 {
+			ret[reg.Name] = htmlT.HTML(content)
+		}
+	}
+	return ret
+}
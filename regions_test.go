@@ -0,0 +1,156 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	"strings"
+	"testing"
+)
+
+func TestGetRegion(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/footer.html":        "root footer",
+		"/hero.html":          "root hero",
+		"/foo/footer.html":    "foo footer",
+		"/foo/hero.html":      "foo hero",
+		"/foo/bar/__empty__":  "",
+		"/cruz/bar/hero.html": "bar hero",
+		"/cruz/sidebar.html":  "cruz sidebar",
+		"/cruz/bar/__empty__": ""}, "TestGetRegion")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	hero := region{Name: "hero"}
+	inherited := region{Name: "hero", Inherit: true}
+	footer := region{Name: "footer", Root: true}
+	tests := []struct {
+		Region        region
+		Path, Content string
+	}{
+		{hero, "/", "root hero"},
+		{hero, "/foo", "foo hero"},
+		{hero, "/foo/bar", ""},
+		{hero, "/cruz", ""},
+		{inherited, "/foo/bar", "foo hero"},
+		{inherited, "/cruz", "root hero"},
+		{inherited, "/cruz/bar", "bar hero"},
+		{footer, "/foo", "root footer"},
+		{footer, "/cruz/bar", "root footer"},
+		{region{Name: "sidebar", Inherit: true}, "/cruz/bar", "cruz sidebar"},
+		{region{Name: "sidebar", Inherit: true}, "/foo", ""},
+		{region{Name: "missing", Inherit: true}, "/foo/bar", ""}}
+	for i, v := range tests {
+		ret := getRegion(v.Region, v.Path, root, "")
+		if ret != v.Content {
+			t.Errorf("Test %v: getRegion(%v, %q, _) = %q, should be %q", i,
+				v.Region, v.Path, ret, v.Content)
+		}
+	}
+}
+
+func TestGetDefaultRegions(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/footer.html":                 "root footer",
+		"/below_header.html":           "root banner",
+		"/foo/below_header.html":       "foo banner",
+		"/foo/footer.html":             "foo footer",
+		"/foo/bar/below_header.html":   "",
+		"/foo/bar/cruz/__empty__":      "",
+		"/other/sidebar.html":          "other sidebar",
+		"/other/child/sidebar.html":    "",
+		"/other/child/child/__empty__": ""}, "TestGetDefaultRegions")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Path                         string
+		BelowHeader, Sidebar, Footer string
+	}{
+		{"/", "root banner", "", "root footer"},
+		{"/foo", "foo banner", "", "foo footer"},
+		{"/foo/bar", "", "", "foo footer"},
+		{"/foo/bar/cruz", "", "", "foo footer"},
+		{"/other", "root banner", "other sidebar", "root footer"},
+		{"/other/child/child", "root banner", "", "root footer"}}
+	for i, v := range tests {
+		regions := getRegions(defaultRegions, v.Path, root, "")
+		if string(regions["below_header"]) != v.BelowHeader ||
+			string(regions["sidebar"]) != v.Sidebar ||
+			string(regions["footer"]) != v.Footer {
+			t.Errorf("Test %v: getRegions(defaultRegions, %q, _) = %v", i, v.Path, regions)
+		}
+	}
+}
+
+func TestValidRegionName(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Valid bool
+	}{
+		{"hero", true},
+		{"pre_footer", true},
+		{"", false},
+		{".revisions", false},
+		{"../node", false},
+		{"foo/bar", false}}
+	for _, v := range tests {
+		if ret := validRegionName(v.Name); ret != v.Valid {
+			t.Errorf("validRegionName(%q) = %v, should be %v", v.Name, ret,
+				v.Valid)
+		}
+	}
+}
+
+func TestGetRegionLocalized(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/footer.html":        "footer",
+		"/footer.de.html":     "Fußzeile",
+		"/foo/footer.html":    "foo footer",
+		"/foo/footer.fr.html": "foo pied de page",
+		"/foo/bar/__empty__":  "",
+	}, "TestGetRegionLocalized")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	footer := region{Name: "footer", Inherit: true}
+	tests := []struct {
+		Path, Locale, Content string
+	}{
+		{"/", "", "footer"},
+		{"/", "de", "Fußzeile"},
+		{"/", "de_DE", "Fußzeile"},
+		{"/", "en", "footer"},
+		{"/", "../x", "footer"},
+		{"/foo", "de", "foo footer"},
+		{"/foo", "fr", "foo pied de page"},
+		{"/foo/bar", "fr", "foo pied de page"},
+		{"/foo/bar", "de", "foo footer"}}
+	for i, v := range tests {
+		ret := getRegion(footer, v.Path, root, v.Locale)
+		if ret != v.Content {
+			t.Errorf("Test %v: getRegion(_, %q, _, %q) = %q, should be %q", i,
+				v.Path, v.Locale, ret, v.Content)
+		}
+	}
+}
+
+func TestRegionFiles(t *testing.T) {
+	tests := []struct {
+		Locale string
+		Files  []string
+	}{
+		{"", []string{"footer.html"}},
+		{"de", []string{"footer.de.html", "footer.html"}},
+		{"de_DE", []string{"footer.de_DE.html", "footer.de.html", "footer.html"}},
+		{"../de", []string{"footer.html"}},
+		{"de/x", []string{"footer.html"}}}
+	for _, v := range tests {
+		ret := regionFiles("footer", v.Locale)
+		if strings.Join(ret, ",") != strings.Join(v.Files, ",") {
+			t.Errorf("regionFiles(\"footer\", %q) = %v, should be %v", v.Locale,
+				ret, v.Files)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"reflect"
+	"sort"
+)
+
+// diffSites returns human readable descriptions of the differences between
+// the given old and new sites.
+func diffSites(oldSites, newSites map[string]site) []string {
+	var changes []string
+	names := make([]string, 0, len(oldSites)+len(newSites))
+	for name := range oldSites {
+		names = append(names, name)
+	}
+	for name := range newSites {
+		if _, ok := oldSites[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldSite, inOld := oldSites[name]
+		newSite, inNew := newSites[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("Added site %q with hosts %v",
+				name, newSite.Hosts))
+			continue
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("Removed site %q", name))
+			continue
+		}
+		for _, host := range newSite.Hosts {
+			if !inStringSlice(host, oldSite.Hosts) {
+				changes = append(changes, fmt.Sprintf("Added host %q to site %q",
+					host, name))
+			}
+		}
+		for _, host := range oldSite.Hosts {
+			if !inStringSlice(host, newSite.Hosts) {
+				changes = append(changes, fmt.Sprintf(
+					"Removed host %q from site %q", host, name))
+			}
+		}
+		oldSite.Name, oldSite.Hosts = "", nil
+		newSite.Name, newSite.Hosts = "", nil
+		if !reflect.DeepEqual(oldSite, newSite) {
+			changes = append(changes, fmt.Sprintf("Changed settings of site %q",
+				name))
+		}
+	}
+	return changes
+}
+
+// Reload reloads the settings from the given configuration directory.
+//
+// Site and host changes apply immediately. Read-only modes set on the status
+// page will be kept. The handler's settings are replaced at once and apply
+// to requests started after the reload. Workers will be started for new node
+// types and restarted if their command, arguments, environment or working
+// directory changed. Cached templates will be reread. Settings only read on
+// startup, e.g. of the listeners, the login limiter or the workers of
+// unchanged node types, apply after the next restart.
+func (h *nodeHandler) Reload(cfgPath string) error {
+	newSettings, err := loadSettings(cfgPath)
+	if err != nil {
+		return fmt.Errorf("Could not load settings: %v", err)
+	}
+	commands := make(map[string]worker.Command, len(newSettings.NodeTypes))
+	var changedCommands []string
+	for _, nodeType := range newSettings.NodeTypes {
+		command, err := newSettings.workerCommand(nodeType)
+		if err != nil {
+			return err
+		}
+		commands[nodeType] = command
+		old, err := h.workerCommand(nodeType)
+		if _, ok := h.nodeQueue(nodeType); ok &&
+			(err != nil || !reflect.DeepEqual(old, command)) {
+			changedCommands = append(changedCommands, nodeType)
+		}
+	}
+	h.mutex.Lock()
+	h.commands = commands
+	h.mutex.Unlock()
+	h.Renderer.Flush()
+	setContentModes(newSettings.ContentModes)
+	h.Sites.KeepReadOnly(newSettings.Sites)
+	oldSites := h.Sites.All()
+	changes := diffSites(oldSites, newSettings.Sites)
+	for name, site := range newSettings.Sites {
+		if len(site.LogFile) == 0 || oldSites[name].LogFile == site.LogFile {
+			continue
+		}
+		siteLog, err := openSiteLogger(site.LogFile, name, h.Log.Level)
+		if err != nil {
+			return fmt.Errorf("Could not open log file of site %q: %v", name, err)
+		}
+		h.mutex.Lock()
+		h.SiteLogs[name] = siteLog
+		h.mutex.Unlock()
+	}
+	if newSettings.DefaultSite != h.Sites.DefaultSite() {
+		changes = append(changes, fmt.Sprintf("Changed default site to %q",
+			newSettings.DefaultSite))
+	}
+	for _, site := range newSettings.Sites {
+		siteWriteLock(site)
+	}
+	h.Sites.Set(newSettings.Sites, newSettings.DefaultSite)
+	h.reloaded.Store(newSettings)
+	h.enableCaches(newSettings, newSettings.Sites)
+	if h.Certificates != nil {
+		for _, err := range h.Certificates.Load(newSettings.Sites,
+			newSettings.DefaultSite) {
+			h.Log.Error("%v", err)
+		}
+	}
+	for _, change := range changes {
+		h.Log.Info("%v", change)
+	}
+	for _, nodeType := range newSettings.NodeTypes {
+		if _, ok := h.nodeQueue(nodeType); !ok {
+			h.Log.Info("Added node type %q", nodeType)
+			h.AddNodeProcess(nodeType, h.Log.Logger)
+		}
+	}
+	for _, nodeType := range changedCommands {
+		h.Log.Info("Restarting worker of node type %q to apply its new command",
+			nodeType)
+		if err := h.restartWorker(nodeType); err != nil {
+			h.Log.Error("Could not restart worker: %v", err)
+		}
+	}
+	h.Log.Info("Reloaded settings.")
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSites(t *testing.T) {
+	foo := site{Title: "Foo", Hosts: []string{"foo.example.com"}}
+	fooMoved := site{Title: "Foo", Hosts: []string{"www.foo.example.com"}}
+	fooRenamed := site{Title: "Foo!", Hosts: []string{"foo.example.com"}}
+	bar := site{Title: "Bar", Hosts: []string{"bar.example.com"}}
+	tests := []struct {
+		Old, New map[string]site
+		Changes  []string
+	}{
+		{map[string]site{"foo": foo}, map[string]site{"foo": foo}, nil},
+		{map[string]site{"foo": foo}, map[string]site{"foo": foo, "bar": bar},
+			[]string{`Added site "bar" with hosts [bar.example.com]`}},
+		{map[string]site{"foo": foo, "bar": bar}, map[string]site{"foo": foo},
+			[]string{`Removed site "bar"`}},
+		{map[string]site{"foo": foo}, map[string]site{"foo": fooMoved},
+			[]string{`Added host "www.foo.example.com" to site "foo"`,
+				`Removed host "foo.example.com" from site "foo"`}},
+		{map[string]site{"foo": foo}, map[string]site{"foo": fooRenamed},
+			[]string{`Changed settings of site "foo"`}}}
+	for i, v := range tests {
+		changes := diffSites(v.Old, v.New)
+		if !reflect.DeepEqual(changes, v.Changes) {
+			t.Errorf("Test %v: diffSites(...) = %v, should be %v", i, changes,
+				v.Changes)
+		}
+	}
+}
+
+func TestCurrentSettings(t *testing.T) {
+	initial := &settings{SlowRequestMillis: 100}
+	h := nodeHandler{Settings: initial}
+	if ret := h.currentSettings(); ret != initial {
+		t.Errorf("currentSettings() = %v, should be %v", ret, initial)
+	}
+	reloaded := &settings{SlowRequestMillis: 200}
+	h.reloaded.Store(reloaded)
+	if ret := h.currentSettings(); ret != reloaded {
+		t.Errorf("currentSettings() = %v, should be %v", ret, reloaded)
+	}
+	if h.Settings != initial {
+		t.Errorf("Settings = %v, should be %v", h.Settings, initial)
+	}
+}
@@ -14,6 +14,12 @@ type masterTmplFlags uint32
 
 const (
 	EDIT_VIEW masterTmplFlags = 1 << iota
+	// PREVIEW_VIEW marks the content as preview of unsaved changes.
+	PREVIEW_VIEW
+	// PROTECTED_NODE marks nodes which can't be removed, so the remove
+	// action should not be offered. Set by renderInMaster for protected
+	// nodes, see nodeProtected.
+	PROTECTED_NODE
 )
 
 // Environment/context for the master template.
@@ -22,6 +28,25 @@ type masterTmplEnv struct {
 	Session            *client.Session
 	Title, Description string
 	Flags              masterTmplFlags
+	// Access is used to omit restricted nodes from the navigations. If nil,
+	// e.g. for errors before the user has been authenticated, only nodes
+	// anonymous users may view will be shown.
+	Access *nodeAccess
+	// EditLock is the lock of another user editing the node. If set, a
+	// warning with a form posting to TakeoverURL will be shown.
+	EditLock    *editLock
+	TakeoverURL string
+	// CSRFToken is the token of the takeover form.
+	CSRFToken string
+	// NodeLocale is the locale of the served translation of the node. Empty
+	// if the untranslated node is served.
+	NodeLocale string
+	// Debug is the debug information of the request. If set, the debug
+	// toolbar will be appended to the page.
+	Debug *debugInfo
+	// Fields are the custom fields of the node. Loaded from the node's
+	// node.yaml file if nil.
+	Fields nodeFields
 }
 
 // splitFirstDir returns the first directory in the given path.
@@ -33,26 +58,76 @@ func splitFirstDir(path string) string {
 }
 
 // renderInMaster renders the content in the master template.
-func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
+func renderInMaster(r renderer, content []byte, env masterTmplEnv,
 	settings *settings, site site, locale string) string {
-	firstDir := splitFirstDir(env.Node.Path)
-	prinav, err := getNav("/", path.Join("/", firstDir),
-		site.Directories.Data)
-	prinav.MakeAbsolute(firstDir)
-	if err != nil {
-		panic(fmt.Sprint("Could not get primary navigation: ", err))
+	master := r
+	if env.Access == nil {
+		env.Access = newNodeAccess(site.Directories.Data, nil)
+	}
+	if env.Debug != nil {
+		r = debugRenderer{r, env.Debug}
+	}
+	theme := site.Theme
+	var prinav, secnav navigation
+	var prinavRoot, secnavRoot string
+	var err error
+	if theme.navigation() != themeNavNone {
+		firstDir := splitFirstDir(env.Node.Path)
+		prinav, prinavRoot, err = findNav("/", path.Join("/", firstDir),
+			site.Directories.Data, env.Access, locale)
+		prinav.MakeAbsolute(firstDir)
+		if err != nil {
+			panic(fmt.Sprint("Could not get primary navigation: ", err))
+		}
+		prinav.MakeAbsolute(site.URL("/"))
 	}
-	prinav.MakeAbsolute("/")
-	var secnav navigation = nil
-	if env.Node.Path != "/" {
-		secnav, err = getNav(env.Node.Path, env.Node.Path, site.Directories.Data)
+	if env.Node.Path != "/" && theme.navigation() == themeNavFull {
+		secnav, secnavRoot, err = findNav(env.Node.Path, env.Node.Path,
+			site.Directories.Data, env.Access, locale)
 		if err != nil {
 			panic(fmt.Sprint("Could not get secondary navigation: ", err))
 		}
-		secnav.MakeAbsolute(env.Node.Path)
+		secnav.MakeAbsolute(site.URL(env.Node.Path))
+	}
+	menus, err := getMenus(site, env.Node.Path, env.Access)
+	if err != nil {
+		panic(fmt.Sprint("Could not get menus: ", err))
+	}
+	var breadcrumbs navigation
+	if theme != nil && theme.Breadcrumbs {
+		breadcrumbs = getBreadcrumbs(site.Directories.Data, env.Node.Path,
+			env.Access, locale)
+		for i := range breadcrumbs {
+			breadcrumbs[i].Target = site.URL(breadcrumbs[i].Target)
+		}
+	}
+	if theme != nil && theme.NavigationFields {
+		prinav.loadFields(site)
+		secnav.loadFields(site)
+		breadcrumbs.loadFields(site)
+	}
+	if nodeProtected(env.Node.Path, site.ProtectedPaths) {
+		env.Flags |= PROTECTED_NODE
+	}
+	if env.Fields == nil {
+		env.Fields = getNodeFields(site.Directories.Data, env.Node.Path)
+	}
+	var translations []string
+	if theme == nil || !theme.DisableTranslations {
+		translations = nodeTranslations(site.Directories.Data, env.Node.Path)
+	}
+	regions := getRegions(theme.regions(site), env.Node.Path,
+		site.Directories.Data, locale)
+	if env.Debug != nil {
+		env.Debug.PrimaryNavRoot, env.Debug.SecondaryNavRoot = prinavRoot,
+			secnavRoot
+		for _, reg := range theme.regions(site) {
+			_, source := findRegion(reg, env.Node.Path, site.Directories.Data,
+				locale)
+			env.Debug.Regions = append(env.Debug.Regions,
+				debugRegion{reg.Name, source})
+		}
 	}
-	sidebarContent := getSidebar(env.Node.Path, site.Directories.Data)
-	belowHeader := getBelowHeader(env.Node.Path, site.Directories.Data)
 	title := env.Node.Title
 	if env.Title != "" {
 		title = env.Title
@@ -61,22 +136,51 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	if env.Title != "" {
 		description = env.Description
 	}
-	return r.Render("master", template.Context{
+	if env.Flags&PREVIEW_VIEW != 0 {
+		content = append([]byte(r.Render("daemon/actions/preview",
+			template.Context{"Node": env.Node}, locale,
+			site.Directories.Templates)), content...)
+	}
+	if env.EditLock != nil {
+		content = append([]byte(r.Render("daemon/actions/editlock",
+			template.Context{"Lock": env.EditLock, "TakeoverURL": env.TakeoverURL,
+				"CSRFToken": env.CSRFToken},
+			locale, site.Directories.Templates)), content...)
+	}
+	embed := newEmbedder(site.Directories.Data, env.Access, locale,
+		env.Node.Path)
+	embed.Assets = newAssetResolver(settings, site)
+	page := r.Render("master", template.Context{
+		"Embed": embed,
 		"Site": template.Context{
-			"Title": site.Title,
+			"Title":    site.Title,
+			"BasePath": site.BasePath,
 		},
 		"Page": template.Context{
 			"Node":             env.Node,
+			"Fields":           env.Fields,
+			"Locale":           env.NodeLocale,
+			"Translations":     translations,
+			"Breadcrumbs":      breadcrumbs,
 			"PrimaryNav":       prinav,
 			"SecondaryNav":     secnav,
+			"Menus":            menus,
 			"EditView":         env.Flags&EDIT_VIEW != 0,
-			"ShowBelowHeader":  len(belowHeader) > 0 && (env.Flags&EDIT_VIEW == 0),
-			"BelowHeader":      htmlT.HTML(belowHeader),
-			"Footer":           htmlT.HTML(getFooter(site.Directories.Data)),
-			"Sidebar":          htmlT.HTML(sidebarContent),
+			"Preview":          env.Flags&PREVIEW_VIEW != 0,
+			"Protected":        env.Flags&PROTECTED_NODE != 0,
+			"ShowBelowHeader":  len(regions["below_header"]) > 0 && (env.Flags&EDIT_VIEW == 0),
+			"BelowHeader":      regions["below_header"],
+			"Footer":           regions["footer"],
+			"Sidebar":          regions["sidebar"],
+			"Regions":          regions,
 			"Title":            title,
 			"Description":      description,
 			"Content":          htmlT.HTML(content),
 			"ShowSecondaryNav": len(secnav) > 0},
 		"Session": env.Session}, locale, site.Directories.Templates)
+	if env.Debug != nil {
+		page = appendToolbar(master, page, env.Debug, locale,
+			site.Directories.Templates)
+	}
+	return page
 }
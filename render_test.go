@@ -70,7 +70,7 @@ The content.`}}
 	for i, v := range tests {
 		session := client.Session{
 			User: &client.User{Login: "admin", Name: "Administrator"}}
-		env := masterTmplEnv{v.Node, &session, "", "", 0}
+		env := masterTmplEnv{Node: v.Node, Session: &session}
 		ret := renderInMaster(renderer, []byte(v.Content), env, new(settings),
 			site, "")
 		for strings.Contains(ret, "\n\n") {
@@ -90,3 +90,50 @@ Should be:
 		}
 	}
 }
+
+func TestRenderInMasterProtected(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":        `{"title": "Home"}`,
+		"/data/foo/node.yaml":    `{"title": "Foo"}`,
+		"/data/bar/node.yaml":    `{"title": "Bar"}`,
+		"/templates/master.html": `{{if .Page.Protected}}protected{{end}}`},
+		"TestRenderInMasterProtected")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r := &templateRenderer{Root: filepath.Join(root, "templates")}
+	site := site{ProtectedPaths: []string{"/foo"}}
+	site.Directories.Data = filepath.Join(root, "data")
+	for nodePath, rendered := range map[string]string{
+		"/": "protected", "/foo": "protected", "/bar": ""} {
+		ret := renderInMaster(r, nil, masterTmplEnv{
+			Node: client.Node{Path: nodePath}}, new(settings), site, "")
+		if ret != rendered {
+			t.Errorf("renderInMaster(...) of %v returned %q, should be %q",
+				nodePath, ret, rendered)
+		}
+	}
+}
+
+func TestRenderInMasterAnonymous(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":        `{"title": "Home"}`,
+		"/data/foo/node.yaml":    `{"title": "Foo"}`,
+		"/data/secret/node.yaml": `{"title": "Secret", "restrict": "login"}`,
+		"/templates/master.html": `{{range .Page.PrimaryNav}}|{{.Name}}{{end}}`},
+		"TestRenderInMasterAnonymous")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r := &templateRenderer{Root: filepath.Join(root, "templates")}
+	site := site{}
+	site.Directories.Data = filepath.Join(root, "data")
+	ret := renderInMaster(r, nil, masterTmplEnv{Node: client.Node{Path: "/"}},
+		new(settings), site, "")
+	if ret != "|Foo" {
+		t.Errorf("renderInMaster(...) without access returned %q, should be"+
+			" %q", ret, "|Foo")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	htmlT "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// renderer renders named templates, e.g. the master template.
+//
+// It's implemented by templateRenderer and util/template's Renderer.
+type renderer interface {
+	Render(name string, context interface{}, locale,
+		siteTemplates string) string
+}
+
+// templateError is the panic value of templateRenderer if a template can't
+// be parsed or executed.
+type templateError struct {
+	// File is the template's file.
+	File string
+	// Err is the parse or execution error. It contains the line number.
+	Err error
+}
+
+func (e *templateError) Error() string {
+	return fmt.Sprintf("Could not render template %v: %v", e.File, e.Err)
+}
+
+// templateRenderer renders templates looking them up in the site's template
+// directory before the shared one.
+//
+// In production mode, parsed templates are cached per locale until Flush is
+// called. Rendering a small cached template takes about a quarter of the time
+// needed to parse and render it (roughly 9µs vs. 34µs, see
+// BenchmarkRenderCached and BenchmarkRenderUncached).
+type templateRenderer struct {
+	// Root is the shared template directory.
+	Root string
+	// Dev enables the development mode: Templates will be read on each
+	// render.
+	Dev bool
+	// mutex protects cache.
+	mutex sync.RWMutex
+	// cache maps template files and locales to the parsed templates.
+	cache map[string]*parsedTemplate
+}
+
+// Flush empties the template cache.
+func (r *templateRenderer) Flush() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cache = nil
+}
+
+// parsedTemplate is a parsed template of the cache.
+type parsedTemplate struct {
+	*htmlT.Template
+	// Embeds is true iff the template uses functions to embed other nodes.
+	// Their functions depend on the request, so the template must be cloned
+	// for each render and never be executed itself.
+	Embeds bool
+}
+
+// templateRefs matches the invocations of other templates, capturing their
+// names.
+var templateRefs = regexp.MustCompile(`{{-?\s*template\s+"([^"]+)"`)
+
+// lookup returns the file of the template with the given name.
+func (r *templateRenderer) lookup(name, siteTemplates string) string {
+	files := templateSearchPath(name, siteTemplates, r.Root)
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return files[len(files)-1]
+}
+
+// parseIncludes parses the templates invoked by the given template source
+// into the given set, e.g. the shared blocks/form template. They are looked
+// up like any other template, so sites may override them.
+//
+// Returns true iff one of them uses functions to embed other nodes.
+func (r *templateRenderer) parseIncludes(set *htmlT.Template, source,
+	siteTemplates string) (bool, error) {
+	embeds := false
+	for _, match := range templateRefs.FindAllStringSubmatch(source, -1) {
+		name := match[1]
+		if set.Lookup(name) != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(r.lookup(name, siteTemplates))
+		if err != nil {
+			return false, err
+		}
+		if _, err := set.New(name).Parse(string(content)); err != nil {
+			return false, err
+		}
+		nested, err := r.parseIncludes(set, string(content), siteTemplates)
+		if err != nil {
+			return false, err
+		}
+		embeds = embeds || nested || usesEmbedFuncs(string(content))
+	}
+	return embeds, nil
+}
+
+// parse returns the parsed template of the given file for the given locale,
+// including the templates it invokes.
+func (r *templateRenderer) parse(file, siteTemplates, locale string) (
+	*parsedTemplate, error) {
+	key := file + "\x00" + siteTemplates + "\x00" + locale
+	if !r.Dev {
+		r.mutex.RLock()
+		tmpl, ok := r.cache[key]
+		r.mutex.RUnlock()
+		if ok {
+			return tmpl, nil
+		}
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	funcs := embedFuncs(nil)
+	funcs["G"] = l10n.UseCatalog(locale)
+	parsed, err := htmlT.New(filepath.Base(file)).Funcs(funcs).Parse(
+		string(content))
+	if err != nil {
+		return nil, err
+	}
+	embeds, err := r.parseIncludes(parsed, string(content), siteTemplates)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &parsedTemplate{parsed, embeds || usesEmbedFuncs(string(content))}
+	if !r.Dev {
+		r.mutex.Lock()
+		if r.cache == nil {
+			r.cache = make(map[string]*parsedTemplate)
+		}
+		r.cache[key] = tmpl
+		r.mutex.Unlock()
+	}
+	return tmpl, nil
+}
+
+// Render renders the template with the given name in the given locale.
+//
+// If the context is a template.Context containing an *embedder with the key
+// Embed, it will be used for the functions embedding other nodes.
+//
+// Panics with a *templateError if the template can't be rendered.
+func (r *templateRenderer) Render(name string, context interface{}, locale,
+	siteTemplates string) string {
+	file := r.lookup(name, siteTemplates)
+	parsed, err := r.parse(file, siteTemplates, locale)
+	if err != nil {
+		panic(&templateError{file, err})
+	}
+	tmpl := parsed.Template
+	if parsed.Embeds {
+		if tmpl, err = tmpl.Clone(); err != nil {
+			panic(&templateError{file, err})
+		}
+		var emb *embedder
+		if ctx, ok := context.(template.Context); ok {
+			emb, _ = ctx["Embed"].(*embedder)
+		}
+		tmpl.Funcs(embedFuncs(emb))
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, context); err != nil {
+		panic(&templateError{file, err})
+	}
+	return buf.String()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateRendererCache(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo.html": "old {{.}}"}, "TestTemplateRendererCache")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Dev                         bool
+		Before, Changed, AfterFlush string
+	}{
+		{false, "old x", "old x", "new x"},
+		{true, "old x", "new x", "new x"}}
+	for i, v := range tests {
+		if err := ioutil.WriteFile(filepath.Join(root, "foo.html"),
+			[]byte("old {{.}}"), 0600); err != nil {
+			t.Fatalf("Could not write template: %v", err)
+		}
+		r := &templateRenderer{Root: root, Dev: v.Dev}
+		before := r.Render("foo", "x", "", "")
+		if err := ioutil.WriteFile(filepath.Join(root, "foo.html"),
+			[]byte("new {{.}}"), 0600); err != nil {
+			t.Fatalf("Could not write template: %v", err)
+		}
+		changed := r.Render("foo", "x", "", "")
+		r.Flush()
+		afterFlush := r.Render("foo", "x", "", "")
+		if before != v.Before || changed != v.Changed ||
+			afterFlush != v.AfterFlush {
+			t.Errorf("Test %v: Rendered %q, %q, %q; should be %q, %q, %q", i,
+				before, changed, afterFlush, v.Before, v.Changed, v.AfterFlush)
+		}
+	}
+}
+
+func TestTemplateRendererError(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/broken.html": "line 1\n{{if}}"}, "TestTemplateRendererError")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	defer func() {
+		tErr, ok := recover().(*templateError)
+		if !ok {
+			t.Fatalf("Render should panic with a *templateError")
+		}
+		msg := tErr.Error()
+		if !strings.Contains(msg, filepath.Join(root, "broken.html")) ||
+			!strings.Contains(msg, ":2:") {
+			t.Errorf("Error should contain file name and line, got %q", msg)
+		}
+	}()
+	r := &templateRenderer{Root: root, Dev: true}
+	r.Render("broken", nil, "", "")
+}
+
+func TestTemplateRendererIncludes(t *testing.T) {
+	files := map[string]string{
+		"/shared/blocks/form.html": "<form>shared</form>",
+		"/site/blocks/form.html":   "<form>site</form>"}
+	for _, name := range []string{"addform", "loginform"} {
+		content, err := ioutil.ReadFile(filepath.Join("templates", "actions",
+			name+".html"))
+		if err != nil {
+			t.Fatalf("Could not read template: %v", err)
+		}
+		files["/shared/daemon/actions/"+name+".html"] = string(content)
+	}
+	root, cleanup, err := utesting.CreateDirectoryTree(files,
+		"TestTemplateRendererIncludes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r := &templateRenderer{Root: filepath.Join(root, "shared")}
+	tests := []struct {
+		Name, SiteTemplates, Form string
+	}{
+		{"daemon/actions/addform", "", "<form>shared</form>"},
+		{"daemon/actions/loginform", "", "<form>shared</form>"},
+		{"daemon/actions/loginform", filepath.Join(root, "site"),
+			"<form>site</form>"}}
+	for i, v := range tests {
+		ret := r.Render(v.Name, nil, "", v.SiteTemplates)
+		if !strings.Contains(ret, v.Form) {
+			t.Errorf("Test %v: Render(%q, ...) = %q, should contain %q", i,
+				v.Name, ret, v.Form)
+		}
+	}
+}
+
+// benchmarkRender renders a small template with the given renderer settings.
+func benchmarkRender(b *testing.B, dev bool) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/page.html": `<h1>{{.Title}}</h1>{{range .Items}}<p>{{G "Item"}} {{.}}</p>{{end}}`},
+		"benchmarkRender")
+	if err != nil {
+		b.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r := &templateRenderer{Root: root, Dev: dev}
+	context := map[string]interface{}{"Title": "Foo",
+		"Items": []string{"a", "b", "c"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Render("page", context, "", "")
+	}
+}
+
+func BenchmarkRenderCached(b *testing.B) {
+	benchmarkRender(b, false)
+}
+
+func BenchmarkRenderUncached(b *testing.B) {
+	benchmarkRender(b, true)
+}
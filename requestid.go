@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/context"
+	"net/http"
+)
+
+// requestIDHeader is the header holding the ID of a request.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the maximum length of request IDs set by trusted
+// proxies.
+const maxRequestIDLength = 64
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic("Could not generate request ID: " + err.Error())
+	}
+	return hex.EncodeToString(id)
+}
+
+// validRequestID checks if the given request ID set by a proxy may be used,
+// i.e. if it's not too long and safe to be logged.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// setRequestID assigns an ID to the given request and sets the response
+// header.
+//
+// The trace ID of traced requests will be used, so logs and traces can be
+// correlated. Otherwise, IDs set by trusted proxies will be reused. Headers
+// of untrusted clients have already been removed by applyProxyHeaders.
+func setRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if span := requestSpan(r); span != nil {
+		id = span.TraceID
+		r.Header.Set(requestIDHeader, id)
+	} else if !validRequestID(id) {
+		id = newRequestID()
+		r.Header.Set(requestIDHeader, id)
+	}
+	context.Set(r, requestIDKey, id)
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// requestID returns the ID of the given request.
+func requestID(r *http.Request) string {
+	id, _ := context.Get(r, requestIDKey).(string)
+	return id
+}
+
+// requestLog returns the logger to be used for messages concerning the given
+// request of the given site. Messages will be prefixed with the request's ID.
+func (h *nodeHandler) requestLog(r *http.Request,
+	siteName string) *leveledLogger {
+	log := h.SiteLog(siteName)
+	if id := requestID(r); len(id) > 0 {
+		return log.withPrefix("[" + id + "] ")
+	}
+	return log
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		ID    string
+		Valid bool
+	}{
+		{"", false},
+		{"0123456789abcdef", true},
+		{"req-1.A_b", true},
+		{"evil\nINFO: fake", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false}}
+	for _, v := range tests {
+		if ret := validRequestID(v.ID); ret != v.Valid {
+			t.Errorf("validRequestID(%q) = %v, should be %v", v.ID, ret, v.Valid)
+		}
+	}
+	if id := newRequestID(); !validRequestID(id) || id == newRequestID() {
+		t.Errorf("newRequestID() returned invalid or repeated ID %q", id)
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRequestIDPropagation")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.1"})
+	var logBuf bytes.Buffer
+	tickets := make(chan worker.Ticket, 1)
+	h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+		tickets <- ticket
+		ticket.ResponseChan <- client.Response{Body: []byte("ok"), Raw: true}
+	})
+	defer stop()
+	h.Settings.Proxies = proxies
+	tests := []struct {
+		RemoteAddr, Header string
+		Reused             bool
+	}{
+		{"192.0.2.1:1234", "", false},
+		{"192.0.2.1:1234", "from-client", false},
+		{"10.0.0.1:1234", "from-proxy", true},
+		{"10.0.0.1:1234", "bad id", false}}
+	for i, v := range tests {
+		logBuf.Reset()
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+		r.RemoteAddr = v.RemoteAddr
+		if len(v.Header) > 0 {
+			r.Header.Set(requestIDHeader, v.Header)
+		}
+		h.ServeHTTP(w, r)
+		ticket := <-tickets
+		id := w.Header().Get(requestIDHeader)
+		if !validRequestID(id) || ticket.RequestID != id {
+			t.Errorf("Test %v: Response has ID %q, ticket %q", i, id,
+				ticket.RequestID)
+		}
+		if (id == v.Header) != v.Reused {
+			t.Errorf("Test %v: Request ID %q reused: %v, should be %v", i,
+				v.Header, id == v.Header, v.Reused)
+		}
+		if !strings.Contains(logBuf.String(), "["+id+"] GET /foo/") {
+			t.Errorf("Test %v: Log should contain the request ID, got %q", i,
+				logBuf.String())
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/chrneumann/mimemail"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/form"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// defaultResetExpiry is the time a password reset token stays valid if the
+// site does not specify otherwise.
+const defaultResetExpiry = time.Hour
+
+// checkResetToken returns true iff the given token matches the user's
+// current, not yet expired reset token.
+func checkResetToken(user *user, token string, now time.Time) bool {
+	if len(user.ResetToken) == 0 || len(token) == 0 ||
+		now.Unix() >= user.ResetExpiry {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(user.ResetToken),
+		[]byte(hashToken(token))) == 1
+}
+
+// findUserByLoginOrEmail returns the index of the enabled user with the given
+// login or email address or -1.
+func findUserByLoginOrEmail(users []user, id string) int {
+	for i, user := range users {
+		if !user.Disabled && len(id) > 0 &&
+			(user.Login == id || user.Email == id) {
+			return i
+		}
+	}
+	return -1
+}
+
+type requestResetFormData struct {
+	Login     string
+	CSRFToken string
+}
+
+type resetFormData struct {
+	Password, Confirm string
+	CSRFToken         string
+}
+
+// ResetPassword handles password reset requests.
+//
+// Without a token query parameter, a form to request a reset link will be
+// shown. Otherwise a form to set a new password.
+func (h *nodeHandler) ResetPassword(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	if len(r.URL.Query().Get("token")) > 0 {
+		h.resetPassword(w, r, node, session, cSession, site)
+		return
+	}
+	G := l10n.UseCatalog(cSession.Locale)
+	data := requestResetFormData{}
+	form := form.NewForm(&data, form.Fields{
+		"Login": form.Field{G("Login or email address"), "",
+			form.Required(G("Required.")), nil},
+		"CSRFToken": csrfField()})
+	message := ""
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		if form.Fill(r.Form) {
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			// Don't reveal whether the account exists, not even by the time it
+			// takes to send the email.
+			scheme, log := requestScheme(r), h.requestLog(r, site.Name)
+			id, locale := data.Login, cSession.Locale
+			go func() {
+				if err := h.sendResetToken(scheme, node, site, id,
+					locale); err != nil {
+					log.Error("Could not send password reset token: %v", err)
+				}
+			}()
+			message = G("If the account exists, an email with instructions to reset the password has been sent.")
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	data.CSRFToken = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/resetpassword", template.Context{
+		"Form": form.RenderData(), "Message": message},
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Reset password"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+// storeResetToken stores the given reset token expiring at the given time
+// for the user with the given login or email address of the site with the
+// given configuration directory.
+//
+// Returns the user or nil if there is no such user.
+func storeResetToken(configDir, id, token string, expiry time.Time) (*user,
+	error) {
+	defer lockUsers(configDir)()
+	users, err := loadUsers(configDir)
+	if err != nil {
+		return nil, err
+	}
+	idx := findUserByLoginOrEmail(users, id)
+	if idx == -1 {
+		return nil, nil
+	}
+	users[idx].ResetToken = hashToken(token)
+	users[idx].ResetExpiry = expiry.Unix()
+	if err := saveUsers(configDir, users); err != nil {
+		return nil, err
+	}
+	return &users[idx], nil
+}
+
+// sendResetToken generates a new reset token for the user with the given
+// login or email address and sends a reset link to the user.
+//
+// The link will use the given scheme. Does nothing if there is no such
+// user.
+func (h *nodeHandler) sendResetToken(scheme string, node client.Node,
+	site site, id, locale string) error {
+	G := l10n.UseCatalog(locale)
+	token := randomToken()
+	expiry := defaultResetExpiry
+	if site.PasswordResetExpiry > 0 {
+		expiry = time.Duration(site.PasswordResetExpiry) * time.Minute
+	}
+	u, err := storeResetToken(site.Directories.Config, id, token,
+		time.Now().Add(expiry))
+	if err != nil || u == nil {
+		return err
+	}
+	if len(site.host()) == 0 {
+		return fmt.Errorf("Missing host of site %q for the reset link",
+			site.Name)
+	}
+	link := url.URL{
+		Scheme: scheme,
+		Host:   site.host(),
+		Path:   site.URL(path.Join(node.Path, "@@reset-password")),
+		RawQuery: url.Values{
+			"login": []string{u.Login},
+			"token": []string{token}}.Encode()}
+	mail := mimemail.Mail{
+		To:      []mimemail.Address{{u.Name, u.Email}},
+		Subject: fmt.Sprintf(G("Reset your password for %v"), site.Title),
+		Body: []byte(fmt.Sprintf(G("Follow this link to set a new password: %v\n\nThe link expires in %v minutes."),
+			link.String(), int(expiry.Minutes())))}
+	return sendMail(h.currentSettings(), site, mail)
+}
+
+// resetPassword handles requests to set a new password using a reset token.
+func (h *nodeHandler) resetPassword(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	defer lockUsers(site.Directories.Config)()
+	users, err := loadUsers(site.Directories.Config)
+	if err != nil {
+		panic(err.Error())
+	}
+	query := r.URL.Query()
+	idx := findUser(users, query.Get("login"))
+	message := ""
+	if idx == -1 || users[idx].Disabled ||
+		!checkResetToken(&users[idx], query.Get("token"), time.Now()) {
+		message = G("The link is invalid or has expired. Please request a new one.")
+	}
+	data := resetFormData{}
+	form := form.NewForm(&data, form.Fields{
+		"Password": form.Field{G("New password"), "",
+			form.Required(G("Required.")), new(form.PasswordWidget)},
+		"Confirm": form.Field{G("Confirm password"), "",
+			form.Required(G("Required.")), new(form.PasswordWidget)},
+		"CSRFToken": csrfField()})
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		if len(message) == 0 && form.Fill(r.Form) {
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			if data.Password != data.Confirm {
+				form.AddError("Confirm", G("The passwords do not match."))
+				break
+			}
+			users[idx].Password = hashPassword(data.Password,
+				h.currentSettings().Login.PasswordCost)
+			users[idx].ResetToken = ""
+			users[idx].ResetExpiry = 0
+			users[idx].SessionVersion++
+			if err := saveUsers(site.Directories.Config, users); err != nil {
+				panic("Can't save user: " + err.Error())
+			}
+			http.Redirect(w, r, site.URL(path.Join(node.Path, "@@login")),
+				http.StatusSeeOther)
+			return
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	data.Password = ""
+	data.Confirm = ""
+	data.CSRFToken = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/resetpassword", template.Context{
+		"Form": form.RenderData(), "Message": message},
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Reset password"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/gorilla/sessions"
+	utesting "github.com/monsti/util/testing"
+	"testing"
+	"time"
+)
+
+func TestCheckResetToken(t *testing.T) {
+	now := time.Now()
+	user := user{
+		ResetToken:  hashToken("foo"),
+		ResetExpiry: now.Add(time.Minute).Unix()}
+	tests := []struct {
+		Token string
+		Now   time.Time
+		Valid bool
+	}{
+		{"foo", now, true},
+		{"bar", now, false},
+		{"", now, false},
+		{"foo", now.Add(time.Minute), false},
+		{"foo", now.Add(time.Hour), false}}
+	for _, v := range tests {
+		if ret := checkResetToken(&user, v.Token, v.Now); ret != v.Valid {
+			t.Errorf("checkResetToken(_, %q, %v) = %v, should be %v", v.Token,
+				v.Now, ret, v.Valid)
+		}
+	}
+	used := user
+	used.ResetToken = ""
+	if checkResetToken(&used, "", now) {
+		t.Errorf("checkResetToken(_, \"\", _) = true for used token")
+	}
+}
+
+func TestFindUserByLoginOrEmail(t *testing.T) {
+	users := []user{
+		{Disabled: true},
+		{},
+		{}}
+	users[0].Login, users[0].Email = "foo", "foo@example.com"
+	users[1].Login, users[1].Email = "bar", "bar@example.com"
+	tests := []struct {
+		Id  string
+		Idx int
+	}{
+		{"", -1},
+		{"foo", -1},
+		{"foo@example.com", -1},
+		{"bar", 1},
+		{"bar@example.com", 1},
+		{"unknown", -1}}
+	for _, v := range tests {
+		if ret := findUserByLoginOrEmail(users, v.Id); ret != v.Idx {
+			t.Errorf("findUserByLoginOrEmail(_, %q) = %v, should be %v", v.Id,
+				ret, v.Idx)
+		}
+	}
+}
+
+func TestGetClientSessionVersion(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/users.yaml": "- login: foo\n  sessionversion: 2\n"},
+		"TestGetClientSessionVersion")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	for _, version := range []int{0, 1, 2, 3} {
+		session := sessions.NewSession(nil, "test")
+		session.Values["login"] = "foo"
+		session.Values["session_version"] = version
+		site_ := site{}
+		site_.Directories.Config = root
+		cSession, _, _, _ := getClientSession(session, site_, time.Now())
+		if valid := cSession.User != nil; valid != (version == 2) {
+			t.Errorf("getClientSession(...) with session version %v returned"+
+				" user %v", version, cSession.User)
+		}
+	}
+}
+
+func TestStoreResetToken(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/users.yaml": `[{"login": "foo", "email": "foo@example.com"}]`},
+		"TestStoreResetToken")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	expiry := time.Now().Add(time.Hour)
+	tests := []struct {
+		Id, Login string
+	}{
+		{"unknown", ""},
+		{"foo", "foo"},
+		{"foo@example.com", "foo"}}
+	for i, v := range tests {
+		u, err := storeResetToken(root, v.Id, "token", expiry)
+		if err != nil {
+			t.Fatalf("Test %v: storeResetToken(...) returned error: %v", i, err)
+		}
+		login := ""
+		if u != nil {
+			login = u.Login
+		}
+		if login != v.Login {
+			t.Errorf("Test %v: storeResetToken(_, %q, ...) returned user %q,"+
+				" should be %q", i, v.Id, login, v.Login)
+		}
+	}
+	u := testUser(t, "foo", root)
+	if u == nil || !checkResetToken(u, "token", time.Now()) {
+		t.Errorf("Reset token should have been stored: %+v", u)
+	}
+}
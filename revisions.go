@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revisionsDir is the name of the directory holding a node's revisions.
+const revisionsDir = ".revisions"
+
+// defaultMaxRevisions is the default number of revisions kept per file.
+const defaultMaxRevisions = 20
+
+// revisionsMutex serializes updates of the revision indexes.
+var revisionsMutex sync.Mutex
+
+// revision is a previous version of a node's file.
+type revision struct {
+	// Name of the revision's file in the revisions directory.
+	Name string
+	// File is the name of the node's file.
+	File string
+	// User is the login of the user who wrote this version.
+	User string `yaml:",omitempty"`
+	// Time this version has been written (RFC 3339).
+	Time string
+}
+
+// revisionAuthor is the author of the current version of a file.
+type revisionAuthor struct {
+	User, Time string
+}
+
+// revisionIndex holds the revisions of a node as stored in the index.yaml
+// file of the revisions directory.
+type revisionIndex struct {
+	// Revisions of the node's files, oldest first.
+	Revisions []revision
+	// Authors maps files to the author of their current version.
+	Authors map[string]revisionAuthor
+}
+
+// loadRevisionIndex returns the revision index of the node with the given
+// revisions directory.
+func loadRevisionIndex(dir string) (*revisionIndex, error) {
+	idx := &revisionIndex{Authors: make(map[string]revisionAuthor)}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "index.yaml"))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read revision index: %v", err)
+	}
+	if err := goyaml.Unmarshal(content, idx); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal revision index: %v", err)
+	}
+	if idx.Authors == nil {
+		idx.Authors = make(map[string]revisionAuthor)
+	}
+	return idx, nil
+}
+
+// save writes the index to the given revisions directory.
+func (idx *revisionIndex) save(dir string) error {
+	content, err := goyaml.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("Could not marshal revision index: %v", err)
+	}
+	if err := writeContentFile(filepath.Join(dir, "index.yaml"),
+		content); err != nil {
+		return fmt.Errorf("Could not write revision index: %v", err)
+	}
+	return nil
+}
+
+// Get returns the revision with the given name.
+func (idx *revisionIndex) Get(name string) (revision, bool) {
+	for _, rev := range idx.Revisions {
+		if rev.Name == name {
+			return rev, true
+		}
+	}
+	return revision{}, false
+}
+
+// saveRevision stores the current version of the given file of the node at
+// the given path of the data directory located at the given root before it
+// gets overwritten by the user with the given login.
+//
+// At most max revisions will be kept per file, pruning the oldest ones.
+func saveRevision(root, nodePath, file, login string, max int,
+	now time.Time) error {
+	if max <= 0 {
+		max = defaultMaxRevisions
+	}
+	current, err := nodeFile(root, nodePath, file)
+	if err != nil {
+		return err
+	}
+	dir, err := nodeFile(root, nodePath, revisionsDir)
+	if err != nil {
+		return err
+	}
+	revisionsMutex.Lock()
+	defer revisionsMutex.Unlock()
+	idx, err := loadRevisionIndex(dir)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(current)
+	switch {
+	case err == nil:
+		author, ok := idx.Authors[file]
+		if !ok {
+			if info, err := os.Stat(current); err == nil {
+				author.Time = info.ModTime().UTC().Format(time.RFC3339)
+			}
+		}
+		rev := revision{
+			Name: now.UTC().Format("20060102T150405.000000000Z") + "-" +
+				strings.Replace(file, "/", "_", -1),
+			File: file,
+			User: author.User,
+			Time: author.Time}
+		if err := mkdirContent(dir); err != nil {
+			return fmt.Errorf("Could not create revisions directory: %v", err)
+		}
+		if err := writeContentFile(filepath.Join(dir, rev.Name),
+			content); err != nil {
+			return fmt.Errorf("Could not write revision: %v", err)
+		}
+		idx.Revisions = append(idx.Revisions, rev)
+		idx.prune(dir, file, max)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("Could not read current version: %v", err)
+	}
+	idx.Authors[file] = revisionAuthor{login, now.UTC().Format(time.RFC3339)}
+	if err := mkdirContent(dir); err != nil {
+		return fmt.Errorf("Could not create revisions directory: %v", err)
+	}
+	return idx.save(dir)
+}
+
+// prune removes the oldest revisions of the given file so that at most max
+// revisions remain.
+func (idx *revisionIndex) prune(dir, file string, max int) {
+	count := 0
+	for _, rev := range idx.Revisions {
+		if rev.File == file {
+			count++
+		}
+	}
+	var kept []revision
+	for _, rev := range idx.Revisions {
+		if rev.File == file && count > max {
+			os.Remove(filepath.Join(dir, rev.Name))
+			count--
+			continue
+		}
+		kept = append(kept, rev)
+	}
+	idx.Revisions = kept
+}
+
+// revertRevision restores the given revision of the node at the given path,
+// saving the current version as new revision.
+func revertRevision(root, nodePath string, rev revision, login string,
+	max int) error {
+	dir, err := nodeFile(root, nodePath, revisionsDir)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, rev.Name))
+	if err != nil {
+		return fmt.Errorf("Could not read revision: %v", err)
+	}
+	if err := saveRevision(root, nodePath, rev.File, login, max,
+		time.Now()); err != nil {
+		return err
+	}
+	file, err := nodeFile(root, nodePath, rev.File)
+	if err != nil {
+		return err
+	}
+	return writeContentFile(file, content)
+}
+
+// History handles requests to show, diff and revert the revisions of a node.
+func (h *nodeHandler) History(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	root := site.Directories.Data
+	dir, err := nodeFile(root, node.Path, revisionsDir)
+	if err != nil {
+		panic("Can't get revisions: " + err.Error())
+	}
+	revisionsMutex.Lock()
+	idx, err := loadRevisionIndex(dir)
+	revisionsMutex.Unlock()
+	if err != nil {
+		panic("Can't load revisions: " + err.Error())
+	}
+	context := template.Context{}
+	switch r.Method {
+	case "GET":
+		name := r.URL.Query().Get("revision")
+		if len(name) == 0 {
+			break
+		}
+		rev, ok := idx.Get(name)
+		if !ok {
+			h.renderError(w, r, "Revision not found.", http.StatusNotFound,
+				node, cSession, site)
+			return
+		}
+		context["Revision"] = rev
+		old, err := ioutil.ReadFile(filepath.Join(dir, rev.Name))
+		if err != nil {
+			panic("Can't read revision: " + err.Error())
+		}
+		var current []byte
+		if file, err := nodeFile(root, node.Path, rev.File); err == nil {
+			current, _ = ioutil.ReadFile(file)
+		}
+		if isText(old) && isText(current) {
+			diff, err := unifiedDiff(rev.Name, rev.File, string(old),
+				string(current))
+			if err != nil {
+				context["DiffError"] = err.Error()
+			}
+			context["Diff"] = diff
+		}
+	case "POST":
+		r.ParseForm()
+		rev, ok := idx.Get(r.Form.Get("Revision"))
+		switch {
+		case !validCSRFRequest(r, session, r.Form.Get("CSRFToken")):
+			context["Error"] = G("The form has expired. Please try again.")
+		case site.ReadOnly:
+			context["Error"] = G("The site is read-only.")
+		case !ok:
+			h.renderError(w, r, "Revision not found.", http.StatusNotFound,
+				node, cSession, site)
+			return
+		default:
+			login := sessionLogin(cSession)
+			if err := revertRevision(root, node.Path, rev, login,
+				site.MaxRevisions); err != nil {
+				panic("Can't revert: " + err.Error())
+			}
+			dataWritten(site, node.Path, rev.File, login, auditRevert,
+				h.requestLog(r, site.Name).Warn)
+			http.Redirect(w, r, site.URL(path.Join(node.Path, "@@history")),
+				http.StatusSeeOther)
+			return
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	revisions := make([]revision, len(idx.Revisions))
+	for i, rev := range idx.Revisions {
+		revisions[len(revisions)-1-i] = rev
+	}
+	context["Revisions"] = revisions
+	context["CSRFToken"] = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/history", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("History"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveRevision(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/body.html": "v1"}, "TestSaveRevision")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	body := filepath.Join(root, "foo", "body.html")
+	now := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, content := range []string{"v2", "v3", "v4"} {
+		if err := saveRevision(root, "/foo", "body.html", "alice", 2,
+			now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("saveRevision failed: %v", err)
+		}
+		if err := ioutil.WriteFile(body, []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write body: %v", err)
+		}
+	}
+	dir := filepath.Join(root, "foo", revisionsDir)
+	idx, err := loadRevisionIndex(dir)
+	if err != nil {
+		t.Fatalf("Could not load revision index: %v", err)
+	}
+	if len(idx.Revisions) != 2 {
+		t.Fatalf("len(Revisions) = %v, should be 2", len(idx.Revisions))
+	}
+	tests := []struct {
+		Content, User string
+	}{
+		{"v2", "alice"},
+		{"v3", "alice"}}
+	for i, v := range tests {
+		rev := idx.Revisions[i]
+		content, err := ioutil.ReadFile(filepath.Join(dir, rev.Name))
+		if err != nil {
+			t.Fatalf("Could not read revision: %v", err)
+		}
+		if string(content) != v.Content || rev.User != v.User {
+			t.Errorf("Revision %v is %q by %q, should be %q by %q", i,
+				content, rev.User, v.Content, v.User)
+		}
+	}
+	if err := revertRevision(root, "/foo", idx.Revisions[0], "bob",
+		2); err != nil {
+		t.Fatalf("revertRevision failed: %v", err)
+	}
+	content, _ := ioutil.ReadFile(body)
+	if string(content) != "v2" {
+		t.Errorf("Reverted content is %q, should be \"v2\"", content)
+	}
+	idx, _ = loadRevisionIndex(dir)
+	last := idx.Revisions[len(idx.Revisions)-1]
+	saved, _ := ioutil.ReadFile(filepath.Join(dir, last.Name))
+	if string(saved) != "v4" {
+		t.Errorf("Revert should save the current version, got %q", saved)
+	}
+	if idx.Authors["body.html"].User != "bob" {
+		t.Errorf("Author is %q, should be \"bob\"", idx.Authors["body.html"].User)
+	}
+}
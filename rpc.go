@@ -8,13 +8,13 @@ import (
 	"github.com/monsti/monsti-daemon/worker"
 	"github.com/monsti/rpc/client"
 	"github.com/monsti/rpc/types"
+	"github.com/monsti/util/l10n"
 	"io/ioutil"
 	"log"
-	"net/smtp"
 	"net/url"
 	"os"
-	"path/filepath"
-	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // NodeRPC provides RPC methods for workers.
@@ -25,11 +25,88 @@ type NodeRPC struct {
 	Settings *settings
 	Session  *sessions.Session
 	Log      *log.Logger
+	// Sites holds the hosted sites.
+	Sites *siteRegistry
+	// NodeType handled by the worker.
+	NodeType string
+	// Protocols records the outcome of the worker's protocol handshake.
+	Protocols *protocolRegistry
+	// SubRequest renders another node for the request of the given ticket.
+	// Sub-requests are not supported if nil.
+	SubRequest func(parent *worker.Ticket, nodePath, action string) ([]byte,
+		error)
 }
 
+// checkWritable returns an error if the given site is read-only.
+//
+// Must be called by all RPC methods changing the site's content.
+func checkWritable(site site) error {
+	if site.ReadOnly {
+		G := l10n.UseCatalog(site.Locale)
+		return errors.New(G("The site is read-only."))
+	}
+	return nil
+}
+
+// checkChange checks if the request of the given ticket might change the
+// site's content.
+func (m *NodeRPC) checkChange(ticket *worker.Ticket, site site) error {
+	if err := checkWritable(site); err != nil {
+		return err
+	}
+	// Scheduled tasks don't have a client. Anonymous changes like comments
+	// are allowed from any network.
+	if ticket.Action != cronAction && privilegedRoles(ticket.Roles) &&
+		!site.adminAllowed(ticket.ClientIP) {
+		m.Log.Printf("monsti: Rejected change of %q from network %v",
+			sessionLogin(&ticket.Session), ticket.ClientIP)
+		G := l10n.UseCatalog(site.Locale)
+		return errors.New(G("Changes are not allowed from your network."))
+	}
+	return nil
+}
+
+// errNoTicket is returned by RPC methods called while the worker holds no
+// ticket, e.g. because it died meanwhile.
+var errNoTicket = errors.New("monsti: No request is being processed.")
+
+// ticket returns the ticket of the current request.
+func (m *NodeRPC) ticket() (*worker.Ticket, error) {
+	ticket := m.Worker.CurrentTicket()
+	if ticket == nil {
+		return nil, errNoTicket
+	}
+	return ticket, nil
+}
+
+// site returns the ticket and the site of the current request.
+func (m *NodeRPC) site() (*worker.Ticket, site, error) {
+	ticket, err := m.ticket()
+	if err != nil {
+		return nil, site{}, err
+	}
+	site, _ := m.Sites.Get(ticket.Site)
+	return ticket, site, nil
+}
+
+// GetNodeData returns the content of the given file of a node.
+//
+// Views of nodes get the translation of the file for the session's locale,
+// e.g. body.de.html, if there is one.
 func (m *NodeRPC) GetNodeData(args *types.GetNodeDataArgs, reply *[]byte) error {
-	site := m.Settings.Sites[m.Worker.Ticket.Site]
-	path := filepath.Join(site.Directories.Data, args.Path[1:], args.File)
+	ticket, site, err := m.site()
+	if err != nil {
+		return err
+	}
+	file := args.File
+	if len(ticket.Action) == 0 {
+		file, _ = findTranslation(site.Directories.Data, args.Path, file,
+			ticket.Session.Locale)
+	}
+	path, err := nodeFile(site.Directories.Data, args.Path, file)
+	if err != nil {
+		return err
+	}
 	ret, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -44,68 +121,279 @@ func (m *NodeRPC) GetNodeData(args *types.GetNodeDataArgs, reply *[]byte) error
 
 func (m *NodeRPC) WriteNodeData(args *types.WriteNodeDataArgs,
 	reply *int) error {
-	site := m.Settings.Sites[m.Worker.Ticket.Site]
-	path := filepath.Join(site.Directories.Data, args.Path[1:], args.File)
-	err := ioutil.WriteFile(path, []byte(args.Content), 0600)
-	return err
+	ticket, site, err := m.site()
+	if err != nil {
+		return err
+	}
+	if err := m.checkChange(ticket, site); err != nil {
+		return err
+	}
+	path, err := nodeFile(site.Directories.Data, args.Path, args.File)
+	if err != nil {
+		return err
+	}
+	login := sessionLogin(&ticket.Session)
+	if lock := activeEditLock(site.Directories.Data, args.Path, login,
+		time.Now()); lock != nil {
+		m.Log.Printf("monsti: %q writes %q of node %q locked by %q", login,
+			args.File, args.Path, lock.User)
+	}
+	if err := saveRevision(site.Directories.Data, args.Path, args.File, login,
+		site.MaxRevisions, time.Now()); err != nil {
+		m.Log.Printf("monsti: Could not save revision of %q of node %q: %v",
+			args.File, args.Path, err)
+	}
+	if err := writeContentFile(path, []byte(args.Content)); err != nil {
+		return err
+	}
+	dataWritten(site, args.Path, args.File, login, auditWriteData,
+		m.Log.Printf)
+	return nil
+}
+
+// WriteTranslatedNodeDataArgs are the arguments of WriteTranslatedNodeData.
+type WriteTranslatedNodeDataArgs struct {
+	// Path of the node.
+	Path string
+	// File is the name of the untranslated file, e.g. body.html.
+	File string
+	// Locale of the translation, e.g. de.
+	Locale string
+	// Content of the translation.
+	Content string
+}
+
+// WriteTranslatedNodeData writes the translation of the given file of a node,
+// e.g. body.de.html for body.html and de.
+func (m *NodeRPC) WriteTranslatedNodeData(args *WriteTranslatedNodeDataArgs,
+	reply *int) error {
+	if !validLocale(args.Locale) {
+		return fmt.Errorf("Invalid locale %q", args.Locale)
+	}
+	return m.WriteNodeData(&types.WriteNodeDataArgs{
+		Path:    args.Path,
+		File:    localizedFile(args.File, args.Locale),
+		Content: args.Content}, reply)
 }
 
+// GetFilePath returns the path of the temporary file holding the first
+// file uploaded with the given form field. The file will be removed after
+// the response has been written.
+func (m *NodeRPC) GetFilePath(key *string, reply *string) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	files := ticket.Files[*key]
+	if len(files) == 0 {
+		return fmt.Errorf("No file uploaded with form field %q", *key)
+	}
+	*reply = files[0]
+	return nil
+}
+
+// GetFileData returns the content of the first file uploaded with the given
+// form field.
 func (m *NodeRPC) GetFileData(key *string, reply *[]byte) error {
-	if err := m.Worker.Ticket.Request.ParseMultipartForm(1024 * 1024); err != nil {
+	var path string
+	if err := m.GetFilePath(key, &path); err != nil {
 		return err
 	}
-	file, _, err := m.Worker.Ticket.Request.FormFile(*key)
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("Could not read uploaded file: %v", err)
 	}
-	defer file.Close()
-	*reply, err = ioutil.ReadAll(file)
-	return err
+	*reply = content
+	return nil
 }
 
 func (m *NodeRPC) GetFormData(arg int, reply *url.Values) error {
-	err := m.Worker.Ticket.Request.ParseForm()
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	if ticket.Request == nil {
+		*reply = url.Values{}
+		return nil
+	}
+	err = ticket.Request.ParseForm()
 	if err != nil {
 		return err
 	}
-	*reply = m.Worker.Ticket.Request.Form
+	*reply = ticket.Request.Form
 	return nil
 }
 
+// HandshakeArgs are the arguments of Handshake.
+type HandshakeArgs struct {
+	// Version of the protocol spoken by the worker.
+	Version string
+	// Actions implemented by the worker, e.g. edit.
+	Actions []string
+}
+
+// Handshake must be called by workers right after they started. They
+// announce their protocol version and the actions they implement and get
+// the daemon's protocol version in reply.
+//
+// Fails if the major versions of the worker and the daemon differ.
+func (m *NodeRPC) Handshake(args *HandshakeArgs, reply *string) error {
+	*reply = worker.ProtocolVersion
+	return m.Protocols.Handshake(m.NodeType, args.Version, args.Actions)
+}
+
 func (m *NodeRPC) GetRequest(arg int, reply *client.Request) error {
-	if m.Worker.Ticket != nil {
+	// Workers not starting with the handshake don't support it.
+	m.Protocols.Legacy(m.NodeType, 0)
+	if m.Protocols.Get(m.NodeType).State == handshakeRefused {
+		return fmt.Errorf("monsti: Incompatible protocol version, expected %q",
+			worker.ProtocolVersion)
+	}
+	if m.Worker.CurrentTicket() != nil {
 		return errors.New("monsti: Still waiting for response to last request.")
 	}
 	ticket := <-m.Worker.Tickets
-	m.Worker.Ticket = &ticket
+	// The daemon already stopped waiting for the response to expired
+	// tickets and answered them with an expiry response.
+	for ticket.Expired(time.Now()) {
+		ticket = <-m.Worker.Tickets
+	}
+	m.Worker.SetTicket(&ticket)
+	m.Worker.Alive()
+	if ticket.Received != nil {
+		close(ticket.Received)
+	}
 	request := client.Request{
-		Method:  m.Worker.Ticket.Request.Method,
-		Node:    m.Worker.Ticket.Node,
-		Query:   m.Worker.Ticket.Request.URL.Query(),
-		Session: m.Worker.Ticket.Session,
-		Action:  m.Worker.Ticket.Action}
+		Node:    ticket.Node,
+		Query:   url.Values{},
+		Session: ticket.Session,
+		Action:  ticket.Action}
+	// Tickets of scheduled tasks have no HTTP request.
+	if r := ticket.Request; r != nil {
+		request.Method, request.Query = r.Method, r.URL.Query()
+	}
 	*reply = request
 	return nil
 }
 
+// Ping does nothing. Workers may call it while handling long requests to
+// not be considered unresponsive.
+func (m *NodeRPC) Ping(arg int, reply *int) error {
+	return nil
+}
+
+// GetDeadline returns the time after which the response to the current
+// request won't be used anymore. Returns the zero time if there is no
+// deadline and the current time if the client already went away.
+func (m *NodeRPC) GetDeadline(arg int, reply *time.Time) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	*reply = ticket.Deadline
+	if ticket.Expired(now) && (reply.IsZero() || now.Before(*reply)) {
+		*reply = now
+	}
+	return nil
+}
+
+// GetClientIP returns the IP address of the current request's client.
+func (m *NodeRPC) GetClientIP(arg int, reply *string) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	*reply = ticket.ClientIP
+	return nil
+}
+
+// GetTraceParent returns the W3C traceparent of the current request, or an
+// empty string if it is not traced.
+func (m *NodeRPC) GetTraceParent(arg int, reply *string) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	*reply = ticket.TraceParent
+	return nil
+}
+
+// GetScheme returns the scheme of the current request, i.e. http or https.
+func (m *NodeRPC) GetScheme(arg int, reply *string) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	*reply = ticket.Scheme
+	return nil
+}
+
+// GetEditLock returns the edit lock of the node at the given path. The reply
+// will be empty if the node is not locked.
+func (m *NodeRPC) GetEditLock(nodePath string, reply *editLock) error {
+	_, site, err := m.site()
+	if err != nil {
+		return err
+	}
+	lock, err := readEditLock(site.Directories.Data, nodePath)
+	if err != nil {
+		return err
+	}
+	if lock != nil && !lock.Expired(time.Now()) {
+		*reply = *lock
+	}
+	return nil
+}
+
+// GetRoles returns the roles of the current request's user.
+func (m *NodeRPC) GetRoles(arg int, reply *[]string) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	*reply = ticket.Roles
+	return nil
+}
+
 func (m *NodeRPC) UpdateNode(node client.Node, reply *int) error {
-	site := m.Settings.Sites[m.Worker.Ticket.Site]
-	return writeNode(node, site.Directories.Data)
+	ticket, site, err := m.site()
+	if err != nil {
+		return err
+	}
+	if err := m.checkChange(ticket, site); err != nil {
+		return err
+	}
+	login := sessionLogin(&ticket.Session)
+	if err := saveRevision(site.Directories.Data, node.Path, "node.yaml", login,
+		site.MaxRevisions, time.Now()); err != nil {
+		m.Log.Printf("monsti: Could not save revision of node %q: %v",
+			node.Path, err)
+	}
+	created, err := createParentNodes(site.Directories.Data, node.Path,
+		site.placeholderType(), login)
+	for _, nodePath := range created {
+		auditChange(site, login, auditAdd, nodePath, "", m.Log.Printf)
+		fireWebhooks(site, eventNodeWritten, nodePath, login, m.Log.Printf)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeNode(node, login, site.Directories.Data); err != nil {
+		return err
+	}
+	auditChange(site, login, auditWriteNode, node.Path, "node.yaml",
+		m.Log.Printf)
+	fireWebhooks(site, eventNodeWritten, node.Path, login, m.Log.Printf)
+	return nil
 }
 
 func (m *NodeRPC) SendMail(mail mimemail.Mail, reply *int) error {
-	site := m.Settings.Sites[m.Worker.Ticket.Site]
-	owner := mimemail.Address{site.Owner.Name, site.Owner.Email}
-	if len(mail.From.Email) == 0 {
-		mail.From = owner
-	}
-	if mail.To == nil {
-		mail.To = []mimemail.Address{owner}
-	}
-	auth := smtp.PlainAuth("", m.Settings.Mail.Username,
-		m.Settings.Mail.Password, strings.Split(m.Settings.Mail.Host, ":")[0])
-	if err := smtp.SendMail(m.Settings.Mail.Host, auth,
-		mail.Sender(), mail.Recipients(), mail.Message()); err != nil {
+	_, site, err := m.site()
+	if err != nil {
+		return err
+	}
+	if err := sendMail(m.Settings, site, mail); err != nil {
 		m.Log.Println("monsti: Could not send email: " + err.Error())
 		return fmt.Errorf("Could not send email.")
 	}
@@ -113,7 +401,54 @@ func (m *NodeRPC) SendMail(mail mimemail.Mail, reply *int) error {
 }
 
 func (m *NodeRPC) SendResponse(res client.Response, reply *int) error {
-	m.Worker.Ticket.ResponseChan <- res
-	m.Worker.Ticket = nil
+	if !m.Worker.Respond(res) {
+		return errNoTicket
+	}
+	return nil
+}
+
+// CreateSnapshot takes a snapshot of the site's data and configuration,
+// e.g. for a backup worker. Only allowed for admins and scheduled tasks.
+func (m *NodeRPC) CreateSnapshot(arg int, reply *snapshotInfo) error {
+	ticket, site, err := m.site()
+	if err != nil {
+		return err
+	}
+	if ticket.Action != cronAction && !hasRole(ticket.Roles, roleAdmin) {
+		return errors.New("Snapshots may only be taken by admins.")
+	}
+	info, err := createSnapshot(site, time.Now(), func(format string,
+		v ...interface{}) {
+		m.Log.Printf("monsti: "+format, v...)
+	})
+	if err != nil {
+		return err
+	}
+	*reply = *info
+	return nil
+}
+
+// GetCSRFToken returns the CSRF token to be included in forms rendered by the
+// worker.
+func (m *NodeRPC) GetCSRFToken(arg int, reply *string) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	if ticket.CSRFTokenUsed != nil {
+		atomic.StoreInt32(ticket.CSRFTokenUsed, 1)
+	}
+	*reply = ticket.CSRFToken
+	return nil
+}
+
+// CheckCSRFToken checks if the given token is valid for the current request.
+func (m *NodeRPC) CheckCSRFToken(token string, reply *bool) error {
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	*reply = csrfExempt(ticket.Request) ||
+		equalCSRFTokens(ticket.CSRFToken, token)
 	return nil
 }
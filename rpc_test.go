@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"github.com/gorilla/sessions"
 	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
 	"github.com/monsti/rpc/types"
 	utesting "github.com/monsti/util/testing"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // setupRPC creates a RPC environment for testing.
@@ -24,7 +29,8 @@ func setupRPC(t *testing.T, testName string) (NodeRPC, string, func()) {
 	ticket := worker.Ticket{Site: site_.Name}
 	worker := worker.Worker{Ticket: &ticket}
 	session := sessions.Session{}
-	return NodeRPC{&worker, &settings, &session, nil}, root, cleanup
+	return NodeRPC{Worker: &worker, Settings: &settings, Session: &session,
+		Sites: newSiteRegistry(settings.Sites, "")}, root, cleanup
 }
 
 func TestRPCWriteNodeData(t *testing.T) {
@@ -41,3 +47,179 @@ func TestRPCWriteNodeData(t *testing.T) {
 		t.Fatalf("Written data is %q, should be \"Hey World!\"", writtenData)
 	}
 }
+
+func TestRPCTranslatedNodeData(t *testing.T) {
+	rpc, root, cleanup := setupRPC(t, "TestRPCTranslatedNodeData")
+	defer cleanup()
+	var reply int
+	for _, locale := range []string{"../de", "de/x", ""} {
+		if err := rpc.WriteTranslatedNodeData(&WriteTranslatedNodeDataArgs{
+			Path: "/foo", File: "body.html", Locale: locale, Content: "evil"},
+			&reply); err == nil {
+			t.Errorf("WriteTranslatedNodeData should fail for locale %q", locale)
+		}
+	}
+	rpc.WriteNodeData(&types.WriteNodeDataArgs{
+		Path: "/foo", File: "body.html", Content: "Hello"}, &reply)
+	if err := rpc.WriteTranslatedNodeData(&WriteTranslatedNodeDataArgs{
+		Path: "/foo", File: "body.html", Locale: "de", Content: "Hallo"},
+		&reply); err != nil {
+		t.Fatalf("WriteTranslatedNodeData failed: %v", err)
+	}
+	written, err := ioutil.ReadFile(filepath.Join(root, "foo", "body.de.html"))
+	if err != nil || string(written) != "Hallo" {
+		t.Errorf("Translation is %q, %v; should be \"Hallo\"", written, err)
+	}
+	tests := []struct {
+		Action, Locale, Content string
+	}{
+		{"", "de", "Hallo"},
+		{"", "fr", "Hello"},
+		{"edit", "de", "Hello"}}
+	for _, v := range tests {
+		rpc.Worker.Ticket.Action = v.Action
+		rpc.Worker.Ticket.Session.Locale = v.Locale
+		var data []byte
+		if err := rpc.GetNodeData(&types.GetNodeDataArgs{
+			Path: "/foo", File: "body.html"}, &data); err != nil {
+			t.Fatalf("GetNodeData failed: %v", err)
+		}
+		if string(data) != v.Content {
+			t.Errorf("GetNodeData for action %q and locale %q returned %q,"+
+				" should be %q", v.Action, v.Locale, data, v.Content)
+		}
+	}
+}
+
+func TestRPCReadOnly(t *testing.T) {
+	rpc, root, cleanup := setupRPC(t, "TestRPCReadOnly")
+	defer cleanup()
+	var reply int
+	node := client.Node{Path: "/foo", Title: "Foo"}
+	if err := rpc.UpdateNode(node, &reply); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	nodeFile := filepath.Join(root, "foo", "node.yaml")
+	before, err := os.Stat(nodeFile)
+	if err != nil {
+		t.Fatalf("Could not stat node.yaml: %v", err)
+	}
+	rpc.Sites.SetReadOnly("FooSite", true)
+	node.Title = "Changed"
+	if err := rpc.UpdateNode(node, &reply); err == nil {
+		t.Errorf("UpdateNode should fail for read-only sites")
+	}
+	if err := rpc.WriteNodeData(&types.WriteNodeDataArgs{
+		Path: "/foo", File: "node.yaml", Content: "title: Changed"},
+		&reply); err == nil {
+		t.Errorf("WriteNodeData should fail for read-only sites")
+	}
+	after, err := os.Stat(nodeFile)
+	if err != nil {
+		t.Fatalf("Could not stat node.yaml: %v", err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		t.Errorf("node.yaml has been changed by blocked writes")
+	}
+}
+
+func TestRPCAdminNetworks(t *testing.T) {
+	rpc, root, cleanup := setupRPC(t, "TestRPCAdminNetworks")
+	defer cleanup()
+	rpc.Log = log.New(ioutil.Discard, "", 0)
+	site_, _ := rpc.Sites.Get("FooSite")
+	site_.AdminAllow, _ = parseTrustedProxies([]string{"10.0.0.0/8",
+		"2001:db8::/32"})
+	rpc.Sites = newSiteRegistry(map[string]site{"FooSite": site_}, "")
+	tests := []struct {
+		IP      string
+		Allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"2001:db8::1", true},
+		{"192.168.1.1", false},
+		{"2001:db9::1", false}}
+	rpc.Worker.Ticket.Roles = []string{roleEditor}
+	for _, v := range tests {
+		rpc.Worker.Ticket.ClientIP = v.IP
+		var reply int
+		err := rpc.UpdateNode(client.Node{Path: "/foo", Title: v.IP}, &reply)
+		if (err == nil) != v.Allowed {
+			t.Errorf("UpdateNode(...) from %v returned %v", v.IP, err)
+		}
+		err = rpc.WriteNodeData(&types.WriteNodeDataArgs{
+			Path: "/foo", File: "body.html", Content: v.IP}, &reply)
+		if (err == nil) != v.Allowed {
+			t.Errorf("WriteNodeData(...) from %v returned %v", v.IP, err)
+		}
+	}
+	body, _ := ioutil.ReadFile(filepath.Join(root, "foo", "body.html"))
+	if string(body) != "2001:db8::1" {
+		t.Errorf("body.html is %q, should be written by allowed clients only",
+			body)
+	}
+	// Changes of anonymous users, e.g. comments, are allowed from anywhere.
+	rpc.Worker.Ticket.Roles = nil
+	rpc.Worker.Ticket.ClientIP = "192.168.1.1"
+	var reply int
+	if err := rpc.WriteNodeData(&types.WriteNodeDataArgs{
+		Path: "/foo", File: "comments.yaml", Content: "[]"}, &reply); err != nil {
+		t.Errorf("WriteNodeData(...) of anonymous user returned %v", err)
+	}
+}
+
+func TestRPCInvalidPaths(t *testing.T) {
+	rpc, root, cleanup := setupRPC(t, "TestRPCInvalidPaths")
+	defer cleanup()
+	tests := []struct {
+		Path, File string
+	}{
+		{"/foo", "../../other-site/node.yaml"},
+		{"/foo", "/etc/passwd"},
+		{"/../other-site", "node.yaml"},
+		{"foo", "node.yaml"}}
+	for i, v := range tests {
+		var reply int
+		if err := rpc.WriteNodeData(&types.WriteNodeDataArgs{
+			Path: v.Path, File: v.File, Content: "evil"}, &reply); err == nil {
+			t.Errorf("Test %v: WriteNodeData(%q, %q) should fail", i, v.Path,
+				v.File)
+		}
+		var data []byte
+		if err := rpc.GetNodeData(&types.GetNodeDataArgs{
+			Path: v.Path, File: v.File}, &data); err == nil {
+			t.Errorf("Test %v: GetNodeData(%q, %q) should fail", i, v.Path,
+				v.File)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "..", "other-site")); err == nil {
+		t.Errorf("WriteNodeData escaped the data directory")
+	}
+}
+
+func TestRPCGetRequestSkipsExpired(t *testing.T) {
+	rpc, _, cleanup := setupRPC(t, "TestRPCGetRequestSkipsExpired")
+	defer cleanup()
+	rpc.Worker.Ticket = nil
+	rpc.Worker.Tickets = make(chan worker.Ticket, 2)
+	done := make(chan struct{})
+	close(done)
+	r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+	rpc.Worker.Tickets <- worker.Ticket{Node: client.Node{Path: "/expired"},
+		Request: r, Done: done}
+	rpc.Worker.Tickets <- worker.Ticket{Node: client.Node{Path: "/foo"},
+		Request: r, Deadline: time.Now().Add(time.Minute)}
+	var req client.Request
+	if err := rpc.GetRequest(0, &req); err != nil {
+		t.Fatalf("GetRequest failed: %v", err)
+	}
+	if req.Node.Path != "/foo" {
+		t.Errorf("GetRequest should skip expired tickets, got %q", req.Node.Path)
+	}
+	var deadline time.Time
+	rpc.GetDeadline(0, &deadline)
+	if !deadline.Equal(rpc.Worker.Ticket.Deadline) {
+		t.Errorf("GetDeadline returned %v, should be %v", deadline,
+			rpc.Worker.Ticket.Deadline)
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"html"
+	htmlT "html/template"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// searchIndexPath is the path of the search index directory relative to the
+// data directory.
+const searchIndexPath = ".monsti/index"
+
+// searchBodyFile is the node data file holding the node's main content.
+const searchBodyFile = "body.html"
+
+// searchPageSize is the number of results shown per page of @@search.
+const searchPageSize = 20
+
+// snippetLength is the approximate length of result snippets in bytes.
+const snippetLength = 200
+
+// searchFlushDelay is the time changes of a search index are collected
+// before the index gets written.
+const searchFlushDelay = 10 * time.Second
+
+var (
+	// searchIndexes holds the loaded search indexes by data directory.
+	searchIndexes = make(map[string]*searchIndex)
+	// searchDirty holds the data directories whose search index has changes
+	// which haven't been written yet.
+	searchDirty = make(map[string]bool)
+	// searchMutex serializes access to the search indexes.
+	searchMutex sync.Mutex
+)
+
+// searchDocument holds the indexed content of a node.
+type searchDocument struct {
+	Title, Type string
+	// Text is the node's body stripped of any markup.
+	Text string
+}
+
+// searchIndex is an inverted index of the nodes of a data directory.
+type searchIndex struct {
+	// Documents maps node paths to their content.
+	Documents map[string]searchDocument
+	// Terms maps terms to the paths of the nodes containing them.
+	Terms map[string][]string
+}
+
+// newSearchIndex returns a new, empty searchIndex.
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		Documents: make(map[string]searchDocument),
+		Terms:     make(map[string][]string)}
+}
+
+// isWordRune returns true iff the given rune is part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// tokenize splits the given text at Unicode word boundaries and returns the
+// lower cased words.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !isWordRune(r)
+	})
+	for i, word := range words {
+		words[i] = strings.ToLower(word)
+	}
+	return words
+}
+
+// stripTags removes any HTML tags from the given markup and unescapes the
+// remaining text.
+func stripTags(markup string) string {
+	var text []byte
+	inTag := false
+	for i := 0; i < len(markup); i++ {
+		switch c := markup[i]; {
+		case c == '<':
+			inTag = true
+			text = append(text, ' ')
+		case c == '>' && inTag:
+			inTag = false
+		case !inTag:
+			text = append(text, c)
+		}
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(string(text))), " ")
+}
+
+// Add adds or replaces the document of the node at the given path.
+func (idx *searchIndex) Add(nodePath string, doc searchDocument) {
+	idx.Remove(nodePath)
+	idx.Documents[nodePath] = doc
+	seen := make(map[string]bool)
+	for _, term := range tokenize(doc.Title + " " + doc.Text) {
+		if !seen[term] {
+			seen[term] = true
+			idx.Terms[term] = append(idx.Terms[term], nodePath)
+		}
+	}
+}
+
+// Remove removes the document of the node at the given path.
+func (idx *searchIndex) Remove(nodePath string) {
+	doc, ok := idx.Documents[nodePath]
+	if !ok {
+		return
+	}
+	delete(idx.Documents, nodePath)
+	for _, term := range tokenize(doc.Title + " " + doc.Text) {
+		paths := idx.Terms[term]
+		for i, p := range paths {
+			if p == nodePath {
+				paths = append(paths[:i], paths[i+1:]...)
+				break
+			}
+		}
+		if len(paths) == 0 {
+			delete(idx.Terms, term)
+		} else {
+			idx.Terms[term] = paths
+		}
+	}
+}
+
+// RemoveTree removes the documents of the node at the given path and of all
+// its descendants.
+func (idx *searchIndex) RemoveTree(nodePath string) {
+	prefix := strings.TrimSuffix(nodePath, "/") + "/"
+	for p := range idx.Documents {
+		if p == nodePath || strings.HasPrefix(p, prefix) {
+			idx.Remove(p)
+		}
+	}
+}
+
+// searchResult is a node matching a search query.
+type searchResult struct {
+	Path, Title, Type string
+	// Score is higher for better matches.
+	Score int
+	// Snippet is an excerpt of the node's text with highlighted terms.
+	Snippet htmlT.HTML
+}
+
+// searchResultList sorts results by score, best first.
+type searchResultList []searchResult
+
+// Len is the number of elements in the list.
+func (l searchResultList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l searchResultList) Less(i, j int) bool {
+	if l[i].Score == l[j].Score {
+		return l[i].Path < l[j].Path
+	}
+	return l[i].Score > l[j].Score
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l searchResultList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Search returns the nodes below the given path (including the node itself)
+// containing all words of the given query and viewable according to the
+// given nodeAccess.
+func (idx *searchIndex) Search(query, below string,
+	access *nodeAccess) []searchResult {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	var candidates []string
+	for i, term := range terms {
+		if i == 0 {
+			candidates = idx.Terms[term]
+			continue
+		}
+		var matching []string
+		for _, p := range candidates {
+			if inStringSlice(p, idx.Terms[term]) {
+				matching = append(matching, p)
+			}
+		}
+		candidates = matching
+	}
+	prefix := strings.TrimSuffix(below, "/") + "/"
+	var results []searchResult
+	for _, p := range candidates {
+		if p != below && !strings.HasPrefix(p, prefix) || !access.CanView(p) {
+			continue
+		}
+		doc := idx.Documents[p]
+		score := 0
+		for _, word := range tokenize(doc.Title) {
+			if inStringSlice(word, terms) {
+				score += 10
+			}
+		}
+		for _, word := range tokenize(doc.Text) {
+			if inStringSlice(word, terms) {
+				score++
+			}
+		}
+		results = append(results, searchResult{Path: p, Title: doc.Title,
+			Type: doc.Type, Score: score, Snippet: snippet(doc.Text, terms)})
+	}
+	sort.Sort(searchResultList(results))
+	return results
+}
+
+// snippet returns an excerpt of the given text around the first occurrence
+// of any of the given terms. The terms get highlighted.
+func snippet(text string, terms []string) htmlT.HTML {
+	type word struct{ start, end int }
+	var words []word
+	start := -1
+	for i, r := range text + " " {
+		switch {
+		case isWordRune(r) && start < 0:
+			start = i
+		case !isWordRune(r) && start >= 0:
+			words = append(words, word{start, i})
+			start = -1
+		}
+	}
+	from, to := 0, len(text)
+	for _, w := range words {
+		if inStringSlice(strings.ToLower(text[w.start:w.end]), terms) {
+			from = w.start - snippetLength/2
+			break
+		}
+	}
+	if from < 0 {
+		from = 0
+	}
+	// Move the bounds to word boundaries to not break words or runes.
+	for _, w := range words {
+		if w.start >= from {
+			from = w.start
+			break
+		}
+	}
+	if from+snippetLength < to {
+		to = from + snippetLength
+		for i := len(words) - 1; i >= 0; i-- {
+			if words[i].end <= to {
+				to = words[i].end
+				break
+			}
+		}
+	}
+	var ret []string
+	if from > 0 {
+		ret = append(ret, "… ")
+	}
+	last := from
+	for _, w := range words {
+		if w.start < from || w.end > to {
+			continue
+		}
+		if inStringSlice(strings.ToLower(text[w.start:w.end]), terms) {
+			ret = append(ret, html.EscapeString(text[last:w.start]), "<strong>",
+				html.EscapeString(text[w.start:w.end]), "</strong>")
+			last = w.end
+		}
+	}
+	ret = append(ret, html.EscapeString(text[last:to]))
+	if to < len(text) {
+		ret = append(ret, " …")
+	}
+	return htmlT.HTML(strings.Join(ret, ""))
+}
+
+// readSearchDocument returns the indexable content of the node at the given
+// path of the data directory located at the given root.
+func readSearchDocument(root, nodePath string) (searchDocument, error) {
+	node, err := readStoredNode(root, nodePath)
+	if err != nil {
+		return searchDocument{}, err
+	}
+	doc := searchDocument{Title: node.Title, Type: node.Type}
+	file, err := nodeFile(root, nodePath, searchBodyFile)
+	if err != nil {
+		return searchDocument{}, err
+	}
+	if body, err := ioutil.ReadFile(file); err == nil {
+		doc.Text = stripTags(string(body))
+	}
+	return doc, nil
+}
+
+// buildSearchIndex indexes all nodes of the data directory located at the
+// given root.
+func buildSearchIndex(root string) (*searchIndex, error) {
+	idx := newSearchIndex()
+	err := walkNodes(root, func(nodePath string, info os.FileInfo) error {
+		if doc, err := readSearchDocument(root, nodePath); err == nil {
+			idx.Add(nodePath, doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// loadSearchIndex returns the search index of the data directory located at
+// the given root. The caller must hold searchMutex.
+//
+// The index is read once and kept in memory. It will be rebuilt if it is
+// missing.
+func loadSearchIndex(root string) (*searchIndex, error) {
+	if idx, ok := searchIndexes[root]; ok {
+		return idx, nil
+	}
+	file := filepath.Join(root, searchIndexPath, "index.yaml")
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		idx, err := buildSearchIndex(root)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveSearchIndex(root, idx); err != nil {
+			return nil, err
+		}
+		searchIndexes[root] = idx
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read search index: %v", err)
+	}
+	idx := newSearchIndex()
+	if err := goyaml.Unmarshal(content, idx); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal search index: %v", err)
+	}
+	searchIndexes[root] = idx
+	return idx, nil
+}
+
+// saveSearchIndex writes the given search index of the data directory
+// located at the given root.
+func saveSearchIndex(root string, idx *searchIndex) error {
+	content, err := goyaml.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("Could not marshal search index: %v", err)
+	}
+	dir := filepath.Join(root, searchIndexPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create search index directory: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "index.yaml"), content,
+		0600); err != nil {
+		return fmt.Errorf("Could not write search index: %v", err)
+	}
+	return nil
+}
+
+// rebuildSearchIndex replaces the search index of the data directory located
+// at the given root by a freshly built one.
+func rebuildSearchIndex(root string) error {
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	idx, err := buildSearchIndex(root)
+	if err != nil {
+		return err
+	}
+	if err := saveSearchIndex(root, idx); err != nil {
+		return err
+	}
+	searchIndexes[root] = idx
+	delete(searchDirty, root)
+	return nil
+}
+
+// updateSearchIndex calls the given function to update the search index of
+// the data directory located at the given root.
+//
+// The changes get written after searchFlushDelay, so subsequent changes
+// are written at once. Until then, the index file is removed to get the
+// index rebuilt if the daemon stops in the meantime. On failure, the index
+// gets deleted to be rebuilt on next use.
+func updateSearchIndex(root string, fun func(idx *searchIndex)) {
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	idx, err := loadSearchIndex(root)
+	if err != nil {
+		os.RemoveAll(filepath.Join(root, searchIndexPath))
+		return
+	}
+	fun(idx)
+	if searchDirty[root] {
+		return
+	}
+	searchDirty[root] = true
+	err = os.Remove(filepath.Join(root, searchIndexPath, "index.yaml"))
+	if err != nil && !os.IsNotExist(err) {
+		delete(searchIndexes, root)
+		delete(searchDirty, root)
+		os.RemoveAll(filepath.Join(root, searchIndexPath))
+		return
+	}
+	time.AfterFunc(searchFlushDelay, func() { flushSearchIndex(root) })
+}
+
+// flushSearchIndex writes the changes of the search index of the data
+// directory located at the given root.
+func flushSearchIndex(root string) {
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	idx, ok := searchIndexes[root]
+	if !ok || !searchDirty[root] {
+		return
+	}
+	delete(searchDirty, root)
+	if _, err := os.Stat(root); err != nil {
+		// The data directory has been removed in the meantime.
+		delete(searchIndexes, root)
+		return
+	}
+	if err := saveSearchIndex(root, idx); err != nil {
+		delete(searchIndexes, root)
+		os.RemoveAll(filepath.Join(root, searchIndexPath))
+	}
+}
+
+// indexNode updates the search index entry of the node at the given path.
+func indexNode(root, nodePath string) {
+	updateSearchIndex(root, func(idx *searchIndex) {
+		if doc, err := readSearchDocument(root, nodePath); err == nil {
+			idx.Add(nodePath, doc)
+		} else {
+			idx.Remove(nodePath)
+		}
+	})
+}
+
+// unindexNode removes the node at the given path and its descendants from
+// the search index.
+func unindexNode(root, nodePath string) {
+	updateSearchIndex(root, func(idx *searchIndex) {
+		idx.RemoveTree(nodePath)
+	})
+}
+
+// Search handles search requests.
+func (h *nodeHandler) Search(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if r.Method != "GET" {
+		panic("Request method not supported: " + r.Method)
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var results []searchResult
+	if len(query) > 0 {
+		searchMutex.Lock()
+		idx, err := loadSearchIndex(site.Directories.Data)
+		if err == nil {
+			results = idx.Search(query, node.Path, requestNodeAccess(r))
+		}
+		searchMutex.Unlock()
+		if err != nil {
+			panic("Can't load search index: " + err.Error())
+		}
+	}
+	page, pages, start, end := paginate(r.URL.Query().Get("page"),
+		len(results), searchPageSize)
+	type resultRow struct {
+		searchResult
+		URL string
+	}
+	rows := make([]resultRow, 0, end-start)
+	for _, result := range results[start:end] {
+		rows = append(rows, resultRow{result, site.URL(result.Path)})
+	}
+	pageURL := func(page int) string {
+		return "?" + url.Values{"q": {query},
+			"page": {strconv.Itoa(page)}}.Encode()
+	}
+	context := template.Context{"Query": query, "Results": rows,
+		"Count": len(results), "Page": page, "Pages": pages}
+	if page > 1 {
+		context["PrevURL"] = pageURL(page - 1)
+	}
+	if page < pages {
+		context["NextURL"] = pageURL(page + 1)
+	}
+	body := h.renderTemplate("daemon/actions/search", context,
+		cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Title: G("Search"),
+		Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	htmlT "html/template"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		Text  string
+		Words []string
+	}{
+		{"", []string{}},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"Größe und Maß", []string{"größe", "und", "maß"}},
+		{"foo-bar 42x", []string{"foo", "bar", "42x"}},
+		{"Привет мир", []string{"привет", "мир"}}}
+	for i, v := range tests {
+		if ret := tokenize(v.Text); !reflect.DeepEqual(ret, v.Words) {
+			t.Errorf("Test %v: tokenize(%q) = %q, should be %q", i, v.Text, ret,
+				v.Words)
+		}
+	}
+}
+
+func TestStripTags(t *testing.T) {
+	tests := []struct {
+		Markup, Text string
+	}{
+		{"", ""},
+		{"<p>Hello <b>World</b></p>", "Hello World"},
+		{"<p>foo</p><p>bar</p>", "foo bar"},
+		{"Fish &amp; Chips", "Fish & Chips"},
+		{`<a href="x">link</a>`, "link"}}
+	for i, v := range tests {
+		if ret := stripTags(v.Markup); ret != v.Text {
+			t.Errorf("Test %v: stripTags(%q) = %q, should be %q", i, v.Markup, ret,
+				v.Text)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	idx := newSearchIndex()
+	idx.Add("/", searchDocument{Title: "Home", Text: "Welcome to our site."})
+	idx.Add("/blog", searchDocument{Title: "Blog",
+		Text: "News about our site."})
+	idx.Add("/blog/entry", searchDocument{Title: "Site news",
+		Text: "A new entry."})
+	idx.Add("/about", searchDocument{Title: "Über uns", Text: "Wir über uns."})
+	tests := []struct {
+		Query, Below string
+		Paths        []string
+	}{
+		{"", "/", nil},
+		{"site", "/", []string{"/blog/entry", "/", "/blog"}},
+		{"SITE news", "/", []string{"/blog/entry", "/blog"}},
+		{"site", "/blog", []string{"/blog/entry", "/blog"}},
+		{"site", "/blog/entry", []string{"/blog/entry"}},
+		{"über", "/", []string{"/about"}},
+		{"missing", "/", nil}}
+	for i, v := range tests {
+		var paths []string
+		for _, result := range idx.Search(v.Query, v.Below, nil) {
+			paths = append(paths, result.Path)
+		}
+		if !reflect.DeepEqual(paths, v.Paths) {
+			t.Errorf("Test %v: Search(%q, %q) = %v, should be %v", i, v.Query,
+				v.Below, paths, v.Paths)
+		}
+	}
+	idx.Add("/blog", searchDocument{Title: "Blog", Text: "Nothing."})
+	if ret := idx.Search("news", "/", nil); len(ret) != 1 {
+		t.Errorf("Search after update returned %v, should only find /blog/entry",
+			ret)
+	}
+	idx.RemoveTree("/blog")
+	if ret := idx.Search("site", "/", nil); len(ret) != 1 || ret[0].Path != "/" {
+		t.Errorf("Search after removal returned %v, should only find /", ret)
+	}
+	if _, ok := idx.Terms["news"]; ok {
+		t.Errorf("Term of removed nodes is still indexed")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("word ", 64)
+	tests := []struct {
+		Text    string
+		Terms   []string
+		Snippet htmlT.HTML
+	}{
+		{"", []string{"foo"}, ""},
+		{"Foo & bar", []string{"foo"}, "<strong>Foo</strong> &amp; bar"},
+		{"a <b> c", []string{"c"}, "a &lt;b&gt; <strong>c</strong>"},
+		{long + "needle " + long, []string{"needle"},
+			htmlT.HTML("… " + strings.Repeat("word ", 20) +
+				"<strong>needle</strong> " + strings.Repeat("word ", 17) +
+				"word …")}}
+	for i, v := range tests {
+		if ret := snippet(v.Text, v.Terms); ret != v.Snippet {
+			t.Errorf("Test %v: snippet(%q, %v) = %q, should be %q", i, v.Text,
+				v.Terms, ret, v.Snippet)
+		}
+	}
+}
+
+func TestUpdateSearchIndex(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":     `{"type": "Document", "title": "Home"}`,
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`,
+		"/foo/body.html": "<p>Some words</p>",
+		"/bar/__empty__": ""}, "TestUpdateSearchIndex")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	file := filepath.Join(root, searchIndexPath, "index.yaml")
+	indexNode(root, "/foo")
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Outdated index file should be removed, got %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "bar", "node.yaml"),
+		[]byte(`{"type": "Document", "title": "Bar words"}`), 0600); err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	indexNode(root, "/bar")
+	searchMutex.Lock()
+	idx, err := loadSearchIndex(root)
+	searchMutex.Unlock()
+	if err != nil || len(idx.Search("words", "/", nil)) != 2 {
+		t.Fatalf("Changes should be kept in memory, got %v", err)
+	}
+	flushSearchIndex(root)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Index has not been written: %v", err)
+	}
+	saved := newSearchIndex()
+	if err := goyaml.Unmarshal(content, saved); err != nil ||
+		len(saved.Search("words", "/", nil)) != 2 {
+		t.Errorf("Written index should contain the changes, got %v", err)
+	}
+}
@@ -2,75 +2,436 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/gorilla/context"
 	"github.com/gorilla/sessions"
 	"github.com/monsti/monsti-daemon/worker"
 	"github.com/monsti/rpc/client"
 	"github.com/monsti/util/l10n"
-	"github.com/monsti/util/template"
+	htmlT "html/template"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // nodeHandler is a net/http handler to process incoming HTTP requests.
 type nodeHandler struct {
-	Renderer template.Renderer
+	Renderer *templateRenderer
+	// Settings are the settings the handler has been started with. Use
+	// currentSettings to get the settings of the last reload.
 	Settings *settings
-	// Hosts is a map from hosts to site names.
-	Hosts      map[string]string
+	// reloaded holds the *settings of the last reload.
+	reloaded atomic.Value
+	// Sites holds the hosted sites.
+	Sites *siteRegistry
+	// mutex protects NodeQueues, lanes, workers, commands, restarting,
+	// restartDelays and SiteLogs which may change on reload.
+	mutex      sync.RWMutex
 	NodeQueues map[string]chan worker.Ticket
+	// lanes maps node types to the lanes in front of their queue.
+	lanes map[string]*ticketLanes
+	// workers maps node types to their running workers.
+	workers map[string]*worker.Worker
+	// commands maps node types to the commands to start their workers as
+	// configured on the last reload. If missing, the command will be taken
+	// from Settings.
+	commands map[string]worker.Command
+	// restarting holds the node types whose workers have been killed by
+	// restartWorker.
+	restarting map[string]bool
+	// restartDelays holds the last delays before restarting crashed workers
+	// by node type, see restartDelay.
+	restartDelays map[string]time.Duration
 	// Log is the logger used by the node handler.
-	Log *log.Logger
+	Log *leveledLogger
+	// SiteLogs maps site names to loggers of sites having their own log
+	// file.
+	SiteLogs map[string]*leveledLogger
+	// LoginLimiter limits failed login attempts. May be nil.
+	LoginLimiter *loginLimiter
+	// RateLimiter limits the request rate of clients. May be nil.
+	RateLimiter *rateLimiter
+	// Tracer traces sampled requests. May be nil.
+	Tracer *tracer
+	// Notifier notifies about panics and dead workers. May be nil.
+	Notifier *notifier
+	// AccessLog is the access log. If nil, accesses will be logged to Log.
+	AccessLog *accessLog
+	// Stats keeps track of the status of the workers. May be nil.
+	Stats *workerStats
+	// Protocols keeps track of the protocols spoken by the workers. May be
+	// nil.
+	Protocols *protocolRegistry
+	// Locales are the locales having a catalog for the web interface.
+	Locales []string
+	// Certificates holds the TLS certificates of the sites. May be nil.
+	Certificates *certStore
+	// Cron keeps track of the scheduled tasks.
+	Cron cronScheduler
+}
+
+// SiteLog returns the logger to be used for messages concerning the given
+// site.
+func (h *nodeHandler) SiteLog(siteName string) *leveledLogger {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if logger, ok := h.SiteLogs[siteName]; ok {
+		return logger
+	}
+	return h.Log
+}
+
+// nodeQueue returns the ticket queue of the given node type.
+func (h *nodeHandler) nodeQueue(nodeType string) (chan worker.Ticket, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	queue, ok := h.NodeQueues[nodeType]
+	return queue, ok
+}
+
+// nodeLanes returns the ticket lanes in front of the queue of the given
+// node type. The lanes will be set up on first use.
+func (h *nodeHandler) nodeLanes(nodeType string) (*ticketLanes, bool) {
+	h.mutex.RLock()
+	lanes, ok := h.lanes[nodeType]
+	h.mutex.RUnlock()
+	if ok {
+		return lanes, true
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if lanes, ok := h.lanes[nodeType]; ok {
+		return lanes, true
+	}
+	queue, ok := h.NodeQueues[nodeType]
+	if !ok {
+		return nil, false
+	}
+	if h.lanes == nil {
+		h.lanes = make(map[string]*ticketLanes)
+	}
+	lanes = newTicketLanes(h.currentSettings().InteractiveBurst)
+	go lanes.run(queue)
+	h.lanes[nodeType] = lanes
+	return lanes, true
+}
+
+// stopLanes stops the ticket lanes of all node types, e.g. before their
+// queues get closed.
+func (h *nodeHandler) stopLanes() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for nodeType, lanes := range h.lanes {
+		lanes.Stop()
+		delete(h.lanes, nodeType)
+	}
+}
+
+// NodeTypes returns the sorted names of all node types having a queue.
+func (h *nodeHandler) NodeTypes() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	nodeTypes := make([]string, 0, len(h.NodeQueues))
+	for nodeType := range h.NodeQueues {
+		nodeTypes = append(nodeTypes, nodeType)
+	}
+	sort.Strings(nodeTypes)
+	return nodeTypes
 }
 
 // QueueTicket adds a ticket to the ticket queue of the corresponding
-// node type (ticket.Node.Type).
-func (h *nodeHandler) QueueTicket(ticket worker.Ticket) {
+// node type (ticket.Node.Type). Actions of logged in users will be handed
+// to the workers before other requests.
+//
+// Returns false if the ticket's Done channel got closed before the ticket
+// could be queued.
+func (h *nodeHandler) QueueTicket(ticket worker.Ticket) bool {
 	nodeType := ticket.Node.Type
-	if _, ok := h.NodeQueues[nodeType]; !ok {
+	lanes, ok := h.nodeLanes(nodeType)
+	if !ok {
 		panic("Missing queue for node type " + nodeType)
 	}
-	h.NodeQueues[nodeType] <- ticket
+	h.Stats.Queue(nodeType, 1)
+	defer h.Stats.Queue(nodeType, -1)
+	return lanes.Queue(ticket)
+}
+
+// Errors of requestWorker.
+var (
+	errWorkerDied = errors.New("Worker died")
+	errTimeout    = errors.New("Worker did not respond in time")
+	errClientGone = errors.New("Client went away")
+)
+
+// closeNotify returns a channel receiving a value when the client of the
+// given response went away. Returns nil if the writer doesn't support
+// this.
+func closeNotify(w http.ResponseWriter) <-chan bool {
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+// requestWorker queues the given ticket and waits for the worker's response.
+//
+// Returns errWorkerDied if the worker process died before responding and
+// errTimeout if the ticket's deadline passed. Returns errClientGone if the
+// given channel received a value, i.e. the client went away. In the latter
+// cases, the ticket's Done channel gets closed and the ticket gets removed
+// from the queue if the worker didn't pick it up yet.
+//
+// For traced requests, the worker span covers the whole round trip and its
+// queue child span the time until a worker picked up the ticket. Timed
+// requests record the same durations in the queue and worker phases.
+func (h *nodeHandler) requestWorker(ticket worker.Ticket,
+	gone <-chan bool) (res client.Response, err error) {
+	c := make(chan client.Response, 1)
+	done := make(chan struct{})
+	ticket.ResponseChan, ticket.Done = c, done
+	var timeout <-chan time.Time
+	if !ticket.Deadline.IsZero() {
+		timer := time.NewTimer(ticket.Deadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	timings := getRequestTimer(ticket.Request)
+	workerSpan := startSpan(ticket.Request, "worker")
+	workerSpan.SetAttribute("monsti.node_type", ticket.Node.Type)
+	queueSpan := workerSpan.Child("queue")
+	var received chan struct{}
+	if workerSpan != nil || timings != nil {
+		received = make(chan struct{})
+		ticket.TraceParent, ticket.Received = workerSpan.TraceParent(), received
+	}
+	queued, pickedUp := timings.Now(), time.Time{}
+	defer func() {
+		if received != nil {
+			queueSpan.Finish()
+			timings.End(phaseQueue, queued)
+		} else {
+			timings.End(phaseWorker, pickedUp)
+		}
+		workerSpan.SetError(err)
+		workerSpan.Finish()
+	}()
+	// reason may only be read after done got closed.
+	var reason error
+	go func() {
+		select {
+		case <-gone:
+			reason = errClientGone
+		case <-timeout:
+			reason = errTimeout
+		case <-finished:
+			return
+		}
+		close(done)
+	}()
+	if !h.QueueTicket(ticket) {
+		return client.Response{}, reason
+	}
+	for {
+		select {
+		case <-received:
+			queueSpan.Finish()
+			timings.End(phaseQueue, queued)
+			pickedUp, received = timings.Now(), nil
+		case res, ok := <-c:
+			// If the worker process dies, the channel will be closed.
+			if !ok {
+				return res, errWorkerDied
+			}
+			return res, nil
+		case <-done:
+			return client.Response{}, reason
+		}
+	}
+}
+
+// currentSettings returns the settings of the last reload or, if the
+// settings have not been reloaded yet, the initial settings.
+func (h *nodeHandler) currentSettings() *settings {
+	if s, ok := h.reloaded.Load().(*settings); ok {
+		return s
+	}
+	return h.Settings
 }
 
 // splitAction splits and returns the path and @@action of the given URL.
+//
+// The daemon's sub actions, e.g. /path/to/node/@@users/add, will be split
+// into /path/to/node and users/add. Other actions must be the last part of
+// the path.
 func splitAction(path string) (string, string) {
 	tokens := strings.Split(path, "/")
-	last := tokens[len(tokens)-1]
-	var action string
-	if len(last) > 2 && last[:2] == "@@" {
-		action = last[2:]
-	}
-	nodePath := path
-	if len(action) > 0 {
-		nodePath = path[:len(path)-(len(action)+3)]
-		if len(nodePath) == 0 {
-			nodePath = "/"
+	for i, token := range tokens {
+		if len(token) > 2 && token[:2] == "@@" {
+			action := strings.TrimRight(strings.Join(tokens[i:], "/")[2:], "/")
+			if i < len(tokens)-1 && !inStringSlice(action, daemonActions) {
+				break
+			}
+			nodePath := strings.Join(tokens[:i], "/")
+			if len(nodePath) == 0 {
+				nodePath = "/"
+			}
+			return nodePath, action
 		}
 	}
-	return nodePath, action
+	return path, ""
+}
+
+// loginURL returns the URL of the login form of the given node which will
+// redirect back to the given URL after login.
+func loginURL(nodePath, back string) string {
+	return path.Join(nodePath, "@@login") + "?" +
+		url.Values{"back": []string{back}}.Encode()
 }
 
 // ServeHTTP handles incoming HTTP requests.
 func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == h.healthCheckPath() {
+		h.ServeHealth(w, r)
+		return
+	}
+	settings := h.currentSettings()
+	applyProxyHeaders(r, settings.Proxies, settings.TrustForwardedFor)
+	if h.serveWellKnown(w, r) {
+		return
+	}
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+	defer context.Clear(r)
+	span := h.Tracer.StartRequest(r)
+	threshold := time.Duration(h.currentSettings().SlowRequestMillis) *
+		time.Millisecond
+	timings := startTimer(r, threshold, start)
+	setRequestID(rec, r)
+	defer h.logAccess(rec, r, start)
+	h.serve(rec, r)
+	h.logSlowRequest(r, timings, threshold)
+	span.SetAttribute("http.status_code", strconv.Itoa(rec.Status))
+	if rec.Status >= 500 {
+		span.SetError(fmt.Errorf("Status %v", rec.Status))
+	}
+	span.Finish()
+}
+
+// serve handles incoming HTTP requests.
+func (h *nodeHandler) serve(w http.ResponseWriter, r *http.Request) {
+	site, ok := h.Sites.Lookup(r.Host)
+	if !ok {
+		h.Log.Debug("No site found for host %q", r.Host)
+		setSecurityHeaders(w.Header(), site, "")
+		if len(h.currentSettings().UnknownHostRedirect) > 0 {
+			http.Redirect(w, r, h.currentSettings().UnknownHostRedirect,
+				http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "No site found for host "+r.Host, http.StatusNotFound)
+		return
+	}
+	if len(site.CanonicalHost) > 0 && site.isAlias(r.Host) &&
+		!matchHost(r.Host, site.CanonicalHost) {
+		http.Redirect(w, r, canonicalURL(r, site.CanonicalHost),
+			http.StatusMovedPermanently)
+		return
+	}
+	sitePath, ok := site.stripBasePath(r.URL.Path)
+	if !ok {
+		h.renderError(w, r, "Page not found.", http.StatusNotFound,
+			client.Node{Path: "/"}, nil, site)
+		return
+	}
+	if len(sitePath) == 0 {
+		http.Redirect(w, r, site.URL("/"), http.StatusSeeOther)
+		return
+	}
+	nodePath, action := splitAction(normalizeName(sitePath, site.NodeNames))
+	maxSize := site.maxRequestSize(action)
+	if r.ContentLength > maxSize {
+		h.renderError(w, r, "The request is too large.",
+			http.StatusRequestEntityTooLarge, client.Node{Path: "/"}, nil, site)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	timings := getRequestTimer(r)
+	timings.Describe(site.Name, action, "")
+	if action == cronAction {
+		h.renderError(w, r, "Page not found.", http.StatusNotFound,
+			client.Node{Path: "/"}, nil, site)
+		return
+	}
+	setSecurityHeaders(w.Header(), site, action)
+	if handleCORS(w, r, site.CORS, action) {
+		return
+	}
+	cSession := &client.Session{Locale: site.Locale}
 	defer func() {
 		if err := recover(); err != nil {
 			var buf bytes.Buffer
 			fmt.Fprintf(&buf, "panic: %v\n", err)
-			buf.Write(debug.Stack())
-			h.Log.Println(buf.String())
-			http.Error(w, "Application error.",
-				http.StatusInternalServerError)
+			stack := debug.Stack()
+			buf.Write(stack)
+			h.requestLog(r, site.Name).Error("%v %v%v: %v", r.Method, r.Host,
+				r.URL.Path, buf.String())
+			h.Notifier.NotifyAll(site, notification{Kind: notifyPanic,
+				Site: site.Name, Path: r.URL.Path, Error: fmt.Sprint(err),
+				Stack: string(stack)})
+			if tErr, ok := err.(*templateError); ok && h.Renderer.Dev &&
+				context.Get(r, accessUserKey) != nil {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "<h1>Template error</h1><pre>%v</pre>",
+					htmlT.HTMLEscapeString(tErr.Error()))
+				return
+			}
+			h.renderError(w, r, "Application error.",
+				http.StatusInternalServerError, client.Node{Path: "/"}, cSession,
+				site)
 		}
 	}()
-	nodePath, action := splitAction(r.URL.Path)
+	if strings.HasPrefix(sitePath, "/site-static/") {
+		http.StripPrefix(site.BasePath, http.FileServer(http.Dir(
+			filepath.Dir(site.Directories.Statics)))).ServeHTTP(w, r)
+		return
+	}
+	if isDAVPath(sitePath) {
+		h.ServeDAV(w, r, site)
+		return
+	}
+	attachment := false
 	if len(action) == 0 && nodePath[len(nodePath)-1] != '/' {
-		newPath, err := url.Parse(nodePath + "/")
+		_, err := servableFile(site, nodePath)
+		attachment = err == nil
+	}
+	_, resize, _ := parseImageParams(r.URL.Query())
+	if attachment && publicFile(site, nodePath) && !resize {
+		// Public files are served without a session. Resizing images is
+		// expensive, so it's subject to rate limiting like page views.
+		h.ServeAttachment(w, r, nodePath, nil, nil, site)
+		return
+	}
+	if !attachment && len(action) == 0 && nodePath[len(nodePath)-1] != '/' {
+		if _, err := lookupNode(site.Directories.Data, nodePath); err != nil &&
+			redirectLegacyPath(w, r, site, nodePath, action) {
+			return
+		}
+		newPath, err := url.Parse(site.URL(nodePath + "/"))
 		if err != nil {
 			panic("Could not parse request URL:" + err.Error())
 		}
@@ -78,59 +439,352 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, url.String(), http.StatusSeeOther)
 		return
 	}
-	site_name, ok := h.Hosts[r.Host]
-	if !ok {
-		panic("No site found for host " + r.Host)
+	var token *apiToken
+	if secret, ok := bearerToken(r); ok {
+		if token, ok = h.authenticateToken(w, r, site, secret, nodePath,
+			action); !ok {
+			return
+		}
+		// Token requests must neither use nor set the session cookie.
+		r.Header.Del("Cookie")
+		w = noCookieWriter{w}
+		context.Set(r, tokenAuthKey, true)
 	}
-	site := h.Settings.Sites[site_name]
-	site.Name = site_name
 	session := getSession(r, site)
-	defer context.Clear(r)
-	cSession := getClientSession(session, site.Directories.Config)
-	cSession.Locale = site.Locale
+	var roles []string
+	if token != nil {
+		cSession, roles = token.Session(site.Locale), token.Roles()
+	} else {
+		var modified bool
+		sessionSpan, sessionStart := startSpan(r, "getClientSession"),
+			timings.Now()
+		var err error
+		cSession, roles, modified, err = getClientSession(session, site,
+			time.Now())
+		sessionSpan.Finish()
+		timings.End(phaseSession, sessionStart)
+		if err != nil {
+			h.requestLog(r, site.Name).Error(
+				"Could not get user of session, treating as anonymous: %v", err)
+		}
+		if modified {
+			if err := session.Save(r, w); err != nil {
+				panic("Could not save session: " + err.Error())
+			}
+		}
+		if cSession.User != nil {
+			context.Set(r, accessUserKey, cSession.User.Login)
+		}
+	}
+	timings.EnableDebug(r, roles)
+	debug := startDebug(r, site, roles)
+	cSession.Locale = requestLocale(r, session, cSession.Locale,
+		h.siteLocales(site), site.Locale)
+	// The locale of the web interface depends on the Accept-Language header.
+	w.Header().Add("Vary", "Accept-Language")
+	if privilegedAction(action, site) && !site.adminAllowed(clientIP(r)) {
+		h.requestLog(r, site.Name).Warn(
+			"Rejected action %q of user %q from network %v", action,
+			sessionLogin(cSession), clientIP(r))
+		h.renderError(w, r, "This action is not allowed from your network.",
+			http.StatusForbidden, client.Node{Path: "/"}, cSession, site)
+		return
+	}
+	budget := requestBudget(r.Method, action, cSession.User != nil)
+	if budget != -1 {
+		if ok, wait := h.RateLimiter.Take(budget, clientIP(r)); !ok {
+			h.requestLog(r, site.Name).Debug("Rate limit %v exceeded by %v",
+				budgetNames[budget], clientIP(r))
+			w.Header().Set("Retry-After",
+				strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			h.renderError(w, r, "Too many requests. Please try again later.",
+				statusTooManyRequests, client.Node{Path: "/"}, cSession, site)
+			return
+		}
+	}
+	if attachment {
+		h.ServeAttachment(w, r, nodePath, roles, cSession, site)
+		return
+	}
+	lookupSpan, lookupStart := startSpan(r, "lookupNode"), timings.Now()
 	node, err := lookupNode(site.Directories.Data, nodePath)
+	lookupSpan.SetError(err)
+	lookupSpan.Finish()
+	timings.End(phaseLookup, lookupStart)
+	if err == nil {
+		timings.Describe(site.Name, action, node.Type)
+		if debug != nil {
+			debug.NodeType = node.Type
+			debug.NodeFile, _ = nodeFile(site.Directories.Data, node.Path,
+				"node.yaml")
+		}
+	}
+	if err == errInvalidPath {
+		h.requestLog(r, site.Name).Warn("Rejected invalid node path %q",
+			nodePath)
+		h.renderError(w, r, "Invalid path.", http.StatusBadRequest,
+			client.Node{Path: "/"}, cSession, site)
+		return
+	}
+	if err != nil && redirectLegacyPath(w, r, site, nodePath, action) {
+		return
+	}
+	if err != nil && action == "remove" && r.Method == "POST" {
+		// Replayed submissions of the remove form get redirected to the
+		// parent like the first one.
+		if target := usedFormTokens.Target(r.PostFormValue(
+			"FormToken")); len(target) > 0 {
+			http.Redirect(w, r, target, http.StatusSeeOther)
+			return
+		}
+	}
 	if err != nil {
-		h.Log.Println("Node not found.")
-		http.Error(w, "Node not found: "+err.Error(), http.StatusNotFound)
+		h.requestLog(r, site.Name).Debug("Node not found: %v: %v", nodePath,
+			err)
+		h.renderError(w, r, "Node not found.", http.StatusNotFound,
+			client.Node{Path: "/"}, cSession, site)
 		return
 	}
-
-	if !checkPermission(action, cSession) {
-		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+	if len(action) == 0 {
+		var translation string
+		node, translation = translateNode(site.Directories.Data, node,
+			cSession.Locale)
+		context.Set(r, nodeLocaleKey, translation)
+	}
+	access := newNodeAccess(site.Directories.Data, roles)
+	access.Log = h.requestLog(r, site.Name).Error
+	context.Set(r, nodeAccessKey, access)
+	err = h.actions().Check(node.Type, action, roles, site.Permissions)
+	if err == errActionUnknown {
+		h.requestLog(r, site.Name).Debug("Unknown action %q for node type %q",
+			action, node.Type)
+		h.renderError(w, r, "Not implemented.", http.StatusNotImplemented,
+			node, cSession, site)
+		return
+	}
+	if (!unrestrictedActions[action] && !access.CanView(node.Path)) ||
+		err == errActionDenied {
+		h.Deny(w, r, node, cSession, site)
 		return
 	}
+	if inStringSlice(action, daemonActions) && !idempotentMethod(r.Method) {
+		// The daemon's handlers don't check the errors of parsing their forms.
+		if err := r.ParseForm(); bodyTooLarge(err) {
+			h.renderError(w, r, "The request is too large.",
+				http.StatusRequestEntityTooLarge, node, cSession, site)
+			return
+		}
+	}
 	switch action {
 	case "login":
 		h.Login(w, r, node, session, cSession, site)
 	case "logout":
-		h.Logout(w, r, node, session)
+		h.Logout(w, r, node, session, site)
+	case "reset-password":
+		h.ResetPassword(w, r, node, session, cSession, site)
+	case "setup-2fa":
+		h.SetupTwoFactor(w, r, node, session, cSession, site)
+	case "status":
+		h.Status(w, r, node, session, cSession, site)
+	case "recent":
+		h.Recent(w, r, node, session, cSession, site)
+	case "usage":
+		h.Usage(w, r, node, session, cSession, site)
+	case "search":
+		h.Search(w, r, node, session, cSession, site)
+	case "json":
+		h.JSON(w, r, node, cSession, site)
+	case "feed":
+		h.Feed(w, r, node, site)
+	case "export":
+		h.Export(w, r, node, session, cSession, site)
+	case "import":
+		h.Import(w, r, node, session, cSession, site)
+	case "audit":
+		h.Audit(w, r, node, session, cSession, site)
+	case "history":
+		h.History(w, r, node, session, cSession, site)
+	case "blocks":
+		h.Blocks(w, r, node, session, cSession, site)
+	case "attachments":
+		h.Attachments(w, r, node, session, cSession, site)
+	case "aliases":
+		h.Aliases(w, r, node, session, cSession, site)
+	case "tokens":
+		h.Tokens(w, r, node, session, cSession, site)
+	case "set-locale":
+		h.SetLocale(w, r, node, session, cSession, site)
 	case "add":
 		h.Add(w, r, node, session, cSession, site)
 	case "remove":
 		h.Remove(w, r, node, session, cSession, site)
+	case "users":
+		h.Users(w, r, node, session, cSession, site)
+	case "users/add":
+		h.EditUser(w, r, node, session, cSession, site, true)
+	case "users/edit":
+		h.EditUser(w, r, node, session, cSession, site, false)
+	case "users/disable":
+		h.DisableUser(w, r, node, session, cSession, site, false)
+	case "users/enable":
+		h.DisableUser(w, r, node, session, cSession, site, true)
+	default:
+		h.RequestNode(w, r, node, action, session, cSession, roles, site)
+	}
+}
+
+// isAPIRequest returns true if the request seems to be made by some API
+// client instead of a browser.
+func isAPIRequest(r *http.Request) bool {
+	if _, action := splitAction(r.URL.Path); action == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Deny responds to requests the user is not allowed to perform.
+//
+// Anonymous browser requests get redirected to the login form which will
+// redirect back to the requested URL after login.
+func (h *nodeHandler) Deny(w http.ResponseWriter, r *http.Request,
+	node client.Node, cSession *client.Session, site site) {
+	switch {
+	case cSession.User != nil:
+		h.renderError(w, r, "Forbidden.", http.StatusForbidden, node, cSession,
+			site)
+	case isAPIRequest(r):
+		h.renderError(w, r, "Unauthorized.", http.StatusUnauthorized, node,
+			cSession, site)
 	default:
-		h.RequestNode(w, r, node, action, session, cSession, site)
+		http.Redirect(w, r, loginURL(site.URL(node.Path), r.URL.RequestURI()),
+			http.StatusSeeOther)
 	}
 }
 
 // RequestNode handles node requests.
 func (h *nodeHandler) RequestNode(w http.ResponseWriter, r *http.Request,
 	node client.Node, action string, session *sessions.Session,
-	cSession *client.Session, site site) {
+	cSession *client.Session, roles []string, site site) {
 	// Setup ticket and send to workers.
-	h.Log.Println(site.Name, r.Method, r.URL.Path)
-	c := make(chan client.Response)
-	h.QueueTicket(worker.Ticket{
-		Node:         node,
-		Request:      r,
-		ResponseChan: c,
-		Session:      *cSession,
-		Action:       action,
-		Site:         site.Name})
-
-	// Process response received from a worker.
-	// If the worker process dies, the channel will be closed.
-	res := <-c
+	h.requestLog(r, site.Name).Info("%v %v", r.Method, r.URL.Path)
+	login := sessionLogin(cSession)
+	editing := action == "edit" && len(login) > 0
+	if editing && r.Method == "POST" && r.URL.Query().Get("takeover") == "1" {
+		h.takeOverEditLock(w, r, node, login, session, site)
+		return
+	}
+	if editing && r.Method == "GET" {
+		lock, err := acquireEditLock(site.Directories.Data, node.Path, login,
+			false, time.Now())
+		if err != nil {
+			h.requestLog(r, site.Name).Warn("Could not lock %q: %v", node.Path,
+				err)
+		}
+		if lock != nil {
+			context.Set(r, editLockKey, lock)
+		}
+	}
+	protocol := h.Protocols.Get(node.Type)
+	if protocol.State == handshakeRefused {
+		h.renderError(w, r, "The page could not be generated. Please try"+
+			" again later.", http.StatusBadGateway, node, cSession, site)
+		return
+	}
+	ticket := worker.Ticket{
+		Node:      node,
+		Request:   r,
+		Session:   *cSession,
+		Roles:     roles,
+		Action:    action,
+		Site:      site.Name,
+		ClientIP:  clientIP(r),
+		Scheme:    requestScheme(r),
+		RequestID: requestID(r),
+		CSRFToken: pendingCSRFToken(session),
+		// Only store new tokens if the worker used them.
+		CSRFTokenUsed: new(int32)}
+	// The locale chosen for the web interface only applies to the daemon's
+	// pages, workers use the site's locale.
+	ticket.Session.Locale = site.Locale
+	if !idempotentMethod(r.Method) {
+		files, dir, err := parseBody(r)
+		if len(dir) > 0 {
+			defer os.RemoveAll(dir)
+		}
+		switch {
+		case bodyTooLarge(err):
+			h.renderError(w, r, "The request is too large.",
+				http.StatusRequestEntityTooLarge, node, cSession, site)
+			return
+		case err != nil:
+			h.requestLog(r, site.Name).Info("Could not parse request body: %v",
+				err)
+			h.renderError(w, r, "Invalid request.", http.StatusBadRequest, node,
+				cSession, site)
+			return
+		}
+		ticket.Form, ticket.Files = r.Form, files
+	}
+	if timeout := h.currentSettings().nodeType(node.Type).Timeout; timeout > 0 {
+		ticket.Deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	gone := closeNotify(w)
+	res, err := h.requestWorker(ticket, gone)
+	if err == errWorkerDied && r.Method == "GET" &&
+		h.currentSettings().RetryFailedRequests {
+		h.Stats.Failed(node.Type)
+		h.requestLog(r, site.Name).Warn(
+			"Worker of node type %q died while handling %q, retrying",
+			node.Type, node.Path)
+		res, err = h.requestWorker(ticket, gone)
+	}
+	if atomic.LoadInt32(ticket.CSRFTokenUsed) == 1 {
+		storeCSRFToken(session, ticket.CSRFToken)
+	}
+	switch err {
+	case errClientGone:
+		h.requestLog(r, site.Name).Info(
+			"Client went away while waiting for the worker of node type %q",
+			node.Type)
+		return
+	case errTimeout:
+		h.requestLog(r, site.Name).Warn(
+			"Worker of node type %q did not respond to %q in time", node.Type,
+			node.Path)
+		h.renderError(w, r, "The page could not be generated in time. Please"+
+			" try again later.", http.StatusGatewayTimeout, node, cSession, site)
+		return
+	case errWorkerDied:
+		h.Stats.Failed(node.Type)
+		h.requestLog(r, site.Name).Error(
+			"Worker of node type %q died while handling %q", node.Type,
+			node.Path)
+		if idempotentMethod(r.Method) {
+			h.renderError(w, r, "The page could not be generated. Please try"+
+				" again later.", http.StatusBadGateway, node, cSession, site)
+			return
+		}
+		id, err := spoolTicket(site.Directories.Data, ticket, time.Now())
+		if err != nil {
+			h.requestLog(r, site.Name).Error("Could not spool request: %v", err)
+			h.renderError(w, r, "Your request could not be processed. Please"+
+				" try again later.", http.StatusBadGateway, node, cSession, site)
+			return
+		}
+		h.requestLog(r, site.Name).Warn("Spooled request as %q", id)
+		h.renderError(w, r, "Your request could not be processed. It has been"+
+			" saved for the site's administrators.", http.StatusBadGateway, node,
+			cSession, site)
+		return
+	}
+	h.Stats.Served(node.Type)
+	if editing && r.Method == "POST" && len(res.Redirect) > 0 {
+		if err := releaseEditLock(site.Directories.Data, node.Path,
+			login); err != nil {
+			h.requestLog(r, site.Name).Warn("Could not unlock %q: %v",
+				node.Path, err)
+		}
+	}
 	h.ProcessNodeResponse(res, w, r, node, action, session,
 		cSession, site)
 }
@@ -139,10 +793,15 @@ func (h *nodeHandler) ProcessNodeResponse(res client.Response,
 	w http.ResponseWriter, r *http.Request, node client.Node,
 	action string, session *sessions.Session,
 	cSession *client.Session, site site) {
+	timings := getRequestTimer(r)
 	G := l10n.UseCatalog(cSession.Locale)
+	if previewRequest(r, action) && len(res.Body) > 0 {
+		h.renderPreview(res, w, r, node, cSession, site)
+		return
+	}
 	if len(res.Body) == 0 && len(res.Redirect) == 0 {
-		http.Error(w, "Application error.",
-			http.StatusInternalServerError)
+		h.renderError(w, r, "Application error.",
+			http.StatusInternalServerError, node, cSession, site)
 		return
 	}
 	if res.Node != nil {
@@ -150,44 +809,267 @@ func (h *nodeHandler) ProcessNodeResponse(res client.Response,
 		node = *res.Node
 		node.Path = oldPath
 	}
+	if value := cacheControl(site, node.Path, action,
+		cSession.User != nil); len(value) > 0 {
+		w.Header().Set("Cache-Control", value)
+	}
+	if site.Purge.Enabled {
+		w.Header().Set(purgeKeyHeader, path.Clean(node.Path))
+	}
 	if len(res.Redirect) > 0 {
-		http.Redirect(w, r, res.Redirect, http.StatusSeeOther)
+		target := res.Redirect
+		if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+			target = site.URL(target)
+		}
+		uncacheableCookies(w.Header())
+		http.Redirect(w, r, target, http.StatusSeeOther)
 		return
 	}
-	env := masterTmplEnv{Node: node, Session: cSession}
+	env := masterTmplEnv{Node: node, Session: cSession,
+		Access: requestNodeAccess(r), Debug: requestDebugInfo(r)}
+	env.NodeLocale, _ = context.Get(r, nodeLocaleKey).(string)
 	if action == "edit" {
 		env.Title = fmt.Sprintf(G("Edit \"%s\""), node.Title)
 		env.Flags = EDIT_VIEW
+		if lock, ok := context.Get(r, editLockKey).(*editLock); ok {
+			env.EditLock = lock
+			env.TakeoverURL = site.URL(path.Join(node.Path, "@@edit")) +
+				"?takeover=1"
+			env.CSRFToken = getCSRFToken(session)
+		}
 	}
 	var content []byte
 	if res.Raw {
 		content = res.Body
 	} else {
-		content = []byte(renderInMaster(h.Renderer, res.Body, env, h.Settings,
-			site, cSession.Locale))
+		renderSpan, renderStart := startSpan(r, "renderInMaster"), timings.Now()
+		content = []byte(renderInMaster(h.Renderer, res.Body, env,
+			h.currentSettings(), site, cSession.Locale))
+		renderSpan.Finish()
+		timings.End(phaseRender, renderStart)
+		if env.Debug != nil {
+			// The toolbar must never be stored by caches.
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if site.MinifyHTML && isHTMLResponse(w.Header()) {
+			content = minifyHTML(content)
+		}
 	}
-	err := session.Save(r, w)
-	if err != nil {
+	if err := saveChangedSession(r, w, session); err != nil {
 		panic(err.Error())
 	}
+	uncacheableCookies(w.Header())
+	timings.SetHeader(w)
+	if len(w.Header().Get("Content-Type")) == 0 {
+		w.Header().Set("Content-Type", http.DetectContentType(content))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	// Responses to HEAD requests get the headers of GET requests, but no
+	// body.
+	if r.Method == "HEAD" {
+		return
+	}
+	writeStart := timings.Now()
 	w.Write(content)
+	timings.End(phaseWrite, writeStart)
+}
+
+// maxHeadlessLogLength is the maximum number of bytes of the responses to
+// headless tickets being logged.
+const maxHeadlessLogLength = 200
+
+// ProcessHeadlessResponse handles the response to a ticket without HTTP
+// request, e.g. of a scheduled task. The response gets logged instead of
+// being sent to a browser.
+//
+// Fails if the worker sent an empty response.
+func (h *nodeHandler) ProcessHeadlessResponse(res client.Response,
+	ticket worker.Ticket) error {
+	if len(res.Body) == 0 && len(res.Redirect) == 0 {
+		return fmt.Errorf("Worker of node type %q sent an empty response",
+			ticket.Node.Type)
+	}
+	body := strings.TrimSpace(string(res.Body))
+	if len(body) > maxHeadlessLogLength {
+		body = body[:maxHeadlessLogLength] + "..."
+	}
+	h.SiteLog(ticket.Site).Info("[%v] Worker of node type %q responded to"+
+		" @@%v: %q", ticket.RequestID, ticket.Node.Type, ticket.Action, body)
+	return nil
+}
+
+// previewField is the form field of edit submissions asking for a preview of
+// the changes. Workers must not save such submissions but answer with the
+// content of the node as it would look like.
+const previewField = "Preview"
+
+// previewRequest returns true iff the given request submits the edit form to
+// preview the changes.
+func previewRequest(r *http.Request, action string) bool {
+	return action == "edit" && r.Method == "POST" &&
+		len(r.Form.Get(previewField)) > 0
+}
+
+// renderPreview renders the body of the given response to a preview request
+// in the master template.
+//
+// Previews must not have any side effects: The session won't be saved and
+// the response must not be cached.
+func (h *nodeHandler) renderPreview(res client.Response,
+	w http.ResponseWriter, r *http.Request, node client.Node,
+	cSession *client.Session, site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if res.Node != nil {
+		oldPath := node.Path
+		node = *res.Node
+		node.Path = oldPath
+	}
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: PREVIEW_VIEW,
+		Title:       fmt.Sprintf(G("Preview of \"%s\""), node.Title),
+		Description: node.Description, Access: requestNodeAccess(r)}
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, renderInMaster(h.Renderer, res.Body, env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+// workerCommand returns the command to start the worker of the given node
+// type.
+func (h *nodeHandler) workerCommand(nodeType string) (worker.Command, error) {
+	h.mutex.RLock()
+	command, ok := h.commands[nodeType]
+	h.mutex.RUnlock()
+	if ok {
+		return command, nil
+	}
+	return h.currentSettings().workerCommand(nodeType)
+}
+
+// Default watchdog settings.
+const (
+	defaultPingSeconds    = 10
+	defaultMaxMissedPings = 6
+)
+
+// watchdogSettings returns the interval in which workers must communicate
+// and the number of missed intervals after which they will be killed.
+func (h *nodeHandler) watchdogSettings() (time.Duration, int) {
+	seconds, misses := h.currentSettings().Watchdog.PingSeconds,
+		h.currentSettings().Watchdog.MaxMissedPings
+	if seconds <= 0 {
+		seconds = defaultPingSeconds
+	}
+	if misses <= 0 {
+		misses = defaultMaxMissedPings
+	}
+	return time.Duration(seconds) * time.Second, misses
+}
+
+// Delays before restarting crashed workers.
+const (
+	minRestartDelay = 5 * time.Second
+	maxRestartDelay = 5 * time.Minute
+)
+
+// restartDelay returns the time to wait before restarting a worker which
+// crashed after running for the given time. previous is the delay before
+// the last restart or zero.
+//
+// The delay doubles for each worker crashing before it ran for
+// maxRestartDelay, up to maxRestartDelay.
+func restartDelay(previous, uptime time.Duration) time.Duration {
+	if previous == 0 || uptime >= maxRestartDelay {
+		return minRestartDelay
+	}
+	if delay := 2 * previous; delay < maxRestartDelay {
+		return delay
+	}
+	return maxRestartDelay
 }
 
 // AddNodeProcess starts a worker process to handle the given node type.
 func (h *nodeHandler) AddNodeProcess(nodeType string, logger *log.Logger) {
-	if _, ok := h.NodeQueues[nodeType]; !ok {
-		h.NodeQueues[nodeType] = make(chan worker.Ticket)
+	command, err := h.workerCommand(nodeType)
+	if err != nil {
+		h.Stats.SetState(nodeType, workerDead)
+		panic("Could not run worker: " + err.Error())
 	}
-	nodeRPC := NodeRPC{Settings: h.Settings, Log: logger}
-	worker := worker.NewWorker("monsti-"+nodeType, h.NodeQueues[nodeType],
-		&nodeRPC, h.Settings.Directories.Config, h.Log)
-	nodeRPC.Worker = worker
+	h.mutex.Lock()
+	queue, ok := h.NodeQueues[nodeType]
+	if !ok {
+		queue = make(chan worker.Ticket)
+		h.NodeQueues[nodeType] = queue
+	}
+	h.mutex.Unlock()
+	nodeRPC := NodeRPC{Settings: h.currentSettings(), Sites: h.Sites,
+		Log: logger, NodeType: nodeType, Protocols: h.Protocols,
+		SubRequest: h.subRequest}
+	nodeWorker := worker.NewWorker("monsti-"+nodeType, command, queue,
+		&nodeRPC, h.Log.Logger)
+	nodeRPC.Worker = nodeWorker
+	started := time.Now()
 	callback := func() {
-		log.Println("Trying to restart worker in 5 seconds.")
-		time.Sleep(5 * time.Second)
-		h.AddNodeProcess(nodeType, h.Log)
+		h.mutex.Lock()
+		intended := h.restarting[nodeType]
+		delete(h.restarting, nodeType)
+		if h.restartDelays == nil {
+			h.restartDelays = make(map[string]time.Duration)
+		}
+		delay := minRestartDelay
+		if !intended {
+			delay = restartDelay(h.restartDelays[nodeType], time.Since(started))
+		}
+		h.restartDelays[nodeType] = delay
+		h.mutex.Unlock()
+		if !intended {
+			h.Notifier.NotifyAll(site{}, notification{Kind: notifyWorkerDied,
+				Error: fmt.Sprintf("Worker of node type %q died", nodeType)})
+		}
+		h.Stats.SetState(nodeType, workerRestarting)
+		h.Log.Warn("Trying to restart worker of node type %q in %v.", nodeType,
+			delay)
+		time.Sleep(delay)
+		h.AddNodeProcess(nodeType, h.Log.Logger)
 	}
-	if err := worker.Run(callback); err != nil {
+	generation := h.Protocols.Started(nodeType)
+	if err := nodeWorker.Run(callback); err != nil {
+		h.Stats.SetState(nodeType, workerDead)
 		panic("Could not run worker: " + err.Error())
 	}
+	time.AfterFunc(handshakeTimeout, func() {
+		h.Protocols.Legacy(nodeType, generation)
+	})
+	interval, misses := h.watchdogSettings()
+	nodeWorker.Watch(interval, misses, func() bool {
+		return h.Stats.Queued(nodeType) > 0
+	}, func() {
+		h.Stats.Killed(nodeType)
+		h.Log.Error("Worker of node type %q stopped responding, killing it",
+			nodeType)
+	})
+	h.mutex.Lock()
+	if h.workers == nil {
+		h.workers = make(map[string]*worker.Worker)
+	}
+	h.workers[nodeType] = nodeWorker
+	h.mutex.Unlock()
+	h.Stats.Started(nodeType)
+	h.Stats.SetCommand(nodeType, command.String())
+}
+
+// restartWorker kills the worker process of the given node type. It will be
+// restarted like a crashed worker.
+func (h *nodeHandler) restartWorker(nodeType string) error {
+	h.mutex.Lock()
+	nodeWorker, ok := h.workers[nodeType]
+	if ok {
+		if h.restarting == nil {
+			h.restarting = make(map[string]bool)
+		}
+		h.restarting[nodeType] = true
+	}
+	h.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("No worker running for node type %q", nodeType)
+	}
+	return nodeWorker.Kill()
 }
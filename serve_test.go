@@ -2,9 +2,19 @@ package main
 
 import (
 	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
 	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSplitAction(t *testing.T) {
@@ -20,7 +30,11 @@ func TestSplitAction(t *testing.T) {
 		{"/foo/@@action/foo", "/foo/@@action/foo", ""},
 		{"/foo/bar", "/foo/bar", ""},
 		{"/foo/bar/@@action", "/foo/bar", "action"},
-		{"/foo/bar/@@action/", "/foo/bar/@@action/", ""}}
+		{"/foo/bar/@@action/", "/foo/bar/@@action/", ""},
+		{"/foo/@@users/add", "/foo", "users/add"},
+		{"/@@users/edit/", "/", "users/edit"},
+		{"/foo/@@users/foo", "/foo/@@users/foo", ""},
+		{"/foo/bar/@@", "/foo/bar/@@", ""}}
 	for _, v := range tests {
 		rnode, raction := splitAction(v.Path)
 		if rnode != v.NodePath || raction != v.Action {
@@ -72,3 +86,280 @@ func TestProcessNodeResponse(t *testing.T) {
 
 	}
 }
+
+func TestProcessNodeResponsePreview(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/foo/node.yaml":                    "title: Foo",
+		"/data/foo/body.html":                    "Saved",
+		"/templates/master.html":                 "{{.Page.Title}}|{{.Page.Content}}",
+		"/templates/daemon/actions/preview.html": "PREVIEW|"},
+		"TestProcessNodeResponsePreview")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := site{SessionAuthKey: "foobar"}
+	site.Directories.Data = filepath.Join(root, "data")
+	h := nodeHandler{
+		Renderer: &templateRenderer{Root: filepath.Join(root, "templates")},
+		Settings: new(settings)}
+	req, _ := http.NewRequest("POST", "http://example.com/foo/@@edit", nil)
+	session := getSession(req, site)
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	req.Form = url.Values{previewField: {"1"}}
+	res := client.Response{Body: []byte("Unsaved"),
+		Node: &client.Node{Title: "Changed"}}
+	h.ProcessNodeResponse(res, w, req, client.Node{Path: "/foo", Title: "Foo"},
+		"edit", session, &client.Session{}, site)
+	if body := w.Body.String(); body != `Preview of &#34;Changed&#34;|PREVIEW|Unsaved` {
+		t.Errorf("Preview body is %q", body)
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Preview should not save the session")
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Preview should not be cached")
+	}
+	saved, err := ioutil.ReadFile(filepath.Join(root, "data", "foo", "body.html"))
+	if err != nil || !strings.Contains(string(saved), "Saved") {
+		t.Errorf("Preview changed the saved content: %q, %v", saved, err)
+	}
+}
+
+// setupWorkerHandler returns a node handler serving the site "foo" at
+// example.com with the given data directory. Requests for nodes of type
+// Document will be passed to the given worker function.
+func setupWorkerHandler(root string, logOutput io.Writer,
+	work func(worker.Ticket)) (*nodeHandler, func()) {
+	site_ := site{Name: "foo", Hosts: []string{"example.com"},
+		SessionAuthKey: "foobar"}
+	site_.Directories.Data = root
+	h := &nodeHandler{
+		Settings:   &settings{},
+		Sites:      newSiteRegistry(map[string]site{"foo": site_}, ""),
+		NodeQueues: map[string]chan worker.Ticket{},
+		Log:        newLeveledLogger(log.New(logOutput, "", 0), levelInfo),
+		Stats:      newWorkerStats()}
+	queue := make(chan worker.Ticket)
+	h.NodeQueues["Document"] = queue
+	go func() {
+		for ticket := range queue {
+			work(ticket)
+		}
+	}()
+	return h, func() {
+		h.stopLanes()
+		close(queue)
+	}
+}
+
+func TestRequestNodeWorkerDied(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRequestNodeWorkerDied")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Method string
+		Retry  bool
+		Status int
+		Tries  int
+	}{
+		{"GET", false, http.StatusBadGateway, 1},
+		{"POST", true, http.StatusBadGateway, 1},
+		{"GET", true, http.StatusOK, 2}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		tries := 0
+		h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+			tries++
+			if tries == 1 {
+				close(ticket.ResponseChan)
+				return
+			}
+			ticket.ResponseChan <- client.Response{Body: []byte("ok"), Raw: true}
+		})
+		h.Settings.RetryFailedRequests = v.Retry
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(v.Method, "http://example.com/foo/", nil)
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status || tries != v.Tries {
+			t.Errorf("Test %v: Got %v after %v tries, should be %v after %v", i,
+				w.Code, tries, v.Status, v.Tries)
+		}
+		if stats := h.Stats.Get(); len(stats) != 1 || stats[0].Failures != 1 {
+			t.Errorf("Test %v: Worker failure should be counted: %v", i, stats)
+		}
+		if v.Status == http.StatusBadGateway &&
+			!strings.Contains(logBuf.String(), `ERROR: `) {
+			t.Errorf("Test %v: Worker failure should be logged, got %q", i,
+				logBuf.String())
+		}
+	}
+}
+
+// closeNotifyRecorder is a ResponseRecorder notifying about the client
+// going away when its channel receives a value.
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+	closed chan bool
+}
+
+func (r closeNotifyRecorder) CloseNotify() <-chan bool {
+	return r.closed
+}
+
+func TestRequestNodeClientGone(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRequestNodeClientGone")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	for _, picked := range []bool{true, false} {
+		var logBuf bytes.Buffer
+		abandoned := make(chan bool, 1)
+		working := make(chan bool, 1)
+		h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+			working <- true
+			<-ticket.Done
+			abandoned <- ticket.Expired(time.Now())
+		})
+		if !picked {
+			// Nobody picks up the ticket.
+			h.NodeQueues["Document"] = make(chan worker.Ticket)
+		}
+		w := closeNotifyRecorder{httptest.NewRecorder(), make(chan bool, 1)}
+		r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+		served := make(chan bool)
+		go func() {
+			h.ServeHTTP(w, r)
+			served <- true
+		}()
+		if picked {
+			// Queue returns before a worker has the ticket.
+			<-working
+		}
+		w.closed <- true
+		select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Fatalf("Picked %v: Daemon should stop waiting if the client went"+
+				" away", picked)
+		}
+		if picked {
+			if expired := <-abandoned; !expired {
+				t.Errorf("Abandoned ticket should be expired")
+			}
+		}
+		if stats := h.Stats.Get(); len(stats) != 1 || stats[0].Queued != 0 ||
+			stats[0].Served != 0 {
+			t.Errorf("Picked %v: Ticket should be dequeued and not served: %v",
+				picked, stats)
+		}
+		if w.Body.Len() > 0 {
+			t.Errorf("Picked %v: Nothing should be written, got %q", picked,
+				w.Body.String())
+		}
+		stop()
+	}
+}
+
+func TestRequestWorkerDeadline(t *testing.T) {
+	var logBuf bytes.Buffer
+	h, stop := setupWorkerHandler("/nonexistent", &logBuf,
+		func(ticket worker.Ticket) {
+			<-ticket.Done
+		})
+	defer stop()
+	ticket := worker.Ticket{Node: client.Node{Type: "Document"},
+		Deadline: time.Now().Add(20 * time.Millisecond)}
+	if _, err := h.requestWorker(ticket, nil); err != errTimeout {
+		t.Errorf("requestWorker should time out, got %v", err)
+	}
+}
+
+func TestLoginURL(t *testing.T) {
+	tests := []struct {
+		NodePath, Back, URL string
+	}{
+		{"/", "/", "/@@login?back=%2F"},
+		{"/foo", "/foo/@@edit?x=1", "/foo/@@login?back=%2Ffoo%2F%40%40edit%3Fx%3D1"}}
+	for _, v := range tests {
+		if ret := loginURL(v.NodePath, v.Back); ret != v.URL {
+			t.Errorf("loginURL(%q, %q) = %q, should be %q", v.NodePath, v.Back,
+				ret, v.URL)
+		}
+	}
+}
+
+func TestHeadRequest(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":      `{"type": "Document", "title": "Foo"}`,
+		"/redirect/node.yaml": `{"type": "Document", "title": "Redirect"}`},
+		"TestHeadRequest")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	h, stop := setupWorkerHandler(root, ioutil.Discard,
+		func(ticket worker.Ticket) {
+			res := client.Response{Body: []byte("Foo"), Raw: true}
+			if ticket.Node.Path == "/redirect/" {
+				res = client.Response{Redirect: "/foo/"}
+			}
+			ticket.ResponseChan <- res
+		})
+	defer stop()
+	for _, nodePath := range []string{"/foo/", "/redirect/"} {
+		responses := make(map[string]*httptest.ResponseRecorder)
+		for _, method := range []string{"GET", "HEAD"} {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest(method, "http://example.com"+nodePath, nil)
+			h.ServeHTTP(w, r)
+			responses[method] = w
+		}
+		get, head := responses["GET"], responses["HEAD"]
+		if head.Code != get.Code {
+			t.Errorf("%v: HEAD got status %v, GET %v", nodePath, head.Code,
+				get.Code)
+		}
+		for _, header := range []string{"Content-Type", "Content-Length",
+			"Location", "Cache-Control"} {
+			if head.Header().Get(header) != get.Header().Get(header) {
+				t.Errorf("%v: HEAD got %v %q, GET %q", nodePath, header,
+					head.Header().Get(header), get.Header().Get(header))
+			}
+		}
+		if nodePath == "/foo/" && (get.Header().Get("Content-Length") != "3" ||
+			get.Body.String() != "Foo" || head.Body.Len() > 0) {
+			t.Errorf("%v: GET got %q with length %q, HEAD %q", nodePath,
+				get.Body.String(), get.Header().Get("Content-Length"),
+				head.Body.String())
+		}
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	tests := []struct {
+		Previous, Uptime, Delay time.Duration
+	}{
+		{0, time.Second, minRestartDelay},
+		{0, time.Hour, minRestartDelay},
+		{5 * time.Second, time.Second, 10 * time.Second},
+		{10 * time.Second, time.Minute, 20 * time.Second},
+		{4 * time.Minute, time.Second, maxRestartDelay},
+		{maxRestartDelay, time.Second, maxRestartDelay},
+		{maxRestartDelay, maxRestartDelay, minRestartDelay}}
+	for _, v := range tests {
+		if ret := restartDelay(v.Previous, v.Uptime); ret != v.Delay {
+			t.Errorf("restartDelay(%v, %v) = %v, should be %v", v.Previous,
+				v.Uptime, ret, v.Delay)
+		}
+	}
+}
@@ -11,57 +11,162 @@ import (
 	"io/ioutil"
 	"launchpad.net/goyaml"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type loginFormData struct {
 	Login, Password string
+	CSRFToken       string
 }
 
 // Login handles login requests.
 func (h *nodeHandler) Login(w http.ResponseWriter, r *http.Request,
 	node client.Node, session *sessions.Session, cSession *client.Session,
 	site site) {
+	if login, ok := getPendingLogin(session); ok {
+		h.LoginSecondFactor(w, r, node, session, cSession, site, login)
+		return
+	}
 	G := l10n.UseCatalog(cSession.Locale)
+	// Show the expiry notice only once.
+	expired, _ := session.Values["session_expired"].(bool)
+	delete(session.Values, "session_expired")
 	data := loginFormData{}
 	form := form.NewForm(&data, form.Fields{
 		"Login": form.Field{G("Login"), "", form.Required(G("Required.")),
 			nil},
 		"Password": form.Field{G("Password"), "", form.Required(G("Required.")),
-			new(form.PasswordWidget)}})
+			new(form.PasswordWidget)},
+		"CSRFToken": csrfField()})
 	switch r.Method {
 	case "GET":
 	case "POST":
 		r.ParseForm()
 		if form.Fill(r.Form) {
-			user := getUser(data.Login, site.Directories.Config)
-			if user != nil && passwordEqual(user.Password, data.Password) {
-				session.Values["login"] = user.Login
-				session.Save(r, w)
-				http.Redirect(w, r, node.Path, http.StatusSeeOther)
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			ip := clientIP(r)
+			keys := []string{"login:" + data.Login, "ip:" + ip}
+			if h.LoginLimiter.Locked(keys...) {
+				h.requestLog(r, site.Name).Warn(
+					"Rejected login attempt for locked user %q from %v", data.Login, ip)
+				form.AddError("", G("Too many failed login attempts. Please try again later."))
+				break
+			}
+			time.Sleep(h.LoginLimiter.Delay(keys...))
+			user, err := authenticate(site, data.Login, data.Password)
+			if err != nil && err != errWrongCredentials {
+				h.requestLog(r, site.Name).Error("Could not authenticate user %q: %v",
+					data.Login, err)
+				form.AddError("", G("Login is currently not possible. Please try again later."))
+				break
+			}
+			if err == nil {
+				h.LoginLimiter.Succeed(keys[0])
+				cost := h.currentSettings().Login.PasswordCost
+				if len(user.External) == 0 &&
+					passwordNeedsRehash(user.Password, cost) {
+					if err := rehashPassword(site.Directories.Config, user,
+						data.Password, cost); err != nil {
+						h.requestLog(r, site.Name).Warn(
+							"Could not rehash password of user %q: %v", user.Login, err)
+					}
+				}
+				if len(user.TOTPSecret) > 0 {
+					setPendingLogin(session, user.Login)
+					session.Save(r, w)
+					http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+					return
+				}
+				completeLogin(w, r, node, session, site, user)
 				return
 			}
+			if h.LoginLimiter.Fail(keys...) {
+				h.requestLog(r, site.Name).Warn("Locked login for user %q from %v"+
+					" after too many failed attempts", data.Login, ip)
+			}
 			form.AddError("", G("Wrong login or password."))
 		}
 	default:
 		panic("Request method not supported: " + r.Method)
 	}
 	data.Password = ""
-	body := h.Renderer.Render("daemon/actions/loginform", template.Context{
-		"Form": form.RenderData()}, cSession.Locale, site.Directories.Templates)
+	data.CSRFToken = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/loginform", template.Context{
+		"Form": form.RenderData(), "Expired": expired}, cSession.Locale, site)
 	env := masterTmplEnv{Node: node, Session: cSession, Title: G("Login"),
 		Description: G("Login with your site account."),
-		Flags:       EDIT_VIEW}
-	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env, h.Settings,
-		site, cSession.Locale))
+		Flags:       EDIT_VIEW, Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+// completeLogin logs in the given user and redirects to the back URL or the
+// given node.
+func completeLogin(w http.ResponseWriter, r *http.Request, node client.Node,
+	session *sessions.Session, site site, user *user) {
+	clearPendingLogin(session)
+	session.Values["login"] = user.Login
+	session.Values["session_version"] = user.SessionVersion
+	now := time.Now().Unix()
+	session.Values["login_time"] = now
+	session.Values["activity_time"] = now
+	rotateCSRFToken(session)
+	session.Save(r, w)
+	target := site.URL(node.Path)
+	if back, ok := checkBackURL(r.URL.Query().Get("back")); ok {
+		target = back
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// checkBackURL checks if the given URL is a safe target to redirect to
+// after login and returns the cleaned URL.
+//
+// Only local paths are allowed, i.e. no scheme or host. URLs pointing to
+// the login form are rejected to avoid loops.
+func checkBackURL(back string) (string, bool) {
+	if len(back) == 0 || back[0] != '/' || strings.HasPrefix(back, "//") ||
+		strings.Contains(back, "\\") {
+		return "", false
+	}
+	target, err := url.Parse(back)
+	if err != nil || target.IsAbs() || len(target.Host) > 0 ||
+		target.User != nil || !strings.HasPrefix(target.Path, "/") {
+		return "", false
+	}
+	if _, action := splitAction(target.Path); action == "login" {
+		return "", false
+	}
+	return target.RequestURI(), true
 }
 
 // Logout handles logout requests.
 func (h *nodeHandler) Logout(w http.ResponseWriter, r *http.Request,
-	node client.Node, session *sessions.Session) {
+	node client.Node, session *sessions.Session, site site) {
 	delete(session.Values, "login")
 	session.Save(r, w)
-	http.Redirect(w, r, node.Path, http.StatusSeeOther)
+	http.Redirect(w, r, site.URL(node.Path), http.StatusSeeOther)
+}
+
+// saveChangedSession saves the given session unless it's a new session
+// without any values, i.e. if the visitor has no session cookie and the
+// session did not change. Anonymous responses stay cacheable this way.
+func saveChangedSession(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	if session.IsNew && len(session.Values) == 0 {
+		return nil
+	}
+	return session.Save(r, w)
 }
 
 // getSession returns a currently active or new session.
@@ -70,15 +175,47 @@ func getSession(r *http.Request, site site) *sessions.Session {
 		panic(`Missing "SessionAuthKey" setting.`)
 	}
 	store := sessions.NewCookieStore([]byte(site.SessionAuthKey))
+	store.Options.Secure = requestScheme(r) == "https"
 	session, _ := store.Get(r, "monsti-session")
 	return session
 }
 
-// getClientSession returns the client session for the given session.
+// sessionLogin returns the login of the given session's user or an empty
+// string for anonymous sessions.
+func sessionLogin(cSession *client.Session) string {
+	if cSession.User == nil {
+		return ""
+	}
+	return cSession.User.Login
+}
+
+// activityResolution is the minimum time in seconds between two updates of
+// a session's activity time. Avoids setting the cookie on every request.
+const activityResolution = 60
+
+// sessionExpired returns true if the given session of the given site timed
+// out at the given Unix time.
+func sessionExpired(session *sessions.Session, site site, now int64) bool {
+	loginTime, _ := session.Values["login_time"].(int64)
+	activityTime, _ := session.Values["activity_time"].(int64)
+	if site.SessionLifetime > 0 &&
+		now-loginTime >= int64(site.SessionLifetime)*60 {
+		return true
+	}
+	return site.SessionIdleTimeout > 0 &&
+		now-activityTime >= int64(site.SessionIdleTimeout)*60
+}
+
+// getClientSession returns the client session and the roles of the
+// session's user for the given session of the given site at the given time.
 //
-// configDir is the site's configuration directory.
-func getClientSession(session *sessions.Session,
-	configDir string) (cSession *client.Session) {
+// Sessions which timed out are treated as anonymous. Refreshes the session's
+// activity time. Returns true as third value if the session has been
+// modified and must be saved. If the users could not be loaded, the session
+// is treated as anonymous without being modified and the error is returned.
+func getClientSession(session *sessions.Session, site site,
+	now time.Time) (cSession *client.Session, roles []string, modified bool,
+	err error) {
 	cSession = new(client.Session)
 	loginData, ok := session.Values["login"]
 	if !ok {
@@ -87,50 +224,248 @@ func getClientSession(session *sessions.Session,
 	login, ok := loginData.(string)
 	if !ok {
 		delete(session.Values, "login")
-		return
+		return cSession, nil, true, nil
+	}
+	user, err := getUser(login, site.Directories.Config)
+	if err != nil {
+		return cSession, nil, false, err
 	}
-	user := getUser(login, configDir)
-	if user == nil {
+	version, _ := session.Values["session_version"].(int)
+	if user == nil || user.Disabled || version != user.SessionVersion {
 		delete(session.Values, "login")
-		return
+		return cSession, nil, true, nil
+	}
+	// Sessions of older versions don't have any timestamps.
+	if _, ok := session.Values["login_time"].(int64); !ok {
+		session.Values["login_time"] = now.Unix()
+		session.Values["activity_time"] = now.Unix()
+		modified = true
+	}
+	if sessionExpired(session, site, now.Unix()) {
+		delete(session.Values, "login")
+		delete(session.Values, "login_time")
+		delete(session.Values, "activity_time")
+		session.Values["session_expired"] = true
+		return cSession, nil, true, nil
 	}
-	*cSession = client.Session{User: user}
+	activityTime, _ := session.Values["activity_time"].(int64)
+	if now.Unix()-activityTime >= activityResolution {
+		session.Values["activity_time"] = now.Unix()
+		modified = true
+	}
+	*cSession = client.Session{User: &user.User, Locale: user.Locale}
+	roles = user.GetRoles()
 	return
 }
 
-// getUser returns the user with the given login.
-func getUser(login, configDir string) *client.User {
+// user is a user account as stored in the users.yaml file.
+type user struct {
+	client.User `yaml:",inline"`
+	// Roles of the user, e.g. admin, editor or reader.
+	//
+	// Users without any roles are administrators. This keeps user databases
+	// of older Monsti versions working.
+	Roles []string `yaml:",omitempty"`
+	// Disabled users can't log in.
+	Disabled bool `yaml:",omitempty"`
+	// SessionVersion gets incremented to invalidate all sessions of the user,
+	// e.g. after a password change.
+	SessionVersion int `yaml:",omitempty"`
+	// ResetToken is the hash of the current password reset token.
+	ResetToken string `yaml:",omitempty"`
+	// ResetExpiry is the Unix time the reset token expires.
+	ResetExpiry int64 `yaml:",omitempty"`
+	// TOTPSecret is the base32 encoded secret for two-factor authentication.
+	// Two-factor authentication is disabled if empty.
+	TOTPSecret string `yaml:",omitempty"`
+	// PendingTOTPSecret is a newly generated secret which has not been
+	// confirmed by a valid code yet. It is not used for logins.
+	PendingTOTPSecret string `yaml:",omitempty"`
+	// Locale is the user's preferred locale of the web interface.
+	Locale string `yaml:",omitempty"`
+	// TOTPLastCounter is the time step of the last accepted TOTP code.
+	TOTPLastCounter int64 `yaml:",omitempty"`
+	// RecoveryCodes are the hashes of unused recovery codes.
+	RecoveryCodes []string `yaml:",omitempty"`
+	// External is the name of the authentication backend of shadow users,
+	// e.g. ldap. Empty for local users.
+	External string `yaml:",omitempty"`
+}
+
+// GetRoles returns the roles of the user.
+//
+// Any user has at least the reader role.
+func (u *user) GetRoles() []string {
+	if len(u.Roles) == 0 {
+		return []string{roleAdmin}
+	}
+	if hasRole(u.Roles, roleReader) {
+		return u.Roles
+	}
+	return append([]string{roleReader}, u.Roles...)
+}
+
+// usersLocks maps configuration directories to the locks of their users
+// files.
+var usersLocks = make(map[string]*sync.Mutex)
+
+// usersLocksMutex protects usersLocks.
+var usersLocksMutex sync.Mutex
+
+// lockUsers locks the users of the site with the given configuration
+// directory until the returned function has been called.
+//
+// Changes of users must hold the lock from loading to saving the users so
+// that concurrent changes don't get lost. Must not be nested.
+func lockUsers(configDir string) func() {
+	usersLocksMutex.Lock()
+	lock, ok := usersLocks[configDir]
+	if !ok {
+		lock = new(sync.Mutex)
+		usersLocks[configDir] = lock
+	}
+	usersLocksMutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// loadUsers returns all users of the site with the given configuration
+// directory.
+func loadUsers(configDir string) ([]user, error) {
 	path := filepath.Join(configDir, "users.yaml")
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic("Could not load users.yaml: " + err.Error())
+		return nil, fmt.Errorf("Could not load users.yaml: %v", err)
 	}
-	var users []client.User
+	var users []user
 	if err = goyaml.Unmarshal(content, &users); err != nil {
-		panic("Could not unmarshal users.yaml: " + err.Error())
+		return nil, fmt.Errorf("Could not unmarshal users.yaml: %v", err)
+	}
+	return users, nil
+}
+
+// saveUsers atomically replaces the users of the site with the given
+// configuration directory.
+func saveUsers(configDir string, users []user) error {
+	content, err := goyaml.Marshal(users)
+	if err != nil {
+		return fmt.Errorf("Could not marshal users: %v", err)
+	}
+	path := filepath.Join(configDir, "users.yaml")
+	if err := writeFileAtomic(path, content, 0600); err != nil {
+		return fmt.Errorf("Could not write users.yaml: %v", err)
+	}
+	return nil
+}
+
+// getUser returns the user with the given login or nil if there is no such
+// user.
+func getUser(login, configDir string) (*user, error) {
+	users, err := loadUsers(configDir)
+	if err != nil {
+		return nil, err
 	}
 	for _, user := range users {
 		if user.Login == login {
-			return &user
+			return &user, nil
 		}
 	}
-	return nil
+	return nil, nil
 }
 
-// checkPermission checks if the session's user might perform the given action.
-func checkPermission(action string, session *client.Session) bool {
-	auth := session.User != nil
-	switch action {
-	case "remove", "edit", "add", "logout":
-		if auth {
+// Roles which may be assigned to users.
+const (
+	// roleAdmin may perform any action.
+	roleAdmin = "admin"
+	// roleEditor may change content.
+	roleEditor = "editor"
+	// roleReader is given to any authenticated user.
+	roleReader = "reader"
+	// roleAnonymous is required for actions anyone might perform.
+	roleAnonymous = "anonymous"
+)
+
+// roleRanks orders the built-in roles. A user having some built-in role also
+// has all built-in roles of lower rank.
+var roleRanks = map[string]int{
+	roleAnonymous: 0,
+	roleReader:    1,
+	roleEditor:    2,
+	roleAdmin:     3}
+
+// defaultPermissions maps actions to the roles required to perform them if
+// the site's settings don't specify otherwise.
+var defaultPermissions = map[string]string{
+	"":               roleAnonymous,
+	"login":          roleAnonymous,
+	"logout":         roleReader,
+	"reset-password": roleAnonymous,
+	"edit":           roleEditor,
+	"add":            roleEditor,
+	"remove":         roleAdmin,
+	"users":          roleAdmin,
+	"users/add":      roleAdmin,
+	"users/edit":     roleAdmin,
+	"users/disable":  roleAdmin,
+	"users/enable":   roleAdmin,
+	"setup-2fa":      roleReader,
+	"status":         roleAdmin,
+	"recent":         roleAdmin,
+	"usage":          roleAdmin,
+	"search":         roleAnonymous,
+	"json":           roleAnonymous,
+	"feed":           roleAnonymous,
+	"export":         roleAdmin,
+	"import":         roleAdmin,
+	"audit":          roleAdmin,
+	"history":        roleEditor,
+	"blocks":         roleEditor,
+	"attachments":    roleEditor,
+	"aliases":        roleAdmin,
+	"tokens":         roleAdmin,
+	"dav":            roleEditor,
+	"set-locale":     roleAnonymous}
+
+// hasRole returns true iff the given roles include the required role.
+func hasRole(roles []string, required string) bool {
+	if required == roleAnonymous {
+		return true
+	}
+	requiredRank, builtin := roleRanks[required]
+	for _, role := range roles {
+		if role == required || role == roleAdmin {
+			return true
+		}
+		if rank, ok := roleRanks[role]; ok && builtin && rank >= requiredRank {
 			return true
 		}
-	case "", "login":
-		return true
 	}
 	return false
 }
 
+// requiredRole returns the role required to perform the given action.
+//
+// permissions maps actions to roles and overrides the default permissions.
+// Unknown actions require the admin role.
+func requiredRole(action string, permissions map[string]string) string {
+	if role, ok := permissions[action]; ok {
+		return role
+	}
+	if role, ok := defaultPermissions[action]; ok {
+		return role
+	}
+	return roleAdmin
+}
+
+// checkPermission checks if a user with the given roles might perform the
+// given action.
+//
+// permissions maps actions to roles and overrides the default permissions.
+func checkPermission(action string, roles []string,
+	permissions map[string]string) bool {
+	return hasRole(roles, requiredRole(action, permissions))
+}
+
 // passwordEqual returns true iff the hash matches the password.
 func passwordEqual(hash, password string) bool {
 	if err := bcrypt.CompareHashAndPassword([]byte(hash),
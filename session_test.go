@@ -2,41 +2,70 @@ package main
 
 import (
 	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/gorilla/sessions"
 	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
 	"io/ioutil"
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestCheckPermission(t *testing.T) {
+	admin := []string{"admin"}
+	editor := []string{"reader", "editor"}
+	reader := []string{"reader"}
+	permissions := map[string]string{
+		"publish": "publisher",
+		"add":     "admin"}
 	tests := []struct {
-		Action      string
-		Auth, Grant bool
+		Action string
+		Roles  []string
+		Grant  bool
 	}{
-		{"", false, true},
-		{"", true, true},
-		{"login", false, true},
-		{"login", true, true},
-		{"logout", false, false},
-		{"logout", true, true},
-		{"edit", false, false},
-		{"edit", true, true},
-		{"add", false, false},
-		{"add", true, true},
-		{"remove", false, false},
-		{"remove", true, true},
-		{"unknown_action", true, false},
-		{"unknown_action", false, false}}
+		{"", nil, true},
+		{"", reader, true},
+		{"login", nil, true},
+		{"login", admin, true},
+		{"logout", nil, false},
+		{"logout", reader, true},
+		{"edit", nil, false},
+		{"edit", reader, false},
+		{"edit", editor, true},
+		{"edit", admin, true},
+		{"add", editor, false},
+		{"add", admin, true},
+		{"remove", nil, false},
+		{"remove", editor, false},
+		{"remove", admin, true},
+		{"publish", editor, false},
+		{"publish", []string{"reader", "publisher"}, true},
+		{"publish", admin, true},
+		{"unknown_action", editor, false},
+		{"unknown_action", admin, true},
+		{"unknown_action", nil, false}}
 	for _, v := range tests {
-		var user *client.User
-		if v.Auth {
-			user = &client.User{}
-		}
-		ret := checkPermission(v.Action, &client.Session{User: user})
+		ret := checkPermission(v.Action, v.Roles, permissions)
 		if ret != v.Grant {
-			t.Errorf("checkPermission(%v, %v) = %v, expected %v", v.Action,
-				user, ret, v.Grant)
+			t.Errorf("checkPermission(%q, %v, _) = %v, expected %v", v.Action,
+				v.Roles, ret, v.Grant)
+		}
+	}
+}
+
+func TestUserGetRoles(t *testing.T) {
+	tests := []struct {
+		Roles, Expected []string
+	}{
+		{nil, []string{"admin"}},
+		{[]string{"editor"}, []string{"editor"}},
+		{[]string{"foo"}, []string{"reader", "foo"}}}
+	for _, v := range tests {
+		u := user{Roles: v.Roles}
+		if ret := u.GetRoles(); !reflect.DeepEqual(ret, v.Expected) {
+			t.Errorf("user{Roles: %v}.GetRoles() = %v, should be %v", v.Roles,
+				ret, v.Expected)
 		}
 	}
 }
@@ -54,6 +83,7 @@ func TestGetUser(t *testing.T) {
   name: Mrs. Bar
   email: bar@example.com
   password: other pass
+  roles: [editor]
 `)
 	if err = ioutil.WriteFile(filepath.Join(root, "users.yaml"),
 		db, 0600); err != nil {
@@ -61,22 +91,33 @@ func TestGetUser(t *testing.T) {
 	}
 	tests := []struct {
 		Login string
-		User  *client.User
+		User  *user
 	}{
 		{Login: "unknown", User: nil},
-		{Login: "foo", User: &client.User{Login: "foo", Password: "the pass",
-			Name: "Mr. Foo", Email: "foo@example.com"}},
-		{Login: "bar", User: &client.User{Login: "bar", Password: "other pass",
-			Name: "Mrs. Bar", Email: "bar@example.com"}}}
+		{Login: "foo", User: &user{User: client.User{Login: "foo",
+			Password: "the pass", Name: "Mr. Foo", Email: "foo@example.com"}}},
+		{Login: "bar", User: &user{User: client.User{Login: "bar",
+			Password: "other pass", Name: "Mrs. Bar", Email: "bar@example.com"},
+			Roles: []string{"editor"}}}}
 	for _, v := range tests {
-		user := getUser(v.Login, root)
-		if !reflect.DeepEqual(user, v.User) {
-			t.Errorf("getUser(%q, _) = %v, should be %v", v.Login,
-				user, v.User)
+		user, err := getUser(v.Login, root)
+		if err != nil || !reflect.DeepEqual(user, v.User) {
+			t.Errorf("getUser(%q, _) = %v, %v, should be %v, nil", v.Login,
+				user, err, v.User)
 		}
 	}
 }
 
+// testUser returns the user with the given login, failing the test if the
+// users could not be loaded.
+func testUser(t *testing.T, login, configDir string) *user {
+	user, err := getUser(login, configDir)
+	if err != nil {
+		t.Fatalf("Could not get user %q: %v", login, err)
+	}
+	return user
+}
+
 func TestPasswordEqual(t *testing.T) {
 	tests := []struct {
 		ToHash, Password string
@@ -96,3 +137,87 @@ func TestPasswordEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckBackURL(t *testing.T) {
+	tests := []struct {
+		Back, Target string
+		OK           bool
+	}{
+		{"", "", false},
+		{"/", "/", true},
+		{"/foo/bar/", "/foo/bar/", true},
+		{"/foo/@@edit?x=1", "/foo/@@edit?x=1", true},
+		{"foo/bar", "", false},
+		{"http://example.com/", "", false},
+		{"https://example.com/foo", "", false},
+		{"//example.com/foo", "", false},
+		{"/\\example.com", "", false},
+		{"javascript:alert(1)", "", false},
+		{"http:/example.com", "", false},
+		{"/foo/@@login", "", false},
+		{"/@@login?back=/foo/", "", false}}
+	for _, v := range tests {
+		target, ok := checkBackURL(v.Back)
+		if target != v.Target || ok != v.OK {
+			t.Errorf("checkBackURL(%q) = %q, %v, should be %q, %v", v.Back,
+				target, ok, v.Target, v.OK)
+		}
+	}
+}
+
+func TestGetClientSessionTimeout(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/users.yaml": `[{"login": "foo"}]`}, "TestGetClientSessionTimeout")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	now := time.Now()
+	minutes := func(n int) int64 {
+		return now.Add(-time.Duration(n) * time.Minute).Unix()
+	}
+	tests := []struct {
+		Idle, Lifetime int
+		// Login and activity time as minutes before now, -1 if not set.
+		LoginTime, ActivityTime int
+		Valid, Refreshed        bool
+	}{
+		{0, 0, 1000, 1000, true, true},
+		{120, 720, 60, 0, true, false},
+		{120, 720, 60, 30, true, true},
+		{120, 720, 600, 119, true, true},
+		{120, 720, 600, 120, false, false},
+		{120, 0, 600, 121, false, false},
+		{120, 720, 720, 0, false, false},
+		{0, 720, 719, 719, true, true},
+		{120, 720, -1, -1, true, true}}
+	for i, v := range tests {
+		site_ := site{SessionIdleTimeout: v.Idle, SessionLifetime: v.Lifetime}
+		site_.Directories.Config = root
+		session := sessions.NewSession(nil, "test")
+		session.Values["login"] = "foo"
+		session.Values["session_version"] = 0
+		if v.LoginTime >= 0 {
+			session.Values["login_time"] = minutes(v.LoginTime)
+			session.Values["activity_time"] = minutes(v.ActivityTime)
+		}
+		cSession, _, modified, _ := getClientSession(session, site_, now)
+		if valid := cSession.User != nil; valid != v.Valid {
+			t.Errorf("Test %v: getClientSession(...) returned user %v, should"+
+				" be valid: %v", i, cSession.User, v.Valid)
+			continue
+		}
+		if expired, _ := session.Values["session_expired"].(bool); expired ==
+			v.Valid {
+			t.Errorf("Test %v: Session expiry notice is %v", i, expired)
+		}
+		refreshed := v.Valid && modified
+		if refreshed != v.Refreshed {
+			t.Errorf("Test %v: Activity time refreshed: %v, should be %v", i,
+				refreshed, v.Refreshed)
+		}
+		if !v.Valid && session.Values["login"] != nil {
+			t.Errorf("Test %v: Login of expired session has not been removed", i)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"github.com/monsti/util"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 )
 
@@ -31,6 +32,22 @@ type site struct {
 	Title string
 	// The hosts which should deliver this site.
 	Hosts []string
+	// BasePath is the URL path the site is mounted at, e.g. /docs if the
+	// site is served as part of a bigger site behind a proxy. Defaults to
+	// the root path.
+	BasePath string
+	// CanonicalHost is the preferred host of the site. Requests to one of
+	// the Aliases will be redirected to it.
+	CanonicalHost string
+	// Aliases are hosts which redirect to the canonical host.
+	Aliases []string
+	// TLS certificate and key files of the site's hosts.
+	TLS struct {
+		Certificate, Key string
+		// DisableACME excludes the site's hosts from automatic certificates,
+		// e.g. if the site's owner supplies the certificate files.
+		DisableACME bool
+	}
 	// Name and email address of site owner.
 	//
 	// The owner's address is used as recipient of contact form submissions.
@@ -39,8 +56,114 @@ type site struct {
 	}
 	// Key to authenticate session cookies.
 	SessionAuthKey string
+	// LogFile is the path to the site's own log file. If empty, messages
+	// will be written to the main log.
+	LogFile string
+	// PasswordResetExpiry is the time in minutes a password reset link stays
+	// valid. Defaults to 60 minutes.
+	PasswordResetExpiry int
+	// SessionIdleTimeout is the time in minutes after which sessions without
+	// any activity get logged out. Zero disables the timeout.
+	SessionIdleTimeout int
+	// SessionLifetime is the time in minutes after which sessions get logged
+	// out regardless of any activity. Zero disables the limit.
+	SessionLifetime int
 	// Locale used to translate monsti's web interface.
 	Locale string
+	// NodeNames is the naming policy for new nodes: "ascii" (default)
+	// allows ASCII letters, digits, dashes and underscores, "unicode" allows
+	// any letters and digits.
+	NodeNames string
+	// ReadOnly prevents any changes to the site's content, e.g. for demo
+	// sites or during backups. May be toggled at runtime on the status page.
+	ReadOnly bool
+	// Permissions maps actions to the roles required to perform them.
+	//
+	// Overrides the default permissions, e.g. to allow editors to remove
+	// content or to restrict custom actions of node types.
+	Permissions map[string]string
+	// Headers overrides the default security headers of all responses,
+	// e.g. to set a Content-Security-Policy. Headers with empty values will
+	// not be sent.
+	Headers map[string]string
+	// ActionHeaders overrides the security headers of action views like
+	// @@edit. By default, these views must not be framed.
+	ActionHeaders map[string]string
+	// Regions are the content regions of the master template. Defaults to
+	// the inherited regions below_header, sidebar and footer.
+	Regions []region
+	// MaxRevisions is the number of previous versions kept per node file.
+	// Defaults to 20.
+	MaxRevisions int
+	// MaxRequestSize is the maximum size in bytes of request bodies, e.g.
+	// of uploads. Defaults to 64 MiB.
+	MaxRequestSize int64
+	// AuditLog is the path to the site's audit log of content changes.
+	// Defaults to .monsti/audit.log in the data directory.
+	AuditLog string
+	// Webhooks are notified of content changes.
+	Webhooks []webhook
+	// PlaceholderType is the node type of the nodes created for missing
+	// parents of written or imported nodes. Defaults to Document.
+	PlaceholderType string
+	// ProtectedPaths lists nodes which can't be removed, including their
+	// subtrees. The root node is always protected.
+	ProtectedPaths []string
+	// AliasMovedNodes makes moved nodes keep their old URLs by adding
+	// aliases instead of rewriting the links to them.
+	AliasMovedNodes bool
+	// CaseInsensitivePaths makes requests for paths not matching a node
+	// redirect to the node whose path only differs in case, if unambiguous.
+	CaseInsensitivePaths bool
+	// AdminNetworks lists the networks (CIDRs) or addresses from which
+	// actions requiring more than the reader role may be performed and
+	// content may be changed by users having more than the reader role,
+	// e.g. the office VPN. Any address is allowed if empty.
+	AdminNetworks []string
+	// AdminAllow are the parsed AdminNetworks.
+	AdminAllow trustedProxies `yaml:"-"`
+	// PublicActions lists the actions which may be performed from any
+	// network regardless of AdminNetworks.
+	PublicActions []string
+	// CORS configures cross-origin requests to the API endpoints.
+	CORS corsSettings
+	// Notifications configures notifications about panics while serving
+	// the site. Mails are sent to the owner by default.
+	Notifications notificationSettings
+	// Theme is the manifest of the site's theme, if there is one. See
+	// themeManifest.
+	Theme *themeManifest `yaml:"-"`
+	// Purge configures purging of changed nodes from external caches.
+	Purge purgeSettings
+	// CacheControl lists the rules setting the Cache-Control header of
+	// node responses in order of precedence. See cacheControl.
+	CacheControl []cacheRule
+	// MinifyHTML removes whitespace and comments from pages rendered in
+	// the master template. See minifyHTML.
+	MinifyHTML bool
+	// DebugToolbar shows admins a toolbar below each page telling which
+	// files and templates have been used to render it.
+	DebugToolbar bool
+	// WebDAV serves the data directory to editors at /@@dav/. See
+	// ServeDAV.
+	WebDAV bool
+	// Snapshots configures the backup snapshots of the site's data and
+	// configuration, see createSnapshot.
+	Snapshots struct {
+		// Retention is the number of snapshots kept. Defaults to 7.
+		Retention int
+	}
+	// AllowInsecureTokens accepts API tokens and WebDAV requests sent over
+	// plain HTTP, e.g. for local testing.
+	AllowInsecureTokens bool
+	// Authentication settings.
+	Auth struct {
+		// Backends are the authentication backends to try in order: local
+		// for the site's users.yaml and ldap. Defaults to local.
+		Backends []string
+		// LDAP configures the ldap backend.
+		LDAP ldapSettings
+	}
 	// Absolute paths to site specific directories.
 	Directories struct {
 		// Configuration directory
@@ -62,7 +185,156 @@ type settings struct {
 		Host, Username, Password string
 	}
 	// Listen is the host and port to listen for incoming HTTP connections.
+	// If empty, HTTP over TCP is disabled if Unix or FastCGI is configured.
 	Listen string
+	// Unix configures a listener for HTTP on a Unix domain socket, e.g. for
+	// reverse proxies running on the same host.
+	//
+	// Requests received on the socket appear to come from 127.0.0.1, so the
+	// proxy may be trusted by adding 127.0.0.1 to TrustedProxies.
+	Unix struct {
+		// Path of the socket. Disabled if empty.
+		Path string
+		// Mode is the octal mode of the socket file. Defaults to 0660.
+		Mode string
+	}
+	// FastCGI configures a listener for FastCGI requests, e.g. of nginx'
+	// fastcgi_pass or Apache's mod_proxy_fcgi.
+	FastCGI struct {
+		// Listen is the host and port or the absolute path of a Unix domain
+		// socket to listen on. Disabled if empty.
+		Listen string
+		// Mode is the octal mode of the socket file. Defaults to 0660.
+		Mode string
+	}
+	// UnixMode and FastCGIMode are the parsed modes of the socket files.
+	UnixMode, FastCGIMode os.FileMode `yaml:"-"`
+	// Settings for HTTPS.
+	TLS struct {
+		// Listen is the host and port to listen for incoming HTTPS
+		// connections. HTTPS is disabled if empty.
+		Listen string
+		// RedirectHTTP makes the HTTP listener redirect all requests to
+		// HTTPS.
+		RedirectHTTP bool
+		// ACME obtains certificates for the sites' hosts automatically, e.g.
+		// from Let's Encrypt.
+		ACME acmeSettings
+	}
+	// Logging settings.
+	Log struct {
+		// Level is the minimum level of logged messages: debug, info, warn or
+		// error. Defaults to info.
+		Level string
+		// AccessLog is the path to the access log file. If empty, accesses
+		// will be logged to the main log.
+		AccessLog string
+	}
+	// RetryFailedRequests makes the daemon retry GET requests once if the
+	// worker died while handling them.
+	RetryFailedRequests bool
+	// Watchdog settings to replace workers which stopped responding.
+	Watchdog struct {
+		// PingSeconds is the interval in seconds in which workers having
+		// pending requests must communicate with the daemon. Defaults to 10.
+		PingSeconds int
+		// MaxMissedPings is the number of intervals without communication
+		// after which a worker will be killed and restarted. Defaults to 6.
+		MaxMissedPings int
+	}
+	// Cache settings of the in-memory caches of the sites' data directories.
+	Cache struct {
+		// Enabled makes the daemon cache parsed nodes, region contents and
+		// directory listings. Changes to the data directories are detected by
+		// watching them. Defaults to false.
+		Enabled bool
+		// MaxEntries is the maximum number of cached entries per site.
+		// Defaults to 10000.
+		MaxEntries int
+	}
+	// InteractiveBurst is the number of actions of logged in users handed
+	// to the workers of a node type in a row before a waiting anonymous
+	// request gets its turn. Defaults to 8.
+	InteractiveBurst int
+	// DevMode makes the daemon read templates on each request instead of
+	// caching them and show template errors to logged in users.
+	DevMode bool
+	// HealthCheckPath is the URL path of the health check endpoint for load
+	// balancers. Defaults to /healthz.
+	HealthCheckPath string
+	// WellKnownPaths lists URL paths like /.well-known/security.txt which
+	// get served from the sites' static or data directories without session,
+	// like /favicon.ico. See serveWellKnown.
+	WellKnownPaths []string
+	// TrustedProxies lists the networks (CIDRs) or addresses of reverse
+	// proxies. The X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+	// headers of requests from these proxies will be used to determine the
+	// client's address, scheme and host.
+	TrustedProxies []string
+	// Proxies are the parsed TrustedProxies.
+	Proxies trustedProxies `yaml:"-"`
+	// TrustForwardedFor trusts the forwarding headers of all requests, i.e.
+	// the immediate peer is taken to be a proxy whatever its address.
+	//
+	// Deprecated: Only enable it if Monsti can't be reached but through a
+	// proxy, and preferably list the proxy in TrustedProxies instead.
+	TrustForwardedFor bool
+	// Modes of the files and directories written to the data directories.
+	Modes struct {
+		// File is the octal mode of files, e.g. 0640. Defaults to 0600.
+		File string
+		// Directory is the octal mode of directories. Defaults to 0700.
+		Directory string
+		// Umask is an octal umask which gets removed from the modes above
+		// and set for the daemon process on startup. The inherited umask
+		// will be kept if empty.
+		Umask string
+		// AllowWorldWritable must be set to accept modes making content
+		// writable by all users.
+		AllowWorldWritable bool
+	}
+	// ContentModes are the parsed Modes.
+	ContentModes contentModes `yaml:"-"`
+	// Settings to limit failed login attempts.
+	Login struct {
+		// MaxFailures is the number of failed attempts after which the login
+		// name or client IP gets locked. Defaults to 10.
+		MaxFailures int
+		// WindowMinutes is the time in minutes after which failed attempts
+		// will be forgotten. Defaults to 15.
+		WindowMinutes int
+		// LockoutMinutes is the time in minutes a login name or client IP
+		// stays locked. Defaults to 15.
+		LockoutMinutes int
+		// PasswordCost is the bcrypt cost of new password hashes. Existing
+		// hashes of a lower cost get replaced on login. Defaults to bcrypt's
+		// default cost.
+		PasswordCost int
+	}
+	// Settings to limit the request rate of clients by their addresses.
+	// Disabled by default.
+	RateLimit struct {
+		// Pages limits page views of anonymous users, Actions requests of @@
+		// actions and Auth login and password reset attempts.
+		Pages, Actions, Auth rateBudget
+		// MaxClients is the maximum number of clients tracked at once. The
+		// least recently seen clients will be forgotten. Defaults to 10000.
+		MaxClients int
+		// Allow lists the networks (CIDRs) or addresses which will not be
+		// limited, e.g. of the office or a monitoring host.
+		Allow []string
+	}
+	// RateLimitAllow are the parsed RateLimit.Allow networks.
+	RateLimitAllow trustedProxies `yaml:"-"`
+	// Tracing configures the tracing of requests. Disabled by default.
+	Tracing tracingSettings
+	// SlowRequestMillis is the duration in milliseconds requests may take
+	// before they get logged as slow, including the time spent in each
+	// phase. Disabled if zero.
+	SlowRequestMillis int
+	// Notifications configures notifications about panics of all sites and
+	// dead workers. Mails require recipients.
+	Notifications notificationSettings
 	// Absolute paths to used directories.
 	Directories struct {
 		// Config files
@@ -76,8 +348,21 @@ type settings struct {
 	}
 	// List of node types to be activated.
 	NodeTypes []string
+	// NodeTypeSettings maps node types to their settings, e.g. their display
+	// names or which child types may be added below nodes of the type.
+	//
+	// Settings may also be stored in the files types/<node type>.yaml in the
+	// configuration directory.
+	NodeTypeSettings map[string]nodeTypeSettings
 	// Sites hosted by this monsti instance.
 	Sites map[string]site
+	// DefaultSite is the name of the site to be delivered for requests to
+	// hosts not matching any site. If empty, such requests will be answered
+	// with 404 Not Found.
+	DefaultSite string
+	// UnknownHostRedirect is the URL to redirect requests for unknown hosts
+	// to if there is no default site.
+	UnknownHostRedirect string
 }
 
 // loadSettings loads daemon and site settings from the given configuration
@@ -96,6 +381,9 @@ func loadSettings(cfgPath string) (*settings, error) {
 	util.MakeAbsolute(&settings.Directories.Statics, cfgPath)
 	util.MakeAbsolute(&settings.Directories.Templates, cfgPath)
 	util.MakeAbsolute(&settings.Directories.Locales, cfgPath)
+	if len(settings.Log.AccessLog) > 0 {
+		util.MakeAbsolute(&settings.Log.AccessLog, cfgPath)
+	}
 
 	// Load site specific configuration files
 	sitesPath := filepath.Join(settings.Directories.Config, "sites")
@@ -117,12 +405,108 @@ func loadSettings(cfgPath string) (*settings, error) {
 			return nil, fmt.Errorf("Could not load settings for site %q: %v",
 				siteName, err)
 		}
+		siteSettings.BasePath = cleanBasePath(siteSettings.BasePath)
+		switch siteSettings.NodeNames {
+		case "":
+			siteSettings.NodeNames = namesASCII
+		case namesASCII, namesUnicode:
+		default:
+			return nil, fmt.Errorf("Unknown node naming policy %q for site %q",
+				siteSettings.NodeNames, siteName)
+		}
+		for _, reg := range siteSettings.Regions {
+			if !validRegionName(reg.Name) {
+				return nil, fmt.Errorf("Invalid region name %q for site %q",
+					reg.Name, siteName)
+			}
+		}
+		if err := checkAuthSettings(siteSettings.Auth.Backends,
+			siteSettings.Auth.LDAP); err != nil {
+			return nil, fmt.Errorf("Invalid authentication settings for site %q:"+
+				" %v", siteName, err)
+		}
+		if err := checkCacheRules(siteSettings.CacheControl); err != nil {
+			return nil, fmt.Errorf("Invalid cache rules for site %q: %v",
+				siteName, err)
+		}
+		if err := checkCORSSettings(siteSettings.CORS); err != nil {
+			return nil, fmt.Errorf("Invalid CORS settings for site %q: %v",
+				siteName, err)
+		}
+		siteSettings.AdminAllow, err = parseTrustedProxies(
+			siteSettings.AdminNetworks)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid admin networks for site %q: %v",
+				siteName, err)
+		}
 		siteSettings.Directories.Config = sitePath
 		util.MakeAbsolute(&siteSettings.Directories.Config, sitePath)
 		util.MakeAbsolute(&siteSettings.Directories.Data, sitePath)
 		util.MakeAbsolute(&siteSettings.Directories.Statics, sitePath)
 		util.MakeAbsolute(&siteSettings.Directories.Templates, sitePath)
+		if len(siteSettings.LogFile) > 0 {
+			util.MakeAbsolute(&siteSettings.LogFile, sitePath)
+		}
+		if len(siteSettings.AuditLog) > 0 {
+			util.MakeAbsolute(&siteSettings.AuditLog, sitePath)
+		}
+		if len(siteSettings.Auth.LDAP.CACertificate) > 0 {
+			util.MakeAbsolute(&siteSettings.Auth.LDAP.CACertificate, sitePath)
+		}
+		if len(siteSettings.TLS.Certificate) > 0 {
+			util.MakeAbsolute(&siteSettings.TLS.Certificate, sitePath)
+			util.MakeAbsolute(&siteSettings.TLS.Key, sitePath)
+		}
+		siteSettings.Theme, err = siteThemeManifest(siteSettings,
+			settings.Directories.Templates)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid theme of site %q: %v", siteName, err)
+		}
 		settings.Sites[siteName] = siteSettings
 	}
+	settings.NodeTypeSettings, err = loadNodeTypeSettings(cfgPath,
+		settings.NodeTypes, settings.NodeTypeSettings)
+	if err != nil {
+		return nil, err
+	}
+	settings.Proxies, err = parseTrustedProxies(settings.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	settings.RateLimitAllow, err = parseTrustedProxies(settings.RateLimit.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rate limit allowlist: %v", err)
+	}
+	settings.ContentModes, err = parseContentModes(settings.Modes.File,
+		settings.Modes.Directory, settings.Modes.Umask,
+		settings.Modes.AllowWorldWritable)
+	if err != nil {
+		return nil, err
+	}
+	settings.UnixMode, err = parseMode("Unix socket", settings.Unix.Mode, 0660)
+	if err != nil {
+		return nil, err
+	}
+	settings.FastCGIMode, err = parseMode("FastCGI socket",
+		settings.FastCGI.Mode, 0660)
+	if err != nil {
+		return nil, err
+	}
+	if len(settings.Unix.Path) > 0 {
+		util.MakeAbsolute(&settings.Unix.Path, cfgPath)
+	}
+	if settings.TLS.ACME.Enabled {
+		if len(settings.TLS.Listen) == 0 {
+			return nil, fmt.Errorf("ACME requires TLS.Listen to be set")
+		}
+		if len(settings.TLS.ACME.CacheDirectory) == 0 {
+			settings.TLS.ACME.CacheDirectory = "acme"
+		}
+		util.MakeAbsolute(&settings.TLS.ACME.CacheDirectory, cfgPath)
+	}
+	if _, ok := settings.Sites[settings.DefaultSite]; len(settings.DefaultSite) > 0 && !ok {
+		return nil, fmt.Errorf("Default site %q does not exist",
+			settings.DefaultSite)
+	}
 	return settings, nil
 }
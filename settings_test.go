@@ -35,6 +35,8 @@ title: "Monsti CMS Example Site"
 hosts: ["localhost:8080"]
 directories:
   data: ../../../bar
+permissions:
+  remove: editor
 `}
 	root, cleanup, err := mtest.CreateDirectoryTree(files, "TestLoadSettings")
 	if err != nil {
@@ -67,6 +69,10 @@ directories:
 		t.Errorf("settings.Sites[\"Example\"] should be "+
 			`"Monsti CMS Example Site", but is %q`, entry.Title)
 	}
+	if entry.Permissions["remove"] != "editor" {
+		t.Errorf(`settings.Sites["example"].Permissions == %v, should be`+
+			` map[remove:editor]`, entry.Permissions)
+	}
 	if len(entry.Hosts) != 1 || entry.Hosts[0] != "localhost:8080" {
 		entry := settings.Sites["example"]
 		if entry.Title != "Monsti CMS Example Site" {
@@ -86,3 +92,29 @@ directories:
 		}
 	}
 }
+
+func TestLoadSettingsDefaultSite(t *testing.T) {
+	tests := []struct {
+		DefaultSite string
+		Valid       bool
+	}{
+		{"", true},
+		{"example", true},
+		{"missing", false}}
+	for i, v := range tests {
+		files := map[string]string{
+			"/config/monsti.yaml":             "defaultsite: " + v.DefaultSite,
+			"/config/sites/example/site.yaml": `hosts: ["localhost:8080"]`}
+		root, cleanup, err := mtest.CreateDirectoryTree(files,
+			"TestLoadSettingsDefaultSite")
+		if err != nil {
+			t.Fatalf("Could not create test files: %v", err)
+		}
+		_, err = loadSettings(filepath.Join(root, "config"))
+		if (err == nil) != v.Valid {
+			t.Errorf("Test %v: loadSettings returned error %v, should be valid: %v",
+				i, err, v.Valid)
+		}
+		cleanup()
+	}
+}
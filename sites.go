@@ -0,0 +1,305 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// siteRegistry holds the hosted sites and maps hosts to them.
+//
+// The sites may be replaced while requests are being served, e.g. after
+// reloading the settings.
+type siteRegistry struct {
+	mutex sync.RWMutex
+	sites map[string]site
+	// hosts maps exact host names to site names.
+	hosts map[string]string
+	// wildcards holds the wildcard hosts, longest first.
+	wildcards []wildcardHost
+	// defaultSite is the name of the site for unmatched hosts.
+	defaultSite string
+	// readOnly holds the read only flags set by SetReadOnly by site name.
+	// They take precedence over the sites' settings until the next restart.
+	readOnly map[string]bool
+}
+
+// wildcardHost maps hosts ending with Suffix to a site.
+type wildcardHost struct {
+	// Suffix including the leading dot, e.g. ".example.com".
+	Suffix string
+	Site   string
+}
+
+type wildcardHostList []wildcardHost
+
+// Len is the number of elements in the list.
+func (l wildcardHostList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l wildcardHostList) Less(i, j int) bool {
+	return len(l[i].Suffix) > len(l[j].Suffix)
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l wildcardHostList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// newSiteRegistry returns a new registry of the given sites.
+//
+// See Set for a description of the parameters.
+func newSiteRegistry(sites map[string]site, defaultSite string) *siteRegistry {
+	registry := new(siteRegistry)
+	registry.Set(sites, defaultSite)
+	return registry
+}
+
+// Set replaces the sites of the registry.
+//
+// Hosts of the sites may be wildcards like "*.example.com" which match any
+// subdomain of example.com. Requests to unmatched hosts will be delivered by
+// the site with the name defaultSite. May be empty if there is no default
+// site. Read only flags set by SetReadOnly will be kept.
+func (r *siteRegistry) Set(sites map[string]site, defaultSite string) {
+	newSites := make(map[string]site, len(sites))
+	hosts := make(map[string]string)
+	var wildcards []wildcardHost
+	for name, site := range sites {
+		site.Name = name
+		newSites[name] = site
+		siteHosts := append([]string{}, site.Hosts...)
+		siteHosts = append(siteHosts, site.Aliases...)
+		if len(site.CanonicalHost) > 0 {
+			siteHosts = append(siteHosts, site.CanonicalHost)
+		}
+		for _, host := range siteHosts {
+			host = strings.ToLower(host)
+			if strings.HasPrefix(host, "*.") {
+				wildcards = append(wildcards, wildcardHost{host[1:], name})
+			} else {
+				hosts[host] = name
+			}
+		}
+	}
+	sort.Stable(wildcardHostList(wildcards))
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.keepReadOnly(newSites)
+	r.sites = newSites
+	r.hosts = hosts
+	r.wildcards = wildcards
+	r.defaultSite = defaultSite
+}
+
+// SetReadOnly sets the read only flag of the site with the given name.
+//
+// The flag will be kept if the sites get replaced, e.g. on reload. Returns
+// false if there is no such site.
+func (r *siteRegistry) SetReadOnly(name string, readOnly bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed, ok := r.sites[name]
+	if !ok {
+		return false
+	}
+	if r.readOnly == nil {
+		r.readOnly = make(map[string]bool)
+	}
+	r.readOnly[name] = readOnly
+	sites := make(map[string]site, len(r.sites))
+	for key, value := range r.sites {
+		sites[key] = value
+	}
+	changed.ReadOnly = readOnly
+	sites[name] = changed
+	r.sites = sites
+	return true
+}
+
+// KeepReadOnly applies the read only flags set by SetReadOnly to the given
+// sites.
+func (r *siteRegistry) KeepReadOnly(sites map[string]site) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	r.keepReadOnly(sites)
+}
+
+// keepReadOnly is KeepReadOnly without locking.
+func (r *siteRegistry) keepReadOnly(sites map[string]site) {
+	for name, readOnly := range r.readOnly {
+		if site, ok := sites[name]; ok {
+			site.ReadOnly = readOnly
+			sites[name] = site
+		}
+	}
+}
+
+// Get returns the site with the given name.
+func (r *siteRegistry) Get(name string) (site, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	site, ok := r.sites[name]
+	return site, ok
+}
+
+// stripPort removes the port from the given host, if any.
+//
+// IPv6 literals keep their brackets, e.g. [::1]:8080 becomes [::1].
+func stripPort(host string) string {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if strings.Contains(name, ":") {
+		return "[" + name + "]"
+	}
+	return name
+}
+
+// matchHost returns whether the given host matches the given pattern which may
+// be a wildcard like "*.example.com". The port of the host will be ignored
+// unless the pattern includes a port.
+func matchHost(host, pattern string) bool {
+	host, pattern = strings.ToLower(host), strings.ToLower(pattern)
+	if host == pattern {
+		return true
+	}
+	host = stripPort(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// isAlias returns whether the given host is one of the site's aliases.
+func (s site) isAlias(host string) bool {
+	for _, alias := range s.Aliases {
+		if matchHost(host, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHost returns whether the given host is one of the site's hosts, aliases
+// or its canonical host.
+func (s site) hasHost(host string) bool {
+	if s.isAlias(host) || matchHost(host, s.CanonicalHost) {
+		return true
+	}
+	for _, pattern := range s.Hosts {
+		if matchHost(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// host returns the site's canonical host, or else the first of the site's
+// hosts. Returns an empty string if the site has no hosts.
+func (s site) host() string {
+	if len(s.CanonicalHost) > 0 {
+		return s.CanonicalHost
+	}
+	if len(s.Hosts) > 0 {
+		return s.Hosts[0]
+	}
+	return ""
+}
+
+// URL returns the URL path of the given node path of the site, i.e. the node
+// path prefixed with the site's base path.
+func (s site) URL(nodePath string) string {
+	if len(s.BasePath) == 0 {
+		return nodePath
+	}
+	ret := path.Join(s.BasePath, nodePath)
+	if strings.HasSuffix(nodePath, "/") {
+		ret += "/"
+	}
+	return ret
+}
+
+// stripBasePath removes the site's base path from the given URL path.
+//
+// Returns false if the URL path is outside of the base path. Returns an empty
+// path for the base path without trailing slash.
+func (s site) stripBasePath(urlPath string) (string, bool) {
+	if len(s.BasePath) == 0 {
+		return urlPath, true
+	}
+	if !strings.HasPrefix(urlPath, s.BasePath) {
+		return "", false
+	}
+	rest := urlPath[len(s.BasePath):]
+	if len(rest) > 0 && rest[0] != '/' {
+		return "", false
+	}
+	return rest, true
+}
+
+// cleanBasePath returns the given base path with a leading and without a
+// trailing slash. The root path results in an empty base path.
+func cleanBasePath(basePath string) string {
+	if len(basePath) == 0 {
+		return ""
+	}
+	basePath = path.Clean("/" + basePath)
+	if basePath == "/" {
+		return ""
+	}
+	return basePath
+}
+
+// canonicalURL returns the URL of the given request on the given host.
+func canonicalURL(r *http.Request, host string) string {
+	return requestScheme(r) + "://" + host + r.URL.RequestURI()
+}
+
+// Lookup returns the site to be delivered for the given host.
+//
+// Exact matches are preferred, with or without port, then the longest
+// matching wildcard, then the default site.
+func (r *siteRegistry) Lookup(host string) (site, bool) {
+	host = strings.ToLower(host)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	name, ok := r.hosts[host]
+	if !ok {
+		host = stripPort(host)
+		name, ok = r.hosts[host]
+	}
+	for i := 0; !ok && i < len(r.wildcards); i++ {
+		if strings.HasSuffix(host, r.wildcards[i].Suffix) {
+			name, ok = r.wildcards[i].Site, true
+		}
+	}
+	if !ok {
+		name = r.defaultSite
+	}
+	site, ok := r.sites[name]
+	return site, ok
+}
+
+// DefaultSite returns the name of the site for unmatched hosts.
+func (r *siteRegistry) DefaultSite() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.defaultSite
+}
+
+// All returns all sites by name.
+//
+// The returned map must not be modified.
+func (r *siteRegistry) All() map[string]site {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.sites
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSiteRegistry(t *testing.T) {
+	sites := map[string]site{
+		"foo": site{Hosts: []string{"foo.example.com", "localhost:8080"}},
+		"sub": site{Hosts: []string{"*.example.com"}},
+		"bar": site{Hosts: []string{"*.bar.example.com", "[::1]"}},
+		"def": site{}}
+	tests := []struct {
+		Host, Default, Site string
+	}{
+		{"foo.example.com", "", "foo"},
+		{"FOO.example.com", "", "foo"},
+		{"foo.example.com:8080", "", "foo"},
+		{"localhost:8080", "", "foo"},
+		{"localhost:8081", "", ""},
+		{"www.example.com", "", "sub"},
+		{"a.b.example.com", "", "sub"},
+		{"www.bar.example.com", "", "bar"},
+		{"www.bar.example.com:80", "", "bar"},
+		{"bar.example.com", "", "sub"},
+		{"example.com", "", ""},
+		{"[::1]", "", "bar"},
+		{"[::1]:8080", "", "bar"},
+		{"[::2]:8080", "", ""},
+		{"192.168.1.1", "", ""},
+		{"192.168.1.1", "def", "def"},
+		{"foo.example.com", "def", "foo"},
+		{"www.example.com", "def", "sub"},
+		{"unknown.example.org", "def", "def"},
+		{"unknown.example.org", "missing", ""}}
+	for i, v := range tests {
+		registry := newSiteRegistry(sites, v.Default)
+		site, ok := registry.Lookup(v.Host)
+		if ok != (len(v.Site) > 0) || site.Name != v.Site {
+			t.Errorf("Test %v: Lookup(%q) = %q, %v; should be %q", i, v.Host,
+				site.Name, ok, v.Site)
+		}
+	}
+}
+
+func TestSiteRegistrySet(t *testing.T) {
+	registry := newSiteRegistry(map[string]site{
+		"foo": site{Hosts: []string{"foo.example.com"}},
+		"bar": site{Hosts: []string{"bar.example.com"}}}, "")
+	registry.Set(map[string]site{
+		"bar": site{Hosts: []string{"bar.example.com", "foo.example.com"}}}, "")
+	if site, ok := registry.Lookup("foo.example.com"); !ok || site.Name != "bar" {
+		t.Errorf(`Lookup("foo.example.com") after Set = %q, %v; should be "bar"`,
+			site.Name, ok)
+	}
+	if _, ok := registry.Get("foo"); ok {
+		t.Errorf(`Get("foo") should fail for removed site`)
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		Host, Stripped string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"127.0.0.1:80", "127.0.0.1"},
+		{"[::1]:8080", "[::1]"},
+		{"[::1]", "[::1]"},
+		{"[2001:db8::1]:443", "[2001:db8::1]"}}
+	for i, v := range tests {
+		if ret := stripPort(v.Host); ret != v.Stripped {
+			t.Errorf("Test %v: stripPort(%q) = %q, should be %q", i, v.Host, ret,
+				v.Stripped)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		Host, Pattern string
+		Match         bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.com:8080", "example.com", true},
+		{"example.com:8080", "example.com:8080", true},
+		{"example.com:8081", "example.com:8080", false},
+		{"www.example.com", "example.com", false},
+		{"www.example.com", "*.example.com", true},
+		{"www.example.com:80", "*.example.com", true},
+		{"example.com", "*.example.com", false}}
+	for i, v := range tests {
+		if ret := matchHost(v.Host, v.Pattern); ret != v.Match {
+			t.Errorf("Test %v: matchHost(%q, %q) = %v, should be %v", i, v.Host,
+				v.Pattern, ret, v.Match)
+		}
+	}
+}
+
+func TestCanonicalRedirect(t *testing.T) {
+	sites := map[string]site{
+		"foo": site{Hosts: []string{"example.com"},
+			CanonicalHost: "example.com",
+			Aliases:       []string{"www.example.com", "*.example.org"}}}
+	tests := []struct {
+		URL, Proto string
+		Trust      bool
+		Location   string
+	}{
+		{"http://www.example.com/foo/", "", false, "http://example.com/foo/"},
+		{"http://www.example.com/foo/?a=b&c=d", "", false,
+			"http://example.com/foo/?a=b&c=d"},
+		{"http://www.example.com/foo/@@edit", "", false,
+			"http://example.com/foo/@@edit"},
+		{"http://www.example.org/", "", false, "http://example.com/"},
+		{"http://www.example.com/", "https", true, "https://example.com/"},
+		{"http://www.example.com/", "https", false, "http://example.com/"},
+		{"http://www.example.com/", "gopher", true, "http://example.com/"}}
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Could not parse proxies: %v", err)
+	}
+	for i, v := range tests {
+		h := nodeHandler{
+			Settings: &settings{},
+			Sites:    newSiteRegistry(sites, "")}
+		if v.Trust {
+			h.Settings.Proxies = proxies
+		}
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", v.URL, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if len(v.Proto) > 0 {
+			r.Header.Set("X-Forwarded-Proto", v.Proto)
+		}
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently ||
+			w.HeaderMap.Get("Location") != v.Location {
+			t.Errorf("Test %v: Got %v to %q, should be %v to %q", i, w.Code,
+				w.HeaderMap.Get("Location"), http.StatusMovedPermanently, v.Location)
+		}
+		if len(w.HeaderMap.Get("Set-Cookie")) > 0 {
+			t.Errorf("Test %v: Canonical redirect should not set cookies", i)
+		}
+	}
+}
+
+func TestSiteRegistrySetReadOnly(t *testing.T) {
+	sites := map[string]site{"foo": site{Hosts: []string{"foo.example.com"}}}
+	registry := newSiteRegistry(sites, "")
+	before := registry.All()
+	if !registry.SetReadOnly("foo", true) {
+		t.Fatalf(`SetReadOnly("foo", true) should succeed`)
+	}
+	if site, _ := registry.Lookup("foo.example.com"); !site.ReadOnly {
+		t.Errorf("Site should be read-only after SetReadOnly")
+	}
+	if before["foo"].ReadOnly {
+		t.Errorf("SetReadOnly should not modify maps returned by All")
+	}
+	if registry.SetReadOnly("unknown", true) {
+		t.Errorf(`SetReadOnly("unknown", true) should fail`)
+	}
+}
+
+func TestCleanBasePath(t *testing.T) {
+	tests := []struct {
+		BasePath, Cleaned string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"/docs", "/docs"},
+		{"/docs/", "/docs"},
+		{"docs", "/docs"},
+		{"/a/b//", "/a/b"}}
+	for i, v := range tests {
+		if ret := cleanBasePath(v.BasePath); ret != v.Cleaned {
+			t.Errorf("Test %v: cleanBasePath(%q) = %q, should be %q", i,
+				v.BasePath, ret, v.Cleaned)
+		}
+	}
+}
+
+func TestSiteURL(t *testing.T) {
+	tests := []struct {
+		BasePath, NodePath, URL string
+	}{
+		{"", "/", "/"},
+		{"", "/foo/@@edit", "/foo/@@edit"},
+		{"/docs", "/", "/docs/"},
+		{"/docs", "/foo", "/docs/foo"},
+		{"/docs", "/foo/", "/docs/foo/"},
+		{"/a/b", "/foo/@@edit", "/a/b/foo/@@edit"}}
+	for i, v := range tests {
+		if ret := (site{BasePath: v.BasePath}).URL(v.NodePath); ret != v.URL {
+			t.Errorf("Test %v: URL(%q) = %q, should be %q", i, v.NodePath, ret,
+				v.URL)
+		}
+	}
+}
+
+func TestSiteHost(t *testing.T) {
+	tests := []struct {
+		Site site
+		Host string
+	}{
+		{site{}, ""},
+		{site{Hosts: []string{"foo.com", "bar.com"}}, "foo.com"},
+		{site{Hosts: []string{"foo.com"}, CanonicalHost: "www.foo.com"},
+			"www.foo.com"}}
+	for i, v := range tests {
+		if ret := v.Site.host(); ret != v.Host {
+			t.Errorf("Test %v: host() = %q, should be %q", i, ret, v.Host)
+		}
+	}
+}
+
+func TestStripBasePath(t *testing.T) {
+	tests := []struct {
+		BasePath, URLPath string
+		OK                bool
+		NodePath, Action  string
+	}{
+		{"", "/foo/@@edit", true, "/foo", "edit"},
+		{"/docs", "/docs/", true, "/", ""},
+		{"/docs", "/docs/foo/", true, "/foo/", ""},
+		{"/docs", "/docs/@@login", true, "/", "login"},
+		{"/docs", "/docs/foo/@@users/add", true, "/foo", "users/add"},
+		{cleanBasePath("/a/b/"), "/a/b/@@edit", true, "/", "edit"},
+		{cleanBasePath("/a/b/"), "/a/b/c/@@edit", true, "/c", "edit"},
+		{"/docs", "/docs", true, "", ""},
+		{"/docs", "/docsfoo/", false, "", ""},
+		{"/docs", "/other/", false, "", ""},
+		{"/docs", "/@@login", false, "", ""}}
+	for i, v := range tests {
+		sitePath, ok := (site{BasePath: v.BasePath}).stripBasePath(v.URLPath)
+		if ok != v.OK {
+			t.Errorf("Test %v: stripBasePath(%q) returned %v, should be %v", i,
+				v.URLPath, ok, v.OK)
+			continue
+		}
+		if !ok || len(sitePath) == 0 {
+			continue
+		}
+		nodePath, action := splitAction(sitePath)
+		if nodePath != v.NodePath || action != v.Action {
+			t.Errorf("Test %v: Got node path %q and action %q for %q, should"+
+				" be %q and %q", i, nodePath, action, v.URLPath, v.NodePath,
+				v.Action)
+		}
+	}
+}
+
+func TestServeBasePath(t *testing.T) {
+	sites := map[string]site{
+		"foo": site{Hosts: []string{"example.com"}, BasePath: "/docs"}}
+	tests := []struct {
+		URL      string
+		Status   int
+		Location string
+	}{
+		{"http://example.com/", http.StatusNotFound, ""},
+		{"http://example.com/other/@@login", http.StatusNotFound, ""},
+		{"http://example.com/docs", http.StatusSeeOther, "/docs/"},
+		{"http://example.com/docs/foo", http.StatusSeeOther,
+			"http://example.com/docs/foo/"}}
+	for i, v := range tests {
+		h := nodeHandler{
+			Settings: &settings{},
+			Sites:    newSiteRegistry(sites, "")}
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", v.URL, nil)
+		h.ServeHTTP(w, r)
+		if w.Code != v.Status || w.HeaderMap.Get("Location") != v.Location {
+			t.Errorf("Test %v: Got %v to %q, should be %v to %q", i, w.Code,
+				w.HeaderMap.Get("Location"), v.Status, v.Location)
+		}
+	}
+}
+
+func TestSiteRegistryKeepReadOnly(t *testing.T) {
+	sites := map[string]site{"foo": site{Hosts: []string{"foo.example.com"}},
+		"bar": site{Hosts: []string{"bar.example.com"}, ReadOnly: true}}
+	registry := newSiteRegistry(sites, "")
+	registry.SetReadOnly("foo", true)
+	registry.SetReadOnly("bar", false)
+	registry.Set(map[string]site{
+		"foo": site{Hosts: []string{"foo.example.com"}},
+		"bar": site{Hosts: []string{"bar.example.com"}, ReadOnly: true},
+		"baz": site{Hosts: []string{"baz.example.com"}, ReadOnly: true}}, "")
+	for name, readOnly := range map[string]bool{
+		"foo": true, "bar": false, "baz": true} {
+		if site, _ := registry.Get(name); site.ReadOnly != readOnly {
+			t.Errorf("Site %q: ReadOnly = %v after Set, should be %v", name,
+				site.ReadOnly, readOnly)
+		}
+	}
+}
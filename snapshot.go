@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSnapshotRetention is the number of snapshots kept per site if the
+// site does not specify otherwise.
+const defaultSnapshotRetention = 7
+
+// snapshotManifest is the name of the file describing a snapshot.
+const snapshotManifest = "snapshot.yaml"
+
+// snapshotTimeFormat is the format of the time in snapshot names.
+const snapshotTimeFormat = "20060102-150405"
+
+// snapshotProgressFiles is the number of files after which the progress of
+// a snapshot gets logged.
+const snapshotProgressFiles = 1000
+
+// snapshotExcludes are the paths of the data directory which will not be
+// included in snapshots as they can be rebuilt.
+var snapshotExcludes = []string{imageCachePath, searchIndexPath}
+
+// snapshotInfo describes a snapshot as stored in its manifest.
+type snapshotInfo struct {
+	// Name of the snapshot's directory.
+	Name string `yaml:"-"`
+	// Site is the name of the snapshot's site.
+	Site string
+	// Created is the time the snapshot has been taken.
+	Created time.Time `yaml:"-"`
+	// CreatedTime is Created as stored in the manifest (RFC 3339).
+	CreatedTime string `yaml:"created"`
+	// Nodes is the number of nodes in the snapshot.
+	Nodes int
+	// Files is the number of files and Size their total size in bytes.
+	Files int
+	Size  int64
+}
+
+// dataWriteLocks maps data and configuration directories to the locks of
+// their sites. Writers hold the locks shared, snapshots exclusively.
+var dataWriteLocks = make(map[string]*sync.RWMutex)
+
+// dataWriteLocksMutex protects dataWriteLocks.
+var dataWriteLocksMutex sync.Mutex
+
+// snapshotMutex makes sure that only one snapshot is taken at a time.
+var snapshotMutex sync.Mutex
+
+// siteWriteLock returns the write lock of the given site's data and
+// configuration directories.
+//
+// Writes only wait for snapshots once the lock exists, so the locks of all
+// sites should be created on startup.
+func siteWriteLock(site site) *sync.RWMutex {
+	dataWriteLocksMutex.Lock()
+	defer dataWriteLocksMutex.Unlock()
+	lock, ok := dataWriteLocks[site.Directories.Data]
+	if !ok {
+		lock = new(sync.RWMutex)
+		dataWriteLocks[site.Directories.Data] = lock
+	}
+	if len(site.Directories.Config) > 0 {
+		dataWriteLocks[site.Directories.Config] = lock
+	}
+	return lock
+}
+
+// lockWrites waits for any snapshot of the directory containing the given
+// file and keeps further snapshots from starting until the returned
+// function has been called.
+//
+// Must not be nested, i.e. the file has to be written without calling
+// other functions locking writes.
+func lockWrites(file string) func() {
+	dataWriteLocksMutex.Lock()
+	var lock *sync.RWMutex
+	for dir, dirLock := range dataWriteLocks {
+		if file == dir ||
+			strings.HasPrefix(file, dir+string(filepath.Separator)) {
+			lock = dirLock
+			break
+		}
+	}
+	dataWriteLocksMutex.Unlock()
+	if lock == nil {
+		return func() {}
+	}
+	lock.RLock()
+	return lock.RUnlock
+}
+
+// snapshotsDir returns the directory holding the snapshots of the given
+// site, which is located next to the data directory.
+func snapshotsDir(site site) string {
+	return filepath.Join(filepath.Dir(site.Directories.Data), "snapshots")
+}
+
+// snapshotFile adds the given file to a snapshot.
+//
+// Files are hard linked if possible. As content files get replaced instead
+// of being changed, see writeFileAtomic, the links keep the snapshot's
+// content. Log files get appended to and will be copied.
+func snapshotFile(file, target string, info os.FileInfo) error {
+	if !strings.HasSuffix(file, ".log") && os.Link(file, target) == nil {
+		return nil
+	}
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// snapshotData adds the given data directory to the snapshot at dst and
+// updates the snapshot's info. Progress will be reported to logf.
+func snapshotData(root, dst string, info *snapshotInfo,
+	logf func(format string, v ...interface{})) error {
+	return filepath.Walk(root, func(file string, fileInfo os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		if inStringSlice(filepath.ToSlash(rel), snapshotExcludes) {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fileInfo.IsDir():
+			return os.Mkdir(target, 0700)
+		case !fileInfo.Mode().IsRegular():
+			return nil
+		}
+		if err := snapshotFile(file, target, fileInfo); err != nil {
+			return err
+		}
+		info.Files++
+		info.Size += fileInfo.Size()
+		if fileInfo.Name() == "node.yaml" {
+			info.Nodes++
+		}
+		if info.Files%snapshotProgressFiles == 0 {
+			logf("Snapshot %v: %v files, %v bytes", info.Name, info.Files,
+				info.Size)
+		}
+		return nil
+	})
+}
+
+// snapshotConfig copies the files of the given configuration directory,
+// e.g. site.yaml and users.yaml, to dst.
+func snapshotConfig(dir, dst string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if err := snapshotFile(filepath.Join(dir, info.Name()),
+			filepath.Join(dst, info.Name()), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSnapshot takes a snapshot of the data and configuration files of
+// the given site and removes the snapshots exceeding the site's retention.
+//
+// Writes to the site wait while the files are linked or copied. Progress
+// will be reported to logf.
+func createSnapshot(site site, now time.Time,
+	logf func(format string, v ...interface{})) (*snapshotInfo, error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	info := snapshotInfo{
+		Name:        site.Name + "-" + now.Format(snapshotTimeFormat),
+		Site:        site.Name,
+		Created:     now,
+		CreatedTime: now.Format(time.RFC3339)}
+	dir := filepath.Join(snapshotsDir(site), info.Name)
+	if err := os.MkdirAll(snapshotsDir(site), 0700); err != nil {
+		return nil, fmt.Errorf("Could not create snapshots directory: %v", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create snapshot directory: %v", err)
+	}
+	logf("Snapshot %v: Started", info.Name)
+	lock := siteWriteLock(site)
+	lock.Lock()
+	err := snapshotData(site.Directories.Data, filepath.Join(dir, "data"),
+		&info, logf)
+	if err == nil && len(site.Directories.Config) > 0 {
+		err = snapshotConfig(site.Directories.Config,
+			filepath.Join(dir, "config"))
+	}
+	lock.Unlock()
+	if err == nil {
+		var content []byte
+		if content, err = goyaml.Marshal(&info); err == nil {
+			err = writeFileAtomic(filepath.Join(dir, snapshotManifest), content,
+				0600)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Could not create snapshot: %v", err)
+	}
+	logf("Snapshot %v: Finished with %v nodes, %v files, %v bytes",
+		info.Name, info.Nodes, info.Files, info.Size)
+	retention := site.Snapshots.Retention
+	if retention <= 0 {
+		retention = defaultSnapshotRetention
+	}
+	if err := pruneSnapshots(site, retention, logf); err != nil {
+		logf("Could not remove old snapshots: %v", err)
+	}
+	return &info, nil
+}
+
+// snapshotList sorts snapshots by their creation time, newest first.
+type snapshotList []snapshotInfo
+
+// Len is the number of elements in the list.
+func (l snapshotList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l snapshotList) Less(i, j int) bool {
+	return l[i].Created.After(l[j].Created)
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l snapshotList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// listSnapshots returns the complete snapshots of the given site, newest
+// first.
+func listSnapshots(site site) ([]snapshotInfo, error) {
+	dirs, err := ioutil.ReadDir(snapshotsDir(site))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read snapshots directory: %v", err)
+	}
+	var ret []snapshotInfo
+	for _, dir := range dirs {
+		if !dir.IsDir() || !strings.HasPrefix(dir.Name(), site.Name+"-") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(snapshotsDir(site),
+			dir.Name(), snapshotManifest))
+		if err != nil {
+			continue
+		}
+		var info snapshotInfo
+		if err := goyaml.Unmarshal(content, &info); err != nil ||
+			info.Site != site.Name {
+			continue
+		}
+		if info.Created, err = time.Parse(time.RFC3339,
+			info.CreatedTime); err != nil {
+			continue
+		}
+		info.Name = dir.Name()
+		ret = append(ret, info)
+	}
+	sort.Sort(snapshotList(ret))
+	return ret, nil
+}
+
+// pruneSnapshots removes the oldest snapshots of the given site exceeding
+// the given number. Removals will be reported to logf.
+func pruneSnapshots(site site, retention int,
+	logf func(format string, v ...interface{})) error {
+	snapshots, err := listSnapshots(site)
+	if err != nil {
+		return err
+	}
+	for i := retention; i < len(snapshots); i++ {
+		if err := os.RemoveAll(filepath.Join(snapshotsDir(site),
+			snapshots[i].Name)); err != nil {
+			return err
+		}
+		logf("Removed snapshot %v", snapshots[i].Name)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupSnapshotSite creates a site with some content and returns it.
+func setupSnapshotSite(t *testing.T, name string) (site, func()) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/site.yaml":                         `{"title": "Foo"}`,
+		"/foo/users.yaml":                        `[{"login": "alice"}]`,
+		"/foo/data/node.yaml":                    `{"type": "Document"}`,
+		"/foo/data/navigation.yaml":              `[]`,
+		"/foo/data/bar/node.yaml":                `{"type": "Document"}`,
+		"/foo/data/bar/body.html":                "Old body",
+		"/foo/data/.monsti/audit.log":            "{}\n",
+		"/foo/data/.monsti/imgcache/bar/img.png": "cached",
+		"/foo/data/.monsti/index/index.yaml":     "{}"}, name)
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	site := site{Name: "foo"}
+	site.Directories.Config = filepath.Join(root, "foo")
+	site.Directories.Data = filepath.Join(root, "foo", "data")
+	return site, cleanup
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	site, cleanup := setupSnapshotSite(t, "TestCreateSnapshot")
+	defer cleanup()
+	now := time.Date(2014, 3, 10, 12, 30, 0, 0, time.UTC)
+	var logged int
+	info, err := createSnapshot(site, now, func(string, ...interface{}) {
+		logged++
+	})
+	if err != nil {
+		t.Fatalf("createSnapshot(...) returned error: %v", err)
+	}
+	if info.Name != "foo-20140310-123000" || info.Nodes != 2 ||
+		info.CreatedTime != "2014-03-10T12:30:00Z" ||
+		info.Files != 5 || logged == 0 {
+		t.Errorf("createSnapshot(...) = %+v, logged %v times", info, logged)
+	}
+	dir := filepath.Join(snapshotsDir(site), info.Name)
+	if err := writeContentFile(filepath.Join(site.Directories.Data, "bar",
+		"body.html"), []byte("New body")); err != nil {
+		t.Fatalf("Could not write body: %v", err)
+	}
+	if err := appendAudit(site, "alice", auditWriteData, "/bar",
+		"body.html"); err != nil {
+		t.Fatalf("Could not append audit record: %v", err)
+	}
+	for file, content := range map[string]string{
+		"data/bar/body.html":     "Old body",
+		"data/navigation.yaml":   "[]",
+		"data/.monsti/audit.log": "{}\n",
+		"config/users.yaml":      `[{"login": "alice"}]`,
+		"data/.monsti/imgcache":  "",
+		"data/.monsti/index":     "",
+		"config/data/node.yaml":  "",
+		"config/snapshots":       ""} {
+		ret, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if len(content) == 0 {
+			if !os.IsNotExist(err) {
+				t.Errorf("%v should not be part of the snapshot", file)
+			}
+			continue
+		}
+		if err != nil || string(ret) != content {
+			t.Errorf("%v of the snapshot is %q (%v), should be %q", file, ret,
+				err, content)
+		}
+	}
+	snapshots, err := listSnapshots(site)
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != info.Name ||
+		snapshots[0].Nodes != 2 || !snapshots[0].Created.Equal(now) {
+		t.Errorf("listSnapshots(...) = %+v, %v", snapshots, err)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	site, cleanup := setupSnapshotSite(t, "TestPruneSnapshots")
+	defer cleanup()
+	site.Snapshots.Retention = 2
+	now := time.Now().Truncate(time.Second)
+	discard := func(string, ...interface{}) {}
+	for i := 3; i >= 0; i-- {
+		if _, err := createSnapshot(site, now.Add(-time.Duration(i)*time.Hour),
+			discard); err != nil {
+			t.Fatalf("createSnapshot(...) returned error: %v", err)
+		}
+	}
+	snapshots, err := listSnapshots(site)
+	if err != nil || len(snapshots) != 2 || !snapshots[0].Created.Equal(now) ||
+		!snapshots[1].Created.Equal(now.Add(-time.Hour)) {
+		t.Errorf("listSnapshots(...) = %+v, %v", snapshots, err)
+	}
+}
+
+func TestLockWrites(t *testing.T) {
+	site, cleanup := setupSnapshotSite(t, "TestLockWrites")
+	defer cleanup()
+	lock := siteWriteLock(site)
+	lock.Lock()
+	written := make(chan error)
+	go func() {
+		written <- writeContentFile(filepath.Join(site.Directories.Data, "bar",
+			"body.html"), []byte("New body"))
+	}()
+	select {
+	case <-written:
+		t.Errorf("File has been written during snapshot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	lock.Unlock()
+	if err := <-written; err != nil {
+		t.Errorf("Could not write file: %v", err)
+	}
+	unlock := lockWrites(filepath.Join(os.TempDir(), "other"))
+	unlock()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// spoolPath is the path of the spool relative to the data directory. The
+// spool keeps requests which could not be handled because the worker died.
+const spoolPath = ".monsti/spool"
+
+// maxSpoolSize is the maximum total size in bytes of a site's spool.
+const maxSpoolSize = 5 * 1024 * 1024
+
+// spooledRequest is a request kept in the spool.
+type spooledRequest struct {
+	// ID is the request's ID. It's also used as file name.
+	ID string
+	// Time the request has been received in nodeTimeFormat.
+	Time                       string
+	Method, Path, Action       string
+	NodeType, Scheme, ClientIP string
+	// Login of the user who sent the request. Empty for anonymous requests.
+	Login string `yaml:",omitempty"`
+	// CSRFValid is true if the request included the CSRF token of the
+	// user's session. The token itself isn't kept, replayed requests get a
+	// new one.
+	CSRFValid bool `yaml:",omitempty"`
+	// Form holds the submitted form values except the CSRF token.
+	Form map[string][]string `yaml:",omitempty"`
+}
+
+// spooledRequestList sorts spooled requests by time, oldest first.
+type spooledRequestList []spooledRequest
+
+// Len is the number of elements in the list.
+func (l spooledRequestList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l spooledRequestList) Less(i, j int) bool {
+	ti, _ := time.Parse(nodeTimeFormat, l[i].Time)
+	tj, _ := time.Parse(nodeTimeFormat, l[j].Time)
+	if ti.Equal(tj) {
+		return l[i].ID < l[j].ID
+	}
+	return ti.Before(tj)
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l spooledRequestList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// idempotentMethod returns true if requests of the given method may be
+// repeated without further side effects.
+func idempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// spoolFile returns the file of the spooled request with the given ID in
+// the data directory located at the given root.
+func spoolFile(root, id string) (string, error) {
+	if !validRequestID(id) {
+		return "", fmt.Errorf("Invalid spooled request ID %q", id)
+	}
+	return filepath.Join(root, spoolPath, id+".yaml"), nil
+}
+
+// spoolSize returns the total size of the spool of the data directory
+// located at the given root.
+func spoolSize(root string) (int64, error) {
+	files, err := ioutil.ReadDir(filepath.Join(root, spoolPath))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Could not read spool: %v", err)
+	}
+	var size int64
+	for _, file := range files {
+		size += file.Size()
+	}
+	return size, nil
+}
+
+// spoolTicket writes the request of the given ticket to the spool of the
+// data directory located at the given root.
+//
+// Returns the ID of the spooled request. Fails if the spool would exceed
+// maxSpoolSize or if the request included uploaded files, which are
+// removed after the request.
+func spoolTicket(root string, ticket worker.Ticket, now time.Time) (string,
+	error) {
+	if len(ticket.Files) > 0 {
+		return "", fmt.Errorf("Requests with uploaded files can't be spooled")
+	}
+	form := make(map[string][]string, len(ticket.Form))
+	for key, values := range ticket.Form {
+		if key != csrfFormField {
+			form[key] = values
+		}
+	}
+	token := ticket.Form.Get(csrfFormField)
+	valid := csrfExempt(ticket.Request) ||
+		equalCSRFTokens(ticket.CSRFToken, token)
+	req := spooledRequest{
+		ID:        ticket.RequestID,
+		Time:      now.Format(nodeTimeFormat),
+		Method:    ticket.Request.Method,
+		Path:      ticket.Node.Path,
+		Action:    ticket.Action,
+		NodeType:  ticket.Node.Type,
+		Scheme:    ticket.Scheme,
+		ClientIP:  ticket.ClientIP,
+		Login:     sessionLogin(&ticket.Session),
+		CSRFValid: valid,
+		Form:      form}
+	if !validRequestID(req.ID) {
+		req.ID = newRequestID()
+	}
+	content, err := goyaml.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("Could not marshal spooled request: %v", err)
+	}
+	size, err := spoolSize(root)
+	if err != nil {
+		return "", err
+	}
+	if size+int64(len(content)) > maxSpoolSize {
+		return "", fmt.Errorf("Spool is full")
+	}
+	file, err := spoolFile(root, req.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return "", fmt.Errorf("Could not create spool directory: %v", err)
+	}
+	if err := writeFileAtomic(file, content, 0600); err != nil {
+		return "", fmt.Errorf("Could not write spooled request: %v", err)
+	}
+	return req.ID, nil
+}
+
+// readSpooledRequest returns the spooled request with the given ID of the
+// data directory located at the given root.
+func readSpooledRequest(root, id string) (*spooledRequest, error) {
+	file, err := spoolFile(root, id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read spooled request: %v", err)
+	}
+	var req spooledRequest
+	if err := goyaml.Unmarshal(content, &req); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal spooled request %q: %v",
+			id, err)
+	}
+	return &req, nil
+}
+
+// listSpool returns all spooled requests of the data directory located at
+// the given root, oldest first.
+func listSpool(root string) ([]spooledRequest, error) {
+	files, err := ioutil.ReadDir(filepath.Join(root, spoolPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read spool: %v", err)
+	}
+	var reqs []spooledRequest
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".yaml")
+		if file.IsDir() || id == file.Name() || !validRequestID(id) {
+			continue
+		}
+		req, err := readSpooledRequest(root, id)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, *req)
+	}
+	sort.Sort(spooledRequestList(reqs))
+	return reqs, nil
+}
+
+// removeSpooledRequest removes the spooled request with the given ID of the
+// data directory located at the given root.
+func removeSpooledRequest(root, id string) error {
+	file, err := spoolFile(root, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("Could not remove spooled request: %v", err)
+	}
+	return nil
+}
+
+// replayTicket returns a ticket to replay the given spooled request.
+//
+// The request will be sent on behalf of its user, using the user's current
+// roles. If the user has been removed or disabled in the meantime, the
+// request will be sent anonymously. Requests which included a valid CSRF
+// token get a new one.
+func replayTicket(req spooledRequest, site site) (worker.Ticket, error) {
+	node, err := lookupNode(site.Directories.Data, req.Path)
+	if err != nil {
+		return worker.Ticket{}, fmt.Errorf("Could not find node %q: %v",
+			req.Path, err)
+	}
+	nodeURL := strings.TrimSuffix(site.URL(req.Path), "/") + "/"
+	if len(req.Action) > 0 {
+		nodeURL += "@@" + req.Action
+	}
+	form := url.Values(req.Form)
+	token := randomToken()
+	if req.CSRFValid {
+		form.Set(csrfFormField, token)
+	}
+	r, err := http.NewRequest(req.Method, nodeURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return worker.Ticket{}, fmt.Errorf("Could not create request: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Form, r.PostForm = form, form
+	ticket := worker.Ticket{
+		Node:      node,
+		Request:   r,
+		Session:   client.Session{Locale: site.Locale},
+		Action:    req.Action,
+		Site:      site.Name,
+		ClientIP:  req.ClientIP,
+		Scheme:    req.Scheme,
+		RequestID: req.ID,
+		CSRFToken: token,
+		Form:      form}
+	if len(req.Login) > 0 {
+		user, err := getUser(req.Login, site.Directories.Config)
+		if err != nil {
+			return worker.Ticket{}, fmt.Errorf("Could not load user %q: %v",
+				req.Login, err)
+		}
+		if user != nil && !user.Disabled {
+			ticket.Session.User = &user.User
+			ticket.Roles = user.GetRoles()
+		}
+	}
+	return ticket, nil
+}
+
+// checkReplay returns an error if the given replay ticket's user might not
+// send its request anymore, e.g. because the user has been demoted or the
+// node has been restricted since the request was spooled. These are the
+// checks made by ServeHTTP before requesting a worker.
+func (h *nodeHandler) checkReplay(ticket worker.Ticket, site site) error {
+	err := h.actions().Check(ticket.Node.Type, ticket.Action, ticket.Roles,
+		site.Permissions)
+	if err != nil {
+		return fmt.Errorf("Action %q on node %q: %v", ticket.Action,
+			ticket.Node.Path, err)
+	}
+	if !unrestrictedActions[ticket.Action] &&
+		!newNodeAccess(site.Directories.Data, ticket.Roles).CanView(
+			ticket.Node.Path) {
+		return fmt.Errorf("Node %q is restricted", ticket.Node.Path)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentMethod(t *testing.T) {
+	tests := []struct {
+		Method     string
+		Idempotent bool
+	}{
+		{"GET", true},
+		{"HEAD", true},
+		{"OPTIONS", true},
+		{"POST", false},
+		{"PUT", false},
+		{"DELETE", false}}
+	for _, v := range tests {
+		if ret := idempotentMethod(v.Method); ret != v.Idempotent {
+			t.Errorf("idempotentMethod(%q) = %v, should be %v", v.Method, ret,
+				v.Idempotent)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "ContactForm"}`}, "TestSpool")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r, _ := http.NewRequest("POST", "http://example.com/foo/", nil)
+	ticket := worker.Ticket{
+		Node:      client.Node{Path: "/foo", Type: "ContactForm"},
+		Request:   r,
+		RequestID: "abc",
+		Form:      url.Values{"Message": []string{"Hello"}}}
+	now := time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC)
+	id, err := spoolTicket(root, ticket, now)
+	if err != nil || id != "abc" {
+		t.Fatalf("spoolTicket(...) = %q, %v, should be abc, nil", id, err)
+	}
+	ticket.RequestID = "../evil"
+	if id, err = spoolTicket(root, ticket, now.Add(time.Minute)); err != nil ||
+		id == "../evil" || !validRequestID(id) {
+		t.Fatalf("spoolTicket(...) = %q, %v, should return a new ID", id, err)
+	}
+	reqs, err := listSpool(root)
+	if err != nil || len(reqs) != 2 {
+		t.Fatalf("listSpool(...) = %v, %v, should return two requests", reqs,
+			err)
+	}
+	if reqs[0].ID != "abc" || reqs[0].Method != "POST" ||
+		reqs[0].Path != "/foo" || reqs[0].Form["Message"][0] != "Hello" {
+		t.Errorf("Wrong spooled request: %v", reqs[0])
+	}
+	err = walkNodes(root, func(nodePath string, info os.FileInfo) error {
+		if nodePath != "/" && nodePath != "/foo" {
+			t.Errorf("Spool should be skipped, got node %q", nodePath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Could not walk nodes: %v", err)
+	}
+	if err := removeSpooledRequest(root, id); err != nil {
+		t.Errorf("Could not remove spooled request: %v", err)
+	}
+	if err := removeSpooledRequest(root, "../../foo/node"); err == nil {
+		t.Errorf("Removing files outside the spool should fail")
+	}
+	ticket.RequestID = "big"
+	ticket.Form = url.Values{"Message": []string{
+		strings.Repeat("x", maxSpoolSize)}}
+	if _, err := spoolTicket(root, ticket, now); err == nil {
+		t.Errorf("Spooling should fail if the spool is full")
+	}
+	if reqs, _ := listSpool(root); len(reqs) != 1 {
+		t.Errorf("Spool should contain one request, got %v", reqs)
+	}
+	ticket.RequestID = "upload"
+	ticket.Form = url.Values{"Message": []string{"Hello"}}
+	ticket.Files = map[string][]string{"File": {"/tmp/upload"}}
+	if _, err := spoolTicket(root, ticket, now); err == nil {
+		t.Errorf("Spooling requests with uploaded files should fail")
+	}
+}
+
+func TestSpoolCSRFToken(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "ContactForm"}`}, "TestSpoolCSRFToken")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{Name: "foo"}
+	site_.Directories.Data = root
+	for i, token := range []string{"secret", "forged"} {
+		r, _ := http.NewRequest("POST", "http://example.com/foo/", nil)
+		ticket := worker.Ticket{
+			Node:      client.Node{Path: "/foo", Type: "ContactForm"},
+			Request:   r,
+			RequestID: fmt.Sprintf("req%v", i),
+			CSRFToken: "secret",
+			Form: url.Values{"Message": []string{"Hello"},
+				csrfFormField: []string{token}}}
+		id, err := spoolTicket(root, ticket, time.Now())
+		if err != nil {
+			t.Fatalf("Could not spool request: %v", err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(root, spoolPath,
+			id+".yaml"))
+		if err != nil || bytes.Contains(content, []byte(token)) ||
+			bytes.Contains(content, []byte("secret")) {
+			t.Errorf("The CSRF token has been spooled: %q, %v", content, err)
+		}
+		req, err := readSpooledRequest(root, id)
+		if err != nil {
+			t.Fatalf("Could not read spooled request: %v", err)
+		}
+		replayed, err := replayTicket(*req, site_)
+		if err != nil {
+			t.Fatalf("Could not create replay ticket: %v", err)
+		}
+		valid := replayed.Form.Get(csrfFormField) == replayed.CSRFToken
+		if valid != (token == "secret") || replayed.CSRFToken == "secret" {
+			t.Errorf("%v: Replay ticket got token %q, form %v", token,
+				replayed.CSRFToken, replayed.Form)
+		}
+	}
+}
+
+func TestRequestNodeSpool(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRequestNodeSpool")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	for _, method := range []string{"GET", "POST"} {
+		var logBuf bytes.Buffer
+		h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+			close(ticket.ResponseChan)
+		})
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "http://example.com/foo/",
+			strings.NewReader("Message=Hello"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%v: Got status %v, should be %v", method, w.Code,
+				http.StatusBadGateway)
+		}
+	}
+	reqs, err := listSpool(root)
+	if err != nil || len(reqs) != 1 {
+		t.Fatalf("Only the POST request should be spooled, got %v, %v", reqs,
+			err)
+	}
+	site_ := site{Name: "foo"}
+	site_.Directories.Data = root
+	ticket, err := replayTicket(reqs[0], site_)
+	if err != nil {
+		t.Fatalf("Could not create replay ticket: %v", err)
+	}
+	if ticket.Node.Title != "Foo" || ticket.Request.Method != "POST" ||
+		ticket.Request.URL.Path != "/foo/" || ticket.Session.User != nil {
+		t.Errorf("Wrong replay ticket: %v", ticket)
+	}
+	if err := ticket.Request.ParseForm(); err != nil ||
+		ticket.Request.Form.Get("Message") != "Hello" {
+		t.Errorf("Replayed form should contain the message, got %v, %v",
+			ticket.Request.Form, err)
+	}
+}
+
+func TestReplaySpooledChecks(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/foo/node.yaml":     `{"type": "Document", "title": "Foo"}`,
+		"/data/members/node.yaml": `{"type": "Document", "restrict": "editor"}`,
+		"/config/__empty__":       ""}, "TestReplaySpooledChecks")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	configDir := filepath.Join(root, "config")
+	if err := saveUsers(configDir, []user{
+		{User: client.User{Login: "demoted"}, Roles: []string{roleReader}},
+		{User: client.User{Login: "editor"}, Roles: []string{roleEditor}}}); err !=
+		nil {
+		t.Fatalf("Could not save users: %v", err)
+	}
+	tests := []struct {
+		Path, Action, Login string
+		Replayed            bool
+	}{
+		{"/foo", "edit", "demoted", false},
+		{"/members", "", "", false},
+		{"/members", "", "demoted", false},
+		{"/members", "edit", "editor", true},
+		{"/foo", "", "", true}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		replayed := make(chan bool, 1)
+		h, stop := setupWorkerHandler(filepath.Join(root, "data"), &logBuf,
+			func(ticket worker.Ticket) {
+				replayed <- true
+				ticket.ResponseChan <- client.Response{Body: []byte("ok"),
+					Raw: true}
+			})
+		site_, _ := h.Sites.Get("foo")
+		site_.Directories.Config = configDir
+		r, _ := http.NewRequest("POST", "http://example.com/foo/", nil)
+		ticket := worker.Ticket{
+			Node:      client.Node{Path: v.Path, Type: "Document"},
+			Request:   r,
+			Action:    v.Action,
+			RequestID: fmt.Sprintf("req%v", i)}
+		if len(v.Login) > 0 {
+			ticket.Session.User = &client.User{Login: v.Login}
+		}
+		id, err := spoolTicket(site_.Directories.Data, ticket, time.Now())
+		if err != nil {
+			t.Fatalf("Could not spool request: %v", err)
+		}
+		r, _ = http.NewRequest("POST", "http://example.com/@@status", nil)
+		h.replaySpooled(r, id, &client.Session{
+			User: &client.User{Login: "admin"}}, site_)
+		stop()
+		_, err = readSpooledRequest(site_.Directories.Data, id)
+		if v.Replayed != (len(replayed) > 0) || v.Replayed != (err != nil) {
+			t.Errorf("Test %v: Request replayed: %v, spool entry: %v, should be"+
+				" replayed: %v", i, len(replayed) > 0, err, v.Replayed)
+		}
+		if !v.Replayed && !strings.Contains(logBuf.String(),
+			"Refused to replay") {
+			t.Errorf("Test %v: Refusal has not been logged: %q", i,
+				logBuf.String())
+		}
+		removeSpooledRequest(site_.Directories.Data, id)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Worker process states.
+const (
+	workerRunning    = "running"
+	workerRestarting = "restarting"
+	workerDead       = "dead"
+)
+
+// workerStatus holds the status of the worker of some node type.
+type workerStatus struct {
+	NodeType string
+	// State is the state of the worker process.
+	State string
+	// Started is the time of the last (re)start of the worker process.
+	Started time.Time
+	// Restarts is the number of restarts since the daemon started.
+	Restarts int
+	// Queued is the number of requests waiting for the worker.
+	Queued int
+	// Served is the number of requests served since the daemon started.
+	Served int
+	// Failures is the number of requests the worker died while handling
+	// them.
+	Failures int
+	// Kills is the number of times the worker has been killed because it
+	// stopped responding.
+	Kills int
+	// Command is the command line used to start the worker.
+	Command string
+}
+
+// workerStats keeps track of the status of the workers.
+//
+// A nil workerStats ignores all updates.
+type workerStats struct {
+	mutex   sync.Mutex
+	workers map[string]*workerStatus
+}
+
+// newWorkerStats returns a new, empty workerStats.
+func newWorkerStats() *workerStats {
+	return &workerStats{workers: make(map[string]*workerStatus)}
+}
+
+// update calls the given function with the status of the given node type.
+func (s *workerStats) update(nodeType string, fun func(*workerStatus)) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status, ok := s.workers[nodeType]
+	if !ok {
+		status = &workerStatus{NodeType: nodeType}
+		s.workers[nodeType] = status
+	}
+	fun(status)
+}
+
+// Started records a (re)start of the worker of the given node type.
+func (s *workerStats) Started(nodeType string) {
+	s.update(nodeType, func(status *workerStatus) {
+		if !status.Started.IsZero() {
+			status.Restarts++
+		}
+		status.State = workerRunning
+		status.Started = time.Now()
+	})
+}
+
+// SetCommand sets the command line used to start the worker of the given
+// node type.
+func (s *workerStats) SetCommand(nodeType, command string) {
+	s.update(nodeType, func(status *workerStatus) {
+		status.Command = command
+	})
+}
+
+// SetState sets the state of the worker of the given node type.
+func (s *workerStats) SetState(nodeType, state string) {
+	s.update(nodeType, func(status *workerStatus) {
+		status.State = state
+	})
+}
+
+// Queue records a request being queued (delta 1) or dequeued (delta -1).
+func (s *workerStats) Queue(nodeType string, delta int) {
+	s.update(nodeType, func(status *workerStatus) {
+		status.Queued += delta
+	})
+}
+
+// Served records a served request.
+func (s *workerStats) Served(nodeType string) {
+	s.update(nodeType, func(status *workerStatus) {
+		status.Served++
+	})
+}
+
+// Failed records a request the worker died while handling it.
+func (s *workerStats) Failed(nodeType string) {
+	s.update(nodeType, func(status *workerStatus) {
+		status.Failures++
+	})
+}
+
+// Killed records the worker being killed because it stopped responding.
+func (s *workerStats) Killed(nodeType string) {
+	s.update(nodeType, func(status *workerStatus) {
+		status.Kills++
+	})
+}
+
+// Queued returns the number of requests waiting for the worker of the given
+// node type.
+func (s *workerStats) Queued(nodeType string) int {
+	var queued int
+	s.update(nodeType, func(status *workerStatus) {
+		queued = status.Queued
+	})
+	return queued
+}
+
+// Get returns a copy of the status of all workers, sorted by node type.
+func (s *workerStats) Get() []workerStatus {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := make([]workerStatus, 0, len(s.workers))
+	for _, status := range s.workers {
+		ret = append(ret, *status)
+	}
+	sort.Sort(workerStatusList(ret))
+	return ret
+}
+
+type workerStatusList []workerStatus
+
+// Len is the number of elements in the list.
+func (l workerStatusList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l workerStatusList) Less(i, j int) bool {
+	return l[i].NodeType < l[j].NodeType
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l workerStatusList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// siteStatus holds information about some site for the status page.
+type siteStatus struct {
+	Name, Title string
+	Hosts       []string
+	// Directories of the site.
+	Data, Templates string
+	// DataOK is true if the data directory is accessible.
+	DataOK bool
+	// ReadOnly is true if the site is in read-only mode.
+	ReadOnly bool
+	// Purge is true if changed nodes get purged from external caches.
+	Purge bool
+}
+
+// Status handles requests to show the status of the workers and the site.
+func (h *nodeHandler) Status(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if node.Path != "/" {
+		h.renderError(w, r, "Page not found.", http.StatusNotFound, node,
+			cSession, site)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		switch {
+		case !validCSRFRequest(r, session, r.Form.Get("CSRFToken")):
+		case len(r.Form.Get("ReplaySpooled")) > 0:
+			h.replaySpooled(r, r.Form.Get("ReplaySpooled"), cSession, site)
+		case len(r.Form.Get("RemoveSpooled")) > 0:
+			id := r.Form.Get("RemoveSpooled")
+			if err := removeSpooledRequest(site.Directories.Data, id); err != nil {
+				panic("Can't remove spooled request: " + err.Error())
+			}
+			h.requestLog(r, site.Name).Info(
+				"User %q removed spooled request %q", cSession.User.Login, id)
+		case len(r.Form.Get("RunTask")) > 0:
+			nodeType := r.Form.Get("RunTask")
+			if _, ok := h.schedules()[nodeType]; !ok {
+				panic("Unknown scheduled task: " + nodeType)
+			}
+			if h.TriggerTask(site.Name, nodeType) {
+				h.requestLog(r, site.Name).Info(
+					"User %q started the scheduled task of node type %q",
+					cSession.User.Login, nodeType)
+			}
+		case r.Form.Get("Snapshot") == "1":
+			h.requestLog(r, site.Name).Info("User %q started a snapshot",
+				cSession.User.Login)
+			go func() {
+				logger := h.SiteLog(site.Name)
+				if _, err := createSnapshot(site, time.Now(),
+					logger.Info); err != nil {
+					logger.Error("%v", err)
+				}
+			}()
+		case r.Form.Get("PurgeAll") == "1" && site.Purge.Enabled:
+			h.requestLog(r, site.Name).Info("User %q started purging the cache",
+				cSession.User.Login)
+			go func() {
+				logger := h.SiteLog(site.Name)
+				purged, err := purgeAll(site, logger.Warn)
+				if err != nil {
+					logger.Error("Could not purge the cache: %v", err)
+				}
+				logger.Info("Purged %v nodes from the cache", purged)
+			}()
+		case r.Form.Get("RebuildIndex") == "1":
+			if err := rebuildSearchIndex(site.Directories.Data); err != nil {
+				panic("Can't rebuild search index: " + err.Error())
+			}
+			h.requestLog(r, site.Name).Info("User %q rebuilt the search index",
+				cSession.User.Login)
+		default:
+			readOnly := r.Form.Get("ReadOnly") == "1"
+			h.Sites.SetReadOnly(site.Name, readOnly)
+			h.requestLog(r, site.Name).Info("User %q set read-only mode to %v",
+				cSession.User.Login, readOnly)
+		}
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		return
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	csrfToken := getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	var nodeTypes []nodeTypeSettings
+	for _, id := range h.NodeTypes() {
+		nodeTypes = append(nodeTypes, h.currentSettings().nodeType(id))
+	}
+	spool, err := listSpool(site.Directories.Data)
+	if err != nil {
+		h.requestLog(r, site.Name).Error("Could not list spool: %v", err)
+	}
+	snapshots, err := listSnapshots(site)
+	if err != nil {
+		h.requestLog(r, site.Name).Error("Could not list snapshots: %v", err)
+	}
+	_, err = os.Stat(site.Directories.Data)
+	var certificates []acmeCert
+	if h.Certificates != nil {
+		certificates = h.Certificates.ACME.Status(site.acmeHosts())
+	}
+	body := h.renderTemplate("daemon/actions/status", template.Context{
+		"Workers":      h.Stats.Get(),
+		"RateLimits":   h.RateLimiter.Stats(),
+		"Certificates": certificates,
+		"Spool":        spool,
+		"NodeTypes":    nodeTypes,
+		"Tasks":        h.Cron.Tasks(site.Name, h.schedules(), time.Now()),
+		"Snapshots":    snapshots,
+		"Actions":      h.actions().List(h.NodeTypes()),
+		"UsageURL":     site.URL("/@@usage"),
+		"CSRFToken":    csrfToken,
+		"Site": siteStatus{
+			Name:      site.Name,
+			Title:     site.Title,
+			Hosts:     site.Hosts,
+			Data:      site.Directories.Data,
+			Templates: site.Directories.Templates,
+			DataOK:    err == nil,
+			ReadOnly:  site.ReadOnly,
+			Purge:     site.Purge.Enabled}}, cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Status"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+// replaySpooled sends the spooled request with the given ID to the workers
+// and removes it from the spool if a worker handled it.
+//
+// Requests the user might not send anymore are kept in the spool.
+func (h *nodeHandler) replaySpooled(r *http.Request, id string,
+	cSession *client.Session, site site) {
+	req, err := readSpooledRequest(site.Directories.Data, id)
+	if err != nil {
+		panic("Can't read spooled request: " + err.Error())
+	}
+	ticket, err := replayTicket(*req, site)
+	if err != nil {
+		h.requestLog(r, site.Name).Error("Could not replay %q: %v", id, err)
+		return
+	}
+	if err := h.checkReplay(ticket, site); err != nil {
+		h.requestLog(r, site.Name).Warn("Refused to replay %q: %v", id, err)
+		return
+	}
+	if _, ok := h.nodeQueue(ticket.Node.Type); !ok {
+		h.requestLog(r, site.Name).Error(
+			"Could not replay %q: Missing queue for node type %q", id,
+			ticket.Node.Type)
+		return
+	}
+	if _, err := h.requestWorker(ticket, nil); err != nil {
+		h.Stats.Failed(ticket.Node.Type)
+		h.requestLog(r, site.Name).Error("Could not replay %q: %v", id, err)
+		return
+	}
+	h.Stats.Served(ticket.Node.Type)
+	if err := removeSpooledRequest(site.Directories.Data, id); err != nil {
+		panic("Can't remove spooled request: " + err.Error())
+	}
+	h.requestLog(r, site.Name).Info("User %q replayed spooled request %q",
+		cSession.User.Login, id)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWorkerStats(t *testing.T) {
+	stats := newWorkerStats()
+	stats.Started("Foo")
+	stats.Started("Bar")
+	stats.Queue("Foo", 1)
+	stats.Queue("Foo", 1)
+	stats.Queue("Foo", -1)
+	stats.Served("Foo")
+	if queued := stats.Queued("Foo"); queued != 1 {
+		t.Errorf(`Queued("Foo") = %v, should be 1`, queued)
+	}
+	stats.Killed("Bar")
+	stats.SetState("Bar", workerRestarting)
+	stats.Started("Bar")
+	stats.SetState("Bar", workerDead)
+	ret := stats.Get()
+	if len(ret) != 2 {
+		t.Fatalf("Get() returned %v entries, should be 2", len(ret))
+	}
+	bar, foo := ret[0], ret[1]
+	if foo.NodeType != "Foo" || foo.State != workerRunning || foo.Queued != 1 ||
+		foo.Served != 1 || foo.Restarts != 0 {
+		t.Errorf("Wrong status of Foo: %v", foo)
+	}
+	if bar.NodeType != "Bar" || bar.State != workerDead || bar.Restarts != 1 ||
+		bar.Kills != 1 || bar.Started.IsZero() {
+		t.Errorf("Wrong status of Bar: %v", bar)
+	}
+	var nilStats *workerStats
+	nilStats.Served("Foo")
+	if nilStats.Get() != nil {
+		t.Errorf("Get() on nil workerStats should return nil")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	"net/http"
+	"path"
+	"time"
+)
+
+// maxSubRequestDepth is the maximum number of nested sub-requests.
+const maxSubRequestDepth = 3
+
+// subRequestTimeout is the time to wait for the response to a sub-request.
+const subRequestTimeout = 5 * time.Second
+
+// errSubRequestDenied is returned if the user of the original request might
+// not view the requested node.
+var errSubRequestDenied = errors.New("Permission denied")
+
+// RenderNodeArgs are the arguments of RenderNode.
+type RenderNodeArgs struct {
+	// Path of the node to render.
+	Path string
+	// Action to request, e.g. comments. Empty for the node's view.
+	Action string
+}
+
+// checkSubRequest checks if a sub-request for the given action of the given
+// node might be issued by the request of the given ticket.
+//
+// Fails if the maximum depth would be exceeded, if the node is already
+// being rendered for the original request or if the worker of the node's
+// type is busy with one of the requests waiting for the sub-request.
+func checkSubRequest(parent *worker.Ticket, node client.Node,
+	action string) error {
+	depth := 0
+	for t := parent; t != nil; t = t.Parent {
+		if t.Node.Path == node.Path && t.Action == action {
+			return fmt.Errorf("Cycle detected: %q is already being rendered",
+				path.Join(node.Path, "@@"+action))
+		}
+		if t.Node.Type == node.Type {
+			return fmt.Errorf("The worker of node type %q is busy with the"+
+				" current request", node.Type)
+		}
+		depth++
+	}
+	if depth > maxSubRequestDepth {
+		return fmt.Errorf("Maximum depth of %v sub-requests exceeded",
+			maxSubRequestDepth)
+	}
+	return nil
+}
+
+// subRequest renders the given action of the node at the given path for the
+// request of the given ticket and returns the resulting body.
+//
+// The sub-request is issued with the session of the original request and
+// waits at most subRequestTimeout, or until the parent's deadline.
+func (h *nodeHandler) subRequest(parent *worker.Ticket, nodePath,
+	action string) ([]byte, error) {
+	site, ok := h.Sites.Get(parent.Site)
+	if !ok {
+		return nil, fmt.Errorf("Unknown site %q", parent.Site)
+	}
+	root := site.Directories.Data
+	node, err := lookupNode(root, path.Clean("/"+nodePath))
+	if err != nil {
+		return nil, fmt.Errorf("Could not find node %q: %v", nodePath, err)
+	}
+	if !newNodeAccess(root, parent.Roles).CanView(node.Path) {
+		return nil, errSubRequestDenied
+	}
+	// Sub-requests are passed to the workers directly, so actions handled by
+	// the daemon can't be requested.
+	actions := h.actions()
+	switch err := actions.Check(node.Type, action, parent.Roles,
+		site.Permissions); {
+	case err == errActionDenied:
+		return nil, errSubRequestDenied
+	case err != nil || actions.Lookup(node.Type, action) != actionWorker:
+		return nil, fmt.Errorf("Node type %q does not implement action %q",
+			node.Type, action)
+	}
+	if err := checkSubRequest(parent, node, action); err != nil {
+		return nil, err
+	}
+	if h.Protocols.Get(node.Type).State == handshakeRefused {
+		return nil, fmt.Errorf("The worker of node type %q refused the"+
+			" handshake", node.Type)
+	}
+	target := node.Path
+	if len(action) > 0 {
+		target = path.Join(target, "@@"+action)
+	}
+	r, err := http.NewRequest("GET", site.URL(target), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request: %v", err)
+	}
+	if parent.Request != nil {
+		r.Host = parent.Request.Host
+		r.RemoteAddr = parent.Request.RemoteAddr
+	}
+	ticket := worker.Ticket{
+		Site:      parent.Site,
+		Node:      node,
+		Request:   r,
+		Session:   parent.Session,
+		Roles:     parent.Roles,
+		Action:    action,
+		ClientIP:  parent.ClientIP,
+		Scheme:    parent.Scheme,
+		RequestID: parent.RequestID,
+		CSRFToken: parent.CSRFToken,
+		Deadline:  time.Now().Add(subRequestTimeout),
+		Parent:    parent,
+		// Forms of the sub-request use the parent's token.
+		CSRFTokenUsed: parent.CSRFTokenUsed}
+	if !parent.Deadline.IsZero() && parent.Deadline.Before(ticket.Deadline) {
+		ticket.Deadline = parent.Deadline
+	}
+	// Give up if the parent's response won't be used anymore.
+	gone := make(chan bool, 1)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-parent.Done:
+			gone <- true
+		case <-finished:
+		}
+	}()
+	res, err := h.requestWorker(ticket, gone)
+	switch {
+	case err == errWorkerDied:
+		h.Stats.Failed(node.Type)
+		return nil, err
+	case err != nil:
+		return nil, err
+	case len(res.Redirect) > 0:
+		return nil, fmt.Errorf("Node %q responded with a redirect", target)
+	}
+	h.Stats.Served(node.Type)
+	return res.Body, nil
+}
+
+// RenderNode renders the given action of another node for the current
+// request and returns the resulting body, e.g. to compose a page of the
+// bodies of several nodes.
+//
+// The sub-request is issued with the permissions of the current request's
+// user. Sub-requests may be nested up to maxSubRequestDepth times. They
+// fail for nodes of the worker's own type and for cycles.
+func (m *NodeRPC) RenderNode(args *RenderNodeArgs, reply *[]byte) error {
+	if m.SubRequest == nil {
+		return errors.New("monsti: Sub-requests are not supported")
+	}
+	ticket, err := m.ticket()
+	if err != nil {
+		return err
+	}
+	body, err := m.SubRequest(ticket, args.Path, args.Action)
+	if err != nil {
+		return fmt.Errorf("monsti: Could not render %q: %v", args.Path, err)
+	}
+	*reply = body
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"testing"
+)
+
+func TestCheckSubRequest(t *testing.T) {
+	page := &worker.Ticket{Node: client.Node{Path: "/", Type: "Page"}}
+	nested := &worker.Ticket{Node: client.Node{Path: "/a", Type: "A"},
+		Parent: page}
+	deep := &worker.Ticket{Node: client.Node{Path: "/c", Type: "C"},
+		Parent: &worker.Ticket{Node: client.Node{Path: "/b", Type: "B"},
+			Parent: nested}}
+	tests := []struct {
+		Parent *worker.Ticket
+		Node   client.Node
+		Action string
+		Valid  bool
+	}{
+		{page, client.Node{Path: "/a", Type: "A"}, "", true},
+		{page, client.Node{Path: "/b", Type: "Page"}, "", false},
+		{nested, client.Node{Path: "/", Type: "Page"}, "", false},
+		{nested, client.Node{Path: "/b", Type: "B"}, "comments", true},
+		{deep, client.Node{Path: "/d", Type: "D"}, "", false}}
+	for i, v := range tests {
+		err := checkSubRequest(v.Parent, v.Node, v.Action)
+		if (err == nil) != v.Valid {
+			t.Errorf("Test %v: checkSubRequest(...) = %v, should be valid: %v",
+				i, err, v.Valid)
+		}
+	}
+}
+
+func TestSubRequest(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":        `{"type": "Page", "title": "Home"}`,
+		"/news/node.yaml":   `{"type": "Document", "title": "News"}`,
+		"/secret/node.yaml": `{"type": "Document", "restrict": "login"}`,
+		"/other/node.yaml":  `{"type": "Page"}`}, "TestSubRequest")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+		if ticket.Parent == nil || ticket.Parent.Node.Path != "/" {
+			ticket.ResponseChan <- client.Response{Redirect: "/"}
+			return
+		}
+		ticket.ResponseChan <- client.Response{
+			Body: []byte(ticket.Node.Title + ticket.Action)}
+	})
+	defer stop()
+	site_, _ := h.Sites.Get("foo")
+	site_.Permissions = map[string]string{"comments": roleAnonymous}
+	h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+	parent := &worker.Ticket{Site: "foo",
+		Node:  client.Node{Path: "/", Type: "Page"},
+		Roles: []string{roleAnonymous}}
+	tests := []struct {
+		Path, Action, Body string
+		Valid              bool
+	}{
+		{"/news", "", "News", true},
+		{"/news/", "comments", "Newscomments", true},
+		{"/news", "edit", "", false},
+		{"/secret", "", "", false},
+		{"/missing", "", "", false},
+		{"/other", "", "", false}}
+	for i, v := range tests {
+		body, err := h.subRequest(parent, v.Path, v.Action)
+		if (err == nil) != v.Valid || string(body) != v.Body {
+			t.Errorf("Test %v: subRequest(..., %q, %q) = %q, %v, should be %q,"+
+				" valid: %v", i, v.Path, v.Action, body, err, v.Body, v.Valid)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/monsti/util/template"
+	"os"
+	"path/filepath"
+)
+
+// templateSearchPath returns the files which will be searched for the
+// template with the given name, in the order of precedence.
+//
+// Templates in the site's template directory override the ones of the shared
+// template directory.
+func templateSearchPath(name, siteDir, sharedDir string) []string {
+	var files []string
+	for _, dir := range []string{siteDir, sharedDir} {
+		if len(dir) > 0 {
+			files = append(files, filepath.Join(dir, name+".html"))
+		}
+	}
+	return files
+}
+
+// templateFile returns the file used for the template with the given name,
+// or "none" if there is none.
+func templateFile(name, siteDir, sharedDir string) string {
+	for _, file := range templateSearchPath(name, siteDir, sharedDir) {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return "none"
+}
+
+// renderTemplate renders the template with the given name for the given site,
+// looking it up in the site's template directory before the shared one.
+func (h *nodeHandler) renderTemplate(name string, context template.Context,
+	locale string, site site) string {
+	if log := h.SiteLog(site.Name); log != nil && log.Level <= levelDebug {
+		files := templateSearchPath(name, site.Directories.Templates,
+			h.Renderer.Root)
+		log.Debug("Template %q: search order %v, using %v", name, files,
+			templateFile(name, site.Directories.Templates, h.Renderer.Root))
+	}
+	if _, ok := context["Embed"]; !ok {
+		// Action templates don't know the request's roles, so they may only
+		// embed nodes viewable by anyone.
+		embed := newEmbedder(site.Directories.Data,
+			newNodeAccess(site.Directories.Data, nil), locale, "")
+		embed.Assets = newAssetResolver(h.currentSettings(), site)
+		context["Embed"] = embed
+	}
+	return h.Renderer.Render(name, context, locale, site.Directories.Templates)
+}
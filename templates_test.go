@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/template"
+	utesting "github.com/monsti/util/testing"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateSearchPath(t *testing.T) {
+	tests := []struct {
+		Name, SiteDir, SharedDir string
+		Files                    []string
+	}{
+		{"master", "/site", "/shared", []string{"/site/master.html",
+			"/shared/master.html"}},
+		{"daemon/actions/addform", "", "/shared",
+			[]string{"/shared/daemon/actions/addform.html"}}}
+	for _, v := range tests {
+		ret := templateSearchPath(v.Name, v.SiteDir, v.SharedDir)
+		if strings.Join(ret, ",") != strings.Join(v.Files, ",") {
+			t.Errorf("templateSearchPath(%q, %q, %q) = %v, should be %v", v.Name,
+				v.SiteDir, v.SharedDir, ret, v.Files)
+		}
+	}
+}
+
+func TestRenderTemplateOverride(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/__empty__":                             "",
+		"/shared/master.html":                         "master|{{.Page.Content}}",
+		"/shared/daemon/actions/addform.html":         "shared addform",
+		"/shared/daemon/actions/removeform.html":      "shared removeform",
+		"/site/templates/daemon/actions/addform.html": "site addform"},
+		"TestRenderTemplateOverride")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var buf bytes.Buffer
+	h := nodeHandler{
+		Renderer: &templateRenderer{Root: filepath.Join(root, "shared")},
+		Settings: new(settings),
+		Log:      newLeveledLogger(log.New(&buf, "", 0), levelDebug)}
+	site := site{}
+	site.Directories.Data = filepath.Join(root, "data")
+	site.Directories.Templates = filepath.Join(root, "site", "templates")
+	tests := []struct {
+		Name, Rendered string
+	}{
+		{"daemon/actions/addform", "master|site addform"},
+		{"daemon/actions/removeform", "master|shared removeform"}}
+	for _, v := range tests {
+		body := h.renderTemplate(v.Name, template.Context{}, "", site)
+		ret := renderInMaster(h.Renderer, []byte(body),
+			masterTmplEnv{Node: client.Node{Path: "/"}}, h.Settings, site, "")
+		if ret != v.Rendered {
+			t.Errorf("Rendering %q returned %q, should be %q", v.Name, ret,
+				v.Rendered)
+		}
+	}
+	if !strings.Contains(buf.String(), filepath.Join(root, "site", "templates",
+		"daemon", "actions", "addform.html")) {
+		t.Errorf("Search order should be logged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"github.com/monsti/util"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// themeManifestFile is the name of the optional theme manifest in a
+// templates directory.
+const themeManifestFile = "theme.yaml"
+
+// themeVersion is the version of the master template context provided by
+// the daemon. Themes requiring a newer version will be rejected.
+const themeVersion = 1
+
+// Navigations computed for the master template.
+const (
+	// themeNavFull computes the primary and the secondary navigation.
+	themeNavFull = "full"
+	// themeNavPrimary only computes the primary navigation.
+	themeNavPrimary = "primary"
+	// themeNavNone computes no navigation at all.
+	themeNavNone = "none"
+)
+
+// themeManifest declares which parts of the master template context a
+// theme needs. Parts which are not needed won't be computed.
+//
+// Without manifest, everything but the breadcrumbs will be computed.
+type themeManifest struct {
+	// Name identifies the theme in error messages. Defaults to the
+	// templates directory.
+	Name string
+	// Version is the version of the master template context the theme has
+	// been written for. Defaults to the current version.
+	Version int
+	// Navigation is one of full (default), primary and none.
+	Navigation string
+	// Breadcrumbs computes the links to the ancestors of the node.
+	Breadcrumbs bool
+	// Regions lists the regions used by the theme. Defaults to all regions
+	// of the site.
+	Regions []string
+	// DisableTranslations omits the locales of the node's translations.
+	DisableTranslations bool
+	// NavigationFields loads the custom fields of the nodes linked by the
+	// navigations and breadcrumbs.
+	NavigationFields bool
+}
+
+// loadThemeManifest loads the manifest of the templates directory located
+// at dir. Returns nil if there is none.
+func loadThemeManifest(dir string) (*themeManifest, error) {
+	file := filepath.Join(dir, themeManifestFile)
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not load theme manifest: %v", err)
+	}
+	manifest := new(themeManifest)
+	if err := util.ParseYAML(file, manifest); err != nil {
+		return nil, fmt.Errorf("Could not load theme manifest %v: %v", file,
+			err)
+	}
+	if len(manifest.Name) == 0 {
+		manifest.Name = dir
+	}
+	if manifest.Version == 0 {
+		manifest.Version = themeVersion
+	}
+	if len(manifest.Navigation) == 0 {
+		manifest.Navigation = themeNavFull
+	}
+	return manifest, nil
+}
+
+// check validates the manifest against the given regions of a site.
+func (m *themeManifest) check(regions []region) error {
+	if m.Version < 0 || m.Version > themeVersion {
+		return fmt.Errorf("Theme %q requires version %v, supported is %v",
+			m.Name, m.Version, themeVersion)
+	}
+	switch m.Navigation {
+	case themeNavFull, themeNavPrimary, themeNavNone:
+	default:
+		return fmt.Errorf("Theme %q has unknown navigation %q", m.Name,
+			m.Navigation)
+	}
+	for _, name := range m.Regions {
+		found := false
+		for _, reg := range regions {
+			found = found || reg.Name == name
+		}
+		if !found {
+			return fmt.Errorf("Theme %q uses unknown region %q", m.Name, name)
+		}
+	}
+	return nil
+}
+
+// siteThemeManifest loads the manifest of the given site's theme, i.e. of
+// the site's templates directory or, if it has none, of the shared one.
+// Returns nil if there is none.
+func siteThemeManifest(site site, sharedTemplates string) (*themeManifest,
+	error) {
+	for _, dir := range []string{site.Directories.Templates,
+		sharedTemplates} {
+		if len(dir) == 0 {
+			continue
+		}
+		manifest, err := loadThemeManifest(dir)
+		if err != nil || manifest != nil {
+			if err == nil {
+				err = manifest.check(siteRegions(site))
+			}
+			return manifest, err
+		}
+	}
+	return nil, nil
+}
+
+// navigation returns the navigations to compute. m may be nil.
+func (m *themeManifest) navigation() string {
+	if m == nil {
+		return themeNavFull
+	}
+	return m.Navigation
+}
+
+// regions returns the regions of the given site used by the theme. m may
+// be nil.
+func (m *themeManifest) regions(site site) []region {
+	regions := siteRegions(site)
+	if m == nil || m.Regions == nil {
+		return regions
+	}
+	var ret []region
+	for _, reg := range regions {
+		if inStringSlice(reg.Name, m.Regions) {
+			ret = append(ret, reg)
+		}
+	}
+	return ret
+}
+
+// getBreadcrumbs returns links to the ancestors of the node at the given
+// path, starting with the root node. Targets are absolute node paths with
+// trailing slash. Ancestors the user may not view will be omitted.
+func getBreadcrumbs(root, nodePath string, access *nodeAccess,
+	locale string) navigation {
+	var ret navigation
+	for nodePath != "/" && nodePath != "." {
+		nodePath = path.Dir(nodePath)
+		node, err := lookupNode(root, nodePath)
+		if err != nil || !access.CanView(node.Path) {
+			continue
+		}
+		node, translation := translateNode(root, node, locale)
+		target := nodePath
+		if target != "/" {
+			target += "/"
+		}
+		ret = append(navigation{navLink{Name: getShortTitle(node),
+			Target: target, Locale: translation}}, ret...)
+	}
+	return ret
+}
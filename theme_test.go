@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSiteThemeManifest(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/shared/theme.yaml":        `{"name": "Shared", "regions": ["footer"]}`,
+		"/none/master.html":         "",
+		"/full/theme.yaml":          `{}`,
+		"/newer/theme.yaml":         `{"name": "Newer", "version": 99}`,
+		"/unknownnav/theme.yaml":    `{"name": "Nav", "navigation": "deep"}`,
+		"/unknownregion/theme.yaml": `{"name": "Region", "regions": ["foo"]}`,
+		"/primary/theme.yaml":       `{"navigation": "primary"}`,
+		"/customregions/theme.yaml": `{"regions": ["left"]}`,
+		"/invalid/theme.yaml":       `{"regions": "footer"`},
+		"TestSiteThemeManifest")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Templates, Shared string
+		Regions           []region
+		Name, Navigation  string
+		Error             string
+	}{
+		{"none", "", nil, "", "", ""},
+		{"none", "shared", nil, "Shared", themeNavFull, ""},
+		{"full", "shared", nil, "full", themeNavFull, ""},
+		{"primary", "", nil, "primary", themeNavPrimary, ""},
+		{"newer", "", nil, "", "", `Theme "Newer" requires version 99`},
+		{"unknownnav", "", nil, "", "", `Theme "Nav" has unknown navigation`},
+		{"unknownregion", "", nil, "", "",
+			`Theme "Region" uses unknown region "foo"`},
+		{"customregions", "", nil, "", "", `uses unknown region "left"`},
+		{"customregions", "", []region{{Name: "left"}}, "customregions",
+			themeNavFull, ""},
+		{"invalid", "", nil, "", "", "Could not load theme manifest"}}
+	for i, v := range tests {
+		site_ := site{Regions: v.Regions}
+		site_.Directories.Templates = filepath.Join(root, v.Templates)
+		shared := ""
+		if len(v.Shared) > 0 {
+			shared = filepath.Join(root, v.Shared)
+		}
+		theme, err := siteThemeManifest(site_, shared)
+		if len(v.Error) > 0 {
+			if err == nil || !strings.Contains(err.Error(), v.Error) {
+				t.Errorf("Test %v: siteThemeManifest(...) returned error %v, "+
+					"should contain %q", i, err, v.Error)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %v: siteThemeManifest(...) failed: %v", i, err)
+			continue
+		}
+		if len(v.Name) == 0 {
+			if theme != nil {
+				t.Errorf("Test %v: siteThemeManifest(...) returned %v, should "+
+					"be nil", i, theme)
+			}
+			continue
+		}
+		if theme == nil || filepath.Base(theme.Name) != v.Name ||
+			theme.navigation() != v.Navigation ||
+			theme.Version != themeVersion {
+			t.Errorf("Test %v: siteThemeManifest(...) returned %+v", i, theme)
+		}
+	}
+}
+
+func TestRenderInMasterTheme(t *testing.T) {
+	masterTmpl := `{{range .Page.Breadcrumbs}}>{{.Target}}|{{.Name}}{{end}}
+{{range .Page.PrimaryNav}}#{{.Target}}{{end}}
+{{range .Page.SecondaryNav}}#{{.Target}}{{end}}
+{{range $name, $_ := .Page.Regions}}@{{$name}}{{end}}
+{{range .Page.Translations}}~{{.}}{{end}}`
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":            `{"title": "Home"}`,
+		"/data/footer.html":          "Footer",
+		"/data/sidebar.html":         "Sidebar",
+		"/data/foo/node.yaml":        `{"title": "Foo"}`,
+		"/data/foo/bar/node.yaml":    `{"title": "Bar"}`,
+		"/data/foo/bar/node.de.yaml": `{"title": "Bar"}`,
+		"/templates/master.html":     masterTmpl}, "TestRenderInMasterTheme")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	r := &templateRenderer{Root: filepath.Join(root, "templates")}
+	tests := []struct {
+		Theme    *themeManifest
+		Rendered string
+	}{
+		{nil, "\n#/foo/\n#/foo/#/foo/bar/\n@footer@sidebar\n~de"},
+		{&themeManifest{Navigation: themeNavFull, Breadcrumbs: true,
+			DisableTranslations: true},
+			">/base/|Home>/base/foo/|Foo\n#/base/foo/\n" +
+				"#/base/foo/#/base/foo/bar/\n@footer@sidebar\n"},
+		{&themeManifest{Navigation: themeNavPrimary, Regions: []string{}},
+			"\n#/foo/\n\n\n~de"},
+		{&themeManifest{Navigation: themeNavNone, Regions: []string{"footer"}},
+			"\n\n\n@footer\n~de"}}
+	for i, v := range tests {
+		site_ := site{Theme: v.Theme}
+		site_.Directories.Data = filepath.Join(root, "data")
+		if v.Theme != nil && v.Theme.Breadcrumbs {
+			site_.BasePath = "/base"
+		}
+		ret := renderInMaster(r, nil, masterTmplEnv{
+			Node: client.Node{Title: "Bar", Path: "/foo/bar"}}, new(settings),
+			site_, "")
+		if ret != v.Rendered {
+			t.Errorf("Test %v: renderInMaster(...) returned %q, should be %q", i,
+				ret, v.Rendered)
+		}
+	}
+}
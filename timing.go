@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Phases of request handling measured by requestTimer.
+const (
+	phaseSession = iota
+	phaseLookup
+	phaseQueue
+	phaseWorker
+	phaseRender
+	phaseWrite
+	numPhases
+)
+
+// phaseNames are the names of the phases as used in logs and the
+// Server-Timing header.
+var phaseNames = [numPhases]string{"session", "lookup", "queue", "worker",
+	"render", "write"}
+
+// timingQueryFlag is the query parameter making requests of admins return
+// their phase durations in the Server-Timing header.
+const timingQueryFlag = "debug-timing"
+
+// requestTimer records the durations of the phases of a request.
+//
+// All methods may be called on a nil requestTimer, which does nothing.
+type requestTimer struct {
+	Start  time.Time
+	Phases [numPhases]time.Duration
+	// Site, Action and NodeType describe the request in the log.
+	Site, Action, NodeType string
+	// Debug is true if the durations should be sent in the Server-Timing
+	// header.
+	Debug bool
+}
+
+// startTimer starts the timer of the given request if slow requests should
+// be logged or the request might ask for its timing. Returns nil
+// otherwise.
+func startTimer(r *http.Request, threshold time.Duration,
+	start time.Time) *requestTimer {
+	if threshold <= 0 && !strings.Contains(r.URL.RawQuery, timingQueryFlag) {
+		return nil
+	}
+	return newRequestTimer(r, start)
+}
+
+// newRequestTimer starts the timer of the given request.
+func newRequestTimer(r *http.Request, start time.Time) *requestTimer {
+	timer := &requestTimer{Start: start}
+	context.Set(r, requestTimerKey, timer)
+	return timer
+}
+
+// getRequestTimer returns the timer of the given request or nil.
+func getRequestTimer(r *http.Request) *requestTimer {
+	timer, _ := context.Get(r, requestTimerKey).(*requestTimer)
+	return timer
+}
+
+// Now returns the current time, or the zero time if t is nil.
+func (t *requestTimer) Now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// End adds the time since start to the given phase.
+func (t *requestTimer) End(phase int, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.Phases[phase] += time.Since(start)
+}
+
+// Describe sets the site, action and node type of the request.
+func (t *requestTimer) Describe(siteName, action, nodeType string) {
+	if t == nil {
+		return
+	}
+	t.Site, t.Action, t.NodeType = siteName, action, nodeType
+}
+
+// EnableDebug makes the timer send the durations in the Server-Timing
+// header if the request asked for it and the user is an admin.
+func (t *requestTimer) EnableDebug(r *http.Request, roles []string) {
+	if t == nil || !hasRole(roles, roleAdmin) {
+		return
+	}
+	t.Debug = r.URL.Query().Get(timingQueryFlag) == "1"
+}
+
+// SetHeader sets the Server-Timing header of the given response if
+// debugging is enabled. Durations are in milliseconds. Phases which have
+// not been completed yet, like the write phase, are missing.
+func (t *requestTimer) SetHeader(w http.ResponseWriter) {
+	if t == nil || !t.Debug {
+		return
+	}
+	var buf bytes.Buffer
+	for phase, duration := range t.Phases {
+		if duration > 0 {
+			fmt.Fprintf(&buf, "%v;dur=%.3f, ", phaseNames[phase],
+				duration.Seconds()*1000)
+		}
+	}
+	fmt.Fprintf(&buf, "total;dur=%.3f",
+		time.Since(t.Start).Seconds()*1000)
+	w.Header().Set("Server-Timing", buf.String())
+}
+
+// String returns the timing as single line of key=value pairs.
+func (t *requestTimer) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "total=%v", time.Since(t.Start))
+	for phase, duration := range t.Phases {
+		fmt.Fprintf(&buf, " %v=%v", phaseNames[phase], duration)
+	}
+	fmt.Fprintf(&buf, " site=%q action=%q type=%q", t.Site, t.Action,
+		t.NodeType)
+	return buf.String()
+}
+
+// logSlowRequest logs the timing of the given request if it took at least
+// the given threshold.
+func (h *nodeHandler) logSlowRequest(r *http.Request, timer *requestTimer,
+	threshold time.Duration) {
+	if timer == nil || threshold <= 0 || time.Since(timer.Start) < threshold {
+		return
+	}
+	h.requestLog(r, timer.Site).Warn("Slow request %v %v: %v", r.Method,
+		r.URL.Path, timer)
+}
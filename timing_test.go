@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimerDebug(t *testing.T) {
+	tests := []struct {
+		Query  string
+		Roles  []string
+		Header bool
+	}{
+		{"debug-timing=1", []string{roleAdmin}, true},
+		{"debug-timing=1", []string{"editor"}, false},
+		{"debug-timing=1", nil, false},
+		{"debug-timing=0", []string{roleAdmin}, false},
+		{"", []string{roleAdmin}, false}}
+	for i, v := range tests {
+		r, _ := http.NewRequest("GET", "http://example.com/foo/?"+v.Query, nil)
+		timer := &requestTimer{Start: time.Now()}
+		timer.End(phaseLookup, time.Now().Add(-2*time.Millisecond))
+		timer.EnableDebug(r, v.Roles)
+		w := httptest.NewRecorder()
+		timer.SetHeader(w)
+		header := w.Header().Get("Server-Timing")
+		if v.Header != (len(header) > 0) {
+			t.Errorf("Test %v: Server-Timing header is %q", i, header)
+		}
+		if v.Header && (!strings.HasPrefix(header, "lookup;dur=2.") ||
+			strings.Contains(header, "session") ||
+			!strings.Contains(header, ", total;dur=")) {
+			t.Errorf("Test %v: Server-Timing header is %q", i, header)
+		}
+	}
+	var nilTimer *requestTimer
+	nilTimer.End(phaseSession, nilTimer.Now())
+	nilTimer.Describe("foo", "", "Document")
+	nilTimer.SetHeader(httptest.NewRecorder())
+}
+
+func TestStartTimer(t *testing.T) {
+	tests := []struct {
+		Query     string
+		Threshold time.Duration
+		Timed     bool
+	}{
+		{"", 0, false},
+		{"foo=bar", 0, false},
+		{"debug-timing=1", 0, true},
+		{"", time.Second, true}}
+	for i, v := range tests {
+		r, _ := http.NewRequest("GET", "http://example.com/foo/?"+v.Query, nil)
+		timer := startTimer(r, v.Threshold, time.Now())
+		if (timer != nil) != v.Timed || getRequestTimer(r) != timer {
+			t.Errorf("Test %v: startTimer(...) returned %v", i, timer)
+		}
+	}
+}
+
+func TestSlowRequest(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestSlowRequest")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+		time.Sleep(10 * time.Millisecond)
+		close(ticket.Received)
+		time.Sleep(20 * time.Millisecond)
+		ticket.ResponseChan <- client.Response{Body: []byte("Foo"), Raw: true}
+	})
+	defer stop()
+	serve := func(threshold int, query string) *httptest.ResponseRecorder {
+		logBuf.Reset()
+		h.Settings.SlowRequestMillis = threshold
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://example.com/foo/"+query, nil)
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Got status %v, should be %v", w.Code, http.StatusOK)
+		}
+		return w
+	}
+	serve(5, "")
+	logged := logBuf.String()
+	for _, part := range []string{"Slow request GET /foo/", `site="foo"`,
+		`type="Document"`, "queue=1", "worker=2", "write="} {
+		if !strings.Contains(logged, part) {
+			t.Errorf("Log should contain %q, got %q", part, logged)
+		}
+	}
+	serve(1000, "")
+	if logged := logBuf.String(); strings.Contains(logged, "Slow request") {
+		t.Errorf("Fast request has been logged: %q", logged)
+	}
+	w := serve(0, "?debug-timing=1")
+	if header := w.Header().Get("Server-Timing"); len(header) > 0 {
+		t.Errorf("Anonymous users got the Server-Timing header %q", header)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// certStore holds the TLS certificates of the sites and selects them by the
+// server name requested by clients.
+type certStore struct {
+	mutex sync.RWMutex
+	// certs maps host names, possibly wildcards, to certificates.
+	certs map[string]*tls.Certificate
+	// defaultCert is used for clients not sending a known server name.
+	defaultCert *tls.Certificate
+	// ACME obtains the certificates of hosts without certificate files. May
+	// be nil.
+	ACME *acmeManager
+}
+
+// Load (re)loads the certificates of the given sites and updates the hosts
+// of the ACME manager.
+//
+// If the certificate of some site can't be loaded, its previous certificate
+// will be kept, if any. Returns the errors of all failed sites.
+func (s *certStore) Load(sites map[string]site, defaultSite string) []error {
+	if s.ACME != nil {
+		s.ACME.SetHosts(sites)
+	}
+	var errs []error
+	certs := make(map[string]*tls.Certificate)
+	var defaultCert *tls.Certificate
+	for name, site := range sites {
+		if len(site.TLS.Certificate) == 0 {
+			continue
+		}
+		hosts := append([]string{}, site.Hosts...)
+		hosts = append(hosts, site.Aliases...)
+		if len(site.CanonicalHost) > 0 {
+			hosts = append(hosts, site.CanonicalHost)
+		}
+		var cert *tls.Certificate
+		pair, err := tls.LoadX509KeyPair(site.TLS.Certificate, site.TLS.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(
+				"Could not load certificate of site %q: %v", name, err))
+			s.mutex.RLock()
+			for _, host := range hosts {
+				if cert = s.certs[strings.ToLower(stripPort(host))]; cert != nil {
+					break
+				}
+			}
+			s.mutex.RUnlock()
+			if cert == nil {
+				continue
+			}
+		} else {
+			cert = &pair
+		}
+		for _, host := range hosts {
+			certs[strings.ToLower(stripPort(host))] = cert
+		}
+		if name == defaultSite {
+			defaultCert = cert
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certs = certs
+	s.defaultCert = defaultCert
+	return errs
+}
+
+// GetCertificate returns the certificate for the server name requested by
+// the client. To be used as tls.Config.GetCertificate.
+//
+// Certificate files take precedence over ACME.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	s.mutex.RLock()
+	cert, ok := s.certs[name]
+	if i := strings.Index(name, "."); !ok && i != -1 {
+		cert, ok = s.certs["*"+name[i:]]
+	}
+	defaultCert := s.defaultCert
+	s.mutex.RUnlock()
+	if ok {
+		return cert, nil
+	}
+	if s.ACME != nil && s.ACME.Allowed(name) {
+		return s.ACME.GetCertificate(hello)
+	}
+	if defaultCert != nil {
+		return defaultCert, nil
+	}
+	return nil, fmt.Errorf("No certificate for server name %q", name)
+}
+
+// httpsRedirector is a http.Handler which redirects all requests to HTTPS.
+type httpsRedirector struct {
+	// Port of the TLS listener. May be empty for the default port.
+	Port string
+	// Handler serves requests which should not be redirected, i.e. health
+	// checks, and provides the sites whose hosts may be redirected to.
+	Handler *nodeHandler
+}
+
+// ServeHTTP redirects the request to the same URL using HTTPS.
+func (h httpsRedirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Handler != nil && r.URL.Path == h.Handler.healthCheckPath() {
+		h.Handler.ServeHealth(w, r)
+		return
+	}
+	host := r.Host
+	if h.Handler != nil {
+		// Only redirect to hosts of the sites. Unknown hosts get redirected to
+		// the default site's host, if any.
+		site, ok := h.Handler.Sites.Lookup(host)
+		if ok && !site.hasHost(host) {
+			host = site.host()
+		}
+		if !ok || len(host) == 0 || strings.HasPrefix(host, "*.") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	host = stripPort(host)
+	if len(h.Port) > 0 && h.Port != "443" {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), h.Port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(),
+		http.StatusMovedPermanently)
+}
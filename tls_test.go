@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for the given common
+// name and its key to the given directory.
+func writeTestCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCertStore")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	foo, bar, broken := site{Hosts: []string{"foo.example.com:8080"},
+		Aliases: []string{"*.foo.example.com"}},
+		site{Hosts: []string{"bar.example.com"}},
+		site{Hosts: []string{"broken.example.com"}}
+	foo.TLS.Certificate, foo.TLS.Key = writeTestCertificate(t, dir, "foo")
+	bar.TLS.Certificate, bar.TLS.Key = writeTestCertificate(t, dir, "bar")
+	broken.TLS.Certificate = filepath.Join(dir, "missing.crt")
+	broken.TLS.Key = filepath.Join(dir, "missing.key")
+	store := certStore{}
+	errs := store.Load(map[string]site{"foo": foo, "bar": bar,
+		"broken": broken}, "")
+	if len(errs) != 1 {
+		t.Errorf("Load should fail for one site, got errors %v", errs)
+	}
+	tests := []struct {
+		ServerName, CommonName string
+	}{
+		{"foo.example.com", "foo"},
+		{"www.foo.example.com", "foo"},
+		{"BAR.example.com", "bar"},
+		{"broken.example.com", ""},
+		{"unknown.example.com", ""},
+		{"", ""}}
+	for i, v := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{
+			ServerName: v.ServerName})
+		if len(v.CommonName) == 0 {
+			if err == nil {
+				t.Errorf("Test %v: GetCertificate(%q) should fail", i, v.ServerName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %v: GetCertificate(%q) failed: %v", i, v.ServerName,
+				err)
+			continue
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil || parsed.Subject.CommonName != v.CommonName {
+			t.Errorf("Test %v: GetCertificate(%q) returned wrong certificate",
+				i, v.ServerName)
+		}
+	}
+	os.Remove(bar.TLS.Certificate)
+	if errs := store.Load(map[string]site{"foo": foo, "bar": bar}, "foo"); len(errs) != 1 {
+		t.Errorf("Reload should fail for one site, got errors %v", errs)
+	}
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{
+		ServerName: "bar.example.com"}); err != nil {
+		t.Errorf("Previous certificate should be kept on failed reload: %v", err)
+	}
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{}); err != nil {
+		t.Errorf("Default certificate should be used without server name: %v",
+			err)
+	}
+}
+
+func TestHTTPSRedirector(t *testing.T) {
+	tests := []struct {
+		Port, URL, Location string
+	}{
+		{"443", "http://example.com/foo/?a=b", "https://example.com/foo/?a=b"},
+		{"", "http://example.com:80/@@login", "https://example.com/@@login"},
+		{"8443", "http://example.com:8080/", "https://example.com:8443/"},
+		{"8443", "http://[::1]:8080/", "https://[::1]:8443/"}}
+	for i, v := range tests {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", v.URL, nil)
+		httpsRedirector{Port: v.Port}.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently ||
+			w.HeaderMap.Get("Location") != v.Location {
+			t.Errorf("Test %v: Got %v to %q, should be %v to %q", i, w.Code,
+				w.HeaderMap.Get("Location"), http.StatusMovedPermanently,
+				v.Location)
+		}
+	}
+}
+
+func TestHTTPSRedirectorHosts(t *testing.T) {
+	h := httpsRedirector{Handler: &nodeHandler{Settings: &settings{},
+		Sites: newSiteRegistry(map[string]site{
+			"foo": {Hosts: []string{"foo.example.com", "*.foo.example.com"},
+				Aliases: []string{"foo.example.org"}},
+			"bar": {Hosts: []string{"*.bar.example.com"}}}, "foo")}}
+	tests := []struct {
+		URL, Location string
+	}{
+		{"http://foo.example.com/a", "https://foo.example.com/a"},
+		{"http://www.foo.example.com/a", "https://www.foo.example.com/a"},
+		{"http://foo.example.org/a", "https://foo.example.org/a"},
+		{"http://www.bar.example.com/a", "https://www.bar.example.com/a"},
+		// Unknown hosts must not be redirected to.
+		{"http://evil.example.com/a", "https://foo.example.com/a"}}
+	for i, v := range tests {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", v.URL, nil)
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently ||
+			w.HeaderMap.Get("Location") != v.Location {
+			t.Errorf("Test %v: Got %v to %q, should be %v to %q", i, w.Code,
+				w.HeaderMap.Get("Location"), http.StatusMovedPermanently,
+				v.Location)
+		}
+	}
+	h.Handler.Sites.Set(map[string]site{
+		"bar": {Hosts: []string{"*.bar.example.com"}}}, "bar")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://evil.example.com/a", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got %v for unknown host without default host, should be %v",
+			w.Code, http.StatusNotFound)
+	}
+}
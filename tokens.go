@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gorilla/context"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenScopes maps the scopes of API tokens to the roles granted by them.
+var tokenScopes = map[string]string{
+	"read":  roleReader,
+	"write": roleEditor,
+	"admin": roleAdmin}
+
+// tokenDeniedActions are the actions which can't be performed using API
+// tokens as they manage accounts or sessions.
+var tokenDeniedActions = map[string]bool{
+	"login":          true,
+	"logout":         true,
+	"reset-password": true,
+	"setup-2fa":      true,
+	"set-locale":     true,
+	"tokens":         true}
+
+// tokenSiteActions are the actions which manage or expose the whole site
+// regardless of the requested node. They can only be performed using tokens
+// restricted to the root node.
+var tokenSiteActions = map[string]bool{
+	"aliases":       true,
+	"audit":         true,
+	"import":        true,
+	"recent":        true,
+	"search":        true,
+	"status":        true,
+	"usage":         true,
+	"users":         true,
+	"users/add":     true,
+	"users/disable": true,
+	"users/edit":    true,
+	"users/enable":  true}
+
+// apiToken is an API token as stored in the tokens.yaml file.
+type apiToken struct {
+	// Name identifies the token, e.g. in logs.
+	Name string
+	// Hash of the token's secret.
+	Hash string
+	// Path is the node path the token is restricted to, including the
+	// node's descendants.
+	Path string
+	// Scope is read, write or admin, see tokenScopes.
+	Scope string
+	// Creator is the login of the user who created the token.
+	Creator string
+	// Created is the Unix time the token has been created.
+	Created int64
+}
+
+// Login returns the login used for the token's requests, e.g. in the audit
+// log.
+func (t *apiToken) Login() string {
+	return "token:" + t.Name
+}
+
+// Covers returns true if the token might be used for the node at the given
+// path.
+func (t *apiToken) Covers(nodePath string) bool {
+	prefix := strings.TrimSuffix(path.Clean("/"+t.Path), "/") + "/"
+	return strings.HasPrefix(path.Clean(nodePath)+"/", prefix)
+}
+
+// SiteWide returns true if the token is restricted to the root node, i.e.
+// might be used for the whole site.
+func (t *apiToken) SiteWide() bool {
+	return path.Clean("/"+t.Path) == "/"
+}
+
+// Session returns the client session of the token's requests.
+func (t *apiToken) Session(locale string) *client.Session {
+	return &client.Session{User: &client.User{Login: t.Login(), Name: t.Name},
+		Locale: locale}
+}
+
+// Roles returns the roles granted by the token.
+func (t *apiToken) Roles() []string {
+	role, ok := tokenScopes[t.Scope]
+	if !ok {
+		return nil
+	}
+	return []string{role}
+}
+
+// loadTokens returns the API tokens of the site with the given configuration
+// directory.
+func loadTokens(configDir string) ([]apiToken, error) {
+	content, err := ioutil.ReadFile(filepath.Join(configDir, "tokens.yaml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not load tokens.yaml: %v", err)
+	}
+	var tokens []apiToken
+	if err = goyaml.Unmarshal(content, &tokens); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal tokens.yaml: %v", err)
+	}
+	return tokens, nil
+}
+
+// tokensLocks maps configuration directories to the locks of their tokens
+// files.
+var tokensLocks = make(map[string]*sync.Mutex)
+
+// tokensLocksMutex protects tokensLocks.
+var tokensLocksMutex sync.Mutex
+
+// lockTokens locks the API tokens of the site with the given configuration
+// directory until the returned function has been called.
+//
+// Changes of tokens must hold the lock from loading to saving the tokens so
+// that concurrent changes don't get lost, e.g. a revoked token coming back.
+func lockTokens(configDir string) func() {
+	tokensLocksMutex.Lock()
+	lock, ok := tokensLocks[configDir]
+	if !ok {
+		lock = new(sync.Mutex)
+		tokensLocks[configDir] = lock
+	}
+	tokensLocksMutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// saveTokens atomically replaces the API tokens of the site with the given
+// configuration directory.
+func saveTokens(configDir string, tokens []apiToken) error {
+	content, err := goyaml.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("Could not marshal tokens: %v", err)
+	}
+	file := filepath.Join(configDir, "tokens.yaml")
+	if err := writeFileAtomic(file, content, 0600); err != nil {
+		return fmt.Errorf("Could not write tokens.yaml: %v", err)
+	}
+	return nil
+}
+
+// findToken returns the token with the given secret or nil.
+func findToken(tokens []apiToken, secret string) *apiToken {
+	hash := []byte(hashToken(secret))
+	for i := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(tokens[i].Hash)) == 1 {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+// bearerToken returns the token of the given request's Authorization header
+// if it uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// noCookieWriter drops any cookies set for the response.
+type noCookieWriter struct {
+	http.ResponseWriter
+}
+
+func (w noCookieWriter) WriteHeader(code int) {
+	w.Header().Del("Set-Cookie")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w noCookieWriter) Write(data []byte) (int, error) {
+	w.Header().Del("Set-Cookie")
+	return w.ResponseWriter.Write(data)
+}
+
+// CloseNotify returns a channel receiving a value when the client went
+// away, see http.CloseNotifier.
+func (w noCookieWriter) CloseNotify() <-chan bool {
+	return closeNotify(w.ResponseWriter)
+}
+
+// authenticateToken checks the API token with the given secret for a request
+// of the given node and action.
+//
+// Tokens are checked on every request, so revoked tokens are rejected
+// immediately. Writes an error response and returns false if the token
+// can't be used.
+func (h *nodeHandler) authenticateToken(w http.ResponseWriter,
+	r *http.Request, site site, secret, nodePath, action string) (*apiToken,
+	bool) {
+	if requestScheme(r) != "https" && !site.AllowInsecureTokens {
+		h.requestLog(r, site.Name).Warn("Rejected API token sent over HTTP")
+		h.renderError(w, r, "API tokens require HTTPS.", http.StatusForbidden,
+			client.Node{Path: "/"}, nil, site)
+		return nil, false
+	}
+	tokens, err := loadTokens(site.Directories.Config)
+	if err != nil {
+		panic("Can't load tokens: " + err.Error())
+	}
+	token := findToken(tokens, secret)
+	if token == nil || token.Roles() == nil {
+		h.requestLog(r, site.Name).Warn("Rejected unknown API token")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+site.Name+`"`)
+		h.renderError(w, r, "Unauthorized.", http.StatusUnauthorized,
+			client.Node{Path: "/"}, nil, site)
+		return nil, false
+	}
+	context.Set(r, accessUserKey, token.Login())
+	if !token.Covers(nodePath) || tokenDeniedActions[action] ||
+		(tokenSiteActions[action] && !token.SiteWide()) {
+		h.requestLog(r, site.Name).Warn("API token %q may not access %v @@%v",
+			token.Name, nodePath, action)
+		h.renderError(w, r, "Forbidden.", http.StatusForbidden,
+			client.Node{Path: "/"}, nil, site)
+		return nil, false
+	}
+	h.requestLog(r, site.Name).Info("API token %q: %v %v", token.Name,
+		r.Method, r.URL.Path)
+	return token, true
+}
+
+type tokenList []apiToken
+
+// Len is the number of elements in the list.
+func (l tokenList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l tokenList) Less(i, j int) bool {
+	return l[i].Name < l[j].Name
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l tokenList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// addToken adds a token with the given properties to the given tokens.
+//
+// Returns the new tokens and the token's secret.
+func addToken(tokens []apiToken, name, nodePath, scope,
+	creator string) ([]apiToken, string, error) {
+	if len(name) == 0 || strings.ContainsAny(name, "\r\n") {
+		return nil, "", fmt.Errorf("Invalid token name %q", name)
+	}
+	if _, ok := tokenScopes[scope]; !ok {
+		return nil, "", fmt.Errorf("Unknown scope %q", scope)
+	}
+	for _, token := range tokens {
+		if token.Name == name {
+			return nil, "", fmt.Errorf("Token %q already exists", name)
+		}
+	}
+	secret := randomToken()
+	tokens = append(tokens, apiToken{Name: name, Hash: hashToken(secret),
+		Path: path.Clean("/" + nodePath), Scope: scope, Creator: creator,
+		Created: time.Now().Unix()})
+	return tokens, secret, nil
+}
+
+// removeToken returns the given tokens without the one with the given name.
+func removeToken(tokens []apiToken, name string) []apiToken {
+	ret := make([]apiToken, 0, len(tokens))
+	for _, token := range tokens {
+		if token.Name != name {
+			ret = append(ret, token)
+		}
+	}
+	return ret
+}
+
+// Tokens handles requests to manage the site's API tokens.
+func (h *nodeHandler) Tokens(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	defer lockTokens(site.Directories.Config)()
+	tokens, err := loadTokens(site.Directories.Config)
+	if err != nil {
+		panic("Can't load tokens: " + err.Error())
+	}
+	ctx := template.Context{"Path": node.Path}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		revoke := r.Form.Get("Revoke")
+		name := strings.TrimSpace(r.Form.Get("Name"))
+		var secret string
+		switch {
+		case !validCSRFRequest(r, session, r.Form.Get("CSRFToken")):
+			ctx["Error"] = G("The form has expired. Please try again.")
+		case len(revoke) > 0:
+			tokens = removeToken(tokens, revoke)
+			name = revoke
+		default:
+			tokens, secret, err = addToken(tokens, name, r.Form.Get("Path"),
+				r.Form.Get("Scope"), sessionLogin(cSession))
+			if err != nil {
+				ctx["Error"] = G("Please choose an unused name and a scope.")
+			}
+		}
+		if _, ok := ctx["Error"]; ok {
+			break
+		}
+		if err := saveTokens(site.Directories.Config, tokens); err != nil {
+			panic("Can't save tokens: " + err.Error())
+		}
+		if len(secret) == 0 {
+			h.requestLog(r, site.Name).Info("%v revoked API token %q",
+				sessionLogin(cSession), name)
+			http.Redirect(w, r, site.URL(path.Join(node.Path, "@@tokens")),
+				http.StatusSeeOther)
+			return
+		}
+		h.requestLog(r, site.Name).Info("%v created API token %q",
+			sessionLogin(cSession), name)
+		// The secret is only shown once as just its hash gets stored.
+		ctx["Secret"] = secret
+		ctx["Name"] = name
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	sort.Sort(tokenList(tokens))
+	ctx["Tokens"] = tokens
+	ctx["CSRFToken"] = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	// Don't cache pages showing secrets.
+	w.Header().Set("Cache-Control", "no-store")
+	body := h.renderTemplate("daemon/actions/tokens", ctx, cSession.Locale,
+		site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("API tokens"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
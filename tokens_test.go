@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAPITokenCovers(t *testing.T) {
+	tests := []struct {
+		Path, NodePath string
+		Covers         bool
+	}{
+		{"/", "/", true},
+		{"/", "/foo/bar", true},
+		{"", "/foo", true},
+		{"/foo", "/foo", true},
+		{"/foo", "/foo/", true},
+		{"/foo/", "/foo/bar", true},
+		{"/foo", "/", false},
+		{"/foo", "/foobar", false},
+		{"/foo", "/bar/foo", false}}
+	for _, v := range tests {
+		token := apiToken{Path: v.Path}
+		if ret := token.Covers(v.NodePath); ret != v.Covers {
+			t.Errorf("apiToken{Path: %q}.Covers(%q) = %v, should be %v", v.Path,
+				v.NodePath, ret, v.Covers)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		Header, Token string
+		OK            bool
+	}{
+		{"", "", false},
+		{"Bearer abc", "abc", true},
+		{"bearer  abc", "abc", true},
+		{"Basic abc", "", false},
+		{"Bearer", "", false},
+		{"Bearer a b", "", false}}
+	for _, v := range tests {
+		r, _ := http.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Authorization", v.Header)
+		if token, ok := bearerToken(r); token != v.Token || ok != v.OK {
+			t.Errorf("bearerToken(%q) = %q, %v, should be %q, %v", v.Header,
+				token, ok, v.Token, v.OK)
+		}
+	}
+}
+
+func TestAddToken(t *testing.T) {
+	tokens, secret, err := addToken(nil, "build", "foo", "write", "alice")
+	if err != nil || len(tokens) != 1 || len(secret) == 0 {
+		t.Fatalf("addToken(...) = %v, %q, %v", tokens, secret, err)
+	}
+	if token := tokens[0]; token.Hash == secret || token.Path != "/foo" ||
+		token.Creator != "alice" {
+		t.Errorf("Added token is %+v", token)
+	}
+	if findToken(tokens, secret) != &tokens[0] ||
+		findToken(tokens, "x") != nil {
+		t.Errorf("findToken(...) does not find the token by its secret")
+	}
+	for _, v := range []struct{ Name, Scope string }{
+		{"build", "read"}, {"", "read"}, {"other", "root"}} {
+		if _, _, err := addToken(tokens, v.Name, "/", v.Scope,
+			"alice"); err == nil {
+			t.Errorf("addToken(_, %q, _, %q, _) should fail", v.Name, v.Scope)
+		}
+	}
+	if tokens = removeToken(tokens, "build"); len(tokens) != 0 {
+		t.Errorf("removeToken(...) = %v, should be empty", tokens)
+	}
+}
+
+func TestTokenRequests(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":     `{"type": "Document"}`,
+		"/data/foo/node.yaml": `{"type": "Document", "restrict": "login"}`,
+		"/data/bar/node.yaml": `{"type": "Document", "restrict": "login"}`,
+		"/config/__empty__":   ""}, "TestTokenRequests")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	configDir := filepath.Join(root, "config")
+	tokens, secret, err := addToken(nil, "build", "/foo", "read", "alice")
+	if err != nil {
+		t.Fatalf("Could not add token: %v", err)
+	}
+	tokens, adminSecret, err := addToken(tokens, "deploy", "/foo", "admin",
+		"alice")
+	if err != nil {
+		t.Fatalf("Could not add token: %v", err)
+	}
+	if err := saveTokens(configDir, tokens); err != nil {
+		t.Fatalf("Could not save tokens: %v", err)
+	}
+	tests := []struct {
+		URL, Token string
+		Insecure   bool
+		Status     int
+	}{
+		{"https://example.com/foo/@@json", "", false, http.StatusUnauthorized},
+		{"https://example.com/foo/@@json", secret, false, http.StatusOK},
+		{"http://example.com/foo/@@json", secret, false, http.StatusForbidden},
+		{"http://example.com/foo/@@json", secret, true, http.StatusOK},
+		{"https://example.com/foo/@@json", "wrong", false,
+			http.StatusUnauthorized},
+		{"https://example.com/bar/@@json", secret, false, http.StatusForbidden},
+		{"https://example.com/foo/@@edit", secret, false, http.StatusForbidden},
+		{"https://example.com/foo/@@tokens", secret, false,
+			http.StatusForbidden},
+		{"https://example.com/foo/@@logout", secret, false,
+			http.StatusForbidden},
+		{"https://example.com/foo/@@users", adminSecret, false,
+			http.StatusForbidden},
+		{"https://example.com/foo/@@status", adminSecret, false,
+			http.StatusForbidden},
+		{"https://example.com/foo/@@aliases", adminSecret, false,
+			http.StatusForbidden}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		h, stop := setupWorkerHandler(filepath.Join(root, "data"), &logBuf,
+			func(worker.Ticket) {})
+		site_, _ := h.Sites.Get("foo")
+		site_.Directories.Config = configDir
+		site_.AllowInsecureTokens = v.Insecure
+		h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", v.URL, nil)
+		r.Header.Set("Accept", "application/json")
+		r.Header.Set("Cookie", "monsti-session=foo")
+		if len(v.Token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+v.Token)
+		}
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+		}
+		if len(v.Token) > 0 && len(w.Header().Get("Set-Cookie")) > 0 {
+			t.Errorf("Test %v: Token request set a cookie", i)
+		}
+		if bytes.Contains(logBuf.Bytes(), []byte(secret)) ||
+			bytes.Contains(logBuf.Bytes(), []byte(adminSecret)) {
+			t.Errorf("Test %v: The token's secret has been logged", i)
+		}
+	}
+	// Revoked tokens must be rejected immediately.
+	tokens = removeToken(tokens, "build")
+	if err := saveTokens(configDir, tokens); err != nil {
+		t.Fatalf("Could not save tokens: %v", err)
+	}
+	var logBuf bytes.Buffer
+	h, stop := setupWorkerHandler(filepath.Join(root, "data"), &logBuf,
+		func(worker.Ticket) {})
+	defer stop()
+	site_, _ := h.Sites.Get("foo")
+	site_.Directories.Config = configDir
+	h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://example.com/foo/@@json", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Revoked token got status %v, should be %v", w.Code,
+			http.StatusUnauthorized)
+	}
+}
+
+func TestRevokeTokensConcurrently(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/__empty__": ""}, "TestRevokeTokensConcurrently")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var tokens []apiToken
+	for i := 0; i < 20; i++ {
+		tokens, _, err = addToken(tokens, fmt.Sprintf("token%v", i), "/", "read",
+			"alice")
+		if err != nil {
+			t.Fatalf("Could not add token: %v", err)
+		}
+	}
+	if err := saveTokens(root, tokens); err != nil {
+		t.Fatalf("Could not save tokens: %v", err)
+	}
+	site_ := site{Name: "foo"}
+	site_.Directories.Config = root
+	h := &nodeHandler{Settings: &settings{}}
+	session := newTestSession(nil)
+	csrfToken := getCSRFToken(session)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			form := url.Values{"Revoke": {fmt.Sprintf("token%v", i)},
+				"CSRFToken": {csrfToken}}
+			r, _ := http.NewRequest("POST", "http://example.com/@@tokens",
+				strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			h.Tokens(w, r, client.Node{Path: "/"}, newTestSession(session),
+				&client.Session{User: &client.User{Login: "alice"}}, site_)
+			if w.Code != http.StatusSeeOther {
+				t.Errorf("Revoking token%v got status %v", i, w.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if tokens, err := loadTokens(root); err != nil || len(tokens) != 0 {
+		t.Errorf("All tokens should be revoked, got %v tokens (%v)",
+			len(tokens), err)
+	}
+}
+
+func TestAPITokenSiteWide(t *testing.T) {
+	tests := []struct {
+		Path     string
+		SiteWide bool
+	}{
+		{"/", true},
+		{"", true},
+		{"/foo", false},
+		{"/foo/..", true}}
+	for _, v := range tests {
+		token := apiToken{Path: v.Path}
+		if ret := token.SiteWide(); ret != v.SiteWide {
+			t.Errorf("apiToken{Path: %q}.SiteWide() = %v, should be %v", v.Path,
+				ret, v.SiteWide)
+		}
+	}
+}
+
+func TestNoCookieWriterCloseNotify(t *testing.T) {
+	closed := make(chan bool, 1)
+	w := noCookieWriter{closeNotifyRecorder{httptest.NewRecorder(), closed}}
+	closed <- true
+	select {
+	case <-w.CloseNotify():
+	default:
+		t.Errorf("CloseNotify() should forward the wrapped writer's channel")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// totpStep is the time step of TOTP codes.
+	totpStep = 30
+	// totpSkew is the number of time steps a code might be off to allow for
+	// clock skew.
+	totpSkew = 1
+	// numRecoveryCodes is the number of recovery codes generated at 2FA
+	// setup.
+	numRecoveryCodes = 10
+)
+
+// newTOTPSecret returns a new random base32 encoded TOTP secret.
+func newTOTPSecret() string {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Could not generate TOTP secret: " + err.Error())
+	}
+	return base32.StdEncoding.EncodeToString(buf)
+}
+
+// totpCode returns the 6 digit code for the given secret and counter as
+// specified by RFC 4226.
+func totpCode(secret []byte, counter int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, uint64(counter))
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// verifyTOTP checks the given code for the given base32 encoded secret at the
+// given time.
+//
+// Codes of time steps up to and including last are rejected to prevent
+// replay attacks. Returns the time step of the code if it's valid.
+func verifyTOTP(secret, code string, now time.Time, last int64) (int64,
+	bool) {
+	key, err := base32.StdEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != 6 {
+		return 0, false
+	}
+	current := now.Unix() / totpStep
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter > last &&
+			hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI to configure authenticator apps.
+func totpURI(issuer, login, secret string) string {
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + login,
+		RawQuery: url.Values{
+			"secret": []string{secret},
+			"issuer": []string{issuer}}.Encode()}
+	return uri.String()
+}
+
+// newRecoveryCodes returns new random recovery codes.
+func newRecoveryCodes() []string {
+	codes := make([]string, numRecoveryCodes)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			panic("Could not generate recovery code: " + err.Error())
+		}
+		codes[i] = strings.ToLower(base32.StdEncoding.EncodeToString(buf))
+	}
+	return codes
+}
+
+// useRecoveryCode checks if the given code is one of the user's recovery
+// codes and removes it if so.
+func (u *user) useRecoveryCode(code string) bool {
+	hash := hashToken(strings.ToLower(strings.TrimSpace(code)))
+	for i, recoveryCode := range u.RecoveryCodes {
+		if hmac.Equal([]byte(recoveryCode), []byte(hash)) {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
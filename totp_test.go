@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		Time int64
+		Code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"}}
+	for _, v := range tests {
+		if ret := totpCode(secret, v.Time/totpStep); ret != v.Code {
+			t.Errorf("totpCode(_, %v) = %q, should be %q", v.Time/totpStep, ret,
+				v.Code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := base32.StdEncoding.EncodeToString(key)
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / totpStep
+	tests := []struct {
+		Code  string
+		Last  int64
+		Valid bool
+	}{
+		{totpCode(key, current), 0, true},
+		{totpCode(key, current-1), 0, true},
+		{totpCode(key, current+1), 0, true},
+		{totpCode(key, current-2), 0, false},
+		{totpCode(key, current+2), 0, false},
+		{totpCode(key, current), current, false},
+		{totpCode(key, current+1), current, true},
+		{"", 0, false},
+		{"12345", 0, false}}
+	for i, v := range tests {
+		_, ok := verifyTOTP(strings.ToLower(secret), v.Code, now, v.Last)
+		if ok != v.Valid {
+			t.Errorf("Test %v: verifyTOTP(_, %q, _, %v) = %v, should be %v", i,
+				v.Code, v.Last, ok, v.Valid)
+		}
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	codes := newRecoveryCodes()
+	if len(codes) != numRecoveryCodes {
+		t.Fatalf("newRecoveryCodes() returned %v codes, should be %v",
+			len(codes), numRecoveryCodes)
+	}
+	u := user{}
+	for _, code := range codes {
+		u.RecoveryCodes = append(u.RecoveryCodes, hashToken(code))
+	}
+	if u.useRecoveryCode("unknown") {
+		t.Errorf("useRecoveryCode(\"unknown\") = true, should be false")
+	}
+	if !u.useRecoveryCode(strings.ToUpper(codes[3])) {
+		t.Errorf("useRecoveryCode(%q) = false, should be true", codes[3])
+	}
+	if u.useRecoveryCode(codes[3]) {
+		t.Errorf("useRecoveryCode(%q) = true for used code", codes[3])
+	}
+	if len(u.RecoveryCodes) != numRecoveryCodes-1 {
+		t.Errorf("User should have %v recovery codes left, has %v",
+			numRecoveryCodes-1, len(u.RecoveryCodes))
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/context"
+	mathRand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceParentHeader is the W3C Trace Context header holding the trace ID,
+// the parent span ID and the sampling flag.
+const traceParentHeader = "Traceparent"
+
+// tracingSettings configure the tracing of requests.
+type tracingSettings struct {
+	// SampleRate is the fraction of requests to be traced, between 0 and 1.
+	// Requests of trusted proxies which have been sampled upstream will be
+	// traced regardless. Tracing is disabled if zero.
+	SampleRate float64
+	// Endpoint is the URL of the OTLP/HTTP traces endpoint of an
+	// OpenTelemetry collector, e.g. http://localhost:4318/v1/traces. If
+	// empty, spans will be logged as JSON.
+	Endpoint string
+	// ServiceName identifies the daemon in the traces. Defaults to
+	// monsti-daemon.
+	ServiceName string
+}
+
+// Maximum number of spans waiting to be exported and sent at once.
+const (
+	maxQueuedSpans = 4096
+	maxSpanBatch   = 256
+)
+
+// spanExportInterval is the interval in which queued spans get exported.
+const spanExportInterval = 5 * time.Second
+
+// span is a timed operation of a traced request.
+//
+// All methods may be called on a nil span, which does nothing. Thus,
+// requests which are not traced don't have any cost besides nil checks.
+type span struct {
+	tracer   *tracer
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	// Server is true for the span of the HTTP request.
+	Server     bool
+	Start, End time.Time
+	mutex      sync.Mutex
+	Attributes map[string]string
+	// Error describes why the operation failed, if it did.
+	Error string
+}
+
+// randomHex returns n random bytes in hexadecimal encoding.
+func randomHex(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		panic("Could not generate ID: " + err.Error())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Child starts a child span of the given name.
+func (s *span) Child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return &span{tracer: s.tracer, TraceID: s.TraceID, SpanID: randomHex(8),
+		ParentID: s.SpanID, Name: name, Start: time.Now()}
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and queues it for export.
+func (s *span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.tracer.queue(s)
+}
+
+// TraceParent returns the value of the traceparent header to propagate the
+// span's context, or an empty string if s is nil.
+func (s *span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.TraceID + "-" + s.SpanID + "-01"
+}
+
+// parseTraceParent returns the trace ID, the parent span ID and the
+// sampling flag of the given traceparent header value.
+func parseTraceParent(value string) (string, string, bool, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+	for _, part := range parts[:4] {
+		if _, err := hex.DecodeString(part); err != nil ||
+			strings.ToLower(part) != part {
+			return "", "", false, false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return parts[1], parts[2], flags&1 == 1, true
+}
+
+// tracer samples requests and exports their spans.
+//
+// A nil tracer does not trace at all.
+type tracer struct {
+	Settings tracingSettings
+	Log      *leveledLogger
+	// Client is used to export spans to the OTLP endpoint.
+	Client *http.Client
+	// sample returns true if a request should be traced. Used for testing.
+	sample func() bool
+	spans  chan *span
+}
+
+// newTracer returns a new tracer using the given settings, or nil if
+// tracing is disabled.
+func newTracer(settings tracingSettings, log *leveledLogger) *tracer {
+	if settings.SampleRate <= 0 {
+		return nil
+	}
+	if len(settings.ServiceName) == 0 {
+		settings.ServiceName = "monsti-daemon"
+	}
+	t := &tracer{
+		Settings: settings,
+		Log:      log,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, maxQueuedSpans)}
+	t.sample = func() bool {
+		return mathRand.Float64() < t.Settings.SampleRate
+	}
+	go t.run(spanExportInterval)
+	return t
+}
+
+// StartRequest starts the span of the given request if it gets sampled.
+//
+// The trace context of requests of trusted proxies will be continued.
+// Headers of untrusted clients have already been removed by
+// applyProxyHeaders.
+func (t *tracer) StartRequest(r *http.Request) *span {
+	if t == nil {
+		return nil
+	}
+	traceID, parentID, sampled, ok := parseTraceParent(
+		r.Header.Get(traceParentHeader))
+	if !ok {
+		traceID, parentID = randomHex(16), ""
+	}
+	if !sampled && !t.sample() {
+		return nil
+	}
+	s := &span{tracer: t, TraceID: traceID, SpanID: randomHex(8),
+		ParentID: parentID, Name: r.Method + " " + r.URL.Path, Server: true,
+		Start: time.Now()}
+	s.SetAttribute("http.method", r.Method)
+	s.SetAttribute("http.host", r.Host)
+	s.SetAttribute("http.target", r.URL.RequestURI())
+	s.SetAttribute("net.peer.ip", clientIP(r))
+	context.Set(r, traceSpanKey, s)
+	return s
+}
+
+// requestSpan returns the span of the given request, or nil if the request
+// is not traced.
+func requestSpan(r *http.Request) *span {
+	s, _ := context.Get(r, traceSpanKey).(*span)
+	return s
+}
+
+// startSpan starts a child span of the given request's span, or returns nil
+// if the request is not traced.
+func startSpan(r *http.Request, name string) *span {
+	return requestSpan(r).Child(name)
+}
+
+// queue queues the given finished span for export. Spans get dropped if
+// the queue is full.
+func (t *tracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// run exports the queued spans in batches, waiting at most the given
+// interval.
+func (t *tracer) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < maxSpanBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			t.Log.Warn("Could not export %v spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// otlpAttribute is an attribute in the OTLP JSON encoding.
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// otlpAttributes converts the given attributes to the OTLP JSON encoding.
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	ret := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		attribute := otlpAttribute{Key: key}
+		attribute.Value.StringValue = value
+		ret = append(ret, attribute)
+	}
+	return ret
+}
+
+// otlpSpan is a span in the OTLP JSON encoding.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlp returns the span in the OTLP JSON encoding.
+func (s *span) otlp() otlpSpan {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := otlpSpan{TraceID: s.TraceID, SpanID: s.SpanID,
+		ParentSpanID: s.ParentID, Name: s.Name,
+		Start:      strconv.FormatInt(s.Start.UnixNano(), 10),
+		End:        strconv.FormatInt(s.End.UnixNano(), 10),
+		Attributes: otlpAttributes(s.Attributes)}
+	// Span kinds internal (1) and server (2).
+	ret.Kind = 1
+	if s.Server {
+		ret.Kind = 2
+	}
+	if len(s.Error) > 0 {
+		ret.Status.Code, ret.Status.Message = 2, s.Error
+	}
+	return ret
+}
+
+// otlpRequest returns the OTLP/HTTP JSON request body to export the given
+// spans.
+func (t *tracer) otlpRequest(spans []*span) ([]byte, error) {
+	var scope struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	scope.Scope.Name = "monsti-daemon"
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+	var resource struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []interface{} `json:"scopeSpans"`
+	}
+	resource.Resource.Attributes = otlpAttributes(map[string]string{
+		"service.name": t.Settings.ServiceName})
+	resource.ScopeSpans = []interface{}{scope}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{resource}})
+}
+
+// export sends the given spans to the OTLP endpoint, or logs them if there
+// is none.
+func (t *tracer) export(spans []*span) error {
+	if len(t.Settings.Endpoint) == 0 {
+		for _, s := range spans {
+			content, err := json.Marshal(s.otlp())
+			if err != nil {
+				return err
+			}
+			t.Log.Info("Span %s", content)
+		}
+		return nil
+	}
+	body, err := t.otlpRequest(spans)
+	if err != nil {
+		return err
+	}
+	res, err := t.Client.Post(t.Settings.Endpoint, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Endpoint responded with %v", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		Value           string
+		TraceID, SpanID string
+		Sampled, OK     bool
+	}{
+		{"00-" + traceID + "-" + spanID + "-01", traceID, spanID, true, true},
+		{"00-" + traceID + "-" + spanID + "-00", traceID, spanID, false, true},
+		{"01-" + traceID + "-" + spanID + "-01-foo", traceID, spanID, true,
+			true},
+		{"00-" + traceID + "-" + spanID + "-01-foo", "", "", false, false},
+		{"ff-" + traceID + "-" + spanID + "-01", "", "", false, false},
+		{"00-" + strings.ToUpper(traceID) + "-" + spanID + "-01", "", "",
+			false, false},
+		{"00-00000000000000000000000000000000-" + spanID + "-01", "", "",
+			false, false},
+		{"00-" + traceID + "-0000000000000000-01", "", "", false, false},
+		{"00-" + traceID[1:] + "-" + spanID + "-01", "", "", false, false},
+		{"", "", "", false, false}}
+	for i, v := range tests {
+		traceID, spanID, sampled, ok := parseTraceParent(v.Value)
+		if traceID != v.TraceID || spanID != v.SpanID || sampled != v.Sampled ||
+			ok != v.OK {
+			t.Errorf("Test %v: parseTraceParent(%q) = %q, %q, %v, %v", i,
+				v.Value, traceID, spanID, sampled, ok)
+		}
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	var tracer_ *tracer
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	span := tracer_.StartRequest(r)
+	child := span.Child("foo")
+	child.SetAttribute("foo", "bar")
+	child.Finish()
+	if span != nil || child != nil || len(span.TraceParent()) > 0 {
+		t.Errorf("A nil tracer should not trace")
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+		}))
+	defer server.Close()
+	tracer_ := &tracer{Settings: tracingSettings{Endpoint: server.URL,
+		ServiceName: "monsti-test"}, Client: http.DefaultClient}
+	root := &span{tracer: tracer_, TraceID: randomHex(16),
+		SpanID: randomHex(8), Name: "GET /", Server: true}
+	child := root.Child("lookupNode")
+	child.SetAttribute("foo", "bar")
+	child.SetError(errInvalidPath)
+	if err := tracer_.export([]*span{root, child}); err != nil {
+		t.Fatalf("export(...) failed: %v", err)
+	}
+	var request struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute
+			}
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		t.Fatalf("Could not unmarshal exported spans: %v\n%s", err, body)
+	}
+	if len(request.ResourceSpans) != 1 ||
+		len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected export request: %s", body)
+	}
+	resource := request.ResourceSpans[0]
+	if attrs := resource.Resource.Attributes; len(attrs) != 1 ||
+		attrs[0].Value.StringValue != "monsti-test" {
+		t.Errorf("Resource attributes are %v", attrs)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Kind != 2 || spans[1].Kind != 1 ||
+		spans[1].ParentSpanID != root.SpanID ||
+		spans[1].TraceID != root.TraceID || spans[1].Status.Code != 2 ||
+		len(spans[1].Attributes) != 1 {
+		t.Errorf("Exported spans are %+v", spans)
+	}
+}
+
+func TestTracedRequest(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestTracedRequest")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var logBuf bytes.Buffer
+	var traceParent string
+	h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+		traceParent = ticket.TraceParent
+		close(ticket.Received)
+		ticket.ResponseChan <- client.Response{Body: []byte("Foo"), Raw: true}
+	})
+	defer stop()
+	h.Tracer = &tracer{Log: newLeveledLogger(log.New(ioutil.Discard, "", 0),
+		levelInfo), sample: func() bool { return true },
+		spans: make(chan *span, 100)}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://example.com/foo/", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %v, should be %v", w.Code, http.StatusOK)
+	}
+	close(h.Tracer.spans)
+	spans := make(map[string]*span)
+	for span := range h.Tracer.spans {
+		spans[span.Name] = span
+	}
+	request := spans["GET /foo/"]
+	if request == nil {
+		t.Fatalf("Missing request span, got %v", spans)
+	}
+	for _, name := range []string{"getClientSession", "lookupNode", "worker"} {
+		if span := spans[name]; span == nil || span.ParentID != request.SpanID {
+			t.Errorf("Span %q is missing or not a child of the request span",
+				name)
+		}
+	}
+	workerSpan := spans["worker"]
+	if queue := spans["queue"]; queue == nil || workerSpan == nil ||
+		queue.ParentID != workerSpan.SpanID {
+		t.Errorf("Span queue is missing or not a child of the worker span")
+	}
+	if workerSpan != nil && traceParent != workerSpan.TraceParent() {
+		t.Errorf("Ticket has trace parent %q, should be %q", traceParent,
+			workerSpan.TraceParent())
+	}
+	if id := w.Header().Get(requestIDHeader); id != request.TraceID {
+		t.Errorf("Request ID is %q, should be the trace ID %q", id,
+			request.TraceID)
+	}
+	if status := request.Attributes["http.status_code"]; status != "200" {
+		t.Errorf("Request span has status %q, should be 200", status)
+	}
+}
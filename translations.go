@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	"io/ioutil"
+	"launchpad.net/goyaml"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// validLocale checks if the given locale may be used in file names.
+func validLocale(locale string) bool {
+	if len(locale) == 0 {
+		return false
+	}
+	for _, c := range locale {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// localeCandidates returns the locales to look for translations of the given
+// locale, most specific first, e.g. de_DE and de for de_DE.
+//
+// Returns nil for invalid locales.
+func localeCandidates(locale string) []string {
+	if !validLocale(locale) {
+		return nil
+	}
+	candidates := []string{locale}
+	if i := strings.IndexAny(locale, "_-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	return candidates
+}
+
+// localizedFile returns the name of the given file's variant for the given
+// locale, e.g. body.de.html for body.html and de.
+func localizedFile(file, locale string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + locale + ext
+}
+
+// findTranslation returns the name of the translation of the given file of
+// the node at the given path for the given locale and the locale of the
+// translation.
+//
+// Returns the file itself and an empty locale if there is no translation.
+func findTranslation(root, nodePath, file, locale string) (name,
+	translation string) {
+	for _, candidate := range localeCandidates(locale) {
+		name := localizedFile(file, candidate)
+		path, err := nodeFile(root, nodePath, name)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return name, candidate
+		}
+	}
+	return file, ""
+}
+
+// translateNode returns the given node with the fields set by its translation
+// for the given locale, e.g. node.de.yaml, and the locale of the translation.
+//
+// Fields missing in the translation keep the values of the base node.
+// Returns the unchanged node and an empty locale if there is no translation.
+func translateNode(root string, node client.Node, locale string) (
+	client.Node, string) {
+	name, translation := findTranslation(root, node.Path, "node.yaml", locale)
+	if len(translation) == 0 {
+		return node, ""
+	}
+	content, err := getNodeFile(root, node.Path, name)
+	if err != nil {
+		return node, ""
+	}
+	translated := node
+	if err := goyaml.Unmarshal(content, &translated); err != nil {
+		return node, ""
+	}
+	translated.Path = node.Path
+	return translated, translation
+}
+
+// nodeTranslations returns the locales of the translations of the node at the
+// given path.
+func nodeTranslations(root, nodePath string) []string {
+	dir, err := nodeFile(root, nodePath, "")
+	if err != nil {
+		return nil
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	var locales []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "node.") ||
+			!strings.HasSuffix(name, ".yaml") || name == "node.yaml" {
+			continue
+		}
+		locale := strings.TrimSuffix(strings.TrimPrefix(name, "node."), ".yaml")
+		if validLocale(locale) {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"strings"
+	"testing"
+)
+
+func TestLocalizedFile(t *testing.T) {
+	tests := []struct {
+		File, Locale, Localized string
+	}{
+		{"body.html", "de", "body.de.html"},
+		{"node.yaml", "de_DE", "node.de_DE.yaml"},
+		{"README", "fr", "README.fr"}}
+	for _, v := range tests {
+		if ret := localizedFile(v.File, v.Locale); ret != v.Localized {
+			t.Errorf("localizedFile(%q, %q) = %q, should be %q", v.File,
+				v.Locale, ret, v.Localized)
+		}
+	}
+}
+
+func TestFindTranslation(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/body.html":    "Hello",
+		"/foo/body.de.html": "Hallo"}, "TestFindTranslation")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Locale, Name, Translation string
+	}{
+		{"", "body.html", ""},
+		{"de", "body.de.html", "de"},
+		{"de_AT", "body.de.html", "de"},
+		{"fr", "body.html", ""},
+		{"../de", "body.html", ""}}
+	for _, v := range tests {
+		name, translation := findTranslation(root, "/foo", "body.html",
+			v.Locale)
+		if name != v.Name || translation != v.Translation {
+			t.Errorf("findTranslation(_, \"/foo\", \"body.html\", %q) = %q, %q,"+
+				" should be %q, %q", v.Locale, name, translation, v.Name,
+				v.Translation)
+		}
+	}
+}
+
+func TestTranslateNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml":    `{"title": "Hello", "description": "Greeting"}`,
+		"/foo/node.de.yaml": `{"title": "Hallo"}`,
+		"/foo/node.fr.yaml": `{"title": "Salut"}`}, "TestTranslateNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	node := client.Node{Path: "/foo", Title: "Hello", Description: "Greeting"}
+	tests := []struct {
+		Locale, Title, Translation string
+	}{
+		{"", "Hello", ""},
+		{"de", "Hallo", "de"},
+		{"it", "Hello", ""}}
+	for _, v := range tests {
+		ret, translation := translateNode(root, node, v.Locale)
+		if ret.Title != v.Title || translation != v.Translation ||
+			ret.Description != "Greeting" || ret.Path != "/foo" {
+			t.Errorf("translateNode(_, _, %q) = %+v, %q, should have title %q"+
+				" and translation %q", v.Locale, ret, translation, v.Title,
+				v.Translation)
+		}
+	}
+	if ret := strings.Join(nodeTranslations(root, "/foo"), ","); ret != "de,fr" {
+		t.Errorf("nodeTranslations(_, \"/foo\") = %q, should be \"de,fr\"", ret)
+	}
+}
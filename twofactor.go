@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/form"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"net/http"
+	"time"
+)
+
+// pendingLoginTimeout is the time a user has to enter the second factor
+// after entering the correct password.
+const pendingLoginTimeout = 5 * time.Minute
+
+// setPendingLogin marks the session as waiting for the second factor of the
+// user with the given login.
+//
+// Pending sessions are not authenticated.
+func setPendingLogin(session *sessions.Session, login string) {
+	session.Values["pending_login"] = login
+	session.Values["pending_login_time"] = time.Now().Unix()
+}
+
+// getPendingLogin returns the login of the user whose second factor the
+// session is waiting for.
+func getPendingLogin(session *sessions.Session) (string, bool) {
+	login, _ := session.Values["pending_login"].(string)
+	since, _ := session.Values["pending_login_time"].(int64)
+	if len(login) == 0 ||
+		time.Since(time.Unix(since, 0)) > pendingLoginTimeout {
+		return "", false
+	}
+	return login, true
+}
+
+// clearPendingLogin removes any pending login from the session.
+func clearPendingLogin(session *sessions.Session) {
+	delete(session.Values, "pending_login")
+	delete(session.Values, "pending_login_time")
+}
+
+type secondFactorFormData struct {
+	Code      string
+	CSRFToken string
+}
+
+// LoginSecondFactor handles the second step of logins of users with enabled
+// two-factor authentication.
+func (h *nodeHandler) LoginSecondFactor(w http.ResponseWriter,
+	r *http.Request, node client.Node, session *sessions.Session,
+	cSession *client.Session, site site, login string) {
+	G := l10n.UseCatalog(cSession.Locale)
+	data := secondFactorFormData{}
+	form := form.NewForm(&data, form.Fields{
+		"Code": form.Field{G("Authentication code"),
+			G("The code of your authenticator app or a recovery code."),
+			form.Required(G("Required.")), nil},
+		"CSRFToken": csrfField()})
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		if form.Fill(r.Form) {
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			ip := clientIP(r)
+			keys := []string{"login:" + login, "ip:" + ip}
+			if h.LoginLimiter.Locked(keys...) {
+				h.requestLog(r, site.Name).Warn(
+					"Rejected login attempt for locked user %q from %v", login, ip)
+				form.AddError("", G("Too many failed login attempts. Please try again later."))
+				break
+			}
+			defer lockUsers(site.Directories.Config)()
+			users, err := loadUsers(site.Directories.Config)
+			if err != nil {
+				panic(err.Error())
+			}
+			idx := findUser(users, login)
+			if idx == -1 || users[idx].Disabled {
+				clearPendingLogin(session)
+				session.Save(r, w)
+				http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+				return
+			}
+			user := &users[idx]
+			counter, ok := verifyTOTP(user.TOTPSecret, data.Code, time.Now(),
+				user.TOTPLastCounter)
+			if ok {
+				user.TOTPLastCounter = counter
+			} else {
+				ok = user.useRecoveryCode(data.Code)
+			}
+			if ok {
+				if err := saveUsers(site.Directories.Config, users); err != nil {
+					panic("Can't save user: " + err.Error())
+				}
+				h.LoginLimiter.Succeed(keys[0])
+				completeLogin(w, r, node, session, site, user)
+				return
+			}
+			h.LoginLimiter.Fail(keys...)
+			form.AddError("Code", G("Wrong code."))
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	data.Code = ""
+	data.CSRFToken = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/secondfactorform",
+		template.Context{"Form": form.RenderData()}, cSession.Locale,
+		site)
+	env := masterTmplEnv{Node: node, Session: cSession, Title: G("Login"),
+		Flags: EDIT_VIEW, Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+// pendingTOTPSecret returns the unconfirmed TOTP secret of the user with the
+// given login. A new secret gets generated and stored in the user's account
+// if there is none or if renew is set.
+func pendingTOTPSecret(configDir, login string, renew bool) (string, error) {
+	defer lockUsers(configDir)()
+	users, err := loadUsers(configDir)
+	if err != nil {
+		return "", err
+	}
+	idx := findUser(users, login)
+	if idx == -1 {
+		return "", fmt.Errorf("User %q not found", login)
+	}
+	if !renew && len(users[idx].PendingTOTPSecret) > 0 {
+		return users[idx].PendingTOTPSecret, nil
+	}
+	users[idx].PendingTOTPSecret = newTOTPSecret()
+	if err := saveUsers(configDir, users); err != nil {
+		return "", err
+	}
+	return users[idx].PendingTOTPSecret, nil
+}
+
+type setupTwoFactorFormData struct {
+	Password, Code string
+	CSRFToken      string
+}
+
+// reauthenticate checks the password of the current user before changes of
+// the user's security settings. Failures count as failed logins.
+//
+// Returns an error message or an empty string if the password is correct.
+func (h *nodeHandler) reauthenticate(r *http.Request, site site, login,
+	password, locale string) string {
+	G := l10n.UseCatalog(locale)
+	ip := clientIP(r)
+	keys := []string{"login:" + login, "ip:" + ip}
+	if h.LoginLimiter.Locked(keys...) {
+		return G("Too many failed login attempts. Please try again later.")
+	}
+	time.Sleep(h.LoginLimiter.Delay(keys...))
+	user, err := authenticate(site, login, password)
+	if err != nil && err != errWrongCredentials {
+		h.requestLog(r, site.Name).Error("Could not authenticate user %q: %v",
+			login, err)
+		return G("Login is currently not possible. Please try again later.")
+	}
+	if err == nil && user.Login == login {
+		h.LoginLimiter.Succeed(keys[0])
+		return ""
+	}
+	if h.LoginLimiter.Fail(keys...) {
+		h.requestLog(r, site.Name).Warn("Locked login for user %q from %v"+
+			" after too many failed attempts", login, ip)
+	}
+	return G("Wrong password.")
+}
+
+// SetupTwoFactor handles requests to enable or disable two-factor
+// authentication for the current user. Both require the user's password.
+//
+// To enable, a new secret gets generated and stored as pending secret in
+// the user's account until the user confirms it by entering a valid code.
+// Recovery codes will be shown once after setup.
+func (h *nodeHandler) SetupTwoFactor(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	login := cSession.User.Login
+	current, err := getUser(login, site.Directories.Config)
+	if err != nil {
+		panic("Can't load current user: " + err.Error())
+	}
+	if current == nil {
+		panic("Current user not found.")
+	}
+	enabled := len(current.TOTPSecret) > 0
+	var secret string
+	if !enabled {
+		secret, err = pendingTOTPSecret(site.Directories.Config, login,
+			r.Method == "GET")
+		if err != nil {
+			panic("Can't store pending secret: " + err.Error())
+		}
+	}
+	data := setupTwoFactorFormData{}
+	fields := form.Fields{
+		"Password": form.Field{G("Password"), G("Your current password."),
+			form.Required(G("Required.")), new(form.PasswordWidget)},
+		"CSRFToken": csrfField()}
+	if !enabled {
+		fields["Code"] = form.Field{G("Authentication code"),
+			G("Enter the code shown by your authenticator app."),
+			form.Required(G("Required.")), nil}
+	}
+	form := form.NewForm(&data, fields)
+	var recoveryCodes []string
+	disabled := false
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		if form.Fill(r.Form) {
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			if msg := h.reauthenticate(r, site, login, data.Password,
+				cSession.Locale); len(msg) > 0 {
+				form.AddError("Password", msg)
+				break
+			}
+			var counter int64
+			if !enabled {
+				var ok bool
+				if counter, ok = verifyTOTP(secret, data.Code, time.Now(),
+					0); !ok {
+					form.AddError("Code", G("Wrong code."))
+					break
+				}
+			}
+			defer lockUsers(site.Directories.Config)()
+			users, err := loadUsers(site.Directories.Config)
+			if err != nil {
+				panic(err.Error())
+			}
+			idx := findUser(users, login)
+			if idx == -1 {
+				panic("Current user not found.")
+			}
+			if enabled {
+				users[idx].TOTPSecret = ""
+				users[idx].PendingTOTPSecret = ""
+				users[idx].TOTPLastCounter = 0
+				users[idx].RecoveryCodes = nil
+				disabled = true
+			} else {
+				recoveryCodes = newRecoveryCodes()
+				users[idx].TOTPSecret = secret
+				users[idx].PendingTOTPSecret = ""
+				users[idx].TOTPLastCounter = counter
+				users[idx].RecoveryCodes = make([]string, len(recoveryCodes))
+				for i, code := range recoveryCodes {
+					users[idx].RecoveryCodes[i] = hashToken(code)
+				}
+			}
+			if err := saveUsers(site.Directories.Config, users); err != nil {
+				panic("Can't save user: " + err.Error())
+			}
+			if disabled {
+				h.requestLog(r, site.Name).Info(
+					"User %q disabled two-factor authentication", login)
+			}
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	data.Password = ""
+	data.Code = ""
+	data.CSRFToken = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/setup2fa", template.Context{
+		"Form":          form.RenderData(),
+		"Enabled":       enabled,
+		"Disabled":      disabled,
+		"Secret":        secret,
+		"URI":           totpURI(site.Title, login, secret),
+		"RecoveryCodes": recoveryCodes}, cSession.Locale,
+		site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title:  G("Two-factor authentication"),
+		Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPendingTOTPSecret(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestPendingTOTPSecret")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := saveUsers(root, []user{
+		{User: client.User{Login: "foo"}}}); err != nil {
+		t.Fatalf("Could not save users: %v", err)
+	}
+	secret, err := pendingTOTPSecret(root, "foo", false)
+	if err != nil || len(secret) == 0 {
+		t.Fatalf("pendingTOTPSecret(...) = %q, %v, should be new secret",
+			secret, err)
+	}
+	foo := testUser(t, "foo", root)
+	if foo.PendingTOTPSecret != secret || len(foo.TOTPSecret) > 0 {
+		t.Errorf("User should have unconfirmed secret %q, got %+v", secret, foo)
+	}
+	if ret, err := pendingTOTPSecret(root, "foo", false); err != nil ||
+		ret != secret {
+		t.Errorf("pendingTOTPSecret(...) = %q, %v, should be %q, nil", ret, err,
+			secret)
+	}
+	renewed, err := pendingTOTPSecret(root, "foo", true)
+	if err != nil || renewed == secret ||
+		testUser(t, "foo", root).PendingTOTPSecret != renewed {
+		t.Errorf("pendingTOTPSecret(..., true) = %q, %v, should store new secret",
+			renewed, err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "users.yaml"))
+	if err != nil || !strings.Contains(string(content), renewed) {
+		t.Errorf("Pending secret should be stored in users file, got %q",
+			content)
+	}
+	if _, err := pendingTOTPSecret(root, "bar", false); err == nil {
+		t.Errorf("pendingTOTPSecret(...) for unknown user should fail")
+	}
+}
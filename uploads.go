@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMaxRequestSize is the maximum size in bytes of request bodies if
+// the site's settings don't specify another value.
+const defaultMaxRequestSize = 64 << 20
+
+// uploadDirPrefix is the prefix of the temporary directories holding the
+// files uploaded with a request.
+const uploadDirPrefix = "monsti-upload-"
+
+// maxRequestSize returns the maximum size in bytes of request bodies of the
+// given action.
+//
+// Imports are limited by maxImportSize instead.
+func (s site) maxRequestSize(action string) int64 {
+	if action == "import" {
+		return maxImportSize
+	}
+	if s.MaxRequestSize > 0 {
+		return s.MaxRequestSize
+	}
+	return defaultMaxRequestSize
+}
+
+// bodyTooLarge returns true if the given error has been caused by reading
+// a request body exceeding its maximum size.
+func bodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// uploadedFile is a file uploaded with a multipart request.
+type uploadedFile struct {
+	// Field is the name of the form field.
+	Field string
+	// Name is the file name given by the client.
+	Name string
+	// Path of the file holding the uploaded content.
+	Path string
+}
+
+// parseBody parses the form values of the given request's body.
+//
+// Files of multipart requests will be streamed to a new temporary directory
+// instead of being held in memory. Returns the paths of the uploaded files
+// by form field and the temporary directory, which has to be removed by the
+// caller. The directory is empty if no files have been uploaded.
+func parseBody(r *http.Request) (map[string][]string, string, error) {
+	if !isMultipart(r) {
+		return nil, "", r.ParseForm()
+	}
+	var dir string
+	uploads, err := streamMultipart(r, func() (*os.File, error) {
+		if len(dir) == 0 {
+			var err error
+			if dir, err = ioutil.TempDir("", uploadDirPrefix); err != nil {
+				return nil, fmt.Errorf("Could not create upload directory: %v",
+					err)
+			}
+		}
+		return ioutil.TempFile(dir, "file-")
+	})
+	files := make(map[string][]string)
+	for _, upload := range uploads {
+		files[upload.Field] = append(files[upload.Field], upload.Path)
+	}
+	return files, dir, err
+}
+
+// isMultipart returns true if the given request has a multipart body.
+func isMultipart(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"),
+		"multipart/form-data")
+}
+
+// streamMultipart parses the multipart body of the given request.
+//
+// Form values are stored in the request's Form and PostForm. The content of
+// each uploaded file is written to a new file returned by create. The
+// uploaded files are returned even if an error occurs, so that the caller
+// can remove them.
+func streamMultipart(r *http.Request,
+	create func() (*os.File, error)) ([]uploadedFile, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	values := make(url.Values)
+	var uploads []uploadedFile
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploads, err
+		}
+		name := part.FormName()
+		if len(name) == 0 {
+			continue
+		}
+		if len(part.FileName()) == 0 {
+			value, err := ioutil.ReadAll(part)
+			if err != nil {
+				return uploads, err
+			}
+			values.Add(name, string(value))
+			continue
+		}
+		file, err := create()
+		if err != nil {
+			return uploads, fmt.Errorf("Could not create upload file: %v", err)
+		}
+		uploads = append(uploads, uploadedFile{Field: name,
+			Name: part.FileName(), Path: filepath.Clean(file.Name())})
+		if err := receiveFile(part, file); err != nil {
+			return uploads, err
+		}
+	}
+	r.PostForm = values
+	r.Form = make(url.Values)
+	for key, value := range r.URL.Query() {
+		r.Form[key] = append(r.Form[key], value...)
+	}
+	for key, value := range values {
+		r.Form[key] = append(r.Form[key], value...)
+	}
+	// Later calls of ParseMultipartForm must not read the body again.
+	r.MultipartForm = &multipart.Form{Value: values,
+		File: make(map[string][]*multipart.FileHeader)}
+	return uploads, nil
+}
+
+// receiveFile writes the given uploaded file to the given file and closes
+// it.
+func receiveFile(part io.Reader, file *os.File) error {
+	_, err := io.Copy(file, part)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// multipartBody returns a multipart body holding the given values and a file
+// with the given content in the field File.
+func multipartBody(t *testing.T, values map[string]string,
+	file string) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range values {
+		if err := writer.WriteField(key, value); err != nil {
+			t.Fatalf("Could not write field: %v", err)
+		}
+	}
+	part, err := writer.CreateFormFile("File", "foo.txt")
+	if err != nil {
+		t.Fatalf("Could not create form file: %v", err)
+	}
+	part.Write([]byte(file))
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+func TestParseBody(t *testing.T) {
+	body, contentType := multipartBody(t, map[string]string{"Title": "Foo"},
+		"Hello")
+	r, _ := http.NewRequest("POST", "http://example.com/foo/?Bar=baz", body)
+	r.Header.Set("Content-Type", contentType)
+	files, dir, err := parseBody(r)
+	if err != nil {
+		t.Fatalf("parseBody(...) returned error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if len(dir) == 0 || len(files["File"]) != 1 ||
+		!strings.HasPrefix(files["File"][0], dir) {
+		t.Fatalf("File should be stored in %q, got %v", dir, files)
+	}
+	if content, err := ioutil.ReadFile(files["File"][0]); err != nil ||
+		string(content) != "Hello" {
+		t.Errorf("Uploaded file should contain Hello, got %q, %v", content, err)
+	}
+	if r.FormValue("Title") != "Foo" || r.FormValue("Bar") != "baz" ||
+		r.PostFormValue("Bar") != "" {
+		t.Errorf("Wrong form values: %v", r.Form)
+	}
+
+	r, _ = http.NewRequest("POST", "http://example.com/foo/",
+		strings.NewReader("Title=Foo"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if files, dir, err = parseBody(r); err != nil || len(dir) > 0 ||
+		len(files) > 0 || r.FormValue("Title") != "Foo" {
+		t.Errorf("parseBody(...) = %v, %q, %v with form %v", files, dir, err,
+			r.Form)
+	}
+}
+
+func TestRequestNodeUploads(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestRequestNodeUploads")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		File          string
+		ContentLength bool
+		Status        int
+	}{
+		{"Hello", true, http.StatusOK},
+		{strings.Repeat("x", 2048), false, http.StatusRequestEntityTooLarge},
+		{strings.Repeat("x", 2048), true, http.StatusRequestEntityTooLarge}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		var uploaded []string
+		h, stop := setupWorkerHandler(root, &logBuf, func(ticket worker.Ticket) {
+			uploaded = ticket.Files["File"]
+			var content []byte
+			if len(uploaded) > 0 {
+				content, _ = ioutil.ReadFile(uploaded[0])
+			}
+			ticket.ResponseChan <- client.Response{Body: content, Raw: true}
+		})
+		siteFoo, _ := h.Sites.Get("foo")
+		siteFoo.MaxRequestSize = 1024
+		h.Sites.Set(map[string]site{"foo": siteFoo}, "")
+		body, contentType := multipartBody(t, nil, v.File)
+		r, _ := http.NewRequest("POST", "http://example.com/foo/", body)
+		r.Header.Set("Content-Type", contentType)
+		if !v.ContentLength {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: Got status %v, should be %v", i, w.Code, v.Status)
+			continue
+		}
+		if v.Status != http.StatusOK {
+			continue
+		}
+		if w.Body.String() != v.File {
+			t.Errorf("Test %v: Worker should read the upload, got %q", i,
+				w.Body.String())
+		}
+		if len(uploaded) != 1 {
+			t.Errorf("Test %v: Ticket should hold the upload, got %v", i,
+				uploaded)
+		} else if _, err := os.Stat(uploaded[0]); !os.IsNotExist(err) {
+			t.Errorf("Test %v: Upload should be removed after the request", i)
+		}
+	}
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	tests := []struct {
+		Setting int64
+		Action  string
+		Size    int64
+	}{
+		{0, "", defaultMaxRequestSize},
+		{1024, "edit", 1024},
+		{1024, "import", maxImportSize},
+		{0, "import", maxImportSize}}
+	for _, v := range tests {
+		site_ := site{MaxRequestSize: v.Setting}
+		if ret := site_.maxRequestSize(v.Action); ret != v.Size {
+			t.Errorf("site{MaxRequestSize: %v}.maxRequestSize(%q) = %v, should"+
+				" be %v", v.Setting, v.Action, ret, v.Size)
+		}
+	}
+}
+
+func TestDaemonActionTooLarge(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.yaml": `{"type": "Document", "title": "Foo"}`},
+		"TestDaemonActionTooLarge")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	h, stop := setupWorkerHandler(root, ioutil.Discard, nil)
+	defer stop()
+	siteFoo, _ := h.Sites.Get("foo")
+	siteFoo.MaxRequestSize = 1024
+	h.Sites.Set(map[string]site{"foo": siteFoo}, "")
+	body := strings.NewReader("Locale=" + strings.Repeat("x", 2048))
+	r, _ := http.NewRequest("POST", "http://example.com/foo/@@set-locale", body)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Got status %v, should be %v", w.Code,
+			http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// usageReportPath is the path of the cached usage report in the data
+// directory.
+const usageReportPath = ".monsti/usage.json"
+
+// usageMaxAge is the age after which a cached usage report gets rebuilt.
+const usageMaxAge = time.Hour
+
+// usageLargestNodes is the number of nodes listed as the largest ones.
+const usageLargestNodes = 10
+
+// trashDir is the name of the directory holding removed nodes, which is
+// counted separately by usage reports.
+const trashDir = ".trash"
+
+// nodeUsage is the disk usage of a single node.
+type nodeUsage struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// Bytes is the size of the node's data files, excluding its children
+	// and revisions.
+	Bytes int64 `json:"bytes"`
+}
+
+// nodeUsageList sorts node usages by size, largest first.
+type nodeUsageList []nodeUsage
+
+// Len is the number of elements in the list.
+func (l nodeUsageList) Len() int {
+	return len(l)
+}
+
+// Less returns whether the element with index i should sort
+// before the element with index j.
+func (l nodeUsageList) Less(i, j int) bool {
+	if l[i].Bytes != l[j].Bytes {
+		return l[i].Bytes > l[j].Bytes
+	}
+	return l[i].Path < l[j].Path
+}
+
+// Swap swaps the elements with indexes i and j.
+func (l nodeUsageList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// usageReport is the content and disk usage of a site's data directory.
+type usageReport struct {
+	Site string `json:"site"`
+	// Created is the time the data directory has been walked.
+	Created time.Time `json:"created"`
+	// Nodes is the number of nodes and NodeTypes their number by type.
+	Nodes     int            `json:"nodes"`
+	NodeTypes map[string]int `json:"nodeTypes"`
+	// DataBytes is the total size of the nodes' files.
+	DataBytes int64 `json:"dataBytes"`
+	// Largest are the largest nodes.
+	Largest []nodeUsage `json:"largest"`
+	// RevisionBytes and TrashBytes are the total sizes of the revisions and
+	// of the trash.
+	RevisionBytes int64 `json:"revisionBytes"`
+	TrashBytes    int64 `json:"trashBytes"`
+	// Errors lists the files which could not be read.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// buildUsageReport walks the data directory located at the given root.
+//
+// Housekeeping directories like caches and indexes in .monsti and other
+// hidden files are skipped. Files which can't be read are listed in the
+// report's errors.
+func buildUsageReport(siteName, root string, now time.Time) *usageReport {
+	report := &usageReport{Site: siteName, Created: now,
+		NodeTypes: make(map[string]int), Largest: []nodeUsage{}}
+	dirBytes := make(map[string]int64)
+	var nodes []nodeUsage
+	filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(root, file)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %v", rel,
+				err))
+			return nil
+		}
+		var hidden string
+		for _, segment := range strings.Split(rel, "/") {
+			if strings.HasPrefix(segment, ".") && segment != "." {
+				hidden = segment
+				break
+			}
+		}
+		switch {
+		case hidden == revisionsDir:
+			if info.Mode().IsRegular() {
+				report.RevisionBytes += info.Size()
+			}
+			return nil
+		case hidden == trashDir:
+			if info.Mode().IsRegular() {
+				report.TrashBytes += info.Size()
+			}
+			return nil
+		case len(hidden) > 0:
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		nodePath := path.Clean("/" + path.Dir(rel))
+		report.DataBytes += info.Size()
+		dirBytes[nodePath] += info.Size()
+		if info.Name() != "node.yaml" {
+			return nil
+		}
+		stored, err := readStoredNode(root, nodePath)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %v", rel,
+				err))
+			return nil
+		}
+		report.Nodes++
+		report.NodeTypes[stored.Type]++
+		nodes = append(nodes, nodeUsage{Path: nodePath, Type: stored.Type})
+		return nil
+	})
+	for i := range nodes {
+		nodes[i].Bytes = dirBytes[nodes[i].Path]
+	}
+	sort.Sort(nodeUsageList(nodes))
+	if len(nodes) > usageLargestNodes {
+		nodes = nodes[:usageLargestNodes]
+	}
+	report.Largest = append(report.Largest, nodes...)
+	return report
+}
+
+// getUsageReport returns the usage report of the given site. A cached
+// report will be returned unless it's older than usageMaxAge or refresh is
+// true.
+func getUsageReport(site site, refresh bool, now time.Time) (*usageReport,
+	error) {
+	file := filepath.Join(site.Directories.Data, usageReportPath)
+	if !refresh {
+		if content, err := ioutil.ReadFile(file); err == nil {
+			var report usageReport
+			if json.Unmarshal(content, &report) == nil &&
+				now.Sub(report.Created) < usageMaxAge {
+				return &report, nil
+			}
+		}
+	}
+	report := buildUsageReport(site.Name, site.Directories.Data, now)
+	content, err := json.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal usage report: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, fmt.Errorf("Could not create usage report directory: %v",
+			err)
+	}
+	if err := writeFileAtomic(file, content, 0600); err != nil {
+		return nil, fmt.Errorf("Could not save usage report: %v", err)
+	}
+	return report, nil
+}
+
+// Usage handles requests to show the content and disk usage of the site.
+//
+// API requests get the report as JSON. The query parameter refresh
+// rebuilds a cached report.
+func (h *nodeHandler) Usage(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if node.Path != "/" {
+		h.renderError(w, r, "Page not found.", http.StatusNotFound, node,
+			cSession, site)
+		return
+	}
+	if r.Method != "GET" {
+		panic("Request method not supported: " + r.Method)
+	}
+	report, err := getUsageReport(site, len(r.URL.Query().Get("refresh")) > 0,
+		time.Now())
+	if err != nil {
+		panic("Can't get usage report: " + err.Error())
+	}
+	if isAPIRequest(r) {
+		writeJSON(w, report, http.StatusOK)
+		return
+	}
+	type nodeTypeRow struct {
+		Type  string
+		Nodes int
+	}
+	var types []string
+	for nodeType := range report.NodeTypes {
+		types = append(types, nodeType)
+	}
+	sort.Strings(types)
+	nodeTypes := make([]nodeTypeRow, 0, len(types))
+	for _, nodeType := range types {
+		nodeTypes = append(nodeTypes, nodeTypeRow{nodeType,
+			report.NodeTypes[nodeType]})
+	}
+	body := h.renderTemplate("daemon/actions/usage", template.Context{
+		"Report":    report,
+		"NodeTypes": nodeTypes}, cSession.Locale, site)
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: G("Disk usage"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+// usageCommand runs the usage command with the given arguments, writing
+// the reports as JSON to w.
+func usageCommand(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	siteName := flags.String("site", "", "Name of the site to report")
+	refresh := flags.Bool("refresh", false, "Rebuild cached reports")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: %v usage [--site=<site>] [--refresh]"+
+			" <config_directory>", filepath.Base(os.Args[0]))
+	}
+	settings, err := loadSettings(absConfigPath(flags.Arg(0)))
+	if err != nil {
+		return fmt.Errorf("Could not load settings: %v", err)
+	}
+	var names []string
+	for name := range settings.Sites {
+		if len(*siteName) == 0 || name == *siteName {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("Unknown site %q", *siteName)
+	}
+	sort.Strings(names)
+	reports := make([]*usageReport, 0, len(names))
+	for _, name := range names {
+		site := settings.Sites[name]
+		if len(site.Name) == 0 {
+			site.Name = name
+		}
+		report, err := getUsageReport(site, *refresh, time.Now())
+		if err != nil {
+			return fmt.Errorf("Could not get usage report of site %q: %v", name,
+				err)
+		}
+		reports = append(reports, report)
+	}
+	content, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal usage reports: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", content)
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildUsageReport(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml":                      `{"type": "Document"}`,
+		"/body.html":                      "12345",
+		"/foo/node.yaml":                  `{"type": "Image"}`,
+		"/foo/image.data":                 "1234567890",
+		"/foo/.revisions/index.yaml":      "123",
+		"/foo/bar/node.yaml":              `{"type": "Document"}`,
+		"/.trash/baz/node.yaml":           `{"type": "Document"}`,
+		"/.monsti/imgcache/foo/image.png": "cached",
+		"/locked/node.yaml":               `{"type": "Document"}`},
+		"TestBuildUsageReport")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	locked := filepath.Join(root, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatalf("Could not change permissions: %v", err)
+	}
+	defer os.Chmod(locked, 0700)
+	_, lockedErr := ioutil.ReadDir(locked)
+	now := time.Date(2014, 3, 10, 12, 30, 0, 0, time.UTC)
+	report := buildUsageReport("foo", root, now)
+	nodeYAML := int64(len(`{"type": "Document"}`))
+	imageYAML := int64(len(`{"type": "Image"}`))
+	largest := []nodeUsage{
+		{"/foo", "Image", imageYAML + 10},
+		{"/", "Document", nodeYAML + 5},
+		{"/foo/bar", "Document", nodeYAML}}
+	nodeTypes := map[string]int{"Document": 2, "Image": 1}
+	dataBytes := 2*nodeYAML + imageYAML + 15
+	if lockedErr == nil {
+		// Permissions are not enforced, e.g. if running as root.
+		largest = append(largest, nodeUsage{"/locked", "Document", nodeYAML})
+		nodeTypes["Document"]++
+		dataBytes += nodeYAML
+	} else if len(report.Errors) != 1 {
+		t.Errorf("Report should list the locked directory, got %v",
+			report.Errors)
+	}
+	if report.Site != "foo" || !report.Created.Equal(now) ||
+		report.Nodes != len(largest) ||
+		!reflect.DeepEqual(report.NodeTypes, nodeTypes) ||
+		!reflect.DeepEqual(report.Largest, largest) ||
+		report.DataBytes != dataBytes || report.RevisionBytes != 3 ||
+		report.TrashBytes != nodeYAML {
+		t.Errorf("buildUsageReport(...) = %+v", report)
+	}
+}
+
+func TestGetUsageReport(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.yaml": `{"type": "Document"}`}, "TestGetUsageReport")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := site{Name: "foo"}
+	site.Directories.Data = root
+	now := time.Date(2014, 3, 10, 12, 30, 0, 0, time.UTC)
+	if _, err := getUsageReport(site, false, now); err != nil {
+		t.Fatalf("getUsageReport(...) returned error: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "bar"), 0700); err != nil {
+		t.Fatalf("Could not create node: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "bar", "node.yaml"),
+		[]byte(`{"type": "Document"}`), 0600); err != nil {
+		t.Fatalf("Could not create node: %v", err)
+	}
+	tests := []struct {
+		Refresh bool
+		Age     time.Duration
+		Nodes   int
+	}{
+		{false, time.Minute, 1},
+		{true, time.Minute, 2},
+		{false, time.Minute, 2},
+		{false, 2 * usageMaxAge, 2}}
+	for i, v := range tests {
+		report, err := getUsageReport(site, v.Refresh, now.Add(v.Age))
+		if err != nil || report.Nodes != v.Nodes {
+			t.Errorf("Test %v: getUsageReport(...) = %+v, %v, should have %v"+
+				" nodes", i, report, err, v.Nodes)
+		}
+	}
+}
+
+func TestUsageCommand(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/monsti.yaml":                  `{}`,
+		"/sites/foo/site.yaml":          `{"hosts": ["foo.example.com"]}`,
+		"/sites/foo/data/node.yaml":     `{"type": "Document"}`,
+		"/sites/foo/data/bar/node.yaml": `{"type": "Document"}`,
+		"/sites/bar/site.yaml":          `{"hosts": ["bar.example.com"]}`,
+		"/sites/bar/data/node.yaml":     `{"type": "Document"}`},
+		"TestUsageCommand")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Args  []string
+		Sites []string
+	}{
+		{[]string{root}, []string{"bar", "foo"}},
+		{[]string{"--site=foo", "--refresh", root}, []string{"foo"}},
+		{[]string{"--site=unknown", root}, nil},
+		{[]string{}, nil}}
+	for i, v := range tests {
+		var out bytes.Buffer
+		err := usageCommand(&out, v.Args)
+		if v.Sites == nil {
+			if err == nil {
+				t.Errorf("Test %v: usageCommand(%v) should fail", i, v.Args)
+			}
+			continue
+		}
+		var reports []usageReport
+		if err != nil || json.Unmarshal(out.Bytes(), &reports) != nil {
+			t.Errorf("Test %v: usageCommand(%v) returned %q, %v", i, v.Args,
+				out.String(), err)
+			continue
+		}
+		var sites []string
+		for _, report := range reports {
+			sites = append(sites, report.Site)
+		}
+		if !reflect.DeepEqual(sites, v.Sites) {
+			t.Errorf("Test %v: usageCommand(%v) reported sites %v, should be %v",
+				i, v.Args, sites, v.Sites)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/form"
+	"github.com/monsti/rpc/client"
+	"github.com/monsti/util/l10n"
+	"github.com/monsti/util/template"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+)
+
+// primaryRole returns the built-in role of highest rank in the given roles.
+func primaryRole(roles []string) string {
+	ret := roleReader
+	for _, role := range roles {
+		if rank, ok := roleRanks[role]; ok && rank > roleRanks[ret] {
+			ret = role
+		}
+	}
+	return ret
+}
+
+// setPrimaryRole replaces the built-in roles of the given roles by the given
+// role. Custom roles are kept.
+func setPrimaryRole(roles []string, role string) []string {
+	ret := []string{role}
+	for _, r := range roles {
+		if _, ok := roleRanks[r]; !ok {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// hashPassword returns the bcrypt hash of the given password.
+//
+// cost is the bcrypt cost. Zero means bcrypt's default cost.
+func hashPassword(password string, cost int) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		panic("Could not hash password: " + err.Error())
+	}
+	return string(hash)
+}
+
+// passwordNeedsRehash returns true if the given password hash is not a
+// bcrypt hash of the given cost or more, e.g. because it has been created
+// by an older version using a lower cost.
+func passwordNeedsRehash(hash string, cost int) bool {
+	if cost < bcrypt.MinCost {
+		cost = bcrypt.DefaultCost
+	}
+	hashCost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || hashCost < cost
+}
+
+// rehashPassword replaces the password hash of the given user by a hash of
+// the given password using the given cost. Like any password change, this
+// invalidates the user's sessions. The given user will be updated to the
+// saved account.
+//
+// Does nothing if the user's hash has been changed in the meantime.
+func rehashPassword(configDir string, u *user, password string,
+	cost int) error {
+	defer lockUsers(configDir)()
+	users, err := loadUsers(configDir)
+	if err != nil {
+		return err
+	}
+	idx := findUser(users, u.Login)
+	if idx == -1 || users[idx].Password != u.Password {
+		return nil
+	}
+	users[idx].Password = hashPassword(password, cost)
+	users[idx].SessionVersion++
+	if err := saveUsers(configDir, users); err != nil {
+		return err
+	}
+	*u = users[idx]
+	return nil
+}
+
+// checkPasswordHashes writes the accounts of the given sites whose password
+// hashes need to be rehashed with the given cost to w.
+//
+// Returns the number of such accounts.
+func checkPasswordHashes(w io.Writer, sites map[string]site,
+	cost int) (int, error) {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	total := 0
+	for _, name := range names {
+		users, err := loadUsers(sites[name].Directories.Config)
+		if err != nil {
+			return total, fmt.Errorf("Site %v: %v", name, err)
+		}
+		var outdated []string
+		for _, user := range users {
+			if len(user.External) == 0 &&
+				passwordNeedsRehash(user.Password, cost) {
+				outdated = append(outdated, user.Login)
+			}
+		}
+		total += len(outdated)
+		fmt.Fprintf(w, "Site %v: %v of %v account(s) with outdated password"+
+			" hashes\n", name, len(outdated), len(users))
+		for _, login := range outdated {
+			fmt.Fprintf(w, "  %v\n", login)
+		}
+	}
+	return total, nil
+}
+
+// lastAdmin returns true if the user at the given index is the only enabled
+// administrator.
+func lastAdmin(users []user, idx int) bool {
+	if users[idx].Disabled || primaryRole(users[idx].GetRoles()) != roleAdmin {
+		return false
+	}
+	for i, u := range users {
+		if i != idx && !u.Disabled && primaryRole(u.GetRoles()) == roleAdmin {
+			return false
+		}
+	}
+	return true
+}
+
+// findUser returns the index of the user with the given login or -1.
+func findUser(users []user, login string) int {
+	for i, user := range users {
+		if user.Login == login {
+			return i
+		}
+	}
+	return -1
+}
+
+// Users handles requests to list the site's users.
+func (h *nodeHandler) Users(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site) {
+	G := l10n.UseCatalog(cSession.Locale)
+	if r.Method != "GET" {
+		panic("Request method not supported: " + r.Method)
+	}
+	users, err := loadUsers(site.Directories.Config)
+	if err != nil {
+		panic(err.Error())
+	}
+	type userEntry struct {
+		User *user
+		Role string
+	}
+	entries := make([]userEntry, 0, len(users))
+	for i := range users {
+		entries = append(entries, userEntry{&users[i],
+			primaryRole(users[i].GetRoles())})
+	}
+	body := h.renderTemplate("daemon/actions/users", template.Context{
+		"Users": entries, "UsersURL": site.URL(path.Join(node.Path, "@@users"))},
+		cSession.Locale,
+		site)
+	env := masterTmplEnv{Node: node, Session: cSession,
+		Flags: EDIT_VIEW, Title: G("Users"), Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+type userFormData struct {
+	Login, Name, Email, Role, Password string
+	CSRFToken                          string
+}
+
+// EditUser handles requests to add (if add is true) or edit users.
+//
+// The user to be edited is specified by the login query parameter.
+func (h *nodeHandler) EditUser(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site, add bool) {
+	G := l10n.UseCatalog(cSession.Locale)
+	defer lockUsers(site.Directories.Config)()
+	users, err := loadUsers(site.Directories.Config)
+	if err != nil {
+		panic(err.Error())
+	}
+	data := userFormData{Role: roleEditor}
+	idx := -1
+	if !add {
+		idx = findUser(users, r.URL.Query().Get("login"))
+		if idx == -1 {
+			h.renderError(w, r, "User not found.", http.StatusNotFound, node,
+				cSession, site)
+			return
+		}
+		data.Login = users[idx].Login
+		data.Name = users[idx].Name
+		data.Email = users[idx].Email
+		data.Role = primaryRole(users[idx].GetRoles())
+	}
+	roleOptions := []form.Option{
+		{roleReader, G("Reader")},
+		{roleEditor, G("Editor")},
+		{roleAdmin, G("Administrator")}}
+	passwordField := form.Field{G("Password"),
+		G("Leave empty to keep the current password."), nil,
+		new(form.PasswordWidget)}
+	if add {
+		passwordField = form.Field{G("Password"), "",
+			form.Required(G("Required.")), new(form.PasswordWidget)}
+	}
+	form := form.NewForm(&data, form.Fields{
+		"Login": form.Field{G("Login"), "", form.And(
+			form.Required(G("Required.")), form.Regex(`^[-.\w]+$`,
+				G("Contains	invalid characters."))), nil},
+		"Name": form.Field{G("Name"), "", form.Required(G("Required.")), nil},
+		"Email": form.Field{G("Email"), "", form.And(
+			form.Required(G("Required.")), form.Regex(`^[^@\s]+@[^@\s]+\.[^@\s]+$`,
+				G("Invalid email address."))), nil},
+		"Role": form.Field{G("Role"), "", form.Required(G("Required.")),
+			form.SelectWidget{roleOptions}},
+		"Password":  passwordField,
+		"CSRFToken": csrfField()})
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		if form.Fill(r.Form) {
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			if _, ok := roleRanks[data.Role]; !ok || data.Role == roleAnonymous {
+				form.AddError("Role", G("Invalid role."))
+				break
+			}
+			if other := findUser(users, data.Login); other != -1 && other != idx {
+				form.AddError("Login", G("This login is already taken."))
+				break
+			}
+			if !add && data.Role != roleAdmin && lastAdmin(users, idx) {
+				form.AddError("Role", G("The last administrator can't be demoted."))
+				break
+			}
+			if add {
+				users = append(users, user{})
+				idx = len(users) - 1
+			}
+			if len(data.Password) > 0 ||
+				data.Role != primaryRole(users[idx].GetRoles()) {
+				users[idx].SessionVersion++
+			}
+			users[idx].Login = data.Login
+			users[idx].Name = data.Name
+			users[idx].Email = data.Email
+			users[idx].Roles = setPrimaryRole(users[idx].Roles, data.Role)
+			if len(data.Password) > 0 {
+				users[idx].Password = hashPassword(data.Password,
+					h.currentSettings().Login.PasswordCost)
+			}
+			if err := saveUsers(site.Directories.Config, users); err != nil {
+				panic("Can't save user: " + err.Error())
+			}
+			http.Redirect(w, r, site.URL(path.Join(node.Path, "@@users")),
+				http.StatusSeeOther)
+			return
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	data.Password = ""
+	data.CSRFToken = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/userform", template.Context{
+		"Form": form.RenderData()}, cSession.Locale, site)
+	title := G("Add user")
+	if !add {
+		title = fmt.Sprintf(G("Edit user \"%v\""), users[idx].Login)
+	}
+	env := masterTmplEnv{Node: node, Session: cSession,
+		Flags: EDIT_VIEW, Title: title, Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
+
+type disableUserFormData struct {
+	CSRFToken string
+}
+
+// DisableUser handles requests to disable users or, if enable is set, to
+// enable disabled users again.
+//
+// The user to be disabled or enabled is specified by the login query
+// parameter. Disabled users are logged out immediately.
+func (h *nodeHandler) DisableUser(w http.ResponseWriter, r *http.Request,
+	node client.Node, session *sessions.Session, cSession *client.Session,
+	site site, enable bool) {
+	G := l10n.UseCatalog(cSession.Locale)
+	defer lockUsers(site.Directories.Config)()
+	users, err := loadUsers(site.Directories.Config)
+	if err != nil {
+		panic(err.Error())
+	}
+	idx := findUser(users, r.URL.Query().Get("login"))
+	if idx == -1 {
+		h.renderError(w, r, "User not found.", http.StatusNotFound, node,
+			cSession, site)
+		return
+	}
+	data := disableUserFormData{}
+	form := form.NewForm(&data, form.Fields{
+		"CSRFToken": csrfField()})
+	switch r.Method {
+	case "GET":
+	case "POST":
+		r.ParseForm()
+		if form.Fill(r.Form) {
+			if !validCSRFRequest(r, session, data.CSRFToken) {
+				form.AddError("", G("The form has expired. Please try again."))
+				break
+			}
+			if enable {
+				users[idx].Disabled = false
+			} else {
+				if lastAdmin(users, idx) {
+					form.AddError("", G("The last administrator can't be disabled."))
+					break
+				}
+				users[idx].Disabled = true
+				users[idx].SessionVersion++
+			}
+			if err := saveUsers(site.Directories.Config, users); err != nil {
+				panic("Can't save user: " + err.Error())
+			}
+			http.Redirect(w, r, site.URL(path.Join(node.Path, "@@users")),
+				http.StatusSeeOther)
+			return
+		}
+	default:
+		panic("Request method not supported: " + r.Method)
+	}
+	data.CSRFToken = getCSRFToken(session)
+	if err := session.Save(r, w); err != nil {
+		panic(err.Error())
+	}
+	body := h.renderTemplate("daemon/actions/disableuserform",
+		template.Context{"Form": form.RenderData(), "User": &users[idx],
+			"Enable":   enable,
+			"UsersURL": site.URL(path.Join(node.Path, "@@users"))},
+		cSession.Locale, site)
+	title := fmt.Sprintf(G("Disable user \"%v\""), users[idx].Login)
+	if enable {
+		title = fmt.Sprintf(G("Enable user \"%v\""), users[idx].Login)
+	}
+	env := masterTmplEnv{Node: node, Session: cSession, Flags: EDIT_VIEW,
+		Title: title, Access: requestNodeAccess(r)}
+	fmt.Fprint(w, renderInMaster(h.Renderer, []byte(body), env,
+		h.currentSettings(), site, cSession.Locale))
+}
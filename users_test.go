@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/bcrypt"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/monsti/rpc/client"
+	utesting "github.com/monsti/util/testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrimaryRole(t *testing.T) {
+	tests := []struct {
+		Roles []string
+		Role  string
+	}{
+		{nil, "reader"},
+		{[]string{"foo"}, "reader"},
+		{[]string{"reader", "editor"}, "editor"},
+		{[]string{"admin", "foo"}, "admin"}}
+	for _, v := range tests {
+		if ret := primaryRole(v.Roles); ret != v.Role {
+			t.Errorf("primaryRole(%v) = %q, should be %q", v.Roles, ret, v.Role)
+		}
+	}
+}
+
+func TestSetPrimaryRole(t *testing.T) {
+	tests := []struct {
+		Roles    []string
+		Role     string
+		Expected []string
+	}{
+		{nil, "editor", []string{"editor"}},
+		{[]string{"reader", "editor", "foo"}, "admin", []string{"admin", "foo"}}}
+	for _, v := range tests {
+		if ret := setPrimaryRole(v.Roles, v.Role); !reflect.DeepEqual(ret,
+			v.Expected) {
+			t.Errorf("setPrimaryRole(%v, %q) = %v, should be %v", v.Roles,
+				v.Role, ret, v.Expected)
+		}
+	}
+}
+
+func TestSaveUsers(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/users.yaml": "- login: foo\n  password: secret\n"}, "TestSaveUsers")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	users, err := loadUsers(root)
+	if err != nil {
+		t.Fatalf("loadUsers(_) failed: %v", err)
+	}
+	users = append(users, user{
+		User:     client.User{Login: "bar", Name: "Mrs. Bar"},
+		Roles:    []string{"editor"},
+		Disabled: true})
+	if err := saveUsers(root, users); err != nil {
+		t.Fatalf("saveUsers(_) failed: %v", err)
+	}
+	ret, err := loadUsers(root)
+	if err != nil || !reflect.DeepEqual(ret, users) {
+		t.Errorf("loadUsers(_) after saveUsers(_) = %v, %v, should be %v, nil",
+			ret, err, users)
+	}
+	if user := testUser(t, "bar", root); user == nil || !user.Disabled {
+		t.Errorf("getUser(\"bar\", _) = %v, should be disabled user", user)
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	tests := []struct {
+		Hash  string
+		Cost  int
+		Needs bool
+	}{
+		{hashPassword("foo", 4), 4, false},
+		{hashPassword("foo", 5), 4, false},
+		{hashPassword("foo", 4), 5, true},
+		{hashPassword("foo", 0), 0, false},
+		{hashPassword("foo", 4), 0, true},
+		{"", 0, true},
+		{"5f4dcc3b5aa765d61d8327deb882cf99", 4, true}}
+	for i, v := range tests {
+		if ret := passwordNeedsRehash(v.Hash, v.Cost); ret != v.Needs {
+			t.Errorf("Test %v: passwordNeedsRehash(%q, %v) = %v, should be %v",
+				i, v.Hash, v.Cost, ret, v.Needs)
+		}
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestRehashPassword")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	legacy := hashPassword("secret", 4)
+	users := []user{{User: client.User{Login: "foo", Password: legacy}},
+		{User: client.User{Login: "bar", Password: hashPassword("other", 4)}}}
+	if err := saveUsers(root, users); err != nil {
+		t.Fatalf("Could not save users: %v", err)
+	}
+	if !passwordEqual(legacy, "secret") || !passwordNeedsRehash(legacy, 5) {
+		t.Fatalf("Legacy hash should verify and need a rehash")
+	}
+	foo := users[0]
+	if err := rehashPassword(root, &foo, "secret", 5); err != nil {
+		t.Fatalf("rehashPassword(...) = %v", err)
+	}
+	upgraded := testUser(t, "foo", root)
+	if cost, err := bcrypt.Cost([]byte(upgraded.Password)); err != nil ||
+		cost != 5 || !passwordEqual(upgraded.Password, "secret") {
+		t.Errorf("Password hash of foo is %q, should be cost 5 hash of secret",
+			upgraded.Password)
+	}
+	if upgraded.SessionVersion != 1 || foo.Password != upgraded.Password ||
+		foo.SessionVersion != 1 {
+		t.Errorf("rehashPassword(...) should invalidate the sessions and update"+
+			" the user, got %+v", foo)
+	}
+	if other := testUser(t, "bar", root); other.Password != users[1].Password {
+		t.Errorf("Password hash of bar has been changed")
+	}
+	// A hash changed in the meantime must not be replaced.
+	stale := users[0]
+	if err := rehashPassword(root, &stale, "old", 6); err != nil ||
+		testUser(t, "foo", root).Password != upgraded.Password {
+		t.Errorf("rehashPassword(...) replaced changed hash: %v", err)
+	}
+}
+
+func TestRehashPasswordCorruptUsers(t *testing.T) {
+	corrupt := `[{"login": "foo"`
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/users.yaml": corrupt}, "TestRehashPasswordCorruptUsers")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := rehashPassword(root, &user{User: client.User{Login: "foo"}},
+		"secret", 4); err == nil {
+		t.Errorf("rehashPassword(...) with corrupt users file should fail")
+	}
+	file := filepath.Join(root, "users.yaml")
+	if content, _ := ioutil.ReadFile(file); string(content) != corrupt {
+		t.Errorf("Corrupt users file has been changed to %q", content)
+	}
+	if user, err := getUser("foo", root); err == nil || user != nil {
+		t.Errorf("getUser(...) with corrupt users file returned %v, %v", user,
+			err)
+	}
+	site_ := site{}
+	site_.Directories.Config = root
+	user, err := authenticate(site_, "foo", "secret")
+	if _, ok := err.(*authUnavailableError); !ok || user != nil {
+		t.Errorf("authenticate(...) with corrupt users file returned %v, %v,"+
+			" should refuse the login as unavailable", user, err)
+	}
+	session := sessions.NewSession(nil, "test")
+	session.Values["login"] = "foo"
+	cSession, roles, modified, err := getClientSession(session, site_,
+		time.Now())
+	if err == nil || cSession.User != nil || roles != nil || modified {
+		t.Errorf("getClientSession(...) with corrupt users file returned %v,"+
+			" %v, %v, %v, should be anonymous", cSession.User, roles, modified,
+			err)
+	}
+}
+
+func TestCheckPasswordHashes(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestCheckPasswordHashes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := saveUsers(root, []user{
+		{User: client.User{Login: "foo", Password: hashPassword("a", 4)}},
+		{User: client.User{Login: "bar", Password: hashPassword("b", 5)}},
+		{User: client.User{Login: "baz", Password: "plain"}}}); err != nil {
+		t.Fatalf("Could not save users: %v", err)
+	}
+	site_ := site{}
+	site_.Directories.Config = root
+	var out bytes.Buffer
+	count, err := checkPasswordHashes(&out, map[string]site{"foo": site_}, 5)
+	expected := "Site foo: 2 of 3 account(s) with outdated password hashes\n" +
+		"  foo\n  baz\n"
+	if err != nil || count != 2 || out.String() != expected {
+		t.Errorf("checkPasswordHashes(...) = %v, %v, output %q, should be 2,"+
+			" nil, output %q", count, err, out.String(), expected)
+	}
+}
+
+func TestEditUserSessionVersion(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestEditUserSessionVersion")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site_ := site{}
+	site_.Directories.Config = root
+	h := nodeHandler{Settings: &settings{}}
+	tests := []struct {
+		Role, Password string
+		Version        int
+	}{
+		{roleEditor, "", 0},
+		{roleEditor, "new", 1},
+		{roleAdmin, "", 1}}
+	for i, v := range tests {
+		if err := saveUsers(root, []user{{User: client.User{Login: "foo",
+			Password: hashPassword("old", 4)}, Roles: []string{roleEditor}}}); err != nil {
+			t.Fatalf("Could not save users: %v", err)
+		}
+		session := newTestSession(nil)
+		form := url.Values{
+			"Login":     {"foo"},
+			"Name":      {"Foo"},
+			"Email":     {"foo@example.com"},
+			"Role":      {v.Role},
+			"Password":  {v.Password},
+			"CSRFToken": {getCSRFToken(session)}}
+		r, _ := http.NewRequest("POST", "http://example.com/@@users/edit?login=foo",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.EditUser(w, r, client.Node{Path: "/"}, session, &client.Session{},
+			site_, false)
+		if foo := testUser(t, "foo", root); w.Code != http.StatusSeeOther ||
+			foo.SessionVersion != v.Version {
+			t.Errorf("Test %v: EditUser responded with %v, session version is"+
+				" %v, should be %v", i, w.Code, foo.SessionVersion, v.Version)
+		}
+	}
+}
+
+func TestEnableUser(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestEnableUser")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	if err := saveUsers(root, []user{
+		{User: client.User{Login: "admin"}, Roles: []string{roleAdmin}},
+		{User: client.User{Login: "foo"}, Roles: []string{roleEditor}}}); err != nil {
+		t.Fatalf("Could not save users: %v", err)
+	}
+	site_ := site{}
+	site_.Directories.Config = root
+	h := nodeHandler{Settings: &settings{}}
+	tests := []struct {
+		Enable   bool
+		Disabled bool
+		Version  int
+	}{
+		{false, true, 1},
+		{true, false, 1},
+		{true, false, 1}}
+	for i, v := range tests {
+		session := newTestSession(nil)
+		form := url.Values{"CSRFToken": {getCSRFToken(session)}}
+		r, _ := http.NewRequest("POST", "http://example.com/@@users/x?login=foo",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.DisableUser(w, r, client.Node{Path: "/"}, session, &client.Session{},
+			site_, v.Enable)
+		foo := testUser(t, "foo", root)
+		if w.Code != http.StatusSeeOther || foo.Disabled != v.Disabled ||
+			foo.SessionVersion != v.Version {
+			t.Errorf("Test %v: DisableUser(..., %v) responded with %v, user is"+
+				" %+v, should be disabled: %v, session version %v", i, v.Enable,
+				w.Code, foo, v.Disabled, v.Version)
+		}
+	}
+	if users, err := loadUsers(root); err != nil || users[0].Disabled {
+		t.Errorf("Other users should not be changed, got %v, %v", users, err)
+	}
+}
+
+func TestLastAdmin(t *testing.T) {
+	admin := user{Roles: []string{roleAdmin}}
+	legacyAdmin := user{}
+	disabledAdmin := user{Roles: []string{roleAdmin}, Disabled: true}
+	editor := user{Roles: []string{roleEditor}}
+	tests := []struct {
+		Users []user
+		Idx   int
+		Last  bool
+	}{
+		{[]user{admin, editor}, 0, true},
+		{[]user{admin, editor}, 1, false},
+		{[]user{admin, disabledAdmin}, 0, true},
+		{[]user{admin, disabledAdmin}, 1, false},
+		{[]user{admin, admin}, 0, false},
+		{[]user{legacyAdmin, editor}, 0, true},
+		{[]user{legacyAdmin, admin}, 0, false}}
+	for i, v := range tests {
+		if ret := lastAdmin(v.Users, v.Idx); ret != v.Last {
+			t.Errorf("Test %v: lastAdmin(...) = %v, should be %v", i, ret, v.Last)
+		}
+	}
+}
+
+func TestLockUsers(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/users.yaml": "[]"}, "TestLockUsers")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			external := &user{User: client.User{Login: fmt.Sprintf("user%v", i)},
+				External: "ldap"}
+			if _, err := syncShadowUser(root, external); err != nil {
+				t.Errorf("syncShadowUser(...) returned error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if users, err := loadUsers(root); err != nil || len(users) != 20 {
+		t.Errorf("Concurrent changes should be kept, got %v users (%v)",
+			len(users), err)
+	}
+}
@@ -1,5 +1,16 @@
 package main
 
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
 // inStringSlice checks if the string value is in the given string slice.
 func inStringSlice(value string, slice []string) bool {
 	for _, v := range slice {
@@ -9,3 +20,74 @@ func inStringSlice(value string, slice []string) bool {
 	}
 	return false
 }
+
+// paginate returns the current page and the number of pages for the given
+// number of items and items per page. It also returns the bounds of the
+// current page's items.
+//
+// page is the requested page number, defaulting to the first page if
+// invalid.
+func paginate(page string, count, size int) (current, pages, start, end int) {
+	current, _ = strconv.Atoi(page)
+	pages = (count + size - 1) / size
+	if current < 1 || current > pages {
+		current = 1
+	}
+	start = (current - 1) * size
+	end = start + size
+	if end > count {
+		end = count
+	}
+	if start > end {
+		start = end
+	}
+	return
+}
+
+// writeFileAtomic writes data to a file named by filename like
+// ioutil.WriteFile, but makes sure that readers either see the old or the
+// complete new content.
+//
+// Waits for snapshots of the directory containing the file, see lockWrites.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	defer lockWrites(filename)()
+	tmp, err := ioutil.TempFile(filepath.Dir(filename),
+		"."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// randomToken returns a new random token, e.g. to be used as CSRF or password
+// reset token.
+func randomToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Could not generate random token: " + err.Error())
+	}
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+// hashToken returns the hash of the given token, e.g. to store password reset
+// tokens or recovery codes.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -25,3 +28,51 @@ func TestInStringSlice(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	root, err := ioutil.TempDir("", "_monsti_TestWriteFileAtomic")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "foo.txt")
+	for _, content := range []string{"foo", "bar"} {
+		if err := writeFileAtomic(path, []byte(content), 0600); err != nil {
+			t.Fatalf("writeFileAtomic(...) failed: %v", err)
+		}
+		ret, err := ioutil.ReadFile(path)
+		if err != nil || string(ret) != content {
+			t.Errorf("Written file contains %q, %v, should be %q", ret, err,
+				content)
+		}
+	}
+	files, err := ioutil.ReadDir(root)
+	if err != nil || len(files) != 1 {
+		t.Errorf("Directory should only contain the written file, has %v, %v",
+			files, err)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		Page                       string
+		Count, Size                int
+		Current, Pages, Start, End int
+	}{
+		{"", 0, 10, 1, 0, 0, 0},
+		{"", 5, 10, 1, 1, 0, 5},
+		{"2", 25, 10, 2, 3, 10, 20},
+		{"3", 25, 10, 3, 3, 20, 25},
+		{"4", 25, 10, 1, 3, 0, 10},
+		{"foo", 25, 10, 1, 3, 0, 10},
+		{"-1", 25, 10, 1, 3, 0, 10}}
+	for i, v := range tests {
+		current, pages, start, end := paginate(v.Page, v.Count, v.Size)
+		if current != v.Current || pages != v.Pages || start != v.Start ||
+			end != v.End {
+			t.Errorf("Test %v: paginate(%q, %v, %v) = %v, %v, %v, %v, should be"+
+				" %v, %v, %v, %v", i, v.Page, v.Count, v.Size, current, pages, start,
+				end, v.Current, v.Pages, v.Start, v.End)
+		}
+	}
+}
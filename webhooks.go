@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Content change events sent to webhooks.
+const (
+	eventNodeWritten     = "node.written"
+	eventNodeRemoved     = "node.removed"
+	eventNodeDataWritten = "node.data-written"
+)
+
+// webhookAttempts is the number of delivery attempts of webhook requests.
+const webhookAttempts = 3
+
+// webhookBackoff is the delay before the second delivery attempt. It doubles
+// for each further attempt.
+var webhookBackoff = 2 * time.Second
+
+// webhookClient is the HTTP client used to deliver webhook requests.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhook is the configuration of a webhook.
+type webhook struct {
+	// URL to POST the events to.
+	URL string
+	// Secret is used to sign the requests. The signature is sent in the
+	// X-Monsti-Signature header as sha256=<hex encoded HMAC-SHA256 of the
+	// body>.
+	Secret string
+	// Events to be sent, e.g. node.written, node.removed or
+	// node.data-written. All events will be sent if empty.
+	Events []string
+}
+
+// webhookEvent is the payload of webhook requests.
+type webhookEvent struct {
+	Event string `json:"event"`
+	Site  string `json:"site"`
+	Path  string `json:"path"`
+	User  string `json:"user,omitempty"`
+	// Time of the event in RFC 3339 format.
+	Time string `json:"time"`
+}
+
+// webhookSignature returns the value of the signature header for the given
+// body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryRequest sends the request returned by newRequest using the given
+// client until it succeeds, at most the given number of attempts. The delay
+// before the second attempt is backoff, doubling for each further attempt.
+//
+// Responses with a 2xx status and, if accepted returns true, the given
+// status are successful.
+func retryRequest(client *http.Client, attempts int, backoff time.Duration,
+	newRequest func() (*http.Request, error), accepted func(int) bool) error {
+	var err error
+	delay := backoff
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var req *http.Request
+		req, err = newRequest()
+		if err != nil {
+			return err
+		}
+		var res *http.Response
+		res, err = client.Do(req)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode >= 200 && res.StatusCode < 300 ||
+			accepted != nil && accepted(res.StatusCode) {
+			return nil
+		}
+		err = fmt.Errorf("Got status %v", res.Status)
+	}
+	return fmt.Errorf("Giving up after %v attempts: %v", attempts, err)
+}
+
+// deliverWebhook sends the given payload to the webhook, retrying failed
+// attempts.
+func deliverWebhook(hook webhook, payload []byte) error {
+	return retryRequest(webhookClient, webhookAttempts, webhookBackoff,
+		func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", hook.URL,
+				bytes.NewReader(payload))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if len(hook.Secret) > 0 {
+				req.Header.Set("X-Monsti-Signature",
+					webhookSignature(hook.Secret, payload))
+			}
+			return req, nil
+		}, nil)
+}
+
+// dataWritten updates the recent changes, the search index and the audit log
+// and notifies the webhooks after the given data file of the node at the
+// given path has been written by the user with the given login.
+func dataWritten(site site, nodePath, file, login, action string,
+	logf func(format string, v ...interface{})) {
+	root := site.Directories.Data
+	invalidateCache(root, nodePath)
+	recordChange(root, nodeChange(root, nodePath, login))
+	if file == searchBodyFile || file == "node.yaml" {
+		indexNode(root, nodePath)
+	}
+	auditChange(site, login, action, nodePath, file, logf)
+	fireWebhooks(site, eventNodeDataWritten, nodePath, login, logf)
+}
+
+// fireWebhooks asynchronously sends the given event of the given node to the
+// site's webhooks and purges the node from external caches, see purgeNode.
+//
+// Failed deliveries will be reported to logf.
+func fireWebhooks(site site, event, nodePath, login string,
+	logf func(format string, v ...interface{})) {
+	purgeNode(site, nodePath, logf)
+	payload, err := json.Marshal(webhookEvent{
+		Event: event,
+		Site:  site.Name,
+		Path:  nodePath,
+		User:  login,
+		Time:  time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		panic("Could not marshal webhook event: " + err.Error())
+	}
+	for _, hook := range site.Webhooks {
+		if len(hook.Events) > 0 && !inStringSlice(event, hook.Events) {
+			continue
+		}
+		go func(hook webhook) {
+			if err := deliverWebhook(hook, payload); err != nil {
+				logf("Could not deliver %v event of %q to webhook %v: %v", event,
+					nodePath, hook.URL, err)
+			}
+		}(hook)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFireWebhooks(t *testing.T) {
+	type request struct {
+		Signature string
+		Body      []byte
+	}
+	requests := make(chan request, 10)
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if failures > 0 {
+				failures--
+				http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			requests <- request{r.Header.Get("X-Monsti-Signature"), body}
+		}))
+	defer server.Close()
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(
+		webhookBackoff)
+	webhookBackoff = time.Millisecond
+	site := site{Name: "FooSite", Webhooks: []webhook{
+		{URL: server.URL, Secret: "secret"},
+		{URL: server.URL + "/removed", Events: []string{eventNodeRemoved}}}}
+	logf := func(format string, v ...interface{}) {
+		t.Errorf("Unexpected delivery failure: "+format, v...)
+	}
+	fireWebhooks(site, eventNodeWritten, "/foo", "editor", logf)
+	var req request
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Webhook has not been called")
+	}
+	if expected := webhookSignature("secret", req.Body); req.Signature !=
+		expected {
+		t.Errorf("Signature is %q, should be %q", req.Signature, expected)
+	}
+	var event map[string]string
+	if err := json.Unmarshal(req.Body, &event); err != nil {
+		t.Fatalf("Payload is not valid JSON: %v", err)
+	}
+	if _, err := time.Parse(time.RFC3339, event["time"]); err != nil {
+		t.Errorf("Invalid time %q: %v", event["time"], err)
+	}
+	delete(event, "time")
+	expected := map[string]string{"event": eventNodeWritten, "site": "FooSite",
+		"path": "/foo", "user": "editor"}
+	if len(event) != len(expected) {
+		t.Errorf("Payload is %v, should be %v", event, expected)
+	}
+	for key, value := range expected {
+		if event[key] != value {
+			t.Errorf("Payload is %v, should be %v", event, expected)
+		}
+	}
+	select {
+	case req = <-requests:
+		t.Errorf("Filtered webhook has been called with %s", req.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeliverWebhookFailure(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+		}))
+	defer server.Close()
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(
+		webhookBackoff)
+	webhookBackoff = time.Millisecond
+	if err := deliverWebhook(webhook{URL: server.URL}, []byte("{}")); err == nil {
+		t.Errorf("deliverWebhook should fail")
+	}
+	if calls != webhookAttempts {
+		t.Errorf("Webhook has been called %v times, should be %v", calls,
+			webhookAttempts)
+	}
+}
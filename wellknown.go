@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultWellKnownPaths are the paths served by serveWellKnown in addition
+// to the ones listed in the settings.
+var defaultWellKnownPaths = []string{
+	"/favicon.ico",
+	"/apple-touch-icon.png",
+	"/apple-touch-icon-precomposed.png"}
+
+// wellKnownCacheControl is the Cache-Control header of well-known files.
+const wellKnownCacheControl = "public, max-age=86400"
+
+// isWellKnownPath returns true if the given URL path is served by
+// serveWellKnown.
+func (h *nodeHandler) isWellKnownPath(urlPath string) bool {
+	return inStringSlice(urlPath, defaultWellKnownPaths) ||
+		inStringSlice(urlPath, h.currentSettings().WellKnownPaths)
+}
+
+// wellKnownFile returns the file to be served for the given well-known
+// path of the given site, or an empty string if there is none.
+//
+// The file is looked up in the site's static directory, in the root of the
+// site's data directory and, e.g. for a default favicon shipped with the
+// daemon, in the shared static directory.
+func wellKnownFile(settings *settings, site site, urlPath string) string {
+	name := filepath.FromSlash(strings.TrimPrefix(path.Clean(urlPath), "/"))
+	var candidates []string
+	if len(site.Directories.Statics) > 0 {
+		candidates = append(candidates,
+			filepath.Join(site.Directories.Statics, name))
+	}
+	if file, err := nodeFile(site.Directories.Data, "/",
+		filepath.ToSlash(name)); err == nil {
+		candidates = append(candidates, file)
+	}
+	if len(settings.Directories.Statics) > 0 {
+		candidates = append(candidates,
+			filepath.Join(settings.Directories.Statics, name))
+	}
+	for _, file := range candidates {
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			return file
+		}
+	}
+	return ""
+}
+
+// serveWellKnown serves requests for well-known paths like /favicon.ico
+// which browsers request on their own, see isWellKnownPath.
+//
+// The requests are answered without session and without being logged.
+// Returns false if the request is not for a well-known path.
+func (h *nodeHandler) serveWellKnown(w http.ResponseWriter,
+	r *http.Request) bool {
+	if !h.isWellKnownPath(r.URL.Path) {
+		return false
+	}
+	site, ok := h.Sites.Lookup(r.Host)
+	if !ok {
+		http.NotFound(w, r)
+		return true
+	}
+	setSecurityHeaders(w.Header(), site, "")
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return true
+	}
+	file := wellKnownFile(h.currentSettings(), site, r.URL.Path)
+	if len(file) == 0 {
+		http.NotFound(w, r)
+		return true
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	w.Header().Set("Cache-Control", wellKnownCacheControl)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"github.com/monsti/monsti-daemon/worker"
+	utesting "github.com/monsti/util/testing"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeWellKnown(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/data/node.yaml":                `{"type": "Document"}`,
+		"/data/apple-touch-icon.png":     "data icon",
+		"/data/.well-known/security.txt": "Contact: foo@example.com",
+		"/site-static/favicon.ico":       "site icon",
+		"/static/favicon.ico":            "default icon",
+		"/static/apple-touch-icon.png":   "default touch icon",
+		"/static/other.png":              ""}, "TestServeWellKnown")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Method, Path string
+		NoSiteIcon   bool
+		Status       int
+		Body         string
+	}{
+		{"GET", "/favicon.ico", false, http.StatusOK, "site icon"},
+		{"GET", "/favicon.ico", true, http.StatusOK, "default icon"},
+		{"HEAD", "/favicon.ico", false, http.StatusOK, ""},
+		{"POST", "/favicon.ico", false, http.StatusMethodNotAllowed, ""},
+		{"GET", "/apple-touch-icon.png", false, http.StatusOK, "data icon"},
+		{"GET", "/apple-touch-icon-precomposed.png", false,
+			http.StatusNotFound, ""},
+		{"GET", "/.well-known/security.txt", false, http.StatusOK,
+			"Contact: foo@example.com"}}
+	for i, v := range tests {
+		var logBuf bytes.Buffer
+		h, stop := setupWorkerHandler(filepath.Join(root, "data"), &logBuf,
+			func(worker.Ticket) {
+				t.Errorf("Test %v: Got ticket", i)
+			})
+		h.Settings.Directories.Statics = filepath.Join(root, "static")
+		h.Settings.WellKnownPaths = []string{"/.well-known/security.txt"}
+		site_, _ := h.Sites.Get("foo")
+		if !v.NoSiteIcon {
+			site_.Directories.Statics = filepath.Join(root, "site-static")
+		}
+		h.Sites = newSiteRegistry(map[string]site{"foo": site_}, "")
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(v.Method, "http://example.com"+v.Path, nil)
+		h.ServeHTTP(w, r)
+		stop()
+		if w.Code != v.Status {
+			t.Errorf("Test %v: %v %v got status %v, should be %v", i, v.Method,
+				v.Path, w.Code, v.Status)
+		}
+		if v.Status == http.StatusOK {
+			if body := w.Body.String(); body != v.Body {
+				t.Errorf("Test %v: %v %v got %q, should be %q", i, v.Method,
+					v.Path, body, v.Body)
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != wellKnownCacheControl {
+				t.Errorf("Test %v: Cache-Control is %q", i, cc)
+			}
+		}
+		if cookie := w.Header().Get("Set-Cookie"); len(cookie) > 0 {
+			t.Errorf("Test %v: %v %v set a cookie: %q", i, v.Method, v.Path,
+				cookie)
+		}
+		if logBuf.Len() > 0 {
+			t.Errorf("Test %v: %v %v has been logged: %q", i, v.Method, v.Path,
+				logBuf.String())
+		}
+	}
+}
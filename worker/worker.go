@@ -1,16 +1,26 @@
 package worker
 
 import (
+	"bytes"
 	"github.com/monsti/rpc/client"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/rpc"
+	"net/url"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ProtocolVersion is the version of the protocol spoken between the daemon
+// and the workers. Workers announce their version with the Handshake RPC
+// method; those having another major version will be refused.
+const ProtocolVersion = "1.0"
+
 // Ticket represents an incoming request to be processed by the worker.
 type Ticket struct {
 	// Site being served.
@@ -20,11 +30,61 @@ type Ticket struct {
 	// Request is the original HTTP request.
 	Request *http.Request
 	// ResponseChan is a channel over which the built respsonse can be send
-	// back to the client.
+	// back to the client. It must be buffered as the response gets sent
+	// while holding the worker's mutex, see Respond.
 	ResponseChan chan client.Response
 	Session      client.Session
+	// Roles of the session's user.
+	Roles []string
 	// Action as specified in the URL (/path/to/node/@@some_action).
 	Action string
+	// ClientIP is the IP address of the client.
+	ClientIP string
+	// Scheme used by the client, i.e. http or https.
+	Scheme string
+	// RequestID identifies the request in the logs of the daemon and the
+	// workers.
+	RequestID string
+	// TraceParent is the W3C traceparent of traced requests to be used as
+	// parent by the worker's spans. Empty if the request is not traced.
+	TraceParent string
+	// CSRFToken is the token to be included in forms rendered by the worker.
+	CSRFToken string
+	// CSRFTokenUsed gets set to 1 when the worker fetched CSRFToken, e.g.
+	// to store a new token in the session only if a form uses it. May be
+	// nil. Must be accessed atomically.
+	CSRFTokenUsed *int32
+	// Form holds the form values of non-idempotent requests, captured
+	// before queueing the ticket.
+	Form url.Values
+	// Files maps form fields to the temporary files holding the files
+	// uploaded with them. The files will be removed after the response has
+	// been written.
+	Files map[string][]string
+	// Deadline is the time after which the daemon stops waiting for the
+	// response, derived from the node type's timeout. Zero if there is no
+	// timeout. Workers may get it with the GetDeadline RPC method to abort
+	// long running requests early.
+	Deadline time.Time
+	// Done gets closed when the daemon stopped waiting for the response,
+	// e.g. because the client went away. May be nil.
+	Done chan struct{}
+	// Received gets closed when a worker picked up the ticket. May be nil.
+	Received chan struct{}
+	// Parent is the ticket of the request which issued this sub-request.
+	// nil for tickets of HTTP requests.
+	Parent *Ticket
+}
+
+// Expired returns true if the daemon stopped or will stop waiting for the
+// response to the ticket at the given time.
+func (t *Ticket) Expired(now time.Time) bool {
+	select {
+	case <-t.Done:
+		return true
+	default:
+	}
+	return !t.Deadline.IsZero() && !now.Before(t.Deadline)
 }
 
 // pipeConnection is a bidirectional pipe to a worker process used for RPC
@@ -39,21 +99,59 @@ func (pipe pipeConnection) Close() (err error) {
 	return nil
 }
 
-// workerLog is a Writer used to log incoming worker errors.
+// Read reads from the worker process and marks the worker alive if it sent
+// anything.
+func (pipe pipeConnection) Read(p []byte) (int, error) {
+	n, err := pipe.ReadCloser.Read(p)
+	if n > 0 {
+		pipe.Worker.Alive()
+	}
+	return n, err
+}
+
+// workerLog is a Writer used to log the output of the worker process line by
+// line.
 type workerLog struct {
-	Type string
-	Log  *log.Logger
+	// Prefix is prepended to each logged line.
+	Prefix string
+	Log    *log.Logger
+	mutex  sync.Mutex
+	buf    []byte
 }
 
-func (w workerLog) Write(p []byte) (int, error) {
-	log.Println(w.Type, "on stderr:", string(p))
+// Write logs all complete lines of the written data. Incomplete lines are
+// buffered until completed or flushed.
+func (w *workerLog) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			break
+		}
+		w.Log.Println(w.Prefix, string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
 	return len(p), nil
 }
 
+// Flush logs any buffered incomplete line.
+func (w *workerLog) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.buf) > 0 {
+		w.Log.Println(w.Prefix, string(w.buf))
+	}
+	w.buf = nil
+}
+
 // Worker represents a process which communicates via RPC over a bidirectional
 // pipe with Monsti to process incoming requests for some node type.
 type Worker struct {
-	// The currently processed ticket (if any).
+	// The currently processed ticket (if any). It's cleared when the worker
+	// dies, so it must be accessed using CurrentTicket, SetTicket and
+	// Respond.
 	Ticket *Ticket
 	// Tickets is the channel where new tickets can be fetched.
 	Tickets chan Ticket
@@ -63,26 +161,72 @@ type Worker struct {
 	cmd *exec.Cmd
 	// Pipe to the worker process.
 	pipe *pipeConnection
+	// Logs the stderr output of the worker process.
+	stderr *workerLog
 	// Receiver for RPC.
 	rcvr interface{}
 	// Log is the logger used by the Worker.
 	Log *log.Logger
+	// mutex protects alive and Ticket.
+	mutex sync.Mutex
+	// alive is true if the worker communicated since the last check of the
+	// watchdog.
+	alive bool
+	// dead gets closed after the worker process died.
+	dead chan struct{}
+}
+
+// Command describes how to start a worker process.
+type Command struct {
+	// Path of the worker's executable. It will be looked up in the
+	// directories of the PATH environment variable if it contains no slash.
+	Path string
+	// Args are the command line arguments of the worker.
+	Args []string
+	// Env holds additional environment variables of the worker in the form
+	// "key=value".
+	Env []string
+	// Dir is the working directory of the worker. Defaults to the daemon's
+	// working directory.
+	Dir string
+}
+
+// String returns the command line of the command, including the names of
+// its environment variables. Their values are left out as they may contain
+// secrets.
+func (c Command) String() string {
+	parts := make([]string, 0, len(c.Env)+len(c.Args)+1)
+	for _, variable := range c.Env {
+		parts = append(parts, strings.SplitN(variable, "=", 2)[0]+"=...")
+	}
+	parts = append(parts, c.Path)
+	parts = append(parts, c.Args...)
+	for i, part := range parts {
+		if len(part) == 0 || strings.ContainsAny(part, " \t\n\"'\\$") {
+			parts[i] = fmt.Sprintf("%q", part)
+		}
+	}
+	return strings.Join(parts, " ")
 }
 
 // NewWorker creates a new worker for the node type that fetches new tickets
 // from the given channele.
 //
-// The worker process fetches its configuration from the given configuration
-// directory. RPC methods are provided to the worker process by the given
-// receiver.
-func NewWorker(nodeType string, tickets chan Ticket, rcvr interface{},
-	configDir string, logger *log.Logger) (w *Worker) {
+// The worker process will be started using the given command. RPC methods
+// are provided to the worker process by the given receiver.
+func NewWorker(nodeType string, command Command, tickets chan Ticket,
+	rcvr interface{}, logger *log.Logger) (w *Worker) {
 	w = &Worker{
 		Tickets:  tickets,
 		NodeType: nodeType,
 		rcvr:     rcvr,
-		Log:      logger}
-	w.cmd = exec.Command(strings.ToLower(nodeType), configDir)
+		Log:      logger,
+		dead:     make(chan struct{})}
+	w.cmd = exec.Command(command.Path, command.Args...)
+	if len(command.Env) > 0 {
+		w.cmd.Env = append(os.Environ(), command.Env...)
+	}
+	w.cmd.Dir = command.Dir
 	return
 }
 
@@ -99,7 +243,8 @@ func (w *Worker) Run(callback func()) error {
 		return fmt.Errorf("Could not setup stdin pipe of worker: %v",
 			err.Error())
 	}
-	w.cmd.Stderr = workerLog{w.NodeType, w.Log}
+	w.stderr = &workerLog{Prefix: "[" + w.NodeType + "]", Log: w.Log}
+	w.cmd.Stderr = w.stderr
 	w.pipe = &pipeConnection{inPipe, outPipe, w}
 	err = w.cmd.Start()
 	if err != nil {
@@ -114,19 +259,122 @@ func (w *Worker) Run(callback func()) error {
 	go server.ServeConn(w.pipe)
 	go func() {
 		w.cmd.Wait()
-		w.Log.Println("Worker process died.")
+		close(w.dead)
+		w.stderr.Flush()
+		w.Log.Println(w.stderr.Prefix, "Worker process died.")
 		w.postMortem()
 		callback()
 	}()
 	return nil
 }
 
+// Alive marks the worker as alive, e.g. after it communicated with the
+// daemon or received a ticket.
+func (w *Worker) Alive() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.alive = true
+}
+
+// SetTicket sets the currently processed ticket, or nil if the worker
+// finished processing it.
+func (w *Worker) SetTicket(ticket *Ticket) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.Ticket = ticket
+}
+
+// CurrentTicket returns the currently processed ticket, or nil if the
+// worker holds none.
+func (w *Worker) CurrentTicket() *Ticket {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.Ticket
+}
+
+// Respond sends the given response for the currently processed ticket and
+// clears it. Returns false if the worker holds no ticket, e.g. because it
+// died meanwhile and its ticket's ResponseChan got closed.
+func (w *Worker) Respond(res client.Response) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.Ticket == nil {
+		return false
+	}
+	w.Ticket.ResponseChan <- res
+	w.Ticket = nil
+	return true
+}
+
+// busy returns true if the worker holds a ticket.
+func (w *Worker) busy() bool {
+	return w.CurrentTicket() != nil
+}
+
+// checkAlive returns true if the worker has been marked alive since the
+// last check.
+func (w *Worker) checkAlive() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	alive := w.alive
+	w.alive = false
+	return alive
+}
+
+// Watch starts a watchdog which kills the worker process if it has pending
+// work but didn't communicate for maxMisses intervals. The callback given
+// to Run will be called as usual.
+//
+// The worker has pending work if it holds a ticket or if the given
+// function returns true, i.e. if tickets are waiting in the queue. The
+// function killed gets called before the process will be killed. The
+// watchdog stops when the process dies.
+func (w *Worker) Watch(interval time.Duration, maxMisses int,
+	pending func() bool, killed func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		misses := 0
+		for {
+			select {
+			case <-w.dead:
+				return
+			case <-ticker.C:
+			}
+			if w.checkAlive() || !w.busy() && !pending() {
+				misses = 0
+				continue
+			}
+			misses++
+			if misses >= maxMisses {
+				killed()
+				if err := w.Kill(); err != nil {
+					w.Log.Println(w.stderr.Prefix, "Could not kill worker:", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Kill kills the worker process. The callback given to Run will be called
+// as usual.
+func (w *Worker) Kill() error {
+	if w.cmd.Process == nil {
+		return fmt.Errorf("Worker process has not been started")
+	}
+	return w.cmd.Process.Kill()
+}
+
 // postMortem gets called after the worker process died. It performs some
 // cleanup actions.
 func (w *Worker) postMortem() {
-	if w.cmd.ProcessState == nil || !w.cmd.ProcessState.Exited() {
+	// ProcessState is set once the process exited or got killed.
+	if w.cmd.ProcessState == nil {
 		panic("worker: postMortem() called on living worker")
 	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	if w.Ticket != nil {
 		close(w.Ticket.ResponseChan)
 	}
@@ -1,12 +1,12 @@
 package worker
 
 import (
+	"bytes"
 	"github.com/monsti/rpc/client"
 	"io"
 	"log"
 	"net/rpc"
 	"os"
-	"os/exec"
 	"testing"
 	"time"
 )
@@ -18,7 +18,7 @@ type TestRPC struct {
 
 func (t *TestRPC) Foo(arg int, ret *int) error {
 	ticket := <-t.Tickets
-	t.Worker.Ticket = &ticket
+	t.Worker.SetTicket(&ticket)
 	return nil
 }
 
@@ -26,10 +26,10 @@ func TestProcessDead(t *testing.T) {
 	rpc := &TestRPC{
 		Tickets: make(chan Ticket)}
 	logger := log.New(os.Stderr, "", log.LstdFlags)
-	worker := NewWorker("true", rpc.Tickets, rpc, "", logger)
+	worker := NewWorker("Dummy", Command{Path: os.Args[0],
+		Args: []string{"-test.run", "TestDummyWorker"},
+		Env:  []string{"GO_WANT_DUMMY_WORKER=1"}}, rpc.Tickets, rpc, logger)
 	rpc.Worker = worker
-	worker.cmd = exec.Command(os.Args[0], "-test.run", "TestDummyWorker")
-	worker.cmd.Env = append([]string{"GO_WANT_DUMMY_WORKER=1"}, os.Environ()...)
 	callbackCalled := false
 	err := worker.Run(func() { callbackCalled = true })
 	if err != nil {
@@ -61,7 +61,8 @@ func (pipe pipe) Close() (err error) {
 }
 
 func TestDummyWorker(t *testing.T) {
-	if os.Getenv("GO_WANT_DUMMY_WORKER") != "1" {
+	mode := os.Getenv("GO_WANT_DUMMY_WORKER")
+	if mode == "" {
 		return
 	}
 	pipe := &pipe{os.Stdin, os.Stdout}
@@ -71,4 +72,126 @@ func TestDummyWorker(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
+	if mode == "wedged" {
+		// Stop answering while holding the ticket.
+		select {}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	rpc := &TestRPC{
+		Tickets: make(chan Ticket)}
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+	worker := NewWorker("Dummy", Command{Path: os.Args[0],
+		Args: []string{"-test.run", "TestDummyWorker"},
+		Env:  []string{"GO_WANT_DUMMY_WORKER=wedged"}}, rpc.Tickets, rpc, logger)
+	rpc.Worker = worker
+	died := make(chan bool)
+	if err := worker.Run(func() { died <- true }); err != nil {
+		t.Fatal(err.Error())
+	}
+	killed := make(chan bool, 1)
+	worker.Watch(10*time.Millisecond, 3, func() bool { return false },
+		func() { killed <- true })
+	ticket := Ticket{
+		ResponseChan: make(chan client.Response)}
+	worker.Tickets <- ticket
+	select {
+	case _, ok := <-ticket.ResponseChan:
+		if ok {
+			t.Error("Response chan should be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the wedged worker to be killed")
+	}
+	select {
+	case <-killed:
+	default:
+		t.Error("Killed callback has not been called")
+	}
+	select {
+	case <-died:
+	case <-time.After(time.Second):
+		t.Error("Callback of Run has not been called")
+	}
+}
+
+func TestRespond(t *testing.T) {
+	w := &Worker{}
+	if w.Respond(client.Response{}) {
+		t.Error("Respond should fail without a ticket")
+	}
+	ticket := Ticket{ResponseChan: make(chan client.Response, 1)}
+	w.SetTicket(&ticket)
+	if !w.Respond(client.Response{Body: []byte("Foo")}) {
+		t.Fatal("Respond failed")
+	}
+	if res := <-ticket.ResponseChan; string(res.Body) != "Foo" {
+		t.Errorf("Response body is %q, should be \"Foo\"", res.Body)
+	}
+	if w.CurrentTicket() != nil {
+		t.Error("Respond should clear the ticket")
+	}
+	if w.Respond(client.Response{}) {
+		t.Error("Respond should fail for already answered tickets")
+	}
+}
+
+func TestWorkerLog(t *testing.T) {
+	var buf bytes.Buffer
+	w := workerLog{Prefix: "[monsti-foo]", Log: log.New(&buf, "", 0)}
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\nincomplete"))
+	expected := "[monsti-foo] first line\n[monsti-foo] second line\n"
+	if buf.String() != expected {
+		t.Errorf("Logged %q, should be %q", buf.String(), expected)
+	}
+	w.Flush()
+	expected += "[monsti-foo] incomplete\n"
+	if buf.String() != expected {
+		t.Errorf("Logged %q after Flush(), should be %q", buf.String(), expected)
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	tests := []struct {
+		Command Command
+		String  string
+	}{
+		{Command{Path: "monsti-document", Args: []string{"/etc/monsti"}},
+			"monsti-document /etc/monsti"},
+		{Command{Path: "/usr/bin/monsti-document",
+			Args: []string{"/etc/monsti", "--name", "Foo Bar", ""},
+			Env:  []string{"API=http://staging", "GOGC=50"}},
+			`API=... GOGC=... /usr/bin/monsti-document /etc/monsti` +
+				` --name "Foo Bar" ""`},
+		{Command{Path: "monsti-document",
+			Env: []string{"TOKEN=secret value", "EMPTY"}},
+			"TOKEN=... EMPTY=... monsti-document"}}
+	for i, v := range tests {
+		if ret := v.Command.String(); ret != v.String {
+			t.Errorf("Test %v: String() = %q, should be %q", i, ret, v.String)
+		}
+	}
+}
+
+func TestTicketExpired(t *testing.T) {
+	now := time.Now()
+	done := make(chan struct{})
+	close(done)
+	tests := []struct {
+		Ticket  Ticket
+		Expired bool
+	}{
+		{Ticket{}, false},
+		{Ticket{Deadline: now.Add(time.Second)}, false},
+		{Ticket{Deadline: now}, true},
+		{Ticket{Done: make(chan struct{})}, false},
+		{Ticket{Done: done, Deadline: now.Add(time.Second)}, true}}
+	for i, v := range tests {
+		if ret := v.Ticket.Expired(now); ret != v.Expired {
+			t.Errorf("Test %v: Expired() = %v, should be %v", i, ret, v.Expired)
+		}
+	}
 }